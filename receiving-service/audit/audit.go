@@ -0,0 +1,164 @@
+// Package audit records an event for each request the receiving service
+// authenticates: who called, with which audience, what they called,
+// whether they were let in and how long the request took. Events are
+// written to a Sink, such as structured logs or a BigQuery table, for
+// security review of service-to-service traffic.
+//
+// The verify middleware fills in the caller and the decision; see
+// verify.WithAudit.
+package audit
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Decisions recorded in Event.Decision.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Event describes one authenticated, or rejected, request.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Caller is the verified email of the calling service account, or the
+	// email of a token rejected by the allowlist. It is empty for tokens
+	// that could not be verified.
+	Caller  string `json:"caller,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// User is the verified email of the end user whose token was
+	// forwarded, if any.
+	User     string `json:"user,omitempty"`
+	Audience string `json:"audience,omitempty"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	// Decision is Allow or Deny.
+	Decision string `json:"decision"`
+	// Reason says why a request was denied.
+	Reason    string        `json:"reason,omitempty"`
+	Status    int           `json:"status"`
+	Latency   time.Duration `json:"latency"`
+	RequestID string        `json:"request_id,omitempty"`
+	// Client is the client's self-reported identity, from its User-Agent
+	// and X-Client-* headers.
+	Client string `json:"client,omitempty"`
+}
+
+// Sink stores audit events. Implementations must be safe for concurrent
+// use.
+type Sink interface {
+	Write(ctx context.Context, ev Event) error
+}
+
+// Logger samples events and writes them to a Sink.
+type Logger struct {
+	sink      Sink
+	allowRate float64
+	denyRate  float64
+}
+
+// Option configures a Logger.
+type Option func(*Logger)
+
+// WithSampling records only a fraction, from 0 to 1, of allowed and of
+// denied requests. The default records every request. Denied requests are
+// rarer and of more interest, so a lower rate for allowed requests alone
+// usually keeps the volume manageable.
+func WithSampling(allow, deny float64) Option {
+	return func(l *Logger) {
+		l.allowRate = allow
+		l.denyRate = deny
+	}
+}
+
+// New returns a Logger writing to sink.
+func New(sink Sink, opts ...Option) *Logger {
+	l := &Logger{sink: sink, allowRate: 1, denyRate: 1}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+type contextKey struct{}
+
+// FromContext returns the event being recorded for the request ctx
+// belongs to, for middleware that knows the caller or the decision to fill
+// in, or nil if the request is not audited.
+func FromContext(ctx context.Context) *Event {
+	ev, _ := ctx.Value(contextKey{}).(*Event)
+	return ev
+}
+
+// Middleware records an event for each request once next has handled it.
+// A request whose decision was not filled in is recorded as denied if it
+// was answered with 401 Unauthorized or 403 Forbidden, and as allowed
+// otherwise.
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := &Event{Time: time.Now(), Method: r.Method, Path: r.URL.Path}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), contextKey{}, ev)))
+
+		ev.Latency = time.Since(ev.Time)
+		ev.Status = sw.status
+		if ev.Status == 0 {
+			ev.Status = http.StatusOK
+		}
+		if ev.Decision == "" {
+			ev.Decision = Allow
+			if ev.Status == http.StatusUnauthorized || ev.Status == http.StatusForbidden {
+				ev.Decision = Deny
+			}
+		}
+		if !l.sampled(ev.Decision) {
+			return
+		}
+		if err := l.sink.Write(r.Context(), *ev); err != nil {
+			log.Printf("Failed to write audit event for %s %s: %v", ev.Method, ev.Path, err)
+		}
+	})
+}
+
+func (l *Logger) sampled(decision string) bool {
+	rate := l.allowRate
+	if decision == Deny {
+		rate = l.denyRate
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
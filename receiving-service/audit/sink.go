@@ -0,0 +1,210 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+)
+
+// LogSink writes each event as a line of JSON in the structured logging
+// format Cloud Logging parses, so that events can be queried with
+// jsonPayload.audit.caller and routed with a log sink. Denied requests are
+// logged with severity WARNING, allowed ones with INFO.
+type LogSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewLogSink returns a LogSink writing to w, normally os.Stdout.
+func NewLogSink(w io.Writer) *LogSink {
+	return &LogSink{enc: json.NewEncoder(w)}
+}
+
+type logEntry struct {
+	Severity string   `json:"severity"`
+	Message  string   `json:"message"`
+	Audit    logEvent `json:"audit"`
+}
+
+// logEvent is an Event with its latency in seconds, the unit Cloud Logging
+// uses for request latencies.
+type logEvent struct {
+	Event
+	Latency float64 `json:"latency"`
+}
+
+// Write implements Sink.
+func (s *LogSink) Write(ctx context.Context, ev Event) error {
+	severity := "INFO"
+	if ev.Decision == Deny {
+		severity = "WARNING"
+	}
+	caller := ev.Caller
+	if caller == "" {
+		caller = "unauthenticated"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(logEntry{
+		Severity: severity,
+		Message:  fmt.Sprintf("Audit: %s %s %s from %s", ev.Decision, ev.Method, ev.Path, caller),
+		Audit:    logEvent{Event: ev, Latency: ev.Latency.Seconds()},
+	})
+}
+
+const (
+	// bigQueryBatchSize is the most rows sent in one insertAll request.
+	bigQueryBatchSize = 500
+	// bigQueryMaxBuffered is the most rows held while BigQuery is slow or
+	// unreachable; events beyond it are dropped.
+	bigQueryMaxBuffered = 10000
+	// bigQueryFlushInterval is how often buffered rows are sent.
+	bigQueryFlushInterval = 5 * time.Second
+)
+
+// BigQuerySink streams events into a BigQuery table, batching them in the
+// background. The table must exist with this schema:
+//
+//	time:TIMESTAMP,caller:STRING,subject:STRING,user:STRING,audience:STRING,
+//	method:STRING,path:STRING,decision:STRING,reason:STRING,status:INTEGER,
+//	latency_ms:FLOAT,request_id:STRING,client:STRING
+//
+// and the service account needs roles/bigquery.dataEditor on it. Rows that
+// cannot be written are logged and dropped, so that auditing never holds
+// up requests.
+type BigQuerySink struct {
+	tabledata *bigquery.TabledataService
+	project   string
+	dataset   string
+	table     string
+
+	mu      sync.Mutex
+	rows    []*bigquery.TableDataInsertAllRequestRows
+	dropped int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBigQuerySink returns a BigQuerySink for table, given as
+// project.dataset.table, and starts sending the events written to it.
+// Call Close to send the remaining events.
+func NewBigQuerySink(ctx context.Context, table string, opts ...option.ClientOption) (*BigQuerySink, error) {
+	parts := strings.Split(table, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("audit: BigQuery table %q is not of the form project.dataset.table", table)
+	}
+	svc, err := bigquery.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("audit: failed to create BigQuery client: %w", err)
+	}
+	s := &BigQuerySink{
+		tabledata: svc.Tabledata,
+		project:   parts[0],
+		dataset:   parts[1],
+		table:     parts[2],
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Write implements Sink. It only buffers the event; events that do not fit
+// in the buffer are counted and reported at the next flush.
+func (s *BigQuerySink) Write(ctx context.Context, ev Event) error {
+	row := &bigquery.TableDataInsertAllRequestRows{Json: map[string]bigquery.JsonValue{
+		"time":       ev.Time.UTC().Format(time.RFC3339Nano),
+		"caller":     ev.Caller,
+		"subject":    ev.Subject,
+		"user":       ev.User,
+		"audience":   ev.Audience,
+		"method":     ev.Method,
+		"path":       ev.Path,
+		"decision":   ev.Decision,
+		"reason":     ev.Reason,
+		"status":     ev.Status,
+		"latency_ms": float64(ev.Latency) / float64(time.Millisecond),
+		"request_id": ev.RequestID,
+		"client":     ev.Client,
+	}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rows) >= bigQueryMaxBuffered {
+		s.dropped++
+		return nil
+	}
+	s.rows = append(s.rows, row)
+	return nil
+}
+
+// Close stops the background sender and sends the buffered events.
+func (s *BigQuerySink) Close() error {
+	close(s.stop)
+	<-s.done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.flush(ctx)
+}
+
+func (s *BigQuerySink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(bigQueryFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), bigQueryFlushInterval)
+			if err := s.flush(ctx); err != nil {
+				log.Printf("Failed to write audit events to BigQuery: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// flush sends the buffered rows in batches. Rows of a failed batch are
+// dropped rather than retried, since a retry could insert some of them
+// twice.
+func (s *BigQuerySink) flush(ctx context.Context) error {
+	s.mu.Lock()
+	rows := s.rows
+	s.rows = nil
+	dropped := s.dropped
+	s.dropped = 0
+	s.mu.Unlock()
+
+	var errs []error
+	if dropped > 0 {
+		errs = append(errs, fmt.Errorf("dropped %d events because the buffer was full", dropped))
+	}
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > bigQueryBatchSize {
+			n = bigQueryBatchSize
+		}
+		resp, err := s.tabledata.InsertAll(s.project, s.dataset, s.table, &bigquery.TableDataInsertAllRequest{Rows: rows[:n]}).Context(ctx).Do()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to insert %d events: %w", n, err))
+		} else if len(resp.InsertErrors) > 0 {
+			msg := ""
+			if e := resp.InsertErrors[0]; len(e.Errors) > 0 {
+				msg = ": " + e.Errors[0].Message
+			}
+			errs = append(errs, fmt.Errorf("%d of %d events were rejected%s", len(resp.InsertErrors), n, msg))
+		}
+		rows = rows[n:]
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,165 @@
+// Package callback lets the receiving service answer an asynchronous call
+// later: the call carries the URL of a callback registered by the
+// sending service, and the result is POSTed there with an ID token of the
+// receiving service's own, minted for the callback URL's origin.
+package callback
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+// Headers of a call answered with a callback, as set by the sending
+// service.
+const (
+	URLHeader = "X-Callback-Url"
+	IDHeader  = "X-Callback-Id"
+)
+
+// sendAttempts and sendBackoff bound the retries of results the callback
+// URL fails to accept.
+const (
+	sendAttempts = 3
+	sendBackoff  = time.Second
+)
+
+// Callback is the callback an asynchronous call asked for.
+type Callback struct {
+	URL string
+	ID  string
+}
+
+// FromRequest returns the callback r asked for, if any.
+func FromRequest(r *http.Request) (Callback, bool) {
+	c := Callback{URL: r.Header.Get(URLHeader), ID: r.Header.Get(IDHeader)}
+	return c, c.URL != ""
+}
+
+// Sender sends results to callback URLs. Since every result carries an ID
+// token of the receiving service, only URLs under the prefixes it allows
+// are called back, so that callers cannot obtain tokens for other
+// audiences.
+type Sender struct {
+	allowed []string
+
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+// NewSender creates a Sender that calls back only URLs starting with one
+// of allowed, such as https://sending-service-xyz.a.run.app/callbacks/. A
+// prefix without a path allows every URL of its origin.
+func NewSender(allowed []string) *Sender {
+	s := &Sender{clients: make(map[string]*http.Client)}
+	for _, prefix := range allowed {
+		if prefix = strings.TrimSpace(prefix); prefix == "" {
+			continue
+		}
+		if u, err := url.Parse(prefix); err == nil && u.Path == "" {
+			prefix += "/"
+		}
+		s.allowed = append(s.allowed, prefix)
+	}
+	return s
+}
+
+// Allowed reports whether results may be sent to c.
+func (s *Sender) Allowed(c Callback) bool {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.User != nil {
+		return false
+	}
+	for _, prefix := range s.allowed {
+		if strings.HasPrefix(c.URL, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send POSTs body, of the given content type, to c with an ID token for
+// the origin of its URL. Results the URL fails to accept with a 5xx or a
+// network error are sent again, up to three times.
+func (s *Sender) Send(ctx context.Context, c Callback, contentType string, body []byte) error {
+	if !s.Allowed(c) {
+		return fmt.Errorf("callback: %s is not an allowed callback URL", c.URL)
+	}
+	u, _ := url.Parse(c.URL)
+	client, err := s.client(u.Scheme + "://" + u.Host)
+	if err != nil {
+		return err
+	}
+	wait := sendBackoff
+	for attempt := 1; ; attempt++ {
+		err := send(ctx, client, c, contentType, body)
+		var retryable *retryableError
+		if err == nil || !errors.As(err, &retryable) || attempt == sendAttempts {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+func send(ctx context.Context, client *http.Client, c Callback, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.ID != "" {
+		req.Header.Set(IDHeader, c.ID)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &retryableError{err}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	switch {
+	case resp.StatusCode >= 500:
+		return &retryableError{fmt.Errorf("callback: %s answered %s", c.URL, resp.Status)}
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("callback: %s answered %s", c.URL, resp.Status)
+	}
+	return nil
+}
+
+// client returns the client that sends ID tokens for audience, creating
+// it on first use so that its tokens are cached.
+func (s *Sender) client(audience string) (*http.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.clients[audience]; ok {
+		return c, nil
+	}
+	c, err := idtoken.NewClient(context.Background(), audience)
+	if err != nil {
+		return nil, fmt.Errorf("callback: failed to create ID token client for %s: %w", audience, err)
+	}
+	s.clients[audience] = c
+	return c, nil
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
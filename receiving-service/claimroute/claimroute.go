@@ -0,0 +1,206 @@
+// Package claimroute dispatches verified callers to different handlers by
+// the claims of their ID tokens, for example to send a batch job's service
+// account to a bulk endpoint and a frontend's to an interactive one. The
+// routes are declared in a Table, usually read from YAML. It is meant to
+// run after the verify middleware, which authenticates the caller.
+package claimroute
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"receiver/verify"
+)
+
+// Table lists the routes callers are dispatched by.
+type Table struct {
+	// Routes are tried in order, and a caller goes to the handler of the
+	// first route it matches.
+	Routes []Route `yaml:"routes"`
+	// Default is the handler of callers that match no route. If empty,
+	// they are rejected with 403 Forbidden.
+	Default string `yaml:"default"`
+}
+
+// Route sends the callers it matches to a named handler. A route matches a
+// caller that meets every condition it sets; a route without conditions
+// matches every caller.
+type Route struct {
+	// Handler names the handler the route's callers are sent to.
+	Handler string `yaml:"handler"`
+	// Callers are the verified emails of the callers the route matches,
+	// compared case-insensitively. They may hold path.Match patterns, as
+	// in *@my-project.iam.gserviceaccount.com.
+	Callers []string `yaml:"callers"`
+	// Claims maps claim names to the values they must have, as in
+	// hd: example.com. Nested claims are named by their path, as in
+	// google.compute_engine.project_id.
+	Claims map[string]string `yaml:"claims"`
+}
+
+// Load reads a Table from a YAML file of the form
+//
+//	routes:
+//	  - handler: bulk
+//	    callers: [batch-jobs-sa@my-project.iam.gserviceaccount.com]
+//	  - handler: interactive
+//	    callers: [frontend-sa@my-project.iam.gserviceaccount.com]
+//	default: interactive
+func Load(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("claimroute: failed to read routes: %w", err)
+	}
+	var t Table
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("claimroute: failed to parse routes %s: %w", path, err)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Validate checks that every route names a handler and that the caller
+// patterns are well formed.
+func (t *Table) Validate() error {
+	for i, r := range t.Routes {
+		if r.Handler == "" {
+			return fmt.Errorf("claimroute: route %d has no handler", i+1)
+		}
+		for _, c := range r.Callers {
+			if _, err := path.Match(strings.ToLower(c), ""); err != nil {
+				return fmt.Errorf("claimroute: route %d has invalid caller pattern %q", i+1, c)
+			}
+		}
+	}
+	return nil
+}
+
+// Handler returns the name of the handler the caller with the given claims
+// is sent to, and false if it matches no route and there is no default.
+// Callers are identified by their verified email; claims holds every claim
+// of their token.
+func (t *Table) Handler(c *verify.Claims, claims map[string]interface{}) (string, bool) {
+	for _, r := range t.Routes {
+		if r.matches(c, claims) {
+			return r.Handler, true
+		}
+	}
+	return t.Default, t.Default != ""
+}
+
+func (r *Route) matches(c *verify.Claims, claims map[string]interface{}) bool {
+	if len(r.Callers) > 0 {
+		if !c.EmailVerified || c.Email == "" {
+			return false
+		}
+		email := strings.ToLower(c.Email)
+		matched := false
+		for _, pattern := range r.Callers {
+			if ok, _ := path.Match(strings.ToLower(pattern), email); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for name, want := range r.Claims {
+		v, ok := lookup(claims, name)
+		if !ok || fmt.Sprint(v) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the claim at the dotted path name.
+func lookup(claims map[string]interface{}, name string) (interface{}, bool) {
+	var v interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Router returns a handler that sends each caller to the handler, among
+// handlers, that the table routes it to, and rejects callers the table
+// has no route for with 403 Forbidden. It fails if the table names a
+// handler missing from handlers. It must be wrapped by the verify
+// middleware, which stores the caller's token in the request context;
+// requests without one are rejected with 401 Unauthorized.
+func (t *Table) Router(handlers map[string]http.Handler) (http.Handler, error) {
+	missing := map[string]bool{}
+	names := []string{t.Default}
+	for _, r := range t.Routes {
+		names = append(names, r.Handler)
+	}
+	for _, name := range names {
+		if _, ok := handlers[name]; name != "" && !ok {
+			missing[name] = true
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("claimroute: routes name unknown handlers %s", strings.Join(sortedKeys(missing), ", "))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := verify.PayloadFromContext(r.Context())
+		c, _ := verify.ClaimsFromContext(r.Context())
+		if !ok || c == nil {
+			log.Printf("Rejected request: no verified caller to route")
+			http.Error(w, "Unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		name, ok := t.Handler(c, payload.Claims)
+		if !ok {
+			log.Printf("Rejected request: no route for caller %q", c.Email)
+			writeForbidden(w, c.Email)
+			return
+		}
+		handlers[name].ServeHTTP(w, r)
+	}), nil
+}
+
+// forbiddenError is the body of a 403 response for a caller that matches
+// no route.
+type forbiddenError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Email   string `json:"email,omitempty"`
+}
+
+func writeForbidden(w http.ResponseWriter, email string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(forbiddenError{
+		Error:   "no_route",
+		Message: "No handler serves this caller",
+		Email:   email,
+	})
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,320 @@
+// Package compression decodes gzip and deflate request bodies, such as
+// those the sending service compresses, and compresses responses for
+// callers that accept it. It is meant to run after the signature
+// verifier, which checks the body as it was sent, and before handlers
+// such as the idempotency middleware that need the decoded body.
+package compression
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Handler is middleware that handles Content-Encoding on both sides.
+type Handler struct {
+	minSize        int
+	level          int
+	maxDecodedSize int64
+}
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// WithMinSize sets the smallest response that is compressed. Smaller
+// responses are sent as they are, since they gain little. The default is
+// 1 KiB.
+func WithMinSize(n int) Option {
+	return func(h *Handler) {
+		h.minSize = n
+	}
+}
+
+// WithLevel sets the compression level of responses, from 1 (fastest) to
+// 9 (smallest). The default is the default level of compress/flate.
+func WithLevel(level int) Option {
+	return func(h *Handler) {
+		h.level = level
+	}
+}
+
+// WithMaxDecodedSize limits decoded request bodies, which can be far
+// larger than what was sent. Handlers reading past it get an
+// *http.MaxBytesError. The default is 10 MiB.
+func WithMaxDecodedSize(n int64) Option {
+	return func(h *Handler) {
+		h.maxDecodedSize = n
+	}
+}
+
+// New creates a Handler.
+func New(opts ...Option) *Handler {
+	h := &Handler{
+		minSize:        1 << 10,
+		level:          flate.DefaultCompression,
+		maxDecodedSize: 10 << 20,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Middleware decodes the bodies of requests with a gzip or deflate
+// Content-Encoding before calling next, rejecting other encodings with 415
+// Unsupported Media Type, and compresses next's responses with the
+// encoding the caller prefers of those it accepts.
+func (h *Handler) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" && r.Body != nil && r.Body != http.NoBody {
+			body, ok := decoder(strings.ToLower(strings.TrimSpace(encoding)), r.Body)
+			if !ok {
+				log.Printf("Rejected request body with unsupported Content-Encoding %q", encoding)
+				w.Header().Set("Accept-Encoding", "gzip, deflate")
+				http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+			r = r.Clone(r.Context())
+			r.Body = http.MaxBytesReader(w, body, h.maxDecodedSize)
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, handler: h, encoding: encoding}
+		defer cw.finish()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// decoder returns a reader of body decoded from encoding.
+func decoder(encoding string, body io.ReadCloser) (io.ReadCloser, bool) {
+	switch encoding {
+	case "identity":
+		return body, true
+	case "gzip", "x-gzip":
+		return &lazyReader{src: body, open: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }}, true
+	case "deflate":
+		return &lazyReader{src: body, open: openDeflate}, true
+	}
+	return nil, false
+}
+
+// openDeflate accepts raw deflate data as well as the zlib-wrapped data
+// RFC 9110 calls for, since some clients send it.
+func openDeflate(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// lazyReader opens its decoding reader on the first read, so a handler
+// that never reads the body doesn't wait for it.
+type lazyReader struct {
+	src  io.ReadCloser
+	open func(io.Reader) (io.ReadCloser, error)
+	r    io.ReadCloser
+	err  error
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil && l.err == nil {
+		l.r, l.err = l.open(l.src)
+	}
+	if l.err != nil {
+		return 0, l.err
+	}
+	return l.r.Read(p)
+}
+
+func (l *lazyReader) Close() error {
+	if l.r != nil {
+		l.r.Close()
+	}
+	return l.src.Close()
+}
+
+// negotiate returns the encoding, gzip or deflate, to compress a response
+// with for the given Accept-Encoding, or "" if the caller accepts neither.
+// gzip is preferred when the caller weighs both the same.
+func negotiate(accept string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[name] = weight
+	}
+	weight := func(name string) float64 {
+		if w, ok := q[name]; ok {
+			return w
+		}
+		return q["*"]
+	}
+	gz, df := weight("gzip"), weight("deflate")
+	switch {
+	case gz > 0 && gz >= df:
+		return "gzip"
+	case df > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+// incompressible reports whether contentType is already compressed, so
+// compressing it again would only cost time.
+func incompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return true
+	}
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zip", "application/zstd", "application/x-7z-compressed":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until it has seen
+// enough of it to decide whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	handler  *Handler
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.handler.minSize {
+			return len(p), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush compresses a streamed response, such as server-sent events, as it
+// goes, sending what has been written so far.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) > 0)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide sends the header, compressed if compress is set and the handler
+// didn't encode the response itself, followed by the buffered body.
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if compress && header.Get("Content-Encoding") == "" && !incompressible(header.Get("Content-Type")) {
+		if header.Get("Content-Type") == "" {
+			// Sniff the type from the plain body, as net/http would.
+			header.Set("Content-Type", http.DetectContentType(cw.buf))
+		}
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		var err error
+		if cw.encoding == "deflate" {
+			cw.enc, err = zlib.NewWriterLevel(cw.ResponseWriter, cw.handler.level)
+		} else {
+			cw.enc, err = gzip.NewWriterLevel(cw.ResponseWriter, cw.handler.level)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// finish sends a response too small to compress, or ends the compressed
+// stream.
+func (cw *compressWriter) finish() {
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Close(); err != nil {
+			log.Printf("Failed to finish compressed response: %v", err)
+		}
+	}
+}
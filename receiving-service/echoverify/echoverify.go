@@ -0,0 +1,48 @@
+// Package echoverify adapts the receiving service's middleware, such as the
+// verify middleware, to echo. It is a module of its own so that services
+// using other routers do not depend on echo.
+package echoverify
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"receiver/verify"
+)
+
+// Middleware returns echo middleware that authenticates requests with v.
+// Handlers read the caller's claims with
+// verify.ClaimsFromContext(c.Request().Context()).
+func Middleware(v *verify.Verifier) echo.MiddlewareFunc {
+	return Wrap(v.Middleware)
+}
+
+// Wrap returns echo middleware that runs m, such as verify.LogRequests or
+// the Middleware method of a ratelimit.Limiter or audit.Logger, with the
+// rest of the echo chain as its next handler. If m does not call next,
+// such as when it rejects the request, the chain stops there. Errors of
+// the chain are returned to echo's error handler.
+func Wrap(m func(http.Handler) http.Handler) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var err error
+			orig := c.Response().Writer
+			m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c.SetRequest(r)
+				// m may have wrapped the response, for example to record
+				// its status; have the rest of the chain write through it.
+				c.Response().Writer = w
+				err = next(c)
+				if err != nil && !c.Response().Committed {
+					// Let echo's error handler write the error through w
+					// too, so that m sees the status it sends.
+					c.Error(err)
+					err = nil
+				}
+				c.Response().Writer = orig
+			})).ServeHTTP(orig, c.Request())
+			return err
+		}
+	}
+}
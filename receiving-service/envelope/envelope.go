@@ -0,0 +1,210 @@
+// Package envelope decrypts request bodies that the sending service
+// encrypted with envelope encryption, and encrypts the responses of callers
+// that ask for it, so that proxies and logs between the services only see
+// ciphertext. Bodies are encrypted with AES-256-GCM under data keys wrapped
+// by a Cloud KMS key or the keys of a local keyset, and sent as JSON
+// envelopes. It is meant to run after the verify middleware, so that only
+// authenticated callers cost a key unwrap, and before the signature
+// verifier and the compression middleware, which see the plaintext.
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// ContentType is the Content-Type of encrypted bodies.
+const ContentType = "application/vnd.envelope+json"
+
+// EncryptResponseHeader asks for the response to be encrypted.
+const EncryptResponseHeader = "X-Encrypt-Response"
+
+// Handler is middleware that decrypts requests and encrypts responses.
+type Handler struct {
+	keys        *dataKeys
+	required    bool
+	maxBodySize int64
+}
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// WithRequired rejects requests whose bodies are not encrypted with 415
+// Unsupported Media Type, and encrypts every response, whether or not the
+// caller asked for it. Without it, plain requests are served as they are,
+// so that encryption can be turned on in the senders after the receiver.
+func WithRequired() Option {
+	return func(h *Handler) {
+		h.required = true
+	}
+}
+
+// WithMaxBodySize limits the encrypted request bodies read. Larger ones
+// are rejected with 413 Request Entity Too Large. The default is 10 MiB.
+func WithMaxBodySize(n int64) Option {
+	return func(h *Handler) {
+		h.maxBodySize = n
+	}
+}
+
+// New creates a Handler whose data keys are wrapped by w, which must hold
+// the key encryption keys of the senders.
+func New(w KeyWrapper, opts ...Option) *Handler {
+	h := &Handler{
+		keys:        newDataKeys(w),
+		maxBodySize: 10 << 20,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Middleware decrypts encrypted request bodies, restoring their
+// Content-Type and Content-Encoding, and buffers and encrypts the
+// responses of callers that send the X-Encrypt-Response header. Bodies
+// that fail to decrypt are rejected with 400 Bad Request. Responses to HEAD
+// requests and those without a body are sent as they are.
+func (h *Handler) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hasBody := r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+		switch {
+		case hasBody && isEnvelope(r.Header.Get("Content-Type")):
+			decrypted, ok := h.decrypt(w, r)
+			if !ok {
+				return
+			}
+			r = decrypted
+		case hasBody && h.required:
+			log.Printf("Rejected unencrypted request body for %s", r.URL.Path)
+			writeError(w, http.StatusUnsupportedMediaType, "encryption_required", "Request bodies must be encrypted")
+			return
+		}
+
+		w.Header().Add("Vary", EncryptResponseHeader)
+		if r.Method == http.MethodHead || !h.required && r.Header.Get(EncryptResponseHeader) != "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &encryptWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		h.encrypt(ew, r)
+	})
+}
+
+// decrypt returns r with its body decrypted, or answers it and returns
+// false if it cannot be.
+func (h *Handler) decrypt(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Request body is too large")
+		} else {
+			writeError(w, http.StatusBadRequest, "invalid_envelope", "Failed to read request body")
+		}
+		return nil, false
+	}
+	body, e, err := h.keys.open(r.Context(), data, requestBinding(r.Method, r.URL.RequestURI()))
+	if err != nil {
+		log.Printf("Rejected request body for %s that failed to decrypt: %v", r.URL.Path, err)
+		writeError(w, http.StatusBadRequest, "invalid_envelope", "Request body could not be decrypted")
+		return nil, false
+	}
+	r = r.Clone(r.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Content-Type")
+	if e.ContentType != "" {
+		r.Header.Set("Content-Type", e.ContentType)
+	}
+	r.Header.Del("Content-Encoding")
+	if e.ContentEncoding != "" {
+		r.Header.Set("Content-Encoding", e.ContentEncoding)
+	}
+	return r, true
+}
+
+// encrypt sends the response buffered by ew, encrypted unless it has no
+// body.
+func (h *Handler) encrypt(ew *encryptWriter, r *http.Request) {
+	w, status := ew.ResponseWriter, ew.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if len(ew.buf) == 0 {
+		w.WriteHeader(status)
+		return
+	}
+	header := w.Header()
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(ew.buf)
+	}
+	sealed, err := h.keys.seal(r.Context(), ew.buf, contentType, header.Get("Content-Encoding"), responseBinding(r.Method, r.URL.RequestURI()))
+	if err != nil {
+		log.Printf("Failed to encrypt response for %s: %v", r.URL.Path, err)
+		for _, name := range []string{"Content-Encoding", "Content-Length", "ETag", "Last-Modified"} {
+			header.Del(name)
+		}
+		writeError(w, http.StatusInternalServerError, "encryption_failed", "Response could not be encrypted")
+		return
+	}
+	header.Set("Content-Type", ContentType)
+	header.Del("Content-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(sealed)))
+	w.WriteHeader(status)
+	w.Write(sealed)
+}
+
+// encryptWriter buffers a response so that it can be encrypted whole.
+type encryptWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+}
+
+func (ew *encryptWriter) WriteHeader(status int) {
+	if status < 200 {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if ew.status == 0 {
+		ew.status = status
+	}
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.status == 0 {
+		ew.status = http.StatusOK
+	}
+	if ew.status == http.StatusNoContent || ew.status == http.StatusNotModified {
+		return 0, http.ErrBodyNotAllowed
+	}
+	ew.buf = append(ew.buf, p...)
+	return len(p), nil
+}
+
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: code, Message: message})
+}
+
+func isEnvelope(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == ContentType
+}
@@ -0,0 +1,330 @@
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	// algorithm is the cipher of envelope bodies and of the data keys
+	// wrapped by a Keyset.
+	algorithm = "A256GCM"
+	// dataKeyLifetime is how long a data key encrypts responses before a
+	// new one is made.
+	dataKeyLifetime = 5 * time.Minute
+	// maxUnwrappedKeys bounds the unwrapped data keys kept for decrypting
+	// requests.
+	maxUnwrappedKeys = 1024
+)
+
+// KeyWrapper wraps and unwraps data keys with a key encryption key, such as
+// a Cloud KMS key.
+type KeyWrapper interface {
+	// WrapKey encrypts key with the primary key encryption key and returns
+	// it with the ID of the key that wrapped it.
+	WrapKey(ctx context.Context, key []byte) (wrapped []byte, keyID string, err error)
+	// UnwrapKey decrypts a key wrapped by the key with the given ID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// NewKMSKeyWrapper wraps data keys with the Cloud KMS symmetric key
+// keyName, of the form projects/P/locations/L/keyRings/R/cryptoKeys/K.
+// The service account must hold roles/cloudkms.cryptoKeyEncrypterDecrypter
+// on the key. Data keys wrapped by any enabled version of the key unwrap,
+// so the key can be rotated in KMS without coordinating with the senders.
+func NewKMSKeyWrapper(ctx context.Context, keyName string, opts ...option.ClientOption) (KeyWrapper, error) {
+	svc, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: failed to create Cloud KMS client: %w", err)
+	}
+	return &kmsKeyWrapper{keys: svc.Projects.Locations.KeyRings.CryptoKeys, name: keyName}, nil
+}
+
+type kmsKeyWrapper struct {
+	keys *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+	name string
+}
+
+func (k *kmsKeyWrapper) WrapKey(ctx context.Context, key []byte) ([]byte, string, error) {
+	resp, err := k.keys.Encrypt(k.name, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(key),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, "", fmt.Errorf("envelope: failed to wrap data key: %w", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return nil, "", fmt.Errorf("envelope: failed to decode wrapped data key: %w", err)
+	}
+	return wrapped, resp.Name, nil
+}
+
+func (k *kmsKeyWrapper) UnwrapKey(ctx context.Context, _ string, wrapped []byte) ([]byte, error) {
+	resp, err := k.keys.Decrypt(k.name, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("envelope: failed to unwrap data key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: failed to decode data key: %w", err)
+	}
+	return key, nil
+}
+
+// Keyset is a KeyWrapper holding AES-256 key encryption keys by ID, in the
+// same JSON form as the sending service's keysets:
+//
+//	{
+//	  "primary": "2024-06",
+//	  "keys": [
+//	    {"id": "2024-01", "key": "<base64 of 32 random bytes>"},
+//	    {"id": "2024-06", "key": "<base64 of 32 random bytes>"}
+//	  ]
+//	}
+//
+// Data keys are wrapped with the primary key and unwrapped with whichever
+// key wrapped them.
+type Keyset struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+type keysetFile struct {
+	Primary string `json:"primary"`
+	Keys    []struct {
+		ID  string `json:"id"`
+		Key []byte `json:"key"`
+	} `json:"keys"`
+}
+
+// ParseKeyset reads a Keyset from JSON.
+func ParseKeyset(data []byte) (*Keyset, error) {
+	var f keysetFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("envelope: failed to parse keyset: %w", err)
+	}
+	ks := &Keyset{primary: f.Primary, keys: make(map[string]cipher.AEAD, len(f.Keys))}
+	for _, k := range f.Keys {
+		if k.ID == "" {
+			return nil, errors.New("envelope: keyset key IDs must not be empty")
+		}
+		if _, ok := ks.keys[k.ID]; ok {
+			return nil, fmt.Errorf("envelope: keyset key ID %q is repeated", k.ID)
+		}
+		if len(k.Key) != 32 {
+			return nil, fmt.Errorf("envelope: keyset key %q must be 32 bytes, not %d", k.ID, len(k.Key))
+		}
+		aead, err := newAEAD(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[k.ID] = aead
+	}
+	if _, ok := ks.keys[ks.primary]; !ok {
+		return nil, fmt.Errorf("envelope: keyset primary key %q is not in the keyset", ks.primary)
+	}
+	return ks, nil
+}
+
+// LoadKeyset reads the Keyset in the file at path.
+func LoadKeyset(path string) (*Keyset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: failed to read keyset: %w", err)
+	}
+	return ParseKeyset(data)
+}
+
+// WrapKey wraps key with the primary key, binding it to the key's ID.
+func (ks *Keyset) WrapKey(_ context.Context, key []byte) ([]byte, string, error) {
+	wrapped, err := seal(ks.keys[ks.primary], key, []byte(ks.primary))
+	return wrapped, ks.primary, err
+}
+
+// UnwrapKey unwraps a key wrapped by the key with the given ID.
+func (ks *Keyset) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := ks.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("envelope: unknown keyset key %q", keyID)
+	}
+	key, err := open(aead, wrapped, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("envelope: failed to unwrap data key: %w", err)
+	}
+	return key, nil
+}
+
+// envelope is the JSON form of an encrypted body.
+type envelope struct {
+	Algorithm       string `json:"alg"`
+	KeyID           string `json:"kid"`
+	WrappedKey      []byte `json:"wrapped_key"`
+	Ciphertext      []byte `json:"ciphertext"`
+	ContentType     string `json:"content_type,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// additionalData binds the ciphertext of e to binding and to the headers
+// it restores.
+func (e *envelope) additionalData(binding string) []byte {
+	return []byte(strings.Join([]string{binding, e.KeyID, e.ContentType, e.ContentEncoding}, "\n"))
+}
+
+// requestBinding and responseBinding are what the bodies of a request and
+// of its response are bound to, as the sending service binds them.
+func requestBinding(method, uri string) string {
+	return "request " + method + " " + uri
+}
+
+func responseBinding(method, uri string) string {
+	return "response " + method + " " + uri
+}
+
+type dataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+	keyID   string
+	expires time.Time
+}
+
+// dataKeys encrypts envelopes with a data key it replaces every
+// dataKeyLifetime, and decrypts them with the data keys it has unwrapped,
+// so that KMS is only called when a sender starts using a new data key.
+type dataKeys struct {
+	wrapper KeyWrapper
+
+	mu        sync.Mutex
+	current   *dataKey
+	unwrapped map[string]cipher.AEAD
+}
+
+func newDataKeys(w KeyWrapper) *dataKeys {
+	return &dataKeys{wrapper: w, unwrapped: make(map[string]cipher.AEAD)}
+}
+
+func (k *dataKeys) key(ctx context.Context) (*dataKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.current != nil && time.Now().Before(k.current.expires) {
+		return k.current, nil
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, keyID, err := k.wrapper.WrapKey(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	k.current = &dataKey{aead: aead, wrapped: wrapped, keyID: keyID, expires: time.Now().Add(dataKeyLifetime)}
+	return k.current, nil
+}
+
+func (k *dataKeys) unwrap(ctx context.Context, e *envelope) (cipher.AEAD, error) {
+	id := e.KeyID + "\x00" + string(e.WrappedKey)
+	k.mu.Lock()
+	aead, ok := k.unwrapped[id]
+	k.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	raw, err := k.wrapper.UnwrapKey(ctx, e.KeyID, e.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newAEAD(raw); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	if len(k.unwrapped) >= maxUnwrappedKeys {
+		k.unwrapped = make(map[string]cipher.AEAD)
+	}
+	k.unwrapped[id] = aead
+	k.mu.Unlock()
+	return aead, nil
+}
+
+// seal returns the envelope of plaintext, whose Content-Type and
+// Content-Encoding are given, bound to binding.
+func (k *dataKeys) seal(ctx context.Context, plaintext []byte, contentType, contentEncoding, binding string) ([]byte, error) {
+	key, err := k.key(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e := envelope{
+		Algorithm:       algorithm,
+		KeyID:           key.keyID,
+		WrappedKey:      key.wrapped,
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+	}
+	if e.Ciphertext, err = seal(key.aead, plaintext, e.additionalData(binding)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// open decrypts the envelope data bound to binding.
+func (k *dataKeys) open(ctx context.Context, data []byte, binding string) ([]byte, *envelope, error) {
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, nil, fmt.Errorf("malformed envelope: %w", err)
+	}
+	if e.Algorithm != algorithm {
+		return nil, nil, fmt.Errorf("unsupported envelope algorithm %q", e.Algorithm)
+	}
+	aead, err := k.unwrap(ctx, &e)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := open(aead, e.Ciphertext, e.additionalData(binding))
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, &e, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which it prepends to the
+// ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:n], ciphertext[n:], additionalData)
+}
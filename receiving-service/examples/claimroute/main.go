@@ -0,0 +1,65 @@
+// Command claimroute is a receiving service that authenticates callers
+// with the verify middleware and then serves each caller from the handler
+// its ID token's claims are routed to, read from the YAML table in
+// CLAIM_ROUTES_FILE (see routes.yaml).
+//
+// Callers routed to bulk get a handler that accepts large batches, and
+// callers routed to interactive one that answers one item at a time.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"receiver/claimroute"
+	"receiver/verify"
+)
+
+func main() {
+	audience := os.Getenv("EXPECTED_AUDIENCE")
+	if audience == "" {
+		log.Fatal("EXPECTED_AUDIENCE environment variable is not set")
+	}
+	path := os.Getenv("CLAIM_ROUTES_FILE")
+	if path == "" {
+		path = "routes.yaml"
+	}
+	table, err := claimroute.Load(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	router, err := table.Router(map[string]http.Handler{
+		"bulk": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "Queued batch")
+		}),
+		"interactive": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "Processed item")
+		}),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           http.MaxBytesHandler(verify.New(audience).Middleware(router), 1<<20),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Printf("Listening on :%s", port)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,74 @@
+// Command rbac is a receiving service that authenticates callers with the
+// verify middleware and then authorizes each route by the caller's roles,
+// read from the YAML policy in RBAC_POLICY_FILE (see roles.yaml).
+//
+// GET /orders needs orders.read, POST /orders needs orders.write, and
+// DELETE /orders needs orders.delete.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"receiver/rbac"
+	"receiver/verify"
+)
+
+func main() {
+	audience := os.Getenv("EXPECTED_AUDIENCE")
+	if audience == "" {
+		log.Fatal("EXPECTED_AUDIENCE environment variable is not set")
+	}
+	path := os.Getenv("RBAC_POLICY_FILE")
+	if path == "" {
+		path = "roles.yaml"
+	}
+	policy, err := rbac.Load(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	orders := map[string]http.Handler{
+		http.MethodGet: policy.Require("orders.read", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "Listing orders")
+		})),
+		http.MethodPost: policy.Require("orders.write", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintln(w, "Created order")
+		})),
+		http.MethodDelete: policy.Require("orders.delete", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		h, ok := orders[r.Method]
+		if !ok {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           http.MaxBytesHandler(verify.New(audience).Middleware(mux), 1<<20),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Printf("Listening on :%s", port)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+// Package ginverify adapts the receiving service's middleware, such as the
+// verify middleware, to gin. It is a module of its own so that services
+// using other routers do not depend on gin; chi and gorilla/mux take the
+// middleware as is, and echo through the echoverify module.
+package ginverify
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"receiver/verify"
+)
+
+// Middleware returns gin middleware that authenticates requests with v.
+// Handlers read the caller's claims with
+// verify.ClaimsFromContext(c.Request.Context()).
+func Middleware(v *verify.Verifier) gin.HandlerFunc {
+	return Wrap(v.Middleware)
+}
+
+// Wrap returns gin middleware that runs m, such as verify.LogRequests or
+// the Middleware method of a ratelimit.Limiter or audit.Logger, with the
+// rest of the gin chain as its next handler. If m does not call next,
+// such as when it rejects the request, the chain is aborted.
+func Wrap(m func(http.Handler) http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orig := c.Writer
+		called := false
+		m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			c.Request = r
+			if w != http.ResponseWriter(orig) {
+				// m wrapped the response, for example to record its
+				// status; have the rest of the chain write through it.
+				c.Writer = &responseWriter{ResponseWriter: orig, w: w}
+			}
+			c.Next()
+			c.Writer = orig
+		})).ServeHTTP(orig, c.Request)
+		if !called {
+			c.Abort()
+		}
+	}
+}
+
+// responseWriter is a gin.ResponseWriter that writes through the
+// http.ResponseWriter of a middleware.
+type responseWriter struct {
+	gin.ResponseWriter
+	w http.ResponseWriter
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.w.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	return rw.w.Write(b)
+}
+
+func (rw *responseWriter) WriteString(s string) (int, error) {
+	return rw.w.Write([]byte(s))
+}
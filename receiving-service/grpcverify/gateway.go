@@ -0,0 +1,39 @@
+package grpcverify
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc/metadata"
+
+	"receiver/verify"
+)
+
+// Metadata keys GatewayMetadata sets.
+const (
+	CallerEmailKey   = "x-verified-caller-email"
+	CallerSubjectKey = "x-verified-caller-sub"
+)
+
+// GatewayMetadata returns the verified caller of r as gRPC metadata, for
+// runtime.WithMetadata of a gRPC-Gateway mux wrapped in the verify
+// middleware:
+//
+//	mux := runtime.NewServeMux(runtime.WithMetadata(grpcverify.GatewayMetadata))
+//	handler := v.Middleware(mux)
+//
+// The gateway already forwards the Authorization header, so a gRPC server
+// using the interceptors verifies the token again; the metadata is for
+// servers that only the gateway can reach, which can then read the caller
+// without doing so. Requests without verified claims get no metadata.
+func GatewayMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	claims, ok := verify.ClaimsFromContext(r.Context())
+	if !ok {
+		return nil
+	}
+	md := metadata.Pairs(CallerSubjectKey, claims.Subject)
+	if claims.EmailVerified && claims.Email != "" {
+		md.Set(CallerEmailKey, claims.Email)
+	}
+	return md
+}
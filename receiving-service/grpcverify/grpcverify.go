@@ -0,0 +1,117 @@
+// Package grpcverify provides gRPC server interceptors that authenticate
+// incoming calls carrying Google-signed ID tokens, the gRPC counterpart of
+// the verify middleware.
+package grpcverify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"receiver/verify"
+)
+
+// UnaryServerInterceptor rejects unary calls without a valid ID token for
+// v's audience in their authorization metadata, or from callers v doesn't
+// allow. Handlers can read the caller's claims with
+// verify.ClaimsFromContext.
+func UnaryServerInterceptor(v *verify.Verifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, v, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of
+// UnaryServerInterceptor.
+func StreamServerInterceptor(v *verify.Verifier) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), v, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticate returns Unauthenticated for a missing or invalid token, or
+// a missing client certificate with verify.WithClientCertificates,
+// PermissionDenied for a caller that is not allowed or whose certificate
+// is not bound to it, and Unavailable if the replay store fails.
+func authenticate(ctx context.Context, v *verify.Verifier, method string) (context.Context, error) {
+	token, err := bearerToken(ctx)
+	if err != nil {
+		log.Printf("Rejected call to %s: %v", method, err)
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	ctx, err = v.Authenticate(ctx, token)
+	var notAllowed *verify.CallerNotAllowedError
+	if errors.As(err, &notAllowed) {
+		log.Printf("Rejected call to %s: %v", method, err)
+		return nil, status.Error(codes.PermissionDenied, "caller is not allowed to invoke this service")
+	}
+	if errors.Is(err, verify.ErrClockSkew) {
+		log.Printf("Rejected call to %s: %v; check the clocks of the caller and of this service", method, err)
+		return nil, status.Error(codes.Unauthenticated, "invalid ID token: clock skew")
+	}
+	if errors.Is(err, verify.ErrAudienceMismatch) {
+		log.Printf("Rejected call to %s: %v; check the audience the caller mints tokens for", method, err)
+		return nil, status.Error(codes.Unauthenticated, "invalid ID token: audience mismatch")
+	}
+	if errors.Is(err, verify.ErrReplayCheckFailed) {
+		log.Printf("Rejected call to %s: %v", method, err)
+		return nil, status.Error(codes.Unavailable, "failed to check ID token")
+	}
+	if err != nil {
+		log.Printf("Rejected call to %s: invalid ID token: %v", method, err)
+		return nil, status.Error(codes.Unauthenticated, "invalid ID token")
+	}
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	if ctx, err = v.AuthenticateCertificate(ctx, state); err != nil {
+		log.Printf("Rejected call to %s: %v", method, err)
+		if errors.Is(err, verify.ErrNoClientCertificate) {
+			return nil, status.Error(codes.Unauthenticated, "client certificate required")
+		}
+		return nil, status.Error(codes.PermissionDenied, "client certificate not allowed for caller")
+	}
+	return ctx, nil
+}
+
+func bearerToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", errors.New("missing authorization metadata")
+	}
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errors.New("malformed authorization metadata")
+	}
+	return token, nil
+}
@@ -0,0 +1,211 @@
+// Package handoff fetches the bodies the sending service hands off through
+// Cloud Storage: requests too large to send carry a signed URL of their
+// body instead, with its size and SHA-256 digest, and the middleware
+// replaces the empty body with the one fetched, checked against them. It
+// is meant to run after the ID token and signature verifiers, so that only
+// authenticated callers make it fetch anything, and before the compression
+// middleware, which decodes the fetched body.
+package handoff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of a request whose body was handed off.
+const (
+	URLHeader             = "X-Payload-Url"
+	SHA256Header          = "X-Payload-Sha256"
+	SizeHeader            = "X-Payload-Size"
+	ContentTypeHeader     = "X-Payload-Content-Type"
+	ContentEncodingHeader = "X-Payload-Content-Encoding"
+)
+
+// storageHost serves the signed URLs.
+const storageHost = "storage.googleapis.com"
+
+// Fetcher is middleware that fetches handed-off request bodies.
+type Fetcher struct {
+	buckets map[string]bool
+	maxSize int64
+	client  *http.Client
+}
+
+// Option configures a Fetcher.
+type Option func(*Fetcher)
+
+// WithMaxSize limits the bodies fetched. Larger ones are rejected with 413
+// Request Entity Too Large. The default is 1 GiB.
+func WithMaxSize(n int64) Option {
+	return func(f *Fetcher) {
+		f.maxSize = n
+	}
+}
+
+// WithClient sets the client bodies are fetched with. The default has a
+// 30 second timeout for the response headers and does not follow
+// redirects.
+func WithClient(c *http.Client) Option {
+	return func(f *Fetcher) {
+		f.client = c
+	}
+}
+
+// New creates a Fetcher that fetches bodies from the given buckets only, so
+// that a caller cannot make the receiving service fetch other URLs.
+func New(buckets []string, opts ...Option) *Fetcher {
+	f := &Fetcher{
+		buckets: make(map[string]bool, len(buckets)),
+		maxSize: 1 << 30,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, b := range buckets {
+		if b = strings.TrimSpace(b); b != "" {
+			f.buckets[b] = true
+		}
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Middleware calls next with the body fetched from the URL of requests with
+// an X-Payload-Url header, and their Content-Type and Content-Encoding
+// restored; other requests are passed through. Requests with a URL of a
+// bucket that is not allowed, or without a valid size or digest, are
+// rejected with 400 Bad Request, and requests whose body cannot be fetched
+// with 502 Bad Gateway. A body that does not match its size or digest
+// fails the handler's read of its end with an error.
+func (f *Fetcher) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawURL := r.Header.Get(URLHeader)
+		if rawURL == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bucket, err := f.bucket(rawURL)
+		if err != nil {
+			log.Printf("Rejected handed-off body: %v", err)
+			http.Error(w, "invalid payload URL", http.StatusBadRequest)
+			return
+		}
+		size, err := strconv.ParseInt(r.Header.Get(SizeHeader), 10, 64)
+		digest, errDigest := hex.DecodeString(r.Header.Get(SHA256Header))
+		if err != nil || size < 0 || errDigest != nil || len(digest) != sha256.Size {
+			log.Printf("Rejected handed-off body from bucket %s without a valid size and digest", bucket)
+			http.Error(w, "invalid payload size or digest", http.StatusBadRequest)
+			return
+		}
+		if size > f.maxSize {
+			log.Printf("Rejected handed-off body of %d bytes from bucket %s", size, bucket)
+			http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, rawURL, nil)
+		if err != nil {
+			http.Error(w, "invalid payload URL", http.StatusBadRequest)
+			return
+		}
+		resp, err := f.client.Do(req)
+		if err != nil {
+			log.Printf("Failed to fetch handed-off body from bucket %s: %v", bucket, err)
+			http.Error(w, "failed to fetch payload", http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			log.Printf("Failed to fetch handed-off body from bucket %s: %s", bucket, resp.Status)
+			http.Error(w, "failed to fetch payload", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		r = r.Clone(r.Context())
+		r.Body = &verifyingReader{r: resp.Body, h: sha256.New(), size: size, digest: digest}
+		r.ContentLength = size
+		r.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		if ct := r.Header.Get(ContentTypeHeader); ct != "" {
+			r.Header.Set("Content-Type", ct)
+		}
+		if ce := r.Header.Get(ContentEncodingHeader); ce != "" {
+			r.Header.Set("Content-Encoding", ce)
+		}
+		for _, h := range []string{URLHeader, SHA256Header, SizeHeader, ContentTypeHeader, ContentEncodingHeader} {
+			r.Header.Del(h)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bucket returns the bucket of a signed URL, if it is one of f's.
+func (f *Fetcher) bucket(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || u.Host != storageHost || u.User != nil {
+		return "", fmt.Errorf("URL not served by %s: %s", storageHost, u.Redacted())
+	}
+	bucket, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if !f.buckets[bucket] {
+		return "", fmt.Errorf("bucket %q not allowed", bucket)
+	}
+	return bucket, nil
+}
+
+// ErrPayloadMismatch is returned by reads of a handed-off body that does not
+// match the size or digest it was sent with.
+var ErrPayloadMismatch = errors.New("handoff: payload does not match its size or digest")
+
+// verifyingReader reads a fetched body, checking its size and digest when
+// it ends.
+type verifyingReader struct {
+	r      io.ReadCloser
+	h      hash.Hash
+	n      int64
+	size   int64
+	digest []byte
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if remaining := v.size - v.n + 1; int64(len(p)) > remaining {
+		// Read no further than one byte past the expected size, enough to
+		// tell that the body is too long.
+		p = p[:remaining]
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	if v.n > v.size {
+		return n, ErrPayloadMismatch
+	}
+	if err == io.EOF && (v.n != v.size || !bytes.Equal(v.h.Sum(nil), v.digest)) {
+		return n, ErrPayloadMismatch
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
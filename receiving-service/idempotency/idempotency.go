@@ -0,0 +1,227 @@
+// Package idempotency deduplicates retried requests by their
+// Idempotency-Key header: the first request with a key is handled and its
+// response stored, and later requests with the same key get the stored
+// response without being handled again. It lets callers such as the
+// sending service safely retry POST, PUT, PATCH and DELETE requests. It is
+// meant to run after the verify middleware, so that keys are scoped to the
+// verified caller.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"receiver/verify"
+)
+
+// Header is the request header carrying the idempotency key.
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set to "true" on responses replayed from the store.
+const ReplayedHeader = "Idempotent-Replayed"
+
+var (
+	// ErrInProgress is returned by Store.Begin for a key whose first
+	// request is still being handled.
+	ErrInProgress = errors.New("idempotency: request in progress")
+	// ErrMismatch is returned by Store.Begin for a key that was first used
+	// with a different request.
+	ErrMismatch = errors.New("idempotency: key reused with a different request")
+)
+
+// Response is a stored response.
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// Store records which keys have been seen and the responses to them.
+// Implementations must be safe for concurrent use; stores shared by
+// several instances, such as one backed by Redis or Firestore, make
+// deduplication work across instances.
+type Store interface {
+	// Begin reserves key for a request with the given fingerprint for at
+	// most ttl. It returns nil if the key is new, the stored response if
+	// a request with the key completed, ErrInProgress if one is still
+	// being handled and ErrMismatch if the fingerprint differs.
+	Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*Response, error)
+	// Complete stores the response to the request holding key, to be
+	// replayed for ttl.
+	Complete(ctx context.Context, key string, resp *Response, ttl time.Duration) error
+	// Release forgets key, so that the request can be tried again.
+	Release(ctx context.Context, key string) error
+}
+
+// Deduplicator is middleware that deduplicates requests by key.
+type Deduplicator struct {
+	store       Store
+	ttl         time.Duration
+	maxBodySize int64
+}
+
+// Option configures a Deduplicator.
+type Option func(*Deduplicator)
+
+// WithTTL sets how long keys and their responses are kept. The default is
+// 24 hours, which should outlast the caller's retries.
+func WithTTL(ttl time.Duration) Option {
+	return func(d *Deduplicator) {
+		d.ttl = ttl
+	}
+}
+
+// WithMaxBodySize sets the largest request body accepted with a key, since
+// bodies are read into memory to fingerprint the request. Larger requests
+// are rejected with 413 Request Entity Too Large. The default is 10 MiB.
+func WithMaxBodySize(n int64) Option {
+	return func(d *Deduplicator) {
+		d.maxBodySize = n
+	}
+}
+
+// New returns a Deduplicator that keeps keys in store.
+func New(store Store, opts ...Option) *Deduplicator {
+	d := &Deduplicator{store: store, ttl: 24 * time.Hour, maxBodySize: 10 << 20}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Middleware returns a handler that calls next once per key. Requests
+// without an Idempotency-Key header, and GET, HEAD and OPTIONS requests,
+// are passed through. Requests whose key is held by a request still being
+// handled are rejected with 409 Conflict, and requests reusing a key for a
+// different method, path or body with 422 Unprocessable Entity. Responses
+// with a 5xx status are not stored, so the caller's retry is handled
+// again.
+func (d *Deduplicator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" || !mutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, d.maxBodySize+1))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > d.maxBodySize {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scoped := scope(r, key)
+		stored, err := d.store.Begin(r.Context(), scoped, fingerprint(r, body), d.ttl)
+		switch {
+		case errors.Is(err, ErrInProgress):
+			log.Printf("Rejected request: idempotency key %q is in progress", key)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+			return
+		case errors.Is(err, ErrMismatch):
+			log.Printf("Rejected request: idempotency key %q reused for a different request", key)
+			http.Error(w, "Idempotency-Key reused with a different request", http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			log.Printf("Idempotency store failed: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		case stored != nil:
+			replay(w, stored)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			if !completed {
+				d.release(scoped)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+		if rec.status >= 500 {
+			return
+		}
+		resp := &Response{Status: rec.status, Header: w.Header().Clone(), Body: rec.body.Bytes()}
+		if err := d.store.Complete(context.Background(), scoped, resp, d.ttl); err != nil {
+			log.Printf("Failed to store response for idempotency key %q: %v", key, err)
+			return
+		}
+		completed = true
+	})
+}
+
+func (d *Deduplicator) release(key string) {
+	if err := d.store.Release(context.Background(), key); err != nil {
+		log.Printf("Failed to release idempotency key: %v", err)
+	}
+}
+
+func replay(w http.ResponseWriter, resp *Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+// scope qualifies key with the verified caller, so that callers cannot
+// see each other's responses by guessing keys.
+func scope(r *http.Request, key string) string {
+	caller := ""
+	if claims, ok := verify.ClaimsFromContext(r.Context()); ok {
+		caller = claims.Subject
+	}
+	return caller + "\x00" + key
+}
+
+// fingerprint identifies the request a key was used for.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\x00")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// recorder passes a response through to the client and keeps a copy.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,82 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps keys in memory. Each instance of the
+// service has its own, so retries routed to another instance are handled
+// again; implement Store over a shared database to deduplicate across
+// instances.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	// sweep is when expired entries are next removed.
+	sweep time.Time
+}
+
+type entry struct {
+	fingerprint string
+	resp        *Response
+	expires     time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*entry)}
+}
+
+// Begin implements Store.
+func (s *MemoryStore) Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.removeExpired(now)
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		switch {
+		case e.fingerprint != fingerprint:
+			return nil, ErrMismatch
+		case e.resp == nil:
+			return nil, ErrInProgress
+		default:
+			return e.resp, nil
+		}
+	}
+	s.entries[key] = &entry{fingerprint: fingerprint, expires: now.Add(ttl)}
+	return nil, nil
+}
+
+// Complete implements Store.
+func (s *MemoryStore) Complete(ctx context.Context, key string, resp *Response, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		e.resp = resp
+		e.expires = time.Now().Add(ttl)
+	}
+	return nil
+}
+
+// Release implements Store.
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// removeExpired drops expired entries, at most once a minute.
+func (s *MemoryStore) removeExpired(now time.Time) {
+	if now.Before(s.sweep) {
+		return
+	}
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+	s.sweep = now.Add(time.Minute)
+}
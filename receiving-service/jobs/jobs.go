@@ -0,0 +1,148 @@
+// Package jobs runs simulated long work in the background and serves its
+// status, for trying out callers that are answered with 202 Accepted and
+// poll a status endpoint until the work is done, or that have the result
+// sent to a callback, instead of holding a request open for minutes.
+//
+// Jobs are kept in the memory of the instance that started them, so a
+// poll served by another instance finds no job. Real services keep the
+// status in a shared store such as Firestore; for trying jobs out, deploy
+// with --session-affinity or --max-instances=1.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"receiver/callback"
+)
+
+// retention is how long finished jobs can still be polled.
+const retention = 10 * time.Minute
+
+// callbackTimeout bounds sending the result of a job to its callback.
+const callbackTimeout = time.Minute
+
+// Runner starts jobs and serves their status.
+type Runner struct {
+	duration   time.Duration
+	retryAfter time.Duration
+	callbacks  *callback.Sender
+
+	mu   sync.Mutex
+	jobs map[string]time.Time // job ID to the time the job finishes
+}
+
+// Option configures a Runner.
+type Option func(*Runner)
+
+// WithCallbacks sends the result of jobs started by calls that carry a
+// callback to its URL with s, once the job is done. Calls with a callback
+// that s does not allow are rejected.
+func WithCallbacks(s *callback.Sender) Option {
+	return func(run *Runner) {
+		run.callbacks = s
+	}
+}
+
+// New creates a Runner whose jobs take duration, and whose answers ask
+// callers to poll again after retryAfter.
+func New(duration, retryAfter time.Duration, opts ...Option) *Runner {
+	run := &Runner{duration: duration, retryAfter: retryAfter, jobs: make(map[string]time.Time)}
+	for _, opt := range opts {
+		opt(run)
+	}
+	return run
+}
+
+type status struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Result string `json:"result,omitempty"`
+}
+
+// ServeHTTP starts a job for requests to /jobs/, answering 202 Accepted
+// with the job's status URL in Location, and answers requests to
+// /jobs/{id} with 202 Accepted and the same Location while the job runs,
+// and 200 OK once it is done. Jobs can be started with GET as well as
+// POST, since the sending service relays with GET. The result of a job
+// started by a call carrying a callback is also sent to the callback.
+func (run *Runner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cb, hasCallback := callback.FromRequest(r)
+		if hasCallback && (run.callbacks == nil || !run.callbacks.Allowed(cb)) {
+			http.Error(w, "Callback URL not allowed", http.StatusBadRequest)
+			return
+		}
+		id = run.start()
+		if hasCallback {
+			time.AfterFunc(run.duration, func() { run.callBack(cb, id) })
+		}
+		run.write(w, http.StatusAccepted, status{ID: id, Status: "running"})
+		return
+	}
+
+	run.mu.Lock()
+	done, ok := run.jobs[id]
+	run.mu.Unlock()
+	switch {
+	case !ok:
+		http.Error(w, "Unknown job", http.StatusNotFound)
+	case time.Now().Before(done):
+		run.write(w, http.StatusAccepted, status{ID: id, Status: "running"})
+	default:
+		run.write(w, http.StatusOK, status{ID: id, Status: "done", Result: "Job " + id + " done"})
+	}
+}
+
+func (run *Runner) start() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	now := time.Now()
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	for other, done := range run.jobs {
+		if now.Sub(done) > retention {
+			delete(run.jobs, other)
+		}
+	}
+	run.jobs[id] = now.Add(run.duration)
+	return id
+}
+
+// callBack sends the result of the job id to cb.
+func (run *Runner) callBack(cb callback.Callback, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+	body, _ := json.Marshal(status{ID: id, Status: "done", Result: "Job " + id + " done"})
+	if err := run.callbacks.Send(ctx, cb, "application/json", body); err != nil {
+		log.Printf("Failed to send result of job %s to callback %s: %v", id, cb.ID, err)
+		return
+	}
+	log.Printf("Sent result of job %s to callback %s", id, cb.ID)
+}
+
+func (run *Runner) write(w http.ResponseWriter, code int, s status) {
+	if code == http.StatusAccepted {
+		w.Header().Set("Location", "/jobs/"+s.ID)
+		w.Header().Set("Retry-After", strconv.Itoa(int(run.retryAfter.Seconds())))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s)
+}
@@ -1,14 +1,502 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"errors"
+	"expvar"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"receiver/audit"
+	"receiver/callback"
+	"receiver/compression"
+	"receiver/envelope"
+	"receiver/handoff"
+	"receiver/idempotency"
+	"receiver/jobs"
+	"receiver/maintenance"
+	"receiver/pubsub"
+	"receiver/ratelimit"
+	"receiver/recovery"
+	"receiver/redisidempotency"
+	"receiver/redisreplay"
+	"receiver/scheduler"
+	"receiver/validation"
+	"receiver/verify"
 )
 
+// apiSpec is the OpenAPI spec of the service's routes, which requests are
+// validated against with REQUEST_VALIDATION=true.
+//
+//go:embed openapi.yaml
+var apiSpec []byte
+
 func main() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// closeAudit, if set, sends buffered audit events on shutdown.
+	var closeAudit func() error
+	// authenticate wraps the handlers that require a verified ID token.
+	authenticate := func(h http.Handler) http.Handler { return h }
+	var hello http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "Hello from the receiving service!")
 	})
+	// protect wraps the authenticated routes, / and the jobs runner, in
+	// the middleware that checks and decodes their bodies. Each use adds
+	// one around those before it, so request validation, added first, sees
+	// decoded bodies.
+	protect := func(h http.Handler) http.Handler { return h }
+	use := func(m func(http.Handler) http.Handler) {
+		inner := protect
+		protect = func(h http.Handler) http.Handler { return m(inner(h)) }
+	}
+	if os.Getenv("REQUEST_VALIDATION") == "true" {
+		var opts []validation.Option
+		if v := os.Getenv("REQUEST_VALIDATION_MAX_BODY"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid REQUEST_VALIDATION_MAX_BODY: %v", err)
+			}
+			opts = append(opts, validation.WithMaxBodySize(n))
+		}
+		var validator *validation.Validator
+		var err error
+		if path := os.Getenv("REQUEST_VALIDATION_SPEC"); path != "" {
+			validator, err = validation.Load(path, opts...)
+		} else {
+			validator, err = validation.Parse(apiSpec, opts...)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		use(validator.Middleware)
+	}
+	if os.Getenv("IDEMPOTENCY_ENABLED") == "true" {
+		var opts []idempotency.Option
+		if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+			ttl, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("Invalid IDEMPOTENCY_TTL: %v", err)
+			}
+			opts = append(opts, idempotency.WithTTL(ttl))
+		}
+		var store idempotency.Store = idempotency.NewMemoryStore()
+		if addr := os.Getenv("IDEMPOTENCY_REDIS_ADDR"); addr != "" {
+			store = redisidempotency.New(redis.NewClient(redisOptions("IDEMPOTENCY_REDIS", addr)), "idempotency:")
+		}
+		use(idempotency.New(store, opts...).Middleware)
+	}
+	if os.Getenv("COMPRESSION_ENABLED") == "true" {
+		var opts []compression.Option
+		if v := os.Getenv("COMPRESSION_MIN_SIZE"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				log.Fatalf("Invalid COMPRESSION_MIN_SIZE: %v", err)
+			}
+			opts = append(opts, compression.WithMinSize(n))
+		}
+		use(compression.New(opts...).Middleware)
+	}
+	if buckets := os.Getenv("HANDOFF_BUCKETS"); buckets != "" {
+		var opts []handoff.Option
+		if v := os.Getenv("HANDOFF_MAX_SIZE"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				log.Fatalf("Invalid HANDOFF_MAX_SIZE: %v", err)
+			}
+			opts = append(opts, handoff.WithMaxSize(n))
+		}
+		use(handoff.New(strings.Split(buckets, ","), opts...).Middleware)
+	}
+	if signer := os.Getenv("REQUIRE_SIGNATURE_FROM"); signer != "" {
+		use(verify.NewSignatureVerifier(verify.NewKeySet(verify.ServiceAccountKeysURL(signer), nil)).Middleware)
+	}
+	if wrapper := envelopeKeys(); wrapper != nil {
+		opts := []envelope.Option{envelope.WithMaxBodySize(envInt64("ENCRYPTION_MAX_BODY_SIZE", 10<<20))}
+		if os.Getenv("ENCRYPTION_REQUIRED") == "true" {
+			opts = append(opts, envelope.WithRequired())
+		}
+		use(envelope.New(wrapper, opts...).Middleware)
+	}
+	hello = protect(hello)
+	if audience := os.Getenv("EXPECTED_AUDIENCE"); audience != "" {
+		if audience == verify.AutoAudience {
+			derived, err := verify.CloudRunAudience()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Expecting ID tokens for %s", derived)
+			audience = derived
+		}
+		allowlist, err := verify.AllowlistFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := []verify.Option{verify.WithAllowlist(allowlist)}
+		if os.Getenv("OFFLINE_VERIFICATION") == "true" {
+			keys := verify.NewKeySet(verify.GoogleCertsURL, nil)
+			expvar.Publish("jwks", expvar.Func(func() interface{} { return keys.Stats() }))
+			opts = append(opts, verify.WithKeySet(keys))
+		}
+		if os.Getenv("ACCEPT_SERVERLESS_AUTHORIZATION") == "true" {
+			opts = append(opts, verify.WithServerlessAuthorization())
+		}
+		if v := os.Getenv("CLOCK_SKEW"); v != "" {
+			skew, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("Invalid CLOCK_SKEW: %v", err)
+			}
+			opts = append(opts, verify.WithClockSkew(skew))
+		}
+		if os.Getenv("REPLAY_PROTECTION") == "true" {
+			var store verify.ReplayStore = verify.NewMemoryReplayStore()
+			if addr := os.Getenv("REPLAY_REDIS_ADDR"); addr != "" {
+				store = redisreplay.New(redis.NewClient(redisOptions("REPLAY_REDIS", addr)), "replay:")
+			}
+			var window time.Duration
+			if v := os.Getenv("REPLAY_WINDOW"); v != "" {
+				var err error
+				if window, err = time.ParseDuration(v); err != nil {
+					log.Fatalf("Invalid REPLAY_WINDOW: %v", err)
+				}
+			}
+			opts = append(opts, verify.WithReplayProtection(store, window))
+		}
+		if os.Getenv("AUDIT_ENABLED") == "true" {
+			var sink audit.Sink = audit.NewLogSink(os.Stdout)
+			if table := os.Getenv("AUDIT_BIGQUERY_TABLE"); table != "" {
+				bq, err := audit.NewBigQuerySink(context.Background(), table)
+				if err != nil {
+					log.Fatal(err)
+				}
+				closeAudit = bq.Close
+				sink = bq
+			}
+			allowRate, denyRate := sampleRate("AUDIT_SAMPLE_RATE"), sampleRate("AUDIT_DENY_SAMPLE_RATE")
+			opts = append(opts, verify.WithAudit(audit.New(sink, audit.WithSampling(allowRate, denyRate))))
+		}
+		if os.Getenv("TLS_CLIENT_CA_FILE") != "" {
+			var bindings verify.CertBindings
+			if path := os.Getenv("CLIENT_CERT_BINDINGS_FILE"); path != "" {
+				var err error
+				if bindings, err = verify.LoadCertBindings(path); err != nil {
+					log.Fatal(err)
+				}
+			}
+			opts = append(opts, verify.WithClientCertificates(bindings))
+		}
+		if userAudience := os.Getenv("FORWARDED_USER_AUDIENCE"); userAudience != "" {
+			opts = append(opts, verify.WithForwardedUser(verify.New(userAudience)))
+		}
+		verifier := verify.New(audience, opts...)
+		expvar.Publish("verify", expvar.Func(func() interface{} { return verifier.Stats() }))
+		limit := func(h http.Handler) http.Handler { return h }
+		if policy := callerRateLimits(); policy != nil {
+			limit = ratelimit.New(policy).Middleware
+		}
+		gate := func(h http.Handler) http.Handler { return h }
+		if path := os.Getenv("MAINTENANCE_FILE"); path != "" {
+			mode, err := maintenance.Load(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			expvar.Publish("maintenance", expvar.Func(func() interface{} { return mode.Stats() }))
+			go mode.Watch(context.Background(), envDuration("MAINTENANCE_RELOAD_INTERVAL", 10*time.Second))
+			reload := make(chan os.Signal, 1)
+			signal.Notify(reload, syscall.SIGHUP)
+			go func() {
+				for range reload {
+					if err := mode.Reload(); err != nil {
+						log.Printf("Keeping the current maintenance config: %v", err)
+					}
+				}
+			}()
+			gate = mode.Middleware
+		}
+		authenticate = func(h http.Handler) http.Handler {
+			return verifier.Middleware(verify.LogRequests(gate(limit(h))))
+		}
+		hello = authenticate(hello)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", hello)
+	expvar.Publish("panics", &recovery.Panics)
+	if callers := os.Getenv("DEBUG_VARS_CALLERS"); callers != "" {
+		// The variables include the command line and the verifier's
+		// counters, so only the callers named may read them.
+		if os.Getenv("EXPECTED_AUDIENCE") == "" {
+			log.Fatal("DEBUG_VARS_CALLERS needs EXPECTED_AUDIENCE")
+		}
+		admins := verify.Allowlist{Emails: strings.Split(callers, ",")}
+		mux.Handle("/debug/vars", authenticate(admins.Require(expvar.Handler())))
+	}
+
+	if os.Getenv("JOBS_ENABLED") == "true" {
+		duration, retryAfter := 2*time.Minute, 10*time.Second
+		if v := os.Getenv("JOBS_DURATION"); v != "" {
+			var err error
+			if duration, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("Invalid JOBS_DURATION: %v", err)
+			}
+		}
+		if v := os.Getenv("JOBS_RETRY_AFTER"); v != "" {
+			var err error
+			if retryAfter, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("Invalid JOBS_RETRY_AFTER: %v", err)
+			}
+		}
+		var opts []jobs.Option
+		if v := os.Getenv("CALLBACK_ALLOWED_URLS"); v != "" {
+			opts = append(opts, jobs.WithCallbacks(callback.NewSender(strings.Split(v, ","))))
+		}
+		runner := authenticate(protect(jobs.New(duration, retryAfter, opts...)))
+		mux.Handle("/jobs", runner)
+		mux.Handle("/jobs/", runner)
+	}
+
+	if audience := os.Getenv("PUBSUB_PUSH_AUDIENCE"); audience != "" {
+		sa := os.Getenv("PUBSUB_PUSH_SERVICE_ACCOUNT")
+		if sa == "" {
+			log.Fatal("PUBSUB_PUSH_SERVICE_ACCOUNT must be set with PUBSUB_PUSH_AUDIENCE")
+		}
+		mux.Handle("/pubsub/push", pubsub.NewPushHandler(audience, sa, func(ctx context.Context, req *pubsub.PushRequest) error {
+			log.Printf("Received message %s from %s: %s", req.Message.MessageID, req.Subscription, req.Message.Data)
+			return nil
+		}))
+	}
+
+	if audience := os.Getenv("SCHEDULER_AUDIENCE"); audience != "" {
+		callers := strings.Split(os.Getenv("SCHEDULER_SERVICE_ACCOUNTS"), ",")
+		if os.Getenv("SCHEDULER_SERVICE_ACCOUNTS") == "" {
+			log.Fatal("SCHEDULER_SERVICE_ACCOUNTS must be set with SCHEDULER_AUDIENCE")
+		}
+		mux.Handle("/scheduler/", scheduler.New(audience, callers).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			job := scheduler.JobFromRequest(r)
+			log.Printf("Running scheduled job %s (scheduled for %s)", job.Name, job.ScheduleTime)
+			w.WriteHeader(http.StatusNoContent)
+		})))
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	var handler http.Handler = mux
+	if n := envInt64("SERVER_MAX_REQUEST_BODY", 32<<20); n > 0 {
+		handler = limitBody(handler, n)
+	}
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           recovery.Middleware(handler),
+		ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("SERVER_READ_TIMEOUT", 0),
+		WriteTimeout:      envDuration("SERVER_WRITE_TIMEOUT", 0),
+		IdleTimeout:       envDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		MaxHeaderBytes:    int(envInt64("SERVER_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)),
+	}
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile != "" {
+		srv.TLSConfig = serverTLSConfig()
+	} else if os.Getenv("TLS_CLIENT_CA_FILE") != "" {
+		log.Fatal("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down gracefully: %v", err)
+			srv.Close()
+		}
+		if closeAudit != nil {
+			if err := closeAudit(); err != nil {
+				log.Printf("Failed to write audit events: %v", err)
+			}
+		}
+	}()
+
+	var err error
+	if certFile != "" {
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// sampleRate returns the fraction of requests to audit set in the named
+// environment variable, or 1 if it is empty.
+func sampleRate(name string) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return 1
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		log.Fatalf("Invalid %s: must be a number between 0 and 1", name)
+	}
+	return rate
+}
+
+// callerRateLimits returns the per-caller rate limits from the file named
+// by CALLER_RATE_LIMITS_FILE, or a default quota for every caller from
+// CALLER_RATE_LIMIT_RPS and CALLER_RATE_LIMIT_BURST, or nil if neither is
+// set.
+func callerRateLimits() *ratelimit.Policy {
+	if path := os.Getenv("CALLER_RATE_LIMITS_FILE"); path != "" {
+		policy, err := ratelimit.Load(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return policy
+	}
+	v := os.Getenv("CALLER_RATE_LIMIT_RPS")
+	if v == "" {
+		return nil
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps <= 0 {
+		log.Fatalf("Invalid CALLER_RATE_LIMIT_RPS: must be a positive number")
+	}
+	return &ratelimit.Policy{Default: ratelimit.Quota{RPS: rps, Burst: int(envInt64("CALLER_RATE_LIMIT_BURST", 0))}}
+}
+
+// serverTLSConfig returns the TLS configuration of the server when it
+// terminates TLS itself, outside Cloud Run, such as on GKE or a VM. With
+// TLS_CLIENT_CA_FILE set, clients must present a certificate issued by one
+// of the CAs in it.
+func serverTLSConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	path := os.Getenv("TLS_CLIENT_CA_FILE")
+	if path == "" {
+		return cfg
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read TLS_CLIENT_CA_FILE: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Fatalf("No certificates in TLS_CLIENT_CA_FILE %s", path)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	log.Printf("Requiring client certificates issued by the CAs in %s", path)
+	return cfg
+}
+
+// redisOptions returns the options of the Redis instance at addr, such as
+// Memorystore, with the AUTH string in prefix_PASSWORD and, with
+// prefix_TLS=true or a CA file in prefix_TLS_CA_FILE, in-transit
+// encryption. Memorystore's certificates are issued by its own server CA,
+// which must be given in the file.
+func redisOptions(prefix, addr string) *redis.Options {
+	opts := &redis.Options{Addr: addr, Password: os.Getenv(prefix + "_PASSWORD")}
+	caFile := os.Getenv(prefix + "_TLS_CA_FILE")
+	if caFile == "" && os.Getenv(prefix+"_TLS") != "true" {
+		return opts
+	}
+	opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			log.Fatalf("Failed to read %s_TLS_CA_FILE: %v", prefix, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates in %s_TLS_CA_FILE %s", prefix, caFile)
+		}
+		opts.TLSConfig.RootCAs = pool
+	}
+	return opts
+}
 
-	http.ListenAndServe(":8080", nil)
+// envelopeKeys returns the key wrapper of the Cloud KMS key in
+// ENCRYPTION_KMS_KEY or the keyset in ENCRYPTION_KEYSET_FILE, or nil if
+// neither is set.
+func envelopeKeys() envelope.KeyWrapper {
+	kmsKey, keysetFile := os.Getenv("ENCRYPTION_KMS_KEY"), os.Getenv("ENCRYPTION_KEYSET_FILE")
+	switch {
+	case kmsKey != "" && keysetFile != "":
+		log.Fatal("ENCRYPTION_KMS_KEY and ENCRYPTION_KEYSET_FILE are mutually exclusive")
+	case keysetFile != "":
+		keyset, err := envelope.LoadKeyset(keysetFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return keyset
+	case kmsKey != "":
+		wrapper, err := envelope.NewKMSKeyWrapper(context.Background(), kmsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return wrapper
+	}
+	return nil
+}
+
+// envDuration returns the duration in the named environment variable, or
+// def if it is empty.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatalf("Invalid %s: must be a non-negative duration", name)
+	}
+	return d
+}
+
+// envInt64 returns the integer in the named environment variable, or def
+// if it is empty.
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid %s: must be a non-negative integer", name)
+	}
+	return n
+}
+
+// limitBody rejects requests declaring a body larger than n bytes with 413
+// Request Entity Too Large, and limits the others to n bytes, so that
+// handlers reading past it get an *http.MaxBytesError.
+func limitBody(next http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			log.Printf("Rejected request body of %d bytes", r.ContentLength)
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
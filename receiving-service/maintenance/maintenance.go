@@ -0,0 +1,326 @@
+// Package maintenance puts the service into maintenance mode, in which
+// verified callers other than those allowed through are answered with 503
+// Service Unavailable, and gates features by caller identity. Both are
+// read from a YAML file that is reloaded while the service runs, so that a
+// migration can drain callers and let the migrating ones through without
+// a redeploy. It is meant to run after the verify middleware, which
+// authenticates the caller.
+package maintenance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"receiver/verify"
+)
+
+// defaultRetryAfter is the Retry-After of maintenance responses when the
+// config sets none.
+const defaultRetryAfter = time.Minute
+
+// defaultMessage is the message of maintenance responses when the config
+// sets none.
+const defaultMessage = "The service is down for maintenance"
+
+// Config is the maintenance state of the service and its feature flags.
+type Config struct {
+	// Enabled puts the service into maintenance mode.
+	Enabled bool `yaml:"enabled"`
+	// Message is the message of the responses to rejected callers.
+	Message string `yaml:"message"`
+	// RetryAfter is how long rejected callers are asked to wait, one
+	// minute by default.
+	RetryAfter time.Duration `yaml:"retry_after"`
+	// Allow lists the verified emails of the callers let through in
+	// maintenance mode, compared case-insensitively. They may be
+	// path.Match patterns, such as *@my-project.iam.gserviceaccount.com.
+	Allow []string `yaml:"allow"`
+	// Features maps feature names to the callers they are enabled for,
+	// given as in Allow.
+	Features map[string][]string `yaml:"features"`
+}
+
+// Validate checks that the caller patterns are valid and the retry delay
+// is not negative.
+func (c *Config) Validate() error {
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("maintenance: retry_after must not be negative")
+	}
+	for _, pattern := range c.Allow {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			return fmt.Errorf("maintenance: invalid caller pattern %q", pattern)
+		}
+	}
+	for feature, callers := range c.Features {
+		if feature == "" {
+			return fmt.Errorf("maintenance: feature names must not be empty")
+		}
+		for _, pattern := range callers {
+			if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+				return fmt.Errorf("maintenance: invalid caller pattern %q of feature %s", pattern, feature)
+			}
+		}
+	}
+	return nil
+}
+
+// Parse reads a Config from YAML of the form
+//
+//	enabled: true
+//	message: Orders are moving to orders-v2
+//	retry_after: 5m
+//	allow:
+//	  - migrator@my-project.iam.gserviceaccount.com
+//	features:
+//	  bulk-export: ["*@batch-project.iam.gserviceaccount.com"]
+func Parse(data []byte) (*Config, error) {
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("maintenance: failed to parse config: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Mode holds the Config read from a file and reloads it when the file
+// changes.
+type Mode struct {
+	path   string
+	config atomic.Pointer[Config]
+
+	mu       sync.Mutex
+	data     []byte
+	loadedAt time.Time
+	reloads  int64
+	failures int64
+	lastErr  string
+	rejected atomic.Int64
+}
+
+// Load reads the Config in the file at path, as Parse describes.
+func Load(path string) (*Mode, error) {
+	m := &Mode{path: path}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Config returns the Config in effect.
+func (m *Mode) Config() *Config {
+	return m.config.Load()
+}
+
+// Reload reads the file again and puts its Config in effect if it changed.
+// If the file cannot be read or is invalid, the Config in effect is kept
+// and the error returned.
+func (m *Mode) Reload() error {
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		err = fmt.Errorf("maintenance: failed to read config: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil && m.config.Load() != nil && bytes.Equal(data, m.data) {
+		return nil
+	}
+	var c *Config
+	if err == nil {
+		c, err = Parse(data)
+	}
+	if err != nil {
+		m.failures++
+		m.lastErr = err.Error()
+		return err
+	}
+	previous := m.config.Load()
+	m.config.Store(c)
+	m.data, m.loadedAt, m.lastErr = data, time.Now(), ""
+	if previous != nil {
+		m.reloads++
+		if previous.Enabled != c.Enabled {
+			log.Printf("Maintenance mode %s by %s", onOff(c.Enabled), m.path)
+		} else {
+			log.Printf("Reloaded maintenance config %s", m.path)
+		}
+	} else if c.Enabled {
+		log.Printf("Maintenance mode on by %s", m.path)
+	}
+	return nil
+}
+
+// Watch reloads the file every interval until ctx is done, logging the
+// errors of reloads that fail.
+func (m *Mode) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Reload(); err != nil {
+				log.Printf("Keeping the current maintenance config: %v", err)
+			}
+		}
+	}
+}
+
+// Stats describes the Config in effect and its reloads, for expvar.
+type Stats struct {
+	Enabled        bool      `json:"enabled"`
+	LoadedAt       time.Time `json:"loaded_at"`
+	Reloads        int64     `json:"reloads"`
+	ReloadFailures int64     `json:"reload_failures"`
+	LastError      string    `json:"last_error,omitempty"`
+	Rejected       int64     `json:"rejected"`
+}
+
+// Stats returns the current Stats.
+func (m *Mode) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Stats{
+		Enabled:        m.config.Load().Enabled,
+		LoadedAt:       m.loadedAt,
+		Reloads:        m.reloads,
+		ReloadFailures: m.failures,
+		LastError:      m.lastErr,
+		Rejected:       m.rejected.Load(),
+	}
+}
+
+// Middleware answers requests with 503 Service Unavailable, a Retry-After
+// header and a JSON body while maintenance mode is on, unless the caller
+// is allowed through. Requests without a verified email are never allowed
+// through. It must be wrapped by the verify middleware.
+func (m *Mode) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := m.config.Load()
+		if !c.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		email := callerEmail(r)
+		if matches(c.Allow, email) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.rejected.Add(1)
+		log.Printf("Rejected request from caller %s: maintenance mode", describe(email))
+		writeUnavailable(w, c)
+	})
+}
+
+// Enabled reports whether feature is enabled for the caller of r. It must
+// be called inside the verify middleware.
+func (m *Mode) Enabled(r *http.Request, feature string) bool {
+	return matches(m.config.Load().Features[feature], callerEmail(r))
+}
+
+// Require wraps next so that only callers feature is enabled for reach
+// it; the others are answered with 404 Not Found and a JSON body, as if
+// the route did not exist. It must run inside the verify middleware.
+func (m *Mode) Require(feature string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Enabled(r, feature) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("Rejected request from caller %s: feature %s is not enabled for it", describe(callerEmail(r)), feature)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(featureError{
+			Error:   "feature_disabled",
+			Message: "Not found",
+			Feature: feature,
+		})
+	})
+}
+
+type unavailableError struct {
+	Error             string `json:"error"`
+	Message           string `json:"message"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"`
+}
+
+type featureError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Feature string `json:"feature"`
+}
+
+func writeUnavailable(w http.ResponseWriter, c *Config) {
+	message, retryAfter := c.Message, c.RetryAfter
+	if message == "" {
+		message = defaultMessage
+	}
+	if retryAfter == 0 {
+		retryAfter = defaultRetryAfter
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(unavailableError{
+		Error:             "maintenance",
+		Message:           message,
+		RetryAfterSeconds: seconds,
+	})
+}
+
+// callerEmail returns the verified email of the caller of r, or "".
+func callerEmail(r *http.Request) string {
+	claims, ok := verify.ClaimsFromContext(r.Context())
+	if !ok || !claims.EmailVerified {
+		return ""
+	}
+	return strings.ToLower(claims.Email)
+}
+
+// describe names the caller with the given email in logs.
+func describe(email string) string {
+	if email == "" {
+		return "without a verified email"
+	}
+	return email
+}
+
+// matches reports whether email, in lower case, is one of callers or
+// matches one of their patterns.
+func matches(callers []string, email string) bool {
+	if email == "" {
+		return false
+	}
+	for _, pattern := range callers {
+		if ok, _ := path.Match(strings.ToLower(pattern), email); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
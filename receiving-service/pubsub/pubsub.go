@@ -0,0 +1,70 @@
+// Package pubsub implements an authenticated endpoint for Pub/Sub push
+// subscriptions. Pub/Sub signs each push request with an OIDC token for
+// the subscription's service account; the handler verifies the token
+// before decoding the message.
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"receiver/verify"
+)
+
+// maxEnvelopeSize bounds push request bodies. Pub/Sub messages are at most
+// 10 MB, and the data is base64-encoded in the envelope.
+const maxEnvelopeSize = 14 << 20
+
+// Message is a Pub/Sub message as delivered in a push request.
+type Message struct {
+	// Data is the message payload, decoded from base64.
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	MessageID   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
+	OrderingKey string            `json:"orderingKey"`
+}
+
+// PushRequest is the JSON envelope of a push request.
+type PushRequest struct {
+	Message         Message `json:"message"`
+	Subscription    string  `json:"subscription"`
+	DeliveryAttempt int     `json:"deliveryAttempt"`
+}
+
+// HandlerFunc processes a verified push request. Returning an error makes
+// Pub/Sub redeliver the message.
+type HandlerFunc func(ctx context.Context, req *PushRequest) error
+
+// NewPushHandler returns an http.Handler for a push subscription. Requests
+// must carry an ID token for audience, the audience configured on the
+// subscription, issued to serviceAccount, the subscription's push
+// authentication service account.
+func NewPushHandler(audience, serviceAccount string, h HandlerFunc) http.Handler {
+	push := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req PushRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEnvelopeSize)).Decode(&req); err != nil {
+			log.Printf("Failed to decode push request: %v", err)
+			http.Error(w, "Invalid push request", http.StatusBadRequest)
+			return
+		}
+
+		if err := h(r.Context(), &req); err != nil {
+			log.Printf("Failed to process message %s: %v", req.Message.MessageID, err)
+			http.Error(w, "Failed to process message", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return verify.New(audience, verify.WithAllowedCallers(serviceAccount)).Middleware(push)
+}
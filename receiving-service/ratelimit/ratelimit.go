@@ -0,0 +1,203 @@
+// Package ratelimit limits the rate of requests of each verified caller,
+// by the service-account email of its ID token, so that one noisy
+// internal client cannot starve the others. It is meant to run after the
+// verify middleware, which authenticates the caller.
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+
+	"receiver/verify"
+)
+
+// idleTimeout is how long a caller's bucket is kept after its last use.
+const idleTimeout = 3 * time.Minute
+
+// Quota is the rate a caller may send requests at.
+type Quota struct {
+	// RPS is the sustained number of requests per second. Zero or less
+	// leaves the caller unlimited.
+	RPS float64 `yaml:"rps"`
+	// Burst is how many requests may be sent at once above the rate. It
+	// defaults to RPS, and to 1 for rates below one request per second.
+	Burst int `yaml:"burst"`
+}
+
+func (q Quota) burst() int {
+	if q.Burst > 0 {
+		return q.Burst
+	}
+	return int(math.Max(1, math.Ceil(q.RPS)))
+}
+
+// Policy gives callers their quotas.
+type Policy struct {
+	// Default is the quota of each caller with none of its own.
+	Default Quota `yaml:"default"`
+	// Callers maps verified service-account emails to their quotas. Emails may be
+	// path.Match patterns, such as *@my-project.iam.gserviceaccount.com;
+	// a caller gets the quota of its exact email if it has one, and
+	// otherwise that of the first pattern it matches in sorted order.
+	Callers map[string]Quota `yaml:"callers"`
+}
+
+// Load reads a Policy from a YAML file of the form
+//
+//	default:
+//	  rps: 50
+//	callers:
+//	  batch@my-project.iam.gserviceaccount.com: {rps: 5, burst: 10}
+//	  frontend@my-project.iam.gserviceaccount.com: {rps: 200}
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: failed to read policy: %w", err)
+	}
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("ratelimit: failed to parse policy %s: %w", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks that the caller patterns are valid and no burst is
+// negative.
+func (p *Policy) Validate() error {
+	if p.Default.Burst < 0 {
+		return fmt.Errorf("ratelimit: default burst must not be negative")
+	}
+	for email, q := range p.Callers {
+		if _, err := path.Match(email, ""); err != nil {
+			return fmt.Errorf("ratelimit: invalid caller pattern %q", email)
+		}
+		if q.Burst < 0 {
+			return fmt.Errorf("ratelimit: burst of caller %s must not be negative", email)
+		}
+	}
+	return nil
+}
+
+// quotaFor returns the quota of the caller with the given email.
+func (p *Policy) quotaFor(email string) Quota {
+	var patterns []string
+	for pattern, q := range p.Callers {
+		if strings.EqualFold(pattern, email) {
+			return q
+		}
+		if strings.ContainsAny(pattern, "*?[") {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(email)); ok {
+			return p.Callers[pattern]
+		}
+	}
+	return p.Default
+}
+
+// Limiter enforces the quotas of a Policy.
+type Limiter struct {
+	policy *Policy
+
+	mu        sync.Mutex
+	callers   map[string]*caller
+	lastSweep time.Time
+}
+
+type caller struct {
+	// limiter is nil for unlimited callers.
+	limiter  *rate.Limiter
+	quota    Quota
+	lastSeen time.Time
+}
+
+// New creates a Limiter for p.
+func New(p *Policy) *Limiter {
+	return &Limiter{policy: p, callers: make(map[string]*caller), lastSweep: time.Now()}
+}
+
+// Middleware rejects the requests of callers over their quota with 429 Too
+// Many Requests and a Retry-After header. Limited callers' responses carry
+// RateLimit-Limit and RateLimit-Remaining headers. It must be wrapped by
+// the verify middleware; requests without a verified caller are rejected
+// with 401 Unauthorized.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := verify.ClaimsFromContext(r.Context())
+		if !ok {
+			log.Printf("Rejected request: no verified caller to rate limit")
+			http.Error(w, "Unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		email, key := "", "sub:"+claims.Subject
+		if claims.EmailVerified && claims.Email != "" {
+			email, key = claims.Email, strings.ToLower(claims.Email)
+		}
+		c := l.callerFor(key, email)
+		if c.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		res := c.limiter.ReserveN(now, 1)
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(c.quota.burst()))
+		if delay := res.DelayFrom(now); !res.OK() || delay > 0 {
+			res.CancelAt(now)
+			h.Set("RateLimit-Remaining", "0")
+			h.Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			log.Printf("Rate limited caller %s: over %v requests per second", key, c.quota.RPS)
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, c.limiter.TokensAt(now)))))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// callerFor returns the bucket of the caller with the given key, whose
+// limiter is nil if the caller is unlimited.
+func (l *Limiter) callerFor(key, email string) *caller {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > idleTimeout {
+		for k, c := range l.callers {
+			if now.Sub(c.lastSeen) > idleTimeout {
+				delete(l.callers, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.callers[key]
+	if !ok {
+		c = &caller{quota: l.policy.quotaFor(email)}
+		if c.quota.RPS > 0 {
+			c.limiter = rate.NewLimiter(rate.Limit(c.quota.RPS), c.quota.burst())
+		}
+		l.callers[key] = c
+	}
+	c.lastSeen = now
+	return c
+}
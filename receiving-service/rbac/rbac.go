@@ -0,0 +1,134 @@
+// Package rbac authorizes verified callers by role: a Policy maps caller
+// service-account emails to roles, and roles to the permissions they
+// grant. It is meant to run after the verify middleware, which
+// authenticates the caller.
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"receiver/verify"
+)
+
+// Policy maps callers to roles and roles to permissions.
+type Policy struct {
+	// Roles maps each role to the permissions it grants, such as
+	// orders.read.
+	Roles map[string][]string `yaml:"roles"`
+	// Callers maps service-account emails to their roles.
+	Callers map[string][]string `yaml:"callers"`
+}
+
+// Load reads a Policy from a YAML file of the form
+//
+//	roles:
+//	  reader: [orders.read]
+//	callers:
+//	  reporting@my-project.iam.gserviceaccount.com: [reader]
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("rbac: failed to read policy: %w", err)
+	}
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("rbac: failed to parse policy %s: %w", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks that every role given to a caller is defined.
+func (p *Policy) Validate() error {
+	for _, email := range sortedKeys(p.Callers) {
+		for _, role := range p.Callers[email] {
+			if _, ok := p.Roles[role]; !ok {
+				return fmt.Errorf("rbac: caller %s has undefined role %q", email, role)
+			}
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the caller with the given claims holds perm
+// through one of its roles. Callers are identified by their verified
+// email, compared case-insensitively.
+func (p *Policy) Allows(c *verify.Claims, perm string) bool {
+	if !c.EmailVerified || c.Email == "" {
+		return false
+	}
+	for email, roles := range p.Callers {
+		if !strings.EqualFold(email, c.Email) {
+			continue
+		}
+		for _, role := range roles {
+			for _, granted := range p.Roles[role] {
+				if granted == perm {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Require returns a handler that calls next only for callers holding perm,
+// and rejects other callers with 403 Forbidden. It must be wrapped by the
+// verify middleware, which stores the caller's claims in the request
+// context; requests without claims are rejected with 401 Unauthorized.
+func (p *Policy) Require(perm string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := verify.ClaimsFromContext(r.Context())
+		if !ok {
+			log.Printf("Rejected request: no verified caller for %s", perm)
+			http.Error(w, "Unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		if !p.Allows(claims, perm) {
+			log.Printf("Rejected request: caller %q lacks permission %s", claims.Email, perm)
+			writeForbidden(w, claims.Email, perm)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forbiddenError is the body of a 403 response for a caller that lacks a
+// permission.
+type forbiddenError struct {
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	Email      string `json:"email,omitempty"`
+	Permission string `json:"permission"`
+}
+
+func writeForbidden(w http.ResponseWriter, email, perm string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(forbiddenError{
+		Error:      "permission_denied",
+		Message:    "Caller does not have the required permission",
+		Email:      email,
+		Permission: perm,
+	})
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,157 @@
+// Package recovery recovers panics in the receiving service's handlers,
+// reporting them to Error Reporting and answering 500 in place of the
+// connection the handler would have dropped.
+package recovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+// reportedErrorEvent is the type that makes Error Reporting pick up a log
+// entry whose message is a stack trace.
+const reportedErrorEvent = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+
+// Panics counts the panics recovered by Middleware. Publish it with
+// expvar.Publish to serve it on /debug/vars.
+var Panics expvar.Int
+
+// mu serializes writes of events to os.Stderr.
+var mu sync.Mutex
+
+// event is a log entry in the format Cloud Logging and Error Reporting
+// read from a container's output.
+type event struct {
+	Severity       string         `json:"severity"`
+	Message        string         `json:"message"`
+	Type           string         `json:"@type"`
+	ServiceContext serviceContext `json:"serviceContext"`
+	Context        eventContext   `json:"context"`
+}
+
+type serviceContext struct {
+	Service string `json:"service"`
+	Version string `json:"version,omitempty"`
+}
+
+type eventContext struct {
+	HTTPRequest httpRequest `json:"httpRequest"`
+}
+
+type httpRequest struct {
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	UserAgent string `json:"userAgent,omitempty"`
+	RemoteIP  string `json:"remoteIp,omitempty"`
+}
+
+// internalError is the body of the 500 response sent for a recovered
+// panic.
+type internalError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Middleware recovers panics in next. Each panic is written to os.Stderr
+// as a JSON Error Reporting event carrying the stack trace, the request
+// and the service and revision from K_SERVICE and K_REVISION, and counted
+// in Panics, and the caller gets 500 unless the response was already
+// started. Panics with http.ErrAbortHandler, which abort a response on
+// purpose, are passed on.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			report(r, fmt.Sprintf("panic: %v\n\n%s", v, debug.Stack()))
+			Panics.Add(1)
+			if !rec.started {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("X-Content-Type-Options", "nosniff")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(internalError{Error: "internal", Message: "Internal server error"})
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func report(r *http.Request, message string) {
+	service := os.Getenv("K_SERVICE")
+	if service == "" {
+		service = "receiving-service"
+	}
+	data, err := json.Marshal(event{
+		Severity:       "ERROR",
+		Message:        message,
+		Type:           reportedErrorEvent,
+		ServiceContext: serviceContext{Service: service, Version: os.Getenv("K_REVISION")},
+		Context: eventContext{HTTPRequest: httpRequest{
+			Method:    r.Method,
+			URL:       r.URL.String(),
+			UserAgent: r.UserAgent(),
+			RemoteIP:  r.RemoteAddr,
+		}},
+	})
+	if err != nil {
+		log.Print(message)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	os.Stderr.Write(append(data, '\n'))
+}
+
+// responseRecorder records whether a response was started, after which
+// no error response can be sent.
+type responseRecorder struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.started = true
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.started = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Flush() {
+	r.started = true
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket connections through the middleware.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.started = true
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
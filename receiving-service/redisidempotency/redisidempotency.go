@@ -0,0 +1,92 @@
+// Package redisidempotency keeps the idempotency keys of the receiving
+// service and the responses to them in Redis, for example Memorystore, so
+// that a retry is deduplicated whichever instance it reaches.
+package redisidempotency
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"receiver/idempotency"
+)
+
+var _ idempotency.Store = (*Store)(nil)
+
+// Each key is a hash with the fingerprint of the request that reserved it
+// and, once that request completes, its response as JSON.
+var (
+	// begin reserves KEYS[1] for the fingerprint ARGV[1] for ARGV[2]
+	// milliseconds, returning nothing if it was free and the fingerprint
+	// and response already stored otherwise.
+	begin = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], 'fingerprint', ARGV[1]) == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return {}
+end
+return redis.call('HMGET', KEYS[1], 'fingerprint', 'response')
+`)
+	// complete stores the response ARGV[1] under KEYS[1] for ARGV[2]
+	// milliseconds, if the key is still reserved.
+	complete = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('HSET', KEYS[1], 'response', ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+)
+
+// Store is an idempotency.Store backed by Redis.
+type Store struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// New creates a Store that keeps its keys in client under keys starting
+// with prefix.
+func New(client redis.UniversalClient, prefix string) *Store {
+	return &Store{client: client, prefix: prefix}
+}
+
+// Begin implements idempotency.Store, reserving the key atomically so that
+// only the first of concurrent requests with it, on any instance, is
+// handled.
+func (s *Store) Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*idempotency.Response, error) {
+	res, err := begin.Run(ctx, s.client, []string{s.prefix + key}, fingerprint, ttl.Milliseconds()).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	if stored, _ := res[0].(string); stored != fingerprint {
+		return nil, idempotency.ErrMismatch
+	}
+	data, ok := res[1].(string)
+	if !ok {
+		return nil, idempotency.ErrInProgress
+	}
+	var resp idempotency.Response
+	if err := json.Unmarshal([]byte(data), &resp); err != nil {
+		return nil, fmt.Errorf("redisidempotency: invalid stored response: %w", err)
+	}
+	return &resp, nil
+}
+
+// Complete implements idempotency.Store.
+func (s *Store) Complete(ctx context.Context, key string, resp *idempotency.Response, ttl time.Duration) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return complete.Run(ctx, s.client, []string{s.prefix + key}, data, ttl.Milliseconds()).Err()
+}
+
+// Release implements idempotency.Store.
+func (s *Store) Release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.prefix+key).Err()
+}
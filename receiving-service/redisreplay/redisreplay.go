@@ -0,0 +1,39 @@
+// Package redisreplay records the ID tokens the receiving service has
+// accepted in Redis, for example Memorystore, so that every instance of
+// the service rejects a token replayed to it.
+package redisreplay
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store is a verify.ReplayStore backed by Redis.
+type Store struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// New creates a Store that keeps its keys in client under keys starting
+// with prefix.
+func New(client redis.UniversalClient, prefix string) *Store {
+	return &Store{client: client, prefix: prefix}
+}
+
+// Seen implements verify.ReplayStore with SET NX, so that only the first
+// of concurrent requests with the same token records it.
+func (s *Store) Seen(ctx context.Context, key string, until time.Time) (bool, error) {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		// Redis needs a positive expiry; the token is rejected as expired
+		// by then anyway.
+		ttl = time.Second
+	}
+	stored, err := s.client.SetNX(ctx, s.prefix+key, 1, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	return !stored, nil
+}
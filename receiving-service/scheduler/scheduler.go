@@ -0,0 +1,95 @@
+// Package scheduler authenticates requests sent by Cloud Scheduler jobs
+// configured with an OIDC token.
+package scheduler
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+
+	"receiver/verify"
+)
+
+// Cloud Scheduler sets these headers on every HTTP job request.
+const (
+	headerScheduler    = "X-CloudScheduler"
+	headerJobName      = "X-CloudScheduler-JobName"
+	headerScheduleTime = "X-CloudScheduler-ScheduleTime"
+)
+
+// Verifier authenticates Cloud Scheduler job requests.
+type Verifier struct {
+	audience       string
+	callers        []string
+	requireHeaders bool
+}
+
+// Option configures a Verifier.
+type Option func(*Verifier)
+
+// RequireSchedulerHeaders makes the Verifier reject requests without the
+// X-CloudScheduler headers. The headers can be set by any caller, so this
+// only guards against misrouted requests; the token is what authenticates
+// the job.
+func RequireSchedulerHeaders() Option {
+	return func(v *Verifier) {
+		v.requireHeaders = true
+	}
+}
+
+// New creates a Verifier that accepts ID tokens minted for audience and
+// issued to one of the callers, the service accounts the jobs run as.
+// callers must not be empty: an empty list admits any authenticated caller.
+func New(audience string, callers []string, opts ...Option) *Verifier {
+	v := &Verifier{audience: audience}
+	for _, c := range callers {
+		if c = strings.TrimSpace(c); c != "" {
+			v.callers = append(v.callers, c)
+		}
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Middleware returns a handler that rejects requests that are not from an
+// allowed Cloud Scheduler job and otherwise calls next with the verified
+// payload stored in the request context.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	check := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v.requireHeaders && r.Header.Get(headerScheduler) != "true" {
+			log.Printf("Rejected scheduler request: missing %s header", headerScheduler)
+			http.Error(w, "Not a Cloud Scheduler request", http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return verify.New(v.audience, verify.WithAllowedCallers(v.callers...)).Middleware(check)
+}
+
+// Job describes the Cloud Scheduler job that sent a request.
+type Job struct {
+	// Name is the job's short name, from X-CloudScheduler-JobName.
+	Name string
+	// ScheduleTime is the scheduled time of this run in RFC 3339 format,
+	// from X-CloudScheduler-ScheduleTime.
+	ScheduleTime string
+	// Payload is the verified ID token payload.
+	Payload *idtoken.Payload
+}
+
+// JobFromRequest returns the job that sent r. It is only meaningful in
+// handlers wrapped by Middleware.
+func JobFromRequest(r *http.Request) Job {
+	payload, _ := verify.PayloadFromContext(r.Context())
+	return Job{
+		Name:         r.Header.Get(headerJobName),
+		ScheduleTime: r.Header.Get(headerScheduleTime),
+		Payload:      payload,
+	}
+}
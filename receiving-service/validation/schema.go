@@ -0,0 +1,242 @@
+package validation
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const schemaRefPrefix = "#/components/schemas/"
+
+// Schema is the subset of the OpenAPI 3 schema object, itself a dialect of
+// JSON Schema, that requests are validated against.
+type Schema struct {
+	Ref        string             `yaml:"$ref"`
+	Type       string             `yaml:"type"`
+	Format     string             `yaml:"format"`
+	Nullable   bool               `yaml:"nullable"`
+	Enum       []interface{}      `yaml:"enum"`
+	Properties map[string]*Schema `yaml:"properties"`
+	Required   []string           `yaml:"required"`
+	// AdditionalProperties is false to reject properties not listed in
+	// Properties, or a schema they must match.
+	AdditionalProperties yaml.Node `yaml:"additionalProperties"`
+	Items                *Schema   `yaml:"items"`
+	MinItems             *int      `yaml:"minItems"`
+	MaxItems             *int      `yaml:"maxItems"`
+	MinLength            *int      `yaml:"minLength"`
+	MaxLength            *int      `yaml:"maxLength"`
+	Pattern              string    `yaml:"pattern"`
+	Minimum              *float64  `yaml:"minimum"`
+	Maximum              *float64  `yaml:"maximum"`
+
+	// Set by compile.
+	resolved        *Schema
+	pattern         *regexp.Regexp
+	noAdditional    bool
+	additionalMatch *Schema
+}
+
+// Violation is one way a request does not match the spec.
+type Violation struct {
+	// Field locates the value, as in body.items[2].name, query.limit or
+	// header.X-Callback-Url.
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// compile resolves the references of s and its subschemas against schemas
+// and parses its patterns.
+func (s *Schema) compile(schemas map[string]*Schema, seen map[*Schema]bool) error {
+	if s == nil || seen[s] {
+		return nil
+	}
+	seen[s] = true
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, schemaRefPrefix)
+		target, ok := schemas[name]
+		if !strings.HasPrefix(s.Ref, schemaRefPrefix) || !ok {
+			return fmt.Errorf("undefined schema %s", s.Ref)
+		}
+		s.resolved = target
+		return target.compile(schemas, seen)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	if n := &s.AdditionalProperties; n.Kind != 0 {
+		var allowed bool
+		if n.Kind == yaml.ScalarNode && n.Decode(&allowed) == nil {
+			s.noAdditional = !allowed
+		} else {
+			s.additionalMatch = &Schema{}
+			if err := n.Decode(s.additionalMatch); err != nil {
+				return fmt.Errorf("invalid additionalProperties: %w", err)
+			}
+		}
+	}
+	for _, sub := range []*Schema{s.Items, s.additionalMatch} {
+		if err := sub.compile(schemas, seen); err != nil {
+			return err
+		}
+	}
+	for _, sub := range s.Properties {
+		if err := sub.compile(schemas, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate appends the ways v, a value decoded from JSON, does not match
+// s to violations.
+func (s *Schema) validate(field string, v interface{}, violations []Violation) []Violation {
+	for s.resolved != nil {
+		s = s.resolved
+	}
+	fail := func(format string, args ...interface{}) []Violation {
+		return append(violations, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	if v == nil {
+		if s.Nullable || s.Type == "" {
+			return violations
+		}
+		return fail("must not be null")
+	}
+	if len(s.Enum) > 0 && isScalar(v) && !inEnum(v, s.Enum) {
+		return fail("must be one of %s", enumList(s.Enum))
+	}
+	switch s.Type {
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		n := len([]rune(str))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fail("must match %s", s.Pattern)
+		}
+	case "integer", "number":
+		f, ok := v.(float64)
+		if !ok {
+			return fail("must be a number")
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			return fail("must be an integer")
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fail("must be at most %v", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("must be a boolean")
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fail("must be an array")
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			return fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			return fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				violations = s.Items.validate(fmt.Sprintf("%s[%d]", field, i), item, violations)
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("must be an object")
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				violations = append(violations, Violation{Field: field + "." + name, Message: "is required"})
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub, ok := s.Properties[k]
+			switch {
+			case ok:
+				violations = sub.validate(field+"."+k, obj[k], violations)
+			case s.noAdditional:
+				violations = append(violations, Violation{Field: field + "." + k, Message: "is not allowed"})
+			case s.additionalMatch != nil:
+				violations = s.additionalMatch.validate(field+"."+k, obj[k], violations)
+			}
+		}
+	}
+	return violations
+}
+
+// parse converts the string value of a parameter to the type of s, so
+// that it can be validated like a JSON value.
+func (s *Schema) parse(value string) (interface{}, bool) {
+	for s.resolved != nil {
+		s = s.resolved
+	}
+	switch s.Type {
+	case "integer", "number":
+		f, err := strconv.ParseFloat(value, 64)
+		return f, err == nil
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		return b, err == nil
+	}
+	return value, true
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+func inEnum(v interface{}, enum []interface{}) bool {
+	for _, e := range enum {
+		// Enum values come from YAML, which decodes integers as int.
+		if n, ok := e.(int); ok {
+			e = float64(n)
+		}
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	vals := make([]string, len(enum))
+	for i, e := range enum {
+		vals[i] = fmt.Sprint(e)
+	}
+	return strings.Join(vals, ", ")
+}
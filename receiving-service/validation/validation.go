@@ -0,0 +1,385 @@
+// Package validation checks requests against the OpenAPI spec of the
+// service, such as receiving-service/openapi.yaml: the parameters and
+// JSON bodies of requests to the routes the spec describes must match its
+// schemas, and requests that do not are rejected with a 400 Bad Request
+// listing what is wrong. It is meant to run after the verify middleware,
+// so that unauthenticated callers learn nothing about the API, and before
+// the handlers, which can then trust their input.
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMaxBody is the largest request body read for validation unless
+// WithMaxBodySize is given.
+const defaultMaxBody = 1 << 20
+
+// Validator validates requests against an OpenAPI spec.
+type Validator struct {
+	routes  []*route
+	maxBody int64
+}
+
+// Option configures a Validator.
+type Option func(*Validator)
+
+// WithMaxBodySize sets the largest request body, in bytes, that is read
+// for validation. Larger bodies are rejected with 413 Request Entity Too
+// Large. It defaults to 1 MiB.
+func WithMaxBodySize(n int64) Option {
+	return func(v *Validator) {
+		v.maxBody = n
+	}
+}
+
+// spec is the part of an OpenAPI 3 document requests are validated
+// against.
+type spec struct {
+	OpenAPI    string               `yaml:"openapi"`
+	Paths      map[string]*pathItem `yaml:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+type pathItem struct {
+	Parameters []*parameter `yaml:"parameters"`
+	Get        *operation   `yaml:"get"`
+	Put        *operation   `yaml:"put"`
+	Post       *operation   `yaml:"post"`
+	Delete     *operation   `yaml:"delete"`
+	Patch      *operation   `yaml:"patch"`
+}
+
+type operation struct {
+	Parameters  []*parameter `yaml:"parameters"`
+	RequestBody *struct {
+		Required bool `yaml:"required"`
+		Content  map[string]struct {
+			Schema *Schema `yaml:"schema"`
+		} `yaml:"content"`
+	} `yaml:"requestBody"`
+}
+
+type parameter struct {
+	Name     string  `yaml:"name"`
+	In       string  `yaml:"in"`
+	Required bool    `yaml:"required"`
+	Schema   *Schema `yaml:"schema"`
+}
+
+// route is a path of the spec with the operations on it by method.
+type route struct {
+	segments   []string
+	operations map[string]*compiledOperation
+}
+
+type compiledOperation struct {
+	params       []*parameter
+	body         *Schema
+	bodyRequired bool
+}
+
+// Load reads the OpenAPI 3 spec at path and returns a Validator for it.
+func Load(path string, opts ...Option) (*Validator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("validation: failed to read spec: %w", err)
+	}
+	v, err := Parse(data, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%w (in %s)", err, path)
+	}
+	return v, nil
+}
+
+// Parse returns a Validator for the OpenAPI 3 spec in data, in YAML or
+// JSON.
+func Parse(data []byte, opts ...Option) (*Validator, error) {
+	var s spec
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("validation: failed to parse spec: %w", err)
+	}
+	v, err := newValidator(&s)
+	if err != nil {
+		return nil, fmt.Errorf("validation: %w", err)
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v, nil
+}
+
+func newValidator(s *spec) (*Validator, error) {
+	if !strings.HasPrefix(s.OpenAPI, "3.") {
+		return nil, fmt.Errorf("only OpenAPI 3 specs are supported, not %q", s.OpenAPI)
+	}
+	v := &Validator{maxBody: defaultMaxBody}
+	seen := map[*Schema]bool{}
+	for _, sub := range s.Components.Schemas {
+		if err := sub.compile(s.Components.Schemas, seen); err != nil {
+			return nil, err
+		}
+	}
+	for p, item := range s.Paths {
+		r := &route{segments: strings.Split(strings.Trim(p, "/"), "/"), operations: map[string]*compiledOperation{}}
+		for method, op := range map[string]*operation{
+			http.MethodGet:    item.Get,
+			http.MethodPut:    item.Put,
+			http.MethodPost:   item.Post,
+			http.MethodDelete: item.Delete,
+			http.MethodPatch:  item.Patch,
+		} {
+			if op == nil {
+				continue
+			}
+			c, err := compileOperation(item.Parameters, op, s.Components.Schemas, seen)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, p, err)
+			}
+			r.operations[method] = c
+		}
+		v.routes = append(v.routes, r)
+	}
+	// Try routes with more literal segments first, so that /jobs/latest
+	// wins over /jobs/{id}.
+	sort.Slice(v.routes, func(i, j int) bool {
+		if a, b := v.routes[i].literals(), v.routes[j].literals(); a != b {
+			return a > b
+		}
+		return strings.Join(v.routes[i].segments, "/") < strings.Join(v.routes[j].segments, "/")
+	})
+	return v, nil
+}
+
+func compileOperation(shared []*parameter, op *operation, schemas map[string]*Schema, seen map[*Schema]bool) (*compiledOperation, error) {
+	c := &compiledOperation{}
+	byKey := map[string]int{}
+	for _, p := range append(append([]*parameter{}, shared...), op.Parameters...) {
+		if p.In == "header" {
+			p.Name = http.CanonicalHeaderKey(p.Name)
+		}
+		if p.In == "path" {
+			p.Required = true
+		}
+		if err := p.Schema.compile(schemas, seen); err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+		key := p.In + ":" + p.Name
+		if i, ok := byKey[key]; ok {
+			c.params[i] = p
+			continue
+		}
+		byKey[key] = len(c.params)
+		c.params = append(c.params, p)
+	}
+	if b := op.RequestBody; b != nil {
+		for mediaType, content := range b.Content {
+			if mediaType != "application/json" {
+				continue
+			}
+			if err := content.Schema.compile(schemas, seen); err != nil {
+				return nil, fmt.Errorf("request body: %w", err)
+			}
+			c.body = content.Schema
+		}
+		c.bodyRequired = b.Required
+	}
+	return c, nil
+}
+
+func (r *route) literals() int {
+	n := 0
+	for _, s := range r.segments {
+		if !strings.HasPrefix(s, "{") {
+			n++
+		}
+	}
+	return n
+}
+
+// match returns the path parameters of path if r matches it.
+func (r *route) match(path string) (map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, s := range r.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// operation returns the operation of the spec that req is for, with its
+// path parameters, or nil if the spec does not describe it.
+func (v *Validator) operation(req *http.Request) (*compiledOperation, map[string]string) {
+	for _, r := range v.routes {
+		params, ok := r.match(req.URL.Path)
+		if !ok {
+			continue
+		}
+		return r.operations[req.Method], params
+	}
+	return nil, nil
+}
+
+// Middleware returns a handler that validates requests to the operations
+// of the spec and calls next with those that match it, with their bodies
+// intact. Requests to paths or methods the spec does not describe are
+// passed to next unchecked.
+func (v *Validator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, pathParams := v.operation(r)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		violations := validateParams(r, op, pathParams)
+
+		if op.body != nil {
+			body, status, violation := v.readBody(r, op)
+			switch {
+			case status != 0:
+				writeError(w, status, []Violation{violation})
+				return
+			case violation.Message != "":
+				violations = append(violations, violation)
+			case body != nil:
+				violations = op.body.validate("body", body, violations)
+			}
+		}
+		if len(violations) > 0 {
+			log.Printf("Rejected request to %s %s: %d validation errors", r.Method, r.URL.Path, len(violations))
+			writeError(w, http.StatusBadRequest, violations)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validateParams(r *http.Request, op *compiledOperation, pathParams map[string]string) []Violation {
+	var violations []Violation
+	query := r.URL.Query()
+	for _, p := range op.params {
+		var value string
+		var present bool
+		switch p.In {
+		case "path":
+			value, present = pathParams[p.Name]
+		case "query":
+			present = query.Has(p.Name)
+			value = query.Get(p.Name)
+		case "header":
+			values := r.Header.Values(p.Name)
+			present = len(values) > 0
+			if present {
+				value = values[0]
+			}
+		default:
+			continue
+		}
+		field := p.In + "." + p.Name
+		if !present {
+			if p.Required {
+				violations = append(violations, Violation{Field: field, Message: "is required"})
+			}
+			continue
+		}
+		if p.Schema == nil {
+			continue
+		}
+		parsed, ok := p.Schema.parse(value)
+		if !ok {
+			violations = append(violations, Violation{Field: field, Message: "must be " + typeName(p.Schema)})
+			continue
+		}
+		violations = p.Schema.validate(field, parsed, violations)
+	}
+	return violations
+}
+
+// readBody reads and decodes the JSON body of r, leaving r.Body readable
+// again. It returns a status other than 0 for bodies that cannot be
+// validated at all, and a violation for a body that is missing or is not
+// JSON.
+func (v *Validator) readBody(r *http.Request, op *compiledOperation) (interface{}, int, Violation) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, v.maxBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, http.StatusBadRequest, Violation{Field: "body", Message: "could not be read"}
+	}
+	if int64(len(data)) > v.maxBody {
+		return nil, http.StatusRequestEntityTooLarge, Violation{Field: "body", Message: fmt.Sprintf("must be at most %d bytes", v.maxBody)}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if len(bytes.TrimSpace(data)) == 0 {
+		if op.bodyRequired {
+			return nil, 0, Violation{Field: "body", Message: "is required"}
+		}
+		return nil, 0, Violation{}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil, http.StatusUnsupportedMediaType, Violation{Field: "header.Content-Type", Message: "must be application/json"}
+	}
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, 0, Violation{Field: "body", Message: "must be valid JSON"}
+	}
+	return body, 0, Violation{}
+}
+
+// typeName names the type of values s accepts, for parameters that do
+// not parse as one.
+func typeName(s *Schema) string {
+	for s.resolved != nil {
+		s = s.resolved
+	}
+	switch s.Type {
+	case "integer":
+		return "an integer"
+	case "boolean":
+		return "a boolean"
+	}
+	return "a number"
+}
+
+// validationError is the body of a response to a request that does not
+// match the spec.
+type validationError struct {
+	Error      string      `json:"error"`
+	Message    string      `json:"message"`
+	Violations []Violation `json:"violations"`
+}
+
+func writeError(w http.ResponseWriter, status int, violations []Violation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(validationError{
+		Error:      "invalid_request",
+		Message:    "Request does not match the API spec",
+		Violations: violations,
+	})
+}
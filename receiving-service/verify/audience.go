@@ -0,0 +1,30 @@
+package verify
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrAudienceMismatch matches, with errors.Is, the *AudienceMismatchError
+// returned for tokens minted for another audience.
+var ErrAudienceMismatch = errors.New("verify: audience mismatch")
+
+// AudienceMismatchError is returned for a token with a valid signature and
+// issuer whose audience is not the expected one, which usually means the
+// caller is configured with the wrong audience for this service, such as
+// its URL when a custom audience or OAuth client ID is expected.
+type AudienceMismatchError struct {
+	// Audience is the aud claim of the token.
+	Audience string
+	// Expected is the audience the token should have been minted for.
+	Expected string
+}
+
+func (e *AudienceMismatchError) Error() string {
+	return fmt.Sprintf("verify: audience %q does not match %q", e.Audience, e.Expected)
+}
+
+// Is reports whether target is ErrAudienceMismatch.
+func (e *AudienceMismatchError) Is(target error) bool {
+	return target == ErrAudienceMismatch
+}
@@ -0,0 +1,63 @@
+package verify
+
+import (
+	"net/http"
+
+	"receiver/audit"
+)
+
+// WithAudit records an audit event with l for every request the
+// Middleware handles: the verified caller and end user, the audience, the
+// decision and, for denied requests, the reason.
+func WithAudit(l *audit.Logger) Option {
+	return func(v *Verifier) {
+		v.audit = l
+	}
+}
+
+// startAudit fills in the parts of the request's audit event, if any, that
+// are known before the token is checked.
+func (v *Verifier) startAudit(r *http.Request) {
+	ev := audit.FromContext(r.Context())
+	if ev == nil {
+		return
+	}
+	info := ClientInfoFromRequest(r)
+	ev.Audience = v.audience
+	ev.RequestID = info.RequestID
+	info.RequestID = ""
+	ev.Client = info.String()
+}
+
+// auditCaller records the caller of r in its audit event.
+func auditCaller(r *http.Request, email, subject string) {
+	if ev := audit.FromContext(r.Context()); ev != nil {
+		ev.Caller = email
+		ev.Subject = subject
+	}
+}
+
+// auditAllowed records that r was let in, with its verified caller and end
+// user, in its audit event.
+func auditAllowed(r *http.Request, claims, user *Claims) {
+	ev := audit.FromContext(r.Context())
+	if ev == nil {
+		return
+	}
+	ev.Decision = audit.Allow
+	if claims != nil {
+		ev.Caller = claims.Email
+		ev.Subject = claims.Subject
+	}
+	if user != nil {
+		ev.User = user.Email
+	}
+}
+
+// auditDenied records why r was rejected in its audit event.
+func auditDenied(r *http.Request, reason string) {
+	if ev := audit.FromContext(r.Context()); ev != nil {
+		ev.Decision = audit.Deny
+		ev.Reason = reason
+	}
+}
@@ -0,0 +1,74 @@
+package verify
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+type claimsKey struct{}
+
+// Claims are the claims of a verified Google-signed ID token.
+type Claims struct {
+	Issuer   string
+	Subject  string
+	Audience string
+	// AuthorizedParty is the azp claim: the client the token was issued
+	// to, usually the caller's service-account ID.
+	AuthorizedParty string
+	Email           string
+	EmailVerified   bool
+	// HostedDomain is the hd claim, the Google Workspace domain of a user
+	// account.
+	HostedDomain string
+	IssuedAt     time.Time
+	Expires      time.Time
+	// ComputeEngine is set for tokens minted by the metadata server of a
+	// Compute Engine instance with format=full.
+	ComputeEngine *ComputeEngineClaims
+}
+
+// ComputeEngineClaims describe the instance that minted a token.
+type ComputeEngineClaims struct {
+	ProjectID     string
+	ProjectNumber int64
+	Zone          string
+	InstanceID    string
+	InstanceName  string
+}
+
+// ClaimsFromPayload extracts the typed claims from a verified payload.
+func ClaimsFromPayload(payload *idtoken.Payload) *Claims {
+	c := &Claims{
+		Issuer:   payload.Issuer,
+		Subject:  payload.Subject,
+		Audience: payload.Audience,
+		IssuedAt: time.Unix(payload.IssuedAt, 0),
+		Expires:  time.Unix(payload.Expires, 0),
+	}
+	c.AuthorizedParty, _ = payload.Claims["azp"].(string)
+	c.Email, _ = payload.Claims["email"].(string)
+	c.EmailVerified, _ = payload.Claims["email_verified"].(bool)
+	c.HostedDomain, _ = payload.Claims["hd"].(string)
+
+	google, _ := payload.Claims["google"].(map[string]interface{})
+	if gce, ok := google["compute_engine"].(map[string]interface{}); ok {
+		c.ComputeEngine = &ComputeEngineClaims{}
+		c.ComputeEngine.ProjectID, _ = gce["project_id"].(string)
+		c.ComputeEngine.Zone, _ = gce["zone"].(string)
+		c.ComputeEngine.InstanceID, _ = gce["instance_id"].(string)
+		c.ComputeEngine.InstanceName, _ = gce["instance_name"].(string)
+		if n, ok := gce["project_number"].(float64); ok {
+			c.ComputeEngine.ProjectNumber = int64(n)
+		}
+	}
+	return c
+}
+
+// ClaimsFromContext returns the claims of the verified token stored in ctx
+// by the middleware, if any.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,44 @@
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// AutoAudience is the audience value that asks for the audience to be
+// derived from the Cloud Run environment with CloudRunAudience.
+const AutoAudience = "auto"
+
+// CloudRunAudience returns the URL the Cloud Run service the process runs
+// as is served at, https://{service}-{project number}.{region}.run.app, for
+// use as the expected audience. The service name is read from K_SERVICE,
+// and the project number and region from the metadata server.
+//
+// Services also answer at their older https://{service}-{hash}-{region
+// code}.a.run.app URL, which cannot be derived. Callers must mint their
+// tokens for the URL returned here; services called at the older URL
+// should keep setting their audience explicitly.
+func CloudRunAudience() (string, error) {
+	service := os.Getenv("K_SERVICE")
+	if service == "" {
+		return "", errors.New("verify: K_SERVICE is not set; the audience can only be derived on Cloud Run")
+	}
+	number, err := metadata.NumericProjectID()
+	if err != nil {
+		return "", fmt.Errorf("verify: failed to read the project number from the metadata server: %w", err)
+	}
+	// The region is returned as projects/{number}/regions/{region}.
+	region, err := metadata.Get("instance/region")
+	if err != nil {
+		return "", fmt.Errorf("verify: failed to read the region from the metadata server: %w", err)
+	}
+	region = strings.TrimSpace(region[strings.LastIndex(region, "/")+1:])
+	if region == "" {
+		return "", errors.New("verify: the metadata server returned no region")
+	}
+	return fmt.Sprintf("https://%s-%s.%s.run.app", service, strings.TrimSpace(number), region), nil
+}
@@ -0,0 +1,293 @@
+package verify
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+// GoogleCertsURL serves the JSON Web Key Set that signs Google ID tokens.
+const GoogleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+const (
+	// defaultKeyTTL is used when the JWKS response has no usable
+	// Cache-Control max-age.
+	defaultKeyTTL = time.Hour
+	// minRefetchInterval limits how often an unknown kid triggers a
+	// refetch, so tokens with made-up key IDs can't hammer the JWKS
+	// endpoint.
+	minRefetchInterval = 30 * time.Second
+)
+
+// KeySet verifies ID tokens locally against a cached JSON Web Key Set. Keys
+// are refreshed when the Cache-Control lifetime of the last response runs
+// out, or early when a token names a key ID that isn't cached, which is how
+// key rotation shows up.
+type KeySet struct {
+	url    string
+	client *http.Client
+
+	// fetchMu serializes fetches so concurrent cache misses share one.
+	fetchMu sync.Mutex
+
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	expires   time.Time
+	lastFetch time.Time
+
+	hits            atomic.Int64
+	misses          atomic.Int64
+	refreshes       atomic.Int64
+	refreshFailures atomic.Int64
+}
+
+// KeySetStats are counters describing a KeySet's cache behaviour.
+type KeySetStats struct {
+	CacheHits       int64 `json:"cache_hits"`
+	CacheMisses     int64 `json:"cache_misses"`
+	Refreshes       int64 `json:"refreshes"`
+	RefreshFailures int64 `json:"refresh_failures"`
+	Keys            int   `json:"keys"`
+}
+
+// NewKeySet creates a KeySet that fetches keys from url using client. A
+// nil client uses http.DefaultClient.
+func NewKeySet(url string, client *http.Client) *KeySet {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &KeySet{url: url, client: client}
+}
+
+// Stats returns the KeySet's counters.
+func (ks *KeySet) Stats() KeySetStats {
+	ks.mu.RLock()
+	n := len(ks.keys)
+	ks.mu.RUnlock()
+	return KeySetStats{
+		CacheHits:       ks.hits.Load(),
+		CacheMisses:     ks.misses.Load(),
+		Refreshes:       ks.refreshes.Load(),
+		RefreshFailures: ks.refreshFailures.Load(),
+		Keys:            n,
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Validate checks the signature, issuer, audience and lifetime of token and
+// returns its payload. An empty audience skips the audience check. Tokens
+// rejected only for their times, within DefaultClockSkew of being valid,
+// fail with a *ClockSkewError.
+func (ks *KeySet) Validate(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
+	return ks.validate(ctx, token, audience, DefaultClockSkew)
+}
+
+func (ks *KeySet) validate(ctx context.Context, token, audience string, leeway time.Duration) (*idtoken.Payload, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("verify: malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("verify: malformed token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("verify: unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := ks.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("verify: malformed token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("verify: invalid token signature")
+	}
+
+	var payload idtoken.Payload
+	if err := decodeSegment(parts[1], &payload); err != nil {
+		return nil, fmt.Errorf("verify: malformed token payload: %w", err)
+	}
+	if err := decodeSegment(parts[1], &payload.Claims); err != nil {
+		return nil, fmt.Errorf("verify: malformed token payload: %w", err)
+	}
+
+	if !googleIssuers[payload.Issuer] {
+		return nil, fmt.Errorf("verify: unexpected issuer %q", payload.Issuer)
+	}
+	if audience != "" && payload.Audience != audience {
+		return nil, &AudienceMismatchError{Audience: payload.Audience, Expected: audience}
+	}
+	if err := checkTimes(&payload, time.Now(), leeway); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// key returns the public key for kid, fetching the key set if it is stale
+// or doesn't contain kid.
+func (ks *KeySet) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	fresh := time.Now().Before(ks.expires)
+	ks.mu.RUnlock()
+	if ok && fresh {
+		ks.hits.Add(1)
+		return key, nil
+	}
+	ks.misses.Add(1)
+
+	ks.fetchMu.Lock()
+	defer ks.fetchMu.Unlock()
+
+	// Another request may have refreshed the keys while this one waited.
+	ks.mu.RLock()
+	key, ok = ks.keys[kid]
+	fresh = time.Now().Before(ks.expires)
+	recent := time.Since(ks.lastFetch) < minRefetchInterval
+	ks.mu.RUnlock()
+	if ok && fresh {
+		return key, nil
+	}
+	if !ok && fresh && recent {
+		return nil, fmt.Errorf("verify: unknown signing key %q", kid)
+	}
+
+	if err := ks.refresh(ctx); err != nil {
+		ks.refreshFailures.Add(1)
+		// Keys outlive their cache lifetime, so a stale key is better than
+		// rejecting every request while the JWKS endpoint is unavailable.
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	ks.mu.RLock()
+	key, ok = ks.keys[kid]
+	ks.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("verify: unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (ks *KeySet) refresh(ctx context.Context) error {
+	ks.refreshes.Add(1)
+	ks.mu.Lock()
+	ks.lastFetch = time.Now()
+	ks.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return fmt.Errorf("verify: failed to fetch signing keys: %w", err)
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("verify: failed to fetch signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("verify: failed to fetch signing keys: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return fmt.Errorf("verify: failed to decode signing keys: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("verify: invalid signing key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.expires = time.Now().Add(cacheLifetime(resp.Header))
+	ks.mu.Unlock()
+	return nil
+}
+
+func (k jwk) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(e)
+	if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent too large")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+// cacheLifetime returns how long a response may be cached according to its
+// Cache-Control max-age, less its Age.
+func cacheLifetime(h http.Header) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		maxAge, err := strconv.Atoi(value)
+		if err != nil || maxAge <= 0 {
+			break
+		}
+		age, _ := strconv.Atoi(h.Get("Age"))
+		if ttl := time.Duration(maxAge-age) * time.Second; ttl > 0 {
+			return ttl
+		}
+		return 0
+	}
+	return defaultKeyTTL
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,143 @@
+package verify
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNoClientCertificate is returned for requests that did not come over
+// TLS with a verified client certificate.
+var ErrNoClientCertificate = errors.New("no verified client certificate")
+
+type clientCertKey struct{}
+
+// CertBindings bind client certificate identities to the callers that may
+// present them: each key is an identity CertIdentities returns, such as the
+// SPIFFE ID spiffe://cluster.local/ns/default/sa/sender, and its value the
+// verified emails of the ID tokens that may come with it. Outside Cloud
+// Run, where the receiving service terminates TLS itself, they make a
+// stolen ID token useless without the caller's private key as well.
+type CertBindings map[string][]string
+
+// LoadCertBindings reads CertBindings from a JSON file of the form
+// {"spiffe://cluster.local/ns/default/sa/sender": ["sender@my-project.iam.gserviceaccount.com"]}.
+func LoadCertBindings(path string) (CertBindings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("verify: failed to read certificate bindings: %w", err)
+	}
+	var b CertBindings
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("verify: failed to parse certificate bindings %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// CertIdentities returns the identities of cert: its URI SANs, such as
+// SPIFFE IDs, its DNS and email SANs, and its subject's common name.
+func CertIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	if cn := cert.Subject.CommonName; cn != "" {
+		ids = append(ids, cn)
+	}
+	return ids
+}
+
+// CertNotBoundError is returned for a client certificate that is not bound
+// to the verified caller of the request it came with.
+type CertNotBoundError struct {
+	Identities []string
+	Email      string
+}
+
+func (e *CertNotBoundError) Error() string {
+	return fmt.Sprintf("client certificate %s is not bound to caller %q", strings.Join(e.Identities, ", "), e.Email)
+}
+
+// Check returns a *CertNotBoundError unless one of the identities of cert
+// is bound to the verified email of claims. Empty bindings accept every
+// certificate.
+func (b CertBindings) Check(cert *x509.Certificate, claims *Claims) error {
+	if len(b) == 0 {
+		return nil
+	}
+	ids := CertIdentities(cert)
+	if claims.EmailVerified && claims.Email != "" {
+		for _, id := range ids {
+			for _, email := range b[id] {
+				if strings.EqualFold(email, claims.Email) {
+					return nil
+				}
+			}
+		}
+	}
+	return &CertNotBoundError{Identities: ids, Email: claims.Email}
+}
+
+// WithClientCertificates also requires requests to have come over TLS with
+// a client certificate the server verified, such as with
+// tls.RequireAndVerifyClientCert, and, if bindings is not empty, one bound
+// to the caller of the ID token. Requests without one are rejected with
+// 401 Unauthorized and those whose certificate is not bound to the caller
+// with 403 Forbidden. The certificate is stored in the request context.
+func WithClientCertificates(bindings CertBindings) Option {
+	return func(v *Verifier) {
+		v.certs = true
+		v.bindings = bindings
+	}
+}
+
+// AuthenticateCertificate checks the client certificate of the connection
+// with state against the caller stored in ctx by Authenticate, when
+// WithClientCertificates is given, and returns a copy of ctx carrying it,
+// for use outside HTTP handlers such as in gRPC interceptors. A connection
+// without a verified client certificate is reported with
+// ErrNoClientCertificate, and a certificate not bound to the caller with a
+// *CertNotBoundError. Without WithClientCertificates, ctx is returned as
+// is.
+func (v *Verifier) AuthenticateCertificate(ctx context.Context, state *tls.ConnectionState) (context.Context, error) {
+	if !v.certs {
+		return ctx, nil
+	}
+	cert, err := clientCertificate(state)
+	if err != nil {
+		v.clientCert.Add(1)
+		return nil, err
+	}
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, errors.New("verify: no authenticated caller to check the client certificate against")
+	}
+	if err := v.bindings.Check(cert, claims); err != nil {
+		v.clientCert.Add(1)
+		return nil, err
+	}
+	return context.WithValue(ctx, clientCertKey{}, cert), nil
+}
+
+// clientCertificate returns the verified client certificate of the
+// connection with state.
+func clientCertificate(state *tls.ConnectionState) (*x509.Certificate, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, ErrNoClientCertificate
+	}
+	return state.VerifiedChains[0][0], nil
+}
+
+// ClientCertificateFromContext returns the verified client certificate
+// stored in ctx by the middleware when WithClientCertificates is given.
+func ClientCertificateFromContext(ctx context.Context) (*x509.Certificate, bool) {
+	cert, ok := ctx.Value(clientCertKey{}).(*x509.Certificate)
+	return cert, ok
+}
@@ -0,0 +1,119 @@
+package verify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+var (
+	// ErrReplayed is returned by Authenticate for a token that has been
+	// presented before.
+	ErrReplayed = errors.New("verify: token replayed")
+	// ErrReplayCheckFailed is returned by Authenticate when the replay
+	// store fails, so that the token can be neither accepted nor rejected.
+	ErrReplayCheckFailed = errors.New("verify: replay check failed")
+)
+
+// ReplayStore records the tokens a Verifier has accepted. Implementations
+// must be safe for concurrent use; stores shared by several instances,
+// such as one backed by Redis, catch replays sent to another instance.
+type ReplayStore interface {
+	// Seen records key until the given time and reports whether it was
+	// recorded already. Recording and checking must be atomic, so that of
+	// two concurrent requests with the same key only one gets false.
+	Seen(ctx context.Context, key string, until time.Time) (bool, error)
+}
+
+// WithReplayProtection accepts each token only once, rejecting later
+// requests with the same token with 401 Unauthorized. Tokens are known by
+// their jti claim, if they have one, and otherwise by their hash, and are
+// remembered in store until they expire. If window is positive, tokens
+// issued longer than window ago are rejected too, and are remembered only
+// for window, which bounds the size of the store.
+//
+// Google-signed ID tokens have no jti, and callers such as authclient
+// reuse a token until shortly before it expires, so this is for callers
+// that mint a token for every request; request signatures protect against
+// replayed requests without that cost.
+func WithReplayProtection(store ReplayStore, window time.Duration) Option {
+	return func(v *Verifier) {
+		v.replay = store
+		v.replayWindow = window
+	}
+}
+
+// checkReplay records token in the replay store, failing if the token is
+// too old or has been seen before.
+func (v *Verifier) checkReplay(ctx context.Context, token string, payload *idtoken.Payload) error {
+	issued := time.Unix(payload.IssuedAt, 0)
+	until := time.Unix(payload.Expires, 0)
+	if v.replayWindow > 0 {
+		if time.Since(issued) > v.replayWindow+v.leeway {
+			return fmt.Errorf("verify: token issued %s ago, longer than the replay window of %s", time.Since(issued).Round(time.Second), v.replayWindow)
+		}
+		if end := issued.Add(v.replayWindow); end.Before(until) {
+			until = end
+		}
+	}
+	seen, err := v.replay.Seen(ctx, replayKey(token, payload), until.Add(v.leeway))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReplayCheckFailed, err)
+	}
+	if seen {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// replayKey identifies a token by its issuer and jti, or by its hash.
+func replayKey(token string, payload *idtoken.Payload) string {
+	if jti, _ := payload.Claims["jti"].(string); jti != "" {
+		return "jti:" + payload.Issuer + ":" + jti
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// MemoryReplayStore is a ReplayStore that keeps keys in memory. Each
+// instance of the service has its own, so a token replayed to another
+// instance is accepted there once; implement ReplayStore over a shared
+// database to catch those too.
+type MemoryReplayStore struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+	// sweep is when expired keys are next removed.
+	sweep time.Time
+}
+
+// NewMemoryReplayStore returns an empty MemoryReplayStore.
+func NewMemoryReplayStore() *MemoryReplayStore {
+	return &MemoryReplayStore{keys: make(map[string]time.Time)}
+}
+
+// Seen implements ReplayStore.
+func (s *MemoryReplayStore) Seen(ctx context.Context, key string, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.After(s.sweep) {
+		for k, expires := range s.keys {
+			if !now.Before(expires) {
+				delete(s.keys, k)
+			}
+		}
+		s.sweep = now.Add(time.Minute)
+	}
+
+	if expires, ok := s.keys[key]; ok && now.Before(expires) {
+		return true, nil
+	}
+	s.keys[key] = until
+	return false, nil
+}
@@ -0,0 +1,126 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the header carrying a request signature.
+const SignatureHeader = "X-Signature"
+
+const (
+	// maxSignatureAge is how long after signing a request is accepted.
+	maxSignatureAge = 5 * time.Minute
+	// maxSignedBodySize bounds the bodies the signature middleware reads.
+	maxSignedBodySize = 10 << 20
+)
+
+// ServiceAccountKeysURL returns the URL of the JSON Web Key Set of the
+// Google-managed keys of the service account email, which sign the blobs
+// the service account signs through the IAM Credentials API.
+func ServiceAccountKeysURL(email string) string {
+	return "https://www.googleapis.com/service_accounts/v1/jwk/" + url.PathEscape(email)
+}
+
+// SignatureVerifier checks request signatures: a JWS in the X-Signature
+// header with the request body as its detached payload (RFC 7515,
+// appendix F), signed with RS256 by a key in a KeySet. The JWS protected
+// header must name the request's method in "htm", its path and query
+// string in "htu", and the time it was signed in "iat".
+type SignatureVerifier struct {
+	keys *KeySet
+}
+
+// NewSignatureVerifier creates a SignatureVerifier that accepts signatures
+// made with keys, normally
+// NewKeySet(ServiceAccountKeysURL(callerServiceAccount), nil).
+func NewSignatureVerifier(keys *KeySet) *SignatureVerifier {
+	return &SignatureVerifier{keys: keys}
+}
+
+type signatureHeader struct {
+	Alg      string `json:"alg"`
+	Kid      string `json:"kid"`
+	Method   string `json:"htm"`
+	URI      string `json:"htu"`
+	IssuedAt int64  `json:"iat"`
+}
+
+// Verify checks that r, whose body is body, carries a valid signature.
+func (sv *SignatureVerifier) Verify(ctx context.Context, r *http.Request, body []byte) error {
+	jws := r.Header.Get(SignatureHeader)
+	if jws == "" {
+		return errors.New("verify: missing " + SignatureHeader + " header")
+	}
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return errors.New("verify: malformed signature")
+	}
+
+	var header signatureHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("verify: malformed signature header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("verify: unsupported signing algorithm %q", header.Alg)
+	}
+	key, err := sv.keys.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("verify: malformed signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + base64.RawURLEncoding.EncodeToString(body)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return errors.New("verify: invalid signature")
+	}
+
+	if header.Method != r.Method || header.URI != r.URL.RequestURI() {
+		return fmt.Errorf("verify: signature is for %s %s, not %s %s", header.Method, header.URI, r.Method, r.URL.RequestURI())
+	}
+	signed := time.Unix(header.IssuedAt, 0)
+	if now := time.Now(); now.After(signed.Add(maxSignatureAge)) || now.Add(DefaultClockSkew).Before(signed) {
+		return errors.New("verify: signature expired")
+	}
+	return nil
+}
+
+// Middleware returns a handler that rejects requests without a valid
+// signature with 401 Unauthorized, and otherwise calls next with the body
+// restored. Bodies larger than 10 MiB are rejected.
+func (sv *SignatureVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Printf("Rejected request: failed to read body: %v", err)
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if err := sv.Verify(r.Context(), r, body); err != nil {
+			log.Printf("Rejected request: %v", err)
+			http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+// DefaultClockSkew is the leeway allowed when checking the exp, iat and
+// nbf claims of tokens, and the time of request signatures.
+const DefaultClockSkew = 30 * time.Second
+
+// maxReportedSkew is how far past the leeway a token may have expired and
+// still be reported as a clock problem. Tokens expired for longer are
+// stale rather than skewed.
+const maxReportedSkew = 5 * time.Minute
+
+// ErrClockSkew matches, with errors.Is, the *ClockSkewError returned for
+// tokens that are valid except for their times.
+var ErrClockSkew = errors.New("verify: clock skew")
+
+// ClockSkewError is returned for a token with a valid signature, issuer
+// and audience that was rejected only because of its times: one issued or
+// not valid until after now, or one that expired moments ago. These point
+// to the clock of the caller or of this service being off, rather than to
+// a token that shouldn't be trusted.
+type ClockSkewError struct {
+	// Claim is the claim that failed: exp, iat or nbf.
+	Claim string
+	// Skew is how far the claim is from now: how long ago the token
+	// expired, or how far in the future it was issued or becomes valid.
+	Skew time.Duration
+	// Leeway is the clock skew that was allowed.
+	Leeway time.Duration
+}
+
+func (e *ClockSkewError) Error() string {
+	switch e.Claim {
+	case "exp":
+		return fmt.Sprintf("verify: token expired %s ago, more than the allowed clock skew of %s", e.Skew, e.Leeway)
+	default:
+		return fmt.Sprintf("verify: token %s is %s in the future, more than the allowed clock skew of %s", e.Claim, e.Skew, e.Leeway)
+	}
+}
+
+// Is reports whether target is ErrClockSkew.
+func (e *ClockSkewError) Is(target error) bool {
+	return target == ErrClockSkew
+}
+
+// WithClockSkew sets the leeway allowed when checking the exp, iat and nbf
+// claims of tokens. The default is DefaultClockSkew. Without WithKeySet,
+// tokens are checked with idtoken.Validate, which allows no leeway on exp,
+// so the leeway only applies to iat and nbf.
+func WithClockSkew(d time.Duration) Option {
+	return func(v *Verifier) {
+		v.leeway = d
+	}
+}
+
+// checkTimes checks the exp, iat and nbf claims of payload against now,
+// allowing leeway either way.
+func checkTimes(payload *idtoken.Payload, now time.Time, leeway time.Duration) error {
+	if late := now.Sub(time.Unix(payload.Expires, 0)); late > leeway {
+		if late > leeway+maxReportedSkew {
+			return errors.New("verify: token expired")
+		}
+		return &ClockSkewError{Claim: "exp", Skew: late.Round(time.Second), Leeway: leeway}
+	}
+	if early := time.Unix(payload.IssuedAt, 0).Sub(now); early > leeway {
+		return &ClockSkewError{Claim: "iat", Skew: early.Round(time.Second), Leeway: leeway}
+	}
+	if nbf, ok := payload.Claims["nbf"].(float64); ok {
+		if early := time.Unix(int64(nbf), 0).Sub(now); early > leeway {
+			return &ClockSkewError{Claim: "nbf", Skew: early.Round(time.Second), Leeway: leeway}
+		}
+	}
+	return nil
+}
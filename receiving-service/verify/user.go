@@ -0,0 +1,113 @@
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/idtoken"
+)
+
+// ForwardedAuthorizationHeader carries the end user's credentials when a
+// sending service calls on a user's behalf with its own ID token in
+// Authorization or X-Serverless-Authorization.
+const ForwardedAuthorizationHeader = "X-Forwarded-Authorization"
+
+type userKey struct{}
+
+type userClaimsKey struct{}
+
+// WithForwardedUser also requires the end user's ID token in the
+// X-Forwarded-Authorization header, validated with users: its audience is
+// the users Verifier's, normally the OAuth client ID the user signed in
+// with, and its allowlist restricts which users are admitted. Requests
+// whose service token is valid but that carry no valid user token are
+// rejected with 401 Unauthorized, and users that are not allowed with 403
+// Forbidden. The user's payload and claims are stored in the request
+// context next to the calling service's, for UserClaimsFromContext.
+func WithForwardedUser(users *Verifier) Option {
+	return func(v *Verifier) {
+		v.users = users
+	}
+}
+
+// UserNotAllowedError is returned by AuthenticateUser for a valid user
+// token whose user is not on the allowlist.
+type UserNotAllowedError struct {
+	Email   string
+	Subject string
+}
+
+func (e *UserNotAllowedError) Error() string {
+	return fmt.Sprintf("user %q (sub %s) is not on the allowlist", e.Email, e.Subject)
+}
+
+// AuthenticateUser validates the end user's token and checks the user
+// against the allowlist. It returns a copy of ctx carrying the user's
+// verified payload and claims. A user that is not allowed is reported with
+// a *UserNotAllowedError.
+func (v *Verifier) AuthenticateUser(ctx context.Context, token string) (context.Context, error) {
+	payload, err := v.validate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	claims := ClaimsFromPayload(payload)
+	if !v.allowlist.allows(claims) {
+		return nil, &UserNotAllowedError{Email: claims.Email, Subject: claims.Subject}
+	}
+	ctx = context.WithValue(ctx, userKey{}, payload)
+	return context.WithValue(ctx, userClaimsKey{}, claims), nil
+}
+
+// UserPayloadFromContext returns the verified payload of the end user's
+// token stored in ctx by a Verifier configured with WithForwardedUser, if
+// any.
+func UserPayloadFromContext(ctx context.Context) (*idtoken.Payload, bool) {
+	payload, ok := ctx.Value(userKey{}).(*idtoken.Payload)
+	return payload, ok
+}
+
+// UserClaimsFromContext returns the claims of the end user's verified
+// token stored in ctx by a Verifier configured with WithForwardedUser, if
+// any. ClaimsFromContext still returns the calling service's claims.
+func UserClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(userClaimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// authenticateUser verifies the user token forwarded with r and writes the
+// rejection if it is missing or not accepted.
+func (v *Verifier) authenticateUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, bool) {
+	token, err := bearerToken(r, []string{ForwardedAuthorizationHeader})
+	if err != nil {
+		logRejected(r, "%v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		http.Error(w, "Missing end-user token", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	ctx, err = v.users.AuthenticateUser(ctx, token)
+	var notAllowed *UserNotAllowedError
+	if errors.As(err, &notAllowed) {
+		logRejected(r, "%v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(forbiddenError{
+			Error:   "user_not_allowed",
+			Message: "User is not allowed to invoke this service",
+			Email:   notAllowed.Email,
+			Subject: notAllowed.Subject,
+		})
+		return nil, false
+	}
+	if err != nil {
+		logRejected(r, "invalid end-user token: %v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid end-user token", http.StatusUnauthorized)
+		return nil, false
+	}
+	return ctx, true
+}
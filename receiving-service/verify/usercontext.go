@@ -0,0 +1,61 @@
+package verify
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// UserContextHeader carries the end user a sending service in browser mode
+// verified, as base64url-encoded JSON of a UserContext. Unlike
+// X-Forwarded-Authorization it holds no token the receiving service can
+// check itself: it is only as trustworthy as the service that sent it.
+const UserContextHeader = "X-User-Context"
+
+// UserContext is the end user described by a sending service in the
+// X-User-Context header.
+type UserContext struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Issuer        string `json:"iss"`
+	// Provider is firebase or google.
+	Provider       string `json:"provider"`
+	SignInProvider string `json:"sign_in_provider,omitempty"`
+	Tenant         string `json:"tenant,omitempty"`
+	AuthTime       int64  `json:"auth_time,omitempty"`
+}
+
+// ErrNoUserContext is returned by UserContextFromRequest for requests
+// without an X-User-Context header.
+var ErrNoUserContext = errors.New("no user context")
+
+// UserContextFromRequest returns the end user described in the
+// X-User-Context header of r. The header is only read from requests the
+// Verifier middleware admitted, so that it comes from an authenticated
+// calling service; restrict which services may send it with the
+// allowlist.
+func UserContextFromRequest(r *http.Request) (*UserContext, error) {
+	if _, ok := ClaimsFromContext(r.Context()); !ok {
+		return nil, errors.New("user context of an unverified request")
+	}
+	value := r.Header.Get(UserContextHeader)
+	if value == "" {
+		return nil, ErrNoUserContext
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", UserContextHeader, err)
+	}
+	var u UserContext
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", UserContextHeader, err)
+	}
+	if u.Subject == "" {
+		return nil, fmt.Errorf("invalid %s header: no subject", UserContextHeader)
+	}
+	return &u, nil
+}
@@ -0,0 +1,352 @@
+// Package verify provides HTTP middleware that authenticates incoming
+// requests carrying Google-signed ID tokens.
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/idtoken"
+
+	"receiver/audit"
+)
+
+type contextKey struct{}
+
+// Verifier validates ID tokens presented in the Authorization header of
+// incoming requests.
+type Verifier struct {
+	audience  string
+	allowlist Allowlist
+	keys      *KeySet
+	headers   []string
+	users     *Verifier
+	certs     bool
+	bindings  CertBindings
+
+	replay       ReplayStore
+	replayWindow time.Duration
+	leeway       time.Duration
+
+	audit *audit.Logger
+
+	accepted   atomic.Int64
+	invalid    atomic.Int64
+	clockSkew  atomic.Int64
+	notAllowed atomic.Int64
+	replayed   atomic.Int64
+	clientCert atomic.Int64
+}
+
+// VerifierStats count the tokens a Verifier has accepted and rejected, by
+// reason.
+type VerifierStats struct {
+	Accepted int64 `json:"accepted"`
+	// Invalid counts tokens rejected for their signature, issuer,
+	// audience or expiry.
+	Invalid int64 `json:"invalid"`
+	// ClockSkew counts tokens rejected only because of their times, which
+	// points to a clock being off rather than to a bad token.
+	ClockSkew  int64 `json:"clock_skew"`
+	NotAllowed int64 `json:"not_allowed"`
+	Replayed   int64 `json:"replayed"`
+	// ClientCert counts requests rejected for their client certificate,
+	// with WithClientCertificates.
+	ClientCert int64 `json:"client_cert"`
+}
+
+// Stats returns the Verifier's counters.
+func (v *Verifier) Stats() VerifierStats {
+	return VerifierStats{
+		Accepted:   v.accepted.Load(),
+		Invalid:    v.invalid.Load(),
+		ClockSkew:  v.clockSkew.Load(),
+		NotAllowed: v.notAllowed.Load(),
+		Replayed:   v.replayed.Load(),
+		ClientCert: v.clientCert.Load(),
+	}
+}
+
+// googleIssuers are the issuers of Google-signed ID tokens. idtoken.Validate
+// checks the signature and audience but not the issuer.
+var googleIssuers = map[string]bool{
+	"accounts.google.com":         true,
+	"https://accounts.google.com": true,
+}
+
+// Option configures a Verifier.
+type Option func(*Verifier)
+
+// WithAllowlist only admits callers on the allowlist. Authenticated callers
+// that are not on it are rejected with 403 Forbidden.
+func WithAllowlist(a Allowlist) Option {
+	return func(v *Verifier) {
+		v.allowlist = a
+	}
+}
+
+// WithAllowedCallers only admits callers whose verified email is one of
+// emails.
+func WithAllowedCallers(emails ...string) Option {
+	return func(v *Verifier) {
+		v.allowlist.Emails = append(v.allowlist.Emails, emails...)
+	}
+}
+
+// WithKeySet verifies tokens locally against ks instead of with
+// idtoken.Validate.
+func WithKeySet(ks *KeySet) Option {
+	return func(v *Verifier) {
+		v.keys = ks
+	}
+}
+
+// WithServerlessAuthorization also accepts the ID token in the
+// X-Serverless-Authorization header, which callers use when the
+// Authorization header carries something else, such as an end user's
+// credentials or an access token. When both headers are present, only
+// X-Serverless-Authorization is checked, as Cloud Run does, so the
+// Authorization header is left for the application.
+func WithServerlessAuthorization() Option {
+	return func(v *Verifier) {
+		v.headers = []string{ServerlessAuthorizationHeader, "Authorization"}
+	}
+}
+
+// New creates a Verifier that accepts ID tokens minted for the given
+// audience, normally the URL of the receiving service.
+func New(audience string, opts ...Option) *Verifier {
+	v := &Verifier{audience: audience, headers: []string{"Authorization"}, leeway: DefaultClockSkew}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Middleware returns a handler that rejects requests without a valid ID
+// token, without a valid end-user token when WithForwardedUser is given, or
+// without a client certificate bound to the caller when
+// WithClientCertificates is, and otherwise calls next with the verified
+// payload stored in the request context. With WithAudit, every request is
+// also recorded in an audit event.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	h := v.middleware(next)
+	if v.audit != nil {
+		h = v.audit.Middleware(h)
+	}
+	return h
+}
+
+func (v *Verifier) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.startAudit(r)
+		if v.certs {
+			// Reject requests without a certificate before checking
+			// their token.
+			if _, err := clientCertificate(r.TLS); err != nil {
+				v.clientCert.Add(1)
+				logRejected(r, "%v", err)
+				http.Error(w, "Client certificate required", http.StatusUnauthorized)
+				return
+			}
+		}
+		token, err := bearerToken(r, v.headers)
+		if err != nil {
+			logRejected(r, "%v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx, err := v.Authenticate(r.Context(), token)
+		var notAllowed *CallerNotAllowedError
+		if errors.As(err, &notAllowed) {
+			logRejected(r, "%v", err)
+			auditCaller(r, notAllowed.Email, notAllowed.Subject)
+			writeForbidden(w, notAllowed.Email, notAllowed.Subject)
+			return
+		}
+		if errors.Is(err, ErrReplayCheckFailed) {
+			logRejected(r, "%v", err)
+			http.Error(w, "Failed to check ID token", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, ErrClockSkew) {
+			logRejected(r, "%v; check the clocks of the caller and of this service", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="clock skew"`)
+			http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, ErrAudienceMismatch) {
+			logRejected(r, "%v; check the audience the caller mints tokens for", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="audience mismatch"`)
+			http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, ErrReplayed) {
+			logRejected(r, "%v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="token replayed"`)
+			http.Error(w, "Replayed ID token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			logRejected(r, "invalid ID token: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+			return
+		}
+		caller, _ := ClaimsFromContext(ctx)
+		if ctx, err = v.AuthenticateCertificate(ctx, r.TLS); err != nil {
+			logRejected(r, "%v", err)
+			auditCaller(r, caller.Email, caller.Subject)
+			http.Error(w, "Client certificate not allowed for caller", http.StatusForbidden)
+			return
+		}
+		if v.users != nil {
+			var ok bool
+			if ctx, ok = v.authenticateUser(ctx, w, r); !ok {
+				return
+			}
+		}
+		claims, _ := ClaimsFromContext(ctx)
+		user, _ := UserClaimsFromContext(ctx)
+		auditAllowed(r, claims, user)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CallerNotAllowedError is returned by Authenticate for a valid token whose
+// caller is not on the allowlist.
+type CallerNotAllowedError struct {
+	Email   string
+	Subject string
+}
+
+func (e *CallerNotAllowedError) Error() string {
+	return fmt.Sprintf("caller %q (sub %s) is not on the allowlist", e.Email, e.Subject)
+}
+
+// Authenticate validates token and checks its caller against the
+// allowlist. It returns a copy of ctx carrying the verified payload and
+// claims, for use outside HTTP handlers such as in gRPC interceptors. A
+// caller that is not allowed is reported with a *CallerNotAllowedError,
+// and with WithReplayProtection, a token seen before with ErrReplayed. A
+// token rejected only because of its times is reported with a
+// *ClockSkewError, and one minted for another audience with an
+// *AudienceMismatchError.
+func (v *Verifier) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	payload, err := v.validate(ctx, token)
+	if errors.Is(err, ErrClockSkew) {
+		v.clockSkew.Add(1)
+		return nil, err
+	}
+	if err != nil {
+		v.invalid.Add(1)
+		return nil, err
+	}
+	ctx = NewContext(ctx, payload)
+	claims, _ := ClaimsFromContext(ctx)
+	if !v.allowlist.allows(claims) {
+		v.notAllowed.Add(1)
+		return nil, &CallerNotAllowedError{Email: claims.Email, Subject: claims.Subject}
+	}
+	if v.replay != nil {
+		if err := v.checkReplay(ctx, token, payload); err != nil {
+			if errors.Is(err, ErrReplayed) {
+				v.replayed.Add(1)
+			} else if !errors.Is(err, ErrReplayCheckFailed) {
+				v.invalid.Add(1)
+			}
+			return nil, err
+		}
+	}
+	v.accepted.Add(1)
+	return ctx, nil
+}
+
+func (v *Verifier) validate(ctx context.Context, token string) (*idtoken.Payload, error) {
+	if v.keys != nil {
+		return v.keys.validate(ctx, token, v.audience, v.leeway)
+	}
+	// The audience is checked here rather than by idtoken.Validate, once
+	// the signature is known to be good, so that a mismatch can be told
+	// apart from other failures.
+	payload, err := idtoken.Validate(ctx, token, "")
+	if err != nil {
+		return nil, err
+	}
+	if !googleIssuers[payload.Issuer] {
+		return nil, fmt.Errorf("unexpected issuer %q", payload.Issuer)
+	}
+	if v.audience != "" && payload.Audience != v.audience {
+		return nil, &AudienceMismatchError{Audience: payload.Audience, Expected: v.audience}
+	}
+	// idtoken.Validate has checked exp, strictly, but not iat or nbf.
+	if err := checkTimes(payload, time.Now(), v.leeway); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// NewContext returns a copy of ctx carrying the verified token payload and
+// its claims.
+func NewContext(ctx context.Context, payload *idtoken.Payload) context.Context {
+	ctx = context.WithValue(ctx, contextKey{}, payload)
+	return context.WithValue(ctx, claimsKey{}, ClaimsFromPayload(payload))
+}
+
+// PayloadFromContext returns the verified token payload stored in ctx by
+// the middleware, if any.
+func PayloadFromContext(ctx context.Context) (*idtoken.Payload, bool) {
+	payload, ok := ctx.Value(contextKey{}).(*idtoken.Payload)
+	return payload, ok
+}
+
+// forbiddenError is the body of a 403 response for an authenticated caller
+// that is not on the allowlist.
+type forbiddenError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Email   string `json:"email,omitempty"`
+	Subject string `json:"sub"`
+}
+
+func writeForbidden(w http.ResponseWriter, email, sub string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(forbiddenError{
+		Error:   "caller_not_allowed",
+		Message: "Caller is not allowed to invoke this service",
+		Email:   email,
+		Subject: sub,
+	})
+}
+
+// ServerlessAuthorizationHeader is the header Cloud Run reads the ID token
+// from, in preference to Authorization, when a request carries both.
+const ServerlessAuthorizationHeader = "X-Serverless-Authorization"
+
+// bearerToken returns the bearer token in the first of headers that r
+// carries.
+func bearerToken(r *http.Request, headers []string) (string, error) {
+	for _, name := range headers {
+		header := r.Header.Get(name)
+		if header == "" {
+			continue
+		}
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errors.New("malformed " + name + " header")
+		}
+		return token, nil
+	}
+	return "", errors.New("missing " + strings.Join(headers, " or ") + " header")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/downstream"
+	"sender/logging"
+	"sender/outbox"
+)
+
+// defaultDeadLetterLimit is how many dead letters are listed or replayed by
+// default.
+const defaultDeadLetterLimit = 100
+
+// flushResult is the body of a /admin/cache/flush response.
+type flushResult struct {
+	// Flushed are the audiences whose clients and tokens were discarded.
+	Flushed []string `json:"flushed"`
+	// Responses is set if the response cache was purged.
+	Responses bool `json:"responses_purged,omitempty"`
+}
+
+// flushCaches returns a handler for POST /admin/cache/flush that discards
+// the cached clients and ID tokens of the services named with ?service=,
+// which may be repeated, or of every service, so that they are created and
+// minted again on the next request. Flushing every service also purges
+// responses, the response cache, if it is a ResponsePurger; with a shared
+// token store or response cache, the flush applies to every instance.
+func flushCaches(registry *downstream.Registry, responses authclient.ResponseStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			apierror.Write(w, r, apierror.New(http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Use POST to flush caches"))
+			return
+		}
+		names := r.URL.Query()["service"]
+		for _, name := range names {
+			if _, ok := registry.Service(name); !ok {
+				apierror.Write(w, r, apierror.New(http.StatusNotFound, apierror.CodeUnknownService, "Unknown downstream service"))
+				return
+			}
+		}
+		flushed, err := registry.Flush(names...)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Failed to flush client caches", slog.Any("error", err))
+			apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Failed to flush caches"))
+			return
+		}
+		if flushed == nil {
+			flushed = []string{}
+		}
+		logging.FromContext(r.Context()).Info("Flushed client caches", slog.Any("audiences", flushed))
+		result := flushResult{Flushed: flushed}
+		if p, ok := responses.(authclient.ResponsePurger); ok && len(names) == 0 {
+			if err := p.Purge(r.Context()); err != nil {
+				logging.FromContext(r.Context()).Error("Failed to purge response cache", slog.Any("error", err))
+				apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Failed to purge the response cache"))
+				return
+			}
+			logging.FromContext(r.Context()).Info("Purged response cache")
+			result.Responses = true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// stateResult is the body of a GET /admin/state response.
+type stateResult struct {
+	Services []serviceState           `json:"services"`
+	Clients  []authclient.ClientState `json:"clients"`
+}
+
+// serviceState describes a registered downstream service.
+type serviceState struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Audience string `json:"audience"`
+}
+
+// adminState returns a handler for GET /admin/state that describes the
+// registered services and the cached clients, with when their ID tokens
+// were minted and expire, their circuit breaker states and their errors of
+// the last five minutes. Tokens themselves are never included.
+func adminState(registry *downstream.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			apierror.Write(w, r, apierror.New(http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Use GET to read the state"))
+			return
+		}
+		res := stateResult{Services: []serviceState{}, Clients: registry.State()}
+		for _, name := range registry.Names() {
+			svc, _ := registry.Service(name)
+			res.Services = append(res.Services, serviceState{Name: name, URL: svc.URL, Audience: svc.Audience})
+		}
+		if res.Clients == nil {
+			res.Clients = []authclient.ClientState{}
+		}
+		writeAdminJSON(w, http.StatusOK, res)
+	}
+}
+
+// deadLetterList is the body of a GET /admin/dead-letters response.
+type deadLetterList struct {
+	DeadLetters []*outbox.Message `json:"dead_letters"`
+}
+
+// replayResult is the body of a response to a replay.
+type replayResult struct {
+	// Replayed are the IDs of the messages queued again.
+	Replayed []string `json:"replayed"`
+}
+
+// deadLetters returns a handler for the outbox's dead letters:
+//
+//	GET    /admin/dead-letters              lists dead letters, without their bodies
+//	GET    /admin/dead-letters/{id}         returns one, with its body
+//	POST   /admin/dead-letters/{id}/replay  queues one for delivery again
+//	POST   /admin/dead-letters/replay       queues every listed one again
+//	DELETE /admin/dead-letters/{id}         discards one
+//
+// Listing and replaying all take ?service= to select the dead letters of a
+// service and ?limit=, which defaults to 100, to bound how many are read.
+func deadLetters(box *outbox.Outbox) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/dead-letters"), "/")
+		id, action, _ := strings.Cut(rest, "/")
+		switch {
+		case rest == "" && r.Method == http.MethodGet:
+			msgs, ok := listDeadLetters(w, r, box)
+			if !ok {
+				return
+			}
+			for i, m := range msgs {
+				summary := *m
+				summary.Body = nil
+				msgs[i] = &summary
+			}
+			writeAdminJSON(w, http.StatusOK, deadLetterList{DeadLetters: msgs})
+		case rest == "replay" && r.Method == http.MethodPost:
+			msgs, ok := listDeadLetters(w, r, box)
+			if !ok {
+				return
+			}
+			replayed := []string{}
+			for _, m := range msgs {
+				if _, err := box.Replay(r.Context(), m.ID); err != nil && !errors.Is(err, outbox.ErrNotFound) {
+					writeDeadLetterError(w, r, err)
+					return
+				}
+				replayed = append(replayed, m.ID)
+			}
+			writeAdminJSON(w, http.StatusAccepted, replayResult{Replayed: replayed})
+		case action == "" && r.Method == http.MethodGet:
+			m, err := box.DeadLetter(r.Context(), id)
+			if err != nil {
+				writeDeadLetterError(w, r, err)
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, m)
+		case action == "replay" && r.Method == http.MethodPost:
+			if _, err := box.Replay(r.Context(), id); err != nil {
+				writeDeadLetterError(w, r, err)
+				return
+			}
+			writeAdminJSON(w, http.StatusAccepted, replayResult{Replayed: []string{id}})
+		case action == "" && r.Method == http.MethodDelete:
+			if err := box.Discard(r.Context(), id); err != nil {
+				writeDeadLetterError(w, r, err)
+				return
+			}
+			logging.FromContext(r.Context()).Info("Discarded dead-lettered outbox message", slog.String("message_id", id))
+			w.WriteHeader(http.StatusNoContent)
+		case action == "" || action == "replay" || rest == "replay":
+			apierror.Write(w, r, apierror.New(http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed"))
+		default:
+			apierror.Write(w, r, apierror.New(http.StatusNotFound, apierror.CodeNotFound, "Not found"))
+		}
+	}
+}
+
+// listDeadLetters returns the dead letters selected by the ?service= and
+// ?limit= parameters of r, or writes an error and returns false.
+func listDeadLetters(w http.ResponseWriter, r *http.Request, box *outbox.Outbox) ([]*outbox.Message, bool) {
+	limit := defaultDeadLetterLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			apierror.Write(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "limit must be a positive integer"))
+			return nil, false
+		}
+		limit = n
+	}
+	msgs, err := box.DeadLetters(r.Context(), limit)
+	if err != nil {
+		writeDeadLetterError(w, r, err)
+		return nil, false
+	}
+	service := r.URL.Query().Get("service")
+	selected := []*outbox.Message{}
+	for _, m := range msgs {
+		if service == "" || m.Service == service {
+			selected = append(selected, m)
+		}
+	}
+	return selected, true
+}
+
+func writeDeadLetterError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, outbox.ErrNotFound) {
+		apierror.Write(w, r, apierror.New(http.StatusNotFound, apierror.CodeNotFound, "No dead letter with this ID"))
+		return
+	}
+	logging.FromContext(r.Context()).Error("Failed to access outbox dead letters", slog.Any("error", err))
+	apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Failed to access dead letters"))
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,81 @@
+// Package admin guards the sending service's administrative endpoints,
+// which only the operators' accounts may call.
+package admin
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+
+	"sender/apierror"
+	"sender/logging"
+)
+
+// googleIssuers are the issuers of Google-signed ID tokens.
+var googleIssuers = map[string]bool{
+	"accounts.google.com":         true,
+	"https://accounts.google.com": true,
+}
+
+var errInvalidIssuer = errors.New("admin: token not issued by Google")
+
+// Require returns a handler that calls next only for requests carrying a
+// Google-signed ID token for audience, normally the URL of the sending
+// service, whose verified email is one of callers. Other requests are
+// answered with 401 Unauthorized or 403 Forbidden. Cloud Run's own IAM
+// check only asks for roles/run.invoker, which every calling service has,
+// so the endpoints it guards need this narrower check too.
+func Require(audience string, callers []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(callers))
+	for _, c := range callers {
+		allowed[strings.ToLower(c)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.FromContext(r.Context())
+		email, ok := Authenticate(w, r, audience)
+		if !ok {
+			return
+		}
+		if !allowed[strings.ToLower(email)] {
+			logger.Warn("Rejected admin request from caller not allowed", slog.String("caller", email))
+			apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodePermissionDenied, "Caller may not use admin endpoints"))
+			return
+		}
+		logger.Info("Admin request", slog.String("caller", email), slog.String("path", r.URL.Path))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authenticate returns the verified email of the caller of r, from a
+// Google-signed ID token for audience in its Authorization header. If the
+// token is missing or invalid, or has no verified email, it answers r with
+// 401 Unauthorized or 403 Forbidden and returns false.
+func Authenticate(w http.ResponseWriter, r *http.Request, audience string) (string, bool) {
+	logger := logging.FromContext(r.Context())
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthenticated, "Missing bearer token"))
+		return "", false
+	}
+	payload, err := idtoken.Validate(r.Context(), token, audience)
+	if err == nil && !googleIssuers[payload.Issuer] {
+		err = errInvalidIssuer
+	}
+	if err != nil {
+		logger.Warn("Rejected request with invalid ID token", slog.String("path", r.URL.Path), slog.Any("error", err))
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthenticated, "Invalid ID token"))
+		return "", false
+	}
+	email, _ := payload.Claims["email"].(string)
+	if verified, _ := payload.Claims["email_verified"].(bool); !verified || email == "" {
+		logger.Warn("Rejected request from caller without a verified email", slog.String("path", r.URL.Path), slog.String("subject", payload.Subject))
+		apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodePermissionDenied, "Caller has no verified email"))
+		return "", false
+	}
+	return email, true
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"sender/apierror"
+	"sender/authclient"
+)
+
+// sessionAffinity sends the downstream calls of requests carrying header as
+// part of the session its value names, so that the calls of a caller's
+// workflow reach the same receiving service instance where possible, in
+// every mode. The header is removed, and the session's ID sent downstream
+// in the X-Session-Affinity header instead.
+func sessionAffinity(header string, sessions *authclient.Sessions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session, err := sessions.Get(id)
+		if err != nil {
+			apierror.Write(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "Invalid session ID in "+header))
+			return
+		}
+		r = r.Clone(authclient.CallContext(r.Context(), authclient.SessionAffinity(session)))
+		r.Header.Del(header)
+		next.ServeHTTP(w, r)
+	})
+}
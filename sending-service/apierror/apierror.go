@@ -0,0 +1,185 @@
+// Package apierror writes the JSON error responses of the sending service,
+// so that its clients can tell failures apart without parsing messages.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sender/authclient"
+	"sender/handoff"
+	"sender/logging"
+)
+
+// Codes identify the kind of failure in an error response.
+const (
+	CodeUnauthenticated       = "unauthenticated"
+	CodePermissionDenied      = "permission_denied"
+	CodeMethodNotAllowed      = "method_not_allowed"
+	CodeNotFound              = "not_found"
+	CodeConflict              = "conflict"
+	CodeUnknownService        = "unknown_service"
+	CodeUnknownTenant         = "unknown_tenant"
+	CodeAudienceNotAllowed    = "audience_not_allowed"
+	CodeRateLimited           = "rate_limited"
+	CodeOverloaded            = "overloaded"
+	CodeDeadlineExceeded      = "deadline_exceeded"
+	CodeTokenUnavailable      = "token_unavailable"
+	CodeCircuitOpen           = "circuit_open"
+	CodeConcurrencyLimited    = "concurrency_limited"
+	CodeRetryBudgetExhausted  = "retry_budget_exhausted"
+	CodeDownstreamTimeout     = "downstream_timeout"
+	CodeDownstreamRejected    = "downstream_rejected"
+	CodeAudienceRejected      = "audience_rejected"
+	CodeDownstreamError       = "downstream_error"
+	CodeDownstreamUnreachable = "downstream_unreachable"
+	CodeResponseTooLarge      = "response_too_large"
+	CodeBadResponse           = "bad_response"
+	CodeBadRequest            = "bad_request"
+	CodeRequestTooLarge       = "request_too_large"
+	CodeOutboxUnavailable     = "outbox_unavailable"
+	CodeHookFailed            = "hook_failed"
+	CodeHandoffFailed         = "handoff_failed"
+	CodeInternal              = "internal"
+)
+
+// Error is an error response.
+type Error struct {
+	// Status is the HTTP status code of the response.
+	Status int `json:"-"`
+	// Code is one of the Code constants.
+	Code string `json:"code"`
+	// Message describes the failure for people.
+	Message string `json:"message"`
+	// RequestID is the ID the request is logged with, for correlating a
+	// failure with the sending service's logs.
+	RequestID string `json:"request_id,omitempty"`
+	// DownstreamStatus is the status code the downstream service answered
+	// with, if the failure is its response.
+	DownstreamStatus int `json:"downstream_status,omitempty"`
+	// RetryAfter, if positive, is sent in a Retry-After header.
+	RetryAfter time.Duration `json:"-"`
+	// RetryAfterSeconds repeats the Retry-After header in the body, for
+	// callers that only look at the body.
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+}
+
+// concurrencyRetryAfter is how long callers turned away by a concurrency
+// limit are asked to wait, since a slot usually frees up within a second.
+const concurrencyRetryAfter = time.Second
+
+// New returns an Error with the given status, code and message.
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// FromDownstream describes a failed downstream call: 503 with a
+// Retry-After when the circuit breaker is open, too many requests are in
+// flight or the retry budget is spent, 504 when the call timed out, 500
+// when no ID token could be obtained, the downstream status for an error
+// response, along with its Retry-After for 429 and 503, the status chosen
+// by a request or response hook that failed, or else 502, and 502 when the
+// receiving service sent a bad response or could not be reached.
+func FromDownstream(err error) *Error {
+	var (
+		openErr   *authclient.CircuitOpenError
+		statusErr *authclient.DownstreamStatusError
+		hookErr   *authclient.HookError
+		budgetErr *authclient.RetryBudgetError
+		described Describer
+	)
+	switch {
+	case errors.As(err, &described):
+		return described.APIError()
+	case errors.As(err, &hookErr):
+		status := hookErr.Status
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		return New(status, CodeHookFailed, "Failed to process the request or response")
+	case errors.As(err, &openErr):
+		e := New(http.StatusServiceUnavailable, CodeCircuitOpen, "Receiving service unavailable")
+		e.RetryAfter = openErr.RetryAfter
+		return e
+	case errors.As(err, new(*http.MaxBytesError)):
+		return New(http.StatusRequestEntityTooLarge, CodeRequestTooLarge, "Request body is too large")
+	case errors.Is(err, authclient.ErrReplayLimit):
+		return New(http.StatusRequestEntityTooLarge, CodeRequestTooLarge, "Request body is too large to send")
+	case errors.Is(err, authclient.ErrUnsignableUpload):
+		return New(http.StatusRequestEntityTooLarge, CodeRequestTooLarge, "Request body is too large to sign")
+	case errors.Is(err, handoff.ErrHandoff):
+		return New(http.StatusBadGateway, CodeHandoffFailed, "Failed to hand off the request body")
+	case errors.Is(err, authclient.ErrConcurrencyLimit):
+		e := New(http.StatusServiceUnavailable, CodeConcurrencyLimited, "Too many requests in flight to the receiving service")
+		e.RetryAfter = concurrencyRetryAfter
+		return e
+	case errors.As(err, &budgetErr):
+		e := New(http.StatusServiceUnavailable, CodeRetryBudgetExhausted, "Receiving service is failing and retries are exhausted")
+		e.RetryAfter = budgetErr.RetryAfter
+		return e
+	case errors.As(err, &statusErr):
+		code := CodeDownstreamError
+		if errors.Is(err, authclient.ErrAudienceRejected) {
+			code = CodeAudienceRejected
+		} else if errors.Is(err, authclient.ErrUnauthorized) {
+			code = CodeDownstreamRejected
+		}
+		e := New(statusErr.Code, code, "Receiving service answered "+strconv.Itoa(statusErr.Code))
+		e.DownstreamStatus = statusErr.Code
+		e.RetryAfter, _ = statusErr.RetryAfter()
+		return e
+	case errors.Is(err, authclient.ErrBadResponse):
+		return New(http.StatusBadGateway, CodeBadResponse, "Receiving service sent a bad response")
+	case errors.Is(err, authclient.ErrDownstreamTimeout):
+		return New(http.StatusGatewayTimeout, CodeDownstreamTimeout, "Receiving service timed out")
+	case errors.Is(err, authclient.ErrTokenMint):
+		return New(http.StatusInternalServerError, CodeTokenUnavailable, "Failed to obtain an ID token")
+	}
+	return New(http.StatusBadGateway, CodeDownstreamUnreachable, "Failed to reach the receiving service")
+}
+
+// Describer is implemented by errors that carry the response describing
+// them, such as those of request bodies rejected while they were being
+// forwarded. FromDownstream answers with that response.
+type Describer interface {
+	APIError() *Error
+}
+
+// envelope is the body of an error response.
+type envelope struct {
+	Error *Error `json:"error"`
+}
+
+// Write sends e as the response to r, with the ID r is logged with.
+func Write(w http.ResponseWriter, r *http.Request, e *Error) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if e.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(retryAfterSeconds(e.RetryAfter)))
+	}
+	w.WriteHeader(e.Status)
+	WriteBody(w, r, e)
+}
+
+// WriteBody writes e as the body of a response to r whose status line has
+// already been sent, as when a long-running call fails after the caller
+// was sent keep-alives.
+func WriteBody(w io.Writer, r *http.Request, e *Error) {
+	body := *e
+	body.RequestID = logging.RequestID(r.Context())
+	if e.RetryAfter > 0 {
+		body.RetryAfterSeconds = retryAfterSeconds(e.RetryAfter)
+	}
+	json.NewEncoder(w).Encode(envelope{Error: &body})
+}
+
+// retryAfterSeconds rounds d up to whole seconds, as Retry-After is sent.
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/callback"
+	"sender/downstream"
+	"sender/logging"
+)
+
+// callbackEntries bounds the callbacks an instance keeps in memory.
+const callbackEntries = 10000
+
+// asyncResult is the body of a response to an accepted asynchronous call.
+type asyncResult struct {
+	ID      string `json:"id"`
+	Service string `json:"service"`
+	// StatusURL is where the result can be fetched once sent.
+	StatusURL string `json:"status_url"`
+}
+
+// asyncCall returns a handler for /async/{service}/{path} that sends the
+// request to path on the named service with a callback registered in
+// callbacks, and answers 202 Accepted with the callback's URL in Location
+// once the service has accepted the call. The service sends the result to
+// that URL later, where the caller fetches it. Bodies over maxBody bytes
+// are rejected.
+func asyncCall(callbacks *callback.Registry, registry *downstream.Registry, maxBody int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/async/"), "/")
+		svc, ok := registry.Service(name)
+		if !ok {
+			apierror.Write(w, r, apierror.New(http.StatusNotFound, apierror.CodeUnknownService, "Unknown downstream service"))
+			return
+		}
+		path = "/" + path
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			apierror.Write(w, r, apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Request body is too large"))
+			return
+		case err != nil:
+			apierror.Write(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "Failed to read request body"))
+			return
+		}
+
+		logger := logging.FromContext(r.Context()).With(slog.String("service", name))
+		client, err := registry.Client(name)
+		if err != nil {
+			logger.Error("Failed to create authenticated client", slog.Any("error", err))
+			apierror.Write(w, r, apierror.FromDownstream(err))
+			return
+		}
+		cb, err := callbacks.Register(r.Context(), name)
+		if err != nil {
+			logger.Error("Failed to register callback", slog.Any("error", err))
+			apierror.Write(w, r, apierror.New(http.StatusServiceUnavailable, apierror.CodeInternal, "Failed to register the callback"))
+			return
+		}
+		logger = logger.With(slog.String("callback_id", cb.ID))
+
+		ctx := authclient.ForwardAuthorization(r.Context(), r.Header.Get("Authorization"))
+		req, err := http.NewRequestWithContext(ctx, r.Method, strings.TrimSuffix(svc.URL, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Failed to create request"))
+			return
+		}
+		for _, name := range enqueuedHeaders {
+			if v := r.Header.Get(name); v != "" {
+				req.Header.Set(name, v)
+			}
+		}
+		cb.Attach(req.Header)
+
+		resp, err := client.Do(req)
+		if err == nil {
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+			resp.Body.Close()
+			if resp.StatusCode >= http.StatusMultipleChoices {
+				err = &authclient.DownstreamStatusError{Code: resp.StatusCode, Status: resp.Status, Header: resp.Header, Body: data}
+			}
+		}
+		if err != nil {
+			logger.Warn("Asynchronous call failed", slog.Any("error", err))
+			apierror.Write(w, r, apierror.FromDownstream(err))
+			return
+		}
+		logger.Info("Sent asynchronous call", slog.String("callback_url", cb.URL))
+
+		w.Header().Set("Location", callbacks.Path()+cb.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(asyncResult{ID: cb.ID, Service: name, StatusURL: cb.URL})
+	}
+}
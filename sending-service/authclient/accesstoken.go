@@ -0,0 +1,82 @@
+package authclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+// ServerlessAuthorizationHeader is the header Cloud Run reads the ID token
+// from, in preference to Authorization, when a request carries both.
+const ServerlessAuthorizationHeader = "X-Serverless-Authorization"
+
+// CloudPlatformScope is the default scope of access tokens from
+// DefaultAccessTokenSource and ImpersonatedAccessTokenSource.
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// WithTokenHeader sends the ID token in the named header instead of
+// Authorization, normally ServerlessAuthorizationHeader for receiving
+// services that consume the Authorization header themselves, for example
+// for end-user authentication or behind API Gateway. Cloud Run checks the
+// ID token in either header.
+func WithTokenHeader(name string) Option {
+	return func(o *options) {
+		o.tokenHeader = name
+	}
+}
+
+// WithAccessToken sends an OAuth2 access token from ts along with the ID
+// token, for receiving services that act on the caller's behalf, such as
+// ones that call Google APIs with the caller's token or sit behind ESPv2.
+// The access token is sent in the Authorization header, and the ID token
+// moves to the X-Serverless-Authorization header, where Cloud Run checks
+// it, so the receiving service gets the access token untouched, unless
+// WithTokenHeader names another header. ts should
+// cache tokens, as oauth2.ReuseTokenSource does.
+func WithAccessToken(ts oauth2.TokenSource) Option {
+	return func(o *options) {
+		o.accessTokens = ts
+	}
+}
+
+// DefaultAccessTokenSource returns a source of access tokens for scopes,
+// or for CloudPlatformScope if none are given, from Application Default
+// Credentials or the metadata server.
+func DefaultAccessTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if len(scopes) == 0 {
+		scopes = []string{CloudPlatformScope}
+	}
+	ts, err := google.DefaultTokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to create access token source: %w", err)
+	}
+	return ts, nil
+}
+
+// ImpersonatedAccessTokenSource returns a source of access tokens for
+// scopes, or for CloudPlatformScope if none are given, of the service
+// account targetPrincipal, minted through the IAM Credentials
+// generateAccessToken API as with ImpersonatedTokenSource.
+func ImpersonatedAccessTokenSource(ctx context.Context, targetPrincipal string, scopes []string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	return Impersonation{TargetPrincipal: targetPrincipal}.AccessTokenSource(ctx, scopes, opts...)
+}
+
+// accessTokenTransport attaches access tokens in the Authorization header.
+type accessTokenTransport struct {
+	next   http.RoundTripper
+	source oauth2.TokenSource
+}
+
+func (t *accessTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := t.source.Token()
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to obtain access token: %w", err)
+	}
+	r := req.Clone(req.Context())
+	tok.SetAuthHeader(r)
+	return t.next.RoundTrip(r)
+}
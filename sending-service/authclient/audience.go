@@ -0,0 +1,40 @@
+package authclient
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrAudienceRejected is matched by errors.Is for a *DownstreamStatusError
+// with status 401 whose response says the ID token was minted for the
+// wrong audience, as the receiving service's verify package and IAP do.
+// Minting a new token does not help: the client must be created for the
+// audience the receiver expects, such as its custom audience or OAuth
+// client ID.
+var ErrAudienceRejected = errors.New("authclient: downstream rejected the ID token audience")
+
+// AudienceRejected reports whether resp rejects the audience of the ID
+// token it answers, going by its WWW-Authenticate header. It does not
+// read the body.
+func AudienceRejected(resp *http.Response) bool {
+	return audienceRejected(resp.StatusCode, resp.Header, nil)
+}
+
+// audienceRejected reports whether a response with code, header and body
+// rejects the audience of the token: a 401 whose WWW-Authenticate, such as
+// Bearer error="invalid_token", error_description="audience mismatch", or
+// body, such as IAP's "Invalid IAP credentials: JWT audience doesn't
+// match this application", names the audience.
+func audienceRejected(code int, header http.Header, body []byte) bool {
+	if code != http.StatusUnauthorized {
+		return false
+	}
+	for _, v := range header.Values("WWW-Authenticate") {
+		if strings.Contains(strings.ToLower(v), "audience") {
+			return true
+		}
+	}
+	return bytes.Contains(bytes.ToLower(body), []byte("audience"))
+}
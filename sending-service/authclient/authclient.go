@@ -0,0 +1,350 @@
+// Package authclient builds HTTP clients that authenticate to Cloud Run
+// services with Google-signed ID tokens.
+package authclient
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// Client is an HTTP client that attaches an ID token for a single audience
+// to every request it sends. If the receiving service rejects a token with
+// 401 or 403, the client mints a new token and retries the request once.
+type Client struct {
+	audience   string
+	baseURL    string
+	source     *tokenSource
+	breaker    *circuitBreaker
+	httpClient *http.Client
+	created    time.Time
+}
+
+// Option configures a Client.
+type Option func(*options)
+
+type options struct {
+	timeout         time.Duration
+	transport       http.RoundTripper
+	http3           *HTTP3Settings
+	scopes          []string
+	retry           *RetryPolicy
+	replayLimit     int64
+	uploads         *UploadSettings
+	uploadObserver  UploadObserver
+	breaker         *BreakerSettings
+	tokenSourceFunc TokenSourceFunc
+	tokenStore      TokenStore
+	logger          *slog.Logger
+	observer        TokenObserver
+	baseURL         string
+	refreshSkew     time.Duration
+	staleGrace      time.Duration
+	timeouts        TimeoutPolicy
+	headers         func() http.Header
+	hedgeDelay      time.Duration
+	dedup           *DedupSettings
+	cacheStore      ResponseStore
+	cacheTTL        time.Duration
+	signer          Signer
+	keyWrapper      KeyWrapper
+	quotaProject    string
+	userAgent       string
+	clientVersion   string
+	clientLabels    string
+	accessTokens    oauth2.TokenSource
+	tokenHeader     string
+
+	forwardAuthorization bool
+	idempotencyKeys      bool
+	compression          *CompressionSettings
+	decompress           bool
+	iapClientID          string
+	iapClientIDs         map[string]string
+
+	retryBudget   *RetryBudget
+	concurrency   *ConcurrencyLimit
+	limitObserver LimitObserver
+
+	retryObservers        []RetryObserver
+	backpressureObservers []BackpressureObserver
+
+	middleware        []Middleware
+	attemptMiddleware []Middleware
+
+	propagateDeadline bool
+	deadlineReserve   time.Duration
+}
+
+// WithTimeout sets the overall time limit for requests made by the client.
+// A zero value means no timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithTransport sets the base transport used to send requests once the ID
+// token has been attached. It defaults to http.DefaultTransport.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = rt
+	}
+}
+
+// WithScopes sets the OAuth2 scopes requested when minting tokens from
+// service account credentials.
+func WithScopes(scopes ...string) Option {
+	return func(o *options) {
+		o.scopes = scopes
+	}
+}
+
+// WithLogger sets the logger used to report token refreshes and retries.
+// It defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// New creates a Client that authenticates requests with ID tokens for the
+// given audience. The audience is normally the URL of the receiving service.
+func New(ctx context.Context, audience string, opts ...Option) (*Client, error) {
+	if audience == "" {
+		return nil, errors.New("authclient: audience must not be empty")
+	}
+
+	o := options{
+		transport: http.DefaultTransport,
+		logger:    slog.Default(),
+		observer:  nopObserver{},
+
+		limitObserver: nopLimitObserver{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	mint := o.tokenSourceFunc
+	if mint == nil {
+		var clientOpts []option.ClientOption
+		if len(o.scopes) > 0 {
+			clientOpts = append(clientOpts, option.WithScopes(o.scopes...))
+		}
+		if o.quotaProject != "" {
+			clientOpts = append(clientOpts, option.WithQuotaProject(o.quotaProject))
+		}
+		mint = defaultTokenSourceFunc(clientOpts)
+	}
+	if o.tokenStore != nil {
+		mint = storedTokenSourceFunc(o.tokenStore, mint, max(o.refreshSkew, o.staleGrace)+minStoredTokenLife, o.logger)
+	}
+
+	ts, err := newTokenSource(ctx, audience, mint, o.observer)
+	if err != nil {
+		return nil, err
+	}
+	ts.logger, ts.staleGrace, ts.store = o.logger, o.staleGrace, o.tokenStore
+	if o.refreshSkew > 0 {
+		go ts.refreshLoop(o.refreshSkew, o.logger)
+	}
+
+	base := o.transport
+	if o.http3 != nil {
+		base = newHTTP3Transport(base, *o.http3, o.logger)
+	}
+	base = Chain(o.attemptMiddleware...)(base)
+	base = &attemptTimingTransport{next: base}
+	if o.timeouts.Attempt > 0 {
+		base = &attemptTransport{next: base, timeout: o.timeouts.Attempt}
+	}
+	if o.userAgent != "" || o.clientVersion != "" || o.clientLabels != "" {
+		base = &identityTransport{next: base, userAgent: o.userAgent, version: o.clientVersion, labels: o.clientLabels}
+	}
+	if o.quotaProject != "" {
+		base = &quotaTransport{next: base, project: o.quotaProject}
+	}
+	base = &sessionTransport{next: base}
+	base = &callHeaderTransport{next: base}
+	if o.headers != nil {
+		base = &headerTransport{next: base, headers: o.headers}
+	}
+	idTokenHeader := o.tokenHeader
+	if o.accessTokens != nil {
+		base = &accessTokenTransport{next: base, source: o.accessTokens}
+		if idTokenHeader == "" {
+			idTokenHeader = ServerlessAuthorizationHeader
+		}
+	}
+	if idTokenHeader == "" {
+		idTokenHeader = "Authorization"
+	}
+	if o.accessTokens != nil && strings.EqualFold(idTokenHeader, "Authorization") {
+		return nil, errors.New("authclient: the ID token and the access token cannot both be sent in Authorization")
+	}
+	iapClientID := o.iapClientID
+	if iapClientID == "" {
+		iapClientID = o.iapClientIDs[audience]
+	}
+	separateIAP := iapClientID != "" && iapClientID != audience
+	if iapClientID != "" {
+		it := &iapTransport{next: base, clientID: iapClientID, logger: o.logger}
+		if separateIAP {
+			if strings.EqualFold(idTokenHeader, ProxyAuthorizationHeader) {
+				return nil, errors.New("authclient: the ID token cannot be sent in Proxy-Authorization with a separate IAP token")
+			}
+			if it.source, err = newTokenSource(ctx, iapClientID, mint, o.observer); err != nil {
+				return nil, err
+			}
+			it.source.logger, it.source.staleGrace, it.source.store = o.logger, o.staleGrace, o.tokenStore
+		}
+		base = it
+	}
+	var transport http.RoundTripper = &authTransport{source: ts, next: base, logger: o.logger, header: idTokenHeader, separateIAP: separateIAP}
+	if len(o.backpressureObservers) > 0 {
+		transport = &backpressureTransport{next: transport, audience: audience, observers: o.backpressureObservers}
+	}
+	if o.concurrency != nil && o.concurrency.MaxInFlight > 0 {
+		transport = newLimitTransport(transport, audience, *o.concurrency, o.limitObserver)
+	}
+	if o.hedgeDelay > 0 {
+		transport = &hedgeTransport{next: transport, delay: o.hedgeDelay, logger: o.logger}
+	}
+	if o.retry != nil && o.retry.MaxAttempts > 1 {
+		rt := &retryTransport{next: transport, policy: *o.retry, logger: o.logger, audience: audience, observers: o.retryObservers}
+		if o.retryBudget != nil {
+			rt.budget = newRetryBudget(audience, *o.retryBudget, o.limitObserver)
+		}
+		transport = rt
+	}
+	var breaker *circuitBreaker
+	if o.breaker != nil {
+		breaker = newCircuitBreaker(audience, *o.breaker)
+		transport = &breakerTransport{breaker: breaker, next: transport}
+	}
+	if o.replayLimit > 0 {
+		transport = &replayTransport{next: transport, limit: o.replayLimit}
+	}
+	if o.idempotencyKeys {
+		transport = &idempotencyTransport{next: transport}
+	}
+	if o.keyWrapper != nil {
+		transport = &encryptTransport{next: transport, keys: newDataKeys(o.keyWrapper)}
+	}
+	// Requests are signed as they are sent, after compression, which is how
+	// the receiving service checks them before decoding the body.
+	if o.signer != nil {
+		transport = &signTransport{next: transport, signer: o.signer}
+	}
+	if o.compression != nil {
+		if err := o.compression.Validate(); err != nil {
+			return nil, err
+		}
+		transport = &compressTransport{next: transport, settings: *o.compression}
+	}
+	if o.decompress {
+		transport = &decompressTransport{next: transport}
+	}
+	if o.propagateDeadline {
+		transport = &propagateTransport{next: transport, reserve: o.deadlineReserve}
+	}
+	transport = &pollTransport{next: transport}
+	if o.timeouts.Overall > 0 {
+		transport = &deadlineTransport{next: transport, timeout: o.timeouts.Overall}
+	}
+	transport = &callTimeoutTransport{next: transport}
+	if o.uploads != nil {
+		transport = &uploadTransport{next: transport, settings: *o.uploads, audience: audience, observer: o.uploadObserver, logger: o.logger}
+	}
+	if o.dedup != nil {
+		transport = newDedupTransport(transport, audience, *o.dedup, o.logger)
+	}
+	if o.cacheStore != nil {
+		transport = &cacheTransport{next: transport, store: o.cacheStore, defaultTTL: o.cacheTTL, logger: o.logger}
+	}
+	transport = &callQueryTransport{next: transport}
+	transport = &callTagTransport{next: transport}
+	if o.forwardAuthorization {
+		transport = &forwardTransport{next: transport}
+	}
+	transport = &callTimingTransport{next: transport}
+	transport = Chain(o.middleware...)(transport)
+
+	baseURL := o.baseURL
+	if baseURL == "" {
+		baseURL = audience
+	}
+
+	return &Client{
+		audience: audience,
+		baseURL:  baseURL,
+		source:   ts,
+		breaker:  breaker,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   o.timeout,
+		},
+		created: time.Now(),
+	}, nil
+}
+
+// NewRoundTripper returns a transport that authenticates requests with ID
+// tokens for audience and sends them with base, so that ID-token auth can
+// be layered onto an existing transport, such as one instrumented with
+// OpenTelemetry or going through a proxy, and used in an http.Client of
+// the caller's own. A nil base is http.DefaultTransport. opts apply as for
+// New, except that a WithTransport among them is overridden by base and the
+// timeout of WithTimeout, which is that of the Client's http.Client, does
+// not apply.
+func NewRoundTripper(ctx context.Context, base http.RoundTripper, audience string, opts ...Option) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c, err := New(ctx, audience, append(append([]Option(nil), opts...), WithTransport(base))...)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient.Transport, nil
+}
+
+// Audience returns the audience the client's ID tokens are minted for.
+func (c *Client) Audience() string {
+	return c.audience
+}
+
+// Token returns the client's current ID token, minting one if none is cached
+// or the cached one has expired.
+func (c *Client) Token() (*oauth2.Token, error) {
+	return c.source.Token()
+}
+
+// BreakerState returns the state of the client's circuit breaker, which is
+// always BreakerClosed if the client has none.
+func (c *Client) BreakerState() BreakerState {
+	if c.breaker == nil {
+		return BreakerClosed
+	}
+	return c.breaker.State()
+}
+
+// HTTPClient returns the underlying authenticated *http.Client.
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// Do sends an HTTP request with an ID token attached.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	return c.httpClient.Do(req)
+}
+
+// Get issues an authenticated GET to the given URL.
+func (c *Client) Get(url string) (*http.Response, error) {
+	return c.httpClient.Get(url)
+}
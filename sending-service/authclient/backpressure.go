@@ -0,0 +1,107 @@
+package authclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrRetryBudget is matched by errors.Is for requests that failed and were
+// not retried because the client's retry budget was spent.
+var ErrRetryBudget = errors.New("authclient: retry budget exhausted")
+
+// RetryBudgetError is returned for a request that failed without a
+// response and was not retried because the retry budget was spent. It
+// wraps the error of the last attempt.
+type RetryBudgetError struct {
+	Audience string
+	// RetryAfter is how long until the budget's window ends and retries
+	// are allowed again.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RetryBudgetError) Error() string {
+	return fmt.Sprintf("authclient: retry budget for %s exhausted: %v", e.Audience, e.Err)
+}
+
+func (e *RetryBudgetError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrRetryBudget.
+func (e *RetryBudgetError) Is(target error) bool {
+	return target == ErrRetryBudget
+}
+
+// RetryAfter returns how long the receiving service asked to wait before
+// the request is sent again, from the Retry-After header of a 429 or 503
+// response, and whether it asked.
+func RetryAfter(resp *http.Response) (time.Duration, bool) {
+	return backpressure(resp.StatusCode, resp.Header)
+}
+
+// RetryAfter returns how long the receiving service asked to wait with a
+// 429 or 503 answer, and whether it asked.
+func (e *DownstreamStatusError) RetryAfter() (time.Duration, bool) {
+	return backpressure(e.Code, e.Header)
+}
+
+func backpressure(code int, h http.Header) (time.Duration, bool) {
+	if code != http.StatusTooManyRequests && code != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	d, ok := parseRetryAfter(h.Get("Retry-After"))
+	if d < 0 {
+		d = 0
+	}
+	return d, ok
+}
+
+// BackpressureObserver is told when the receiving service pushes back with
+// 429 Too Many Requests or 503 Service Unavailable, so that a caller can
+// slow down adaptively, for example by lowering its own send rate until
+// retryAfter has passed.
+type BackpressureObserver interface {
+	// Backpressure is called for each such answer to an attempt, with the
+	// delay of its Retry-After header, or 0 if it has none.
+	Backpressure(audience string, status int, retryAfter time.Duration)
+}
+
+// WithBackpressureObserver registers an observer for the receiving
+// service's 429 and 503 answers, retries and hedged attempts included.
+func WithBackpressureObserver(obs BackpressureObserver) Option {
+	return func(o *options) {
+		o.backpressureObservers = append(o.backpressureObservers, obs)
+	}
+}
+
+type backpressureTransport struct {
+	next      http.RoundTripper
+	audience  string
+	observers []BackpressureObserver
+}
+
+func (t *backpressureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return resp, err
+	}
+	after, _ := RetryAfter(resp)
+	for _, obs := range t.observers {
+		obs.Backpressure(t.audience, resp.StatusCode, after)
+	}
+	return resp, nil
+}
+
+// retryAfterHeader formats d as the seconds of a Retry-After header,
+// rounded up.
+func retryAfterHeader(d time.Duration) string {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
@@ -0,0 +1,229 @@
+package authclient
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balancing strategies of a BalancerSettings.
+const (
+	BalanceRandom     = "random"
+	BalanceRoundRobin = "round_robin"
+)
+
+// Endpoint is one deployment of a service that a balanced client sends
+// calls to.
+type Endpoint struct {
+	// Client sends the endpoint's calls, with ID tokens for its audience.
+	Client *Client
+	// URL is the base URL of the endpoint.
+	URL string
+	// Weight is the endpoint's share of calls relative to the others. It
+	// defaults to 1.
+	Weight int
+}
+
+// BalancerSettings configures how a balanced client spreads calls over
+// its endpoints and ejects failing ones.
+type BalancerSettings struct {
+	// Strategy is BalanceRandom, which picks an endpoint at random in
+	// proportion to its weight, or BalanceRoundRobin, which takes turns in
+	// proportion to the weights. It defaults to BalanceRandom.
+	Strategy string
+	// EjectAfter is the number of calls in a row an endpoint must fail,
+	// by not being reachable or answering with a 5xx status, before it is
+	// ejected. It defaults to 3.
+	EjectAfter int
+	// EjectFor is how long an ejected endpoint gets no calls. It defaults
+	// to 30 seconds.
+	EjectFor time.Duration
+	// Logger reports ejected endpoints. It defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// DefaultBalancerSettings returns settings that pick endpoints at random
+// by weight and eject one for 30 seconds after 3 failed calls in a row.
+func DefaultBalancerSettings() BalancerSettings {
+	return BalancerSettings{Strategy: BalanceRandom, EjectAfter: 3, EjectFor: 30 * time.Second}
+}
+
+// NewBalancer returns a client that sends each call to one of endpoints,
+// the same service deployed more than once, such as in several regions.
+// Requests are written against baseURL; each is sent with the scheme and
+// host of the endpoint picked for it, and its path in place of baseURL's.
+// Requests to other hosts go to the first endpoint unchanged.
+//
+// An endpoint that fails EjectAfter calls in a row gets no calls for
+// EjectFor and is then tried again. If every endpoint is ejected, calls
+// are spread over all of them, as no endpoint is known to be healthier.
+//
+// The returned client reports the audience, token and circuit breaker
+// state of the first endpoint.
+func NewBalancer(baseURL string, endpoints []Endpoint, s BalancerSettings) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("authclient: a balancer needs at least one endpoint")
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("authclient: invalid base URL %q", baseURL)
+	}
+	defaults := DefaultBalancerSettings()
+	switch s.Strategy {
+	case "":
+		s.Strategy = defaults.Strategy
+	case BalanceRandom, BalanceRoundRobin:
+	default:
+		return nil, fmt.Errorf("authclient: unknown balancing strategy %q", s.Strategy)
+	}
+	if s.EjectAfter <= 0 {
+		s.EjectAfter = defaults.EjectAfter
+	}
+	if s.EjectFor <= 0 {
+		s.EjectFor = defaults.EjectFor
+	}
+	if s.Logger == nil {
+		s.Logger = slog.Default()
+	}
+	t := &balanceTransport{base: base, settings: s}
+	for _, e := range endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("authclient: invalid endpoint URL %q", e.URL)
+		}
+		if e.Weight < 0 {
+			return nil, fmt.Errorf("authclient: endpoint %s has a negative weight", e.URL)
+		}
+		if e.Weight == 0 {
+			e.Weight = 1
+		}
+		t.endpoints = append(t.endpoints, &endpoint{client: e.Client, url: u, weight: e.Weight})
+	}
+	first := endpoints[0].Client
+	return &Client{
+		audience: first.audience,
+		baseURL:  baseURL,
+		source:   first.source,
+		breaker:  first.breaker,
+		httpClient: &http.Client{
+			Transport: t,
+			Timeout:   first.httpClient.Timeout,
+		},
+		created: time.Now(),
+	}, nil
+}
+
+type endpoint struct {
+	client *Client
+	url    *url.URL
+	weight int
+
+	// Guarded by balanceTransport.mu.
+	failures     int
+	ejectedUntil time.Time
+	current      int
+}
+
+type balanceTransport struct {
+	base      *url.URL
+	endpoints []*endpoint
+	settings  BalancerSettings
+
+	mu sync.Mutex
+}
+
+func (t *balanceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Host, t.base.Host) {
+		return t.endpoints[0].client.httpClient.Transport.RoundTrip(req)
+	}
+	e := t.pick()
+	r := req.Clone(req.Context())
+	r.Body = req.Body
+	r.URL.Scheme = e.url.Scheme
+	r.URL.Host = e.url.Host
+	if p := strings.TrimSuffix(t.base.Path, "/"); p != "" || e.url.Path != "" {
+		r.URL.Path = strings.TrimSuffix(e.url.Path, "/") + strings.TrimPrefix(req.URL.Path, p)
+		r.URL.RawPath = ""
+	}
+	r.Host = ""
+	resp, err := e.client.httpClient.Transport.RoundTrip(r)
+	switch {
+	case err != nil && req.Context().Err() == nil, err == nil && resp.StatusCode >= 500:
+		t.failed(e)
+	case err == nil:
+		t.succeeded(e)
+	}
+	return resp, err
+}
+
+// pick returns the endpoint for the next call, among those not ejected.
+func (t *balanceTransport) pick() *endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	healthy := make([]*endpoint, 0, len(t.endpoints))
+	for _, e := range t.endpoints {
+		if !now.Before(e.ejectedUntil) {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = t.endpoints
+	}
+	total := 0
+	for _, e := range healthy {
+		total += e.weight
+	}
+	if t.settings.Strategy == BalanceRoundRobin {
+		// Smooth weighted round-robin, as nginx does: every endpoint
+		// earns its weight each turn, and the richest is picked and pays
+		// back the total, which interleaves endpoints of unequal weight.
+		var best *endpoint
+		for _, e := range healthy {
+			e.current += e.weight
+			if best == nil || e.current > best.current {
+				best = e
+			}
+		}
+		best.current -= total
+		return best
+	}
+	n := rand.Intn(total)
+	for _, e := range healthy {
+		if n < e.weight {
+			return e
+		}
+		n -= e.weight
+	}
+	return healthy[len(healthy)-1]
+}
+
+// failed counts a failed call of e, ejecting it once it has failed
+// EjectAfter calls in a row.
+func (t *balanceTransport) failed(e *endpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.failures++
+	if e.failures < t.settings.EjectAfter {
+		return
+	}
+	e.failures = 0
+	e.ejectedUntil = time.Now().Add(t.settings.EjectFor)
+	t.settings.Logger.Warn("Ejected failing endpoint",
+		slog.String("endpoint", e.url.Host),
+		slog.Duration("for", t.settings.EjectFor),
+	)
+}
+
+// succeeded resets the count of e's failed calls.
+func (t *balanceTransport) succeeded(e *endpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.failures = 0
+}
@@ -0,0 +1,140 @@
+package authclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxBatchResponseSize is the largest response body Batch reads for a
+	// single request.
+	MaxBatchResponseSize = 10 << 20
+	// batchTokenLifetime is how long the token must remain valid for a
+	// batch to start with it; a token closer to expiry is replaced first.
+	batchTokenLifetime = 5 * time.Minute
+)
+
+// BatchRequest is one call made by Client.Batch.
+type BatchRequest struct {
+	// Method defaults to GET.
+	Method string
+	// Path is resolved against the client's base URL unless it is
+	// absolute, as with DoJSON.
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// BatchResult is the outcome of one BatchRequest. Err is set if the
+// request could not be sent or its response could not be read; a response
+// with an error status is not an error.
+type BatchResult struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Duration   time.Duration
+	Err        error
+}
+
+// Batch sends many small requests to the client's audience, at most
+// maxConcurrency at a time, and returns their results in the order of
+// requests. A token is obtained once before the first request is sent,
+// minting a fresh one if the cached token expires within five minutes, so
+// every request of the batch reuses it instead of racing to mint its own.
+// If no token can be obtained, Batch returns the error without sending
+// anything. Requests still waiting to be sent when ctx is done are reported
+// with ctx's error; those in flight are cancelled.
+func (c *Client) Batch(ctx context.Context, requests []BatchRequest, maxConcurrency int) ([]BatchResult, error) {
+	if err := c.freshToken(); err != nil {
+		return nil, err
+	}
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+
+	results := make([]BatchResult, len(requests))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		wg.Add(1)
+		go func(req BatchRequest, res *BatchResult) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				res.Err = ctx.Err()
+				return
+			}
+
+			start := time.Now()
+			c.sendBatched(ctx, req, res)
+			res.Duration = time.Since(start)
+		}(req, &results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// freshToken makes sure the cached token stays valid for at least
+// batchTokenLifetime.
+func (c *Client) freshToken() error {
+	tok, err := c.source.Token()
+	if err != nil {
+		return err
+	}
+	if tok.Expiry.IsZero() || time.Until(tok.Expiry) >= batchTokenLifetime {
+		return nil
+	}
+	if err := c.source.invalidate(tok); err != nil {
+		return err
+	}
+	_, err = c.source.Token()
+	return err
+}
+
+// sendBatched makes a single batched request and records its response in
+// res.
+func (c *Client) sendBatched(ctx context.Context, req BatchRequest, res *BatchResult) {
+	target, err := c.resolve(req.Path)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if req.Body != nil {
+		body = bytes.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	for k, v := range req.Header {
+		httpReq.Header[k] = v
+	}
+
+	resp, err := c.Do(httpReq)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	res.StatusCode = resp.StatusCode
+	res.Header = resp.Header
+	res.Body, res.Err = io.ReadAll(io.LimitReader(resp.Body, MaxBatchResponseSize+1))
+	if res.Err == nil && len(res.Body) > MaxBatchResponseSize {
+		res.Body = nil
+		res.Err = fmt.Errorf("authclient: response from %s exceeds %d bytes", target, MaxBatchResponseSize)
+	}
+}
@@ -0,0 +1,210 @@
+package authclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerSettings configures the circuit breaker of a Client.
+type BreakerSettings struct {
+	// FailureThreshold is the fraction of failed requests in a window,
+	// between 0 and 1, that opens the circuit.
+	FailureThreshold float64
+	// MinRequests is the number of requests a window must contain before
+	// the failure rate is considered.
+	MinRequests int
+	// Window is the length of the interval over which failures are counted.
+	Window time.Duration
+	// OpenTimeout is how long the circuit stays open before a trial
+	// request is let through.
+	OpenTimeout time.Duration
+}
+
+// DefaultBreakerSettings returns settings that open the circuit when half
+// of at least 10 requests within 10 seconds fail, and try again after 30
+// seconds.
+func DefaultBreakerSettings() BreakerSettings {
+	return BreakerSettings{
+		FailureThreshold: 0.5,
+		MinRequests:      10,
+		Window:           10 * time.Second,
+		OpenTimeout:      30 * time.Second,
+	}
+}
+
+// WithCircuitBreaker stops sending requests to the receiving service while
+// it is failing. Network errors and 5xx responses count as failures. While
+// the circuit is open, requests fail immediately with a *CircuitOpenError.
+func WithCircuitBreaker(s BreakerSettings) Option {
+	return func(o *options) {
+		o.breaker = &s
+	}
+}
+
+// ErrCircuitOpen is matched by errors.Is for requests rejected because the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("authclient: circuit breaker is open")
+
+// CircuitOpenError is returned for requests rejected by an open circuit
+// breaker.
+type CircuitOpenError struct {
+	Audience string
+	// RetryAfter is the time left until the breaker lets a trial request
+	// through.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("authclient: circuit breaker for %s is open, retry after %s", e.Audience, e.RetryAfter.Round(time.Second))
+}
+
+// Is reports whether target is ErrCircuitOpen.
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	outcomeIgnored
+)
+
+type circuitBreaker struct {
+	audience string
+	settings BreakerSettings
+
+	mu          sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	trial       bool
+}
+
+func newCircuitBreaker(audience string, s BreakerSettings) *circuitBreaker {
+	return &circuitBreaker{audience: audience, settings: s, windowStart: time.Now()}
+}
+
+// allow reports whether a request may be sent, moving an open breaker to
+// half-open once its timeout has passed. Only one trial request at a time
+// is allowed while half-open.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.settings.OpenTimeout - now.Sub(b.openedAt); wait > 0 {
+			return &CircuitOpenError{Audience: b.audience, RetryAfter: wait}
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return nil
+	case BreakerHalfOpen:
+		if b.trial {
+			return &CircuitOpenError{Audience: b.audience, RetryAfter: time.Second}
+		}
+		b.trial = true
+		return nil
+	default:
+		if now.Sub(b.windowStart) > b.settings.Window {
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+		return nil
+	}
+}
+
+func (b *circuitBreaker) record(o outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen {
+		b.trial = false
+		switch o {
+		case outcomeSuccess:
+			b.state = BreakerClosed
+			b.windowStart = time.Now()
+			b.requests, b.failures = 0, 0
+		case outcomeFailure:
+			b.open()
+		}
+		return
+	}
+	if b.state != BreakerClosed || o == outcomeIgnored {
+		return
+	}
+
+	b.requests++
+	if o == outcomeFailure {
+		b.failures++
+	}
+	if b.requests >= b.settings.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= b.settings.FailureThreshold {
+		b.open()
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.requests, b.failures = 0, 0
+}
+
+func (b *circuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+type breakerTransport struct {
+	breaker *circuitBreaker
+	next    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrConcurrencyLimit):
+		t.breaker.record(outcomeIgnored)
+	case err != nil, resp.StatusCode >= http.StatusInternalServerError:
+		t.breaker.record(outcomeFailure)
+	default:
+		t.breaker.record(outcomeSuccess)
+	}
+	return resp, err
+}
@@ -0,0 +1,83 @@
+package authclient
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// NewPooledTransport returns a transport with the default settings,
+// suitable for sharing between clients.
+func NewPooledTransport() *http.Transport {
+	return NewTransport(DefaultTransportSettings())
+}
+
+// TokenClientFactory hands out authenticated clients by audience. *Cache is
+// the production implementation; tests can substitute a
+// TokenClientFactoryFunc that returns clients backed by a fake token
+// source.
+type TokenClientFactory interface {
+	Client(audience string) (*Client, error)
+}
+
+// TokenClientFactoryFunc adapts a function to a TokenClientFactory.
+type TokenClientFactoryFunc func(audience string) (*Client, error)
+
+// Client calls f.
+func (f TokenClientFactoryFunc) Client(audience string) (*Client, error) {
+	return f(audience)
+}
+
+// Cache lazily creates and reuses one Client per audience. All clients
+// created by a Cache share a single base transport so connections are pooled
+// across audiences, and each client keeps its token source so ID tokens are
+// refreshed in place instead of being minted for every request.
+type Cache struct {
+	ctx  context.Context
+	opts []Option
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	once   sync.Once
+	client *Client
+	err    error
+}
+
+// NewCache creates an empty Cache. The context is used to create token
+// sources and should outlive the cache; it is typically
+// context.Background(). The options are applied to every client the cache
+// creates.
+func NewCache(ctx context.Context, opts ...Option) *Cache {
+	return &Cache{
+		ctx:     ctx,
+		opts:    append([]Option{WithTransport(NewPooledTransport())}, opts...),
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// Client returns the cached Client for audience, creating it on first use.
+// Failed constructions are not cached, so a later call retries.
+func (c *Cache) Client(audience string) (*Client, error) {
+	c.mu.Lock()
+	e, ok := c.entries[audience]
+	if !ok {
+		e = &cacheEntry{}
+		c.entries[audience] = e
+	}
+	c.mu.Unlock()
+
+	e.once.Do(func() {
+		e.client, e.err = New(c.ctx, audience, c.opts...)
+	})
+	if e.err != nil {
+		c.mu.Lock()
+		if c.entries[audience] == e {
+			delete(c.entries, audience)
+		}
+		c.mu.Unlock()
+	}
+	return e.client, e.err
+}
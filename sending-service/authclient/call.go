@@ -0,0 +1,265 @@
+package authclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RevisionTagSeparator separates a revision tag from the service host in
+// the URL Cloud Run serves a tagged revision at, as in
+// https://canary---receiving-service-xyz.a.run.app.
+const RevisionTagSeparator = "---"
+
+// CallOption changes how a single call is sent, overriding the defaults the
+// client was created with.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	timeout time.Duration
+	noRetry bool
+	header  http.Header
+	query   url.Values
+	tag     string
+	poll    time.Duration
+	session *Session
+}
+
+type callKey struct{}
+
+// CallTimeout bounds the call, including retries and reading the response
+// body, by d instead of the Overall timeout of the client's TimeoutPolicy.
+// The http.Client timeout set with WithTimeout still applies on top, so d
+// can only extend the call up to it.
+func CallTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = d
+	}
+}
+
+// NoRetry sends the call once, even if the client retries failed requests,
+// for example for a call whose caller retries itself.
+func NoRetry() CallOption {
+	return func(o *callOptions) {
+		o.noRetry = true
+	}
+}
+
+// CallHeader sets the header name to value on the call, replacing any value
+// set by WithHeaders or on the request. As with WithHeaders, the
+// Authorization and X-Serverless-Authorization headers are ignored. Calls
+// with call headers, which may identify an end user, are never answered
+// from the response cache or shared with other calls by deduplication.
+func CallHeader(name, value string) CallOption {
+	return func(o *callOptions) {
+		if o.header == nil {
+			o.header = make(http.Header)
+		}
+		o.header.Set(name, value)
+	}
+}
+
+// QueryParam adds the query parameter name with value to the call's URL,
+// after any the URL has. Adding the same name again sends it repeated,
+// as in ?tag=a&tag=b. Values are escaped as needed.
+func QueryParam(name, value string) CallOption {
+	return func(o *callOptions) {
+		if o.query == nil {
+			o.query = make(url.Values)
+		}
+		o.query.Add(name, value)
+	}
+}
+
+// Query adds every parameter of q to the call's URL, as QueryParam does.
+func Query(q url.Values) CallOption {
+	return func(o *callOptions) {
+		for name, values := range q {
+			for _, v := range values {
+				QueryParam(name, v)(o)
+			}
+		}
+	}
+}
+
+func cloneValues(v url.Values) url.Values {
+	if v == nil {
+		return nil
+	}
+	return url.Values(http.Header(v).Clone())
+}
+
+// RevisionTag sends the call to the Cloud Run revision tagged tag, at the
+// service's tag URL, instead of to the revisions traffic is split between,
+// for example to test a canary revision that receives no traffic yet. The
+// ID token keeps the client's audience, the service's own URL, which
+// Cloud Run accepts on its tag URLs too. Calls to hosts other than run.app
+// fail, since only run.app URLs have tagged forms.
+func RevisionTag(tag string) CallOption {
+	return func(o *callOptions) {
+		o.tag = tag
+	}
+}
+
+// CallContext returns a copy of ctx carrying opts, which apply to every
+// request sent with it by a client, including requests a reverse proxy
+// sends through the client's transport. Options already carried by ctx are
+// kept unless opts override them.
+func CallContext(ctx context.Context, opts ...CallOption) context.Context {
+	var o callOptions
+	if prev, ok := ctx.Value(callKey{}).(*callOptions); ok {
+		o = *prev
+		o.header = prev.header.Clone()
+		o.query = cloneValues(prev.query)
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return context.WithValue(ctx, callKey{}, &o)
+}
+
+// Call sends req with ctx and the given call options, as Do does with the
+// client's defaults.
+func (c *Client) Call(ctx context.Context, req *http.Request, opts ...CallOption) (*http.Response, error) {
+	return c.Do(req.WithContext(CallContext(ctx, opts...)))
+}
+
+// callOptionsFrom returns the call options carried by ctx, or nil.
+func callOptionsFrom(ctx context.Context) *callOptions {
+	o, _ := ctx.Value(callKey{}).(*callOptions)
+	return o
+}
+
+// hasCallHeaders reports whether the request's call options set headers.
+// They are only applied below the response cache and deduplication, which
+// therefore pass such calls through rather than key them without those
+// headers.
+func hasCallHeaders(req *http.Request) bool {
+	o := callOptionsFrom(req.Context())
+	return o != nil && len(o.header) > 0
+}
+
+// noRetry reports whether the request's call options disable retries.
+func noRetry(req *http.Request) bool {
+	o := callOptionsFrom(req.Context())
+	return o != nil && o.noRetry
+}
+
+// callTimeoutTransport bounds requests by the timeout of their call
+// options, in place of the client's overall timeout.
+type callTimeoutTransport struct {
+	next http.RoundTripper
+}
+
+func (t *callTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if o := callOptionsFrom(req.Context()); o != nil && o.timeout > 0 {
+		return (&deadlineTransport{next: t.next, timeout: o.timeout, call: true}).RoundTrip(req)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// callHeaderTransport sets the headers of the call options. It runs after
+// the headers of WithHeaders are set, so that the call's values win.
+type callHeaderTransport struct {
+	next http.RoundTripper
+}
+
+func (t *callHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := callOptionsFrom(req.Context())
+	if o == nil || len(o.header) == 0 {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	for k, vs := range o.header {
+		if k == "Authorization" || k == ServerlessAuthorizationHeader {
+			continue
+		}
+		r.Header[k] = vs
+	}
+	return t.next.RoundTrip(r)
+}
+
+// TaggedHost returns the host Cloud Run serves the revision tagged tag of
+// the service at host at, replacing any tag host already carries. It fails
+// for hosts other than run.app and for tags that are not lower-case
+// letters, digits and hyphens starting with a letter.
+func TaggedHost(host, tag string) (string, error) {
+	if err := ValidateRevisionTag(tag); err != nil {
+		return "", err
+	}
+	name := strings.ToLower(host)
+	if hostname, _, _ := strings.Cut(name, ":"); !strings.HasSuffix(hostname, ".run.app") {
+		return "", fmt.Errorf("authclient: %s is not a run.app host and has no revision tags", host)
+	}
+	if _, untagged, ok := strings.Cut(name, RevisionTagSeparator); ok {
+		name = untagged
+	}
+	return tag + RevisionTagSeparator + name, nil
+}
+
+// ValidateRevisionTag checks that tag can name a Cloud Run revision: lower-case
+// letters, digits and hyphens, starting with a letter.
+func ValidateRevisionTag(tag string) error {
+	valid := tag != "" && tag[0] >= 'a' && tag[0] <= 'z' && !strings.Contains(tag, RevisionTagSeparator)
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			valid = false
+		}
+	}
+	if !valid {
+		return fmt.Errorf("authclient: %q is not a revision tag", tag)
+	}
+	return nil
+}
+
+// callQueryTransport adds the query parameters of the call options to the
+// URL. It runs before responses are cached and requests signed, so that
+// both see the full URL.
+type callQueryTransport struct {
+	next http.RoundTripper
+}
+
+func (t *callQueryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := callOptionsFrom(req.Context())
+	if o == nil || len(o.query) == 0 {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	extra := o.query.Encode()
+	if r.URL.RawQuery == "" {
+		r.URL.RawQuery = extra
+	} else {
+		r.URL.RawQuery += "&" + extra
+	}
+	return t.next.RoundTrip(r)
+}
+
+// callTagTransport sends requests whose call options carry a revision tag
+// to the tag URL of the service. It runs before responses are cached and
+// requests signed, so that both see the tagged URL.
+type callTagTransport struct {
+	next http.RoundTripper
+}
+
+func (t *callTagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := callOptionsFrom(req.Context())
+	if o == nil || o.tag == "" {
+		return t.next.RoundTrip(req)
+	}
+	host, err := TaggedHost(req.URL.Host, o.tag)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	r.URL.Host = host
+	if r.Host != "" {
+		r.Host = host
+	}
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,61 @@
+package authclient
+
+import (
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+)
+
+// TokenClaims are the claims of a minted ID token that describe how it was
+// configured. They never include the token or its signature.
+type TokenClaims struct {
+	Issuer   string
+	Audience string
+	Subject  string
+	// Email is the email of the service account the token was minted for,
+	// if it has one.
+	Email    string
+	IssuedAt time.Time
+	Expiry   time.Time
+}
+
+// TokenClaimsObserver is implemented by TokenObservers that also inspect
+// the claims of minted tokens, for example to check that they are minted
+// for the expected audience and identity. The claims are decoded locally,
+// without verifying the token, only for observers that implement it.
+type TokenClaimsObserver interface {
+	// TokenClaims is called along with TokenMinted with the claims of the
+	// token minted for audience.
+	TokenClaims(audience string, claims TokenClaims)
+}
+
+func (m multiObserver) TokenClaims(audience string, claims TokenClaims) {
+	for _, o := range m {
+		if co, ok := o.(TokenClaimsObserver); ok {
+			co.TokenClaims(audience, claims)
+		}
+	}
+}
+
+// notifyClaims tells the observer the claims of tok, if it wants them and
+// tok is a JWT.
+func (s *tokenSource) notifyClaims(tok *oauth2.Token) {
+	co, ok := s.observer.(TokenClaimsObserver)
+	if !ok {
+		return
+	}
+	payload, err := idtoken.ParsePayload(tok.AccessToken)
+	if err != nil {
+		return
+	}
+	email, _ := payload.Claims["email"].(string)
+	co.TokenClaims(s.audience, TokenClaims{
+		Issuer:   payload.Issuer,
+		Audience: payload.Audience,
+		Subject:  payload.Subject,
+		Email:    email,
+		IssuedAt: time.Unix(payload.IssuedAt, 0),
+		Expiry:   time.Unix(payload.Expires, 0),
+	})
+}
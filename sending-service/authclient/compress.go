@@ -0,0 +1,268 @@
+package authclient
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EncodingGzip is the gzip content coding.
+	EncodingGzip = "gzip"
+	// EncodingDeflate is the deflate content coding: zlib-wrapped deflate
+	// data, as RFC 9110 defines it.
+	EncodingDeflate = "deflate"
+)
+
+// ErrUnsupportedEncoding is returned for responses with a Content-Encoding
+// that WithResponseDecompression can't decode.
+var ErrUnsupportedEncoding = errors.New("authclient: unsupported content encoding")
+
+// CompressionSettings configure WithRequestCompression.
+type CompressionSettings struct {
+	// Encoding is EncodingGzip or EncodingDeflate.
+	Encoding string
+	// MinSize is the smallest body that is compressed. Small bodies gain
+	// little and cost the receiver a decompression.
+	MinSize int64
+	// Level is the compression level, from 1 (fastest) to 9 (smallest);
+	// 0 uses the default level.
+	Level int
+}
+
+// DefaultCompressionSettings returns gzip at the default level for bodies
+// of 1 KiB or more.
+func DefaultCompressionSettings() CompressionSettings {
+	return CompressionSettings{Encoding: EncodingGzip, MinSize: 1 << 10}
+}
+
+// Validate reports whether s can be used.
+func (s CompressionSettings) Validate() error {
+	if s.Encoding != EncodingGzip && s.Encoding != EncodingDeflate {
+		return fmt.Errorf("authclient: compression encoding must be %s or %s, not %q", EncodingGzip, EncodingDeflate, s.Encoding)
+	}
+	if s.Level < 0 || s.Level > 9 {
+		return fmt.Errorf("authclient: compression level must be between 0 and 9, not %d", s.Level)
+	}
+	if s.MinSize < 0 {
+		return errors.New("authclient: compression minimum size must not be negative")
+	}
+	return nil
+}
+
+// WithRequestCompression compresses request bodies of at least s.MinSize
+// bytes that aren't encoded already, setting Content-Encoding and
+// Content-Length to match. Bodies are compressed once per call, before
+// they are signed, so every attempt sends the same bytes. The receiving
+// service must decode them, as the receiver's compression middleware does.
+func WithRequestCompression(s CompressionSettings) Option {
+	return func(o *options) {
+		o.compression = &s
+	}
+}
+
+// WithResponseDecompression asks for gzip or deflate responses on requests
+// that don't set Accept-Encoding themselves, and decodes responses in
+// either encoding, removing their Content-Encoding and Content-Length
+// headers. Without it, http.Transport decodes gzip only, and only when the
+// caller hasn't set Accept-Encoding; with it, responses are decoded even
+// when the caller asked for an encoding, as a proxy forwarding its
+// caller's Accept-Encoding does.
+func WithResponseDecompression() Option {
+	return func(o *options) {
+		o.decompress = true
+	}
+}
+
+// DecompressMiddleware returns the Middleware behind
+// WithResponseDecompression, for placing it at a chosen point of the
+// chain or around another transport, such as a reverse proxy's.
+func DecompressMiddleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &decompressTransport{next: next}
+	}
+}
+
+type passThroughKey struct{}
+
+// PassThroughEncoding returns a copy of ctx that marks requests sent with
+// it as wanting the response as the receiving service encoded it, so
+// WithResponseDecompression leaves it alone, as a proxy passing compressed
+// responses through to callers that asked for them needs.
+func PassThroughEncoding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, passThroughKey{}, true)
+}
+
+// IsPassThroughEncoding reports whether ctx was marked with
+// PassThroughEncoding.
+func IsPassThroughEncoding(ctx context.Context) bool {
+	passThrough, _ := ctx.Value(passThroughKey{}).(bool)
+	return passThrough
+}
+
+type compressTransport struct {
+	next     http.RoundTripper
+	settings CompressionSettings
+}
+
+func (t *compressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" || uploadFrom(req) != nil ||
+		(req.ContentLength >= 0 && req.ContentLength < t.settings.MinSize) {
+		return t.next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	if int64(len(body)) >= t.settings.MinSize {
+		if body, err = encode(t.settings, body); err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Encoding", t.settings.Encoding)
+	}
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return t.next.RoundTrip(r)
+}
+
+func encode(s CompressionSettings, body []byte) ([]byte, error) {
+	level := s.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch s.Encoding {
+	case EncodingDeflate:
+		w, err = zlib.NewWriterLevel(&buf, level)
+	default:
+		w, err = gzip.NewWriterLevel(&buf, level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type decompressTransport struct {
+	next http.RoundTripper
+}
+
+func (t *decompressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if IsPassThroughEncoding(req.Context()) {
+		return t.next.RoundTrip(req)
+	}
+	if req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" {
+		r := req.Clone(req.Context())
+		r.Header.Set("Accept-Encoding", EncodingGzip+", "+EncodingDeflate)
+		req = r
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := Decompress(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Decompress replaces the body of a gzip or deflate encoded response with
+// a reader of the decoded body, and removes the Content-Encoding and
+// Content-Length headers that applied to the encoded one. Responses
+// without a Content-Encoding, or to HEAD requests, are left alone; other
+// encodings fail with ErrUnsupportedEncoding.
+func Decompress(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || resp.Body == nil || resp.Body == http.NoBody ||
+		(resp.Request != nil && resp.Request.Method == http.MethodHead) {
+		return nil
+	}
+	body, err := NewDecoder(encoding, resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// NewDecoder returns a reader of r decoded from encoding, gzip or deflate,
+// that closes r when it is closed. The stream is opened on the first read,
+// so a corrupt body fails then rather than here.
+func NewDecoder(encoding string, r io.ReadCloser) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case EncodingGzip, "x-gzip":
+		return &decoder{src: r, open: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }}, nil
+	case EncodingDeflate:
+		return &decoder{src: r, open: openZlibOrRaw}, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupportedEncoding, encoding)
+}
+
+// decoder opens its decoding reader on the first read, since opening one
+// reads the stream's header and would block on a response that is still
+// being written.
+type decoder struct {
+	src  io.ReadCloser
+	open func(io.Reader) (io.ReadCloser, error)
+	r    io.ReadCloser
+	err  error
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = d.open(d.src)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func (d *decoder) Close() error {
+	if d.r != nil {
+		d.r.Close()
+	}
+	return d.src.Close()
+}
+
+// openZlibOrRaw decodes deflate bodies, accepting raw deflate data as well
+// as the zlib-wrapped data RFC 9110 calls for, since some servers send it.
+func openZlibOrRaw(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
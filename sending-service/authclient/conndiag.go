@@ -0,0 +1,197 @@
+package authclient
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnStats counts the requests sent to a host and the connections they
+// were sent on.
+type ConnStats struct {
+	// HTTP1, HTTP2 and HTTP3 count responses by the protocol they were
+	// received over.
+	HTTP1, HTTP2, HTTP3 int64
+	// NewConns counts requests sent on a new connection, and ReusedConns
+	// those sent on a pooled one, including HTTP/2 streams on a shared
+	// connection.
+	NewConns, ReusedConns int64
+	// Failed counts requests that failed without a response.
+	Failed int64
+}
+
+// ConnDiagnostics records the protocol negotiated with, and the connection
+// reuse of, each host it sees, for checking that connections are pooled
+// and that HTTP/2 is used where it is expected. Add its Middleware with
+// WithAttemptMiddleware so that every attempt is recorded.
+type ConnDiagnostics struct {
+	logger      *slog.Logger
+	expectHTTP2 bool
+
+	mu     sync.Mutex
+	hosts  map[string]*ConnStats
+	warned map[string]bool
+}
+
+// NewConnDiagnostics creates a ConnDiagnostics logging each attempt to
+// logger at debug level, or to slog.Default() if logger is nil. If
+// expectHTTP2 is set, as with TransportSettings.ForceHTTP2, hosts that
+// answer over HTTP/1.1 are reported once each with a warning.
+func NewConnDiagnostics(logger *slog.Logger, expectHTTP2 bool) *ConnDiagnostics {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &ConnDiagnostics{
+		logger:      logger,
+		expectHTTP2: expectHTTP2,
+		hosts:       make(map[string]*ConnStats),
+		warned:      make(map[string]bool),
+	}
+}
+
+// Middleware records the requests sent through next.
+func (d *ConnDiagnostics) Middleware(next http.RoundTripper) http.RoundTripper {
+	return &connDiagTransport{next: next, diag: d}
+}
+
+type connDiagTransport struct {
+	next http.RoundTripper
+	diag *ConnDiagnostics
+}
+
+func (t *connDiagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		mu   sync.Mutex
+		got  bool
+		conn httptrace.GotConnInfo
+	)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			got, conn = true, info
+			mu.Unlock()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := t.next.RoundTrip(req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	t.diag.record(req, resp, got, conn)
+	return resp, err
+}
+
+func (d *ConnDiagnostics) record(req *http.Request, resp *http.Response, got bool, info httptrace.GotConnInfo) {
+	host := strings.ToLower(req.URL.Host)
+	proto := ""
+	if resp != nil {
+		proto = resp.Proto
+	}
+
+	d.mu.Lock()
+	s, ok := d.hosts[host]
+	if !ok {
+		s = &ConnStats{}
+		d.hosts[host] = s
+	}
+	switch {
+	case resp == nil:
+		s.Failed++
+	case resp.ProtoMajor == 2:
+		s.HTTP2++
+	case resp.ProtoMajor == 3:
+		s.HTTP3++
+	default:
+		s.HTTP1++
+	}
+	if got {
+		if info.Reused {
+			s.ReusedConns++
+		} else {
+			s.NewConns++
+		}
+	}
+	warn := d.expectHTTP2 && resp != nil && resp.ProtoMajor < 2 && !d.warned[host]
+	if warn {
+		d.warned[host] = true
+	}
+	d.mu.Unlock()
+
+	if warn {
+		d.logger.WarnContext(req.Context(), "HTTP/2 was not negotiated; falling back to HTTP/1.1",
+			slog.String("host", host),
+			slog.String("protocol", proto),
+		)
+	}
+	attrs := []any{
+		slog.String("host", host),
+		slog.String("protocol", proto),
+	}
+	if got {
+		attrs = append(attrs,
+			slog.Bool("reused", info.Reused),
+			slog.Bool("was_idle", info.WasIdle),
+		)
+		if info.WasIdle {
+			attrs = append(attrs, slog.Duration("idle_time", info.IdleTime))
+		}
+	}
+	d.logger.DebugContext(req.Context(), "Connection used", attrs...)
+}
+
+// Stats returns a snapshot of the counts for each host, keyed by the
+// host:port of the request URL.
+func (d *ConnDiagnostics) Stats() map[string]ConnStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := make(map[string]ConnStats, len(d.hosts))
+	for host, s := range d.hosts {
+		stats[host] = *s
+	}
+	return stats
+}
+
+// LogStats logs the counts for each host at info level.
+func (d *ConnDiagnostics) LogStats() {
+	stats := d.Stats()
+	hosts := make([]string, 0, len(stats))
+	for host := range stats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		s := stats[host]
+		reuse := 0.0
+		if n := s.NewConns + s.ReusedConns; n > 0 {
+			reuse = float64(s.ReusedConns) / float64(n)
+		}
+		d.logger.Info("Connection statistics",
+			slog.String("host", host),
+			slog.Int64("http1", s.HTTP1),
+			slog.Int64("http2", s.HTTP2),
+			slog.Int64("http3", s.HTTP3),
+			slog.Int64("new_conns", s.NewConns),
+			slog.Int64("reused_conns", s.ReusedConns),
+			slog.Float64("reuse_ratio", reuse),
+			slog.Int64("failed", s.Failed),
+		)
+	}
+}
+
+// RunStats logs the counts every interval until stop is closed.
+func (d *ConnDiagnostics) RunStats(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.LogStats()
+		case <-stop:
+			return
+		}
+	}
+}
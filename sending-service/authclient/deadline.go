@@ -0,0 +1,71 @@
+package authclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DeadlineHeader carries the absolute deadline of a request, in RFC 3339
+// format, so that the receiving service can stop working on it once the
+// caller has given up.
+const DeadlineHeader = "X-Request-Deadline"
+
+// WithDeadlinePropagation forwards the deadline of each request's context,
+// less reserve, to the receiving service in the X-Request-Deadline header,
+// and applies it to the request itself. The reserve leaves the caller time
+// to handle the response or the failure before its own deadline. Requests
+// with no more than reserve left fail immediately with an error matching
+// ErrDownstreamTimeout, rather than starting a call that can't finish in
+// time. Requests whose context has no deadline are sent unchanged.
+func WithDeadlinePropagation(reserve time.Duration) Option {
+	return func(o *options) {
+		o.propagateDeadline = true
+		o.deadlineReserve = reserve
+	}
+}
+
+type propagateTransport struct {
+	next    http.RoundTripper
+	reserve time.Duration
+}
+
+func (t *propagateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline, ok := req.Context().Deadline()
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	deadline = deadline.Add(-t.reserve)
+	if !time.Now().Before(deadline) {
+		return nil, &insufficientTimeError{remaining: time.Until(deadline) + t.reserve, reserve: t.reserve}
+	}
+
+	ctx, cancel := context.WithDeadline(req.Context(), deadline)
+	r := req.Clone(ctx)
+	r.Header.Set(DeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newCancelBody(resp.Body, cancel)
+	return resp, nil
+}
+
+// insufficientTimeError reports that a request was not sent because too
+// little of its deadline remained.
+type insufficientTimeError struct {
+	remaining time.Duration
+	reserve   time.Duration
+}
+
+func (e *insufficientTimeError) Error() string {
+	return fmt.Sprintf("authclient: only %s left before the request deadline, less than the reserve of %s", e.remaining.Round(time.Millisecond), e.reserve)
+}
+
+// Is reports whether target is ErrDownstreamTimeout.
+func (e *insufficientTimeError) Is(target error) bool { return target == ErrDownstreamTimeout }
+
+// Timeout reports true, like net.Error timeouts.
+func (e *insufficientTimeError) Timeout() bool { return true }
@@ -0,0 +1,232 @@
+package authclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// defaultDedupMaxBody is the largest response body shared between
+// deduplicated requests by default.
+const defaultDedupMaxBody = 1 << 20
+
+// DedupObserver is told when a request was answered by a call already in
+// flight instead of one of its own.
+type DedupObserver interface {
+	RequestDeduplicated(audience string)
+}
+
+// DedupSettings configures WithDeduplication.
+type DedupSettings struct {
+	// MaxBody is the largest response body shared by the requests of a
+	// call. Zero means 1 MiB.
+	MaxBody int64
+	// Observer, if set, is told about each request that joined a call.
+	Observer DedupObserver
+}
+
+// WithDeduplication collapses identical GET requests made while one is
+// in flight into a single downstream call, whose response is handed to
+// each of them, so that a burst of callers asking for the same resource
+// costs the receiving service one request. Requests are identical if they
+// have the same URL and the headers that distinguish cached responses;
+// requests with a body, a Range header, a forwarded Authorization header,
+// a streaming context or a session are always sent on their own. The call runs
+// until its response arrives or every request waiting for it has given
+// up, so one caller's cancellation does not fail the others. A request
+// whose response cannot be shared, because it is an event stream or its
+// body is larger than s.MaxBody, takes the response, and the requests
+// that joined it are sent on their own instead. It sits below
+// WithResponseCache, so only cache misses are collapsed.
+func WithDeduplication(s DedupSettings) Option {
+	return func(o *options) {
+		o.dedup = &s
+	}
+}
+
+type dedupTransport struct {
+	next     http.RoundTripper
+	audience string
+	maxBody  int64
+	observer DedupObserver
+	logger   *slog.Logger
+
+	mu    sync.Mutex
+	calls map[string]*dedupCall
+}
+
+// dedupCall is a downstream call shared by identical requests. Its fields
+// other than done and cancel are guarded by the transport's mutex until
+// done is closed.
+type dedupCall struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	// waiting counts the requests still waiting for the call.
+	waiting int
+
+	resp *http.Response
+	err  error
+	// body is the body of resp if it can be shared; otherwise resp is
+	// handed to one request, and taken is set once it has been.
+	body   []byte
+	shared bool
+	taken  bool
+}
+
+func newDedupTransport(next http.RoundTripper, audience string, s DedupSettings, logger *slog.Logger) *dedupTransport {
+	t := &dedupTransport{
+		next:     next,
+		audience: audience,
+		maxBody:  s.MaxBody,
+		observer: s.Observer,
+		logger:   logger,
+		calls:    make(map[string]*dedupCall),
+	}
+	if t.maxBody <= 0 {
+		t.maxBody = defaultDedupMaxBody
+	}
+	return t
+}
+
+func (t *dedupTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !dedupable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	key := cacheKey(req)
+	t.mu.Lock()
+	c, joined := t.calls[key]
+	if joined {
+		c.waiting++
+	} else {
+		c = &dedupCall{done: make(chan struct{}), waiting: 1}
+		t.calls[key] = c
+	}
+	t.mu.Unlock()
+
+	if joined {
+		t.logger.DebugContext(req.Context(), "Joining identical downstream request in flight",
+			slog.String("url", req.URL.String()),
+		)
+		if t.observer != nil {
+			t.observer.RequestDeduplicated(t.audience)
+		}
+	} else {
+		// The call keeps the request's values, such as its logger and
+		// call options, but not its cancellation.
+		ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+		c.cancel = cancel
+		go t.call(key, c, req.Clone(ctx))
+	}
+
+	select {
+	case <-c.done:
+	case <-req.Context().Done():
+		t.leave(c)
+		return nil, req.Context().Err()
+	}
+	return t.result(req, c)
+}
+
+// call sends req and records its outcome in c.
+func (t *dedupTransport) call(key string, c *dedupCall, req *http.Request) {
+	resp, err := t.next.RoundTrip(req)
+	var body []byte
+	shared := false
+	if err == nil && !isEventStream(resp) && resp.ContentLength <= t.maxBody {
+		body, err = io.ReadAll(io.LimitReader(resp.Body, t.maxBody+1))
+		switch {
+		case err != nil:
+			resp.Body.Close()
+			resp = nil
+		case int64(len(body)) > t.maxBody:
+			// Too large to share: hand back what was read followed by
+			// the rest.
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			body = nil
+		default:
+			resp.Body.Close()
+			shared = true
+		}
+	}
+	if resp != nil && !shared {
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: c.cancel}
+	} else {
+		c.cancel()
+	}
+
+	t.mu.Lock()
+	delete(t.calls, key)
+	c.resp, c.err, c.body, c.shared = resp, err, body, shared
+	if c.waiting == 0 && resp != nil && !shared {
+		// Every request gave up; nobody will read the response.
+		resp.Body.Close()
+		c.taken = true
+	}
+	t.mu.Unlock()
+	close(c.done)
+}
+
+// leave records that a request stopped waiting for c, cancelling the call
+// if it was the last one.
+func (t *dedupTransport) leave(c *dedupCall) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c.waiting--
+	if c.waiting > 0 {
+		return
+	}
+	select {
+	case <-c.done:
+		if c.resp != nil && !c.shared && !c.taken {
+			c.resp.Body.Close()
+			c.taken = true
+		}
+	default:
+		c.cancel()
+	}
+}
+
+// result returns the response of c for req: a copy of a shared response,
+// the response itself for the first request to take one that cannot be
+// shared, and otherwise the response to a request of req's own.
+func (t *dedupTransport) result(req *http.Request, c *dedupCall) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.shared {
+		resp := *c.resp
+		resp.Header = c.resp.Header.Clone()
+		resp.Trailer = c.resp.Trailer.Clone()
+		resp.Body = io.NopCloser(bytes.NewReader(c.body))
+		resp.ContentLength = int64(len(c.body))
+		resp.TransferEncoding = nil
+		resp.Request = req
+		return &resp, nil
+	}
+	t.mu.Lock()
+	taken := c.taken
+	c.taken = true
+	t.mu.Unlock()
+	if taken {
+		return t.next.RoundTrip(req)
+	}
+	c.resp.Request = req
+	return c.resp, nil
+}
+
+func dedupable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != "" {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return !IsStreaming(req.Context()) && !isUpgrade(req) && req.Header.Get("Range") == "" && req.Header.Get(ForwardedAuthorizationHeader) == "" && !hasCallHeaders(req) && sessionFrom(req) == nil
+}
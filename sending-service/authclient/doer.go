@@ -0,0 +1,137 @@
+package authclient
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Doer sends HTTP requests. It is the interface many SDKs and existing
+// codebases accept an injected HTTP client as; *Client, *http.Client and
+// the Doer returned by NewDoer implement it.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+var (
+	_ Doer = (*Client)(nil)
+	_ Doer = (*http.Client)(nil)
+)
+
+// AudienceFunc returns the audience to mint the ID token of req for.
+type AudienceFunc func(req *http.Request) (string, error)
+
+// URLAudience returns the origin of req's URL, such as
+// https://receiving-service-abc123-ew.a.run.app, which is the audience
+// Cloud Run services and Cloud Functions expect. Default ports are left
+// out.
+func URLAudience(req *http.Request) (string, error) {
+	if req.URL == nil || req.URL.Host == "" {
+		return "", fmt.Errorf("authclient: request URL has no host to infer the audience from")
+	}
+	scheme := strings.ToLower(req.URL.Scheme)
+	host := strings.ToLower(req.URL.Host)
+	if (scheme == "https" && strings.HasSuffix(host, ":443")) || (scheme == "http" && strings.HasSuffix(host, ":80")) {
+		host = host[:strings.LastIndexByte(host, ':')]
+	}
+	return scheme + "://" + host, nil
+}
+
+// HostAudiences returns an AudienceFunc that maps the hosts of requests to
+// audiences, such as a custom domain, api.example.com, to the run.app URL of
+// the service behind it, and infers the audience of other hosts with
+// fallback, or URLAudience if it is nil. Hosts are matched without regard
+// to case, with their port if they have one and without it otherwise; a
+// host of the form *.example.com matches the subdomains of example.com.
+func HostAudiences(audiences map[string]string, fallback AudienceFunc) AudienceFunc {
+	if fallback == nil {
+		fallback = URLAudience
+	}
+	hosts := make(map[string]string, len(audiences))
+	for host, audience := range audiences {
+		hosts[strings.ToLower(host)] = audience
+	}
+	return func(req *http.Request) (string, error) {
+		if req.URL == nil {
+			return fallback(req)
+		}
+		host := strings.ToLower(req.URL.Host)
+		if audience, ok := hosts[host]; ok {
+			return audience, nil
+		}
+		name := strings.ToLower(req.URL.Hostname())
+		if audience, ok := hosts[name]; ok {
+			return audience, nil
+		}
+		for dot := strings.IndexByte(name, '.'); dot >= 0; dot = strings.IndexByte(name, '.') {
+			name = name[dot+1:]
+			if audience, ok := hosts["*."+name]; ok {
+				return audience, nil
+			}
+		}
+		return fallback(req)
+	}
+}
+
+// NewDoer returns a Doer that sends each request with the client clients
+// hands out for its audience, so that one Doer can call any number of
+// receiving services. audience infers the audience of a request; if nil,
+// it is URLAudience. clients is typically a *Cache, whose clients are
+// created on first use and reused.
+func NewDoer(clients TokenClientFactory, audience AudienceFunc) Doer {
+	return newAudienceRouter(clients, audience)
+}
+
+// NewAudienceTransport returns a transport that sends each request like
+// the Doer NewDoer returns, for code that takes an http.RoundTripper or
+// builds its own http.Client. The timeout of WithTimeout, which bounds whole calls
+// made with a Client, does not apply; set one on the http.Client, or the
+// attempt timeout of WithTimeouts.
+func NewAudienceTransport(clients TokenClientFactory, audience AudienceFunc) http.RoundTripper {
+	return newAudienceRouter(clients, audience)
+}
+
+func newAudienceRouter(clients TokenClientFactory, audience AudienceFunc) *audienceRouter {
+	if audience == nil {
+		audience = URLAudience
+	}
+	return &audienceRouter{clients: clients, audience: audience}
+}
+
+// audienceRouter sends requests with the clients of their audiences.
+type audienceRouter struct {
+	clients  TokenClientFactory
+	audience AudienceFunc
+}
+
+func (d *audienceRouter) Do(req *http.Request) (*http.Response, error) {
+	c, err := d.client(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (d *audienceRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, err := d.client(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.HTTPClient().Transport.RoundTrip(req)
+}
+
+// client returns the client of req's audience, closing the body of req if
+// there is none.
+func (d *audienceRouter) client(req *http.Request) (*Client, error) {
+	audience, err := d.audience(req)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	c, err := d.clients.Client(audience)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	return c, nil
+}
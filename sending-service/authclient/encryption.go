@@ -0,0 +1,457 @@
+package authclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// EnvelopeContentType is the Content-Type of bodies encrypted by
+// WithEncryption: a JSON envelope holding the ciphertext, the data key it
+// was encrypted with, wrapped by a key encryption key, and the Content-Type
+// and Content-Encoding of the plaintext.
+const EnvelopeContentType = "application/vnd.envelope+json"
+
+// EncryptResponseHeader asks the receiving service to encrypt its response.
+const EncryptResponseHeader = "X-Encrypt-Response"
+
+const (
+	// envelopeAlgorithm is the cipher of envelope bodies and of the data
+	// keys wrapped by a Keyset.
+	envelopeAlgorithm = "A256GCM"
+	// dataKeyLifetime is how long a data key encrypts bodies before a new
+	// one is made, which bounds the wrapping calls to one per lifetime and
+	// lets a rotated key encryption key take effect within it.
+	dataKeyLifetime = 5 * time.Minute
+	// maxUnwrappedKeys bounds the unwrapped data keys kept for decrypting
+	// responses.
+	maxUnwrappedKeys = 1024
+)
+
+// KeyWrapper wraps and unwraps the data keys of encrypted bodies with a key
+// encryption key, such as a Cloud KMS key.
+type KeyWrapper interface {
+	// WrapKey encrypts key with the primary key encryption key and returns
+	// it with the ID of the key that wrapped it.
+	WrapKey(ctx context.Context, key []byte) (wrapped []byte, keyID string, err error)
+	// UnwrapKey decrypts a key wrapped by the key with the given ID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KMSKeyWrapper wraps data keys with the Cloud KMS symmetric key keyName,
+// of the form projects/P/locations/L/keyRings/R/cryptoKeys/K, so the key
+// encryption key never leaves KMS. Rotating the key in KMS changes the
+// version new data keys are wrapped with; keys wrapped by earlier versions
+// unwrap as long as those versions are enabled. The caller's credentials,
+// or those given in opts, must hold roles/cloudkms.cryptoKeyEncrypterDecrypter
+// on the key, as must those of the receiving services.
+func KMSKeyWrapper(ctx context.Context, keyName string, opts ...option.ClientOption) (KeyWrapper, error) {
+	svc, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to create Cloud KMS client: %w", err)
+	}
+	return &kmsKeyWrapper{keys: svc.Projects.Locations.KeyRings.CryptoKeys, name: keyName}, nil
+}
+
+type kmsKeyWrapper struct {
+	keys *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+	name string
+}
+
+func (k *kmsKeyWrapper) WrapKey(ctx context.Context, key []byte) ([]byte, string, error) {
+	resp, err := k.keys.Encrypt(k.name, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(key),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, "", fmt.Errorf("authclient: failed to wrap data key: %w", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return nil, "", fmt.Errorf("authclient: failed to decode wrapped data key: %w", err)
+	}
+	// resp.Name is the key version that wrapped the data key.
+	return wrapped, resp.Name, nil
+}
+
+// UnwrapKey ignores keyID: the ciphertext names the key version to KMS.
+func (k *kmsKeyWrapper) UnwrapKey(ctx context.Context, _ string, wrapped []byte) ([]byte, error) {
+	resp, err := k.keys.Decrypt(k.name, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to unwrap data key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to decode data key: %w", err)
+	}
+	return key, nil
+}
+
+// Keyset is a KeyWrapper holding AES-256 key encryption keys by ID, for
+// services that cannot call Cloud KMS. Data keys are wrapped with the
+// primary key, and unwrapped with whichever key wrapped them, so a key is
+// rotated by adding a new one to the keysets of the sender and its
+// receivers, then making it primary, then removing the old one once no
+// message wrapped by it is in flight.
+type Keyset struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// keysetFile is the JSON form of a Keyset.
+type keysetFile struct {
+	Primary string `json:"primary"`
+	Keys    []struct {
+		ID  string `json:"id"`
+		Key []byte `json:"key"`
+	} `json:"keys"`
+}
+
+// ParseKeyset reads a Keyset from JSON of the form
+//
+//	{
+//	  "primary": "2024-06",
+//	  "keys": [
+//	    {"id": "2024-01", "key": "<base64 of 32 random bytes>"},
+//	    {"id": "2024-06", "key": "<base64 of 32 random bytes>"}
+//	  ]
+//	}
+func ParseKeyset(data []byte) (*Keyset, error) {
+	var f keysetFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("authclient: failed to parse keyset: %w", err)
+	}
+	ks := &Keyset{primary: f.Primary, keys: make(map[string]cipher.AEAD, len(f.Keys))}
+	for _, k := range f.Keys {
+		if k.ID == "" {
+			return nil, errors.New("authclient: keyset key IDs must not be empty")
+		}
+		if _, ok := ks.keys[k.ID]; ok {
+			return nil, fmt.Errorf("authclient: keyset key ID %q is repeated", k.ID)
+		}
+		if len(k.Key) != 32 {
+			return nil, fmt.Errorf("authclient: keyset key %q must be 32 bytes, not %d", k.ID, len(k.Key))
+		}
+		aead, err := newAEAD(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[k.ID] = aead
+	}
+	if _, ok := ks.keys[ks.primary]; !ok {
+		return nil, fmt.Errorf("authclient: keyset primary key %q is not in the keyset", ks.primary)
+	}
+	return ks, nil
+}
+
+// LoadKeyset reads the Keyset in the file at path, as ParseKeyset
+// describes. On Cloud Run the file is normally a mounted Secret Manager
+// secret.
+func LoadKeyset(path string) (*Keyset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to read keyset: %w", err)
+	}
+	return ParseKeyset(data)
+}
+
+// WrapKey wraps key with the primary key, binding it to the key's ID.
+func (ks *Keyset) WrapKey(_ context.Context, key []byte) ([]byte, string, error) {
+	wrapped, err := seal(ks.keys[ks.primary], key, []byte(ks.primary))
+	return wrapped, ks.primary, err
+}
+
+// UnwrapKey unwraps a key wrapped by the key with the given ID.
+func (ks *Keyset) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := ks.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("authclient: unknown keyset key %q", keyID)
+	}
+	key, err := open(aead, wrapped, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to unwrap data key: %w", err)
+	}
+	return key, nil
+}
+
+// WithEncryption encrypts the bodies of the requests sent by the client
+// and asks receiving services to encrypt their responses, for defense in
+// depth beyond TLS and IAM: proxies and logs between the services only see
+// ciphertext. Bodies are encrypted with AES-256-GCM under a data key that
+// is wrapped by w and replaced every five minutes, and sent as JSON
+// envelopes with the EnvelopeContentType. The encryption binds a body to
+// the request's method, path and query string. Encrypted responses are
+// decrypted; responses the receiving service sends in the clear, such as
+// its authentication errors, are returned as they are. A request is
+// encrypted once, however many times it is retried, and after it is
+// compressed, so that compression still pays off, and signed. Streamed uploads are
+// refused with an error matching ErrUnencryptableUpload.
+func WithEncryption(w KeyWrapper) Option {
+	return func(o *options) {
+		o.keyWrapper = w
+	}
+}
+
+// envelope is the JSON form of an encrypted body.
+type envelope struct {
+	Algorithm       string `json:"alg"`
+	KeyID           string `json:"kid"`
+	WrappedKey      []byte `json:"wrapped_key"`
+	Ciphertext      []byte `json:"ciphertext"`
+	ContentType     string `json:"content_type,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// IsEnvelope reports whether contentType is the EnvelopeContentType.
+func IsEnvelope(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == EnvelopeContentType
+}
+
+// dataKey is a data key and its wrapped form.
+type dataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+	keyID   string
+	expires time.Time
+}
+
+// dataKeys encrypts envelopes with a data key it replaces every
+// dataKeyLifetime, and decrypts them with the data keys it has unwrapped.
+type dataKeys struct {
+	wrapper KeyWrapper
+
+	mu        sync.Mutex
+	current   *dataKey
+	unwrapped map[string]cipher.AEAD
+}
+
+func newDataKeys(w KeyWrapper) *dataKeys {
+	return &dataKeys{wrapper: w, unwrapped: make(map[string]cipher.AEAD)}
+}
+
+// key returns the current data key, making a new one if it has expired.
+func (k *dataKeys) key(ctx context.Context) (*dataKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.current != nil && time.Now().Before(k.current.expires) {
+		return k.current, nil
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, keyID, err := k.wrapper.WrapKey(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	k.current = &dataKey{aead: aead, wrapped: wrapped, keyID: keyID, expires: time.Now().Add(dataKeyLifetime)}
+	return k.current, nil
+}
+
+// unwrap returns the data key of e, unwrapping it unless it was seen
+// before.
+func (k *dataKeys) unwrap(ctx context.Context, e *envelope) (cipher.AEAD, error) {
+	id := e.KeyID + "\x00" + string(e.WrappedKey)
+	k.mu.Lock()
+	aead, ok := k.unwrapped[id]
+	k.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	raw, err := k.wrapper.UnwrapKey(ctx, e.KeyID, e.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = newAEAD(raw); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	if len(k.unwrapped) >= maxUnwrappedKeys {
+		k.unwrapped = make(map[string]cipher.AEAD)
+	}
+	k.unwrapped[id] = aead
+	k.mu.Unlock()
+	return aead, nil
+}
+
+// seal returns the envelope of plaintext, whose Content-Type and
+// Content-Encoding are given, bound to binding.
+func (k *dataKeys) seal(ctx context.Context, plaintext []byte, contentType, contentEncoding, binding string) ([]byte, error) {
+	key, err := k.key(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e := envelope{
+		Algorithm:       envelopeAlgorithm,
+		KeyID:           key.keyID,
+		WrappedKey:      key.wrapped,
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+	}
+	if e.Ciphertext, err = seal(key.aead, plaintext, e.additionalData(binding)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// open decrypts the envelope data bound to binding.
+func (k *dataKeys) open(ctx context.Context, data []byte, binding string) ([]byte, *envelope, error) {
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, nil, fmt.Errorf("malformed envelope: %w", err)
+	}
+	if e.Algorithm != envelopeAlgorithm {
+		return nil, nil, fmt.Errorf("unsupported envelope algorithm %q", e.Algorithm)
+	}
+	aead, err := k.unwrap(ctx, &e)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := open(aead, e.Ciphertext, e.additionalData(binding))
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, &e, nil
+}
+
+// additionalData binds the ciphertext of e to binding and to the headers
+// it restores.
+func (e *envelope) additionalData(binding string) []byte {
+	return []byte(strings.Join([]string{binding, e.KeyID, e.ContentType, e.ContentEncoding}, "\n"))
+}
+
+// requestBinding and responseBinding are what the bodies of a request and
+// of its response are bound to, so that neither can be
+// replayed to another endpoint or as the other.
+func requestBinding(method, uri string) string {
+	return "request " + method + " " + uri
+}
+
+func responseBinding(method, uri string) string {
+	return "response " + method + " " + uri
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which it prepends to the
+// ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:n], ciphertext[n:], additionalData)
+}
+
+type encryptTransport struct {
+	next http.RoundTripper
+	keys *dataKeys
+}
+
+func (t *encryptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if uploadFrom(req) != nil {
+		req.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrUnencryptableUpload, req.URL.Redacted())
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(EncryptResponseHeader, "true")
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 && !IsEnvelope(r.Header.Get("Content-Type")) {
+		sealed, err := t.keys.seal(r.Context(), body, r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding"), requestBinding(r.Method, r.URL.RequestURI()))
+		if err != nil {
+			return nil, fmt.Errorf("authclient: failed to encrypt request: %w", err)
+		}
+		r.Header.Set("Content-Type", EnvelopeContentType)
+		r.Header.Del("Content-Encoding")
+		r.Header.Set("Content-Length", strconv.Itoa(len(sealed)))
+		r.ContentLength = int64(len(sealed))
+		r.Body = io.NopCloser(bytes.NewReader(sealed))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(sealed)), nil
+		}
+	}
+
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.decrypt(r, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// decrypt replaces the body of an encrypted response with the plaintext,
+// and restores its Content-Type and Content-Encoding. A Content-Encoding
+// the transport would have decoded had it seen it, because the request
+// did not set Accept-Encoding, is decoded.
+func (t *encryptTransport) decrypt(req *http.Request, resp *http.Response) error {
+	if req.Method == http.MethodHead || !IsEnvelope(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	body, e, err := t.keys.open(req.Context(), data, responseBinding(req.Method, req.URL.RequestURI()))
+	if err != nil {
+		return fmt.Errorf("authclient: failed to decrypt response: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Type")
+	if e.ContentType != "" {
+		resp.Header.Set("Content-Type", e.ContentType)
+	}
+	resp.Header.Del("Content-Encoding")
+	if e.ContentEncoding != "" {
+		resp.Header.Set("Content-Encoding", e.ContentEncoding)
+		if req.Header.Get("Accept-Encoding") == "" {
+			return Decompress(resp)
+		}
+	}
+	return nil
+}
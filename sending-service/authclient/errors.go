@@ -0,0 +1,100 @@
+package authclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrTokenMint is matched by errors.Is for requests that failed because
+	// no ID token could be minted, usually a problem with the caller's own
+	// credentials rather than with the receiving service.
+	ErrTokenMint = errors.New("authclient: failed to mint ID token")
+	// ErrUnauthorized is matched by errors.Is for a *DownstreamStatusError
+	// with status 401 or 403: the receiving service rejected the token, or
+	// the caller may not invoke it.
+	ErrUnauthorized = errors.New("authclient: downstream rejected the ID token")
+	// ErrDownstreamTimeout is matched by errors.Is for requests that ran out
+	// of time under the client's TimeoutPolicy, and for a
+	// *DownstreamStatusError with status 408 or 504.
+	ErrDownstreamTimeout = errors.New("authclient: downstream call timed out")
+)
+
+// TokenMintError is returned for requests that failed because no ID token
+// could be minted for the audience.
+type TokenMintError struct {
+	Audience string
+	Err      error
+}
+
+func (e *TokenMintError) Error() string {
+	return fmt.Sprintf("authclient: failed to mint ID token for %s: %v", e.Audience, e.Err)
+}
+
+func (e *TokenMintError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrTokenMint.
+func (e *TokenMintError) Is(target error) bool {
+	return target == ErrTokenMint
+}
+
+// Is reports whether target is ErrUnauthorized, for status 401 and 403,
+// ErrAudienceRejected, for a 401 that names the audience, or
+// ErrDownstreamTimeout, for status 408 and 504.
+func (e *DownstreamStatusError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden
+	case ErrAudienceRejected:
+		return audienceRejected(e.Code, e.Header, e.Body)
+	case ErrDownstreamTimeout:
+		return e.Code == http.StatusRequestTimeout || e.Code == http.StatusGatewayTimeout
+	}
+	return false
+}
+
+// deadlineError reports that a call ran out of its overall timeout.
+type deadlineError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *deadlineError) Error() string {
+	return fmt.Sprintf("authclient: no response within request timeout of %s: %v", e.timeout, e.err)
+}
+
+func (e *deadlineError) Unwrap() error { return e.err }
+
+// Is reports whether target is ErrDownstreamTimeout.
+func (e *deadlineError) Is(target error) bool { return target == ErrDownstreamTimeout }
+
+// Timeout reports true, like net.Error timeouts.
+func (e *deadlineError) Timeout() bool { return true }
+
+// GatewayStatus returns the status code a service relaying a downstream
+// call should answer with when the call failed with err: 503 when the
+// circuit breaker is open or too many requests are in flight, 504 when the
+// call timed out, 500 when no token could be minted, the downstream status
+// for a *DownstreamStatusError, the status of a *HookError that sets one,
+// and 502 for any other failure to reach the receiving service.
+func GatewayStatus(err error) int {
+	var statusErr *DownstreamStatusError
+	var hookErr *HookError
+	switch {
+	case errors.As(err, &hookErr) && hookErr.Status != 0:
+		return hookErr.Status
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrConcurrencyLimit):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &statusErr):
+		return statusErr.Code
+	case errors.Is(err, ErrDownstreamTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrTokenMint):
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadGateway
+}
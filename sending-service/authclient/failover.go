@@ -0,0 +1,219 @@
+package authclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FailoverSettings configures a client that fails over from one regional
+// deployment of a service to another.
+type FailoverSettings struct {
+	// HealthPath is the path of the primary that is probed while calls go
+	// to the secondary. Any answer below 500 counts as healthy. It
+	// defaults to /.
+	HealthPath string
+	// HealthInterval is how often the primary is probed while calls go to
+	// the secondary. It defaults to 10 seconds.
+	HealthInterval time.Duration
+	// Logger reports failing over and back. It defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// DefaultFailoverSettings returns settings that probe / of the primary
+// every 10 seconds.
+func DefaultFailoverSettings() FailoverSettings {
+	return FailoverSettings{HealthPath: "/", HealthInterval: 10 * time.Second}
+}
+
+// NewFailover returns a client that sends calls to primary and, when the
+// primary cannot be reached or answers with a 5xx status, fails over to
+// secondary, the same service deployed in another region at secondaryURL.
+// Each client keeps its own audience, so the secondary's calls carry ID
+// tokens minted for it. Requests are written against the primary's URL;
+// those sent to the secondary have its scheme and host, and its path in
+// place of the primary's. Requests to other hosts go to the primary
+// unchanged.
+//
+// The failed call is sent again to the secondary if its body can be
+// replayed, and every later call goes to the secondary until the primary,
+// probed every HealthInterval, is healthy again. The primary is probed
+// only while failed over.
+//
+// The returned client reports the primary's audience, token and circuit
+// breaker state.
+func NewFailover(primary, secondary *Client, secondaryURL string, s FailoverSettings) (*Client, error) {
+	primaryBase, err := url.Parse(primary.baseURL)
+	if err != nil || primaryBase.Host == "" {
+		return nil, fmt.Errorf("authclient: invalid primary URL %q", primary.baseURL)
+	}
+	secondaryBase, err := url.Parse(secondaryURL)
+	if err != nil || secondaryBase.Host == "" {
+		return nil, fmt.Errorf("authclient: invalid secondary URL %q", secondaryURL)
+	}
+	defaults := DefaultFailoverSettings()
+	if s.HealthPath == "" {
+		s.HealthPath = defaults.HealthPath
+	}
+	if s.HealthInterval <= 0 {
+		s.HealthInterval = defaults.HealthInterval
+	}
+	if s.Logger == nil {
+		s.Logger = slog.Default()
+	}
+	t := &failoverTransport{
+		primary:       primary,
+		secondary:     secondary,
+		primaryBase:   primaryBase,
+		secondaryBase: secondaryBase,
+		settings:      s,
+	}
+	return &Client{
+		audience: primary.audience,
+		baseURL:  primary.baseURL,
+		source:   primary.source,
+		breaker:  primary.breaker,
+		httpClient: &http.Client{
+			Transport: t,
+			Timeout:   primary.httpClient.Timeout,
+		},
+		created: time.Now(),
+	}, nil
+}
+
+type failoverTransport struct {
+	primary, secondary         *Client
+	primaryBase, secondaryBase *url.URL
+	settings                   FailoverSettings
+
+	mu         sync.Mutex
+	failedOver bool
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(req.URL.Host, t.primaryBase.Host) {
+		return t.primary.httpClient.Transport.RoundTrip(req)
+	}
+	if t.active() {
+		return t.toSecondary(req)
+	}
+	resp, err := t.primary.httpClient.Transport.RoundTrip(req)
+	if !t.failed(req, resp, err) {
+		return resp, err
+	}
+	t.failOver(resp, err)
+	if !replayable(req) {
+		return resp, err
+	}
+	if resp != nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+	}
+	r := req
+	if req.GetBody != nil {
+		body, berr := req.GetBody()
+		if berr != nil {
+			return nil, berr
+		}
+		r = req.Clone(req.Context())
+		r.Body = body
+	}
+	return t.toSecondary(r)
+}
+
+// failed reports whether the primary could not be reached or failed the
+// request, rather than the caller giving up on it.
+func (t *failoverTransport) failed(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	return resp.StatusCode >= 500
+}
+
+// active reports whether calls go to the secondary.
+func (t *failoverTransport) active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failedOver
+}
+
+// failOver sends calls to the secondary and starts probing the primary,
+// unless they already go to the secondary.
+func (t *failoverTransport) failOver(resp *http.Response, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failedOver {
+		return
+	}
+	t.failedOver = true
+	attrs := []any{
+		slog.String("primary", t.primaryBase.Host),
+		slog.String("secondary", t.secondaryBase.Host),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	} else {
+		attrs = append(attrs, slog.Int("status", resp.StatusCode))
+	}
+	t.settings.Logger.Warn("Primary region failed, failing over to secondary", attrs...)
+	go t.probe()
+}
+
+// probe checks the primary every HealthInterval until it is healthy, then
+// sends calls to it again.
+func (t *failoverTransport) probe() {
+	ticker := time.NewTicker(t.settings.HealthInterval)
+	defer ticker.Stop()
+	u := t.primaryBase.JoinPath(t.settings.HealthPath).String()
+	for range ticker.C {
+		if err := t.checkPrimary(u); err != nil {
+			t.settings.Logger.Debug("Primary region still unhealthy", slog.String("primary", t.primaryBase.Host), slog.Any("error", err))
+			continue
+		}
+		t.mu.Lock()
+		t.failedOver = false
+		t.mu.Unlock()
+		t.settings.Logger.Info("Primary region healthy again, failing back", slog.String("primary", t.primaryBase.Host))
+		return
+	}
+}
+
+func (t *failoverTransport) checkPrimary(u string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.settings.HealthInterval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(CallContext(ctx, NoRetry()), http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.primary.httpClient.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// toSecondary sends req to the secondary's URL instead of the primary's.
+func (t *failoverTransport) toSecondary(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.Body = req.Body
+	r.URL.Scheme = t.secondaryBase.Scheme
+	r.URL.Host = t.secondaryBase.Host
+	if p := strings.TrimSuffix(t.primaryBase.Path, "/"); p != "" || t.secondaryBase.Path != "" {
+		r.URL.Path = strings.TrimSuffix(t.secondaryBase.Path, "/") + strings.TrimPrefix(req.URL.Path, p)
+		r.URL.RawPath = ""
+	}
+	r.Host = ""
+	return t.secondary.httpClient.Transport.RoundTrip(r)
+}
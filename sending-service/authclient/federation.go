@@ -0,0 +1,69 @@
+package authclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/api/option"
+)
+
+// FederatedTokenSource returns a TokenSourceFunc for callers outside Google
+// Cloud, such as workloads on AWS, Azure or on-premises, that authenticate
+// with Workload Identity Federation. credentialsFile is an external account
+// configuration created with `gcloud iam workload-identity-pools
+// create-cred-config`; it names where the workload's own credential comes
+// from, a file or a URL, and how to exchange it for a Google token.
+//
+// ID tokens are minted for serviceAccount through the IAM Credentials
+// generateIdToken API. If serviceAccount is empty, the service account
+// named by the configuration's service_account_impersonation_url is used.
+// The federated principal needs roles/iam.workloadIdentityUser on the
+// service account, and the service account needs roles/run.invoker on the
+// receiving service. opts apply to the IAM Credentials client, for example
+// QuotaProject.
+func FederatedTokenSource(credentialsFile, serviceAccount string, opts ...option.ClientOption) (TokenSourceFunc, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to read workload identity credentials: %w", err)
+	}
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("authclient: failed to parse workload identity credentials: %w", err)
+	}
+	if cfg["type"] != "external_account" {
+		return nil, fmt.Errorf("authclient: %s is not an external_account credential configuration", credentialsFile)
+	}
+
+	if serviceAccount == "" {
+		impersonationURL, _ := cfg["service_account_impersonation_url"].(string)
+		serviceAccount = serviceAccountFromURL(impersonationURL)
+		if serviceAccount == "" {
+			return nil, fmt.Errorf("authclient: no service account given and %s does not impersonate one", credentialsFile)
+		}
+	}
+
+	// The federated token itself calls generateIdToken. Left in place, the
+	// impersonation URL would have the service account mint a token for
+	// itself, which needs an extra self-binding.
+	delete(cfg, "service_account_impersonation_url")
+	delete(cfg, "service_account_impersonation")
+	base, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to encode workload identity credentials: %w", err)
+	}
+
+	return ImpersonatedTokenSource(serviceAccount, append([]option.ClientOption{option.WithCredentialsJSON(base)}, opts...)...), nil
+}
+
+// serviceAccountFromURL extracts the email from an impersonation URL of the
+// form .../serviceAccounts/{email}:generateAccessToken.
+func serviceAccountFromURL(u string) string {
+	_, rest, ok := strings.Cut(u, "/serviceAccounts/")
+	if !ok {
+		return ""
+	}
+	email, _, _ := strings.Cut(rest, ":")
+	return email
+}
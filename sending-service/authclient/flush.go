@@ -0,0 +1,85 @@
+package authclient
+
+import (
+	"sort"
+	"time"
+)
+
+// Flusher is implemented by client factories whose clients can be
+// discarded at runtime, such as *Cache.
+type Flusher interface {
+	Flush(audiences ...string) []string
+}
+
+// FlushToken discards the client's cached ID token and the token source
+// that minted it, so the next request mints a new token from freshly
+// obtained credentials. Use it after IAM changes or key rotation, when a
+// cached token would otherwise be sent until it expires.
+func (c *Client) FlushToken() error {
+	return c.source.reset()
+}
+
+// Flush discards the cached clients for audiences, or every cached client
+// if none are given, so the next call to Client creates a new one with a
+// new token source, circuit breaker and connections. It returns the
+// audiences whose clients were discarded, in sorted order. Code still
+// holding a discarded client, such as a reverse proxy, keeps working: its
+// token is flushed too, so it mints a new one on its next request, but it
+// no longer refreshes tokens in the background.
+func (c *Cache) Flush(audiences ...string) []string {
+	c.mu.Lock()
+	var flushed []*cacheEntry
+	var names []string
+	drop := func(audience string) {
+		if e, ok := c.entries[audience]; ok {
+			delete(c.entries, audience)
+			flushed = append(flushed, e)
+			names = append(names, audience)
+		}
+	}
+	if len(audiences) == 0 {
+		for audience := range c.entries {
+			drop(audience)
+		}
+	}
+	for _, audience := range audiences {
+		drop(audience)
+	}
+	c.mu.Unlock()
+
+	for _, e := range flushed {
+		// Wait for a client still being created, so it is flushed too.
+		e.once.Do(func() {})
+		if e.client == nil {
+			continue
+		}
+		e.client.source.stopRefresh()
+		e.client.source.reset()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reset replaces the underlying token source unconditionally and forgets
+// the token last handed out, so the next call to Token mints a new token
+// rather than reusing the flushed one within the stale grace period.
+func (s *tokenSource) reset() error {
+	s.forgetStored(nil)
+	ts, err := s.mint(s.ctx, s.audience)
+	if err != nil {
+		s.tokenError(err)
+		return &TokenMintError{Audience: s.audience, Err: err}
+	}
+	s.mu.Lock()
+	s.ts = ts
+	s.last = ""
+	s.minted, s.expiry = time.Time{}, time.Time{}
+	s.cachedTok = nil
+	s.mu.Unlock()
+	s.markStale(false)
+	return nil
+}
+
+func (s *tokenSource) stopRefresh() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
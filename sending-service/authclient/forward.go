@@ -0,0 +1,53 @@
+package authclient
+
+import (
+	"context"
+	"net/http"
+)
+
+// ForwardedAuthorizationHeader carries the end user's credentials to the
+// receiving service when the client forwards them, since Authorization or
+// X-Serverless-Authorization holds the client's own ID token.
+const ForwardedAuthorizationHeader = "X-Forwarded-Authorization"
+
+type forwardKey struct{}
+
+// ForwardAuthorization returns a copy of ctx carrying authorization, the
+// Authorization header of the end user's request, for a client created
+// with WithForwardedAuthorization to forward on requests that don't set
+// Authorization themselves.
+func ForwardAuthorization(ctx context.Context, authorization string) context.Context {
+	return context.WithValue(ctx, forwardKey{}, authorization)
+}
+
+// WithForwardedAuthorization forwards the end user's credentials to the
+// receiving service alongside the client's ID token: the Authorization
+// header a request carries, or else the one given with
+// ForwardAuthorization, is moved to X-Forwarded-Authorization before the
+// ID token is attached. The receiving service can then validate both and
+// authorize the call in the user's context. Requests with forwarded
+// credentials are never served from or stored in the response cache of
+// WithResponseCache, since their responses are specific to the user.
+func WithForwardedAuthorization() Option {
+	return func(o *options) {
+		o.forwardAuthorization = true
+	}
+}
+
+type forwardTransport struct {
+	next http.RoundTripper
+}
+
+func (t *forwardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		authorization, _ = req.Context().Value(forwardKey{}).(string)
+	}
+	if authorization == "" {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Header.Del("Authorization")
+	r.Header.Set(ForwardedAuthorizationHeader, authorization)
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,93 @@
+package authclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+)
+
+// gkeMetadataAttempts and gkeMetadataBackoff bound the retries of identity
+// requests the GKE metadata server fails, as it does for a few seconds
+// after a pod starts.
+const (
+	gkeMetadataAttempts = 5
+	gkeMetadataBackoff  = 500 * time.Millisecond
+)
+
+// gkeTokenLifetime is the lifetime of metadata server ID tokens, assumed
+// for a token whose exp claim cannot be read, less a margin.
+const gkeTokenLifetime = 55 * time.Minute
+
+// OnGKE reports whether the process runs in a Kubernetes pod with a
+// metadata server, as on GKE.
+func OnGKE() bool {
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != "" && metadata.OnGCE()
+}
+
+// GKETokenSource returns a TokenSourceFunc that mints ID tokens from the GKE
+// metadata server, for pods using Workload Identity. The tokens are those
+// of the Google service account the pod's Kubernetes service account is
+// bound to with the iam.gke.io/gcp-service-account annotation, and carry
+// its email, with the same audiences and one-hour lifetime as on Cloud
+// Run; their expiry is read from the token itself.
+//
+// Unlike the Cloud Run metadata server, the GKE one is only ready a few
+// seconds after the pod starts, so failed requests are retried with
+// backoff, and errors say how to check the Workload Identity binding.
+func GKETokenSource() TokenSourceFunc {
+	return func(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+		return oauth2.ReuseTokenSource(nil, &gkeTokenSource{audience: audience}), nil
+	}
+}
+
+type gkeTokenSource struct {
+	audience string
+}
+
+func (s *gkeTokenSource) Token() (*oauth2.Token, error) {
+	path := "instance/service-accounts/default/identity?format=full&audience=" + url.QueryEscape(s.audience)
+	wait := gkeMetadataBackoff
+	for attempt := 1; ; attempt++ {
+		raw, err := metadata.Get(path)
+		if err == nil {
+			token := strings.TrimSpace(raw)
+			expiry := tokenExpiry(token)
+			if expiry.IsZero() {
+				expiry = time.Now().Add(gkeTokenLifetime)
+			}
+			return &oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: expiry}, nil
+		}
+		if attempt >= gkeMetadataAttempts || !gkeRetryable(err) {
+			return nil, gkeError(err)
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// gkeRetryable reports whether err is the metadata server being
+// unreachable or failing, rather than refusing the request.
+func gkeRetryable(err error) bool {
+	var merr *metadata.Error
+	if errors.As(err, &merr) {
+		return merr.Code >= 500
+	}
+	return true
+}
+
+// gkeError adds to err what to check when the metadata server does not
+// hand out ID tokens.
+func gkeError(err error) error {
+	var merr *metadata.Error
+	if errors.As(err, &merr) && merr.Code == 404 {
+		return fmt.Errorf("authclient: GKE metadata server has no identity for this pod; check that Workload Identity is enabled on the node pool and that the Kubernetes service account is annotated with iam.gke.io/gcp-service-account and bound with roles/iam.workloadIdentityUser: %w", err)
+	}
+	return fmt.Errorf("authclient: failed to mint ID token from the GKE metadata server: %w", err)
+}
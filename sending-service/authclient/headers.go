@@ -0,0 +1,44 @@
+package authclient
+
+import (
+	"net/http"
+	"net/textproto"
+)
+
+// WithHeaders attaches static headers, such as an API key or a tenant ID,
+// to every request sent by the client, replacing any values the request
+// already has. The Authorization and X-Serverless-Authorization headers
+// are reserved for tokens and are ignored.
+func WithHeaders(h http.Header) Option {
+	static := make(http.Header, len(h))
+	for k, vs := range h {
+		static[textproto.CanonicalMIMEHeaderKey(k)] = append([]string(nil), vs...)
+	}
+	return WithHeaderFunc(func() http.Header { return static })
+}
+
+// WithHeaderFunc is like WithHeaders, but calls f for the headers of each
+// request, so that they can change while the client is in use, for example
+// when a secret is rotated. f must be safe for concurrent use and must not
+// modify headers it has returned.
+func WithHeaderFunc(f func() http.Header) Option {
+	return func(o *options) {
+		o.headers = f
+	}
+}
+
+type headerTransport struct {
+	next    http.RoundTripper
+	headers func() http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	for k, vs := range t.headers() {
+		if ck := textproto.CanonicalMIMEHeaderKey(k); ck == "Authorization" || ck == ServerlessAuthorizationHeader {
+			continue
+		}
+		r.Header[textproto.CanonicalMIMEHeaderKey(k)] = vs
+	}
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,122 @@
+package authclient
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// WithHedging sends a second, identical request when a GET, HEAD or
+// OPTIONS request without a body, or with one that can be replayed, has
+// not been answered within delay, and uses whichever response arrives
+// first. The other request is cancelled. Hedging trades extra load on the
+// receiving service for lower tail latency, so choose a delay around the
+// 95th percentile of response times.
+func WithHedging(delay time.Duration) Option {
+	return func(o *options) {
+		o.hedgeDelay = delay
+	}
+}
+
+type hedgeTransport struct {
+	next   http.RoundTripper
+	delay  time.Duration
+	logger *slog.Logger
+}
+
+type hedgeResult struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hedgeable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	launch := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		i := len(cancels) - 1
+		go func() {
+			r := req.Clone(ctx)
+			if i > 0 && req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					results <- hedgeResult{index: i, err: err}
+					return
+				}
+				r.Body = body
+			}
+			resp, err := t.next.RoundTrip(r)
+			results <- hedgeResult{index: i, resp: resp, err: err}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+
+	pending := 1
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if len(cancels) == 1 {
+				t.logger.DebugContext(req.Context(), "Sending hedged request",
+					slog.String("url", req.URL.String()),
+					slog.Duration("delay", t.delay),
+				)
+				launch()
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				for i, cancel := range cancels {
+					if i != res.index {
+						cancel()
+					}
+				}
+				if pending > 0 {
+					go discard(results, pending)
+				}
+				res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: cancels[res.index]}
+				return res.resp, nil
+			}
+			cancels[res.index]()
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// discard releases the responses of requests that lost the race.
+func discard(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.err == nil {
+			io.Copy(io.Discard, res.resp.Body)
+			res.resp.Body.Close()
+		}
+	}
+}
+
+func hedgeable(req *http.Request) bool {
+	if isUpgrade(req) {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "":
+		return replayable(req)
+	}
+	return false
+}
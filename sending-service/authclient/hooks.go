@@ -0,0 +1,205 @@
+package authclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RequestHook modifies requests before they are sent, for example to
+// rewrite headers or add context such as the tenant a request is made for.
+type RequestHook interface {
+	// BeforeSend is called with a copy of each request, which it may
+	// modify, including its header, URL and body. An error fails the
+	// request without sending it.
+	BeforeSend(req *http.Request) error
+}
+
+// RequestHookFunc adapts a function to the RequestHook interface.
+type RequestHookFunc func(req *http.Request) error
+
+// BeforeSend calls f.
+func (f RequestHookFunc) BeforeSend(req *http.Request) error {
+	return f(req)
+}
+
+// ResponseHook modifies responses before they are returned, for example to
+// remove internal headers or transform the body.
+type ResponseHook interface {
+	// AfterReceive is called with each response, which it may modify,
+	// including replacing its body. An error fails the request, and the
+	// response body is closed.
+	AfterReceive(resp *http.Response) error
+}
+
+// ResponseHookFunc adapts a function to the ResponseHook interface.
+type ResponseHookFunc func(resp *http.Response) error
+
+// AfterReceive calls f.
+func (f ResponseHookFunc) AfterReceive(resp *http.Response) error {
+	return f(resp)
+}
+
+// HookError is returned for requests that failed because a hook returned
+// an error. Hooks may return a *HookError themselves to choose the status
+// a gateway answers with, such as 400 for a request that lacks context the
+// hook needs; other errors are wrapped with a Status of 0, which stands
+// for 502 Bad Gateway.
+type HookError struct {
+	Status int
+	Err    error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("authclient: hook failed: %v", e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// WithRequestHooks calls hooks, in order, with every request made with the
+// client, once per call before any built-in layer, so changes made by a
+// hook apply to every attempt. It may be given more than once to add more
+// hooks.
+func WithRequestHooks(hooks ...RequestHook) Option {
+	return WithMiddleware(HookMiddleware(hooks, nil))
+}
+
+// WithResponseHooks calls hooks, in order, with every response the client
+// returns, after every built-in layer, including responses served from the
+// response cache. It may be given more than once to add more hooks.
+func WithResponseHooks(hooks ...ResponseHook) Option {
+	return WithMiddleware(HookMiddleware(nil, hooks))
+}
+
+// HookMiddleware returns a Middleware that calls before with each request
+// and after with each response, for use with WithMiddleware or
+// WithAttemptMiddleware, or with other transports such as a reverse
+// proxy's.
+func HookMiddleware(before []RequestHook, after []ResponseHook) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		if len(before) == 0 && len(after) == 0 {
+			return next
+		}
+		return &hookTransport{next: next, before: before, after: after}
+	}
+}
+
+type hookTransport struct {
+	next   http.RoundTripper
+	before []RequestHook
+	after  []ResponseHook
+}
+
+func (t *hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.before) > 0 {
+		r := req.Clone(req.Context())
+		for _, hook := range t.before {
+			if err := hook.BeforeSend(r); err != nil {
+				closeBody(req)
+				return nil, hookError(err)
+			}
+		}
+		req = r
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range t.after {
+		if err := hook.AfterReceive(resp); err != nil {
+			resp.Body.Close()
+			return nil, hookError(err)
+		}
+	}
+	return resp, nil
+}
+
+func hookError(err error) error {
+	if _, ok := err.(*HookError); ok {
+		return err
+	}
+	return &HookError{Err: err}
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// hopByHopHeaders are the headers that apply to a single connection, from
+// RFC 9110 section 7.6.1, and are not forwarded by proxies.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// StripHopByHopHeaders returns a RequestHook that removes hop-by-hop
+// headers, and the headers listed in Connection, from requests, for
+// clients that forward inbound requests themselves rather than through a
+// reverse proxy, which removes them already. WebSocket handshakes, which
+// need Connection and Upgrade, are left alone.
+func StripHopByHopHeaders() RequestHook {
+	return RequestHookFunc(func(req *http.Request) error {
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			return nil
+		}
+		for _, v := range req.Header.Values("Connection") {
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					req.Header.Del(name)
+				}
+			}
+		}
+		for _, name := range hopByHopHeaders {
+			req.Header.Del(name)
+		}
+		return nil
+	})
+}
+
+// TransformResponseBody returns a ResponseHook that replaces the body of
+// each response with the result of transform, which is given the
+// response, with its status and headers, and its body. Bodies are read
+// into memory, up to maxSize bytes; larger responses fail with a
+// *HookError, and a maxSize of 0 disables the limit. The Content-Length
+// is updated to the new body, so transform should remove or update
+// headers such as Content-Encoding or ETag that the new body invalidates.
+// Streamed responses are better transformed with a hook that wraps the
+// body in a reader of its own.
+func TransformResponseBody(maxSize int64, transform func(resp *http.Response, body []byte) ([]byte, error)) ResponseHook {
+	return ResponseHookFunc(func(resp *http.Response) error {
+		r := io.Reader(resp.Body)
+		if maxSize > 0 {
+			r = io.LimitReader(resp.Body, maxSize+1)
+		}
+		body, err := io.ReadAll(r)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if maxSize > 0 && int64(len(body)) > maxSize {
+			return &HookError{Status: http.StatusBadGateway, Err: fmt.Errorf("response body exceeds %d bytes", maxSize)}
+		}
+		if body, err = transform(resp, body); err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	})
+}
@@ -0,0 +1,80 @@
+package authclient
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cTransport sends requests to http:// URLs over HTTP/2 with prior
+// knowledge (h2c). A host that fails to speak HTTP/2 on its first request
+// is remembered as HTTP/1.1-only and its requests are sent with fallback,
+// so receivers that don't serve h2c keep working.
+type h2cTransport struct {
+	h2       *http2.Transport
+	fallback http.RoundTripper
+
+	mu    sync.Mutex
+	hosts map[string]bool // true for h2c, false for HTTP/1.1
+}
+
+func newH2CTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error), fallback http.RoundTripper) *h2cTransport {
+	return &h2cTransport{
+		h2: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		},
+		fallback: fallback,
+		hosts:    make(map[string]bool),
+	}
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	t.mu.Lock()
+	h2c, known := t.hosts[host]
+	t.mu.Unlock()
+	if known && !h2c {
+		return t.fallback.RoundTrip(req)
+	}
+
+	resp, err := t.h2.RoundTrip(req)
+	if err == nil {
+		if !known {
+			t.mu.Lock()
+			t.hosts[host] = true
+			t.mu.Unlock()
+		}
+		return resp, nil
+	}
+	if known || req.Context().Err() != nil || !replayable(req) {
+		return nil, err
+	}
+
+	// The host has never answered over h2c, so take the failure as the
+	// sign of an HTTP/1.1-only server rather than of a broken connection.
+	t.mu.Lock()
+	t.hosts[host] = false
+	t.mu.Unlock()
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	return t.fallback.RoundTrip(r)
+}
+
+// CloseIdleConnections closes the idle HTTP/2 connections.
+func (t *h2cTransport) CloseIdleConnections() {
+	t.h2.CloseIdleConnections()
+}
@@ -0,0 +1,200 @@
+package authclient
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHTTP3BrokenFor is how long HTTP/3 is not attempted again with a
+// host after it failed.
+const defaultHTTP3BrokenFor = 5 * time.Minute
+
+// defaultAltSvcMaxAge is how long an Alt-Svc advertisement without ma is
+// remembered, as in RFC 7838.
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// HTTP3Observer is told when an HTTP/3 attempt failed and the request was
+// sent over the base transport instead.
+type HTTP3Observer interface {
+	HTTP3Fallback(host string, err error)
+}
+
+// HTTP3Settings configures WithHTTP3.
+type HTTP3Settings struct {
+	// RoundTripper sends requests over HTTP/3, such as the transport of
+	// the sender/http3 module.
+	RoundTripper http.RoundTripper
+	// BrokenFor is how long a host whose HTTP/3 attempt failed is only
+	// sent requests over the base transport. Zero means 5 minutes.
+	BrokenFor time.Duration
+	// Observer, if set, is told about each fallback.
+	Observer HTTP3Observer
+}
+
+// WithHTTP3 experimentally sends requests to hosts that advertise HTTP/3
+// with an Alt-Svc header, as Google Cloud load balancers can, over
+// s.RoundTripper, which can save round trips on lossy, long-distance
+// paths such as cross-region calls. The first requests to a host, and every
+// request to a host that did not advertise h3 on the same port, use the
+// base transport over HTTP/2 or HTTP/1.1. When an HTTP/3 attempt fails
+// without a response, for example because UDP is blocked, a request whose
+// body can be replayed is sent again over the base transport and HTTP/3 is
+// not attempted with the host for s.BrokenFor. The protocol a response was
+// received over is in its Proto field, and ConnDiagnostics counts it.
+func WithHTTP3(s HTTP3Settings) Option {
+	return func(o *options) {
+		if s.RoundTripper != nil {
+			o.http3 = &s
+		}
+	}
+}
+
+type http3Transport struct {
+	h3        http.RoundTripper
+	next      http.RoundTripper
+	brokenFor time.Duration
+	observer  HTTP3Observer
+	logger    *slog.Logger
+
+	mu sync.Mutex
+	// advertised holds until when hosts advertised h3, and broken until
+	// when they are not sent HTTP/3 after it failed.
+	advertised map[string]time.Time
+	broken     map[string]time.Time
+}
+
+func newHTTP3Transport(next http.RoundTripper, s HTTP3Settings, logger *slog.Logger) *http3Transport {
+	t := &http3Transport{
+		h3:         s.RoundTripper,
+		next:       next,
+		brokenFor:  s.BrokenFor,
+		observer:   s.Observer,
+		logger:     logger,
+		advertised: make(map[string]time.Time),
+		broken:     make(map[string]time.Time),
+	}
+	if t.brokenFor <= 0 {
+		t.brokenFor = defaultHTTP3BrokenFor
+	}
+	return t
+}
+
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if req.URL.Scheme != "https" || !t.usable(host) {
+		return t.remember(host, req)(t.next.RoundTrip(req))
+	}
+
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil {
+		return t.remember(host, req)(resp, nil)
+	}
+	if req.Context().Err() != nil {
+		return nil, err
+	}
+	retry := req
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, berr := req.GetBody()
+		if berr != nil {
+			return nil, err
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+
+	t.mu.Lock()
+	t.broken[host] = time.Now().Add(t.brokenFor)
+	t.mu.Unlock()
+	t.logger.WarnContext(req.Context(), "HTTP/3 failed; falling back to the base transport",
+		slog.String("host", host),
+		slog.Duration("for", t.brokenFor),
+		slog.Any("error", err),
+	)
+	if t.observer != nil {
+		t.observer.HTTP3Fallback(host, err)
+	}
+	return t.remember(host, retry)(t.next.RoundTrip(retry))
+}
+
+// usable reports whether host advertised h3 and has not failed since.
+func (t *http3Transport) usable(host string) bool {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until, ok := t.broken[host]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(t.broken, host)
+	}
+	until, ok := t.advertised[host]
+	if ok && !now.Before(until) {
+		delete(t.advertised, host)
+		return false
+	}
+	return ok
+}
+
+// remember returns a function recording the Alt-Svc header of the response
+// to req before passing it on.
+func (t *http3Transport) remember(host string, req *http.Request) func(*http.Response, error) (*http.Response, error) {
+	return func(resp *http.Response, err error) (*http.Response, error) {
+		if err != nil || req.URL.Scheme != "https" {
+			return resp, err
+		}
+		altSvc := resp.Header.Values("Alt-Svc")
+		if len(altSvc) == 0 {
+			return resp, nil
+		}
+		port := req.URL.Port()
+		if port == "" {
+			port = "443"
+		}
+		maxAge, ok := parseAltSvcH3(altSvc, port)
+		t.mu.Lock()
+		if ok {
+			t.advertised[host] = time.Now().Add(maxAge)
+		} else {
+			delete(t.advertised, host)
+		}
+		t.mu.Unlock()
+		return resp, nil
+	}
+}
+
+// parseAltSvcH3 returns how long the Alt-Svc header values advertise h3
+// on port of the same host for, and whether they do. The value clear, or
+// values without h3, withdraw earlier advertisements.
+func parseAltSvcH3(values []string, port string) (time.Duration, bool) {
+	for _, v := range values {
+		for _, alt := range strings.Split(v, ",") {
+			params := strings.Split(alt, ";")
+			protocol, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+			if !ok || protocol != "h3" {
+				continue
+			}
+			altHost, altPort, err := net.SplitHostPort(strings.Trim(authority, `"`))
+			if err != nil || altHost != "" || altPort != port {
+				continue
+			}
+			maxAge := defaultAltSvcMaxAge
+			for _, p := range params[1:] {
+				if s, ok := strings.CutPrefix(strings.TrimSpace(p), "ma="); ok {
+					if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+						maxAge = time.Duration(n) * time.Second
+					}
+				}
+			}
+			return maxAge, maxAge > 0
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,170 @@
+package authclient
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/oauth2"
+)
+
+// ProxyAuthorizationHeader is the header Identity-Aware Proxy also reads ID
+// tokens from, leaving the Authorization header to the backend.
+const ProxyAuthorizationHeader = "Proxy-Authorization"
+
+// iapGeneratedHeader is set by IAP on the responses it sends itself rather
+// than relaying from the backend.
+const iapGeneratedHeader = "X-Goog-IAP-Generated-Response"
+
+// WithIAP prepares the client for a service behind a load balancer with
+// Identity-Aware Proxy. clientID is the OAuth client ID of the
+// IAP-protected backend service, which IAP expects as the audience of ID
+// tokens instead of the run.app URL.
+//
+// If clientID is the audience passed to New, that one token is sent as
+// usual; use this when Cloud Run lets the IAP service agent, or all users,
+// invoke the service. Otherwise a second token, minted for clientID, is
+// sent in the Proxy-Authorization header, which IAP checks and removes,
+// while the token for the audience reaches Cloud Run in Authorization, for
+// services that require both IAP and Cloud Run IAM.
+//
+// IAP answers requests it does not accept with a 401, or with a 302
+// redirect to the Google sign-in page when it takes the caller for a
+// browser. The client turns those redirects into 401 Unauthorized responses
+// rather than following them, and retries once with a fresh IAP token.
+func WithIAP(clientID string) Option {
+	return func(o *options) {
+		o.iapClientID = clientID
+	}
+}
+
+// WithIAPClientIDs applies WithIAP to the clients whose audience is a key
+// of ids, with the OAuth client ID it maps to. It is meant for a Cache
+// shared by services with and without IAP.
+func WithIAPClientIDs(ids map[string]string) Option {
+	return func(o *options) {
+		o.iapClientIDs = ids
+	}
+}
+
+// iapTransport sends the IAP token, if it is separate from the ID token,
+// and handles the responses IAP generates.
+type iapTransport struct {
+	next     http.RoundTripper
+	clientID string
+	// source mints the token sent in Proxy-Authorization, or is nil when
+	// the ID token itself is minted for IAP.
+	source *tokenSource
+	logger *slog.Logger
+}
+
+func (t *iapTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, tok, err := t.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if tok != nil && iapRejected(resp) && replayable(req) {
+		t.logger.InfoContext(req.Context(), "Refreshing IAP token after IAP rejected it",
+			slog.String("client_id", t.clientID),
+			slog.Int("status", resp.StatusCode),
+		)
+		if err := t.source.invalidate(tok); err != nil {
+			t.logger.ErrorContext(req.Context(), "Failed to refresh IAP token",
+				slog.String("client_id", t.clientID),
+				slog.Any("error", err),
+			)
+		} else if r, ok := rewind(req); ok {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp, _, err = t.send(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if iapRejected(resp) {
+		t.logger.WarnContext(req.Context(), "Identity-Aware Proxy rejected the request; check that the caller has roles/iap.httpsResourceAccessor and that the IAP client ID is the one of the backend service",
+			slog.String("url", req.URL.String()),
+			slog.String("client_id", t.clientID),
+			slog.Int("status", resp.StatusCode),
+		)
+	}
+	if iapSignIn(resp) {
+		resp = signInAsUnauthorized(resp)
+	}
+	return resp, nil
+}
+
+// send sends req with the IAP token, if there is a separate one, and
+// returns the token it used.
+func (t *iapTransport) send(req *http.Request) (*http.Response, *oauth2.Token, error) {
+	if t.source == nil {
+		resp, err := t.next.RoundTrip(req)
+		return resp, nil, err
+	}
+	tok, err := t.source.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(ProxyAuthorizationHeader, tok.Type()+" "+tok.AccessToken)
+	resp, err := t.next.RoundTrip(r)
+	return resp, tok, err
+}
+
+// rewind returns a copy of req with a fresh body, for sending it again.
+func rewind(req *http.Request) (*http.Request, bool) {
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		r.Body = body
+	}
+	return r, true
+}
+
+// iapRejected reports whether resp is IAP turning the request away, with a
+// 401 or a sign-in redirect, rather than an answer from the backend.
+func iapRejected(resp *http.Response) bool {
+	generated := resp.Header.Get(iapGeneratedHeader) == "true"
+	return (generated && resp.StatusCode == http.StatusUnauthorized) || iapSignIn(resp)
+}
+
+// iapSignIn reports whether resp redirects to the Google sign-in page.
+func iapSignIn(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+	default:
+		return false
+	}
+	if resp.Header.Get(iapGeneratedHeader) == "true" {
+		return true
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	return err == nil && loc.Host == "accounts.google.com"
+}
+
+// signInAsUnauthorized replaces a sign-in redirect with the 401 a
+// programmatic caller expects, keeping its headers, including Location.
+func signInAsUnauthorized(resp *http.Response) *http.Response {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	body := []byte("Identity-Aware Proxy redirected the request to sign-in: the ID token is missing or was not accepted\n")
+	header := resp.Header.Clone()
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	out := *resp
+	out.StatusCode = http.StatusUnauthorized
+	out.Status = strconv.Itoa(http.StatusUnauthorized) + " " + http.StatusText(http.StatusUnauthorized)
+	out.Header = header
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	out.Uncompressed = false
+	return &out
+}
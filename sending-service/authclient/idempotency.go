@@ -0,0 +1,52 @@
+package authclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// IdempotencyKeyHeader carries the key that lets a receiving service
+// recognize repeated attempts of the same request.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// WithIdempotencyKeys attaches a random Idempotency-Key header to POST,
+// PUT, PATCH and DELETE requests that don't carry one already. The key is
+// chosen once per request, so retries and hedged attempts send the same
+// key and a receiving service that deduplicates by key, such as one using
+// the receiver's idempotency middleware, applies the request only once.
+// This makes it safe to retry mutating requests with WithRetry.
+func WithIdempotencyKeys() Option {
+	return func(o *options) {
+		o.idempotencyKeys = true
+	}
+}
+
+type idempotencyTransport struct {
+	next http.RoundTripper
+}
+
+func (t *idempotencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !mutating(req.Method) || req.Header.Get(IdempotencyKeyHeader) != "" {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(IdempotencyKeyHeader, newIdempotencyKey())
+	return t.next.RoundTrip(r)
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,77 @@
+package authclient
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Headers that describe the calling service to downstream services, set
+// by WithClientVersion and WithClientLabels.
+const (
+	ClientVersionHeader = "X-Client-Version"
+	ClientLabelsHeader  = "X-Client-Labels"
+)
+
+// WithUserAgent identifies the calling service in the User-Agent header of
+// every request, such as "orders-service/1.4.2". A User-Agent the request
+// already carries, for example one forwarded from an inbound request, is
+// kept after it.
+func WithUserAgent(ua string) Option {
+	return func(o *options) {
+		o.userAgent = ua
+	}
+}
+
+// WithClientVersion sends version, such as a release or Cloud Run
+// revision, in the X-Client-Version header of every request.
+func WithClientVersion(version string) Option {
+	return func(o *options) {
+		o.clientVersion = version
+	}
+}
+
+// WithClientLabels sends labels describing the calling service's
+// environment, such as env=prod or region=europe-west1, in the
+// X-Client-Labels header of every request, as a comma-separated list of
+// key=value pairs in key order.
+func WithClientLabels(labels map[string]string) Option {
+	return func(o *options) {
+		o.clientLabels = formatLabels(labels)
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// identityTransport sets the headers describing the calling service.
+type identityTransport struct {
+	next      http.RoundTripper
+	userAgent string
+	version   string
+	labels    string
+}
+
+func (t *identityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	if t.userAgent != "" {
+		ua := t.userAgent
+		if existing := r.Header.Get("User-Agent"); existing != "" {
+			ua += " " + existing
+		}
+		r.Header.Set("User-Agent", ua)
+	}
+	if t.version != "" {
+		r.Header.Set(ClientVersionHeader, t.version)
+	}
+	if t.labels != "" {
+		r.Header.Set(ClientLabelsHeader, t.labels)
+	}
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,131 @@
+package authclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// maxErrorBody is the number of bytes of a non-2xx response body kept in a
+// DownstreamStatusError.
+const maxErrorBody = 64 << 10
+
+// DownstreamStatusError is returned when the receiving service answers
+// with a non-2xx status code.
+type DownstreamStatusError struct {
+	Code   int
+	Status string
+	Header http.Header
+	// Body holds up to the first 64 KiB of the response body.
+	Body []byte
+}
+
+func (e *DownstreamStatusError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("authclient: downstream returned %s", e.Status)
+	}
+	return fmt.Sprintf("authclient: downstream returned %s: %s", e.Status, bytes.TrimSpace(e.Body))
+}
+
+// WithBaseURL sets the URL that relative paths passed to DoJSON are
+// resolved against. It defaults to the audience.
+func WithBaseURL(u string) Option {
+	return func(o *options) {
+		o.baseURL = u
+	}
+}
+
+// DoJSON sends an authenticated request to path, which is resolved against
+// the client's base URL unless it is absolute. A non-nil in is encoded as
+// the JSON request body. On a 2xx response the JSON body is decoded into
+// out unless out is nil, and a body that cannot be decoded into it is
+// returned as a *BadResponseError; any other status is returned as a
+// *DownstreamStatusError.
+func (c *Client) DoJSON(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("authclient: encoding request body: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := c.NewRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := CheckResponse(resp); err != nil {
+		return err
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("authclient: reading response body: %w", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		if len(data) > maxBadResponseBody {
+			data = data[:maxBadResponseBody]
+		}
+		return &BadResponseError{Code: resp.StatusCode, ContentType: resp.Header.Get("Content-Type"), Reason: "failed to decode JSON body", Body: data, Err: err}
+	}
+	return nil
+}
+
+// NewRequest returns a request for path, which is resolved against the
+// client's base URL unless it is absolute, as DoJSON does, for calls whose
+// bodies are not JSON.
+func (c *Client) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	target, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequestWithContext(ctx, method, target, body)
+}
+
+// CheckResponse returns a *DownstreamStatusError for a response with a
+// status other than 2xx, after reading up to 64 KiB of its body, and nil
+// otherwise. It does not close the body.
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &DownstreamStatusError{
+		Code:   resp.StatusCode,
+		Status: resp.Status,
+		Header: resp.Header,
+		Body:   data,
+	}
+}
+
+func (c *Client) resolve(path string) (string, error) {
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return "", fmt.Errorf("authclient: invalid base URL: %w", err)
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", fmt.Errorf("authclient: invalid path: %w", err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
@@ -0,0 +1,256 @@
+package authclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryBudget caps the retries a client makes relative to its traffic, so
+// that a receiving service that is failing a large share of requests isn't
+// sent several times the load by the retry layer. Within each Window, at
+// most MinRetries plus Ratio times the number of requests may be retried;
+// further failures are returned to the caller without retrying.
+type RetryBudget struct {
+	// Ratio is the fraction of requests that may be retried, between 0
+	// and 1.
+	Ratio float64
+	// MinRetries are allowed in every window however few requests it
+	// has, so that a quiet client can still retry.
+	MinRetries int
+	// Window is the length of the interval over which requests and
+	// retries are counted.
+	Window time.Duration
+}
+
+// DefaultRetryBudget returns a budget that allows retrying a fifth of the
+// requests of a ten-second window, plus ten retries.
+func DefaultRetryBudget() RetryBudget {
+	return RetryBudget{Ratio: 0.2, MinRetries: 10, Window: 10 * time.Second}
+}
+
+// WithRetryBudget limits the retries of WithRetry to the budget b. It has
+// no effect without retries. A request that failed without a response and
+// is not retried because the budget is spent fails with a
+// *RetryBudgetError, and a 429 or 503 answer that is not retried gets a
+// Retry-After header for the end of the window if it has none.
+func WithRetryBudget(b RetryBudget) Option {
+	return func(o *options) {
+		o.retryBudget = &b
+	}
+}
+
+// ConcurrencyLimit caps the requests a client has in flight to its
+// receiving service.
+type ConcurrencyLimit struct {
+	// MaxInFlight is the number of attempts, including retries and hedged
+	// requests, that may be in flight at once.
+	MaxInFlight int
+	// MaxWait is how long an attempt waits for one of the others to finish
+	// once MaxInFlight are in flight. Zero fails it immediately.
+	MaxWait time.Duration
+}
+
+// WithConcurrencyLimit limits the attempts in flight to the client's
+// audience to l.MaxInFlight. Attempts beyond the limit wait up to
+// l.MaxWait for a slot, and then fail with a *ConcurrencyLimitError. Each
+// client has its own limit, so clients of a Cache are limited per target.
+func WithConcurrencyLimit(l ConcurrencyLimit) Option {
+	return func(o *options) {
+		o.concurrency = &l
+	}
+}
+
+// LimitObserver is notified of retry budget and concurrency limit activity,
+// for example to export metrics.
+type LimitObserver interface {
+	// RetryBudget is called with the number of retries left in the current
+	// window whenever it changes.
+	RetryBudget(audience string, available float64)
+	// RetryDenied is called when a failed request is not retried because
+	// the budget is spent.
+	RetryDenied(audience string)
+	// InFlight is called with the number of attempts in flight whenever it
+	// changes.
+	InFlight(audience string, n int)
+	// ConcurrencyLimited is called when an attempt is rejected because too
+	// many are in flight.
+	ConcurrencyLimited(audience string)
+}
+
+// WithLimitObserver registers an observer for retry budget and concurrency
+// limit events.
+func WithLimitObserver(obs LimitObserver) Option {
+	return func(o *options) {
+		o.limitObserver = obs
+	}
+}
+
+type nopLimitObserver struct{}
+
+func (nopLimitObserver) RetryBudget(string, float64) {}
+func (nopLimitObserver) RetryDenied(string)          {}
+func (nopLimitObserver) InFlight(string, int)        {}
+func (nopLimitObserver) ConcurrencyLimited(string)   {}
+
+// ErrConcurrencyLimit is matched by errors.Is for requests rejected because
+// too many were in flight to the receiving service.
+var ErrConcurrencyLimit = errors.New("authclient: concurrency limit reached")
+
+// ConcurrencyLimitError is returned for requests rejected by a client's
+// concurrency limit.
+type ConcurrencyLimitError struct {
+	Audience    string
+	MaxInFlight int
+}
+
+func (e *ConcurrencyLimitError) Error() string {
+	return fmt.Sprintf("authclient: %d requests already in flight to %s", e.MaxInFlight, e.Audience)
+}
+
+// Is reports whether target is ErrConcurrencyLimit.
+func (e *ConcurrencyLimitError) Is(target error) bool {
+	return target == ErrConcurrencyLimit
+}
+
+// retryBudget counts the requests and retries of the current window.
+type retryBudget struct {
+	audience string
+	budget   RetryBudget
+	observer LimitObserver
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(audience string, b RetryBudget, obs LimitObserver) *retryBudget {
+	rb := &retryBudget{audience: audience, budget: b, observer: obs, windowStart: time.Now()}
+	obs.RetryBudget(audience, float64(b.MinRetries))
+	return rb
+}
+
+// request records a request sent for the first time.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	b.roll()
+	b.requests++
+	available := b.available()
+	b.mu.Unlock()
+	b.observer.RetryBudget(b.audience, available)
+}
+
+// withdraw reports whether a retry may be made, and records it if so.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	b.roll()
+	ok := b.available() >= 1
+	if ok {
+		b.retries++
+	}
+	available := b.available()
+	b.mu.Unlock()
+
+	if !ok {
+		b.observer.RetryDenied(b.audience)
+		return false
+	}
+	b.observer.RetryBudget(b.audience, available)
+	return true
+}
+
+// retryAfter returns how long until the current window ends.
+func (b *retryBudget) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Until(b.windowStart.Add(b.budget.Window))
+}
+
+func (b *retryBudget) roll() {
+	if now := time.Now(); now.Sub(b.windowStart) > b.budget.Window {
+		b.windowStart = now
+		b.requests, b.retries = 0, 0
+	}
+}
+
+func (b *retryBudget) available() float64 {
+	n := float64(b.budget.MinRetries) + b.budget.Ratio*float64(b.requests) - float64(b.retries)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+type limitTransport struct {
+	next     http.RoundTripper
+	audience string
+	limit    ConcurrencyLimit
+	observer LimitObserver
+	slots    chan struct{}
+}
+
+func newLimitTransport(next http.RoundTripper, audience string, l ConcurrencyLimit, obs LimitObserver) *limitTransport {
+	return &limitTransport{next: next, audience: audience, limit: l, observer: obs, slots: make(chan struct{}, l.MaxInFlight)}
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.acquire(req); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols || IsStreaming(req.Context()) {
+		t.release()
+		return resp, err
+	}
+	// The slot is held until the body is closed, since the request is in
+	// flight for the receiving service until then. Upgraded connections
+	// and streamed responses only hold it until the response arrives, so
+	// long-lived streams don't use up the limit.
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: t.release}
+	return resp, nil
+}
+
+func (t *limitTransport) acquire(req *http.Request) error {
+	select {
+	case t.slots <- struct{}{}:
+		t.observer.InFlight(t.audience, len(t.slots))
+		return nil
+	default:
+	}
+	if t.limit.MaxWait > 0 {
+		timer := time.NewTimer(t.limit.MaxWait)
+		defer timer.Stop()
+		select {
+		case t.slots <- struct{}{}:
+			t.observer.InFlight(t.audience, len(t.slots))
+			return nil
+		case <-req.Context().Done():
+			return req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	t.observer.ConcurrencyLimited(t.audience)
+	return &ConcurrencyLimitError{Audience: t.audience, MaxInFlight: t.limit.MaxInFlight}
+}
+
+func (t *limitTransport) release() {
+	<-t.slots
+	t.observer.InFlight(t.audience, len(t.slots))
+}
+
+// releaseBody releases a concurrency slot once, when it is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,85 @@
+package authclient
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Middleware wraps a RoundTripper, for example to log or measure the
+// requests a client sends or to modify them on the way out.
+type Middleware func(http.RoundTripper) http.RoundTripper
+
+// Chain composes mws into a single Middleware. They apply in order: the
+// first sees each request first and its response last.
+func Chain(mws ...Middleware) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// WithMiddleware wraps every call made with the client in mws, in order,
+// outside all the layers configured with other options. Each middleware
+// sees a call once, as the caller made it and before the ID token is
+// attached, however many attempts it takes, and sees cached responses
+// too. It may be given more than once to add more middleware.
+//
+// Built-in behavior can be placed in the chain explicitly with
+// RetryMiddleware, HeaderMiddleware and CacheMiddleware instead of the
+// corresponding options, for example to run a custom middleware between
+// the cache and the retries.
+func WithMiddleware(mws ...Middleware) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, mws...)
+	}
+}
+
+// WithAttemptMiddleware wraps each attempt in mws, in order, just before
+// it is sent with the base transport. Each middleware sees every retry and
+// hedged request separately, with the ID token and the headers of
+// WithHeaderFunc attached and within the attempt timeout, which makes it
+// the place for per-request logging, metrics and tracing. It may be given
+// more than once to add more middleware.
+func WithAttemptMiddleware(mws ...Middleware) Option {
+	return func(o *options) {
+		o.attemptMiddleware = append(o.attemptMiddleware, mws...)
+	}
+}
+
+// RetryMiddleware returns the retry layer configured by WithRetry, for use
+// with WithMiddleware. Retries are logged with logger, or slog.Default()
+// if it is nil.
+func RetryMiddleware(p RetryPolicy, logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		if p.MaxAttempts <= 1 {
+			return next
+		}
+		return &retryTransport{next: next, policy: p, logger: logger}
+	}
+}
+
+// HeaderMiddleware returns the layer configured by WithHeaderFunc, for use
+// with WithMiddleware.
+func HeaderMiddleware(f func() http.Header) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &headerTransport{next: next, headers: f}
+	}
+}
+
+// CacheMiddleware returns the response cache configured by
+// WithResponseCache, for use with WithMiddleware. Cache failures are
+// logged with logger, or slog.Default() if it is nil.
+func CacheMiddleware(store ResponseStore, defaultTTL time.Duration, logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &cacheTransport{next: next, store: store, defaultTTL: defaultTTL, logger: logger}
+	}
+}
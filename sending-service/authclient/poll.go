@@ -0,0 +1,86 @@
+package authclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxPollDrain bounds the bytes read from the body of a 202 Accepted
+// response before it is closed, so that its connection can be reused.
+const maxPollDrain = 4 << 10
+
+// PollAccepted treats a 202 Accepted response carrying a Location header
+// as work the service goes on doing after answering: the Location, a
+// status endpoint of the same service, is fetched every interval, or after
+// the Retry-After of the last answer, until it answers with something
+// other than 202, and that answer is the call's response. Each poll is a
+// request of its own, sent with a fresh ID token and retried like any
+// other, so no connection has to stay open while the service works. The
+// call's timeout bounds the polling as a whole.
+func PollAccepted(interval time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.poll = interval
+	}
+}
+
+// pollTransport polls the status endpoint of calls whose call options ask
+// for it and that are answered with 202 Accepted. It runs inside the call
+// timeout, so that the timeout bounds the polling, and outside retries and
+// authentication, so that every poll is retried and authenticated itself.
+type pollTransport struct {
+	next http.RoundTripper
+}
+
+func (t *pollTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := callOptionsFrom(req.Context())
+	if o == nil || o.poll <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	resp, err := t.next.RoundTrip(req)
+	for err == nil && resp.StatusCode == http.StatusAccepted {
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return resp, nil
+		}
+		status, perr := req.URL.Parse(location)
+		if perr != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("authclient: invalid Location %q of accepted call: %w", location, perr)
+		}
+		if status.Host != req.URL.Host {
+			// The ID token is only meant for the service called.
+			resp.Body.Close()
+			return nil, fmt.Errorf("authclient: status endpoint %s of accepted call is not on %s", status.Redacted(), req.URL.Host)
+		}
+		wait := o.poll
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok && after > 0 {
+			wait = after
+		}
+		io.CopyN(io.Discard, resp.Body, maxPollDrain)
+		resp.Body.Close()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		poll, perr := http.NewRequestWithContext(req.Context(), http.MethodGet, status.String(), nil)
+		if perr != nil {
+			return nil, perr
+		}
+		for k, vs := range req.Header {
+			switch http.CanonicalHeaderKey(k) {
+			case "Content-Type", "Content-Length", "Content-Encoding", IdempotencyKeyHeader:
+			default:
+				poll.Header[k] = vs
+			}
+		}
+		poll.Host = req.Host
+		resp, err = t.next.RoundTrip(poll)
+	}
+	return resp, err
+}
@@ -0,0 +1,114 @@
+package authclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// TokenProvider mints ID tokens. It is the interface to implement to
+// obtain tokens from elsewhere than Google, such as a Vault secrets engine
+// or an internal token service. The client caches each token until shortly
+// before its expiry, so implementations need not cache themselves.
+type TokenProvider interface {
+	// Token returns a new ID token for audience and the time it expires. A
+	// zero expiry means the token never expires.
+	Token(ctx context.Context, audience string) (token string, expiry time.Time, err error)
+}
+
+// TokenProviderFunc adapts a function to the TokenProvider interface.
+type TokenProviderFunc func(ctx context.Context, audience string) (string, time.Time, error)
+
+// Token calls f.
+func (f TokenProviderFunc) Token(ctx context.Context, audience string) (string, time.Time, error) {
+	return f(ctx, audience)
+}
+
+// WithTokenProvider replaces the default ID token source, which uses
+// Application Default Credentials or the metadata server, with p. It takes
+// the place of WithTokenSourceFunc, and the last of the two given wins.
+func WithTokenProvider(p TokenProvider) Option {
+	return WithTokenSourceFunc(ProviderTokenSource(p))
+}
+
+// ProviderTokenSource returns a TokenSourceFunc that obtains tokens from p
+// and caches them until they expire. The tokens are minted with the
+// context the client was created with.
+func ProviderTokenSource(p TokenProvider) TokenSourceFunc {
+	return func(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+		return oauth2.ReuseTokenSource(nil, &providerSource{ctx: ctx, provider: p, audience: audience}), nil
+	}
+}
+
+type providerSource struct {
+	ctx      context.Context
+	provider TokenProvider
+	audience string
+}
+
+func (s *providerSource) Token() (*oauth2.Token, error) {
+	token, expiry, err := s.provider.Token(s.ctx, s.audience)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// SourceProvider returns a TokenProvider that mints tokens with f, keeping
+// one token source per audience, so that the built-in token sources can be
+// used wherever a TokenProvider is expected.
+func SourceProvider(f TokenSourceFunc) TokenProvider {
+	return &sourceProvider{mint: f, sources: make(map[string]oauth2.TokenSource)}
+}
+
+type sourceProvider struct {
+	mint TokenSourceFunc
+
+	mu      sync.Mutex
+	sources map[string]oauth2.TokenSource
+}
+
+func (p *sourceProvider) Token(ctx context.Context, audience string) (string, time.Time, error) {
+	p.mu.Lock()
+	ts, ok := p.sources[audience]
+	if !ok {
+		var err error
+		ts, err = p.mint(ctx, audience)
+		if err != nil {
+			p.mu.Unlock()
+			return "", time.Time{}, err
+		}
+		p.sources[audience] = ts
+	}
+	p.mu.Unlock()
+
+	tok, err := ts.Token()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tok.AccessToken, tok.Expiry, nil
+}
+
+// DefaultTokenProvider returns a TokenProvider that mints tokens with
+// Application Default Credentials, or the metadata server on Google Cloud,
+// as clients do when no token source is configured.
+func DefaultTokenProvider(opts ...option.ClientOption) TokenProvider {
+	return SourceProvider(defaultTokenSourceFunc(opts))
+}
+
+// ImpersonatedTokenProvider returns a TokenProvider that mints tokens for
+// targetPrincipal, as ImpersonatedTokenSource does.
+func ImpersonatedTokenProvider(targetPrincipal string, opts ...option.ClientOption) TokenProvider {
+	return SourceProvider(ImpersonatedTokenSource(targetPrincipal, opts...))
+}
+
+// StaticTokenProvider returns a TokenProvider that hands out token for
+// every audience, as StaticTokenSource does.
+func StaticTokenProvider(token string) TokenProvider {
+	return TokenProviderFunc(func(context.Context, string) (string, time.Time, error) {
+		return token, tokenExpiry(token), nil
+	})
+}
@@ -0,0 +1,46 @@
+package authclient
+
+import (
+	"net/http"
+
+	"google.golang.org/api/option"
+)
+
+// QuotaProjectHeader is the header that attributes a call to Google APIs,
+// or to a receiving service that checks it, to a quota and billing
+// project.
+const QuotaProjectHeader = "X-Goog-User-Project"
+
+// QuotaProject attributes the quota and billing of Google API calls made
+// with a client to project. It is an option.ClientOption for the token
+// sources and API clients that take them, such as ImpersonatedTokenSource.
+func QuotaProject(project string) option.ClientOption {
+	return option.WithQuotaProject(project)
+}
+
+// WithQuotaProject attributes the client's calls to project: every request
+// carries project in the X-Goog-User-Project header, unless it already
+// sets one, and the default token source mints tokens with project as its
+// quota project. Token sources given with WithTokenSourceFunc or
+// WithTokenProvider are not affected; pass QuotaProject(project) to them
+// instead. The caller's credentials need serviceusage.services.use on
+// project, which roles/serviceusage.serviceUsageConsumer grants.
+func WithQuotaProject(project string) Option {
+	return func(o *options) {
+		o.quotaProject = project
+	}
+}
+
+type quotaTransport struct {
+	next    http.RoundTripper
+	project string
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(QuotaProjectHeader) != "" {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(QuotaProjectHeader, t.project)
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,107 @@
+package authclient
+
+import (
+	"log/slog"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// minRefreshRetry and maxRefreshRetry bound the delay before retrying
+	// a failed background refresh.
+	minRefreshRetry = time.Second
+	maxRefreshRetry = 30 * time.Second
+	// minRefreshInterval keeps a source whose tokens live shorter than the
+	// skew from being renewed in a tight loop.
+	minRefreshInterval = 30 * time.Second
+)
+
+// WithBackgroundRefresh starts a goroutine per client that mints a new ID
+// token skew before the current one expires, so requests never wait for the
+// metadata server once the first token is cached. The goroutine stops when
+// the context passed to New is done. Tokens without an expiry, such as
+// static development tokens, are never refreshed.
+func WithBackgroundRefresh(skew time.Duration) Option {
+	return func(o *options) {
+		o.refreshSkew = skew
+	}
+}
+
+// renew mints a token from a new underlying source and swaps the source in
+// once it has produced the token, so concurrent callers keep using the
+// current token until then.
+func (s *tokenSource) renew() (*oauth2.Token, error) {
+	start := time.Now()
+	ts, err := s.mint(s.ctx, s.audience)
+	if err != nil {
+		s.tokenError(err)
+		return nil, err
+	}
+	tok, err := ts.Token()
+	if err != nil {
+		s.tokenError(err)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.ts = ts
+	s.last = tok.AccessToken
+	s.cachedTok = tok
+	s.minted, s.expiry = time.Now(), tok.Expiry
+	s.mu.Unlock()
+	s.notifyMinted(tok, time.Since(start))
+	return tok, nil
+}
+
+// refreshLoop keeps the cached token at least skew away from expiry until
+// s.ctx is done or the source is flushed from a Cache.
+func (s *tokenSource) refreshLoop(skew time.Duration, logger *slog.Logger) {
+	tok, err := s.Token()
+	retry := minRefreshRetry
+	for {
+		var wait time.Duration
+		if err != nil {
+			logger.Warn("Failed to refresh ID token in the background",
+				slog.String("audience", s.audience),
+				slog.Any("error", err),
+			)
+			wait = retry
+			retry = min(retry*2, maxRefreshRetry)
+		} else {
+			if tok.Expiry.IsZero() {
+				return
+			}
+			wait = max(time.Until(tok.Expiry.Add(-skew)), minRefreshInterval)
+			retry = minRefreshRetry
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err != nil {
+			// The cached token may still be valid; only renew once it is
+			// actually close to expiry.
+			tok, err = s.Token()
+			if err != nil || time.Until(tok.Expiry) > skew {
+				continue
+			}
+		}
+		tok, err = s.renew()
+		s.markStale(err != nil)
+		if err == nil {
+			logger.Debug("Refreshed ID token ahead of expiry",
+				slog.String("audience", s.audience),
+				slog.Time("expiry", tok.Expiry),
+			)
+		}
+	}
+}
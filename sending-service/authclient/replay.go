@@ -0,0 +1,63 @@
+package authclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ErrReplayLimit is matched by errors.Is for requests refused because their
+// body is larger than the limit of WithBodyBuffering, and so could not be
+// sent again on a retry.
+var ErrReplayLimit = errors.New("authclient: request body exceeds the replay limit")
+
+// WithBodyBuffering reads the bodies of requests that cannot be replayed,
+// such as those of inbound requests forwarded by a reverse proxy, into
+// memory before they are sent, so that retries, hedged requests and the
+// resend after a rejected token can send them again. http.NewRequest
+// already makes bytes, string and bytes.Buffer bodies replayable, and
+// those are left alone, as are the requests of calls sent with NoRetry.
+//
+// Bodies of more than limit bytes are refused with an error matching
+// ErrReplayLimit, before anything is sent, rather than sent once and
+// silently not retried.
+func WithBodyBuffering(limit int64) Option {
+	return func(o *options) {
+		o.replayLimit = limit
+	}
+}
+
+type replayTransport struct {
+	next  http.RoundTripper
+	limit int64
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if replayable(req) || noRetry(req) || isUpgrade(req) || uploadFrom(req) != nil {
+		return t.next.RoundTrip(req)
+	}
+	if req.ContentLength > t.limit {
+		req.Body.Close()
+		return nil, fmt.Errorf("%w: %d bytes to %s, limit %d", ErrReplayLimit, req.ContentLength, req.URL.Redacted(), t.limit)
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, t.limit+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > t.limit {
+		return nil, fmt.Errorf("%w: more than %d bytes to %s", ErrReplayLimit, t.limit, req.URL.Redacted())
+	}
+	r := req.Clone(req.Context())
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,232 @@
+package authclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedBody is the largest response body stored in a response cache.
+const maxCachedBody = 1 << 20
+
+// cacheKeyHeaders are the request headers that distinguish cached
+// responses for the same URL.
+var cacheKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// ResponseStore stores serialized responses for WithResponseCache.
+// Implementations must be safe for concurrent use.
+type ResponseStore interface {
+	// Get returns the value stored under key, if it has not expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key for ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// ResponsePurger is implemented by ResponseStores whose cached responses
+// can be discarded all at once, such as after a downstream deployment
+// changed what they would be. Purging a store shared by several instances
+// purges it for all of them.
+type ResponsePurger interface {
+	Purge(ctx context.Context) error
+}
+
+// WithResponseCache caches successful responses to GET requests in store,
+// so repeated identical calls skip minting a token and the network round
+// trip. Responses are cached for their Cache-Control max-age, or for
+// defaultTTL if they don't set one; responses marked no-store or no-cache
+// are not cached, and requests with Cache-Control: no-cache bypass the
+// cache. Cached responses carry an X-Cache: HIT header.
+func WithResponseCache(store ResponseStore, defaultTTL time.Duration) Option {
+	return func(o *options) {
+		o.cacheStore = store
+		o.cacheTTL = defaultTTL
+	}
+}
+
+type cacheTransport struct {
+	next       http.RoundTripper
+	store      ResponseStore
+	defaultTTL time.Duration
+	logger     *slog.Logger
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || IsStreaming(req.Context()) || isUpgrade(req) || hasDirective(req.Header, "no-cache") || hasDirective(req.Header, "no-store") || req.Header.Get(ForwardedAuthorizationHeader) != "" || hasCallHeaders(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	key := cacheKey(req)
+	if data, ok, err := t.store.Get(ctx, key); err != nil {
+		t.logger.WarnContext(ctx, "Failed to read response cache", slog.Any("error", err))
+	} else if ok {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+		if err == nil {
+			resp.Header.Set("X-Cache", "HIT")
+			return resp, nil
+		}
+		t.logger.WarnContext(ctx, "Failed to decode cached response", slog.Any("error", err))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || isEventStream(resp) {
+		return resp, err
+	}
+	ttl := t.ttl(resp.Header)
+	if ttl <= 0 || (resp.ContentLength > maxCachedBody) {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > maxCachedBody {
+		// Too large to cache: hand back what was read followed by the rest.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+
+	stored := *resp
+	stored.Body = io.NopCloser(bytes.NewReader(body))
+	stored.TransferEncoding = nil
+	if data, err := httputil.DumpResponse(&stored, true); err == nil {
+		if err := t.store.Set(ctx, key, data, ttl); err != nil {
+			t.logger.WarnContext(ctx, "Failed to write response cache", slog.Any("error", err))
+		}
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	return resp, nil
+}
+
+// ttl returns how long a response may be cached, or 0 if it may not.
+func (t *cacheTransport) ttl(h http.Header) time.Duration {
+	if hasDirective(h, "no-store") || hasDirective(h, "no-cache") || h.Get("Set-Cookie") != "" || h.Get("Vary") == "*" {
+		return 0
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v, ok := directive(h, name); ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0
+			}
+			age, _ := strconv.Atoi(h.Get("Age"))
+			return time.Duration(secs-age) * time.Second
+		}
+	}
+	return t.defaultTTL
+}
+
+func cacheKey(req *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, req.URL.String())
+	for _, name := range cacheKeyHeaders {
+		io.WriteString(h, "\n"+name+": "+req.Header.Get(name))
+	}
+	return "authclient:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func hasDirective(h http.Header, name string) bool {
+	_, ok := directive(h, name)
+	return ok
+}
+
+func directive(h http.Header, name string) (string, bool) {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(k, name) {
+			return strings.Trim(v, `"`), true
+		}
+	}
+	return "", false
+}
+
+// MemoryStore is an in-memory ResponseStore holding at most a fixed number
+// of entries.
+type MemoryStore struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryStore creates a MemoryStore holding at most maxEntries
+// responses.
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{max: maxEntries, entries: make(map[string]memoryEntry)}
+}
+
+// Get implements ResponseStore.
+func (s *MemoryStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(e.expires) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	return e.value, true, nil
+}
+
+// Set implements ResponseStore. When the store is full, expired entries
+// are dropped, and if that isn't enough the entry closest to expiry is.
+func (s *MemoryStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= s.max {
+		s.evict()
+	}
+	s.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// Purge implements ResponsePurger.
+func (s *MemoryStore) Purge(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make(map[string]memoryEntry)
+	return nil
+}
+
+func (s *MemoryStore) evict() {
+	now := time.Now()
+	var oldest string
+	var oldestExpiry time.Time
+	for k, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, k)
+			continue
+		}
+		if oldest == "" || e.expires.Before(oldestExpiry) {
+			oldest, oldestExpiry = k, e.expires
+		}
+	}
+	if len(s.entries) >= s.max && oldest != "" {
+		delete(s.entries, oldest)
+	}
+}
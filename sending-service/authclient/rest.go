@@ -0,0 +1,99 @@
+package authclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The REST helpers below send a call to path, resolved against the
+// client's base URL as with DoJSON, with opts applied as with Call. Use
+// QueryParam or Query for query parameters and CallHeader for headers.
+// Statuses other than 2xx are returned as a *DownstreamStatusError.
+
+// GetJSON sends a GET and decodes the JSON response into out.
+func (c *Client) GetJSON(ctx context.Context, path string, out interface{}, opts ...CallOption) error {
+	return c.DoJSON(CallContext(ctx, opts...), http.MethodGet, path, nil, out)
+}
+
+// PostJSON sends a POST with in as the JSON body and decodes the JSON
+// response into out, unless out is nil.
+func (c *Client) PostJSON(ctx context.Context, path string, in, out interface{}, opts ...CallOption) error {
+	return c.DoJSON(CallContext(ctx, opts...), http.MethodPost, path, in, out)
+}
+
+// PutJSON sends a PUT with in as the JSON body and decodes the JSON
+// response into out, unless out is nil.
+func (c *Client) PutJSON(ctx context.Context, path string, in, out interface{}, opts ...CallOption) error {
+	return c.DoJSON(CallContext(ctx, opts...), http.MethodPut, path, in, out)
+}
+
+// PatchJSON sends a PATCH with in as the JSON body, such as a JSON merge
+// patch, and decodes the JSON response into out, unless out is nil. Set
+// the Content-Type with CallHeader for other patch formats, such as
+// application/merge-patch+json.
+func (c *Client) PatchJSON(ctx context.Context, path string, in, out interface{}, opts ...CallOption) error {
+	return c.DoJSON(CallContext(ctx, opts...), http.MethodPatch, path, in, out)
+}
+
+// Delete sends a DELETE and decodes the JSON response into out, unless out
+// is nil or the response is 204 No Content.
+func (c *Client) Delete(ctx context.Context, path string, out interface{}, opts ...CallOption) error {
+	return c.DoJSON(CallContext(ctx, opts...), http.MethodDelete, path, nil, out)
+}
+
+// Head sends a HEAD and returns the response headers, for example to read
+// an ETag or Content-Length without fetching the body.
+func (c *Client) Head(ctx context.Context, path string, opts ...CallOption) (http.Header, error) {
+	resp, err := c.Send(ctx, http.MethodHead, path, "", nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+// AllowedMethods sends an OPTIONS and returns the methods listed in the
+// response's Allow header.
+func (c *Client) AllowedMethods(ctx context.Context, path string, opts ...CallOption) ([]string, error) {
+	resp, err := c.Send(ctx, http.MethodOptions, path, "", nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	var methods []string
+	for _, v := range resp.Header.Values("Allow") {
+		for _, m := range strings.Split(v, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				methods = append(methods, m)
+			}
+		}
+	}
+	return methods, nil
+}
+
+// Send sends a call with method and, unless body is nil, the body with the
+// given Content-Type, for bodies that are not JSON, such as form or file
+// uploads. It returns the response of a 2xx status, whose body the caller
+// must close, and otherwise closes the body and returns a
+// *DownstreamStatusError.
+func (c *Client) Send(ctx context.Context, method, path, contentType string, body io.Reader, opts ...CallOption) (*http.Response, error) {
+	req, err := c.NewRequest(CallContext(ctx, opts...), method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil && contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
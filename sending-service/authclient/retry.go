@@ -0,0 +1,204 @@
+package authclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed requests are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts, including delays
+	// requested by a Retry-After header.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the delay grows by after each attempt.
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction of its value.
+	Jitter float64
+	// RetryOn lists the response status codes that are retried. Network
+	// errors are always retried.
+	RetryOn []int
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured:
+// three attempts with exponential backoff on 429 and 5xx gateway errors.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		RetryOn: []int{
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// WithRetry retries failed requests according to the policy. Requests with
+// a body are only retried when their GetBody field is set, which
+// http.NewRequest does for in-memory bodies and WithBodyBuffering does for
+// the others.
+func WithRetry(p RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = &p
+	}
+}
+
+// RetryObserver is notified of each retry of a downstream request, for
+// example to export metrics.
+type RetryObserver interface {
+	// Retrying is called before attempt+1 of a request to audience is
+	// sent. status is the status code of the failed attempt, or 0 if it
+	// failed without a response.
+	Retrying(audience string, attempt, status int)
+}
+
+// WithRetryObserver registers an observer for retries. It may be given
+// more than once; each observer is notified.
+func WithRetryObserver(obs RetryObserver) Option {
+	return func(o *options) {
+		o.retryObservers = append(o.retryObservers, obs)
+	}
+}
+
+type retryTransport struct {
+	next      http.RoundTripper
+	policy    RetryPolicy
+	logger    *slog.Logger
+	budget    *retryBudget
+	audience  string
+	observers []RetryObserver
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.budget != nil {
+		t.budget.request()
+	}
+	r := req
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(r)
+		if attempt >= t.policy.MaxAttempts || noRetry(req) || !t.retryable(req, resp, err) {
+			return resp, err
+		}
+		if t.budget != nil && !t.budget.withdraw() {
+			t.logger.WarnContext(req.Context(), "Retry budget exhausted, not retrying downstream request",
+				slog.String("url", req.URL.String()),
+				slog.Int("attempt", attempt),
+			)
+			// Tell the caller when retrying may help again, unless the
+			// receiving service already did.
+			after := t.budget.retryAfter()
+			if err != nil {
+				return nil, &RetryBudgetError{Audience: t.audience, RetryAfter: after, Err: err}
+			}
+			if _, ok := RetryAfter(resp); !ok && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+				resp.Header.Set("Retry-After", retryAfterHeader(after))
+			}
+			return resp, err
+		}
+
+		wait := t.backoff(attempt, resp)
+		attrs := []slog.Attr{
+			slog.String("url", req.URL.String()),
+			slog.Int("attempt", attempt),
+			slog.Duration("backoff", wait),
+		}
+		status := 0
+		if err != nil {
+			attrs = append(attrs, slog.Any("error", err))
+		} else {
+			status = resp.StatusCode
+			attrs = append(attrs, slog.Int("status", status))
+		}
+		t.logger.LogAttrs(req.Context(), slog.LevelWarn, "Retrying downstream request", attrs...)
+		for _, obs := range t.observers {
+			obs.Retrying(t.audience, attempt, status)
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		r = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+	}
+}
+
+func (t *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if !replayable(req) {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrConcurrencyLimit)
+	}
+	for _, code := range t.policy.RetryOn {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *retryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	d := float64(t.policy.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= t.policy.Multiplier
+	}
+	if t.policy.Jitter > 0 {
+		d += d * t.policy.Jitter * (2*rand.Float64() - 1)
+	}
+	wait := time.Duration(d)
+
+	if resp != nil {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok && after > wait {
+			wait = after
+		}
+	}
+	if t.policy.MaxBackoff > 0 && wait > t.policy.MaxBackoff {
+		wait = t.policy.MaxBackoff
+	}
+	return wait
+}
+
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
@@ -0,0 +1,186 @@
+package authclient
+
+import (
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
+	"time"
+)
+
+// SessionAffinityHeader carries the ID of the session a call belongs to, so
+// that a receiving service, or a load balancer in front of it hashing on
+// the header, can keep the state of a workflow in one place.
+const SessionAffinityHeader = "X-Session-Affinity"
+
+// CloudRunAffinityCookie is the cookie Cloud Run pins a client to an
+// instance with when session affinity is enabled on the service.
+const CloudRunAffinityCookie = "GAESA"
+
+// maxSessionIDLength bounds the length of session IDs.
+const maxSessionIDLength = 128
+
+// Session pins the calls of one logical workflow, such as the steps of a
+// multi-request upload, to the same receiving service instance where
+// possible. Calls sent with SessionAffinity(s) carry the session's ID in
+// the X-Session-Affinity header and the cookies the receiving services set
+// on earlier calls of the session, which includes the GAESA cookie of
+// Cloud Run session affinity. Pinning is best effort: Cloud Run routes a
+// call elsewhere when the instance is gone or at its concurrency limit. A
+// Session is safe for concurrent use.
+type Session struct {
+	id  string
+	jar *cookiejar.Jar
+}
+
+// NewSession returns a Session with a random ID.
+func NewSession() *Session {
+	return newSession(newIdempotencyKey())
+}
+
+// ResumeSession returns a Session with the given ID, for example the ID
+// of a workflow whose calls are made by several processes. The cookies of
+// the session's earlier calls are not known to it, so the first call may
+// reach another Cloud Run instance. It fails for IDs that are not valid,
+// as ValidateSessionID describes.
+func ResumeSession(id string) (*Session, error) {
+	if err := ValidateSessionID(id); err != nil {
+		return nil, err
+	}
+	return newSession(id), nil
+}
+
+func newSession(id string) *Session {
+	// cookiejar.New only fails with invalid options.
+	jar, _ := cookiejar.New(nil)
+	return &Session{id: id, jar: jar}
+}
+
+// ID returns the ID of the session.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// ValidateSessionID checks that id can identify a session: 1 to 128
+// letters, digits, hyphens, underscores and dots.
+func ValidateSessionID(id string) error {
+	valid := id != "" && len(id) <= maxSessionIDLength
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			valid = false
+		}
+	}
+	if !valid {
+		return errors.New("authclient: session IDs must be 1 to 128 letters, digits, hyphens, underscores and dots")
+	}
+	return nil
+}
+
+// SessionAffinity sends the call as part of s.
+func SessionAffinity(s *Session) CallOption {
+	return func(o *callOptions) {
+		o.session = s
+	}
+}
+
+// sessionFrom returns the session of the request's call options, or nil.
+func sessionFrom(req *http.Request) *Session {
+	if o := callOptionsFrom(req.Context()); o != nil {
+		return o.session
+	}
+	return nil
+}
+
+// sessionTransport sends each attempt of the calls of a session with its
+// ID and cookies, and keeps the cookies the responses set. It runs for
+// every attempt, so that a retry or hedged attempt follows the cookie an
+// earlier one was given.
+type sessionTransport struct {
+	next http.RoundTripper
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := sessionFrom(req)
+	if s == nil {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	if r.Header.Get(SessionAffinityHeader) == "" {
+		r.Header.Set(SessionAffinityHeader, s.id)
+	}
+	for _, c := range s.jar.Cookies(r.URL) {
+		if _, err := r.Cookie(c.Name); err != nil {
+			r.AddCookie(c)
+		}
+	}
+	resp, err := t.next.RoundTrip(r)
+	if err == nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			s.jar.SetCookies(r.URL, cookies)
+		}
+	}
+	return resp, err
+}
+
+// Sessions keeps sessions by ID, so that the calls made for separate
+// requests of the same workflow, such as inbound requests carrying the
+// same session header, share a Session. Sessions unused for longer than
+// the idle timeout are forgotten. It is safe for concurrent use.
+type Sessions struct {
+	idle time.Duration
+	max  int
+
+	mu        sync.Mutex
+	sessions  map[string]*sessionEntry
+	lastSweep time.Time
+}
+
+type sessionEntry struct {
+	session  *Session
+	lastUsed time.Time
+}
+
+// NewSessions returns Sessions that forget sessions idle for longer than
+// idle and keep at most max of them; a session asked for beyond max is
+// not kept, so its cookies only last for its call. Zero values mean 30
+// minutes and 10000 sessions.
+func NewSessions(idle time.Duration, max int) *Sessions {
+	if idle <= 0 {
+		idle = 30 * time.Minute
+	}
+	if max <= 0 {
+		max = 10000
+	}
+	return &Sessions{idle: idle, max: max, sessions: make(map[string]*sessionEntry), lastSweep: time.Now()}
+}
+
+// Get returns the session with the given ID, creating it if there is none.
+// It fails for IDs that are not valid, as ValidateSessionID describes.
+func (s *Sessions) Get(id string) (*Session, error) {
+	if err := ValidateSessionID(id); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sessions[id]
+	if now.Sub(s.lastSweep) > s.idle || !ok && len(s.sessions) >= s.max {
+		for k, e := range s.sessions {
+			if now.Sub(e.lastUsed) > s.idle {
+				delete(s.sessions, k)
+			}
+		}
+		s.lastSweep = now
+		e, ok = s.sessions[id]
+	}
+	if !ok {
+		e = &sessionEntry{session: newSession(id)}
+		if len(s.sessions) >= s.max {
+			return e.session, nil
+		}
+		s.sessions[id] = e
+	}
+	e.lastUsed = now
+	return e.session, nil
+}
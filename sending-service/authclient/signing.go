@@ -0,0 +1,178 @@
+package authclient
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+// SignatureHeader is the header carrying the detached JWS added by
+// WithRequestSigning.
+const SignatureHeader = "X-Signature"
+
+// Signer signs request signatures with an RS256 key.
+type Signer interface {
+	// Sign returns the RSASSA-PKCS1-v1_5 SHA-256 signature of data and the
+	// ID of the key that made it.
+	Sign(ctx context.Context, data []byte) (sig []byte, keyID string, err error)
+}
+
+// SignerFunc adapts a function to the Signer interface.
+type SignerFunc func(ctx context.Context, data []byte) ([]byte, string, error)
+
+// Sign calls f.
+func (f SignerFunc) Sign(ctx context.Context, data []byte) ([]byte, string, error) {
+	return f(ctx, data)
+}
+
+// IAMSigner signs with a Google-managed key of serviceAccount through the
+// IAM Credentials signBlob API, so no key has to be stored with the
+// service. The caller's credentials, or those given in opts, must hold
+// roles/iam.serviceAccountTokenCreator on serviceAccount, which may be the
+// caller's own service account. Receivers verify the signatures against
+// the service account's public keys.
+func IAMSigner(ctx context.Context, serviceAccount string, opts ...option.ClientOption) (Signer, error) {
+	svc, err := iamcredentials.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("authclient: failed to create IAM Credentials client: %w", err)
+	}
+	name := "projects/-/serviceAccounts/" + serviceAccount
+	return SignerFunc(func(ctx context.Context, data []byte) ([]byte, string, error) {
+		resp, err := svc.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
+			Payload: base64.StdEncoding.EncodeToString(data),
+		}).Context(ctx).Do()
+		if err != nil {
+			return nil, "", fmt.Errorf("authclient: failed to sign request: %w", err)
+		}
+		sig, err := base64.StdEncoding.DecodeString(resp.SignedBlob)
+		if err != nil {
+			return nil, "", fmt.Errorf("authclient: failed to decode signature: %w", err)
+		}
+		return sig, resp.KeyId, nil
+	}), nil
+}
+
+// KeySigner signs with key, which receivers look up by keyID.
+func KeySigner(key *rsa.PrivateKey, keyID string) Signer {
+	return SignerFunc(func(_ context.Context, data []byte) ([]byte, string, error) {
+		digest := sha256.Sum256(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return sig, keyID, err
+	})
+}
+
+// WithRequestSigning signs every request sent by the client with s and
+// sends the signature in the X-Signature header as a JWS with a detached
+// payload (RFC 7515, appendix F). The payload is the request body as it is
+// sent: compressed if the client compresses requests, and before it is
+// encrypted if the client encrypts them, so that a receiver checks it
+// before decoding it. The protected header binds the signature to the
+// request's method, path and query string and to the time it was signed,
+// so a receiver can check that the body arrived unmodified. A request is
+// signed once, however many times it is retried.
+func WithRequestSigning(s Signer) Option {
+	return func(o *options) {
+		o.signer = s
+	}
+}
+
+// signatureHeader is the protected header of a request signature.
+type signatureHeader struct {
+	Alg      string `json:"alg"`
+	Kid      string `json:"kid"`
+	Method   string `json:"htm"`
+	URI      string `json:"htu"`
+	IssuedAt int64  `json:"iat"`
+}
+
+type signTransport struct {
+	next   http.RoundTripper
+	signer Signer
+	// keyID is the ID of the key that made the last signature. The key is
+	// only known once a signature has been made, so a request is signed
+	// again if the key has changed, for example after a key rotation.
+	keyID atomic.Value
+}
+
+func (t *signTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if uploadFrom(req) != nil {
+		req.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrUnsignableUpload, req.URL.Redacted())
+	}
+	r := req.Clone(req.Context())
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header := signatureHeader{Alg: "RS256", Method: r.Method, URI: r.URL.RequestURI(), IssuedAt: time.Now().Unix()}
+	header.Kid, _ = t.keyID.Load().(string)
+	jws, keyID, err := t.sign(r.Context(), header, body)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != header.Kid {
+		t.keyID.Store(keyID)
+		header.Kid = keyID
+		if jws, _, err = t.sign(r.Context(), header, body); err != nil {
+			return nil, err
+		}
+	}
+
+	r.Header.Set(SignatureHeader, jws)
+	return t.next.RoundTrip(r)
+}
+
+// sign returns the compact serialization of a JWS over body with header
+// and its payload omitted.
+func (t *signTransport) sign(ctx context.Context, header signatureHeader, body []byte) (string, string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(h)
+	sig, keyID, err := t.signer.Sign(ctx, []byte(protected+"."+base64.RawURLEncoding.EncodeToString(body)))
+	if err != nil {
+		return "", "", err
+	}
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(sig), keyID, nil
+}
+
+// readBody returns the body of req, leaving req with a body that can be
+// read again.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
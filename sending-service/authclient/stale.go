@@ -0,0 +1,136 @@
+package authclient
+
+import (
+	"log/slog"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// WithStaleTokenGrace renews each cached ID token in the background once it
+// is within grace of expiry, and keeps sending requests with it until it
+// expires while renewal fails, retrying with backoff, so that a transient
+// metadata server outage does not fail requests as long as the cached token
+// is valid. Only once it has expired do requests wait for a new token, and
+// fail if none can be minted. Tokens without an expiry are never renewed.
+func WithStaleTokenGrace(grace time.Duration) Option {
+	return func(o *options) {
+		o.staleGrace = grace
+	}
+}
+
+// StaleTokenObserver is implemented by TokenObservers that also record
+// when a client keeps using its cached token because it could not be
+// renewed, for example to alert before it expires.
+type StaleTokenObserver interface {
+	// TokenStale is called with stale set when renewing the token for
+	// audience first fails, and with it unset once a token is minted
+	// again or the stale token has expired.
+	TokenStale(audience string, stale bool)
+}
+
+func (m multiObserver) TokenStale(audience string, stale bool) {
+	for _, o := range m {
+		if so, ok := o.(StaleTokenObserver); ok {
+			so.TokenStale(audience, stale)
+		}
+	}
+}
+
+// graceToken returns the cached token if it is within the grace period and
+// still valid, starting its renewal in the background if it has not
+// started yet.
+func (s *tokenSource) graceToken() (*oauth2.Token, bool) {
+	if s.staleGrace <= 0 {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok := s.cachedTok
+	if tok == nil || tok.Expiry.IsZero() || time.Until(tok.Expiry) > s.staleGrace || !tok.Valid() {
+		return nil, false
+	}
+	if time.Since(s.minted) < minRefreshInterval {
+		// Tokens that live shorter than the grace period are renewed at
+		// most this often.
+		return tok, true
+	}
+	if !s.renewing {
+		s.renewing = true
+		go s.renewStale(tok)
+	}
+	return tok, true
+}
+
+// renewStale renews tok until a new token is minted, tok expires, or the
+// source is stopped.
+func (s *tokenSource) renewStale(tok *oauth2.Token) {
+	defer func() {
+		s.mu.Lock()
+		s.renewing = false
+		s.mu.Unlock()
+		s.markStale(false)
+	}()
+
+	retry := minRefreshRetry
+	for {
+		fresh, err := s.renew()
+		if err == nil {
+			if s.stale() {
+				s.logger.Info("Renewed stale ID token",
+					slog.String("audience", s.audience),
+					slog.Time("expiry", fresh.Expiry),
+				)
+			}
+			return
+		}
+		s.markStale(true)
+		s.logger.Warn("Failed to renew ID token; sending requests with the cached token until it expires",
+			slog.String("audience", s.audience),
+			slog.Time("expiry", tok.Expiry),
+			slog.Any("error", err),
+		)
+
+		wait := min(retry, time.Until(tok.Expiry))
+		retry = min(retry*2, maxRefreshRetry)
+		if wait <= 0 {
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !tok.Valid() {
+			return
+		}
+	}
+}
+
+// stale reports whether the cached token is being used because it could
+// not be renewed.
+func (s *tokenSource) stale() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isStale
+}
+
+// markStale records whether the cached token is stale, telling the
+// observer when that changes.
+func (s *tokenSource) markStale(stale bool) {
+	s.mu.Lock()
+	changed := s.isStale != stale
+	s.isStale = stale
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	if so, ok := s.observer.(StaleTokenObserver); ok {
+		so.TokenStale(s.audience, stale)
+	}
+}
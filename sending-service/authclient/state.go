@@ -0,0 +1,155 @@
+package authclient
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recentErrorWindow is how far back ClientState counts errors, in
+// recentErrorBuckets buckets.
+const (
+	recentErrorWindow  = 5 * time.Minute
+	recentErrorBuckets = 5
+)
+
+// ClientState describes a client and its cached ID token, for live
+// debugging. It never includes the token itself.
+type ClientState struct {
+	Audience string    `json:"audience"`
+	Created  time.Time `json:"created"`
+	// TokenMinted and TokenExpiry are when the cached ID token was minted
+	// and expires. They are nil before the first token is minted and
+	// after the token is discarded.
+	TokenMinted *time.Time `json:"token_minted,omitempty"`
+	TokenExpiry *time.Time `json:"token_expiry,omitempty"`
+	// TokenStale is set while the cached ID token is used because it could
+	// not be renewed.
+	TokenStale bool `json:"token_stale,omitempty"`
+	// CircuitBreaker is the state of the client's circuit breaker, or
+	// empty if it has none.
+	CircuitBreaker string `json:"circuit_breaker,omitempty"`
+	// RecentErrors counts the errors of the last five minutes.
+	RecentErrors ErrorCounts `json:"recent_errors"`
+	// LastError is the last error, of any age, and when it happened.
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// ErrorCounts count a client's errors by kind.
+type ErrorCounts struct {
+	// Token counts ID tokens that could not be minted.
+	Token int64 `json:"token"`
+	// Rejected counts attempts answered with 401 or 403.
+	Rejected int64 `json:"rejected"`
+	// Server counts attempts answered with a 5xx status.
+	Server int64 `json:"server"`
+	// Transport counts attempts that got no response.
+	Transport int64 `json:"transport"`
+}
+
+func (c *ErrorCounts) add(o ErrorCounts) {
+	c.Token += o.Token
+	c.Rejected += o.Rejected
+	c.Server += o.Server
+	c.Transport += o.Transport
+}
+
+// StateReporter is implemented by client factories that can describe
+// their clients, such as *Cache.
+type StateReporter interface {
+	State() []ClientState
+}
+
+// State describes the client.
+func (c *Client) State() ClientState {
+	s := ClientState{Audience: c.audience, Created: c.created}
+	if minted, expiry := c.source.cached(); !expiry.IsZero() {
+		s.TokenMinted, s.TokenExpiry = &minted, &expiry
+	}
+	s.TokenStale = c.source.stale()
+	if c.breaker != nil {
+		s.CircuitBreaker = c.breaker.State().String()
+	}
+	s.RecentErrors, s.LastError, s.LastErrorAt = c.source.errors.recent()
+	return s
+}
+
+// State describes every client the cache holds, in order of audience.
+// Clients that could not be created are left out.
+func (c *Cache) State() []ClientState {
+	c.mu.Lock()
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	c.mu.Unlock()
+
+	states := make([]ClientState, 0, len(entries))
+	for _, e := range entries {
+		// Wait for a client still being created, as Flush does.
+		e.once.Do(func() {})
+		if e.client != nil {
+			states = append(states, e.client.State())
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Audience < states[j].Audience })
+	return states
+}
+
+// errorLog counts a client's errors in one-minute buckets.
+type errorLog struct {
+	mu      sync.Mutex
+	buckets [recentErrorBuckets]errorBucket
+	last    string
+	lastAt  time.Time
+}
+
+type errorBucket struct {
+	minute int64
+	counts ErrorCounts
+}
+
+func (l *errorLog) record(counts ErrorCounts, err string) {
+	now := time.Now()
+	minute := now.Unix() / 60
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := &l.buckets[minute%recentErrorBuckets]
+	if b.minute != minute {
+		*b = errorBucket{minute: minute}
+	}
+	b.counts.add(counts)
+	l.last, l.lastAt = err, now
+}
+
+func (l *errorLog) recent() (ErrorCounts, string, *time.Time) {
+	since := time.Now().Add(-recentErrorWindow).Unix() / 60
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var counts ErrorCounts
+	for _, b := range l.buckets {
+		if b.minute > since {
+			counts.add(b.counts)
+		}
+	}
+	if l.lastAt.IsZero() {
+		return counts, "", nil
+	}
+	at := l.lastAt
+	return counts, l.last, &at
+}
+
+// recordAttempt counts the error, if any, of an attempt answered with resp
+// or failed with err.
+func (l *errorLog) recordAttempt(resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		l.record(ErrorCounts{Transport: 1}, err.Error())
+	case rejected(resp):
+		l.record(ErrorCounts{Rejected: 1}, resp.Status)
+	case resp.StatusCode >= 500:
+		l.record(ErrorCounts{Server: 1}, resp.Status)
+	}
+}
@@ -0,0 +1,30 @@
+package authclient
+
+import (
+	"context"
+	"mime"
+	"net/http"
+)
+
+type streamingKey struct{}
+
+// Streaming returns a copy of ctx that marks requests sent with it as
+// streaming, such as server-sent events. For a streaming request, the
+// overall timeout of the client's TimeoutPolicy only bounds the time until
+// the response headers arrive, so a long-lived stream isn't cut off, and
+// the response is never cached.
+func Streaming(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamingKey{}, true)
+}
+
+// IsStreaming reports whether ctx was marked with Streaming.
+func IsStreaming(ctx context.Context) bool {
+	streaming, _ := ctx.Value(streamingKey{}).(bool)
+	return streaming
+}
+
+// isEventStream reports whether resp is a server-sent event stream.
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
@@ -0,0 +1,160 @@
+package authclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// TimeoutPolicy bounds the phases of a downstream call. Dial and TLS
+// handshake timeouts are set on the transport with TransportSettings.
+type TimeoutPolicy struct {
+	// Attempt bounds each attempt, from sending the request until the
+	// response headers arrive. The response body may take longer, so
+	// large or streamed responses are not cut off. A retried or refreshed
+	// request gets a new attempt timeout.
+	Attempt time.Duration
+	// Overall bounds the whole call, including retries, backoff, token
+	// refreshes and reading the response body. For requests marked with
+	// Streaming and protocol upgrades such as WebSockets, it stops once the
+	// response headers arrive.
+	Overall time.Duration
+}
+
+// WithTimeoutPolicy enforces p on every request sent by the client,
+// including requests sent through its transport by a reverse proxy. Zero
+// values disable the corresponding timeout.
+func WithTimeoutPolicy(p TimeoutPolicy) Option {
+	return func(o *options) {
+		o.timeouts = p
+	}
+}
+
+// deadlineTransport bounds a request and the reading of its response body
+// by timeout. Streaming and upgrade requests are only bounded until their
+// response headers arrive.
+type deadlineTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+	// call is set for the timeout of call options, which replaces the
+	// client's.
+	call bool
+}
+
+func (t *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if o := callOptionsFrom(req.Context()); !t.call && o != nil && o.timeout > 0 {
+		// The call's own timeout applies instead.
+		return t.next.RoundTrip(req)
+	}
+	if IsStreaming(req.Context()) || isUpgrade(req) {
+		return t.roundTripStream(req)
+	}
+	if uploadFrom(req) != nil {
+		return t.roundTripUpload(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded && req.Context().Err() == nil {
+			err = &deadlineError{timeout: t.timeout, err: err}
+		}
+		cancel()
+		return nil, err
+	}
+	resp.Body = newCancelBody(resp.Body, cancel)
+	return resp, nil
+}
+
+func (t *deadlineTransport) roundTripStream(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.timeout, func() { cancel(context.DeadlineExceeded) })
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && err != nil {
+		cancel(nil)
+		return nil, &deadlineError{timeout: t.timeout, err: err}
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = newCancelBody(resp.Body, func() { cancel(nil) })
+	return resp, nil
+}
+
+// roundTripUpload bounds a streamed upload from when its body has been
+// sent, so that a large upload is not cut off.
+func (t *deadlineTransport) roundTripUpload(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	stop := afterBody(req, t.timeout, func() { cancel(context.DeadlineExceeded) })
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		if !stop() {
+			err = &deadlineError{timeout: t.timeout, err: err}
+		}
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = newCancelBody(resp.Body, func() {
+		stop()
+		cancel(nil)
+	})
+	return resp, nil
+}
+
+// attemptTransport bounds the time until response headers arrive for a
+// single attempt.
+type attemptTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *attemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	// A streamed upload's attempt starts once its body has been sent.
+	stop := afterBody(req, t.timeout, cancel)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !stop() && err != nil {
+		// The timer fired: report a deadline rather than a cancellation so
+		// the retry transport treats the attempt as timed out.
+		cancel()
+		return nil, &attemptTimeoutError{timeout: t.timeout, err: err}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newCancelBody(resp.Body, cancel)
+	return resp, nil
+}
+
+// attemptTimeoutError reports that an attempt ran out of time. It is not a
+// context error, so the attempt is retried while the overall deadline
+// allows.
+type attemptTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *attemptTimeoutError) Error() string {
+	return "authclient: no response within attempt timeout of " + e.timeout.String()
+}
+
+// Timeout reports true, like net.Error timeouts.
+func (e *attemptTimeoutError) Timeout() bool { return true }
+
+// Is reports whether target is ErrDownstreamTimeout.
+func (e *attemptTimeoutError) Is(target error) bool { return target == ErrDownstreamTimeout }
+
+// cancelBody releases a request's context once its response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,203 @@
+package authclient
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerTimingHeader is the header timing phases are reported in, as the
+// Server Timing specification describes.
+const ServerTimingHeader = "Server-Timing"
+
+type timingKey struct{}
+
+// Timing records where the time of the downstream calls sent with a
+// context went. Get one with TimingContext. It is safe for concurrent use,
+// and sums the phases of every call sent with the context.
+type Timing struct {
+	mu     sync.Mutex
+	phases Phases
+}
+
+// Phases is a summary of the downstream calls recorded by a Timing.
+type Phases struct {
+	// Calls counts the calls, and Attempts the requests they sent,
+	// including retries and hedged attempts. A call answered from the
+	// response cache sends none.
+	Calls, Attempts int
+	// Token is the time spent obtaining ID tokens, which is only
+	// noticeable when one had to be minted.
+	Token time.Duration
+	// Connect is the time attempts spent waiting for a connection,
+	// including DNS, dialing and the TLS handshake; it is near zero for
+	// pooled connections. Like TTFB, it is summed over the attempts, so
+	// hedged attempts can make it exceed Total.
+	Connect time.Duration
+	// TTFB is the time from having a connection to the first byte of the
+	// response, which covers sending the request and the receiving
+	// service's handling of it.
+	TTFB time.Duration
+	// Total is the time from the start of each call until its response
+	// headers arrived, including retries and backoff. Reading the
+	// response body is not included.
+	Total time.Duration
+	// ServerTiming holds the Server-Timing header values of the
+	// downstream responses, for passing them on.
+	ServerTiming []string
+}
+
+// TimingContext returns a copy of ctx whose downstream calls are timed,
+// and the Timing they are recorded in.
+func TimingContext(ctx context.Context) (context.Context, *Timing) {
+	t := &Timing{}
+	return context.WithValue(ctx, timingKey{}, t), t
+}
+
+// timingFrom returns the Timing of ctx, or nil.
+func timingFrom(ctx context.Context) *Timing {
+	t, _ := ctx.Value(timingKey{}).(*Timing)
+	return t
+}
+
+// Phases returns the phases recorded so far.
+func (t *Timing) Phases() Phases {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.phases
+	p.ServerTiming = append([]string(nil), p.ServerTiming...)
+	return p
+}
+
+// recordToken records the time since start spent obtaining a token for a
+// request sent with ctx.
+func recordToken(ctx context.Context, start time.Time) {
+	d := time.Since(start)
+	timingFrom(ctx).add(func(p *Phases) {
+		p.Token += d
+	})
+}
+
+func (t *Timing) add(f func(p *Phases)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	f(&t.phases)
+	t.mu.Unlock()
+}
+
+// Header returns the Server-Timing header value of p: the token, connect,
+// ttfb and downstream phases in milliseconds, followed by the Server-Timing
+// values of the downstream responses. It is empty if no call was made.
+func (p Phases) Header() string {
+	if p.Calls == 0 {
+		return ""
+	}
+	metrics := []string{
+		serverTimingMetric("token", "ID token", p.Token),
+		serverTimingMetric("connect", "Connect", p.Connect),
+		serverTimingMetric("ttfb", "Time to first byte", p.TTFB),
+		serverTimingMetric("downstream", "Downstream total", p.Total),
+	}
+	return strings.Join(append(metrics, p.ServerTiming...), ", ")
+}
+
+func serverTimingMetric(name, desc string, d time.Duration) string {
+	return fmt.Sprintf("%s;desc=%q;dur=%.1f", name, desc, float64(d)/float64(time.Millisecond))
+}
+
+// LogValue logs p as a group of durations.
+func (p Phases) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("calls", p.Calls),
+		slog.Int("attempts", p.Attempts),
+		slog.Duration("token", p.Token),
+		slog.Duration("connect", p.Connect),
+		slog.Duration("ttfb", p.TTFB),
+		slog.Duration("total", p.Total),
+	)
+}
+
+// callTimingTransport records the total time of calls whose context has a
+// Timing, and the Server-Timing values of their responses. It runs around
+// the whole chain, so that retries and backoff are included.
+type callTimingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *callTimingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timing := timingFrom(req.Context())
+	if timing == nil {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	total := time.Since(start)
+	timing.add(func(p *Phases) {
+		p.Calls++
+		p.Total += total
+		if err == nil {
+			p.ServerTiming = append(p.ServerTiming, resp.Header.Values(ServerTimingHeader)...)
+		}
+	})
+	return resp, err
+}
+
+// attemptTimingTransport records the connect and time to first byte
+// phases of each attempt whose context has a Timing.
+type attemptTimingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *attemptTimingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timing := timingFrom(req.Context())
+	if timing == nil {
+		return t.next.RoundTrip(req)
+	}
+	var (
+		mu                 sync.Mutex
+		getConn, gotConn   time.Time
+		firstByte          time.Time
+		connected, started bool
+	)
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			mu.Lock()
+			getConn, started = time.Now(), true
+			mu.Unlock()
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			mu.Lock()
+			gotConn, connected = time.Now(), true
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			firstByte = time.Now()
+			mu.Unlock()
+		},
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	mu.Lock()
+	var connect, ttfb time.Duration
+	if started && connected {
+		connect = gotConn.Sub(getConn)
+	}
+	if connected && !firstByte.IsZero() {
+		ttfb = firstByte.Sub(gotConn)
+	}
+	mu.Unlock()
+	timing.add(func(p *Phases) {
+		p.Attempts++
+		p.Connect += connect
+		p.TTFB += ttfb
+	})
+	return resp, err
+}
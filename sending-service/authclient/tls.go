@@ -0,0 +1,60 @@
+package authclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSSettings configure TLS for receivers that do not present a publicly
+// trusted certificate, such as internal services behind an internal load
+// balancer with private certificates.
+type TLSSettings struct {
+	// CAFile is a PEM bundle of root CAs trusted in addition to the
+	// system roots.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and its key,
+	// presented to receivers that require mutual TLS.
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum TLS version, such as tls.VersionTLS12.
+	// Zero keeps the crypto/tls default.
+	MinVersion uint16
+}
+
+// IsZero reports whether s leaves the default TLS configuration unchanged.
+func (s TLSSettings) IsZero() bool {
+	return s == TLSSettings{}
+}
+
+// Config loads the files of s into a TLS client configuration.
+func (s TLSSettings) Config() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: s.MinVersion}
+	if s.CAFile != "" {
+		pem, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("authclient: reading CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("authclient: no certificates found in %s", s.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return nil, errors.New("authclient: a client certificate needs both a certificate and a key file")
+	}
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("authclient: loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,318 @@
+package authclient
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+)
+
+// TokenSourceFunc creates the source of ID tokens for an audience. The
+// returned source is expected to cache tokens until they expire, as
+// oauth2.ReuseTokenSource does.
+type TokenSourceFunc func(ctx context.Context, audience string) (oauth2.TokenSource, error)
+
+// WithTokenSourceFunc replaces the default ID token source, which uses
+// Application Default Credentials or the metadata server, with f.
+func WithTokenSourceFunc(f TokenSourceFunc) Option {
+	return func(o *options) {
+		o.tokenSourceFunc = f
+	}
+}
+
+func defaultTokenSourceFunc(clientOpts []option.ClientOption) TokenSourceFunc {
+	return func(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+		return idtoken.NewTokenSource(ctx, audience, clientOpts...)
+	}
+}
+
+// TokenObserver is notified of ID token lifecycle events, for example to
+// export metrics.
+type TokenObserver interface {
+	// TokenMinted is called when a new token is obtained for audience,
+	// either the first one or one replacing an expired token.
+	TokenMinted(audience string, expiry time.Time)
+	// TokenRefreshed is called when a token is discarded and replaced
+	// because the receiving service rejected it.
+	TokenRefreshed(audience string)
+	// TokenError is called when a token cannot be obtained.
+	TokenError(audience string, err error)
+}
+
+// WithTokenObserver registers an observer for token events.
+func WithTokenObserver(obs TokenObserver) Option {
+	return func(o *options) {
+		o.observer = obs
+	}
+}
+
+// TokenLatencyObserver is implemented by TokenObservers that also record
+// how long obtaining a token took.
+type TokenLatencyObserver interface {
+	// TokenMintLatency is called along with TokenMinted with the time
+	// spent obtaining the token.
+	TokenMintLatency(audience string, d time.Duration)
+}
+
+// MultiTokenObserver returns a TokenObserver that notifies each of obs in
+// turn, including those that implement TokenLatencyObserver,
+// StaleTokenObserver or TokenClaimsObserver.
+func MultiTokenObserver(obs ...TokenObserver) TokenObserver {
+	return multiObserver(obs)
+}
+
+type multiObserver []TokenObserver
+
+func (m multiObserver) TokenMinted(audience string, expiry time.Time) {
+	for _, o := range m {
+		o.TokenMinted(audience, expiry)
+	}
+}
+
+func (m multiObserver) TokenMintLatency(audience string, d time.Duration) {
+	for _, o := range m {
+		if lo, ok := o.(TokenLatencyObserver); ok {
+			lo.TokenMintLatency(audience, d)
+		}
+	}
+}
+
+func (m multiObserver) TokenRefreshed(audience string) {
+	for _, o := range m {
+		o.TokenRefreshed(audience)
+	}
+}
+
+func (m multiObserver) TokenError(audience string, err error) {
+	for _, o := range m {
+		o.TokenError(audience, err)
+	}
+}
+
+type nopObserver struct{}
+
+func (nopObserver) TokenMinted(string, time.Time) {}
+func (nopObserver) TokenRefreshed(string)         {}
+func (nopObserver) TokenError(string, error)      {}
+
+// tokenSource mints ID tokens for one audience and can discard its cached
+// token on demand, which oauth2.ReuseTokenSource does not allow.
+type tokenSource struct {
+	ctx      context.Context
+	audience string
+	mint     TokenSourceFunc
+	observer TokenObserver
+	// store is the TokenStore mint shares tokens through, if any.
+	store TokenStore
+
+	mu   sync.Mutex
+	ts   oauth2.TokenSource
+	last string
+	// minted and expiry describe the token last handed out, for State.
+	minted, expiry time.Time
+	// cachedTok is the token last handed out, which is used while it is
+	// renewed within staleGrace of expiry.
+	cachedTok  *oauth2.Token
+	staleGrace time.Duration
+	// renewing is set while a stale token is renewed in the background,
+	// and isStale once renewing it has failed.
+	renewing bool
+	isStale  bool
+	logger   *slog.Logger
+
+	// errors counts the errors of the client the source belongs to.
+	errors errorLog
+
+	// stop ends the background refresh loop, if any.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newTokenSource(ctx context.Context, audience string, mint TokenSourceFunc, observer TokenObserver) (*tokenSource, error) {
+	ts, err := mint(ctx, audience)
+	if err != nil {
+		observer.TokenError(audience, err)
+		return nil, &TokenMintError{Audience: audience, Err: err}
+	}
+	return &tokenSource{ctx: ctx, audience: audience, mint: mint, observer: observer, ts: ts, logger: slog.Default(), stop: make(chan struct{})}, nil
+}
+
+func (s *tokenSource) Token() (*oauth2.Token, error) {
+	if tok, ok := s.graceToken(); ok {
+		return tok, nil
+	}
+
+	s.mu.Lock()
+	ts := s.ts
+	s.mu.Unlock()
+
+	start := time.Now()
+	tok, err := ts.Token()
+	if err != nil {
+		s.tokenError(err)
+		return nil, &TokenMintError{Audience: s.audience, Err: err}
+	}
+
+	s.mu.Lock()
+	minted := tok.AccessToken != s.last
+	s.last = tok.AccessToken
+	s.cachedTok = tok
+	if minted || s.expiry.IsZero() {
+		s.minted, s.expiry = time.Now(), tok.Expiry
+	}
+	s.mu.Unlock()
+	if minted {
+		s.notifyMinted(tok, time.Since(start))
+	}
+	return tok, nil
+}
+
+// tokenError tells the observer about a token that could not be minted,
+// and counts it.
+func (s *tokenSource) tokenError(err error) {
+	s.observer.TokenError(s.audience, err)
+	s.errors.record(ErrorCounts{Token: 1}, err.Error())
+}
+
+// cached returns when the token last handed out was minted and when it
+// expires, or zero times if there is none.
+func (s *tokenSource) cached() (minted, expiry time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.minted, s.expiry
+}
+
+// notifyMinted tells the observer about a new token that took d to obtain.
+func (s *tokenSource) notifyMinted(tok *oauth2.Token, d time.Duration) {
+	s.observer.TokenMinted(s.audience, tok.Expiry)
+	if lo, ok := s.observer.(TokenLatencyObserver); ok {
+		lo.TokenMintLatency(s.audience, d)
+	}
+	s.notifyClaims(tok)
+}
+
+// invalidate replaces the underlying token source if it still hands out
+// stale, so the next call to Token mints a new token. Concurrent callers
+// that saw the same stale token only trigger one refresh.
+func (s *tokenSource) invalidate(stale *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.ts.Token()
+	if err == nil && current.AccessToken != stale.AccessToken {
+		return nil
+	}
+
+	s.forgetStored(stale)
+	ts, err := s.mint(s.ctx, s.audience)
+	if err != nil {
+		s.tokenError(err)
+		return &TokenMintError{Audience: s.audience, Err: err}
+	}
+	s.ts = ts
+	s.minted, s.expiry = time.Time{}, time.Time{}
+	s.cachedTok = nil
+	s.observer.TokenRefreshed(s.audience)
+	return nil
+}
+
+// authTransport attaches ID tokens to requests. When the receiving service
+// rejects a token with 401 or 403, it forces a token refresh and retries
+// the request once, unless the rejection names the token's audience.
+type authTransport struct {
+	source *tokenSource
+	next   http.RoundTripper
+	logger *slog.Logger
+	// header is the header the token is sent in.
+	header string
+	// separateIAP is set when IAP checks a token of its own, so that its
+	// rejections are not taken for rejections of this token.
+	separateIAP bool
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	tok, err := t.source.Token()
+	recordToken(req.Context(), start)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(t.withToken(req, tok))
+	t.source.errors.recordAttempt(resp, err)
+	if err != nil || !rejected(resp) || !replayable(req) {
+		return resp, err
+	}
+	if t.separateIAP && resp.Header.Get(iapGeneratedHeader) == "true" {
+		return resp, nil
+	}
+	if AudienceRejected(resp) {
+		// A new token would have the same audience.
+		t.logger.WarnContext(req.Context(), "Downstream rejected the ID token audience; configure the audience the receiving service expects",
+			slog.String("audience", t.source.audience),
+			slog.String("www_authenticate", resp.Header.Get("WWW-Authenticate")),
+		)
+		return resp, nil
+	}
+
+	t.logger.InfoContext(req.Context(), "Refreshing ID token after downstream rejected it",
+		slog.String("audience", t.source.audience),
+		slog.Int("status", resp.StatusCode),
+	)
+	if err := t.source.invalidate(tok); err != nil {
+		t.logger.ErrorContext(req.Context(), "Failed to refresh ID token",
+			slog.String("audience", t.source.audience),
+			slog.Any("error", err),
+		)
+		return resp, nil
+	}
+	start = time.Now()
+	fresh, err := t.source.Token()
+	recordToken(req.Context(), start)
+	if err != nil {
+		t.logger.ErrorContext(req.Context(), "Failed to refresh ID token",
+			slog.String("audience", t.source.audience),
+			slog.Any("error", err),
+		)
+		return resp, nil
+	}
+
+	r := t.withToken(req, fresh)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		r.Body = body
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	resp, err = t.next.RoundTrip(r)
+	t.source.errors.recordAttempt(resp, err)
+	return resp, err
+}
+
+func (t *authTransport) withToken(req *http.Request, tok *oauth2.Token) *http.Request {
+	r := req.Clone(req.Context())
+	if t.header == "Authorization" {
+		tok.SetAuthHeader(r)
+		return r
+	}
+	r.Header.Set(t.header, tok.Type()+" "+tok.AccessToken)
+	return r
+}
+
+func rejected(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
+
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
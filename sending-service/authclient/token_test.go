@@ -0,0 +1,59 @@
+package authclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func staticTokens(context.Context, string) (oauth2.TokenSource, error) {
+	return oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: "token",
+		Expiry:      time.Now().Add(time.Hour),
+	}), nil
+}
+
+// BenchmarkTokenReuse measures handing out a token that is still valid,
+// which is what nearly every request does.
+func BenchmarkTokenReuse(b *testing.B) {
+	s, err := newTokenSource(context.Background(), "https://receiver", staticTokens, nopObserver{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.Token(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkClientDo measures a request through the whole transport chain
+// of a Client with its default options.
+func BenchmarkClientDo(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	c, err := New(context.Background(), srv.URL, WithTokenSourceFunc(staticTokens), WithTransport(srv.Client().Transport))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
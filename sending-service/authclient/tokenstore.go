@@ -0,0 +1,158 @@
+package authclient
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenStore shares minted ID tokens between clients, for WithTokenStore.
+// A store shared by the instances of a service, such as one backed by
+// Redis, lets them mint one token per audience between them instead of one
+// each, and discard a rejected token everywhere at once. Implementations
+// must be safe for concurrent use.
+type TokenStore interface {
+	// GetToken returns the token stored for audience, if any.
+	GetToken(ctx context.Context, audience string) (*oauth2.Token, bool, error)
+	// SetToken stores tok for audience until it expires.
+	SetToken(ctx context.Context, audience string, tok *oauth2.Token) error
+	// DeleteToken removes the token stored for audience.
+	DeleteToken(ctx context.Context, audience string) error
+}
+
+// minStoredTokenLife is how long a stored token must still be valid for,
+// beyond the refresh skew and stale grace, to be used instead of minting a
+// new one.
+const minStoredTokenLife = time.Minute
+
+// WithTokenStore shares the client's ID tokens through store: a token
+// stored for the audience by any client is used while it is valid for long
+// enough, and a newly minted one is stored for the others. A token the
+// receiving service rejects, and the token of a flushed client, is
+// deleted from the store. The store holds bearer credentials, so it must
+// be as trusted as the service itself, and shared only by clients that
+// mint tokens as the same identity.
+func WithTokenStore(store TokenStore) Option {
+	return func(o *options) {
+		o.tokenStore = store
+	}
+}
+
+// storedTokenSourceFunc returns a TokenSourceFunc whose sources take tokens
+// from store while they are valid for longer than minLife, and otherwise
+// mint them with mint and store them.
+func storedTokenSourceFunc(store TokenStore, mint TokenSourceFunc, minLife time.Duration, logger *slog.Logger) TokenSourceFunc {
+	return func(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+		ts, err := mint(ctx, audience)
+		if err != nil {
+			return nil, err
+		}
+		return &storedTokenSource{ctx: ctx, audience: audience, store: store, next: ts, minLife: minLife, logger: logger}, nil
+	}
+}
+
+type storedTokenSource struct {
+	ctx      context.Context
+	audience string
+	store    TokenStore
+	next     oauth2.TokenSource
+	minLife  time.Duration
+	logger   *slog.Logger
+
+	mu  sync.Mutex
+	tok *oauth2.Token
+}
+
+func (s *storedTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.usable(s.tok) {
+		return s.tok, nil
+	}
+	tok, ok, err := s.store.GetToken(s.ctx, s.audience)
+	if err != nil {
+		s.logger.Warn("Failed to read ID token store", slog.String("audience", s.audience), slog.Any("error", err))
+	} else if ok && s.usable(tok) {
+		s.tok = tok
+		return tok, nil
+	}
+
+	if tok, err = s.next.Token(); err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	if err := s.store.SetToken(s.ctx, s.audience, tok); err != nil {
+		s.logger.Warn("Failed to write ID token store", slog.String("audience", s.audience), slog.Any("error", err))
+	}
+	return tok, nil
+}
+
+// usable reports whether tok is valid for longer than minLife; tokens
+// without an expiry always are.
+func (s *storedTokenSource) usable(tok *oauth2.Token) bool {
+	if tok == nil || tok.AccessToken == "" {
+		return false
+	}
+	return tok.Expiry.IsZero() || time.Until(tok.Expiry) > s.minLife
+}
+
+// forgetStored deletes the stored token of the source's audience, if the
+// client has a TokenStore: any token if stale is nil, and otherwise only
+// stale, so that a token another client has since stored is kept.
+func (s *tokenSource) forgetStored(stale *oauth2.Token) {
+	if s.store == nil {
+		return
+	}
+	if stale != nil {
+		tok, ok, err := s.store.GetToken(s.ctx, s.audience)
+		if err == nil && (!ok || tok.AccessToken != stale.AccessToken) {
+			return
+		}
+	}
+	if err := s.store.DeleteToken(s.ctx, s.audience); err != nil {
+		s.logger.Warn("Failed to delete ID token from the store", slog.String("audience", s.audience), slog.Any("error", err))
+	}
+}
+
+// MemoryTokenStore is a TokenStore that keeps tokens in memory, shared by
+// the clients of one process.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*oauth2.Token
+}
+
+// NewMemoryTokenStore returns an empty MemoryTokenStore.
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string]*oauth2.Token)}
+}
+
+// GetToken implements TokenStore.
+func (s *MemoryTokenStore) GetToken(_ context.Context, audience string) (*oauth2.Token, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok, ok := s.tokens[audience]
+	if ok && !tok.Expiry.IsZero() && time.Now().After(tok.Expiry) {
+		delete(s.tokens, audience)
+		return nil, false, nil
+	}
+	return tok, ok, nil
+}
+
+// SetToken implements TokenStore.
+func (s *MemoryTokenStore) SetToken(_ context.Context, audience string, tok *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[audience] = tok
+	return nil
+}
+
+// DeleteToken implements TokenStore.
+func (s *MemoryTokenStore) DeleteToken(_ context.Context, audience string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, audience)
+	return nil
+}
@@ -0,0 +1,118 @@
+package authclient
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TransportSettings tune the connection pool of the base transport.
+type TransportSettings struct {
+	// MaxIdleConns limits idle connections across all hosts. Zero means
+	// no limit.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits idle connections to each host. Cloud Run
+	// services are single hosts, so this is the setting that matters.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes connections idle for longer than this.
+	IdleConnTimeout time.Duration
+	// DialTimeout bounds establishing a TCP connection.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake of new connections.
+	TLSHandshakeTimeout time.Duration
+	// HTTP2 attempts HTTP/2 over TLS, multiplexing requests to a host over
+	// one connection.
+	HTTP2 bool
+	// ForceHTTP2 sends every request over HTTP/2, for checking how a
+	// receiver behaves with large payloads and streams, which differ
+	// between HTTP/1.1 and HTTP/2. Over TLS it implies HTTP2; requests to
+	// http:// URLs, such as local receivers, use HTTP/2 with prior
+	// knowledge (h2c). Hosts that turn out not to speak h2c fall back to
+	// HTTP/1.1, as do TLS hosts that don't negotiate h2; ConnDiagnostics
+	// reports the protocol actually used.
+	ForceHTTP2 bool
+	// KeepAlive is the TCP keep-alive period. A negative value disables
+	// TCP keep-alives and HTTP connection reuse.
+	KeepAlive time.Duration
+	// TLS, if set, configures how receivers' certificates are verified
+	// and the client certificate presented to them. See TLSSettings.
+	TLS *tls.Config
+	// DialOverrides maps the host:port of a request URL, such as
+	// "svc-xyz.a.run.app:443", to the address to connect to instead, such
+	// as an internal load balancer. Requests keep their URL, so the Host
+	// header and TLS server name are unchanged.
+	DialOverrides map[string]string
+}
+
+// DefaultTransportSettings returns the settings of http.DefaultTransport
+// with a larger per-host idle pool and shorter connection timeouts, since
+// Cloud Run accepts connections quickly.
+func DefaultTransportSettings() TransportSettings {
+	return TransportSettings{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+		DialTimeout:         5 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+		HTTP2:               true,
+		KeepAlive:           30 * time.Second,
+	}
+}
+
+// NewTransport returns a transport configured with s. Create one transport
+// and share it between clients so that connections are reused.
+func NewTransport(s TransportSettings) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = s.MaxIdleConns
+	t.MaxIdleConnsPerHost = s.MaxIdleConnsPerHost
+	t.IdleConnTimeout = s.IdleConnTimeout
+	t.TLSHandshakeTimeout = s.TLSHandshakeTimeout
+	t.ForceAttemptHTTP2 = s.HTTP2 || s.ForceHTTP2
+	t.DisableKeepAlives = s.KeepAlive < 0
+	if s.TLS != nil {
+		t.TLSClientConfig = s.TLS.Clone()
+	}
+	dialer := &net.Dialer{
+		Timeout:   s.DialTimeout,
+		KeepAlive: s.KeepAlive,
+	}
+	t.DialContext = dialer.DialContext
+	if len(s.DialOverrides) > 0 {
+		overrides := make(map[string]string, len(s.DialOverrides))
+		for from, to := range s.DialOverrides {
+			overrides[strings.ToLower(from)] = to
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// Tag URLs of a service connect where the service does.
+			_, untagged, _ := strings.Cut(strings.ToLower(addr), RevisionTagSeparator)
+			if to, ok := overrides[strings.ToLower(addr)]; ok {
+				addr = to
+			} else if to, ok := overrides[untagged]; ok {
+				addr = to
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	if s.ForceHTTP2 {
+		t.RegisterProtocol("http", newH2CTransport(t.DialContext, plainHTTP(t)))
+	}
+	return t
+}
+
+// plainHTTP returns a transport that sends requests like t but over
+// HTTP/1.1, for hosts that don't speak h2c. It is separate from t, since
+// protocols registered on t apply to its clones too.
+func plainHTTP(t *http.Transport) *http.Transport {
+	h1 := t.Clone()
+	h1.ForceAttemptHTTP2 = false
+	return h1
+}
+
+// WithTransportSettings sets the base transport to a new transport
+// configured with s. It replaces any transport set with WithTransport.
+func WithTransportSettings(s TransportSettings) Option {
+	return WithTransport(NewTransport(s))
+}
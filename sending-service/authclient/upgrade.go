@@ -0,0 +1,47 @@
+package authclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isUpgrade reports whether req asks to switch protocols, as a WebSocket
+// handshake does. Upgraded connections are long-lived, so they are
+// treated like streaming requests, and are never hedged or cached.
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newCancelBody wraps body so that cancel is called when it is closed. The
+// body of a 101 Switching Protocols response is the upgraded connection,
+// which httputil.ReverseProxy writes to, so a writable body stays writable.
+func newCancelBody(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return &cancelConn{ReadWriteCloser: rwc, cancel: cancel}
+	}
+	return &cancelBody{ReadCloser: body, cancel: cancel}
+}
+
+// cancelConn is a cancelBody for an upgraded connection.
+type cancelConn struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,262 @@
+package authclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrUnsignableUpload is matched by errors.Is for streamed uploads refused
+// because the client signs requests, which takes the whole body.
+var ErrUnsignableUpload = errors.New("authclient: streamed upload cannot be signed")
+
+// ErrUnencryptableUpload is matched by errors.Is for streamed uploads
+// refused because the client encrypts requests, which takes the whole body.
+var ErrUnencryptableUpload = errors.New("authclient: streamed upload cannot be encrypted")
+
+// UploadSettings configures WithStreamingUploads.
+type UploadSettings struct {
+	// MemoryLimit is the largest request body held in memory. Bodies of
+	// up to MemoryLimit bytes are buffered as before, so that they can be
+	// retried, compressed and signed; larger ones, and bodies of unknown
+	// length that turn out larger, are streamed to the receiving service
+	// as they are read, and sent once. It defaults to 8 MiB.
+	MemoryLimit int64
+	// ProgressInterval is how many bytes of a streamed upload are sent
+	// between reports to the UploadObserver. It defaults to 64 MiB.
+	ProgressInterval int64
+}
+
+// UploadObserver is notified of the progress of streamed uploads.
+type UploadObserver interface {
+	// UploadStarted is called when a streamed upload to audience starts,
+	// with the length of its body, or -1 if it is not known.
+	UploadStarted(audience string, contentLength int64)
+	// UploadProgress is called with each further n bytes sent.
+	UploadProgress(audience string, n int64)
+	// UploadFinished is called when the upload is over, with the bytes
+	// sent and the error it failed with, if any.
+	UploadFinished(audience string, sent int64, err error)
+}
+
+// WithStreamingUploads streams request bodies larger than s.MemoryLimit to
+// the receiving service instead of reading them into memory, so that
+// uploads of any size can be forwarded, such as those a reverse proxy
+// relays. Bodies of unknown length are sent with chunked transfer
+// encoding, or as they arrive over HTTP/2. A streamed upload is sent once:
+// it is not retried, hedged or resent after a rejected token, it is not
+// compressed, and a client that signs or encrypts requests refuses it with
+// an error matching ErrUnsignableUpload or ErrUnencryptableUpload. The
+// attempt and overall timeouts of the client's TimeoutPolicy only start
+// once the body has been sent, so that they bound the receiving service's
+// answer rather than the upload.
+func WithStreamingUploads(s UploadSettings) Option {
+	return func(o *options) {
+		if s.MemoryLimit <= 0 {
+			s.MemoryLimit = 8 << 20
+		}
+		if s.ProgressInterval <= 0 {
+			s.ProgressInterval = 64 << 20
+		}
+		o.uploads = &s
+	}
+}
+
+// WithUploadObserver registers an observer for streamed uploads.
+func WithUploadObserver(obs UploadObserver) Option {
+	return func(o *options) {
+		o.uploadObserver = obs
+	}
+}
+
+type uploadKey struct{}
+
+// uploadFrom returns the streamed upload of req, or nil.
+func uploadFrom(req *http.Request) *uploadBody {
+	b, _ := req.Context().Value(uploadKey{}).(*uploadBody)
+	return b
+}
+
+type uploadTransport struct {
+	next     http.RoundTripper
+	settings UploadSettings
+	audience string
+	observer UploadObserver
+	logger   *slog.Logger
+}
+
+func (t *uploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	length := outgoingLength(req)
+	if replayable(req) || isUpgrade(req) || (length >= 0 && length <= t.settings.MemoryLimit) {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	if length < 0 {
+		// Read as much as may be held in memory: a body that fits is sent
+		// like one of known length.
+		head, err := io.ReadAll(io.LimitReader(req.Body, t.settings.MemoryLimit+1))
+		if err != nil {
+			req.Body.Close()
+			return nil, err
+		}
+		if int64(len(head)) <= t.settings.MemoryLimit {
+			req.Body.Close()
+			r.ContentLength = int64(len(head))
+			r.Header.Set("Content-Length", strconv.Itoa(len(head)))
+			r.Body = io.NopCloser(bytes.NewReader(head))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(head)), nil
+			}
+			return t.next.RoundTrip(r)
+		}
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+	}
+
+	body := &uploadBody{ReadCloser: r.Body, t: t}
+	r.Body = body
+	r.GetBody = nil
+	r = r.WithContext(context.WithValue(r.Context(), uploadKey{}, body))
+	if t.observer != nil {
+		t.observer.UploadStarted(t.audience, length)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	sent := body.finish()
+	result := err
+	if err == nil && length >= 0 && sent < length {
+		// The receiving service answered without reading the whole body,
+		// as when it rejects the upload.
+		result = fmt.Errorf("authclient: upload answered with %s after %d of %d bytes", resp.Status, sent, length)
+	}
+	if t.observer != nil {
+		t.observer.UploadFinished(t.audience, sent, result)
+	}
+	if t.logger != nil {
+		attrs := []any{slog.String("audience", t.audience), slog.Int64("bytes", sent), slog.Duration("duration", time.Since(start))}
+		if result != nil {
+			t.logger.Warn("Streamed upload failed", append(attrs, slog.Any("error", result))...)
+		} else {
+			t.logger.Info("Streamed upload", attrs...)
+		}
+	}
+	return resp, err
+}
+
+// outgoingLength returns the length of the body of req, or -1 if it is
+// not known, as http.Transport reads ContentLength: a zero length with a
+// body means an unknown one.
+func outgoingLength(req *http.Request) int64 {
+	if req.Body == nil || req.Body == http.NoBody {
+		return 0
+	}
+	if req.ContentLength != 0 {
+		return req.ContentLength
+	}
+	return -1
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// uploadBody counts the bytes of a streamed upload as they are read, and
+// runs the functions waiting for it to be sent.
+type uploadBody struct {
+	io.ReadCloser
+	t *uploadTransport
+
+	mu       sync.Mutex
+	sent     int64
+	reported int64
+	done     bool
+	waiting  []func()
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	b.sent += int64(n)
+	var progress int64
+	if b.sent-b.reported >= b.t.settings.ProgressInterval {
+		progress = b.sent - b.reported
+		b.reported = b.sent
+	}
+	var waiting []func()
+	if err == io.EOF && !b.done {
+		b.done = true
+		waiting, b.waiting = b.waiting, nil
+	}
+	b.mu.Unlock()
+	if progress > 0 && b.t.observer != nil {
+		b.t.observer.UploadProgress(b.t.audience, progress)
+	}
+	for _, f := range waiting {
+		f()
+	}
+	return n, err
+}
+
+// whenSent calls f once the whole body has been read, or at once if it
+// has been.
+func (b *uploadBody) whenSent(f func()) {
+	b.mu.Lock()
+	if !b.done {
+		b.waiting = append(b.waiting, f)
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Unlock()
+	f()
+}
+
+// finish reports the bytes sent since the last report and returns the
+// total.
+func (b *uploadBody) finish() int64 {
+	b.mu.Lock()
+	progress := b.sent - b.reported
+	b.reported = b.sent
+	sent := b.sent
+	b.mu.Unlock()
+	if progress > 0 && b.t.observer != nil {
+		b.t.observer.UploadProgress(b.t.audience, progress)
+	}
+	return sent
+}
+
+// afterBody calls f after d, counted from when the body of req has been
+// sent if it is a streamed upload, and from now otherwise. The returned
+// function stops the timer and reports, like time.Timer.Stop, whether f
+// had not been called yet.
+func afterBody(req *http.Request, d time.Duration, f func()) func() bool {
+	body := uploadFrom(req)
+	if body == nil {
+		return time.AfterFunc(d, f).Stop
+	}
+	var mu sync.Mutex
+	var timer *time.Timer
+	stopped := false
+	body.whenSent(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			timer = time.AfterFunc(d, f)
+		}
+	})
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		if timer == nil {
+			return true
+		}
+		return timer.Stop()
+	}
+}
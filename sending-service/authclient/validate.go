@@ -0,0 +1,207 @@
+package authclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxBadResponseBody is the number of bytes of a bad response body kept in
+// a BadResponseError.
+const maxBadResponseBody = 1 << 10
+
+// ErrBadResponse is matched by errors.Is for responses that failed the
+// checks of WithResponseValidation, or whose JSON body DoJSON could not
+// decode: the receiving service answered, but not with what the caller
+// expects.
+var ErrBadResponse = errors.New("authclient: bad response from downstream")
+
+// BadResponseError is returned for a 2xx response that is not what the
+// caller expects, with what was wrong with it.
+type BadResponseError struct {
+	// Code is the status code of the response.
+	Code int
+	// ContentType is its Content-Type header.
+	ContentType string
+	// Reason says what was wrong, such as "unexpected content type".
+	Reason string
+	// Body holds up to the first 1 KiB of the response body, if it was
+	// read.
+	Body []byte
+	// Err is the decoding or schema error, if any.
+	Err error
+}
+
+func (e *BadResponseError) Error() string {
+	msg := fmt.Sprintf("authclient: bad response from downstream (%d, %q): %s", e.Code, e.ContentType, e.Reason)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *BadResponseError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrBadResponse.
+func (e *BadResponseError) Is(target error) bool {
+	return target == ErrBadResponse
+}
+
+// Schema validates a decoded JSON response body, returning an error
+// describing how it does not match. The compiled schemas of JSON Schema
+// libraries such as github.com/santhosh-tekuri/jsonschema implement it.
+type Schema interface {
+	Validate(v interface{}) error
+}
+
+// ResponseValidation configures the checks of WithResponseValidation.
+type ResponseValidation struct {
+	// ContentTypes, if set, are the media types responses may have, such
+	// as application/json, without parameters; type/* matches any subtype.
+	ContentTypes []string
+	// MaxSize, if positive, is the largest response body in bytes.
+	MaxSize int64
+	// Schema, if set, validates the body, which must be JSON. Bodies are
+	// read into memory to be validated, up to MaxSize bytes if it is set.
+	Schema Schema
+}
+
+// WithResponseValidation checks every 2xx response the client returns
+// against v, so that a receiving service answering with something
+// malformed, such as an HTML error page from a proxy, fails the call with
+// a *BadResponseError instead of handing the caller garbage. Other
+// responses, and bodies of 204 responses and of responses to HEAD
+// requests, are not checked. A body larger than MaxSize fails with a
+// *BadResponseError when the read goes past it, unless its Content-Length
+// already says so.
+func WithResponseValidation(v ResponseValidation) Option {
+	return WithMiddleware(ValidationMiddleware(v))
+}
+
+// ValidationMiddleware returns the layer configured by
+// WithResponseValidation, for use with WithMiddleware or other transports.
+func ValidationMiddleware(v ResponseValidation) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		if len(v.ContentTypes) == 0 && v.MaxSize <= 0 && v.Schema == nil {
+			return next
+		}
+		return &validatingTransport{next: next, v: v}
+	}
+}
+
+type validatingTransport struct {
+	next http.RoundTripper
+	v    ResponseValidation
+}
+
+func (t *validatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, err
+	}
+	if err := t.check(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *validatingTransport) check(req *http.Request, resp *http.Response) error {
+	if req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	bad := func(reason string, body []byte, err error) error {
+		if len(body) > maxBadResponseBody {
+			body = body[:maxBadResponseBody]
+		}
+		return &BadResponseError{Code: resp.StatusCode, ContentType: resp.Header.Get("Content-Type"), Reason: reason, Body: body, Err: err}
+	}
+	if len(t.v.ContentTypes) > 0 && !matchContentType(resp.Header.Get("Content-Type"), t.v.ContentTypes) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxBadResponseBody))
+		return bad("unexpected content type", body, nil)
+	}
+	max := t.v.MaxSize
+	if max > 0 && resp.ContentLength > max {
+		return bad("body exceeds "+strconv.FormatInt(max, 10)+" bytes", nil, nil)
+	}
+	if t.v.Schema == nil {
+		if max > 0 {
+			resp.Body = &maxSizeBody{ReadCloser: resp.Body, remaining: max, err: bad("body exceeds "+strconv.FormatInt(max, 10)+" bytes", nil, nil)}
+		}
+		return nil
+	}
+
+	r := io.Reader(resp.Body)
+	if max > 0 {
+		r = io.LimitReader(resp.Body, max+1)
+	}
+	body, err := io.ReadAll(r)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if max > 0 && int64(len(body)) > max {
+		return bad("body exceeds "+strconv.FormatInt(max, 10)+" bytes", body, nil)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return bad("invalid JSON", body, err)
+	}
+	if err := t.v.Schema.Validate(doc); err != nil {
+		return bad("body does not match the schema", body, err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// matchContentType reports whether the media type of contentType is one
+// of types.
+func matchContentType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSizeBody fails reads past the first remaining bytes of a body with
+// err.
+type maxSizeBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *maxSizeBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.err
+	}
+	// Read one byte past the limit to tell a body of exactly the maximum
+	// size from a larger one.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), b.err
+	}
+	return n, err
+}
@@ -0,0 +1,161 @@
+package authclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// VaultConfig configures VaultTokenProvider.
+type VaultConfig struct {
+	// Address is the URL of the Vault server, such as
+	// https://vault.example.com:8200.
+	Address string
+	// Token is the Vault token to authenticate with. TokenFile, if set,
+	// takes precedence and is read before every request to Vault, so that
+	// a token kept fresh by Vault Agent is picked up.
+	Token     string
+	TokenFile string
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+	// Mount is the path the GCP secrets engine is mounted at. It defaults
+	// to gcp.
+	Mount string
+	// Roleset is the roleset to request OAuth2 access tokens from. It must
+	// have secret_type access_token.
+	Roleset string
+	// ServiceAccount is the service account to mint ID tokens as. It
+	// defaults to the roleset's own service account, which the Vault token
+	// must then be allowed to read the roleset to look up.
+	ServiceAccount string
+	// HTTPClient sends requests to Vault. It defaults to
+	// http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// VaultTokenProvider returns a TokenProvider for organizations that broker
+// Google credentials through HashiCorp Vault instead of Application Default
+// Credentials. Vault's GCP secrets engine issues OAuth2 access tokens for
+// the roleset's service account, and ID tokens are minted with them
+// through the IAM Credentials generateIdToken API. The roleset needs
+// roles/iam.serviceAccountTokenCreator on the service account ID tokens are
+// minted as, which for the roleset's own account means a binding on
+// itself, and that account needs roles/run.invoker on the receiving
+// service. opts apply to the IAM Credentials client, for example
+// QuotaProject.
+func VaultTokenProvider(ctx context.Context, cfg VaultConfig, opts ...option.ClientOption) (TokenProvider, error) {
+	if cfg.Address == "" || cfg.Roleset == "" {
+		return nil, fmt.Errorf("authclient: a Vault address and roleset are required")
+	}
+	if cfg.Token == "" && cfg.TokenFile == "" {
+		return nil, fmt.Errorf("authclient: a Vault token or token file is required")
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = "gcp"
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	v := &vaultClient{cfg: cfg}
+
+	sa := cfg.ServiceAccount
+	if sa == "" {
+		var roleset struct {
+			ServiceAccountEmail string `json:"service_account_email"`
+		}
+		if err := v.read(ctx, "roleset/"+url.PathEscape(cfg.Roleset), &roleset); err != nil {
+			return nil, fmt.Errorf("authclient: failed to look up the service account of Vault roleset %s: %w", cfg.Roleset, err)
+		}
+		if roleset.ServiceAccountEmail == "" {
+			return nil, fmt.Errorf("authclient: Vault roleset %s has no service account", cfg.Roleset)
+		}
+		sa = roleset.ServiceAccountEmail
+	}
+
+	access := oauth2.ReuseTokenSource(nil, &vaultTokenSource{ctx: ctx, vault: v})
+	return SourceProvider(ImpersonatedTokenSource(sa, append([]option.ClientOption{option.WithTokenSource(access)}, opts...)...)), nil
+}
+
+type vaultClient struct {
+	cfg VaultConfig
+}
+
+// read reads the secret at path below the engine's mount and decodes its
+// data into v.
+func (c *vaultClient) read(ctx context.Context, path string, v interface{}) error {
+	token := c.cfg.Token
+	if c.cfg.TokenFile != "" {
+		data, err := os.ReadFile(c.cfg.TokenFile)
+		if err != nil {
+			return fmt.Errorf("reading Vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	u := strings.TrimSuffix(c.cfg.Address, "/") + "/v1/" + strings.Trim(c.cfg.Mount, "/") + "/" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if c.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.cfg.Namespace)
+	}
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var secret struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("parsing Vault response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(secret.Errors) > 0 {
+			return fmt.Errorf("Vault returned %s: %s", resp.Status, strings.Join(secret.Errors, "; "))
+		}
+		return fmt.Errorf("Vault returned %s", resp.Status)
+	}
+	if err := json.Unmarshal(secret.Data, v); err != nil {
+		return fmt.Errorf("parsing Vault secret: %w", err)
+	}
+	return nil
+}
+
+// vaultTokenSource obtains OAuth2 access tokens from the roleset.
+type vaultTokenSource struct {
+	ctx   context.Context
+	vault *vaultClient
+}
+
+func (s *vaultTokenSource) Token() (*oauth2.Token, error) {
+	var secret struct {
+		Token            string `json:"token"`
+		ExpiresAtSeconds int64  `json:"expires_at_seconds"`
+	}
+	if err := s.vault.read(s.ctx, "roleset/"+url.PathEscape(s.vault.cfg.Roleset)+"/token", &secret); err != nil {
+		return nil, fmt.Errorf("authclient: failed to get an access token from Vault roleset %s: %w", s.vault.cfg.Roleset, err)
+	}
+	tok := &oauth2.Token{AccessToken: secret.Token, TokenType: "Bearer"}
+	if secret.ExpiresAtSeconds > 0 {
+		tok.Expiry = time.Unix(secret.ExpiresAtSeconds, 0)
+	}
+	return tok, nil
+}
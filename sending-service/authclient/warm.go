@@ -0,0 +1,136 @@
+package authclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Defaults of WarmSettings.
+const (
+	defaultWarmPath    = "/"
+	defaultWarmTimeout = 5 * time.Second
+)
+
+// Results of warm pings, as reported to a WarmObserver.
+const (
+	// WarmReused is a ping sent on a pooled connection, which was still
+	// warm.
+	WarmReused = "reused"
+	// WarmNew is a ping that had to open a connection, because the pool
+	// held fewer warm connections than the pings sent at once.
+	WarmNew = "new"
+	// WarmFailed is a ping that got no response, or an error status.
+	WarmFailed = "failed"
+)
+
+// WarmObserver is told about each ping sent by Warm, for example to export
+// metrics.
+type WarmObserver interface {
+	WarmPing(audience, result string)
+}
+
+// WarmSettings configures Warm.
+type WarmSettings struct {
+	// Conns is how many pings are sent at once, and so how many
+	// connections are kept open to a receiving service that speaks
+	// HTTP/1.1. Over HTTP/2 the pings share one connection. Zero means 1.
+	// The transport's MaxIdleConnsPerHost must be at least Conns for the
+	// connections to be kept between rounds.
+	Conns int
+	// Path is the path pinged with HEAD requests, resolved against the
+	// client's base URL. Empty means /.
+	Path string
+	// Timeout bounds each ping. Zero means 5 seconds.
+	Timeout time.Duration
+	// Observer, if set, is told about each ping.
+	Observer WarmObserver
+}
+
+// Warm sends s.Conns authenticated HEAD requests for s.Path at once, so
+// that the client holds that many warm connections, with their TLS
+// handshakes done and a valid ID token, and the receiving service an
+// instance that has served a request recently. Sent at an interval shorter
+// than the transport's idle connection timeout, the pings spare the next
+// real request the cost of connecting after an idle period. Pings are not
+// retried. Warm returns the first error of a ping that got no response or
+// an error status.
+func (c *Client) Warm(ctx context.Context, s WarmSettings) error {
+	conns, path, timeout := s.Conns, s.Path, s.Timeout
+	if conns < 1 {
+		conns = 1
+	}
+	if path == "" {
+		path = defaultWarmPath
+	}
+	if timeout <= 0 {
+		timeout = defaultWarmTimeout
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.ping(ctx, path, timeout, s.Observer); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return first
+}
+
+// ping sends one warm ping and reports its result to observer.
+func (c *Client) ping(ctx context.Context, path string, timeout time.Duration, observer WarmObserver) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		reused bool
+	)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			reused = info.Reused
+			mu.Unlock()
+		},
+	})
+	req, err := c.NewRequest(ctx, http.MethodHead, path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Call(ctx, req, NoRetry())
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError || rejected(resp) {
+			err = &DownstreamStatusError{Code: resp.StatusCode, Status: resp.Status, Header: resp.Header}
+		}
+	}
+	if observer != nil {
+		result := WarmNew
+		mu.Lock()
+		switch {
+		case err != nil:
+			result = WarmFailed
+		case reused:
+			result = WarmReused
+		}
+		mu.Unlock()
+		observer.WarmPing(c.audience, result)
+	}
+	return err
+}
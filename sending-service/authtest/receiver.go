@@ -0,0 +1,90 @@
+package authtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Request is a request received by a Receiver.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	// Claims are the claims of the verified token, or nil if the request
+	// was rejected.
+	Claims map[string]interface{}
+}
+
+// Receiver is a stub receiving service. It verifies the ID token of every
+// request against its Issuer, like a Cloud Run service requiring
+// authentication, and records the request.
+type Receiver struct {
+	*httptest.Server
+
+	issuer   *Issuer
+	audience string
+	handler  http.Handler
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+// NewReceiver starts a stub receiving service that accepts tokens minted by
+// issuer for audience, or for its own URL if audience is empty. Verified
+// requests are passed to handler, which defaults to one answering "Hello
+// from the receiving service!". Requests without a valid token get 401, as
+// from Cloud Run's IAM layer. Call Close when done.
+func NewReceiver(issuer *Issuer, audience string, handler http.Handler) *Receiver {
+	if handler == nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "Hello from the receiving service!")
+		})
+	}
+	r := &Receiver{issuer: issuer, handler: handler}
+	r.Server = httptest.NewUnstartedServer(http.HandlerFunc(r.serve))
+	r.Start()
+	r.audience = audience
+	if r.audience == "" {
+		r.audience = r.URL
+	}
+	return r
+}
+
+// Audience returns the audience the receiver accepts.
+func (r *Receiver) Audience() string {
+	return r.audience
+}
+
+// Requests returns the requests received so far.
+func (r *Receiver) Requests() []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Request(nil), r.requests...)
+}
+
+func (r *Receiver) serve(w http.ResponseWriter, req *http.Request) {
+	rec := Request{Method: req.Method, Path: req.URL.Path, Header: req.Header.Clone()}
+	defer func() {
+		r.mu.Lock()
+		r.requests = append(r.requests, rec)
+		r.mu.Unlock()
+	}()
+
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	claims, err := r.issuer.Verify(token, r.audience)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+	rec.Claims = claims
+	r.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,194 @@
+// Package broker serves /token, which mints ID tokens on behalf of other
+// services: a caller that proves its identity with its own Google-signed
+// ID token gets a token the sending service minted for one of the
+// audiences a grant allows it, identifying the sending service.
+// Services that cannot easily mint tokens themselves, such as jobs outside
+// Google Cloud or tools without Application Default Credentials, can then
+// call receiving services through one audited, policy-controlled place.
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"sender/admin"
+	"sender/apierror"
+	"sender/logging"
+)
+
+// Grant lets callers obtain ID tokens for audiences.
+type Grant struct {
+	// Callers are the emails of the accounts the grant applies to. They
+	// may be path.Match patterns, such as
+	// *@my-project.iam.gserviceaccount.com.
+	Callers []string `json:"callers" yaml:"callers"`
+	// Audiences are the audiences the callers may obtain ID tokens for,
+	// such as the URL of a receiving service.
+	Audiences []string `json:"audiences" yaml:"audiences"`
+}
+
+// ValidateGrants reports the problems of grants.
+func ValidateGrants(grants []Grant) []error {
+	var errs []error
+	for i, g := range grants {
+		if len(g.Callers) == 0 {
+			errs = append(errs, fmt.Errorf("token broker grant %d has no callers", i))
+		}
+		if len(g.Audiences) == 0 {
+			errs = append(errs, fmt.Errorf("token broker grant %d has no audiences", i))
+		}
+		for _, c := range g.Callers {
+			if _, err := path.Match(c, ""); err != nil {
+				errs = append(errs, fmt.Errorf("token broker grant %d: invalid caller pattern %q", i, c))
+			}
+		}
+		for _, a := range g.Audiences {
+			if a == "" || strings.ContainsAny(a, " \t") {
+				errs = append(errs, fmt.Errorf("token broker grant %d: invalid audience %q", i, a))
+			}
+		}
+	}
+	return errs
+}
+
+// maxBody is the largest /token request body read.
+const maxBody = 4 << 10
+
+// TokenFunc mints an ID token for audience.
+type TokenFunc func(ctx context.Context, audience string) (*oauth2.Token, error)
+
+// Broker is the handler of /token.
+type Broker struct {
+	audience string
+	grants   []Grant
+	mint     TokenFunc
+}
+
+// New returns a Broker that admits callers with a Google-signed ID token for
+// audience, normally the URL of the sending service, and mints the tokens
+// grants allow them with mint.
+func New(audience string, grants []Grant, mint TokenFunc) *Broker {
+	return &Broker{audience: audience, grants: grants, mint: mint}
+}
+
+// Allows reports whether a grant lets caller obtain ID tokens for audience.
+func (b *Broker) Allows(caller, audience string) bool {
+	caller = strings.ToLower(caller)
+	for _, g := range b.grants {
+		if !containsAudience(g.Audiences, audience) {
+			continue
+		}
+		for _, pattern := range g.Callers {
+			if ok, _ := path.Match(strings.ToLower(pattern), caller); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsAudience(audiences []string, audience string) bool {
+	for _, a := range audiences {
+		if strings.TrimSuffix(a, "/") == strings.TrimSuffix(audience, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenRequest is the body of a POST /token request.
+type tokenRequest struct {
+	Audience string `json:"audience"`
+}
+
+// tokenResponse is the body of a /token response.
+type tokenResponse struct {
+	IDToken   string    `json:"id_token"`
+	TokenType string    `json:"token_type"`
+	Audience  string    `json:"audience"`
+	Expiry    time.Time `json:"expiry"`
+	ExpiresIn int64     `json:"expires_in"`
+}
+
+// ServeHTTP answers POST /token with an ID token for the audience in the
+// request's JSON or form body, or its ?audience= query parameter, if a
+// grant allows the caller it. Each token handed out is logged with the
+// caller and audience.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		apierror.Write(w, r, apierror.New(http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Use POST to obtain a token"))
+		return
+	}
+	caller, ok := admin.Authenticate(w, r, b.audience)
+	if !ok {
+		return
+	}
+	logger := logging.FromContext(r.Context()).With(slog.String("caller", caller))
+
+	audience, problem := requestedAudience(w, r)
+	if problem != "" {
+		apierror.Write(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, problem))
+		return
+	}
+	if !b.Allows(caller, audience) {
+		logger.Warn("Refused to broker an ID token for an audience not granted", slog.String("audience", audience))
+		apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodeAudienceNotAllowed, "Caller may not obtain tokens for this audience"))
+		return
+	}
+	tok, err := b.mint(r.Context(), audience)
+	if err != nil {
+		logger.Error("Failed to mint a brokered ID token", slog.String("audience", audience), slog.Any("error", err))
+		apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeTokenUnavailable, "Failed to obtain an ID token"))
+		return
+	}
+	logger.Info("Brokered ID token", slog.String("audience", audience), slog.Time("expiry", tok.Expiry))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokenResponse{
+		IDToken:   tok.AccessToken,
+		TokenType: "Bearer",
+		Audience:  audience,
+		Expiry:    tok.Expiry,
+		ExpiresIn: int64(time.Until(tok.Expiry).Seconds()),
+	})
+}
+
+// requestedAudience returns the audience a /token request asks for, or
+// why the request is not valid.
+func requestedAudience(w http.ResponseWriter, r *http.Request) (string, string) {
+	audience := r.URL.Query().Get("audience")
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var req tokenRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody)).Decode(&req); err != nil {
+			return "", "Request body is not valid JSON"
+		}
+		if req.Audience != "" {
+			audience = req.Audience
+		}
+	case "application/x-www-form-urlencoded":
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		if err := r.ParseForm(); err != nil {
+			return "", "Request body is not a valid form"
+		}
+		if a := r.PostForm.Get("audience"); a != "" {
+			audience = a
+		}
+	}
+	if audience == "" {
+		return "", "Missing audience"
+	}
+	return audience, ""
+}
@@ -0,0 +1,290 @@
+// Package browser lets browsers call the sending service as a backend for
+// their frontend: requests carry the signed-in user's Firebase or Google
+// ID token instead of a service's, the token is verified, and downstream
+// calls are sent with the sending service's own identity and the user
+// described in the X-User-Context header. The user's token itself never
+// leaves the sending service, and requests authenticated by cookie must
+// come from an allowed origin, so other sites cannot forge them.
+package browser
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/logging"
+)
+
+// UserContextHeader carries the verified user to downstream services, as
+// base64url-encoded JSON of a User.
+const UserContextHeader = "X-User-Context"
+
+// Providers of a User.
+const (
+	ProviderFirebase = "firebase"
+	ProviderGoogle   = "google"
+)
+
+// googleIssuers are the issuers of Google-signed ID tokens.
+var googleIssuers = map[string]bool{
+	"accounts.google.com":         true,
+	"https://accounts.google.com": true,
+}
+
+// User is the verified end user of a request.
+type User struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Issuer        string `json:"iss"`
+	// Provider is ProviderFirebase or ProviderGoogle.
+	Provider string `json:"provider"`
+	// SignInProvider is how the user signed in to Firebase, such as
+	// password or google.com.
+	SignInProvider string `json:"sign_in_provider,omitempty"`
+	// Tenant is the Identity Platform tenant of the user, if any.
+	Tenant string `json:"tenant,omitempty"`
+	// AuthTime is when the user signed in, in seconds since the epoch.
+	AuthTime int64 `json:"auth_time,omitempty"`
+}
+
+type userKey struct{}
+
+// verifiedUser is the user stored in a request context by the middleware,
+// with the value of its X-User-Context header.
+type verifiedUser struct {
+	user   *User
+	header string
+}
+
+// UserFromContext returns the user verified by the middleware, if any.
+func UserFromContext(ctx context.Context) (*User, bool) {
+	v, ok := ctx.Value(userKey{}).(*verifiedUser)
+	if !ok {
+		return nil, false
+	}
+	return v.user, true
+}
+
+// UserContext returns the X-User-Context header value of the user verified
+// by the middleware, if any, for requests sent later than the call that
+// carried the user, such as those queued in the outbox.
+func UserContext(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(userKey{}).(*verifiedUser)
+	if !ok {
+		return "", false
+	}
+	return v.header, true
+}
+
+// Settings configures which end-user tokens are accepted, and from where.
+type Settings struct {
+	// FirebaseProject accepts Firebase Authentication ID tokens of the
+	// project with this ID.
+	FirebaseProject string
+	// GoogleClientIDs accepts Google Sign-In ID tokens issued to these
+	// OAuth client IDs.
+	GoogleClientIDs []string
+	// AllowedOrigins are the origins of the pages that may call the
+	// sending service, such as https://app.example.com. Cross-origin
+	// requests from them get CORS headers; those from other origins are
+	// rejected.
+	AllowedOrigins []string
+	// SessionCookie, if set, names a cookie the ID token is read from when
+	// a request has no Authorization header, such as __session.
+	SessionCookie string
+	// FirebaseKeysURL serves the keys Firebase tokens are signed with. It
+	// defaults to FirebaseKeysURL.
+	FirebaseKeysURL string
+}
+
+// Guard verifies the end users of browser requests.
+type Guard struct {
+	settings Settings
+	firebase *firebaseVerifier
+	clients  map[string]bool
+	origins  map[string]bool
+}
+
+// New returns a Guard for s, which must accept Firebase or Google tokens.
+func New(s Settings) (*Guard, error) {
+	if s.FirebaseProject == "" && len(s.GoogleClientIDs) == 0 {
+		return nil, errors.New("browser: a Firebase project or a Google client ID is required")
+	}
+	g := &Guard{settings: s, clients: map[string]bool{}, origins: map[string]bool{}}
+	if s.FirebaseProject != "" {
+		keysURL := s.FirebaseKeysURL
+		if keysURL == "" {
+			keysURL = FirebaseKeysURL
+		}
+		g.firebase = &firebaseVerifier{project: s.FirebaseProject, keys: newKeySet(keysURL)}
+	}
+	for _, id := range s.GoogleClientIDs {
+		g.clients[id] = true
+	}
+	for _, o := range s.AllowedOrigins {
+		origin, err := ParseOrigin(o)
+		if err != nil {
+			return nil, err
+		}
+		g.origins[origin] = true
+	}
+	return g, nil
+}
+
+// ParseOrigin checks that o is an origin, a scheme and host without a
+// path, and returns it in the form browsers send.
+func ParseOrigin(o string) (string, error) {
+	u, err := url.Parse(o)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return "", fmt.Errorf("browser: %q is not an origin such as https://app.example.com", o)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// Verify returns the user of an end-user ID token.
+func (g *Guard) Verify(ctx context.Context, token string) (*User, error) {
+	payload, err := idtoken.ParsePayload(token)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	switch {
+	case g.firebase != nil && strings.HasPrefix(payload.Issuer, firebaseIssuerPrefix):
+		return g.firebase.verify(ctx, token)
+	case len(g.clients) > 0 && googleIssuers[payload.Issuer]:
+		if !g.clients[payload.Audience] {
+			return nil, fmt.Errorf("browser: token for client %q, which is not allowed", payload.Audience)
+		}
+		payload, err := idtoken.Validate(ctx, token, payload.Audience)
+		if err != nil {
+			return nil, err
+		}
+		u := &User{Subject: payload.Subject, Issuer: payload.Issuer, Provider: ProviderGoogle}
+		u.Email, _ = payload.Claims["email"].(string)
+		u.EmailVerified, _ = payload.Claims["email_verified"].(bool)
+		u.Name, _ = payload.Claims["name"].(string)
+		return u, nil
+	}
+	return nil, fmt.Errorf("browser: token issued by %q, which is not accepted", payload.Issuer)
+}
+
+// Middleware returns a handler that calls next only for requests with a
+// valid end-user ID token, in the Authorization header or in the session
+// cookie, and otherwise answers 401 Unauthorized. next gets the request
+// without the token or cookies, with the user stored in its context and
+// sent to downstream services in X-User-Context, a header the caller
+// cannot set itself.
+//
+// Cross-origin requests from the allowed origins are answered with CORS
+// headers, and preflight requests from them with 204 No Content; those
+// from other origins are rejected with 403 Forbidden. Requests that could
+// change state and are authenticated by cookie, which browsers attach to
+// requests other sites make, must also come from an allowed origin or the
+// same origin.
+func (g *Guard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.FromContext(r.Context())
+		origin := r.Header.Get("Origin")
+		if origin != "" && !g.sameOrigin(r) {
+			if !g.origins[strings.ToLower(origin)] {
+				logger.Warn("Rejected browser request from origin not allowed", slog.String("origin", origin))
+				apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodePermissionDenied, "Origin not allowed"))
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		token, fromCookie := g.token(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthenticated, "Missing ID token"))
+			return
+		}
+		if fromCookie && !safeMethod(r.Method) && !g.trustedOrigin(r) {
+			logger.Warn("Rejected cookie-authenticated browser request without an allowed origin", slog.String("method", r.Method))
+			apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodePermissionDenied, "Cross-site request rejected"))
+			return
+		}
+		user, err := g.Verify(r.Context(), token)
+		if err != nil {
+			logger.Warn("Rejected browser request with invalid ID token", slog.Any("error", err))
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthenticated, "Invalid ID token"))
+			return
+		}
+
+		encoded, _ := json.Marshal(user)
+		header := base64.RawURLEncoding.EncodeToString(encoded)
+		ctx := context.WithValue(r.Context(), userKey{}, &verifiedUser{user: user, header: header})
+		ctx = authclient.CallContext(ctx, authclient.CallHeader(UserContextHeader, header))
+		r = r.WithContext(ctx)
+		r.Header = r.Header.Clone()
+		r.Header.Del("Authorization")
+		r.Header.Del("Cookie")
+		r.Header.Del(UserContextHeader)
+		r.Header.Del(authclient.ForwardedAuthorizationHeader)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// token returns the ID token of r, and whether it came from the session
+// cookie.
+func (g *Guard) token(r *http.Request) (string, bool) {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return token, false
+	}
+	if g.settings.SessionCookie == "" {
+		return "", false
+	}
+	c, err := r.Cookie(g.settings.SessionCookie)
+	if err != nil {
+		return "", false
+	}
+	return c.Value, true
+}
+
+// trustedOrigin reports whether r was made by a page of an allowed origin
+// or of the sending service itself, by its Origin header, or its Referer
+// or Sec-Fetch-Site headers for browsers that do not send one.
+func (g *Guard) trustedOrigin(r *http.Request) bool {
+	if g.sameOrigin(r) {
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return g.origins[strings.ToLower(origin)]
+	}
+	if ref, err := url.Parse(r.Header.Get("Referer")); err == nil && ref.Host != "" {
+		return g.origins[strings.ToLower(ref.Scheme+"://"+ref.Host)]
+	}
+	return false
+}
+
+// sameOrigin reports whether the browser says r comes from a page of the
+// sending service itself.
+func (g *Guard) sameOrigin(r *http.Request) bool {
+	return r.Header.Get("Sec-Fetch-Site") == "same-origin"
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
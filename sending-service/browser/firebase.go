@@ -0,0 +1,230 @@
+package browser
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FirebaseKeysURL serves the keys Firebase Authentication signs ID tokens
+// with, as a JSON Web Key Set.
+const FirebaseKeysURL = "https://www.googleapis.com/service_accounts/v1/jwk/securetoken@system.gserviceaccount.com"
+
+// firebaseIssuerPrefix, followed by the project ID, is the issuer of a
+// Firebase ID token.
+const firebaseIssuerPrefix = "https://securetoken.google.com/"
+
+const (
+	// clockSkew is how far the clocks of Firebase and the sending service
+	// may disagree about a token's times.
+	clockSkew = time.Minute
+	// minKeyRefresh is how often the keys are fetched again at most, when
+	// a token is signed with a key that is not in the cached set.
+	minKeyRefresh = time.Minute
+	// defaultKeyTTL is how long keys are cached when the response does not
+	// say.
+	defaultKeyTTL = time.Hour
+)
+
+var errInvalidToken = errors.New("browser: invalid ID token")
+
+// firebaseVerifier verifies Firebase ID tokens for a project.
+type firebaseVerifier struct {
+	project string
+	keys    *keySet
+}
+
+// firebaseClaims are the claims of a Firebase ID token.
+type firebaseClaims struct {
+	Issuer        string         `json:"iss"`
+	Audience      string         `json:"aud"`
+	Subject       string         `json:"sub"`
+	IssuedAt      int64          `json:"iat"`
+	Expires       int64          `json:"exp"`
+	AuthTime      int64          `json:"auth_time"`
+	Email         string         `json:"email"`
+	EmailVerified bool           `json:"email_verified"`
+	Name          string         `json:"name"`
+	Firebase      firebaseSignIn `json:"firebase"`
+}
+
+type firebaseSignIn struct {
+	SignInProvider string `json:"sign_in_provider"`
+	Tenant         string `json:"tenant"`
+}
+
+// verify checks the signature, issuer, audience and times of token.
+func (v *firebaseVerifier) verify(ctx context.Context, token string) (*User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errInvalidToken
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("browser: unexpected token algorithm %q", header.Alg)
+	}
+	key, err := v.keys.get(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("browser: invalid token signature")
+	}
+
+	var c firebaseClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, errInvalidToken
+	}
+	now := time.Now()
+	switch {
+	case c.Issuer != firebaseIssuerPrefix+v.project:
+		return nil, fmt.Errorf("browser: token issued by %q, not project %s", c.Issuer, v.project)
+	case c.Audience != v.project:
+		return nil, fmt.Errorf("browser: token for audience %q, not project %s", c.Audience, v.project)
+	case c.Subject == "":
+		return nil, fmt.Errorf("browser: token has no subject")
+	case now.After(time.Unix(c.Expires, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("browser: token expired")
+	case now.Add(clockSkew).Before(time.Unix(c.IssuedAt, 0)), now.Add(clockSkew).Before(time.Unix(c.AuthTime, 0)):
+		return nil, fmt.Errorf("browser: token issued in the future")
+	}
+	return &User{
+		Subject:        c.Subject,
+		Email:          c.Email,
+		EmailVerified:  c.EmailVerified,
+		Name:           c.Name,
+		Issuer:         c.Issuer,
+		Provider:       ProviderFirebase,
+		SignInProvider: c.Firebase.SignInProvider,
+		Tenant:         c.Firebase.Tenant,
+		AuthTime:       c.AuthTime,
+	}, nil
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a token.
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// keySet caches the RSA keys of a JSON Web Key Set, fetching them again
+// once they expire or a token names a key the set lacks.
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	expires time.Time
+	fetched time.Time
+}
+
+func newKeySet(url string) *keySet {
+	return &keySet{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// get returns the key with ID kid.
+func (s *keySet) get(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	key, ok := s.keys[kid]
+	if ok && now.Before(s.expires) {
+		return key, nil
+	}
+	if !ok && now.Sub(s.fetched) < minKeyRefresh && now.Before(s.expires) {
+		return nil, fmt.Errorf("browser: token signed with unknown key %q", kid)
+	}
+	if err := s.fetch(ctx); err != nil {
+		if ok {
+			// Keep using a known key while the set cannot be fetched.
+			return key, nil
+		}
+		return nil, err
+	}
+	if key, ok = s.keys[kid]; !ok {
+		return nil, fmt.Errorf("browser: token signed with unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// fetch replaces the cached keys with those served at s.url.
+func (s *keySet) fetch(ctx context.Context) error {
+	s.fetched = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("browser: failed to fetch signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("browser: failed to fetch signing keys: %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("browser: failed to decode signing keys: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	s.keys = keys
+	s.expires = s.fetched.Add(maxAge(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+// maxAge returns the max-age of a Cache-Control header, or defaultKeyTTL.
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return defaultKeyTTL
+}
@@ -0,0 +1,111 @@
+// Package buildinfo describes the build of the sending service: its
+// version, the commit it was built from and when, so that changes in
+// behavior can be correlated with deployments. The values are set at build
+// time with -ldflags, as the Dockerfile does:
+//
+//	go build -ldflags "-X sender/buildinfo.Version=1.4.2 -X sender/buildinfo.Commit=$(git rev-parse HEAD) -X sender/buildinfo.Time=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// and otherwise read from the module and version control information the
+// Go toolchain embeds in the binary.
+package buildinfo
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"sender/apierror"
+)
+
+// Set with -ldflags -X.
+var (
+	Version string
+	Commit  string
+	Time    string
+)
+
+// Info describes a build.
+type Info struct {
+	// Version is the version the service was built as, empty if unknown.
+	Version string `json:"version,omitempty"`
+	// Commit is the revision of the source it was built from.
+	Commit string `json:"commit,omitempty"`
+	// Time is when the commit was made or the binary built, in RFC 3339.
+	Time string `json:"time,omitempty"`
+	// Modified is set if the source had uncommitted changes.
+	Modified bool `json:"modified,omitempty"`
+	// GoVersion is the Go toolchain it was built with.
+	GoVersion string `json:"go_version"`
+	// Revision is the Cloud Run revision running it, from K_REVISION.
+	Revision string `json:"revision,omitempty"`
+}
+
+var (
+	once sync.Once
+	info Info
+)
+
+// Get returns the build of the running binary.
+func Get() Info {
+	once.Do(func() {
+		info = Info{Version: Version, Commit: Commit, Time: Time, GoVersion: runtime.Version(), Revision: os.Getenv("K_REVISION")}
+		bi, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Time == "" {
+					info.Time = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	})
+	return info
+}
+
+// ShortCommit returns the first 12 characters of the commit.
+func (i Info) ShortCommit() string {
+	if len(i.Commit) > 12 {
+		return i.Commit[:12]
+	}
+	return i.Commit
+}
+
+// LogValue implements slog.LogValuer.
+func (i Info) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("version", i.Version),
+		slog.String("commit", i.Commit),
+		slog.String("time", i.Time),
+		slog.Bool("modified", i.Modified),
+		slog.String("go_version", i.GoVersion),
+		slog.String("revision", i.Revision),
+	)
+}
+
+// Handler serves the build as JSON, for GET /version.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apierror.Write(w, r, apierror.New(http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Use GET to read the build"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(Get())
+}
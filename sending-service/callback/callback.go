@@ -0,0 +1,370 @@
+// Package callback implements asynchronous calls whose result the
+// downstream service sends back later. The call carries the URL and ID of
+// a callback registered beforehand; the service answers at once, does the
+// work, and POSTs the result to the URL with an ID token of its own, which
+// is verified and matched to the call it answers.
+package callback
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/api/idtoken"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/downstream"
+	"sender/logging"
+)
+
+// Headers of a call answered with a callback.
+const (
+	// URLHeader carries the URL the result is sent to.
+	URLHeader = "X-Callback-Url"
+	// IDHeader carries the callback's ID, which is also the last segment
+	// of the URL.
+	IDHeader = "X-Callback-Id"
+)
+
+// Defaults of a Registry.
+const (
+	DefaultTTL         = time.Hour
+	DefaultMaxBodySize = 1 << 20
+)
+
+// ErrNotFound is returned for a callback that was never registered or
+// has expired.
+var ErrNotFound = errors.New("callback: not found")
+
+// googleIssuers are the issuers of Google-signed ID tokens.
+var googleIssuers = map[string]bool{
+	"accounts.google.com":         true,
+	"https://accounts.google.com": true,
+}
+
+// Callback is a registered callback, and its result once received.
+type Callback struct {
+	ID string `json:"id"`
+	// URL is where the result is sent.
+	URL string `json:"url"`
+	// Service is the downstream service the call went to.
+	Service string `json:"service"`
+	// RequestID is the ID of the request that made the call, which the
+	// callback is logged with.
+	RequestID string    `json:"request_id,omitempty"`
+	Created   time.Time `json:"created"`
+
+	// Done is set once the result is received, from Caller.
+	Done        bool      `json:"done,omitempty"`
+	Received    time.Time `json:"received"`
+	Caller      string    `json:"caller,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+}
+
+// Attach sets the callback headers of a call on h.
+func (c *Callback) Attach(h http.Header) {
+	h.Set(URLHeader, c.URL)
+	h.Set(IDHeader, c.ID)
+}
+
+// Registry registers callbacks and receives their results. It keeps them
+// in a store shared by every instance of the sending service, such as
+// Redis, since the result may be sent to any instance.
+type Registry struct {
+	store    authclient.ResponseStore
+	baseURL  string
+	path     string
+	audience string
+	callers  map[string]bool
+	ttl      time.Duration
+	maxBody  int64
+}
+
+// Option configures a Registry.
+type Option func(*Registry)
+
+// WithAudience sets the audience of the ID tokens results must carry. It
+// defaults to the scheme and host of the base URL.
+func WithAudience(audience string) Option {
+	return func(r *Registry) {
+		r.audience = audience
+	}
+}
+
+// WithAllowedCallers sets the emails of the service accounts results may be
+// sent by, normally those of the downstream services.
+func WithAllowedCallers(callers []string) Option {
+	return func(r *Registry) {
+		for _, c := range callers {
+			r.callers[strings.ToLower(strings.TrimSpace(c))] = true
+		}
+	}
+}
+
+// WithTTL sets how long a result is awaited, and then kept. It defaults to
+// DefaultTTL.
+func WithTTL(ttl time.Duration) Option {
+	return func(r *Registry) {
+		r.ttl = ttl
+	}
+}
+
+// WithMaxBodySize bounds the size of results. It defaults to
+// DefaultMaxBodySize.
+func WithMaxBodySize(n int64) Option {
+	return func(r *Registry) {
+		r.maxBody = n
+	}
+}
+
+// NewRegistry creates a Registry keeping callbacks in store, whose results
+// are sent to baseURL followed by the callback ID, as in
+// https://sending-service-xyz.a.run.app/callbacks/{id}. Serve Handler at
+// the path of baseURL.
+func NewRegistry(store authclient.ResponseStore, baseURL string, opts ...Option) (*Registry, error) {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	audience, err := downstream.AudienceForURL(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("callback: %w", err)
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("callback: %w", err)
+	}
+	if u.Path == "/" {
+		return nil, fmt.Errorf("callback: %s has no path, such as /callbacks/, to serve callbacks at", baseURL)
+	}
+	r := &Registry{
+		store:    store,
+		baseURL:  baseURL,
+		audience: audience,
+		callers:  make(map[string]bool),
+		ttl:      DefaultTTL,
+		maxBody:  DefaultMaxBodySize,
+	}
+	r.path = u.Path
+	for _, opt := range opts {
+		opt(r)
+	}
+	if len(r.callers) == 0 {
+		return nil, errors.New("callback: at least one allowed caller is required")
+	}
+	return r, nil
+}
+
+// Path returns the path Handler must be served at.
+func (r *Registry) Path() string {
+	return r.path
+}
+
+// Register registers a callback for a call to service, made while handling
+// the request ctx belongs to.
+func (r *Registry) Register(ctx context.Context, service string) (*Callback, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+	c := &Callback{
+		ID:        id,
+		URL:       r.baseURL + id,
+		Service:   service,
+		RequestID: logging.RequestID(ctx),
+		Created:   time.Now().UTC(),
+	}
+	if err := r.put(ctx, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get returns the callback with the given ID, or ErrNotFound.
+func (r *Registry) Get(ctx context.Context, id string) (*Callback, error) {
+	data, ok, err := r.store.Get(ctx, key(id))
+	if err != nil {
+		return nil, fmt.Errorf("callback: failed to read callback: %w", err)
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var c Callback
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("callback: invalid stored callback: %w", err)
+	}
+	return &c, nil
+}
+
+func (r *Registry) put(ctx context.Context, c *Callback) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := r.store.Set(ctx, key(c.ID), data, r.ttl); err != nil {
+		return fmt.Errorf("callback: failed to store callback: %w", err)
+	}
+	return nil
+}
+
+func key(id string) string {
+	return "callback:" + id
+}
+
+// Handler serves the callbacks under the registry's path. A POST delivers
+// the result of a callback: it must carry a Google-signed ID token for the
+// registry's audience from one of the allowed callers, and is answered with
+// 204 No Content, or 409 Conflict if the result was already delivered. A
+// GET returns the result once delivered, with its content type, and 202
+// Accepted until then. The callback ID is unguessable, so it is what
+// authorizes a GET.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, r.path)
+		if id == "" || strings.Contains(id, "/") {
+			apierror.Write(w, req, apierror.New(http.StatusNotFound, apierror.CodeNotFound, "Unknown callback"))
+			return
+		}
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			r.serveResult(w, req, id)
+		case http.MethodPost:
+			r.receive(w, req, id)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			apierror.Write(w, req, apierror.New(http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed"))
+		}
+	})
+}
+
+func (r *Registry) serveResult(w http.ResponseWriter, req *http.Request, id string) {
+	c, ok := r.lookup(w, req, id)
+	if !ok {
+		return
+	}
+	if !c.Done {
+		w.Header().Set("Location", req.URL.Path)
+		w.Header().Set("Retry-After", "5")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}{c.ID, "pending"})
+		return
+	}
+	if c.ContentType != "" {
+		w.Header().Set("Content-Type", c.ContentType)
+	}
+	w.Write(c.Body)
+}
+
+func (r *Registry) receive(w http.ResponseWriter, req *http.Request, id string) {
+	caller, ok := r.verify(w, req)
+	if !ok {
+		return
+	}
+	if h := req.Header.Get(IDHeader); h != "" && h != id {
+		apierror.Write(w, req, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "Callback ID does not match the URL"))
+		return
+	}
+	c, ok := r.lookup(w, req, id)
+	if !ok {
+		return
+	}
+	logger := logging.FromContext(req.Context()).With(
+		slog.String("callback_id", id),
+		slog.String("service", c.Service),
+		slog.String("original_request_id", c.RequestID),
+		slog.String("caller", caller),
+	)
+	if c.Done {
+		logger.Warn("Rejected duplicate callback")
+		apierror.Write(w, req, apierror.New(http.StatusConflict, apierror.CodeConflict, "Callback result already delivered"))
+		return
+	}
+	body, err := readBody(w, req, r.maxBody)
+	if err != nil {
+		apierror.Write(w, req, err)
+		return
+	}
+	c.Done = true
+	c.Received = time.Now().UTC()
+	c.Caller = caller
+	c.ContentType = req.Header.Get("Content-Type")
+	c.Body = body
+	if err := r.put(req.Context(), c); err != nil {
+		logger.Error("Failed to store callback result", slog.Any("error", err))
+		apierror.Write(w, req, apierror.New(http.StatusServiceUnavailable, apierror.CodeInternal, "Failed to store the callback result"))
+		return
+	}
+	logger.Info("Received callback", slog.Duration("after", c.Received.Sub(c.Created)), slog.Int("size", len(body)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Registry) lookup(w http.ResponseWriter, req *http.Request, id string) (*Callback, bool) {
+	c, err := r.Get(req.Context(), id)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		apierror.Write(w, req, apierror.New(http.StatusNotFound, apierror.CodeNotFound, "Unknown or expired callback"))
+		return nil, false
+	case err != nil:
+		logging.FromContext(req.Context()).Error("Failed to look up callback", slog.String("callback_id", id), slog.Any("error", err))
+		apierror.Write(w, req, apierror.New(http.StatusServiceUnavailable, apierror.CodeInternal, "Failed to look up the callback"))
+		return nil, false
+	}
+	return c, true
+}
+
+// verify checks the ID token of a delivered result, and returns the email
+// of its caller.
+func (r *Registry) verify(w http.ResponseWriter, req *http.Request) (string, bool) {
+	logger := logging.FromContext(req.Context())
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apierror.Write(w, req, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthenticated, "Missing bearer token"))
+		return "", false
+	}
+	payload, err := idtoken.Validate(req.Context(), token, r.audience)
+	if err == nil && !googleIssuers[payload.Issuer] {
+		err = errors.New("token not issued by Google")
+	}
+	if err != nil {
+		logger.Warn("Rejected callback with invalid ID token", slog.Any("error", err))
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		apierror.Write(w, req, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthenticated, "Invalid ID token"))
+		return "", false
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if !verified || !r.callers[strings.ToLower(email)] {
+		logger.Warn("Rejected callback from caller not allowed", slog.String("caller", email))
+		apierror.Write(w, req, apierror.New(http.StatusForbidden, apierror.CodePermissionDenied, "Caller may not deliver callbacks"))
+		return "", false
+	}
+	return email, true
+}
+
+func readBody(w http.ResponseWriter, req *http.Request, maxBody int64) ([]byte, *apierror.Error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBody))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Callback result is too large")
+	case err != nil:
+		return nil, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "Failed to read callback result")
+	}
+	return body, nil
+}
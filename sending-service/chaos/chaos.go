@@ -0,0 +1,207 @@
+// Package chaos injects faults into downstream calls, so that teams can
+// check that their retry, circuit breaker and timeout settings hold up
+// when a receiving service is slow, unreachable or failing: a share of
+// the attempts that match a rule is delayed, dropped before it is sent,
+// or answered with an error status in place of the receiving service.
+// It is meant for test environments; the sending service logs each fault
+// it injects.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sender/logging"
+)
+
+// Kinds of fault.
+const (
+	// FaultDelay sends the attempt after Delay.
+	FaultDelay = "delay"
+	// FaultDrop fails the attempt with an error wrapping ErrInjected
+	// without sending it, as a connection failure would.
+	FaultDrop = "drop"
+	// FaultError answers the attempt with Status without sending it.
+	FaultError = "error"
+)
+
+// ErrInjected is matched by errors.Is for attempts failed by a drop fault.
+var ErrInjected = errors.New("chaos: injected connection failure")
+
+// InjectedHeader is set on the responses of error faults, so that they can
+// be told apart from real failures.
+const InjectedHeader = "X-Chaos-Injected"
+
+// Rule injects a fault into a share of the downstream calls it matches.
+type Rule struct {
+	// Host, if set, limits the rule to calls to this host, such as
+	// receiving-service-abc123-ew.a.run.app.
+	Host string `json:"host" yaml:"host"`
+	// Path limits the rule to calls to this path: exactly, or, if it ends
+	// in /*, to those under it. It matches every path if empty.
+	Path string `json:"path" yaml:"path"`
+	// Methods, if set, limits the rule to calls with these methods.
+	Methods []string `json:"methods" yaml:"methods"`
+	// Percent is the share of the matching attempts that get the fault,
+	// from 0 to 100.
+	Percent float64 `json:"percent" yaml:"percent"`
+	// Fault is FaultDelay, FaultDrop or FaultError.
+	Fault string `json:"fault" yaml:"fault"`
+	// Delay is how long a delay fault holds the attempt.
+	Delay time.Duration `json:"delay" yaml:"delay"`
+	// Status is the status of the responses of an error fault. It
+	// defaults to 503.
+	Status int `json:"status" yaml:"status"`
+}
+
+// ValidateRules reports the problems of rules.
+func ValidateRules(rules []Rule) []error {
+	var errs []error
+	for i, r := range rules {
+		if r.Percent < 0 || r.Percent > 100 {
+			errs = append(errs, fmt.Errorf("chaos rule %d: percent must be between 0 and 100, got %v", i, r.Percent))
+		}
+		if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+			errs = append(errs, fmt.Errorf("chaos rule %d: path %q must start with /", i, r.Path))
+		}
+		switch r.Fault {
+		case FaultDelay:
+			if r.Delay <= 0 {
+				errs = append(errs, fmt.Errorf("chaos rule %d: a delay fault needs a positive delay", i))
+			}
+		case FaultDrop:
+		case FaultError:
+			if r.Status != 0 && (r.Status < 400 || r.Status > 599) {
+				errs = append(errs, fmt.Errorf("chaos rule %d: status must be between 400 and 599, got %d", i, r.Status))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("chaos rule %d: fault must be %s, %s or %s, got %q", i, FaultDelay, FaultDrop, FaultError, r.Fault))
+		}
+	}
+	return errs
+}
+
+// matches reports whether r applies to req.
+func (r Rule) matches(req *http.Request) bool {
+	if r.Host != "" && !strings.EqualFold(r.Host, req.URL.Host) {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			if strings.EqualFold(m, req.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	switch {
+	case r.Path == "":
+		return true
+	case strings.HasSuffix(r.Path, "/*"):
+		prefix := strings.TrimSuffix(r.Path, "*")
+		return req.URL.Path == strings.TrimSuffix(prefix, "/") || strings.HasPrefix(req.URL.Path, prefix)
+	}
+	return req.URL.Path == r.Path
+}
+
+// Injector injects the faults of its rules.
+type Injector struct {
+	rules []Rule
+	// roll returns a number in [0, 100).
+	roll func() float64
+}
+
+// New returns an Injector for rules. Each attempt gets the fault of the
+// first rule that matches it and whose roll it loses, if any.
+func New(rules []Rule) *Injector {
+	return &Injector{rules: rules, roll: func() float64 { return rand.Float64() * 100 }}
+}
+
+// NewTransport returns a transport that injects faults into the attempts
+// sent with next. Use it with authclient.WithAttemptMiddleware, so that
+// the faults are retried, counted by the circuit breaker and bounded by
+// the attempt timeout like real ones.
+func (in *Injector) NewTransport(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next, injector: in}
+}
+
+type transport struct {
+	next     http.RoundTripper
+	injector *Injector
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rule, ok := t.injector.pick(req)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	logging.FromContext(req.Context()).Info("Injected fault into downstream call",
+		slog.String("fault", rule.Fault),
+		slog.String("method", req.Method),
+		slog.String("host", req.URL.Host),
+		slog.String("path", req.URL.Path))
+
+	switch rule.Fault {
+	case FaultDelay:
+		timer := time.NewTimer(rule.Delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			closeBody(req)
+			return nil, req.Context().Err()
+		}
+		return t.next.RoundTrip(req)
+	case FaultDrop:
+		closeBody(req)
+		return nil, fmt.Errorf("%w to %s", ErrInjected, req.URL.Host)
+	}
+	closeBody(req)
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	body := "injected fault\n"
+	return &http.Response{
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   {"text/plain; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(len(body))},
+			InjectedHeader:   {"true"},
+		},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// pick returns the rule whose fault req gets, if any.
+func (in *Injector) pick(req *http.Request) (Rule, bool) {
+	for _, r := range in.rules {
+		if r.Percent > 0 && r.matches(req) && in.roll() < r.Percent {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
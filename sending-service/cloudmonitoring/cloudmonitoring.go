@@ -0,0 +1,360 @@
+// Package cloudmonitoring writes custom metrics about ID tokens and
+// downstream authentication to Cloud Monitoring, so that services without
+// a Prometheus stack still get dashboards and alerts: token mint latency,
+// token errors and refreshes, 401 and 403 responses by caller, and retries.
+package cloudmonitoring
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+
+	"sender/authclient"
+)
+
+const (
+	// DefaultPrefix is prepended to the name of each metric.
+	DefaultPrefix = "custom.googleapis.com/sender/"
+	// DefaultInterval is how often Run writes the metrics.
+	DefaultInterval = time.Minute
+	// MinInterval is the shortest interval Run accepts; Cloud Monitoring
+	// rejects points written to a time series more often than every five
+	// seconds.
+	MinInterval = 10 * time.Second
+)
+
+// maxSeriesPerRequest is the most time series CreateTimeSeries accepts in
+// one call.
+const maxSeriesPerRequest = 200
+
+// latencyBounds are the bucket bounds of the mint latency distribution, in
+// milliseconds.
+var latencyBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Metric names, relative to the prefix.
+const (
+	metricMintLatency  = "id_token_mint_latency"
+	metricTokenErrors  = "id_token_errors"
+	metricRefreshes    = "id_token_refreshes"
+	metricAuthFailures = "downstream_auth_failures"
+	metricRetries      = "downstream_retries"
+)
+
+var (
+	_ authclient.TokenObserver        = (*Exporter)(nil)
+	_ authclient.TokenLatencyObserver = (*Exporter)(nil)
+	_ authclient.RetryObserver        = (*Exporter)(nil)
+)
+
+// Exporter accumulates metrics in memory and writes them to Cloud Monitoring
+// as cumulative custom metrics. It implements authclient.TokenObserver,
+// authclient.TokenLatencyObserver and authclient.RetryObserver, and records
+// 401 and 403 responses with the transport returned by NewTransport.
+//
+// Writing needs roles/monitoring.metricWriter on the project. The metric
+// descriptors are created by Cloud Monitoring on the first write.
+type Exporter struct {
+	series   *monitoring.ProjectsTimeSeriesService
+	project  string
+	prefix   string
+	caller   string
+	resource *monitoring.MonitoredResource
+	logger   *slog.Logger
+	start    time.Time
+
+	mu       sync.Mutex
+	counters map[string]*counter
+	latency  map[string]*distribution
+}
+
+// Option configures an Exporter.
+type Option func(*Exporter)
+
+// WithPrefix sets the prefix of metric names. It defaults to DefaultPrefix
+// and should start with custom.googleapis.com/ and end with a slash.
+func WithPrefix(prefix string) Option {
+	return func(e *Exporter) {
+		e.prefix = prefix
+	}
+}
+
+// WithCaller sets the caller label of the auth failure metric, which tells
+// apart the services writing to the same project. It defaults to the
+// K_SERVICE environment variable.
+func WithCaller(caller string) Option {
+	return func(e *Exporter) {
+		e.caller = caller
+	}
+}
+
+// WithResource sets the monitored resource the metrics are written for.
+// By default it is a generic_task identifying this instance, located in the
+// Cloud Run region when running on Google Cloud.
+func WithResource(typ string, labels map[string]string) Option {
+	return func(e *Exporter) {
+		e.resource = &monitoring.MonitoredResource{Type: typ, Labels: labels}
+	}
+}
+
+// WithLogger sets the logger Run reports failed writes to.
+func WithLogger(logger *slog.Logger) Option {
+	return func(e *Exporter) {
+		e.logger = logger
+	}
+}
+
+// New creates an Exporter that writes metrics to project, with a Cloud
+// Monitoring client created with clientOpts.
+func New(ctx context.Context, project string, clientOpts []option.ClientOption, opts ...Option) (*Exporter, error) {
+	if project == "" {
+		return nil, errors.New("cloudmonitoring: a project is required")
+	}
+	svc, err := monitoring.NewService(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("cloudmonitoring: failed to create Cloud Monitoring client: %w", err)
+	}
+	e := &Exporter{
+		series:   svc.Projects.TimeSeries,
+		project:  project,
+		prefix:   DefaultPrefix,
+		caller:   os.Getenv("K_SERVICE"),
+		logger:   slog.Default(),
+		start:    time.Now(),
+		counters: make(map[string]*counter),
+		latency:  make(map[string]*distribution),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.resource == nil {
+		e.resource = defaultResource(project, e.caller)
+	}
+	return e, nil
+}
+
+// defaultResource describes this instance as a generic_task, using the
+// Cloud Run environment and metadata server where available so that each
+// instance writes its own time series.
+func defaultResource(project, service string) *monitoring.MonitoredResource {
+	if service == "" {
+		service = "sending-service"
+	}
+	location := "global"
+	job := os.Getenv("K_REVISION")
+	if job == "" {
+		job = service
+	}
+	task, _ := os.Hostname()
+	task = fmt.Sprintf("%s-%d", task, os.Getpid())
+	if metadata.OnGCE() {
+		// The region is returned as projects/{number}/regions/{region}.
+		if region, err := metadata.Get("instance/region"); err == nil {
+			location = region[strings.LastIndex(region, "/")+1:]
+		} else if zone, err := metadata.Zone(); err == nil {
+			location = zone
+		}
+		// Pods on GKE share their node's instance ID, and their host
+		// name is the pod name.
+		if id, err := metadata.InstanceID(); err == nil && !authclient.OnGKE() {
+			task = id
+		}
+	}
+	return &monitoring.MonitoredResource{
+		Type: "generic_task",
+		Labels: map[string]string{
+			"project_id": project,
+			"location":   location,
+			"namespace":  service,
+			"job":        job,
+			"task_id":    task,
+		},
+	}
+}
+
+// TokenMinted implements authclient.TokenObserver. Minted tokens are
+// counted by the mint latency distribution.
+func (e *Exporter) TokenMinted(audience string, expiry time.Time) {}
+
+// TokenMintLatency implements authclient.TokenLatencyObserver.
+func (e *Exporter) TokenMintLatency(audience string, d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dist, ok := e.latency[audience]
+	if !ok {
+		dist = &distribution{buckets: make([]int64, len(latencyBounds)+1)}
+		e.latency[audience] = dist
+	}
+	dist.add(float64(d) / float64(time.Millisecond))
+}
+
+// TokenRefreshed implements authclient.TokenObserver.
+func (e *Exporter) TokenRefreshed(audience string) {
+	e.inc(metricRefreshes, "audience", audience)
+}
+
+// TokenError implements authclient.TokenObserver.
+func (e *Exporter) TokenError(audience string, err error) {
+	e.inc(metricTokenErrors, "audience", audience)
+}
+
+// Retrying implements authclient.RetryObserver.
+func (e *Exporter) Retrying(audience string, attempt, status int) {
+	e.inc(metricRetries, "audience", audience, "code", strconv.Itoa(status))
+}
+
+// NewTransport returns a transport that counts the 401 and 403 responses
+// to requests sent with next, by caller, host and status code.
+func (e *Exporter) NewTransport(next http.RoundTripper) http.RoundTripper {
+	return &authFailureTransport{next: next, exporter: e}
+}
+
+type authFailureTransport struct {
+	next     http.RoundTripper
+	exporter *Exporter
+}
+
+func (t *authFailureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		t.exporter.inc(metricAuthFailures, "caller", t.exporter.caller, "host", req.URL.Host, "code", strconv.Itoa(resp.StatusCode))
+	}
+	return resp, err
+}
+
+// inc adds one to the counter for metric with the given label name and
+// value pairs.
+func (e *Exporter) inc(metric string, labels ...string) {
+	key := metric + "\x00" + strings.Join(labels, "\x00")
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.counters[key]
+	if !ok {
+		c = &counter{metric: metric, labels: make(map[string]string, len(labels)/2)}
+		for i := 0; i+1 < len(labels); i += 2 {
+			c.labels[labels[i]] = labels[i+1]
+		}
+		e.counters[key] = c
+	}
+	c.value++
+}
+
+// Run writes the metrics every interval until stop is closed. Failed
+// writes are logged and made up for at the next interval, since the values
+// are cumulative. Call Export after closing stop to write the last values.
+func (e *Exporter) Run(interval time.Duration, stop <-chan struct{}) {
+	if interval < MinInterval {
+		interval = MinInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval/2)
+			if err := e.Export(ctx); err != nil {
+				e.logger.Warn("Failed to write metrics to Cloud Monitoring", slog.Any("error", err))
+			}
+			cancel()
+		}
+	}
+}
+
+// Export writes the current value of every metric that has been recorded.
+func (e *Exporter) Export(ctx context.Context) error {
+	series := e.snapshot(time.Now())
+	for len(series) > 0 {
+		n := min(len(series), maxSeriesPerRequest)
+		req := &monitoring.CreateTimeSeriesRequest{TimeSeries: series[:n]}
+		if _, err := e.series.Create("projects/"+e.project, req).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("cloudmonitoring: failed to write %d time series: %w", n, err)
+		}
+		series = series[n:]
+	}
+	return nil
+}
+
+// snapshot returns a point for each metric covering the time from the
+// start of the exporter to now.
+func (e *Exporter) snapshot(now time.Time) []*monitoring.TimeSeries {
+	interval := &monitoring.TimeInterval{
+		StartTime: e.start.UTC().Format(time.RFC3339Nano),
+		EndTime:   now.UTC().Format(time.RFC3339Nano),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var series []*monitoring.TimeSeries
+	for _, c := range e.counters {
+		value := c.value
+		series = append(series, &monitoring.TimeSeries{
+			Metric:     &monitoring.Metric{Type: e.prefix + c.metric, Labels: c.labels},
+			Resource:   e.resource,
+			MetricKind: "CUMULATIVE",
+			ValueType:  "INT64",
+			Unit:       "1",
+			Points:     []*monitoring.Point{{Interval: interval, Value: &monitoring.TypedValue{Int64Value: &value}}},
+		})
+	}
+	for audience, d := range e.latency {
+		series = append(series, &monitoring.TimeSeries{
+			Metric:     &monitoring.Metric{Type: e.prefix + metricMintLatency, Labels: map[string]string{"audience": audience}},
+			Resource:   e.resource,
+			MetricKind: "CUMULATIVE",
+			ValueType:  "DISTRIBUTION",
+			Unit:       "ms",
+			Points:     []*monitoring.Point{{Interval: interval, Value: &monitoring.TypedValue{DistributionValue: d.value()}}},
+		})
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Metric.Type < series[j].Metric.Type })
+	return series
+}
+
+type counter struct {
+	metric string
+	labels map[string]string
+	value  int64
+}
+
+// distribution accumulates samples into latencyBounds buckets, keeping the
+// mean and sum of squared deviation with Welford's method.
+type distribution struct {
+	count   int64
+	mean    float64
+	m2      float64
+	buckets []int64
+}
+
+func (d *distribution) add(v float64) {
+	d.count++
+	delta := v - d.mean
+	d.mean += delta / float64(d.count)
+	d.m2 += delta * (v - d.mean)
+	d.buckets[sort.Search(len(latencyBounds), func(i int) bool { return latencyBounds[i] > v })]++
+}
+
+func (d *distribution) value() *monitoring.Distribution {
+	return &monitoring.Distribution{
+		Count:                 d.count,
+		Mean:                  d.mean,
+		SumOfSquaredDeviation: math.Max(d.m2, 0),
+		BucketOptions: &monitoring.BucketOptions{
+			ExplicitBuckets: &monitoring.Explicit{Bounds: latencyBounds},
+		},
+		BucketCounts: append([]int64(nil), d.buckets...),
+	}
+}
@@ -0,0 +1,224 @@
+// Command grant-invoker grants a caller roles/run.invoker on a Cloud Run
+// service through the Cloud Run Admin API, which is the binding a calling
+// service needs before the ID tokens it sends are accepted.
+//
+// Let a calling service's account invoke a receiving service, by URL or
+// by resource name:
+//
+//	grant-invoker -service https://receiving-service-123456789012.europe-west1.run.app \
+//	    -caller calling-service-sa@my-project.iam.gserviceaccount.com
+//
+//	grant-invoker -service projects/my-project/locations/europe-west1/services/receiving-service \
+//	    -caller calling-service-sa@my-project.iam.gserviceaccount.com
+//
+// Show the change without applying it, or take the binding away again:
+//
+//	grant-invoker -service receiving-service -project my-project -region europe-west1 \
+//	    -caller calling-service-sa@my-project.iam.gserviceaccount.com -dry-run
+//
+//	grant-invoker -service receiving-service -project my-project -region europe-west1 \
+//	    -caller calling-service-sa@my-project.iam.gserviceaccount.com -remove
+//
+// It uses Application Default Credentials, which need run.services.getIamPolicy
+// and run.services.setIamPolicy on the service, as roles/run.admin grants.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	run "google.golang.org/api/run/v2"
+
+	"sender/downstream"
+)
+
+// invokerRole is the role Cloud Run checks before a request reaches the
+// service.
+const invokerRole = "roles/run.invoker"
+
+// maxAttempts bounds the read-modify-write cycles tried when the policy is
+// changed concurrently.
+const maxAttempts = 5
+
+func main() {
+	service := flag.String("service", "", "Cloud Run service: a run.app URL of the form https://NAME-PROJECT_NUMBER.REGION.run.app, a resource name, or a name with -project and -region")
+	project := flag.String("project", "", "project of the service, when -service is a name")
+	region := flag.String("region", "", "region of the service, when -service is a name")
+	caller := flag.String("caller", "", "service account email of the caller, or a member such as user:alice@example.com or group:callers@example.com")
+	remove := flag.Bool("remove", false, "remove the binding instead of adding it")
+	dryRun := flag.Bool("dry-run", false, "print the change without applying it")
+	timeout := flag.Duration("timeout", 30*time.Second, "time limit for reading and updating the policy")
+	flag.Parse()
+
+	resource, err := resourceName(*service, *project, *region)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *caller == "" {
+		fatalf("-caller is required")
+	}
+	member := memberFor(*caller)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	client, err := run.NewService(ctx)
+	if err != nil {
+		fatalf("Failed to create Cloud Run Admin API client: %v", err)
+	}
+	changed, err := update(ctx, client.Projects.Locations.Services, resource, member, *remove, *dryRun)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	change := fmt.Sprintf("grant %s to %s on %s", invokerRole, member, resource)
+	if *remove {
+		change = fmt.Sprintf("remove %s from %s on %s", invokerRole, member, resource)
+	}
+	switch {
+	case !changed && *remove:
+		fmt.Printf("%s does not have %s on %s; nothing to do\n", member, invokerRole, resource)
+	case !changed:
+		fmt.Printf("%s already has %s on %s; nothing to do\n", member, invokerRole, resource)
+	case *dryRun:
+		fmt.Printf("Would %s (dry run)\n", change)
+	default:
+		fmt.Printf("Done: %s\n", change)
+	}
+}
+
+// resourceName returns the resource name of the service given with
+// -service, -project and -region.
+func resourceName(service, project, region string) (string, error) {
+	switch {
+	case service == "":
+		return "", errors.New("-service is required")
+	case strings.HasPrefix(service, "projects/"):
+		return service, downstream.ValidateCloudRunResource(service)
+	case strings.Contains(service, "://"):
+		resource, ok := downstream.CloudRunResource(downstream.Service{URL: service})
+		if !ok {
+			return "", fmt.Errorf("cannot tell the project and region of %s; pass the service name with -project and -region, or its resource name", service)
+		}
+		return resource, nil
+	case project == "" || region == "":
+		return "", fmt.Errorf("-project and -region are required with the service name %q", service)
+	}
+	resource := fmt.Sprintf("projects/%s/locations/%s/services/%s", project, region, service)
+	return resource, downstream.ValidateCloudRunResource(resource)
+}
+
+// memberFor returns the IAM member for caller: caller itself if it names
+// its kind, and otherwise a service account or a user, by its domain.
+func memberFor(caller string) string {
+	if strings.Contains(caller, ":") {
+		return caller
+	}
+	if strings.HasSuffix(caller, ".gserviceaccount.com") {
+		return "serviceAccount:" + caller
+	}
+	return "user:" + caller
+}
+
+// update adds member to, or removes it from, the unconditional invoker
+// binding of resource, retrying when another change to the policy won the
+// race, and reports whether the policy needed changing. With dryRun the
+// policy is only read.
+func update(ctx context.Context, services *run.ProjectsLocationsServicesService, resource, member string, remove, dryRun bool) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		policy, err := services.GetIamPolicy(resource).OptionsRequestedPolicyVersion(3).Context(ctx).Do()
+		if err != nil {
+			return false, describe(err, "reading the IAM policy of", resource)
+		}
+		if !apply(policy, member, remove) {
+			return false, nil
+		}
+		if dryRun {
+			return true, nil
+		}
+		_, err = services.SetIamPolicy(resource, &run.GoogleIamV1SetIamPolicyRequest{Policy: policy}).Context(ctx).Do()
+		if err == nil {
+			return true, nil
+		}
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusConflict && attempt < maxAttempts {
+			// The etag is stale: read the policy again.
+			continue
+		}
+		return false, describe(err, "updating the IAM policy of", resource)
+	}
+}
+
+// apply changes policy in place and reports whether it changed. Conditional
+// invoker bindings are left alone, since they grant the role only some of
+// the time.
+func apply(policy *run.GoogleIamV1Policy, member string, remove bool) bool {
+	var binding *run.GoogleIamV1Binding
+	for _, b := range policy.Bindings {
+		if b.Role == invokerRole && b.Condition == nil {
+			binding = b
+			break
+		}
+	}
+	has := false
+	if binding != nil {
+		for _, m := range binding.Members {
+			if strings.EqualFold(m, member) {
+				has = true
+			}
+		}
+	}
+
+	switch {
+	case remove && !has, !remove && has:
+		return false
+	case remove:
+		members := binding.Members[:0]
+		for _, m := range binding.Members {
+			if !strings.EqualFold(m, member) {
+				members = append(members, m)
+			}
+		}
+		binding.Members = members
+		if len(members) == 0 {
+			bindings := policy.Bindings[:0]
+			for _, b := range policy.Bindings {
+				if b != binding {
+					bindings = append(bindings, b)
+				}
+			}
+			policy.Bindings = bindings
+		}
+	case binding == nil:
+		policy.Bindings = append(policy.Bindings, &run.GoogleIamV1Binding{Role: invokerRole, Members: []string{member}})
+	default:
+		binding.Members = append(binding.Members, member)
+	}
+	return true
+}
+
+// describe explains the Admin API errors a misconfiguration causes.
+func describe(err error, doing, resource string) error {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusNotFound:
+			return fmt.Errorf("%s %s: the service does not exist", doing, resource)
+		case http.StatusForbidden:
+			return fmt.Errorf("%s %s: permission denied; the credentials need run.services.getIamPolicy and run.services.setIamPolicy, as in roles/run.admin: %w", doing, resource, err)
+		}
+	}
+	return fmt.Errorf("%s %s: %w", doing, resource, err)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,217 @@
+// Command idtool mints and inspects Google-signed ID tokens, for debugging
+// service-to-service authentication.
+//
+// Mint a token for a Cloud Run service and print its claims:
+//
+//	idtool -audience https://receiving-service-xyz.a.run.app
+//
+// Mint it as another service account and call the service with it:
+//
+//	idtool -audience https://receiving-service-xyz.a.run.app \
+//	    -source impersonate -impersonate calling-service-sa@my-project.iam.gserviceaccount.com \
+//	    -call https://receiving-service-xyz.a.run.app/
+//
+// Inspect an existing token read from standard input:
+//
+//	gcloud auth print-identity-token | idtool -token -
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+
+	"sender/authclient"
+)
+
+func main() {
+	audience := flag.String("audience", "", "audience to mint the token for, normally the URL of the receiving service")
+	source := flag.String("source", "adc", "token source: adc, metadata, impersonate or gcloud")
+	impersonate := flag.String("impersonate", "", "service account to impersonate with -source impersonate or gcloud")
+	token := flag.String("token", "", "inspect this token instead of minting one; - reads it from standard input")
+	verify := flag.Bool("verify", false, "verify the token's signature and audience")
+	call := flag.String("call", "", "send a GET request with the token to this URL")
+	printToken := flag.Bool("print", false, "print the raw token")
+	timeout := flag.Duration("timeout", 30*time.Second, "time limit for minting the token and calling -call")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	raw, err := obtain(ctx, *token, *source, *audience, *impersonate)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *printToken {
+		fmt.Println(raw)
+	}
+
+	if err := inspect(raw); err != nil {
+		fatalf("Failed to decode token: %v", err)
+	}
+
+	if *verify {
+		if _, err := idtoken.Validate(ctx, raw, *audience); err != nil {
+			fatalf("Token is not valid for audience %q: %v", *audience, err)
+		}
+		fmt.Printf("Signature and audience verified\n")
+	}
+
+	if *call != "" {
+		if err := callURL(ctx, *call, raw); err != nil {
+			fatalf("Failed to call %s: %v", *call, err)
+		}
+	}
+}
+
+// obtain returns the token to inspect: the one given with -token, or a new
+// one minted from source.
+func obtain(ctx context.Context, token, source, audience, impersonate string) (string, error) {
+	switch token {
+	case "":
+	case "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		return token, nil
+	}
+
+	if audience == "" {
+		return "", fmt.Errorf("-audience is required to mint a token")
+	}
+
+	var ts oauth2.TokenSource
+	var err error
+	switch source {
+	case "adc":
+		ts, err = idtoken.NewTokenSource(ctx, audience)
+	case "metadata":
+		return metadataToken(audience)
+	case "impersonate":
+		if impersonate == "" {
+			return "", fmt.Errorf("-impersonate is required with -source impersonate")
+		}
+		ts, err = authclient.ImpersonatedTokenSource(impersonate)(ctx, audience)
+	case "gcloud":
+		ts, err = authclient.GcloudTokenSource(impersonate)(ctx, audience)
+	default:
+		return "", fmt.Errorf("unknown source %q", source)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create token source: %w", err)
+	}
+	tok, err := ts.Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to mint token: %w", err)
+	}
+	return tok.AccessToken, nil
+}
+
+// metadataToken asks the metadata server directly, which is what the
+// idtoken package does on Cloud Run, so failures show the server's error.
+func metadataToken(audience string) (string, error) {
+	if !metadata.OnGCE() {
+		return "", fmt.Errorf("metadata server is not available; use -source adc, impersonate or gcloud")
+	}
+	path := "instance/service-accounts/default/identity?format=full&audience=" + url.QueryEscape(audience)
+	tok, err := metadata.Get(path)
+	if err != nil {
+		return "", fmt.Errorf("metadata server: %w", err)
+	}
+	return tok, nil
+}
+
+// inspect prints the header and claims of a JWT and whether it has expired.
+// The signature is not checked.
+func inspect(raw string) error {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("not a JWT: expected 3 segments, got %d", len(parts))
+	}
+
+	var header, claims map[string]interface{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("claims: %w", err)
+	}
+
+	printJSON("Header", header)
+	printJSON("Claims", claims)
+
+	if exp, ok := claims["exp"].(float64); ok {
+		expiry := time.Unix(int64(exp), 0)
+		if left := time.Until(expiry); left > 0 {
+			fmt.Printf("Expires at %s (in %s)\n", expiry.Format(time.RFC3339), left.Round(time.Second))
+		} else {
+			fmt.Printf("EXPIRED at %s (%s ago)\n", expiry.Format(time.RFC3339), (-left).Round(time.Second))
+		}
+	}
+	if _, ok := claims["email"]; !ok {
+		fmt.Println("Note: the token has no email claim; receivers that allowlist callers by email will reject it")
+	}
+	return nil
+}
+
+// callURL sends a GET request with the token and reports the response.
+func callURL(ctx context.Context, target, raw string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+raw)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	fmt.Printf("%s %s\n", resp.Proto, resp.Status)
+	if len(body) > 0 {
+		fmt.Printf("%s\n", bytes.TrimSpace(body))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		fmt.Println("Hint: 401 means the token was rejected; check that -audience matches the service URL exactly")
+	case http.StatusForbidden:
+		fmt.Println("Hint: 403 means the caller is authenticated but lacks roles/run.invoker on the service")
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func printJSON(title string, v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Printf("%s:\n%s\n", title, data)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
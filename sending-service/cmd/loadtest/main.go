@@ -0,0 +1,438 @@
+// Command loadtest sends authenticated requests at a fixed rate and reports
+// latency percentiles and a breakdown of errors, to check IAM bindings,
+// autoscaling and cold starts under load.
+//
+// Drive the receiving service directly, minting ID tokens for it:
+//
+//	loadtest -url https://receiving-service-xyz.a.run.app/ -qps 50 -duration 1m
+//
+// Drive it through the sending service, which attaches the tokens itself:
+//
+//	loadtest -url https://sending-service-xyz.a.run.app/ -auth none -qps 50
+//
+// Mint the tokens as another service account, to check its invoker role:
+//
+//	loadtest -url https://receiving-service-xyz.a.run.app/ \
+//	    -auth impersonate -impersonate calling-service-sa@my-project.iam.gserviceaccount.com
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"sender/authclient"
+)
+
+func main() {
+	target := flag.String("url", "", "URL to send requests to")
+	method := flag.String("method", http.MethodGet, "request method")
+	body := flag.String("body", "", "request body; @file reads it from a file")
+	contentType := flag.String("content-type", "application/json", "Content-Type of requests with a body")
+	var headers headerFlag
+	flag.Var(&headers, "header", "extra request header as Name: value; may be repeated")
+	auth := flag.String("auth", "adc", "ID token source: adc, impersonate, gcloud, or none to send no token, such as when calling the sending service")
+	audience := flag.String("audience", "", "audience of the ID tokens; defaults to the origin of -url")
+	impersonate := flag.String("impersonate", "", "service account to impersonate with -auth impersonate or gcloud")
+	qps := flag.Float64("qps", 10, "requests started per second")
+	duration := flag.Duration("duration", 30*time.Second, "how long to send requests for")
+	warmup := flag.Duration("warmup", 0, "send requests for this long before measuring, leaving cold starts out of the results")
+	maxInFlight := flag.Int("concurrency", 100, "maximum requests in flight; requests due while at the limit are skipped and counted")
+	timeout := flag.Duration("timeout", 10*time.Second, "time limit for each request")
+	interval := flag.Duration("interval", 10*time.Second, "how often to print progress; 0 disables it")
+	flag.Parse()
+
+	if *target == "" {
+		fatalf("-url is required")
+	}
+	u, err := url.Parse(*target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		fatalf("-url must be an absolute URL")
+	}
+	if *qps <= 0 {
+		fatalf("-qps must be positive")
+	}
+	if *maxInFlight < 1 {
+		fatalf("-concurrency must be at least 1")
+	}
+	payload, err := readBody(*body)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = *maxInFlight
+	transport.MaxIdleConnsPerHost = *maxInFlight
+	client, err := newClient(ctx, *auth, *audience, *impersonate, u, transport, *timeout)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, *method, *target, strings.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if payload == "" {
+			req.Body = http.NoBody
+		} else {
+			req.Header.Set("Content-Type", *contentType)
+		}
+		for _, h := range headers {
+			req.Header.Add(h.name, h.value)
+		}
+		return req, nil
+	}
+
+	r := &run{client: client, newRequest: newRequest, timeout: *timeout, sem: make(chan struct{}, *maxInFlight)}
+	fmt.Printf("Sending %s %s at %g requests/s for %s", *method, *target, *qps, *duration)
+	if *warmup > 0 {
+		fmt.Printf(" after %s of warm-up", *warmup)
+	}
+	fmt.Println()
+
+	if *warmup > 0 {
+		warm := newStats()
+		r.load(ctx, *qps, *warmup, warm, 0)
+		fmt.Printf("Warm-up: %d requests, %d succeeded", warm.sent(), warm.ok)
+		if warm.first > 0 {
+			fmt.Printf(", first response after %s", warm.first.Round(time.Millisecond))
+		}
+		fmt.Println()
+	}
+
+	results := newStats()
+	elapsed := r.load(ctx, *qps, *duration, results, *interval)
+	results.report(os.Stdout, elapsed)
+	if results.ok < results.sent() {
+		os.Exit(1)
+	}
+}
+
+// newClient returns the client requests are sent with: one that attaches
+// ID tokens for the audience from the chosen source, or a plain client for
+// -auth none.
+func newClient(ctx context.Context, auth, audience, impersonate string, target *url.URL, transport http.RoundTripper, timeout time.Duration) (*http.Client, error) {
+	if auth == "none" {
+		return &http.Client{Transport: transport, Timeout: timeout}, nil
+	}
+	if audience == "" {
+		audience = target.Scheme + "://" + target.Host
+	}
+
+	opts := []authclient.Option{authclient.WithTransport(transport), authclient.WithTimeout(timeout)}
+	switch auth {
+	case "adc":
+	case "impersonate":
+		if impersonate == "" {
+			return nil, fmt.Errorf("-impersonate is required with -auth impersonate")
+		}
+		opts = append(opts, authclient.WithTokenSourceFunc(authclient.ImpersonatedTokenSource(impersonate)))
+	case "gcloud":
+		opts = append(opts, authclient.WithTokenSourceFunc(authclient.GcloudTokenSource(impersonate)))
+	default:
+		return nil, fmt.Errorf("unknown -auth %q", auth)
+	}
+	c, err := authclient.New(ctx, audience, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	return c.HTTPClient(), nil
+}
+
+type run struct {
+	client     *http.Client
+	newRequest func(context.Context) (*http.Request, error)
+	timeout    time.Duration
+	sem        chan struct{}
+}
+
+// load starts requests at qps for d, or until ctx is done, and records
+// their results in s. It waits for the requests to finish and returns how
+// long they took.
+func (r *run) load(ctx context.Context, qps float64, d time.Duration, s *stats, interval time.Duration) time.Duration {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	tick := time.NewTicker(time.Duration(float64(time.Second) / qps))
+	defer tick.Stop()
+	var progress <-chan time.Time
+	if interval > 0 {
+		p := time.NewTicker(interval)
+		defer p.Stop()
+		progress = p.C
+	}
+
+	var wg sync.WaitGroup
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return time.Since(start)
+		case <-progress:
+			s.progress(os.Stdout, time.Since(start))
+		case <-tick.C:
+			select {
+			case r.sem <- struct{}{}:
+			default:
+				s.skip()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-r.sem }()
+				latency, status, err := r.send()
+				s.record(time.Since(start), latency, status, err)
+			}()
+		}
+	}
+}
+
+// send sends one request and reads its response. Requests are not tied to
+// the run's context, so those in flight when it ends still complete.
+func (r *run) send() (time.Duration, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	req, err := r.newRequest(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return time.Since(start), 0, err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return time.Since(start), resp.StatusCode, err
+}
+
+// stats collects the results of a run.
+type stats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	ok        int
+	statuses  map[int]int
+	errors    map[string]int
+	skipped   int
+	// first is when the first response arrived, from the start of the run.
+	first time.Duration
+	// window holds the latencies since the last progress report.
+	window []time.Duration
+}
+
+func newStats() *stats {
+	return &stats{statuses: make(map[int]int), errors: make(map[string]int)}
+}
+
+func (s *stats) record(at, latency time.Duration, status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors[errorKind(err)]++
+		return
+	}
+	if s.first == 0 {
+		s.first = at
+	}
+	s.latencies = append(s.latencies, latency)
+	s.window = append(s.window, latency)
+	s.statuses[status]++
+	if status < 400 {
+		s.ok++
+	}
+}
+
+func (s *stats) skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped++
+}
+
+// sent returns the number of requests that completed, successfully or not.
+func (s *stats) sent() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.latencies)
+	for _, count := range s.errors {
+		n += count
+	}
+	return n
+}
+
+func (s *stats) progress(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	window := s.window
+	s.window = nil
+	failed := 0
+	for _, count := range s.errors {
+		failed += count
+	}
+	total := len(s.latencies) + failed
+	s.mu.Unlock()
+	fmt.Fprintf(w, "%6s  %d responses  p50 %s  p99 %s  %d total, %d errors\n",
+		elapsed.Round(time.Second), len(window), percentile(window, 50), percentile(window, 99), total, failed)
+}
+
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	sent := s.sent()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "\nRequests:  %d in %s (%.1f/s), %d succeeded", sent, elapsed.Round(time.Millisecond),
+		float64(sent)/elapsed.Seconds(), s.ok)
+	if s.skipped > 0 {
+		fmt.Fprintf(w, ", %d skipped at the concurrency limit", s.skipped)
+	}
+	fmt.Fprintln(w)
+	if s.first > 0 {
+		fmt.Fprintf(w, "First response after %s\n", s.first.Round(time.Millisecond))
+	}
+
+	if len(s.latencies) > 0 {
+		lat := append([]time.Duration(nil), s.latencies...)
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		fmt.Fprintf(w, "Latency:   min %s  p50 %s  p90 %s  p95 %s  p99 %s  max %s\n",
+			lat[0].Round(time.Microsecond), percentile(lat, 50), percentile(lat, 90),
+			percentile(lat, 95), percentile(lat, 99), lat[len(lat)-1].Round(time.Microsecond))
+	}
+
+	if len(s.statuses) > 0 {
+		fmt.Fprintln(w, "Status codes:")
+		codes := make([]int, 0, len(s.statuses))
+		for code := range s.statuses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "  %d %-24s %d%s\n", code, http.StatusText(code), s.statuses[code], hint(code))
+		}
+	}
+
+	if len(s.errors) > 0 {
+		fmt.Fprintln(w, "Errors:")
+		kinds := make([]string, 0, len(s.errors))
+		for kind := range s.errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Slice(kinds, func(i, j int) bool { return s.errors[kinds[i]] > s.errors[kinds[j]] })
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "  %-40s %d\n", kind, s.errors[kind])
+		}
+	}
+}
+
+// hint explains the status codes that point at a setup problem rather
+// than at the load.
+func hint(code int) string {
+	switch code {
+	case http.StatusUnauthorized:
+		return "  (token rejected: check the audience)"
+	case http.StatusForbidden:
+		return "  (caller lacks roles/run.invoker)"
+	case http.StatusTooManyRequests:
+		return "  (no instance available: check max instances and concurrency)"
+	}
+	return ""
+}
+
+// percentile returns the p-th percentile of the latencies, sorting a copy.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i].Round(time.Microsecond)
+}
+
+// errorKind groups errors by cause, so the breakdown is not split by the
+// addresses and ports in their messages.
+func errorKind(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, authclient.ErrTokenMint):
+		return "minting ID token"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, authclient.ErrDownstreamTimeout), isTimeout(err):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection closed"
+	case errors.As(err, &dnsErr):
+		return "DNS lookup"
+	case errors.As(err, &certErr):
+		return "TLS certificate"
+	case errors.As(err, &opErr):
+		return opErr.Op + " error"
+	}
+	return err.Error()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func readBody(body string) (string, error) {
+	if !strings.HasPrefix(body, "@") {
+		return body, nil
+	}
+	data, err := os.ReadFile(body[1:])
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+	return string(data), nil
+}
+
+type header struct{ name, value string }
+
+// headerFlag collects repeated -header flags.
+type headerFlag []header
+
+func (f *headerFlag) String() string {
+	return ""
+}
+
+func (f *headerFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("header %q is not of the form Name: value", v)
+	}
+	*f = append(*f, header{strings.TrimSpace(name), strings.TrimSpace(value)})
+	return nil
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
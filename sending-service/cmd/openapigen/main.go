@@ -0,0 +1,651 @@
+// Command openapigen generates a typed Go client for an OpenAPI 3 spec,
+// such as the receiving service's openapi.yaml. Each operation becomes a
+// method that sends the call with an authclient.Client, so it carries an
+// ID token for the service, and decodes the response into the schema's
+// type:
+//
+//	openapigen -spec ../receiving-service/openapi.yaml -package receiverclient -out receiverclient/client.go
+//
+// It supports the subset of OpenAPI that describes JSON services: path,
+// query and header parameters of scalar types, application/json request
+// and response bodies given by a schema in components/schemas, and
+// text/plain responses. Specs using anything else are rejected rather
+// than half generated.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+func main() {
+	specPath := flag.String("spec", "openapi.yaml", "OpenAPI 3 spec to generate the client from")
+	pkg := flag.String("package", "", "package name of the generated client")
+	out := flag.String("out", "", "file to write the client to; standard output if empty")
+	flag.Parse()
+	if *pkg == "" {
+		fatalf("-package is required")
+	}
+
+	data, err := os.ReadFile(*specPath)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var s spec
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		fatalf("failed to parse %s: %v", *specPath, err)
+	}
+	src, err := generate(&s, *pkg, filepath.Base(*specPath))
+	if err != nil {
+		fatalf("%s: %v", *specPath, err)
+	}
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "openapigen: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// spec is the part of an OpenAPI 3 document the generator reads.
+type spec struct {
+	OpenAPI string `yaml:"openapi"`
+	Info    struct {
+		Title string `yaml:"title"`
+	} `yaml:"info"`
+	Paths      map[string]*pathItem `yaml:"paths"`
+	Components struct {
+		Schemas map[string]*schema `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+type pathItem struct {
+	Parameters []*parameter `yaml:"parameters"`
+	Get        *operation   `yaml:"get"`
+	Put        *operation   `yaml:"put"`
+	Post       *operation   `yaml:"post"`
+	Delete     *operation   `yaml:"delete"`
+	Patch      *operation   `yaml:"patch"`
+}
+
+// operations returns the item's operations by method, in a fixed order.
+func (p *pathItem) operations() ([]string, []*operation) {
+	var methods []string
+	var ops []*operation
+	for _, m := range []struct {
+		method string
+		op     *operation
+	}{{"Get", p.Get}, {"Put", p.Put}, {"Post", p.Post}, {"Delete", p.Delete}, {"Patch", p.Patch}} {
+		if m.op != nil {
+			methods = append(methods, m.method)
+			ops = append(ops, m.op)
+		}
+	}
+	return methods, ops
+}
+
+type operation struct {
+	OperationID string              `yaml:"operationId"`
+	Summary     string              `yaml:"summary"`
+	Parameters  []*parameter        `yaml:"parameters"`
+	RequestBody *content            `yaml:"requestBody"`
+	Responses   map[string]*content `yaml:"responses"`
+	// Other holds the fields the generator does not read, which must be
+	// documentation only.
+	Other map[string]yaml.Node `yaml:",inline"`
+}
+
+// documentationFields are the operation fields that do not change a call.
+var documentationFields = map[string]bool{"description": true, "tags": true, "deprecated": true, "externalDocs": true}
+
+type parameter struct {
+	Name        string  `yaml:"name"`
+	In          string  `yaml:"in"`
+	Description string  `yaml:"description"`
+	Required    bool    `yaml:"required"`
+	Schema      *schema `yaml:"schema"`
+}
+
+// content is a request body or a response.
+type content struct {
+	Description string                    `yaml:"description"`
+	Content     map[string]*mediaTypeSpec `yaml:"content"`
+}
+
+type mediaTypeSpec struct {
+	Schema *schema `yaml:"schema"`
+}
+
+type schema struct {
+	Ref         string             `yaml:"$ref"`
+	Type        string             `yaml:"type"`
+	Format      string             `yaml:"format"`
+	Description string             `yaml:"description"`
+	Properties  map[string]*schema `yaml:"properties"`
+	Required    []string           `yaml:"required"`
+	Items       *schema            `yaml:"items"`
+}
+
+const schemaRefPrefix = "#/components/schemas/"
+
+// generate returns the formatted source of a client for s.
+func generate(s *spec, pkg, specName string) ([]byte, error) {
+	if !strings.HasPrefix(s.OpenAPI, "3.") {
+		return nil, fmt.Errorf("only OpenAPI 3 specs are supported, not %q", s.OpenAPI)
+	}
+	g := &generator{spec: s, imports: map[string]bool{"context": true}}
+	title := s.Info.Title
+	if title == "" {
+		title = "service"
+	}
+	g.printf("// Client calls the %s API. Its calls are sent with an\n", title)
+	g.printf("// authclient.Client, which adds an ID token for the service.\n")
+	g.printf("type Client struct {\nclient *authclient.Client\n}\n\n")
+	g.printf("// New returns a Client that sends its calls with client, whose base URL\n")
+	g.printf("// must be the service's, as set with authclient.WithBaseURL or the\n")
+	g.printf("// audience.\n")
+	g.printf("func New(client *authclient.Client) *Client {\nreturn &Client{client: client}\n}\n\n")
+
+	names := make([]string, 0, len(s.Components.Schemas))
+	for name := range s.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := g.schemaType(name, s.Components.Schemas[name]); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+	}
+
+	paths := make([]string, 0, len(s.Paths))
+	for p := range s.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		item := s.Paths[p]
+		methods, ops := item.operations()
+		for i, op := range ops {
+			if err := g.method(p, strings.ToUpper(methods[i]), item.Parameters, op); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(methods[i]), p, err)
+			}
+		}
+	}
+	if g.imports["io"] {
+		g.printf("%s", textHelper)
+	}
+
+	var file bytes.Buffer
+	fmt.Fprintf(&file, "// Code generated by openapigen from %s; DO NOT EDIT.\n\n", specName)
+	fmt.Fprintf(&file, "package %s\n\nimport (\n", pkg)
+	for _, imp := range []string{"context", "io", "net/url"} {
+		if g.imports[imp] {
+			fmt.Fprintf(&file, "%q\n", imp)
+		}
+	}
+	fmt.Fprintf(&file, "\n\"sender/authclient\"\n)\n\n")
+	file.Write(g.buf.Bytes())
+	src, err := format.Source(file.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code: %w", err)
+	}
+	return src, nil
+}
+
+type generator struct {
+	spec *spec
+	buf  bytes.Buffer
+	// imports are the standard packages the client uses.
+	imports map[string]bool
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// comment writes text as a doc comment.
+func (g *generator) comment(text string) {
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		g.printf("// %s\n", strings.TrimSpace(line))
+	}
+}
+
+// schemaType writes the struct type of the named object schema.
+func (g *generator) schemaType(name string, s *schema) error {
+	if s.Type != "object" || len(s.Properties) == 0 {
+		return fmt.Errorf("only object schemas with properties are supported")
+	}
+	if s.Description != "" {
+		g.comment(exported(name) + " is " + lowerFirst(s.Description))
+	}
+	required := map[string]bool{}
+	for _, r := range s.Required {
+		required[r] = true
+	}
+	props := make([]string, 0, len(s.Properties))
+	for p := range s.Properties {
+		props = append(props, p)
+	}
+	sort.Strings(props)
+	g.printf("type %s struct {\n", exported(name))
+	for _, p := range props {
+		typ, err := g.goType(s.Properties[p])
+		if err != nil {
+			return fmt.Errorf("property %s: %w", p, err)
+		}
+		if d := s.Properties[p].Description; d != "" {
+			g.comment(exported(p) + " is " + lowerFirst(d))
+		}
+		tag := p
+		if !required[p] {
+			tag += ",omitempty"
+		}
+		g.printf("%s %s `json:%q`\n", exported(p), typ, tag)
+	}
+	g.printf("}\n\n")
+	return nil
+}
+
+// goType returns the Go type of a property or parameter schema.
+func (g *generator) goType(s *schema) (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("missing schema")
+	}
+	if s.Ref != "" {
+		name, err := g.ref(s.Ref)
+		if err != nil {
+			return "", err
+		}
+		return "*" + name, nil
+	}
+	switch s.Type {
+	case "string":
+		return "string", nil
+	case "integer":
+		if s.Format == "int32" {
+			return "int32", nil
+		}
+		return "int64", nil
+	case "number":
+		if s.Format == "float" {
+			return "float32", nil
+		}
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "array":
+		elem, err := g.goType(s.Items)
+		if err != nil {
+			return "", fmt.Errorf("items: %w", err)
+		}
+		return "[]" + elem, nil
+	case "object":
+		if len(s.Properties) > 0 {
+			return "", fmt.Errorf("inline object schemas are not supported; move it to components/schemas")
+		}
+		return "map[string]any", nil
+	}
+	return "", fmt.Errorf("unsupported schema type %q", s.Type)
+}
+
+// ref returns the type name of a schema reference.
+func (g *generator) ref(ref string) (string, error) {
+	name, ok := strings.CutPrefix(ref, schemaRefPrefix)
+	if !ok {
+		return "", fmt.Errorf("only references to %s are supported, not %s", schemaRefPrefix, ref)
+	}
+	if _, ok := g.spec.Components.Schemas[name]; !ok {
+		return "", fmt.Errorf("undefined schema %s", name)
+	}
+	return exported(name), nil
+}
+
+// param is a parameter of a generated method.
+type param struct {
+	*parameter
+	arg string
+	typ string
+}
+
+// method writes the client method of op.
+func (g *generator) method(path, method string, shared []*parameter, op *operation) error {
+	if op.OperationID == "" {
+		return fmt.Errorf("operationId is required")
+	}
+	for field := range op.Other {
+		if !documentationFields[field] {
+			return fmt.Errorf("unsupported operation field %s", field)
+		}
+	}
+	name := exported(op.OperationID)
+
+	byName := map[string]*parameter{}
+	var order []string
+	for _, p := range append(append([]*parameter{}, shared...), op.Parameters...) {
+		key := p.In + ":" + p.Name
+		if _, ok := byName[key]; !ok {
+			order = append(order, key)
+		}
+		byName[key] = p
+	}
+	used := map[string]bool{"ctx": true, "body": true, "opts": true, "c": true, "req": true, "resp": true, "err": true, "out": true, "query": true, "target": true}
+	var params []param
+	for _, key := range order {
+		p := byName[key]
+		switch p.In {
+		case "path":
+			p.Required = true
+		case "query", "header":
+		default:
+			return fmt.Errorf("parameter %s: %s parameters are not supported", p.Name, p.In)
+		}
+		typ, err := g.goType(p.Schema)
+		if err != nil {
+			return fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+		if typ != "string" {
+			return fmt.Errorf("parameter %s: only string parameters are supported", p.Name)
+		}
+		arg := unexported(p.Name)
+		for used[arg] || token.IsKeyword(arg) {
+			arg += "Param"
+		}
+		used[arg] = true
+		params = append(params, param{parameter: p, arg: arg, typ: typ})
+	}
+
+	var inType string
+	if op.RequestBody != nil {
+		s, err := jsonSchema(op.RequestBody)
+		if err != nil {
+			return fmt.Errorf("request body: %w", err)
+		}
+		if inType, err = g.goType(s); err != nil {
+			return fmt.Errorf("request body: %w", err)
+		}
+	}
+	outType, text, err := g.responseType(op.Responses)
+	if err != nil {
+		return err
+	}
+
+	// The doc comment and signature.
+	doc := name + " sends " + method + " " + path + "."
+	if op.Summary != "" {
+		doc = name + " " + lowerFirst(op.Summary)
+	}
+	g.comment(doc)
+	var optional []string
+	for _, p := range params {
+		if !p.Required {
+			optional = append(optional, p.arg)
+		}
+	}
+	if len(optional) > 0 {
+		g.printf("//\n// %s %s left out if empty.\n", joinWords(optional), plural(len(optional), "is", "are"))
+	}
+	args := []string{"ctx context.Context"}
+	for _, p := range params {
+		args = append(args, p.arg+" "+p.typ)
+	}
+	if inType != "" {
+		args = append(args, "body "+inType)
+	}
+	args = append(args, "opts ...authclient.CallOption")
+	result := "error"
+	switch {
+	case text:
+		result = "(string, error)"
+	case outType != "":
+		result = "(*" + outType + ", error)"
+	}
+	g.printf("func (c *Client) %s(%s) %s {\n", name, strings.Join(args, ", "), result)
+
+	// The path, with its parameters substituted, and the query.
+	expr, escaped := pathExpr(path, params)
+	g.printf("target := %s\n", expr)
+	if escaped {
+		g.imports["net/url"] = true
+	}
+	var query, headers []param
+	for _, p := range params {
+		switch p.In {
+		case "query":
+			query = append(query, p)
+		case "header":
+			headers = append(headers, p)
+		}
+	}
+	if len(query) > 0 {
+		g.imports["net/url"] = true
+		g.printf("query := url.Values{}\n")
+		for _, p := range query {
+			if p.Required {
+				g.printf("query.Set(%q, %s)\n", p.Name, p.arg)
+			} else {
+				g.printf("if %s != \"\" {\nquery.Set(%q, %s)\n}\n", p.arg, p.Name, p.arg)
+			}
+		}
+		g.printf("if len(query) > 0 {\ntarget += \"?\" + query.Encode()\n}\n")
+	}
+	for _, p := range headers {
+		if p.Required {
+			g.printf("opts = append(opts, authclient.CallHeader(%q, %s))\n", p.Name, p.arg)
+		} else {
+			g.printf("if %s != \"\" {\nopts = append(opts, authclient.CallHeader(%q, %s))\n}\n", p.arg, p.Name, p.arg)
+		}
+	}
+	g.printf("ctx = authclient.CallContext(ctx, opts...)\n")
+
+	// The call.
+	in := "nil"
+	if inType != "" {
+		in = "body"
+	}
+	switch {
+	case text:
+		g.imports["io"] = true
+		g.printf("return c.text(ctx, %q, target)\n", method)
+	case outType != "":
+		g.printf("var out %s\n", outType)
+		g.printf("if err := c.client.DoJSON(ctx, %q, target, %s, &out); err != nil {\nreturn nil, err\n}\n", method, in)
+		g.printf("return &out, nil\n")
+	default:
+		g.printf("return c.client.DoJSON(ctx, %q, target, %s, nil)\n", method, in)
+	}
+	g.printf("}\n\n")
+	return nil
+}
+
+// responseType returns the type of the 2xx responses, which must agree,
+// or text if they are text/plain. Both are empty for responses without a
+// body.
+func (g *generator) responseType(responses map[string]*content) (typ string, text bool, err error) {
+	codes := make([]string, 0, len(responses))
+	for code := range responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	seen := false
+	for _, code := range codes {
+		if !strings.HasPrefix(code, "2") {
+			continue
+		}
+		r := responses[code]
+		var t string
+		var isText bool
+		switch {
+		case len(r.Content) == 0:
+		case r.Content["text/plain"] != nil && len(r.Content) == 1:
+			isText = true
+		default:
+			s, err := jsonSchema(r)
+			if err != nil {
+				return "", false, fmt.Errorf("response %s: %w", code, err)
+			}
+			if s.Ref == "" {
+				return "", false, fmt.Errorf("response %s: only schemas from components/schemas are supported", code)
+			}
+			if t, err = g.ref(s.Ref); err != nil {
+				return "", false, fmt.Errorf("response %s: %w", code, err)
+			}
+		}
+		if seen && (t != typ || isText != text) {
+			return "", false, fmt.Errorf("response %s: all 2xx responses must have the same body", code)
+		}
+		typ, text, seen = t, isText, true
+	}
+	return typ, text, nil
+}
+
+// jsonSchema returns the application/json schema of c.
+func jsonSchema(c *content) (*schema, error) {
+	mt, ok := c.Content["application/json"]
+	if !ok || len(c.Content) != 1 {
+		return nil, fmt.Errorf("only application/json bodies are supported")
+	}
+	if mt.Schema == nil {
+		return nil, fmt.Errorf("missing schema")
+	}
+	return mt.Schema, nil
+}
+
+// pathExpr returns a Go expression for path with its parameters
+// substituted, escaped, and whether it has any.
+func pathExpr(path string, params []param) (string, bool) {
+	args := map[string]string{}
+	for _, p := range params {
+		if p.In == "path" {
+			args[p.Name] = p.arg
+		}
+	}
+	var parts []string
+	rest := strings.TrimPrefix(path, "/")
+	for {
+		open := strings.Index(rest, "{")
+		close := strings.Index(rest, "}")
+		if open < 0 || close < open {
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%q", rest[:open]), "url.PathEscape("+args[rest[open+1:close]]+")")
+		rest = rest[close+1:]
+	}
+	if rest != "" || len(parts) == 0 {
+		parts = append(parts, fmt.Sprintf("%q", rest))
+	}
+	return strings.Join(parts, " + "), len(args) > 0
+}
+
+// exported returns name as an exported Go identifier, as in JobStatus for
+// jobStatus and RetryAfter for retry_after.
+func exported(name string) string {
+	var b strings.Builder
+	for _, word := range words(name) {
+		if up := strings.ToUpper(word); initialisms[up] {
+			b.WriteString(up)
+			continue
+		}
+		r := []rune(word)
+		b.WriteString(string(unicode.ToUpper(r[0])) + string(r[1:]))
+	}
+	return b.String()
+}
+
+// unexported returns name as an unexported Go identifier.
+func unexported(name string) string {
+	ws := words(name)
+	first := strings.ToLower(ws[0])
+	return first + strings.TrimPrefix(exported(strings.Join(ws, "_")), exported(ws[0]))
+}
+
+// words splits name at underscores, hyphens and lower-to-upper case
+// changes.
+func words(name string) []string {
+	var ws []string
+	var cur []rune
+	for i, r := range name {
+		switch {
+		case r == '_' || r == '-' || r == '.' || r == ' ':
+			if len(cur) > 0 {
+				ws = append(ws, string(cur))
+			}
+			cur = nil
+			continue
+		case unicode.IsUpper(r) && i > 0 && len(cur) > 0 && unicode.IsLower(cur[len(cur)-1]):
+			ws = append(ws, string(cur))
+			cur = nil
+		}
+		cur = append(cur, r)
+	}
+	if len(cur) > 0 {
+		ws = append(ws, string(cur))
+	}
+	if len(ws) == 0 {
+		ws = []string{"x"}
+	}
+	return ws
+}
+
+var initialisms = map[string]bool{"ID": true, "URL": true, "URI": true, "HTTP": true, "API": true, "JSON": true}
+
+func lowerFirst(s string) string {
+	r := []rune(s)
+	if len(r) > 1 && unicode.IsUpper(r[1]) {
+		return s
+	}
+	return string(unicode.ToLower(r[0])) + string(r[1:])
+}
+
+func joinWords(ws []string) string {
+	if len(ws) == 1 {
+		return ws[0]
+	}
+	return strings.Join(ws[:len(ws)-1], ", ") + " and " + ws[len(ws)-1]
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// textHelper sends calls answered with text/plain.
+const textHelper = `// text sends a call answered with a text/plain body and returns the body.
+func (c *Client) text(ctx context.Context, method, target string) (string, error) {
+	req, err := c.client.NewRequest(ctx, method, target, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/plain")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := authclient.CheckResponse(resp); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+`
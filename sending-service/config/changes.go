@@ -0,0 +1,35 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Changes returns the settings that differ between old and new, by their
+// YAML names. The settings of a section, such as timeouts, are named
+// within it, as in timeouts.request; maps and lists, such as services,
+// are compared as a whole. Settings only set by flags are not compared.
+func Changes(old, new *Config) []string {
+	var changes []string
+	diff(reflect.ValueOf(*old), reflect.ValueOf(*new), "", 2, &changes)
+	return changes
+}
+
+func diff(old, new reflect.Value, prefix string, depth int, changes *[]string) {
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		o, n := old.Field(i), new.Field(i)
+		if f.Type.Kind() == reflect.Struct && depth > 1 {
+			diff(o, n, prefix+name+".", depth-1, changes)
+			continue
+		}
+		if !reflect.DeepEqual(o.Interface(), n.Interface()) {
+			*changes = append(*changes, prefix+name)
+		}
+	}
+}
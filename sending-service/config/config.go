@@ -0,0 +1,2439 @@
+// Package config loads the configuration of the sending service from
+// defaults, an optional YAML file, environment variables and command-line
+// flags, in increasing order of precedence.
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/api/option"
+	"gopkg.in/yaml.v3"
+
+	"sender/authclient"
+	"sender/broker"
+	"sender/browser"
+	"sender/callback"
+	"sender/chaos"
+	"sender/cloudmonitoring"
+	"sender/downstream"
+	"sender/handoff"
+	"sender/logging"
+	"sender/proxy"
+	"sender/secrets"
+	"sender/tracing"
+)
+
+// Config is the effective configuration of the sending service.
+type Config struct {
+	// Port is the port the server listens on.
+	Port string `yaml:"port"`
+	// LogLevel is one of debug, info, warn or error.
+	LogLevel string `yaml:"log_level"`
+	// DefaultService names the downstream service called by the / handler.
+	DefaultService string `yaml:"default_service"`
+	// Services are the downstream services, keyed by name.
+	Services map[string]downstream.Service `yaml:"services"`
+	// Identity describes the sending service in the headers of downstream
+	// requests.
+	Identity Identity `yaml:"identity"`
+	// Tenants routes requests to downstream services by tenant.
+	Tenants Tenants `yaml:"tenants"`
+	// PathRoutes forwards requests to downstream services by path, with
+	// their paths rewritten. Requests no route matches are handled as
+	// without routes.
+	PathRoutes []downstream.Route `yaml:"path_routes"`
+	// Headers are attached to every downstream request, for example an
+	// API key required by the receiving service.
+	Headers map[string]string `yaml:"headers"`
+	// SecretsRefreshInterval is how often sm:// header values are read from
+	// Secret Manager again. Zero reads them only at startup.
+	SecretsRefreshInterval time.Duration `yaml:"secrets_refresh_interval"`
+	// Timeouts bound the phases of each call to a downstream service.
+	Timeouts Timeouts `yaml:"timeouts"`
+	// MaxResponseSize is the largest downstream response body, in bytes,
+	// relayed to the caller. Zero disables the limit.
+	MaxResponseSize int64 `yaml:"max_response_size"`
+	// Server bounds the requests the sending service accepts, so that slow
+	// or oversized ones cannot tie up its connections and memory.
+	Server Server `yaml:"server"`
+	// ShutdownTimeout is how long in-flight requests may run after SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ServeH2C also serves HTTP/2 without TLS, which Cloud Run sends to
+	// services deployed with --use-http2. Requests over HTTP/2 are not
+	// bound by Cloud Run's 32 MiB limit on HTTP/1 request bodies.
+	ServeH2C bool `yaml:"serve_h2c"`
+	// Uploads streams large request bodies to downstream services instead
+	// of holding them in memory.
+	Uploads Uploads `yaml:"uploads"`
+	// Handoff sends request bodies too large for downstream services
+	// through a Cloud Storage bucket, as signed URLs.
+	Handoff Handoff `yaml:"handoff"`
+	// Transport tunes the connection pool shared by downstream clients.
+	Transport Transport `yaml:"transport"`
+	// HedgeDelay, if positive, sends a second request for idempotent calls
+	// not answered within this delay.
+	HedgeDelay time.Duration `yaml:"hedge_delay"`
+	// DeduplicateGets collapses identical concurrent downstream GET
+	// requests into one call.
+	DeduplicateGets bool `yaml:"deduplicate_gets"`
+	// ResponseCache caches downstream GET responses.
+	ResponseCache ResponseCache `yaml:"response_cache"`
+	// Outbox accepts requests on /enqueue/{service} and delivers them
+	// asynchronously.
+	Outbox Outbox `yaml:"outbox"`
+	// Deadlines propagates request deadlines to downstream services.
+	Deadlines Deadlines `yaml:"deadlines"`
+	// Compression compresses request bodies and decodes responses.
+	Compression Compression `yaml:"compression"`
+	// RequestSigning signs downstream request bodies.
+	RequestSigning RequestSigning `yaml:"request_signing"`
+	// Encryption encrypts downstream request and response bodies.
+	Encryption Encryption `yaml:"encryption"`
+	// Retry is the retry policy for downstream calls.
+	Retry Retry `yaml:"retry"`
+	// CircuitBreaker configures the circuit breaker of each downstream
+	// service.
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
+	// ConcurrencyLimit caps the requests in flight to each downstream
+	// service.
+	ConcurrencyLimit ConcurrencyLimit `yaml:"concurrency_limit"`
+	// RateLimit limits the rate of inbound requests.
+	RateLimit RateLimit `yaml:"rate_limit"`
+	// LoadShedding caps the inbound requests handled at once.
+	LoadShedding LoadShedding `yaml:"load_shedding"`
+	// TokenRefreshSkew is how long before expiry ID tokens are renewed in
+	// the background. Zero disables background refresh.
+	TokenRefreshSkew time.Duration `yaml:"token_refresh_skew"`
+	// TokenStaleGrace is how long before expiry requests stop waiting for
+	// a new ID token and are sent with the cached one while it is renewed,
+	// until it expires if renewal fails. Zero disables it.
+	TokenStaleGrace time.Duration `yaml:"token_stale_grace"`
+	// TokenAudit logs the claims of a sample of minted ID tokens.
+	TokenAudit TokenAudit `yaml:"token_audit"`
+	// TokenStore shares ID tokens between instances.
+	TokenStore TokenStore `yaml:"token_store"`
+	// Prewarm mints tokens for every service at startup.
+	Prewarm Prewarm `yaml:"prewarm"`
+	// WarmConnections keeps connections to every service open and warm.
+	WarmConnections WarmConnections `yaml:"warm_connections"`
+	// ProxyMode forwards every inbound request to the default service.
+	ProxyMode bool `yaml:"proxy_mode"`
+	// ResponseHeaders selects the downstream response headers returned to
+	// the caller.
+	ResponseHeaders ResponseHeaders `yaml:"response_headers"`
+	// RevisionTagHeader, if set, names an inbound request header whose
+	// value is the tag of the Cloud Run revision to send the request's
+	// downstream calls to, such as a canary revision.
+	RevisionTagHeader string `yaml:"revision_tag_header"`
+	// SessionAffinity pins the downstream calls of related inbound
+	// requests to the same receiving service instance.
+	SessionAffinity SessionAffinity `yaml:"session_affinity"`
+	// ServerTiming reports and logs the phases of each request's
+	// downstream calls.
+	ServerTiming bool `yaml:"server_timing"`
+	// ReadinessProbe makes /readyz send a HEAD request to each service.
+	ReadinessProbe bool `yaml:"readiness_probe_downstream"`
+	// ValidateOnly, set with the -validate flag, checks that a token can be
+	// minted for and used with every service, then exits instead of
+	// serving.
+	ValidateOnly bool `yaml:"-"`
+	// ValidateInterval, if positive, runs the same checks in the
+	// background at this interval and logs failures.
+	ValidateInterval time.Duration `yaml:"validate_interval"`
+	// CheckInvoker asks the Cloud Run Admin API at startup, and with every
+	// validation, whether the calling identity may invoke each service.
+	CheckInvoker bool `yaml:"check_invoker"`
+	// DiscoveryInterval is how often the URLs of services configured by
+	// Cloud Run resource name rather than URL are looked up again, to
+	// follow changes; 0 only looks them up at startup.
+	DiscoveryInterval time.Duration `yaml:"discovery_interval"`
+	// DebugTokenEndpoint serves /debug/token, which describes the ID token
+	// sent to a downstream service.
+	DebugTokenEndpoint bool `yaml:"debug_token_endpoint"`
+	// Admin enables the /admin endpoints for the operators' accounts.
+	Admin Admin `yaml:"admin"`
+	// TokenBroker serves /token, which mints ID tokens for other services
+	// on behalf of the callers its grants allow.
+	TokenBroker TokenBroker `yaml:"token_broker"`
+	// Callbacks enables asynchronous calls on /async/, whose results
+	// downstream services send back to /callbacks/.
+	Callbacks Callbacks `yaml:"callbacks"`
+	// Capture logs the headers and bodies of downstream requests and
+	// responses.
+	Capture Capture `yaml:"capture"`
+	// Chaos injects faults into downstream calls, for resilience testing.
+	Chaos Chaos `yaml:"chaos"`
+	// TraceExporter is one of none, stdout or otlp.
+	TraceExporter string `yaml:"trace_exporter"`
+	// CloudMonitoring writes token and downstream authentication metrics
+	// to Cloud Monitoring.
+	CloudMonitoring CloudMonitoring `yaml:"cloud_monitoring"`
+	// ErrorReporting sends token, downstream and handler errors to Cloud
+	// Error Reporting.
+	ErrorReporting ErrorReporting `yaml:"error_reporting"`
+	// Profiling serves the pprof endpoints and uploads profiles to Cloud
+	// Profiler.
+	Profiling Profiling `yaml:"profiling"`
+	// IDTokenHeader is the header ID tokens are sent in: Authorization,
+	// or X-Serverless-Authorization for receiving services that use the
+	// Authorization header themselves. It defaults to Authorization, or to
+	// X-Serverless-Authorization when an access token is sent.
+	IDTokenHeader string `yaml:"id_token_header"`
+	// AccessToken sends an OAuth2 access token along with the ID token.
+	AccessToken AccessToken `yaml:"access_token"`
+	// ForwardUserCredentials forwards the Authorization header of inbound
+	// requests to downstream services in X-Forwarded-Authorization.
+	ForwardUserCredentials bool `yaml:"forward_user_credentials"`
+	// Browser accepts end users' ID tokens from browsers on the relay,
+	// /call/, /enqueue and /async/ endpoints, and describes the user to
+	// downstream services instead of forwarding the token.
+	Browser Browser `yaml:"browser"`
+	// Inbound verifies the ID tokens of the services calling the relay,
+	// /call/, /enqueue and /async/ endpoints.
+	Inbound Inbound `yaml:"inbound"`
+	// QuotaProject, if set, is the project that quota and billing of
+	// downstream calls and Google API calls are attributed to.
+	QuotaProject string `yaml:"quota_project"`
+	// ImpersonateServiceAccount, if set, mints ID tokens as this service
+	// account through the IAM Credentials API.
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
+	// ImpersonationDelegates are the service accounts of the delegation
+	// chain to ImpersonateServiceAccount, for multi-hop impersonation.
+	ImpersonationDelegates []string `yaml:"impersonation_delegates"`
+	// ImpersonationOmitEmail mints the impersonated ID tokens without the
+	// email claim.
+	ImpersonationOmitEmail bool `yaml:"impersonation_omit_email"`
+	// WorkloadIdentity configures Workload Identity Federation for running
+	// outside Google Cloud.
+	WorkloadIdentity WorkloadIdentity `yaml:"workload_identity"`
+	// Vault configures minting ID tokens with credentials brokered by
+	// HashiCorp Vault's GCP secrets engine.
+	Vault Vault `yaml:"vault"`
+	// Dev configures local development mode.
+	Dev Dev `yaml:"dev"`
+
+	// File, set with the -config flag or CONFIG_FILE, is the YAML file
+	// the settings were read from: a path, or an sm:// reference to a
+	// Secret Manager secret version holding the YAML.
+	File string `yaml:"-"`
+	// ReloadInterval, if positive, is how often File is read again. Changed
+	// settings that can be applied at runtime then are, without a restart.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// fileData is the content File was read with.
+	fileData []byte
+}
+
+// Identity describes the sending service to downstream services, so
+// operators can attribute traffic between services.
+type Identity struct {
+	// UserAgent defaults to the service name followed by the version,
+	// such as sending-service/sending-service-00042-abc.
+	UserAgent string `yaml:"user_agent"`
+	// Version is sent in the X-Client-Version header. On Cloud Run it
+	// defaults to the revision.
+	Version string `yaml:"version"`
+	// Labels are sent in the X-Client-Labels header.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Admin configures the administrative endpoints, such as
+// /admin/cache/flush. They are enabled when AllowedCallers is not empty.
+type Admin struct {
+	// AllowedCallers are the emails of the accounts that may call them.
+	AllowedCallers []string `yaml:"allowed_callers"`
+	// Audience is the audience of the callers' ID tokens, normally the
+	// URL of the sending service.
+	Audience string `yaml:"audience"`
+}
+
+// TokenBroker configures the /token endpoint. It is enabled when Grants is
+// not empty.
+type TokenBroker struct {
+	// Audience is the audience of the callers' ID tokens, normally the URL
+	// of the sending service.
+	Audience string `yaml:"audience"`
+	// Grants say which callers may obtain ID tokens for which audiences.
+	Grants []broker.Grant `yaml:"grants"`
+}
+
+// Browser configures calls from browsers on behalf of their signed-in
+// users. It is enabled when FirebaseProject or GoogleClientIDs is set.
+type Browser struct {
+	// FirebaseProject accepts Firebase Authentication ID tokens of this
+	// project ID.
+	FirebaseProject string `yaml:"firebase_project"`
+	// GoogleClientIDs accepts Google Sign-In ID tokens issued to these
+	// OAuth client IDs.
+	GoogleClientIDs []string `yaml:"google_client_ids"`
+	// AllowedOrigins are the origins of the pages that may call the
+	// sending service from another origin, such as
+	// https://app.example.com.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// SessionCookie, if set, names the cookie the ID token is read from
+	// when a request has no Authorization header.
+	SessionCookie string `yaml:"session_cookie"`
+}
+
+// Enabled reports whether browsers may call the sending service.
+func (b Browser) Enabled() bool {
+	return b.FirebaseProject != "" || len(b.GoogleClientIDs) > 0
+}
+
+// Inbound configures verifying the callers of the sending service at the
+// application layer. It is enabled when Audience is set.
+type Inbound struct {
+	// Audience is the audience of the callers' ID tokens, normally the
+	// URL of the sending service.
+	Audience string `yaml:"audience"`
+	// AllowedCallers, if set, are the emails of the accounts that may
+	// call, or path.Match patterns they must match, such as
+	// *@my-project.iam.gserviceaccount.com.
+	AllowedCallers []string `yaml:"allowed_callers"`
+}
+
+// Callbacks configures asynchronous calls answered with a callback.
+type Callbacks struct {
+	// URL is the base URL results are sent to, the sending service's own
+	// URL followed by /callbacks/. Asynchronous calls are enabled when it
+	// is set.
+	URL string `yaml:"url"`
+	// Audience is the audience of the ID tokens results must carry. It
+	// defaults to the scheme and host of URL.
+	Audience string `yaml:"audience"`
+	// AllowedCallers are the emails of the service accounts results may
+	// be sent by, normally those of the downstream services.
+	AllowedCallers []string `yaml:"allowed_callers"`
+	// TTL is how long a result is awaited, and then kept.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxBodySize bounds the bodies of asynchronous calls and of their
+	// results.
+	MaxBodySize int64 `yaml:"max_body_size"`
+	// RedisAddr, if set, keeps callbacks in Redis at this host:port, so
+	// that a result sent to any instance reaches the caller. Otherwise
+	// they are kept in the memory of each instance.
+	RedisAddr string `yaml:"redis_addr"`
+	// RedisAuth secures the connection to RedisAddr.
+	RedisAuth `yaml:",inline"`
+}
+
+// Tenants routes each request to the downstream service of its tenant,
+// for running the service as a gateway shared by many tenants.
+type Tenants struct {
+	// Header names the request header identifying the tenant. If empty,
+	// the tenant is the host name the request was sent to.
+	Header string `yaml:"header"`
+	// Routes maps tenants to the names of downstream services. Routing by
+	// tenant is enabled when it is not empty.
+	Routes map[string]string `yaml:"routes"`
+}
+
+// AccessToken configures sending an OAuth2 access token in the
+// Authorization header, with the ID token moved to
+// X-Serverless-Authorization.
+type AccessToken struct {
+	Enabled bool `yaml:"enabled"`
+	// Scopes default to cloud-platform.
+	Scopes []string `yaml:"scopes"`
+}
+
+// Capture logs downstream requests and responses in detail, for
+// diagnosing integration issues.
+type Capture struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxBodySize is how many bytes of each body are logged. Zero logs
+	// headers only.
+	MaxBodySize int `yaml:"max_body_size"`
+	// RedactHeaders are masked in addition to Authorization, the other
+	// headers carrying credentials, and the configured headers.
+	RedactHeaders []string `yaml:"redact_headers"`
+	// RedactFields are JSON body fields and query parameters to mask.
+	RedactFields []string `yaml:"redact_fields"`
+}
+
+// Chaos configures fault injection into downstream calls.
+type Chaos struct {
+	Enabled bool `yaml:"enabled"`
+	// Rules say which calls get which faults, and how often.
+	Rules []chaos.Rule `yaml:"rules"`
+}
+
+// Transport tunes the connection pool used for downstream calls.
+type Transport struct {
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	HTTP2               bool          `yaml:"http2"`
+	// ForceHTTP2 sends every request over HTTP/2, using h2c for http://
+	// receivers, falling back to HTTP/1.1 for hosts that don't support it.
+	ForceHTTP2 bool `yaml:"force_http2"`
+	// HTTP3 experimentally sends requests to receivers whose load
+	// balancer advertises HTTP/3 over it, falling back to HTTP/2 or
+	// HTTP/1.1 when it fails. It needs a build with -tags http3.
+	HTTP3 bool `yaml:"http3"`
+	// Diagnostics logs the protocol and connection reuse of each attempt
+	// at debug level, and per-host totals every DiagnosticsInterval.
+	Diagnostics         bool          `yaml:"diagnostics"`
+	DiagnosticsInterval time.Duration `yaml:"diagnostics_interval"`
+	// KeepAlive is the TCP keep-alive period; negative disables keep-alives
+	// and connection reuse.
+	KeepAlive time.Duration `yaml:"keep_alive"`
+	// TLS configures certificates for receivers with private CAs or mutual
+	// TLS.
+	TLS TLS `yaml:"tls"`
+}
+
+// TLS configures the certificates used for downstream calls.
+type TLS struct {
+	// CAFile is a PEM bundle of root CAs trusted in addition to the
+	// system roots.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are a client certificate and key for mutual
+	// TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// MinVersion is the minimum TLS version: "1.2" or "1.3". Empty keeps
+	// the Go default.
+	MinVersion string `yaml:"min_version"`
+}
+
+// tlsVersions maps the accepted minimum TLS versions to crypto/tls.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Settings returns the authclient TLS settings described by t.
+func (t TLS) Settings() authclient.TLSSettings {
+	return authclient.TLSSettings{
+		CAFile:     t.CAFile,
+		CertFile:   t.CertFile,
+		KeyFile:    t.KeyFile,
+		MinVersion: tlsVersions[t.MinVersion],
+	}
+}
+
+// Timeouts bound the phases of a downstream call.
+type Timeouts struct {
+	// Dial bounds establishing a TCP connection.
+	Dial time.Duration `yaml:"dial"`
+	// TLSHandshake bounds the TLS handshake of a new connection.
+	TLSHandshake time.Duration `yaml:"tls_handshake"`
+	// Attempt bounds each attempt until the response headers arrive. Zero
+	// disables the per-attempt timeout.
+	Attempt time.Duration `yaml:"attempt"`
+	// Request bounds the whole call, including retries and reading the
+	// response body.
+	Request time.Duration `yaml:"request"`
+}
+
+// Policy returns the authclient timeout policy described by t.
+func (t Timeouts) Policy() authclient.TimeoutPolicy {
+	return authclient.TimeoutPolicy{
+		Attempt: t.Attempt,
+		Overall: t.Request,
+	}
+}
+
+// ClientOptions returns the options for the Google API clients the service
+// creates, which set the quota project if one is configured.
+func (c *Config) ClientOptions() []option.ClientOption {
+	if c.QuotaProject == "" {
+		return nil
+	}
+	return []option.ClientOption{authclient.QuotaProject(c.QuotaProject)}
+}
+
+// Impersonation returns how ID and access tokens are minted for
+// ImpersonateServiceAccount.
+func (c *Config) Impersonation() authclient.Impersonation {
+	return authclient.Impersonation{
+		TargetPrincipal: c.ImpersonateServiceAccount,
+		Delegates:       c.ImpersonationDelegates,
+		OmitEmail:       c.ImpersonationOmitEmail,
+	}
+}
+
+// CaptureSettings returns the logging capture settings described by the
+// capture configuration. The configured headers, which may carry API keys,
+// are always masked.
+func (c *Config) CaptureSettings() logging.Capture {
+	headers := append([]string(nil), c.Capture.RedactHeaders...)
+	for name := range c.Headers {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+	return logging.Capture{
+		MaxBodySize:   c.Capture.MaxBodySize,
+		RedactHeaders: headers,
+		RedactFields:  c.Capture.RedactFields,
+	}
+}
+
+// TransportSettings returns the authclient transport settings described by
+// the transport and timeout configuration. It fails if the configured
+// certificates cannot be loaded.
+func (c *Config) TransportSettings() (authclient.TransportSettings, error) {
+	settings := authclient.TransportSettings{
+		MaxIdleConns:        c.Transport.MaxIdleConns,
+		MaxIdleConnsPerHost: c.Transport.MaxIdleConnsPerHost,
+		IdleConnTimeout:     c.Transport.IdleConnTimeout,
+		DialTimeout:         c.Timeouts.Dial,
+		TLSHandshakeTimeout: c.Timeouts.TLSHandshake,
+		HTTP2:               c.Transport.HTTP2,
+		ForceHTTP2:          c.Transport.ForceHTTP2,
+		KeepAlive:           c.Transport.KeepAlive,
+		DialOverrides:       downstream.DialOverrides(c.Services),
+	}
+	if t := c.Transport.TLS.Settings(); !t.IsZero() {
+		cfg, err := t.Config()
+		if err != nil {
+			return authclient.TransportSettings{}, err
+		}
+		settings.TLS = cfg
+	}
+	return settings, nil
+}
+
+// ResponseCache configures caching of downstream GET responses.
+type ResponseCache struct {
+	Enabled bool `yaml:"enabled"`
+	// DefaultTTL applies to responses without a Cache-Control max-age.
+	// Zero caches only responses that set one.
+	DefaultTTL time.Duration `yaml:"default_ttl"`
+	// MaxEntries bounds the in-memory cache.
+	MaxEntries int `yaml:"max_entries"`
+	// RedisAddr, if set, stores responses in Redis at this host:port
+	// instead of in memory.
+	RedisAddr string `yaml:"redis_addr"`
+	// RedisAuth secures the connection to RedisAddr.
+	RedisAuth `yaml:",inline"`
+}
+
+// Outbox configures the asynchronous delivery of requests accepted on
+// /enqueue/{service}.
+type Outbox struct {
+	Enabled bool `yaml:"enabled"`
+	// Store is where messages are kept until delivered: memory, file or
+	// firestore.
+	Store string `yaml:"store"`
+	// Dir is the directory of the file store.
+	Dir string `yaml:"dir"`
+	// FirestoreProject is the project of the Firestore store. It defaults
+	// to the project the service runs in.
+	FirestoreProject string `yaml:"firestore_project"`
+	// FirestoreCollection is the collection messages are kept in.
+	FirestoreCollection string `yaml:"firestore_collection"`
+	// MaxAttempts is how many deliveries are tried before a message is
+	// dead-lettered.
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoff is the delay after the first failed delivery, which
+	// doubles after each further failure up to MaxBackoff.
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	// PollInterval is how often the store is checked for due messages.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Lease is how long a message being delivered is hidden from other
+	// instances. It must exceed the request timeout.
+	Lease time.Duration `yaml:"lease"`
+	// BatchSize is how many messages are delivered concurrently.
+	BatchSize int `yaml:"batch_size"`
+	// MaxBodySize bounds the bodies of enqueued requests.
+	MaxBodySize int64 `yaml:"max_body_size"`
+}
+
+// Outbox stores.
+const (
+	OutboxStoreMemory    = "memory"
+	OutboxStoreFile      = "file"
+	OutboxStoreFirestore = "firestore"
+)
+
+// Retry configures retries of downstream calls.
+type Retry struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	RetryOn        []int         `yaml:"retry_on"`
+	// IdempotencyKeys attaches an Idempotency-Key header to mutating
+	// requests, so receivers can deduplicate their retries.
+	IdempotencyKeys bool `yaml:"idempotency_keys"`
+	// Budget caps the share of requests to each service that are retried.
+	Budget RetryBudget `yaml:"budget"`
+	// BodyBufferLimit, if positive, buffers request bodies of up to this
+	// many bytes so they can be retried, and refuses larger ones.
+	BodyBufferLimit int64 `yaml:"body_buffer_limit"`
+}
+
+// Server configures the limits of the sending service's HTTP server.
+// Zero durations and sizes disable the corresponding limit.
+type Server struct {
+	// ReadHeaderTimeout is how long a caller may take to send the headers
+	// of a request, which stops clients that open connections and trickle
+	// headers in to hold them.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// ReadTimeout is how long a caller may take to send a whole request,
+	// body included. Leave it zero to accept slow, large uploads.
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	// WriteTimeout is how long a request may take from the end of its
+	// headers to the end of its response. It cuts off streamed responses
+	// and WebSocket connections too, so it is zero by default.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// IdleTimeout is how long a keep-alive connection is kept open waiting
+	// for the next request.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxHeaderBytes is the largest size of request headers.
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// MaxRequestBody is the largest request body accepted, in bytes.
+	// Larger ones are rejected with 413 Request Entity Too Large.
+	MaxRequestBody int64 `yaml:"max_request_body"`
+}
+
+// Uploads configures streamed uploads.
+type Uploads struct {
+	// Stream sends request bodies larger than MemoryLimit as they arrive,
+	// once, instead of buffering them.
+	Stream bool `yaml:"stream"`
+	// MemoryLimit is the largest request body held in memory. It
+	// defaults to the retry body buffer limit if that is set, and to
+	// 8 MiB otherwise.
+	MemoryLimit int64 `yaml:"memory_limit"`
+	// ProgressInterval is how many bytes of an upload are sent between
+	// updates of the upload metrics. It defaults to 64 MiB.
+	ProgressInterval int64 `yaml:"progress_interval"`
+	// MaxPartSize, if positive, is the largest part of a forwarded
+	// multipart/form-data body, such as an uploaded file.
+	MaxPartSize int64 `yaml:"max_part_size"`
+	// MaxParts, if positive, is the largest number of parts of a
+	// forwarded multipart/form-data body.
+	MaxParts int `yaml:"max_parts"`
+}
+
+// MultipartSettings returns the proxy multipart settings described by u,
+// reporting parts to obs.
+func (u Uploads) MultipartSettings(obs proxy.MultipartObserver) proxy.MultipartSettings {
+	return proxy.MultipartSettings{MaxPartSize: u.MaxPartSize, MaxParts: u.MaxParts, Observer: obs}
+}
+
+// Settings returns the authclient upload settings described by u.
+func (u Uploads) Settings(bodyBufferLimit int64) authclient.UploadSettings {
+	s := authclient.UploadSettings{MemoryLimit: u.MemoryLimit, ProgressInterval: u.ProgressInterval}
+	if s.MemoryLimit == 0 {
+		s.MemoryLimit = bodyBufferLimit
+	}
+	return s
+}
+
+// Handoff configures the hand-off of large request bodies through Cloud
+// Storage. It is enabled by setting a bucket.
+type Handoff struct {
+	// Bucket is the bucket bodies are written to. Give it a lifecycle rule
+	// that deletes old objects.
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to the names of the objects.
+	Prefix string `yaml:"prefix"`
+	// Threshold is the size above which bodies are handed off. It
+	// defaults to 16 MiB.
+	Threshold int64 `yaml:"threshold"`
+	// URLExpiry is how long the signed URLs are valid for. It defaults to
+	// 15 minutes.
+	URLExpiry time.Duration `yaml:"url_expiry"`
+	// ServiceAccount signs the URLs. It defaults to the service's own
+	// service account.
+	ServiceAccount string `yaml:"service_account"`
+}
+
+// Settings returns the handoff settings described by h.
+func (h Handoff) Settings() handoff.Settings {
+	return handoff.Settings{
+		Bucket:         h.Bucket,
+		Prefix:         h.Prefix,
+		Threshold:      h.Threshold,
+		URLExpiry:      h.URLExpiry,
+		ServiceAccount: h.ServiceAccount,
+	}
+}
+
+// RetryBudget configures the retry budget of each downstream service.
+type RetryBudget struct {
+	Enabled    bool          `yaml:"enabled"`
+	Ratio      float64       `yaml:"ratio"`
+	MinRetries int           `yaml:"min_retries"`
+	Window     time.Duration `yaml:"window"`
+}
+
+// Budget returns the authclient retry budget described by b.
+func (b RetryBudget) Budget() authclient.RetryBudget {
+	return authclient.RetryBudget{Ratio: b.Ratio, MinRetries: b.MinRetries, Window: b.Window}
+}
+
+// Policy returns the authclient retry policy described by r.
+func (r Retry) Policy() authclient.RetryPolicy {
+	p := authclient.DefaultRetryPolicy()
+	p.MaxAttempts = r.MaxAttempts
+	p.InitialBackoff = r.InitialBackoff
+	p.MaxBackoff = r.MaxBackoff
+	p.RetryOn = r.RetryOn
+	return p
+}
+
+// CircuitBreaker configures the per-service circuit breakers.
+type CircuitBreaker struct {
+	Enabled          bool          `yaml:"enabled"`
+	FailureThreshold float64       `yaml:"failure_threshold"`
+	MinRequests      int           `yaml:"min_requests"`
+	Window           time.Duration `yaml:"window"`
+	OpenTimeout      time.Duration `yaml:"open_timeout"`
+}
+
+// Settings returns the authclient breaker settings described by b.
+func (b CircuitBreaker) Settings() authclient.BreakerSettings {
+	return authclient.BreakerSettings{
+		FailureThreshold: b.FailureThreshold,
+		MinRequests:      b.MinRequests,
+		Window:           b.Window,
+		OpenTimeout:      b.OpenTimeout,
+	}
+}
+
+// ConcurrencyLimit configures the per-service concurrency limits.
+type ConcurrencyLimit struct {
+	// MaxInFlight is the number of attempts that may be in flight to each
+	// service at once. Zero disables the limit.
+	MaxInFlight int `yaml:"max_in_flight"`
+	// MaxWait is how long an attempt over the limit waits for a slot
+	// before failing with 503.
+	MaxWait time.Duration `yaml:"max_wait"`
+}
+
+// Limit returns the authclient concurrency limit described by l.
+func (l ConcurrencyLimit) Limit() authclient.ConcurrencyLimit {
+	return authclient.ConcurrencyLimit{MaxInFlight: l.MaxInFlight, MaxWait: l.MaxWait}
+}
+
+// LoadShedding configures the gate that bounds the inbound requests
+// handled at once.
+type LoadShedding struct {
+	// MaxInFlight is the number of inbound requests handled at once. Zero
+	// disables the gate.
+	MaxInFlight int `yaml:"max_in_flight"`
+	// MaxQueue is the number of requests over MaxInFlight that wait for a
+	// slot; further ones are shed with 503.
+	MaxQueue int `yaml:"max_queue"`
+	// MaxWait is how long a queued request waits for a slot before it is
+	// shed.
+	MaxWait time.Duration `yaml:"max_wait"`
+}
+
+// RateLimit configures token-bucket rate limiting of inbound requests.
+type RateLimit struct {
+	Enabled           bool    `yaml:"enabled"`
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+	// PerClient gives each client IP address its own bucket.
+	PerClient bool `yaml:"per_client"`
+}
+
+// Deadlines configures deadline propagation.
+type Deadlines struct {
+	// Propagate honors the X-Request-Deadline header of inbound requests
+	// and forwards the remaining time to downstream services.
+	Propagate bool `yaml:"propagate"`
+	// Reserve is kept back from the deadline sent downstream, to leave time
+	// for handling the response.
+	Reserve time.Duration `yaml:"reserve"`
+}
+
+// SessionAffinity configures the sessions inbound requests ask for.
+type SessionAffinity struct {
+	// Header, if set, names an inbound request header whose value is the
+	// ID of the session the request's downstream calls belong to.
+	Header string `yaml:"header"`
+	// IdleTimeout is how long a session's cookies are kept after its last
+	// request.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxSessions bounds the sessions kept at once.
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+// Compression configures Content-Encoding of downstream calls.
+type Compression struct {
+	// Requests is the encoding request bodies are compressed with, gzip or
+	// deflate; empty sends them as they are.
+	Requests string `yaml:"requests"`
+	// MinSize is the smallest body that is compressed.
+	MinSize int64 `yaml:"min_size"`
+	// Level is the compression level, from 1 to 9; 0 is the default.
+	Level int `yaml:"level"`
+	// DecompressResponses decodes gzip and deflate responses before they
+	// are returned.
+	DecompressResponses bool `yaml:"decompress_responses"`
+	// ProxyDecompress decodes proxied responses too, which are otherwise
+	// passed through as the receiving service encoded them.
+	ProxyDecompress bool `yaml:"proxy_decompress"`
+}
+
+// ResponseHeaders configures which headers of downstream responses are
+// copied back to the caller. Without rules, relayed responses only keep
+// Content-Type and proxied ones keep every end-to-end header.
+type ResponseHeaders struct {
+	// Allow lists the headers returned; empty returns every header not
+	// denied. A trailing * matches any header with that prefix.
+	Allow []string `yaml:"allow"`
+	// Deny lists headers never returned, such as Server.
+	Deny []string `yaml:"deny"`
+}
+
+// Rules returns the proxy header rules described by c.
+func (c ResponseHeaders) Rules() proxy.HeaderRules {
+	return proxy.HeaderRules{Allow: c.Allow, Deny: c.Deny}
+}
+
+// Settings returns the authclient compression settings described by c.
+func (c Compression) Settings() authclient.CompressionSettings {
+	return authclient.CompressionSettings{Encoding: c.Requests, MinSize: c.MinSize, Level: c.Level}
+}
+
+// CloudMonitoring configures the Cloud Monitoring metrics exporter.
+type CloudMonitoring struct {
+	Enabled bool `yaml:"enabled"`
+	// ProjectID is the project metrics are written to. It defaults to the
+	// project the service runs in.
+	ProjectID string `yaml:"project_id"`
+	// Interval is how often metrics are written, at least 10s.
+	Interval time.Duration `yaml:"interval"`
+	// Prefix is prepended to metric names.
+	Prefix string `yaml:"prefix"`
+}
+
+// TokenAudit configures the sampling of minted ID tokens for security
+// review.
+type TokenAudit struct {
+	// SampleRate is the fraction of minted tokens whose claims are logged,
+	// between 0 and 1. Zero disables sampling.
+	SampleRate float64 `yaml:"sample_rate"`
+	// ExpectedEmail, if set, is the service account email sampled tokens
+	// must identify.
+	ExpectedEmail string `yaml:"expected_email"`
+}
+
+// TokenStore configures sharing ID tokens between the instances of the
+// service.
+type TokenStore struct {
+	// RedisAddr, if set, stores ID tokens in Redis at this host:port, so
+	// that instances reuse each other's tokens and a rejected or flushed
+	// token is discarded by all of them.
+	RedisAddr string `yaml:"redis_addr"`
+	// RedisAuth secures the connection to RedisAddr.
+	RedisAuth `yaml:",inline"`
+}
+
+// RedisAuth secures the connection to a Redis instance, such as a
+// Memorystore instance with AUTH and in-transit encryption enabled.
+type RedisAuth struct {
+	// RedisPassword is the AUTH string. It may be an sm:// reference.
+	RedisPassword string `yaml:"redis_password"`
+	// RedisTLS connects over TLS, verifying the server against the
+	// system roots.
+	RedisTLS bool `yaml:"redis_tls"`
+	// RedisTLSCAFile is a PEM file with the CA that issued the server's
+	// certificate, which Memorystore's own server CA needs. It implies
+	// RedisTLS.
+	RedisTLSCAFile string `yaml:"redis_tls_ca_file"`
+}
+
+// Options returns the client options of the Redis instance at addr. It
+// fails if the CA file cannot be loaded.
+func (a RedisAuth) Options(addr string) (*redis.Options, error) {
+	opts := &redis.Options{Addr: addr, Password: a.RedisPassword}
+	if a.RedisTLS || a.RedisTLSCAFile != "" {
+		cfg, err := authclient.TLSSettings{CAFile: a.RedisTLSCAFile, MinVersion: tls.VersionTLS12}.Config()
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = cfg
+	}
+	return opts, nil
+}
+
+// ErrorReporting configures reporting of errors to Cloud Error Reporting.
+type ErrorReporting struct {
+	Enabled bool `yaml:"enabled"`
+	// ProjectID is the project errors are reported to. It defaults to the
+	// project the service runs in.
+	ProjectID string `yaml:"project_id"`
+}
+
+// Profiling configures profiling of the sending service.
+type Profiling struct {
+	// Pprof serves the net/http/pprof endpoints on /debug/pprof/ to the
+	// admin allowed callers.
+	Pprof bool `yaml:"pprof"`
+	// CloudProfiler uploads CPU, heap and goroutine profiles to Cloud
+	// Profiler.
+	CloudProfiler bool `yaml:"cloud_profiler"`
+	// ProjectID is the project profiles are uploaded to. It defaults to
+	// the project the service runs in.
+	ProjectID string `yaml:"project_id"`
+}
+
+// RequestSigning configures signing of downstream requests with a
+// service account's Google-managed key.
+type RequestSigning struct {
+	Enabled bool `yaml:"enabled"`
+	// ServiceAccount signs the requests. It defaults to the service's own
+	// service account.
+	ServiceAccount string `yaml:"service_account"`
+}
+
+// Encryption configures envelope encryption of downstream request and
+// response bodies. It is enabled when KMSKey or KeysetFile is set.
+type Encryption struct {
+	// KMSKey is the Cloud KMS key that wraps the data keys, of the form
+	// projects/P/locations/L/keyRings/R/cryptoKeys/K.
+	KMSKey string `yaml:"kms_key"`
+	// KeysetFile is a JSON keyset of local key encryption keys, used
+	// instead of KMSKey.
+	KeysetFile string `yaml:"keyset_file"`
+}
+
+// Enabled reports whether bodies are encrypted.
+func (e Encryption) Enabled() bool {
+	return e.KMSKey != "" || e.KeysetFile != ""
+}
+
+// Prewarm configures minting of ID tokens at startup.
+type Prewarm struct {
+	Enabled bool `yaml:"enabled"`
+	// Timeout bounds the whole warmup; startup continues when it expires.
+	Timeout time.Duration `yaml:"timeout"`
+	// Concurrency is how many tokens are minted at once.
+	Concurrency int `yaml:"concurrency"`
+}
+
+// WarmConnections configures the pings that keep connections to the
+// downstream services warm.
+type WarmConnections struct {
+	Enabled bool `yaml:"enabled"`
+	// PerService is how many connections are kept to each service.
+	PerService int `yaml:"per_service"`
+	// Interval is how often the services are pinged. It must be shorter
+	// than the transport's idle connection timeout.
+	Interval time.Duration `yaml:"interval"`
+	// Path is the path pinged with HEAD requests.
+	Path string `yaml:"path"`
+	// Timeout bounds each ping.
+	Timeout time.Duration `yaml:"timeout"`
+	// Concurrency is how many services are pinged at once.
+	Concurrency int `yaml:"concurrency"`
+}
+
+// Settings returns the authclient settings of the pings, reporting them
+// to observer.
+func (w WarmConnections) Settings(observer authclient.WarmObserver) authclient.WarmSettings {
+	return authclient.WarmSettings{Conns: w.PerService, Path: w.Path, Timeout: w.Timeout, Observer: observer}
+}
+
+// WorkloadIdentity configures minting ID tokens with Workload Identity
+// Federation credentials.
+type WorkloadIdentity struct {
+	// CredentialsFile is an external account credential configuration.
+	CredentialsFile string `yaml:"credentials_file"`
+	// ServiceAccount is the service account to mint ID tokens as. It
+	// defaults to the one the configuration impersonates.
+	ServiceAccount string `yaml:"service_account"`
+}
+
+// Vault configures minting ID tokens with OAuth2 access tokens issued by a
+// Vault GCP secrets engine roleset. It is enabled when Roleset is set.
+type Vault struct {
+	Address string `yaml:"address"`
+	// Token is the Vault token; TokenFile, such as a Vault Agent sink,
+	// takes precedence and is reread on every request to Vault.
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Namespace string `yaml:"namespace"`
+	Mount     string `yaml:"mount"`
+	Roleset   string `yaml:"roleset"`
+	// ServiceAccount is the service account to mint ID tokens as. It
+	// defaults to the roleset's own.
+	ServiceAccount string `yaml:"service_account"`
+}
+
+// Enabled reports whether ID tokens are minted through Vault.
+func (v Vault) Enabled() bool {
+	return v.Roleset != ""
+}
+
+// Dev configures local development mode, in which ID tokens come from
+// gcloud or a static token instead of the metadata server.
+type Dev struct {
+	Enabled bool `yaml:"enabled"`
+	// IdentityToken, if set, is sent as is on every request.
+	IdentityToken string `yaml:"identity_token"`
+	// ImpersonateServiceAccount is passed to gcloud when minting tokens.
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
+}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() Config {
+	policy := authclient.DefaultRetryPolicy()
+	budget := authclient.DefaultRetryBudget()
+	breaker := authclient.DefaultBreakerSettings()
+	transport := authclient.DefaultTransportSettings()
+	return Config{
+		Port:           "8080",
+		LogLevel:       "info",
+		DefaultService: downstream.DefaultName,
+		Services:       make(map[string]downstream.Service),
+		Timeouts: Timeouts{
+			Dial:         transport.DialTimeout,
+			TLSHandshake: transport.TLSHandshakeTimeout,
+			Attempt:      5 * time.Second,
+			Request:      10 * time.Second,
+		},
+		MaxResponseSize: 10 << 20,
+		Server: Server{
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+			MaxRequestBody:    32 << 20,
+		},
+		ShutdownTimeout: 8 * time.Second,
+		Transport: Transport{
+			MaxIdleConns:        transport.MaxIdleConns,
+			MaxIdleConnsPerHost: transport.MaxIdleConnsPerHost,
+			IdleConnTimeout:     transport.IdleConnTimeout,
+			HTTP2:               transport.HTTP2,
+			DiagnosticsInterval: time.Minute,
+			KeepAlive:           transport.KeepAlive,
+		},
+		Retry: Retry{
+			MaxAttempts:    policy.MaxAttempts,
+			InitialBackoff: policy.InitialBackoff,
+			MaxBackoff:     policy.MaxBackoff,
+			RetryOn:        policy.RetryOn,
+			Budget: RetryBudget{
+				Ratio:      budget.Ratio,
+				MinRetries: budget.MinRetries,
+				Window:     budget.Window,
+			},
+		},
+		CircuitBreaker: CircuitBreaker{
+			Enabled:          true,
+			FailureThreshold: breaker.FailureThreshold,
+			MinRequests:      breaker.MinRequests,
+			Window:           breaker.Window,
+			OpenTimeout:      breaker.OpenTimeout,
+		},
+		ConcurrencyLimit: ConcurrencyLimit{
+			MaxWait: time.Second,
+		},
+		LoadShedding: LoadShedding{
+			MaxWait: time.Second,
+		},
+		RateLimit: RateLimit{
+			RequestsPerSecond: 100,
+			Burst:             200,
+			PerClient:         true,
+		},
+		TokenRefreshSkew:  5 * time.Minute,
+		TokenStaleGrace:   2 * time.Minute,
+		DiscoveryInterval: 10 * time.Minute,
+		Deadlines: Deadlines{
+			Reserve: 100 * time.Millisecond,
+		},
+		SessionAffinity: SessionAffinity{
+			IdleTimeout: 30 * time.Minute,
+			MaxSessions: 10000,
+		},
+		Compression: Compression{
+			MinSize: authclient.DefaultCompressionSettings().MinSize,
+		},
+		ResponseCache: ResponseCache{
+			MaxEntries: 1000,
+		},
+		Outbox: Outbox{
+			Store:               OutboxStoreMemory,
+			FirestoreCollection: "outbox",
+			MaxAttempts:         10,
+			InitialBackoff:      time.Second,
+			MaxBackoff:          5 * time.Minute,
+			PollInterval:        time.Second,
+			Lease:               time.Minute,
+			BatchSize:           10,
+			MaxBodySize:         256 << 10,
+		},
+		Callbacks: Callbacks{
+			TTL:         callback.DefaultTTL,
+			MaxBodySize: callback.DefaultMaxBodySize,
+		},
+		Capture: Capture{
+			MaxBodySize: 4096,
+		},
+		AccessToken: AccessToken{
+			Scopes: []string{authclient.CloudPlatformScope},
+		},
+		Prewarm: Prewarm{
+			Timeout:     10 * time.Second,
+			Concurrency: 4,
+		},
+		WarmConnections: WarmConnections{
+			PerService:  2,
+			Interval:    time.Minute,
+			Path:        "/",
+			Timeout:     5 * time.Second,
+			Concurrency: 4,
+		},
+		TraceExporter: tracing.ExporterNone,
+		CloudMonitoring: CloudMonitoring{
+			Interval: cloudmonitoring.DefaultInterval,
+			Prefix:   cloudmonitoring.DefaultPrefix,
+		},
+	}
+}
+
+// Load builds the configuration from args (without the program name),
+// the environment, and the YAML file named by the -config flag or the
+// CONFIG_FILE environment variable, then validates it. The file may be an
+// sm:// reference to a Secret Manager secret version, as described by
+// ReadFile.
+func Load(args []string) (*Config, error) {
+	return load(args, ReadFile)
+}
+
+// Reload builds the configuration as Load does, with data in place of the
+// content of the configuration file, as when the file has changed.
+func Reload(args []string, data []byte) (*Config, error) {
+	return load(args, func(string) ([]byte, error) { return data, nil })
+}
+
+// readFileTimeout bounds reading the configuration file from Secret
+// Manager.
+const readFileTimeout = 10 * time.Second
+
+// ReadFile returns the content of the configuration file path, or of the
+// Secret Manager secret version it refers to if it starts with sm://, read
+// with Application Default Credentials.
+func ReadFile(path string) ([]byte, error) {
+	if !secrets.IsRef(path) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+		return data, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readFileTimeout)
+	defer cancel()
+	client, err := secrets.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	v, err := client.Resolve(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return []byte(v), nil
+}
+
+// FileData returns the content the configuration file was read with, or
+// nil if there is none.
+func (c *Config) FileData() []byte {
+	return c.fileData
+}
+
+func load(args []string, read func(path string) ([]byte, error)) (*Config, error) {
+	fs := flag.NewFlagSet("sender", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration file")
+	port := fs.String("port", "", "port to listen on")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn or error")
+	defaultService := fs.String("default-service", "", "downstream service called by the / handler")
+	requestTimeout := fs.Duration("request-timeout", 0, "overall timeout of each downstream call, including retries")
+	maxResponseSize := fs.Int64("max-response-size", 0, "largest downstream response body in bytes; 0 disables the limit")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "how long in-flight requests may run after SIGTERM")
+	retryMaxAttempts := fs.Int("retry-max-attempts", 0, "attempts per downstream call; 1 disables retries")
+	proxyMode := fs.Bool("proxy-mode", false, "forward every inbound request to the default service")
+	traceExporter := fs.String("trace-exporter", "", "trace exporter: none, stdout or otlp")
+	impersonate := fs.String("impersonate-service-account", "", "service account to mint ID tokens as")
+	dev := fs.Bool("dev", false, "use local credentials instead of the metadata server")
+	validate := fs.Bool("validate", false, "check that every downstream service can be called, then exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		data, err := read(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.loadFile(*configFile, data); err != nil {
+			return nil, err
+		}
+		cfg.File, cfg.fileData = *configFile, data
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "default-service":
+			cfg.DefaultService = *defaultService
+		case "request-timeout":
+			cfg.Timeouts.Request = *requestTimeout
+		case "max-response-size":
+			cfg.MaxResponseSize = *maxResponseSize
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = *shutdownTimeout
+		case "retry-max-attempts":
+			cfg.Retry.MaxAttempts = *retryMaxAttempts
+		case "proxy-mode":
+			cfg.ProxyMode = *proxyMode
+		case "validate":
+			cfg.ValidateOnly = *validate
+		case "trace-exporter":
+			cfg.TraceExporter = *traceExporter
+		case "impersonate-service-account":
+			cfg.ImpersonateServiceAccount = *impersonate
+		case "dev":
+			cfg.Dev.Enabled = *dev
+		}
+	})
+
+	for name, svc := range cfg.Services {
+		if svc.URL == "" && len(svc.Endpoints) > 0 {
+			svc.URL = svc.Endpoints[0].URL
+			cfg.Services[name] = svc
+		}
+		for i, e := range svc.Endpoints {
+			if e.Audience == "" {
+				svc.Endpoints[i].Audience, _ = downstream.AudienceForURL(e.URL)
+			}
+		}
+		if svc.Audience == "" {
+			// An invalid URL leaves the audience empty; Validate reports it.
+			svc.Audience, _ = downstream.AudienceForURL(svc.URL)
+			cfg.Services[name] = svc
+		}
+		if svc.Failover.URL != "" && svc.Failover.Audience == "" {
+			svc.Failover.Audience, _ = downstream.AudienceForURL(svc.Failover.URL)
+			cfg.Services[name] = svc
+		}
+	}
+
+	if cfg.IDTokenHeader == "" {
+		cfg.IDTokenHeader = "Authorization"
+		if cfg.AccessToken.Enabled {
+			cfg.IDTokenHeader = authclient.ServerlessAuthorizationHeader
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) loadFile(path string, data []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config: parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv applies the environment variables that are set.
+func (c *Config) loadEnv() error {
+	var errs []error
+	str := func(key string, dst *string) {
+		if v := os.Getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	boolean := func(key string, dst *bool) {
+		if v := os.Getenv(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+				return
+			}
+			*dst = b
+		}
+	}
+	integer64 := func(key string, dst *int64) {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	integer := func(key string, dst *int) {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	float := func(key string, dst *float64) {
+		if v := os.Getenv(key); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+				return
+			}
+			*dst = f
+		}
+	}
+	duration := func(key string, dst *time.Duration) {
+		if v := os.Getenv(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+				return
+			}
+			*dst = d
+		}
+	}
+	list := func(key string, dst *[]string) {
+		if v := os.Getenv(key); v != "" {
+			*dst = nil
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*dst = append(*dst, item)
+				}
+			}
+		}
+	}
+	redisAuth := func(prefix string, dst *RedisAuth) {
+		str(prefix+"_PASSWORD", &dst.RedisPassword)
+		boolean(prefix+"_TLS", &dst.RedisTLS)
+		str(prefix+"_TLS_CA_FILE", &dst.RedisTLSCAFile)
+	}
+	headers := func(key, raw string) {
+		if c.Headers == nil {
+			c.Headers = make(map[string]string)
+		}
+		if err := yaml.Unmarshal([]byte(raw), &c.Headers); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+		}
+	}
+	routes := func(key, raw string) {
+		if c.Tenants.Routes == nil {
+			c.Tenants.Routes = make(map[string]string)
+		}
+		if err := yaml.Unmarshal([]byte(raw), &c.Tenants.Routes); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+		}
+	}
+	pathRoutes := func(key, raw string) {
+		c.PathRoutes = nil
+		if err := yaml.Unmarshal([]byte(raw), &c.PathRoutes); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+		}
+	}
+	services := func(key, raw string) {
+		if c.Services == nil {
+			c.Services = make(map[string]downstream.Service)
+		}
+		// JSON is valid YAML, so both formats are accepted.
+		if err := yaml.Unmarshal([]byte(raw), &c.Services); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+		}
+	}
+
+	str("PORT", &c.Port)
+	str("LOG_LEVEL", &c.LogLevel)
+	str("DEFAULT_SERVICE", &c.DefaultService)
+	str("TENANT_HEADER", &c.Tenants.Header)
+	if c.Identity.Version == "" {
+		str("K_REVISION", &c.Identity.Version)
+	}
+	str("CLIENT_VERSION", &c.Identity.Version)
+	str("USER_AGENT", &c.Identity.UserAgent)
+	if v := os.Getenv("CLIENT_LABELS"); v != "" {
+		c.Identity.Labels = make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || key == "" {
+				errs = append(errs, fmt.Errorf("invalid CLIENT_LABELS: %q is not of the form key=value", pair))
+				break
+			}
+			c.Identity.Labels[key] = value
+		}
+	}
+	duration("DIAL_TIMEOUT", &c.Timeouts.Dial)
+	duration("TLS_HANDSHAKE_TIMEOUT", &c.Timeouts.TLSHandshake)
+	duration("ATTEMPT_TIMEOUT", &c.Timeouts.Attempt)
+	duration("REQUEST_TIMEOUT", &c.Timeouts.Request)
+	integer64("MAX_RESPONSE_SIZE", &c.MaxResponseSize)
+	duration("SERVER_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout)
+	duration("SERVER_READ_TIMEOUT", &c.Server.ReadTimeout)
+	duration("SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	duration("SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	integer("SERVER_MAX_HEADER_BYTES", &c.Server.MaxHeaderBytes)
+	integer64("SERVER_MAX_REQUEST_BODY", &c.Server.MaxRequestBody)
+	duration("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	boolean("SERVE_H2C", &c.ServeH2C)
+	boolean("UPLOAD_STREAMING", &c.Uploads.Stream)
+	integer64("UPLOAD_MEMORY_LIMIT", &c.Uploads.MemoryLimit)
+	integer64("UPLOAD_PROGRESS_INTERVAL", &c.Uploads.ProgressInterval)
+	integer64("UPLOAD_MAX_PART_SIZE", &c.Uploads.MaxPartSize)
+	integer("UPLOAD_MAX_PARTS", &c.Uploads.MaxParts)
+	str("HANDOFF_BUCKET", &c.Handoff.Bucket)
+	str("HANDOFF_PREFIX", &c.Handoff.Prefix)
+	integer64("HANDOFF_THRESHOLD", &c.Handoff.Threshold)
+	duration("HANDOFF_URL_EXPIRY", &c.Handoff.URLExpiry)
+	str("HANDOFF_SERVICE_ACCOUNT", &c.Handoff.ServiceAccount)
+	integer("TRANSPORT_MAX_IDLE_CONNS", &c.Transport.MaxIdleConns)
+	integer("TRANSPORT_MAX_IDLE_CONNS_PER_HOST", &c.Transport.MaxIdleConnsPerHost)
+	duration("TRANSPORT_IDLE_CONN_TIMEOUT", &c.Transport.IdleConnTimeout)
+	boolean("TRANSPORT_HTTP2", &c.Transport.HTTP2)
+	boolean("TRANSPORT_FORCE_HTTP2", &c.Transport.ForceHTTP2)
+	boolean("TRANSPORT_HTTP3", &c.Transport.HTTP3)
+	boolean("TRANSPORT_DIAGNOSTICS", &c.Transport.Diagnostics)
+	duration("TRANSPORT_DIAGNOSTICS_INTERVAL", &c.Transport.DiagnosticsInterval)
+	duration("TRANSPORT_KEEP_ALIVE", &c.Transport.KeepAlive)
+	str("TLS_CA_FILE", &c.Transport.TLS.CAFile)
+	str("TLS_CERT_FILE", &c.Transport.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.Transport.TLS.KeyFile)
+	str("TLS_MIN_VERSION", &c.Transport.TLS.MinVersion)
+	duration("HEDGE_DELAY", &c.HedgeDelay)
+	boolean("DEDUPLICATE_GETS", &c.DeduplicateGets)
+	boolean("DEADLINE_PROPAGATION", &c.Deadlines.Propagate)
+	duration("DEADLINE_RESERVE", &c.Deadlines.Reserve)
+	str("COMPRESS_REQUESTS", &c.Compression.Requests)
+	integer64("COMPRESS_MIN_SIZE", &c.Compression.MinSize)
+	integer("COMPRESS_LEVEL", &c.Compression.Level)
+	boolean("DECOMPRESS_RESPONSES", &c.Compression.DecompressResponses)
+	boolean("PROXY_DECOMPRESS", &c.Compression.ProxyDecompress)
+	boolean("REQUEST_SIGNING_ENABLED", &c.RequestSigning.Enabled)
+	str("REQUEST_SIGNING_SERVICE_ACCOUNT", &c.RequestSigning.ServiceAccount)
+	str("ENCRYPTION_KMS_KEY", &c.Encryption.KMSKey)
+	str("ENCRYPTION_KEYSET_FILE", &c.Encryption.KeysetFile)
+	boolean("RESPONSE_CACHE_ENABLED", &c.ResponseCache.Enabled)
+	duration("RESPONSE_CACHE_DEFAULT_TTL", &c.ResponseCache.DefaultTTL)
+	integer("RESPONSE_CACHE_MAX_ENTRIES", &c.ResponseCache.MaxEntries)
+	str("RESPONSE_CACHE_REDIS_ADDR", &c.ResponseCache.RedisAddr)
+	redisAuth("RESPONSE_CACHE_REDIS", &c.ResponseCache.RedisAuth)
+	boolean("OUTBOX_ENABLED", &c.Outbox.Enabled)
+	str("OUTBOX_STORE", &c.Outbox.Store)
+	str("OUTBOX_DIR", &c.Outbox.Dir)
+	str("OUTBOX_FIRESTORE_PROJECT", &c.Outbox.FirestoreProject)
+	str("OUTBOX_FIRESTORE_COLLECTION", &c.Outbox.FirestoreCollection)
+	integer("OUTBOX_MAX_ATTEMPTS", &c.Outbox.MaxAttempts)
+	duration("OUTBOX_INITIAL_BACKOFF", &c.Outbox.InitialBackoff)
+	duration("OUTBOX_MAX_BACKOFF", &c.Outbox.MaxBackoff)
+	duration("OUTBOX_POLL_INTERVAL", &c.Outbox.PollInterval)
+	duration("OUTBOX_LEASE", &c.Outbox.Lease)
+	integer("OUTBOX_BATCH_SIZE", &c.Outbox.BatchSize)
+	integer64("OUTBOX_MAX_BODY_SIZE", &c.Outbox.MaxBodySize)
+	integer("RETRY_MAX_ATTEMPTS", &c.Retry.MaxAttempts)
+	duration("RETRY_INITIAL_BACKOFF", &c.Retry.InitialBackoff)
+	duration("RETRY_MAX_BACKOFF", &c.Retry.MaxBackoff)
+	if v := os.Getenv("RETRY_ON_STATUS"); v != "" {
+		c.Retry.RetryOn = nil
+		for _, field := range strings.Split(v, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid RETRY_ON_STATUS: %w", err))
+				break
+			}
+			c.Retry.RetryOn = append(c.Retry.RetryOn, code)
+		}
+	}
+	boolean("RETRY_IDEMPOTENCY_KEYS", &c.Retry.IdempotencyKeys)
+	integer64("RETRY_BODY_BUFFER_LIMIT", &c.Retry.BodyBufferLimit)
+	boolean("RETRY_BUDGET_ENABLED", &c.Retry.Budget.Enabled)
+	float("RETRY_BUDGET_RATIO", &c.Retry.Budget.Ratio)
+	integer("RETRY_BUDGET_MIN_RETRIES", &c.Retry.Budget.MinRetries)
+	duration("RETRY_BUDGET_WINDOW", &c.Retry.Budget.Window)
+	boolean("CIRCUIT_BREAKER_ENABLED", &c.CircuitBreaker.Enabled)
+	float("CIRCUIT_BREAKER_FAILURE_THRESHOLD", &c.CircuitBreaker.FailureThreshold)
+	integer("CIRCUIT_BREAKER_MIN_REQUESTS", &c.CircuitBreaker.MinRequests)
+	duration("CIRCUIT_BREAKER_WINDOW", &c.CircuitBreaker.Window)
+	duration("CIRCUIT_BREAKER_OPEN_TIMEOUT", &c.CircuitBreaker.OpenTimeout)
+	integer("MAX_IN_FLIGHT_PER_SERVICE", &c.ConcurrencyLimit.MaxInFlight)
+	duration("CONCURRENCY_LIMIT_MAX_WAIT", &c.ConcurrencyLimit.MaxWait)
+	integer("MAX_IN_FLIGHT", &c.LoadShedding.MaxInFlight)
+	integer("MAX_QUEUE", &c.LoadShedding.MaxQueue)
+	duration("MAX_QUEUE_WAIT", &c.LoadShedding.MaxWait)
+	boolean("RATE_LIMIT_ENABLED", &c.RateLimit.Enabled)
+	float("RATE_LIMIT_RPS", &c.RateLimit.RequestsPerSecond)
+	integer("RATE_LIMIT_BURST", &c.RateLimit.Burst)
+	boolean("RATE_LIMIT_PER_CLIENT", &c.RateLimit.PerClient)
+	duration("TOKEN_REFRESH_SKEW", &c.TokenRefreshSkew)
+	duration("TOKEN_STALE_GRACE", &c.TokenStaleGrace)
+	float("TOKEN_AUDIT_SAMPLE_RATE", &c.TokenAudit.SampleRate)
+	str("TOKEN_AUDIT_EXPECTED_EMAIL", &c.TokenAudit.ExpectedEmail)
+	str("TOKEN_STORE_REDIS_ADDR", &c.TokenStore.RedisAddr)
+	redisAuth("TOKEN_STORE_REDIS", &c.TokenStore.RedisAuth)
+	boolean("PREWARM_TOKENS", &c.Prewarm.Enabled)
+	duration("PREWARM_TIMEOUT", &c.Prewarm.Timeout)
+	integer("PREWARM_CONCURRENCY", &c.Prewarm.Concurrency)
+	boolean("WARM_CONNECTIONS", &c.WarmConnections.Enabled)
+	integer("WARM_CONNECTIONS_PER_SERVICE", &c.WarmConnections.PerService)
+	duration("WARM_CONNECTIONS_INTERVAL", &c.WarmConnections.Interval)
+	str("WARM_CONNECTIONS_PATH", &c.WarmConnections.Path)
+	duration("WARM_CONNECTIONS_TIMEOUT", &c.WarmConnections.Timeout)
+	integer("WARM_CONNECTIONS_CONCURRENCY", &c.WarmConnections.Concurrency)
+	boolean("PROXY_MODE", &c.ProxyMode)
+	list("RESPONSE_HEADERS_ALLOW", &c.ResponseHeaders.Allow)
+	list("RESPONSE_HEADERS_DENY", &c.ResponseHeaders.Deny)
+	boolean("READINESS_PROBE_DOWNSTREAM", &c.ReadinessProbe)
+	duration("VALIDATE_INTERVAL", &c.ValidateInterval)
+	boolean("CHECK_INVOKER", &c.CheckInvoker)
+	duration("DISCOVERY_INTERVAL", &c.DiscoveryInterval)
+	str("REVISION_TAG_HEADER", &c.RevisionTagHeader)
+	str("SESSION_AFFINITY_HEADER", &c.SessionAffinity.Header)
+	boolean("SERVER_TIMING", &c.ServerTiming)
+	duration("SESSION_AFFINITY_IDLE_TIMEOUT", &c.SessionAffinity.IdleTimeout)
+	integer("SESSION_AFFINITY_MAX_SESSIONS", &c.SessionAffinity.MaxSessions)
+	boolean("DEBUG_TOKEN_ENDPOINT", &c.DebugTokenEndpoint)
+	list("ADMIN_ALLOWED_CALLERS", &c.Admin.AllowedCallers)
+	str("ADMIN_AUDIENCE", &c.Admin.Audience)
+	str("TOKEN_BROKER_AUDIENCE", &c.TokenBroker.Audience)
+	str("CALLBACK_URL", &c.Callbacks.URL)
+	str("CALLBACK_AUDIENCE", &c.Callbacks.Audience)
+	list("CALLBACK_ALLOWED_CALLERS", &c.Callbacks.AllowedCallers)
+	duration("CALLBACK_TTL", &c.Callbacks.TTL)
+	integer64("CALLBACK_MAX_BODY_SIZE", &c.Callbacks.MaxBodySize)
+	str("CALLBACK_REDIS_ADDR", &c.Callbacks.RedisAddr)
+	redisAuth("CALLBACK_REDIS", &c.Callbacks.RedisAuth)
+	boolean("CAPTURE_DOWNSTREAM", &c.Capture.Enabled)
+	integer("CAPTURE_MAX_BODY_SIZE", &c.Capture.MaxBodySize)
+	list("CAPTURE_REDACT_HEADERS", &c.Capture.RedactHeaders)
+	list("CAPTURE_REDACT_FIELDS", &c.Capture.RedactFields)
+	boolean("CHAOS_ENABLED", &c.Chaos.Enabled)
+	str("TRACE_EXPORTER", &c.TraceExporter)
+	boolean("CLOUD_MONITORING_ENABLED", &c.CloudMonitoring.Enabled)
+	str("CLOUD_MONITORING_PROJECT", &c.CloudMonitoring.ProjectID)
+	duration("CLOUD_MONITORING_INTERVAL", &c.CloudMonitoring.Interval)
+	str("CLOUD_MONITORING_PREFIX", &c.CloudMonitoring.Prefix)
+	boolean("ERROR_REPORTING_ENABLED", &c.ErrorReporting.Enabled)
+	str("ERROR_REPORTING_PROJECT", &c.ErrorReporting.ProjectID)
+	boolean("PPROF_ENABLED", &c.Profiling.Pprof)
+	boolean("CLOUD_PROFILER_ENABLED", &c.Profiling.CloudProfiler)
+	str("CLOUD_PROFILER_PROJECT", &c.Profiling.ProjectID)
+	str("ID_TOKEN_HEADER", &c.IDTokenHeader)
+	boolean("ACCESS_TOKEN_ENABLED", &c.AccessToken.Enabled)
+	list("ACCESS_TOKEN_SCOPES", &c.AccessToken.Scopes)
+	boolean("FORWARD_USER_CREDENTIALS", &c.ForwardUserCredentials)
+	str("BROWSER_FIREBASE_PROJECT", &c.Browser.FirebaseProject)
+	list("BROWSER_GOOGLE_CLIENT_IDS", &c.Browser.GoogleClientIDs)
+	list("BROWSER_ALLOWED_ORIGINS", &c.Browser.AllowedOrigins)
+	str("BROWSER_SESSION_COOKIE", &c.Browser.SessionCookie)
+	str("INBOUND_AUDIENCE", &c.Inbound.Audience)
+	list("INBOUND_ALLOWED_CALLERS", &c.Inbound.AllowedCallers)
+	str("GOOGLE_CLOUD_QUOTA_PROJECT", &c.QuotaProject)
+	str("IMPERSONATE_SERVICE_ACCOUNT", &c.ImpersonateServiceAccount)
+	list("IMPERSONATION_DELEGATES", &c.ImpersonationDelegates)
+	boolean("IMPERSONATION_OMIT_EMAIL", &c.ImpersonationOmitEmail)
+	str("WORKLOAD_IDENTITY_CREDENTIALS", &c.WorkloadIdentity.CredentialsFile)
+	str("WORKLOAD_IDENTITY_SERVICE_ACCOUNT", &c.WorkloadIdentity.ServiceAccount)
+	str("VAULT_ADDR", &c.Vault.Address)
+	str("VAULT_TOKEN", &c.Vault.Token)
+	str("VAULT_TOKEN_FILE", &c.Vault.TokenFile)
+	str("VAULT_NAMESPACE", &c.Vault.Namespace)
+	str("VAULT_GCP_MOUNT", &c.Vault.Mount)
+	str("VAULT_GCP_ROLESET", &c.Vault.Roleset)
+	str("VAULT_GCP_SERVICE_ACCOUNT", &c.Vault.ServiceAccount)
+	duration("SECRETS_REFRESH_INTERVAL", &c.SecretsRefreshInterval)
+	duration("CONFIG_RELOAD_INTERVAL", &c.ReloadInterval)
+	boolean("DEV_MODE", &c.Dev.Enabled)
+	str("DEV_IDENTITY_TOKEN", &c.Dev.IdentityToken)
+	str("DEV_IMPERSONATE_SERVICE_ACCOUNT", &c.Dev.ImpersonateServiceAccount)
+
+	if raw := os.Getenv("DOWNSTREAM_HEADERS"); raw != "" {
+		headers("DOWNSTREAM_HEADERS", raw)
+	}
+	if raw := os.Getenv("TENANT_ROUTES"); raw != "" {
+		routes("TENANT_ROUTES", raw)
+	}
+	if raw := os.Getenv("PATH_ROUTES"); raw != "" {
+		pathRoutes("PATH_ROUTES", raw)
+	}
+	if raw := os.Getenv("TOKEN_BROKER_GRANTS"); raw != "" {
+		c.TokenBroker.Grants = nil
+		if err := yaml.Unmarshal([]byte(raw), &c.TokenBroker.Grants); err != nil {
+			errs = append(errs, fmt.Errorf("invalid TOKEN_BROKER_GRANTS: %w", err))
+		}
+	}
+	if raw := os.Getenv("CHAOS_RULES"); raw != "" {
+		c.Chaos.Rules = nil
+		if err := yaml.Unmarshal([]byte(raw), &c.Chaos.Rules); err != nil {
+			errs = append(errs, fmt.Errorf("invalid CHAOS_RULES: %w", err))
+		}
+	}
+	if path := os.Getenv("DOWNSTREAM_SERVICES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading DOWNSTREAM_SERVICES_FILE: %w", err))
+		} else {
+			services("DOWNSTREAM_SERVICES_FILE", string(data))
+		}
+	}
+	if raw := os.Getenv("DOWNSTREAM_SERVICES"); raw != "" {
+		services("DOWNSTREAM_SERVICES", raw)
+	}
+	if u, resource := os.Getenv("RECEIVING_SERVICE_URL"), os.Getenv("RECEIVING_SERVICE_CLOUD_RUN_SERVICE"); u != "" || resource != "" {
+		if c.Services == nil {
+			c.Services = make(map[string]downstream.Service)
+		}
+		svc := downstream.Service{URL: u, CloudRunService: resource}
+		str("RECEIVING_SERVICE_AUDIENCE", &svc.Audience)
+		boolean("RECEIVING_SERVICE_STREAM", &svc.Stream)
+		boolean("RECEIVING_SERVICE_PASS_THROUGH", &svc.PassThrough)
+		str("RECEIVING_SERVICE_DIAL_ADDRESS", &svc.DialAddress)
+		str("RECEIVING_SERVICE_IAP_CLIENT_ID", &svc.IAPClientID)
+		duration("RECEIVING_SERVICE_TIMEOUT", &svc.LongRunning.Timeout)
+		duration("RECEIVING_SERVICE_KEEP_ALIVE", &svc.LongRunning.KeepAlive)
+		duration("RECEIVING_SERVICE_POLL_INTERVAL", &svc.LongRunning.PollInterval)
+		str("RECEIVING_SERVICE_FAILOVER_URL", &svc.Failover.URL)
+		str("RECEIVING_SERVICE_FAILOVER_AUDIENCE", &svc.Failover.Audience)
+		str("RECEIVING_SERVICE_FAILOVER_HEALTH_PATH", &svc.Failover.HealthPath)
+		duration("RECEIVING_SERVICE_FAILOVER_HEALTH_INTERVAL", &svc.Failover.HealthInterval)
+		c.Services[downstream.DefaultName] = svc
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+// Validate reports every problem with the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if n, err := strconv.Atoi(c.Port); err != nil || n < 1 || n > 65535 {
+		errs = append(errs, fmt.Errorf("port %q is not a valid TCP port", c.Port))
+	}
+	if _, err := c.Level(); err != nil {
+		errs = append(errs, fmt.Errorf("log level %q is not one of debug, info, warn or error", c.LogLevel))
+	}
+	if len(c.Services) == 0 {
+		errs = append(errs, errors.New("no downstream services configured; set RECEIVING_SERVICE_URL, RECEIVING_SERVICE_CLOUD_RUN_SERVICE or DOWNSTREAM_SERVICES"))
+	} else if _, ok := c.Services[c.DefaultService]; !ok {
+		errs = append(errs, fmt.Errorf("default service %q is not configured", c.DefaultService))
+	}
+	for _, name := range c.serviceNames() {
+		svc := c.Services[name]
+		if svc.URL == "" && svc.CloudRunService != "" {
+			// The URL, and the audience unless set, are discovered at
+			// startup.
+			if err := downstream.ValidateAudience(svc.Audience); svc.Audience != "" && err != nil {
+				errs = append(errs, fmt.Errorf("service %q: audience: %w", name, err))
+			}
+		} else if err := validateURL(svc.URL); err != nil {
+			errs = append(errs, fmt.Errorf("service %q: url: %w", name, err))
+		} else if _, err := downstream.AudienceForURL(svc.URL); err != nil && svc.Audience == "" {
+			errs = append(errs, fmt.Errorf("service %q: url: %w", name, err))
+		} else if svc.Audience == "" {
+			errs = append(errs, fmt.Errorf("service %q: audience must not be empty", name))
+		} else if err := downstream.ValidateAudience(svc.Audience); err != nil {
+			errs = append(errs, fmt.Errorf("service %q: audience: %w", name, err))
+		}
+		if svc.CloudRunService != "" {
+			if err := downstream.ValidateCloudRunResource(svc.CloudRunService); err != nil {
+				errs = append(errs, fmt.Errorf("service %q: cloud run service: %w", name, err))
+			}
+		}
+		if err := svc.LongRunning.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("service %q: %w", name, err))
+		}
+		if err := svc.Failover.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("service %q: %w", name, err))
+		}
+		if err := downstream.ValidateEndpoints(svc); err != nil {
+			errs = append(errs, fmt.Errorf("service %q: %w", name, err))
+		}
+	}
+	errs = append(errs, downstream.ValidateDialAddresses(c.Services)...)
+	errs = append(errs, downstream.ValidateIAP(c.Services)...)
+	for _, tenant := range c.tenantNames() {
+		name := c.Tenants.Routes[tenant]
+		if _, ok := c.Services[name]; !ok {
+			errs = append(errs, fmt.Errorf("tenant %q: service %q is not configured", tenant, name))
+		}
+	}
+	errs = append(errs, downstream.ValidateRoutes(c.PathRoutes, c.Services)...)
+	if len(c.PathRoutes) > 0 && len(c.Tenants.Routes) > 0 {
+		errs = append(errs, errors.New("path routes cannot be combined with tenant routes"))
+	}
+	for name := range c.Headers {
+		if strings.EqualFold(name, "Authorization") || strings.EqualFold(name, authclient.ServerlessAuthorizationHeader) {
+			errs = append(errs, fmt.Errorf("the %s header carries tokens and cannot be set in headers", http.CanonicalHeaderKey(name)))
+		}
+	}
+	if h := c.IDTokenHeader; !strings.EqualFold(h, "Authorization") && !strings.EqualFold(h, authclient.ServerlessAuthorizationHeader) {
+		errs = append(errs, fmt.Errorf("ID token header %q is not Authorization or %s", h, authclient.ServerlessAuthorizationHeader))
+	} else if c.AccessToken.Enabled && strings.EqualFold(h, "Authorization") {
+		errs = append(errs, errors.New("the ID token header must be X-Serverless-Authorization when an access token is sent"))
+	}
+	if err := c.ResponseHeaders.Rules().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("response headers: %w", err))
+	}
+	if c.SecretsRefreshInterval < 0 {
+		errs = append(errs, errors.New("secrets refresh interval must not be negative"))
+	}
+	if c.ReloadInterval < 0 {
+		errs = append(errs, errors.New("reload interval must not be negative"))
+	} else if c.ReloadInterval > 0 && c.File == "" {
+		errs = append(errs, errors.New("reload interval is set without a configuration file to reload"))
+	}
+	if t := c.Timeouts; t.Request <= 0 {
+		errs = append(errs, errors.New("request timeout must be positive"))
+	} else if t.Dial < 0 || t.TLSHandshake < 0 || t.Attempt < 0 {
+		errs = append(errs, errors.New("dial, TLS handshake and attempt timeouts must not be negative"))
+	} else if t.Attempt > t.Request {
+		errs = append(errs, errors.New("attempt timeout must not exceed the request timeout"))
+	}
+	if c.MaxResponseSize < 0 {
+		errs = append(errs, errors.New("max response size must not be negative"))
+	}
+	if s := c.Server; s.ReadHeaderTimeout < 0 || s.ReadTimeout < 0 || s.WriteTimeout < 0 || s.IdleTimeout < 0 {
+		errs = append(errs, errors.New("server timeouts must not be negative"))
+	}
+	if s := c.Server; s.MaxHeaderBytes < 0 || s.MaxRequestBody < 0 {
+		errs = append(errs, errors.New("server max header bytes and max request body must not be negative"))
+	}
+	if s := c.Server; s.ReadTimeout > 0 && s.ReadHeaderTimeout > s.ReadTimeout {
+		errs = append(errs, errors.New("server read header timeout must not exceed the read timeout"))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdown timeout must not be negative"))
+	}
+	if t := c.Transport; t.MaxIdleConns < 0 || t.MaxIdleConnsPerHost < 0 || t.IdleConnTimeout < 0 {
+		errs = append(errs, errors.New("transport idle connection limits and timeouts must not be negative"))
+	}
+	if c.Transport.Diagnostics && c.Transport.DiagnosticsInterval <= 0 {
+		errs = append(errs, errors.New("transport diagnostics interval must be positive"))
+	}
+	if t := c.Transport.TLS; (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("a TLS client certificate needs both cert_file and key_file"))
+	}
+	if v := c.Transport.TLS.MinVersion; v != "" && tlsVersions[v] == 0 {
+		errs = append(errs, fmt.Errorf("unsupported minimum TLS version %q; use 1.2 or 1.3", v))
+	}
+	if c.HedgeDelay < 0 {
+		errs = append(errs, errors.New("hedge delay must not be negative"))
+	}
+	if rc := c.ResponseCache; rc.Enabled && (rc.DefaultTTL < 0 || (rc.RedisAddr == "" && rc.MaxEntries < 1)) {
+		errs = append(errs, errors.New("response cache default TTL must not be negative and max entries must be at least 1"))
+	}
+	if c.Retry.MaxAttempts < 1 {
+		errs = append(errs, errors.New("retry max attempts must be at least 1"))
+	}
+	if c.Retry.BodyBufferLimit < 0 {
+		errs = append(errs, errors.New("retry body buffer limit must not be negative"))
+	}
+	if u := c.Uploads; u.MemoryLimit < 0 || u.ProgressInterval < 0 {
+		errs = append(errs, errors.New("upload memory limit and progress interval must not be negative"))
+	}
+	if u := c.Uploads; u.MaxPartSize < 0 || u.MaxParts < 0 {
+		errs = append(errs, errors.New("upload max part size and max parts must not be negative"))
+	}
+	if u := c.Uploads; u.Stream && u.MemoryLimit > 0 && c.Retry.BodyBufferLimit > u.MemoryLimit {
+		errs = append(errs, errors.New("retry body buffer limit must not exceed the upload memory limit"))
+	}
+	if c.Handoff.Bucket != "" {
+		errs = append(errs, c.Handoff.Settings().Validate()...)
+	}
+	if c.Retry.InitialBackoff < 0 || c.Retry.MaxBackoff < 0 {
+		errs = append(errs, errors.New("retry backoff must not be negative"))
+	}
+	for _, code := range c.Retry.RetryOn {
+		if code < 100 || code > 599 {
+			errs = append(errs, fmt.Errorf("retry status %d is not an HTTP status code", code))
+		}
+	}
+	if b := c.Retry.Budget; b.Enabled {
+		if b.Ratio < 0 || b.Ratio > 1 {
+			errs = append(errs, errors.New("retry budget ratio must be in [0, 1]"))
+		}
+		if b.MinRetries < 0 || b.Window <= 0 {
+			errs = append(errs, errors.New("retry budget min retries must not be negative and window must be positive"))
+		}
+	}
+	if cb := c.CircuitBreaker; cb.Enabled {
+		if cb.FailureThreshold <= 0 || cb.FailureThreshold > 1 {
+			errs = append(errs, errors.New("circuit breaker failure threshold must be in (0, 1]"))
+		}
+		if cb.MinRequests < 1 {
+			errs = append(errs, errors.New("circuit breaker min requests must be at least 1"))
+		}
+		if cb.Window <= 0 || cb.OpenTimeout <= 0 {
+			errs = append(errs, errors.New("circuit breaker window and open timeout must be positive"))
+		}
+	}
+	if ob := c.Outbox; ob.Enabled {
+		switch ob.Store {
+		case OutboxStoreMemory, OutboxStoreFirestore:
+		case OutboxStoreFile:
+			if ob.Dir == "" {
+				errs = append(errs, errors.New("outbox dir must be set for the file store"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("outbox store %q is not one of memory, file or firestore", ob.Store))
+		}
+		if ob.Store == OutboxStoreFirestore && ob.FirestoreCollection == "" {
+			errs = append(errs, errors.New("outbox Firestore collection must not be empty"))
+		}
+		if ob.MaxAttempts < 1 || ob.BatchSize < 1 {
+			errs = append(errs, errors.New("outbox max attempts and batch size must be at least 1"))
+		}
+		if ob.InitialBackoff <= 0 || ob.MaxBackoff < ob.InitialBackoff || ob.PollInterval <= 0 || ob.MaxBodySize < 1 {
+			errs = append(errs, errors.New("outbox backoffs, poll interval and max body size must be positive, and max backoff at least the initial backoff"))
+		}
+		if ob.Lease <= c.Timeouts.Request {
+			errs = append(errs, errors.New("outbox lease must exceed the request timeout"))
+		}
+	}
+	if len(c.Admin.AllowedCallers) > 0 && c.Admin.Audience == "" {
+		errs = append(errs, errors.New("admin audience must be set with admin allowed callers"))
+	}
+	if tb := c.TokenBroker; len(tb.Grants) > 0 {
+		if tb.Audience == "" {
+			errs = append(errs, errors.New("token broker audience must be set with token broker grants"))
+		}
+		errs = append(errs, broker.ValidateGrants(tb.Grants)...)
+	}
+	if cb := c.Callbacks; cb.URL != "" {
+		if err := validateURL(cb.URL); err != nil {
+			errs = append(errs, fmt.Errorf("callback url: %w", err))
+		}
+		if len(cb.AllowedCallers) == 0 {
+			errs = append(errs, errors.New("callback allowed callers must be set with a callback url"))
+		}
+		if cb.TTL <= 0 || cb.MaxBodySize <= 0 {
+			errs = append(errs, errors.New("callback ttl and max body size must be positive"))
+		}
+	}
+	if b := c.Browser; b.Enabled() {
+		for _, o := range b.AllowedOrigins {
+			if _, err := browser.ParseOrigin(o); err != nil {
+				errs = append(errs, fmt.Errorf("browser allowed origins: %w", err))
+			}
+		}
+		if c.ForwardUserCredentials {
+			errs = append(errs, errors.New("forward user credentials cannot be used with browser mode, which describes the user instead"))
+		}
+		if c.Inbound.Audience != "" {
+			errs = append(errs, errors.New("inbound authentication cannot be used with browser mode, which authenticates the callers itself"))
+		}
+	} else if len(b.AllowedOrigins) > 0 || b.SessionCookie != "" {
+		errs = append(errs, errors.New("browser allowed origins and session cookie need a browser firebase project or google client ids"))
+	}
+	if in := c.Inbound; in.Audience == "" && len(in.AllowedCallers) > 0 {
+		errs = append(errs, errors.New("inbound audience must be set with inbound allowed callers"))
+	} else {
+		for _, caller := range in.AllowedCallers {
+			if _, err := path.Match(caller, ""); err != nil {
+				errs = append(errs, fmt.Errorf("invalid inbound allowed caller pattern %q", caller))
+			}
+		}
+	}
+	if c.Profiling.Pprof && len(c.Admin.AllowedCallers) == 0 {
+		errs = append(errs, errors.New("pprof endpoints need admin allowed callers"))
+	}
+	if ls := c.LoadShedding; ls.MaxInFlight < 0 || ls.MaxQueue < 0 || ls.MaxWait < 0 {
+		errs = append(errs, errors.New("load shedding max in flight, max queue and max wait must not be negative"))
+	}
+	if cl := c.ConcurrencyLimit; cl.MaxInFlight < 0 || cl.MaxWait < 0 {
+		errs = append(errs, errors.New("concurrency limit max in flight and max wait must not be negative"))
+	}
+	if rl := c.RateLimit; rl.Enabled && (rl.RequestsPerSecond <= 0 || rl.Burst < 1) {
+		errs = append(errs, errors.New("rate limit requests per second must be positive and burst at least 1"))
+	}
+	if c.TokenRefreshSkew < 0 || c.TokenRefreshSkew >= time.Hour {
+		errs = append(errs, errors.New("token refresh skew must be between 0 and 1h, the lifetime of an ID token"))
+	}
+	if c.TokenStaleGrace < 0 || c.TokenStaleGrace >= time.Hour {
+		errs = append(errs, errors.New("token stale grace must be between 0 and 1h, the lifetime of an ID token"))
+	}
+	if r := c.TokenAudit.SampleRate; r < 0 || r > 1 {
+		errs = append(errs, errors.New("token audit sample rate must be between 0 and 1"))
+	}
+	if p := c.Prewarm; p.Enabled && (p.Timeout <= 0 || p.Concurrency < 1) {
+		errs = append(errs, errors.New("prewarm timeout must be positive and concurrency at least 1"))
+	}
+	if w := c.WarmConnections; w.Enabled {
+		if w.Interval <= 0 || w.Timeout <= 0 || w.PerService < 1 || w.Concurrency < 1 {
+			errs = append(errs, errors.New("warm connections interval and timeout must be positive, and per service and concurrency at least 1"))
+		}
+		if t := c.Transport.IdleConnTimeout; t > 0 && w.Interval >= t {
+			errs = append(errs, fmt.Errorf("warm connections interval must be shorter than the transport idle connection timeout of %v", t))
+		}
+		if n := c.Transport.MaxIdleConnsPerHost; n > 0 && w.PerService > n {
+			errs = append(errs, fmt.Errorf("warm connections per service must not exceed the transport max idle connections per host of %d", n))
+		}
+		if !strings.HasPrefix(w.Path, "/") {
+			errs = append(errs, errors.New("warm connections path must start with /"))
+		}
+	}
+	if e := c.Encryption; e.KMSKey != "" && e.KeysetFile != "" {
+		errs = append(errs, errors.New("encryption kms key and keyset file are mutually exclusive"))
+	} else if e.KMSKey != "" && (!strings.HasPrefix(e.KMSKey, "projects/") || !strings.Contains(e.KMSKey, "/cryptoKeys/")) {
+		errs = append(errs, fmt.Errorf("encryption kms key %q must be of the form projects/P/locations/L/keyRings/R/cryptoKeys/K", e.KMSKey))
+	}
+	if c.Deadlines.Reserve < 0 {
+		errs = append(errs, errors.New("deadline reserve must not be negative"))
+	}
+	if s := c.SessionAffinity; s.IdleTimeout < 0 || s.MaxSessions < 0 {
+		errs = append(errs, errors.New("session affinity idle timeout and max sessions must not be negative"))
+	}
+	if c.Compression.Requests != "" {
+		if err := c.Compression.Settings().Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if at := c.AccessToken; at.Enabled && len(at.Scopes) == 0 {
+		errs = append(errs, errors.New("access token scopes must not be empty"))
+	}
+	if c.ImpersonateServiceAccount == "" && (len(c.ImpersonationDelegates) > 0 || c.ImpersonationOmitEmail) {
+		errs = append(errs, errors.New("impersonation delegates and omit email need an impersonated service account"))
+	}
+	for _, d := range c.ImpersonationDelegates {
+		if !strings.Contains(d, "@") {
+			errs = append(errs, fmt.Errorf("impersonation delegate %q must be a service account email", d))
+		}
+	}
+	if c.Dev.Enabled && (c.ImpersonateServiceAccount != "" || c.WorkloadIdentity.CredentialsFile != "" || c.Vault.Enabled()) {
+		// Their token sources would replace the development one.
+		errs = append(errs, errors.New("dev mode cannot be combined with impersonation, workload identity or a vault roleset; set dev.impersonate_service_account to mint ID tokens as a service account"))
+	}
+	if c.ImpersonateServiceAccount != "" && c.WorkloadIdentity.CredentialsFile != "" {
+		// Workload identity would mint the tokens and the impersonated
+		// service account would be ignored.
+		errs = append(errs, errors.New("impersonation cannot be combined with workload identity; set workload_identity.service_account to mint ID tokens as another service account"))
+	}
+	if v := c.Vault; v.Enabled() {
+		if err := validateURL(v.Address); err != nil {
+			errs = append(errs, fmt.Errorf("vault address: %w", err))
+		}
+		if v.Token == "" && v.TokenFile == "" {
+			errs = append(errs, errors.New("vault token or token file must be set with a vault roleset"))
+		}
+		if c.ImpersonateServiceAccount != "" || c.WorkloadIdentity.CredentialsFile != "" {
+			errs = append(errs, errors.New("vault roleset cannot be combined with impersonation or workload identity"))
+		}
+	}
+	if c.Capture.MaxBodySize < 0 {
+		errs = append(errs, errors.New("capture max body size must not be negative"))
+	}
+	if c.Chaos.Enabled {
+		if len(c.Chaos.Rules) == 0 {
+			errs = append(errs, errors.New("chaos needs at least one rule"))
+		}
+		errs = append(errs, chaos.ValidateRules(c.Chaos.Rules)...)
+	}
+	if c.ValidateInterval < 0 {
+		errs = append(errs, errors.New("validate interval must not be negative"))
+	}
+	if c.DiscoveryInterval < 0 {
+		errs = append(errs, errors.New("discovery interval must not be negative"))
+	}
+	switch c.TraceExporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		errs = append(errs, fmt.Errorf("trace exporter %q is not one of none, stdout or otlp", c.TraceExporter))
+	}
+	if cm := c.CloudMonitoring; cm.Enabled {
+		if cm.Interval < cloudmonitoring.MinInterval {
+			errs = append(errs, fmt.Errorf("cloud monitoring interval must be at least %s", cloudmonitoring.MinInterval))
+		}
+		if !strings.HasPrefix(cm.Prefix, "custom.googleapis.com/") {
+			errs = append(errs, fmt.Errorf("cloud monitoring prefix %q does not start with custom.googleapis.com/", cm.Prefix))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+// Level returns the parsed log level.
+func (c *Config) Level() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+// LogValue implements slog.LogValuer. Secrets are redacted so the
+// effective configuration can be logged at startup.
+func (c *Config) LogValue() slog.Value {
+	services := make([]slog.Attr, 0, len(c.Services))
+	for _, name := range c.serviceNames() {
+		svc := c.Services[name]
+		services = append(services, slog.Group(name,
+			slog.String("url", svc.URL),
+			slog.String("audience", svc.Audience),
+			slog.Bool("stream", svc.Stream),
+			slog.Bool("pass_through", svc.PassThrough),
+			slog.String("dial_address", svc.DialAddress),
+			slog.String("iap_client_id", svc.IAPClientID),
+			slog.String("cloud_run_service", svc.CloudRunService),
+			slog.Group("long_running",
+				slog.Duration("timeout", svc.LongRunning.Timeout),
+				slog.Duration("keep_alive", svc.LongRunning.KeepAlive),
+				slog.Duration("poll_interval", svc.LongRunning.PollInterval),
+			),
+			slog.Group("failover",
+				slog.String("url", svc.Failover.URL),
+				slog.String("audience", svc.Failover.Audience),
+				slog.String("health_path", svc.Failover.HealthPath),
+				slog.Duration("health_interval", svc.Failover.HealthInterval),
+			),
+			slog.Int("endpoints", len(svc.Endpoints)),
+			slog.String("balancing", svc.Balancing.Strategy),
+		))
+	}
+
+	return slog.GroupValue(
+		slog.String("port", c.Port),
+		slog.String("log_level", c.LogLevel),
+		slog.String("default_service", c.DefaultService),
+		slog.Attr{Key: "services", Value: slog.GroupValue(services...)},
+		slog.Group("identity",
+			slog.String("user_agent", c.Identity.UserAgent),
+			slog.String("version", c.Identity.Version),
+			slog.Any("labels", c.Identity.Labels),
+		),
+		slog.Group("tenants",
+			slog.String("header", c.Tenants.Header),
+			slog.Attr{Key: "routes", Value: slog.GroupValue(c.routeAttrs()...)},
+		),
+		slog.Attr{Key: "path_routes", Value: slog.GroupValue(c.pathRouteAttrs()...)},
+		slog.Attr{Key: "headers", Value: slog.GroupValue(c.headerAttrs()...)},
+		slog.Duration("secrets_refresh_interval", c.SecretsRefreshInterval),
+		slog.String("file", c.File),
+		slog.Duration("reload_interval", c.ReloadInterval),
+		slog.Group("timeouts",
+			slog.Duration("dial", c.Timeouts.Dial),
+			slog.Duration("tls_handshake", c.Timeouts.TLSHandshake),
+			slog.Duration("attempt", c.Timeouts.Attempt),
+			slog.Duration("request", c.Timeouts.Request),
+		),
+		slog.Int64("max_response_size", c.MaxResponseSize),
+		slog.Group("server",
+			slog.Duration("read_header_timeout", c.Server.ReadHeaderTimeout),
+			slog.Duration("read_timeout", c.Server.ReadTimeout),
+			slog.Duration("write_timeout", c.Server.WriteTimeout),
+			slog.Duration("idle_timeout", c.Server.IdleTimeout),
+			slog.Int("max_header_bytes", c.Server.MaxHeaderBytes),
+			slog.Int64("max_request_body", c.Server.MaxRequestBody),
+		),
+		slog.Duration("shutdown_timeout", c.ShutdownTimeout),
+		slog.Bool("serve_h2c", c.ServeH2C),
+		slog.Group("uploads",
+			slog.Bool("stream", c.Uploads.Stream),
+			slog.Int64("memory_limit", c.Uploads.MemoryLimit),
+			slog.Int64("progress_interval", c.Uploads.ProgressInterval),
+			slog.Int64("max_part_size", c.Uploads.MaxPartSize),
+			slog.Int("max_parts", c.Uploads.MaxParts),
+		),
+		slog.Group("handoff",
+			slog.String("bucket", c.Handoff.Bucket),
+			slog.String("prefix", c.Handoff.Prefix),
+			slog.Int64("threshold", c.Handoff.Threshold),
+			slog.Duration("url_expiry", c.Handoff.URLExpiry),
+			slog.String("service_account", c.Handoff.ServiceAccount),
+		),
+		slog.Group("transport",
+			slog.Int("max_idle_conns", c.Transport.MaxIdleConns),
+			slog.Int("max_idle_conns_per_host", c.Transport.MaxIdleConnsPerHost),
+			slog.Duration("idle_conn_timeout", c.Transport.IdleConnTimeout),
+			slog.Bool("http2", c.Transport.HTTP2),
+			slog.Bool("force_http2", c.Transport.ForceHTTP2),
+			slog.Bool("http3", c.Transport.HTTP3),
+			slog.Bool("diagnostics", c.Transport.Diagnostics),
+			slog.Duration("diagnostics_interval", c.Transport.DiagnosticsInterval),
+			slog.Duration("keep_alive", c.Transport.KeepAlive),
+			slog.Group("tls",
+				slog.String("ca_file", c.Transport.TLS.CAFile),
+				slog.String("cert_file", c.Transport.TLS.CertFile),
+				slog.String("key_file", c.Transport.TLS.KeyFile),
+				slog.String("min_version", c.Transport.TLS.MinVersion),
+			),
+		),
+		slog.Duration("hedge_delay", c.HedgeDelay),
+		slog.Bool("deduplicate_gets", c.DeduplicateGets),
+		slog.Group("response_cache",
+			slog.Bool("enabled", c.ResponseCache.Enabled),
+			slog.Duration("default_ttl", c.ResponseCache.DefaultTTL),
+			slog.Int("max_entries", c.ResponseCache.MaxEntries),
+			slog.String("redis_addr", c.ResponseCache.RedisAddr),
+			slog.String("redis_password", redact(c.ResponseCache.RedisPassword)),
+			slog.Bool("redis_tls", c.ResponseCache.RedisTLS),
+			slog.String("redis_tls_ca_file", c.ResponseCache.RedisTLSCAFile),
+		),
+		slog.Group("outbox",
+			slog.Bool("enabled", c.Outbox.Enabled),
+			slog.String("store", c.Outbox.Store),
+			slog.String("dir", c.Outbox.Dir),
+			slog.String("firestore_project", c.Outbox.FirestoreProject),
+			slog.String("firestore_collection", c.Outbox.FirestoreCollection),
+			slog.Int("max_attempts", c.Outbox.MaxAttempts),
+			slog.Duration("initial_backoff", c.Outbox.InitialBackoff),
+			slog.Duration("max_backoff", c.Outbox.MaxBackoff),
+			slog.Duration("poll_interval", c.Outbox.PollInterval),
+			slog.Duration("lease", c.Outbox.Lease),
+			slog.Int("batch_size", c.Outbox.BatchSize),
+			slog.Int64("max_body_size", c.Outbox.MaxBodySize),
+		),
+		slog.Group("deadlines",
+			slog.Bool("propagate", c.Deadlines.Propagate),
+			slog.Duration("reserve", c.Deadlines.Reserve),
+		),
+		slog.Group("compression",
+			slog.String("requests", c.Compression.Requests),
+			slog.Int64("min_size", c.Compression.MinSize),
+			slog.Int("level", c.Compression.Level),
+			slog.Bool("decompress_responses", c.Compression.DecompressResponses),
+			slog.Bool("proxy_decompress", c.Compression.ProxyDecompress),
+		),
+		slog.Group("request_signing",
+			slog.Bool("enabled", c.RequestSigning.Enabled),
+			slog.String("service_account", c.RequestSigning.ServiceAccount),
+		),
+		slog.Group("encryption",
+			slog.String("kms_key", c.Encryption.KMSKey),
+			slog.String("keyset_file", c.Encryption.KeysetFile),
+		),
+		slog.Group("retry",
+			slog.Int("max_attempts", c.Retry.MaxAttempts),
+			slog.Duration("initial_backoff", c.Retry.InitialBackoff),
+			slog.Duration("max_backoff", c.Retry.MaxBackoff),
+			slog.Any("retry_on", c.Retry.RetryOn),
+			slog.Bool("idempotency_keys", c.Retry.IdempotencyKeys),
+			slog.Int64("body_buffer_limit", c.Retry.BodyBufferLimit),
+			slog.Group("budget",
+				slog.Bool("enabled", c.Retry.Budget.Enabled),
+				slog.Float64("ratio", c.Retry.Budget.Ratio),
+				slog.Int("min_retries", c.Retry.Budget.MinRetries),
+				slog.Duration("window", c.Retry.Budget.Window),
+			),
+		),
+		slog.Group("circuit_breaker",
+			slog.Bool("enabled", c.CircuitBreaker.Enabled),
+			slog.Float64("failure_threshold", c.CircuitBreaker.FailureThreshold),
+			slog.Int("min_requests", c.CircuitBreaker.MinRequests),
+			slog.Duration("window", c.CircuitBreaker.Window),
+			slog.Duration("open_timeout", c.CircuitBreaker.OpenTimeout),
+		),
+		slog.Group("concurrency_limit",
+			slog.Int("max_in_flight", c.ConcurrencyLimit.MaxInFlight),
+			slog.Duration("max_wait", c.ConcurrencyLimit.MaxWait),
+		),
+		slog.Group("load_shedding",
+			slog.Int("max_in_flight", c.LoadShedding.MaxInFlight),
+			slog.Int("max_queue", c.LoadShedding.MaxQueue),
+			slog.Duration("max_wait", c.LoadShedding.MaxWait),
+		),
+		slog.Group("rate_limit",
+			slog.Bool("enabled", c.RateLimit.Enabled),
+			slog.Float64("requests_per_second", c.RateLimit.RequestsPerSecond),
+			slog.Int("burst", c.RateLimit.Burst),
+			slog.Bool("per_client", c.RateLimit.PerClient),
+		),
+		slog.Duration("token_refresh_skew", c.TokenRefreshSkew),
+		slog.Duration("token_stale_grace", c.TokenStaleGrace),
+		slog.Group("token_audit",
+			slog.Float64("sample_rate", c.TokenAudit.SampleRate),
+			slog.String("expected_email", c.TokenAudit.ExpectedEmail),
+		),
+		slog.Group("token_store",
+			slog.String("redis_addr", c.TokenStore.RedisAddr),
+			slog.String("redis_password", redact(c.TokenStore.RedisPassword)),
+			slog.Bool("redis_tls", c.TokenStore.RedisTLS),
+			slog.String("redis_tls_ca_file", c.TokenStore.RedisTLSCAFile),
+		),
+		slog.Group("prewarm",
+			slog.Bool("enabled", c.Prewarm.Enabled),
+			slog.Duration("timeout", c.Prewarm.Timeout),
+			slog.Int("concurrency", c.Prewarm.Concurrency),
+		),
+		slog.Group("warm_connections",
+			slog.Bool("enabled", c.WarmConnections.Enabled),
+			slog.Int("per_service", c.WarmConnections.PerService),
+			slog.Duration("interval", c.WarmConnections.Interval),
+			slog.String("path", c.WarmConnections.Path),
+			slog.Duration("timeout", c.WarmConnections.Timeout),
+			slog.Int("concurrency", c.WarmConnections.Concurrency),
+		),
+		slog.Bool("proxy_mode", c.ProxyMode),
+		slog.Group("response_headers",
+			slog.Any("allow", c.ResponseHeaders.Allow),
+			slog.Any("deny", c.ResponseHeaders.Deny),
+		),
+		slog.Bool("readiness_probe_downstream", c.ReadinessProbe),
+		slog.Duration("validate_interval", c.ValidateInterval),
+		slog.Bool("check_invoker", c.CheckInvoker),
+		slog.Duration("discovery_interval", c.DiscoveryInterval),
+		slog.String("revision_tag_header", c.RevisionTagHeader),
+		slog.Group("session_affinity",
+			slog.String("header", c.SessionAffinity.Header),
+			slog.Duration("idle_timeout", c.SessionAffinity.IdleTimeout),
+			slog.Int("max_sessions", c.SessionAffinity.MaxSessions),
+		),
+		slog.Bool("server_timing", c.ServerTiming),
+		slog.Bool("debug_token_endpoint", c.DebugTokenEndpoint),
+		slog.Group("admin",
+			slog.Any("allowed_callers", c.Admin.AllowedCallers),
+			slog.String("audience", c.Admin.Audience),
+		),
+		slog.Group("token_broker",
+			slog.String("audience", c.TokenBroker.Audience),
+			slog.Any("grants", c.TokenBroker.Grants),
+		),
+		slog.Group("callbacks",
+			slog.String("url", c.Callbacks.URL),
+			slog.String("audience", c.Callbacks.Audience),
+			slog.Any("allowed_callers", c.Callbacks.AllowedCallers),
+			slog.Duration("ttl", c.Callbacks.TTL),
+			slog.Int64("max_body_size", c.Callbacks.MaxBodySize),
+			slog.String("redis_addr", c.Callbacks.RedisAddr),
+			slog.String("redis_password", redact(c.Callbacks.RedisPassword)),
+			slog.Bool("redis_tls", c.Callbacks.RedisTLS),
+			slog.String("redis_tls_ca_file", c.Callbacks.RedisTLSCAFile),
+		),
+		slog.Group("capture",
+			slog.Bool("enabled", c.Capture.Enabled),
+			slog.Int("max_body_size", c.Capture.MaxBodySize),
+			slog.Any("redact_headers", c.Capture.RedactHeaders),
+			slog.Any("redact_fields", c.Capture.RedactFields),
+		),
+		slog.Group("chaos",
+			slog.Bool("enabled", c.Chaos.Enabled),
+			slog.Any("rules", c.Chaos.Rules),
+		),
+		slog.String("trace_exporter", c.TraceExporter),
+		slog.Group("cloud_monitoring",
+			slog.Bool("enabled", c.CloudMonitoring.Enabled),
+			slog.String("project_id", c.CloudMonitoring.ProjectID),
+			slog.Duration("interval", c.CloudMonitoring.Interval),
+			slog.String("prefix", c.CloudMonitoring.Prefix),
+		),
+		slog.Group("error_reporting",
+			slog.Bool("enabled", c.ErrorReporting.Enabled),
+			slog.String("project_id", c.ErrorReporting.ProjectID),
+		),
+		slog.Group("profiling",
+			slog.Bool("pprof", c.Profiling.Pprof),
+			slog.Bool("cloud_profiler", c.Profiling.CloudProfiler),
+			slog.String("project_id", c.Profiling.ProjectID),
+		),
+		slog.String("id_token_header", c.IDTokenHeader),
+		slog.Group("access_token",
+			slog.Bool("enabled", c.AccessToken.Enabled),
+			slog.Any("scopes", c.AccessToken.Scopes),
+		),
+		slog.Bool("forward_user_credentials", c.ForwardUserCredentials),
+		slog.Group("browser",
+			slog.String("firebase_project", c.Browser.FirebaseProject),
+			slog.Any("google_client_ids", c.Browser.GoogleClientIDs),
+			slog.Any("allowed_origins", c.Browser.AllowedOrigins),
+			slog.String("session_cookie", c.Browser.SessionCookie),
+		),
+		slog.Group("inbound",
+			slog.String("audience", c.Inbound.Audience),
+			slog.Any("allowed_callers", c.Inbound.AllowedCallers),
+		),
+		slog.String("quota_project", c.QuotaProject),
+		slog.String("impersonate_service_account", c.ImpersonateServiceAccount),
+		slog.Any("impersonation_delegates", c.ImpersonationDelegates),
+		slog.Bool("impersonation_omit_email", c.ImpersonationOmitEmail),
+		slog.Group("workload_identity",
+			slog.String("credentials_file", c.WorkloadIdentity.CredentialsFile),
+			slog.String("service_account", c.WorkloadIdentity.ServiceAccount),
+		),
+		slog.Group("vault",
+			slog.String("address", c.Vault.Address),
+			slog.String("token", redact(c.Vault.Token)),
+			slog.String("token_file", c.Vault.TokenFile),
+			slog.String("namespace", c.Vault.Namespace),
+			slog.String("mount", c.Vault.Mount),
+			slog.String("roleset", c.Vault.Roleset),
+			slog.String("service_account", c.Vault.ServiceAccount),
+		),
+		slog.Group("dev",
+			slog.Bool("enabled", c.Dev.Enabled),
+			slog.String("identity_token", redact(c.Dev.IdentityToken)),
+			slog.String("impersonate_service_account", c.Dev.ImpersonateServiceAccount),
+		),
+	)
+}
+
+// headerAttrs lists the configured header names with their values
+// redacted, since headers typically carry API keys.
+func (c *Config) headerAttrs() []slog.Attr {
+	names := make([]string, 0, len(c.Headers))
+	for name := range c.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		attrs = append(attrs, slog.String(name, redact(c.Headers[name])))
+	}
+	return attrs
+}
+
+// HasSecretRefs reports whether any setting refers to Secret Manager.
+func (c *Config) HasSecretRefs() bool {
+	for _, v := range c.Headers {
+		if secrets.IsRef(v) {
+			return true
+		}
+	}
+	for _, a := range c.redisAuths() {
+		if secrets.IsRef(a.RedisPassword) {
+			return true
+		}
+	}
+	return secrets.IsRef(c.Dev.IdentityToken) || secrets.IsRef(c.Vault.Token)
+}
+
+// redisAuths returns the connection settings of the Redis instances.
+func (c *Config) redisAuths() []*RedisAuth {
+	return []*RedisAuth{&c.ResponseCache.RedisAuth, &c.TokenStore.RedisAuth, &c.Callbacks.RedisAuth}
+}
+
+// ResolveSecrets replaces the sm:// references in the settings that may hold
+// secrets, the header values, the development identity token, the Vault
+// token and the Redis passwords, with the values resolve returns.
+func (c *Config) ResolveSecrets(ctx context.Context, resolve func(context.Context, string) (string, error)) error {
+	headers, err := ResolveHeaders(ctx, c.Headers, resolve)
+	if err != nil {
+		return err
+	}
+	c.Headers = headers
+	if c.Dev.IdentityToken, err = resolve(ctx, c.Dev.IdentityToken); err != nil {
+		return fmt.Errorf("config: dev identity token: %w", err)
+	}
+	if c.Vault.Token, err = resolve(ctx, c.Vault.Token); err != nil {
+		return fmt.Errorf("config: Vault token: %w", err)
+	}
+	for _, a := range c.redisAuths() {
+		if a.RedisPassword, err = resolve(ctx, a.RedisPassword); err != nil {
+			return fmt.Errorf("config: Redis password: %w", err)
+		}
+	}
+	return nil
+}
+
+// ResolveHeaders returns a copy of headers with the values passed through
+// resolve.
+func ResolveHeaders(ctx context.Context, headers map[string]string, resolve func(context.Context, string) (string, error)) (map[string]string, error) {
+	resolved := make(map[string]string, len(headers))
+	for name, v := range headers {
+		r, err := resolve(ctx, v)
+		if err != nil {
+			return nil, fmt.Errorf("config: header %s: %w", name, err)
+		}
+		resolved[name] = r
+	}
+	return resolved, nil
+}
+
+// HTTPHeaders returns the configured headers as an http.Header.
+func (c *Config) HTTPHeaders() http.Header {
+	h := make(http.Header, len(c.Headers))
+	for name, value := range c.Headers {
+		h.Set(name, value)
+	}
+	return h
+}
+
+// pathRouteAttrs lists the path routes, each as its path with the service,
+// rewrite and policy.
+func (c *Config) pathRouteAttrs() []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(c.PathRoutes))
+	for _, route := range c.PathRoutes {
+		group := []any{
+			slog.String("service", route.Service),
+			slog.String("rewrite", route.Rewrite),
+		}
+		if !route.Policy.IsZero() {
+			group = append(group, slog.Any("policy", route.Policy))
+		}
+		attrs = append(attrs, slog.Group(route.Path, group...))
+	}
+	return attrs
+}
+
+// routeAttrs lists the tenant routes in sorted order.
+func (c *Config) routeAttrs() []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(c.Tenants.Routes))
+	for _, tenant := range c.tenantNames() {
+		attrs = append(attrs, slog.String(tenant, c.Tenants.Routes[tenant]))
+	}
+	return attrs
+}
+
+func (c *Config) tenantNames() []string {
+	names := make([]string, 0, len(c.Tenants.Routes))
+	for name := range c.Tenants.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Config) serviceNames() []string {
+	names := make([]string, 0, len(c.Services))
+	for name := range c.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q must use http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
@@ -0,0 +1,47 @@
+// Package deadline propagates request deadlines through the sending
+// service: the deadline a caller sends in the X-Request-Deadline header
+// becomes the deadline of the request context, which the authenticated
+// client forwards to the receiving service.
+package deadline
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/logging"
+)
+
+// Middleware returns a handler that sets the deadline of each request's
+// context from its X-Request-Deadline header. Requests whose deadline has
+// already passed are rejected with 504 Gateway Timeout, and malformed
+// headers are ignored.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(authclient.DeadlineHeader)
+		if v == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		deadline, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Ignoring malformed request deadline",
+				slog.String("deadline", v),
+				slog.Any("error", err),
+			)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !time.Now().Before(deadline) {
+			apierror.Write(w, r, apierror.New(http.StatusGatewayTimeout, apierror.CodeDeadlineExceeded, "Request deadline exceeded"))
+			return
+		}
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/idtoken"
+
+	"sender/apierror"
+	"sender/downstream"
+	"sender/logging"
+)
+
+// tokenInfo is the body of a /debug/token response. The token itself is
+// never included.
+type tokenInfo struct {
+	Service   string                 `json:"service"`
+	Audience  string                 `json:"audience"`
+	Identity  string                 `json:"identity,omitempty"`
+	Issuer    string                 `json:"issuer"`
+	Expiry    time.Time              `json:"expiry"`
+	ExpiresIn string                 `json:"expires_in"`
+	Claims    map[string]interface{} `json:"claims"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+// debugToken returns a handler for /debug/token that obtains the ID token
+// the sending service would send to a downstream service and describes it:
+// its claims, its expiry and the service account it identifies, which is
+// what a receiving service answering 403 sees. The service is chosen with
+// ?service=name or ?audience=url, and defaults to defaultService. Only
+// configured services can be inspected.
+func debugToken(registry *downstream.Registry, defaultService string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := defaultService
+		if s := r.URL.Query().Get("service"); s != "" {
+			if _, ok := registry.Service(s); !ok {
+				apierror.Write(w, r, apierror.New(http.StatusNotFound, apierror.CodeUnknownService, "Unknown downstream service"))
+				return
+			}
+			name = s
+		} else if audience := r.URL.Query().Get("audience"); audience != "" {
+			var ok bool
+			if name, ok = registry.NameForAudience(audience); !ok {
+				apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodeAudienceNotAllowed, "Audience is not a configured downstream service"))
+				return
+			}
+		}
+
+		svc, _ := registry.Service(name)
+		info := tokenInfo{Service: name, Audience: svc.Audience}
+		status := http.StatusOK
+		if err := inspectToken(registry, name, &info); err != nil {
+			logging.FromContext(r.Context()).Warn("Failed to obtain ID token for inspection", slog.String("service", name), slog.Any("error", err))
+			info.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(info)
+	}
+}
+
+// inspectToken fills info from the current ID token for the named service.
+func inspectToken(registry *downstream.Registry, name string, info *tokenInfo) error {
+	client, err := registry.Client(name)
+	if err != nil {
+		return err
+	}
+	tok, err := client.Token()
+	if err != nil {
+		return err
+	}
+	payload, err := idtoken.ParsePayload(tok.AccessToken)
+	if err != nil {
+		return err
+	}
+	info.Identity, _ = payload.Claims["email"].(string)
+	info.Issuer = payload.Issuer
+	info.Expiry = time.Unix(payload.Expires, 0).UTC()
+	info.ExpiresIn = time.Until(info.Expiry).Round(time.Second).String()
+	info.Claims = payload.Claims
+	return nil
+}
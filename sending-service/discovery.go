@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"sender/downstream"
+	"sender/proxy"
+)
+
+// discoverTimeout bounds a lookup of the discovered service URLs.
+const discoverTimeout = 30 * time.Second
+
+// discoverServices looks up the URL of every service configured by Cloud
+// Run resource name rather than URL, setting it in services, along with
+// the audience if none is configured. It returns the names of those
+// services, each mapped to whether its audience is derived from the URL.
+func discoverServices(ctx context.Context, logger *slog.Logger, d *downstream.Discoverer, services map[string]downstream.Service) (map[string]bool, error) {
+	discovered := make(map[string]bool)
+	for name, svc := range services {
+		if svc.URL == "" {
+			discovered[name] = svc.Audience == ""
+		}
+	}
+	for _, name := range sortedNames(discovered) {
+		svc, err := d.Discover(ctx, services[name], discovered[name])
+		if err != nil {
+			return nil, err
+		}
+		services[name] = svc
+		logger.Info("Discovered downstream service URL",
+			slog.String("service", name),
+			slog.String("cloud_run_service", svc.CloudRunService),
+			slog.String("url", svc.URL),
+			slog.String("audience", svc.Audience),
+		)
+	}
+	return discovered, nil
+}
+
+// rediscoverLoop looks up the URLs of the discovered services every
+// interval for the life of the process, updating the registry when one
+// changes, as when a service is deleted and deployed again. Failed
+// lookups are logged and keep the last URL.
+func rediscoverLoop(logger *slog.Logger, d *downstream.Discoverer, registry *downstream.Registry, discovered map[string]bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+		for _, name := range sortedNames(discovered) {
+			old, _ := registry.Service(name)
+			svc, err := d.Discover(ctx, old, discovered[name])
+			if err != nil {
+				logger.Warn("Failed to look up downstream service URL", slog.String("service", name), slog.Any("error", err))
+				continue
+			}
+			if svc.URL == old.URL && svc.Audience == old.Audience {
+				continue
+			}
+			registry.Update(name, svc)
+			logger.Info("Downstream service URL changed",
+				slog.String("service", name),
+				slog.String("old_url", old.URL),
+				slog.String("url", svc.URL),
+				slog.String("audience", svc.Audience),
+			)
+		}
+		cancel()
+	}
+}
+
+// serviceProxy forwards requests to the current URL of a downstream
+// service, building a new reverse proxy when discovery changes it.
+type serviceProxy struct {
+	logger   *slog.Logger
+	registry *downstream.Registry
+	name     string
+	opts     []proxy.Option
+
+	mu      sync.Mutex
+	url     string
+	handler http.Handler
+}
+
+func (p *serviceProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.current().ServeHTTP(w, r)
+}
+
+func (p *serviceProxy) current() http.Handler {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if svc, _ := p.registry.Service(p.name); svc.URL != p.url {
+		h, err := buildProxy(p.logger, p.registry, p.name, p.opts...)
+		if err != nil {
+			p.logger.Error("Failed to proxy to the new downstream service URL", slog.String("service", p.name), slog.Any("error", err))
+			return p.handler
+		}
+		p.url, p.handler = svc.URL, h
+	}
+	return p.handler
+}
+
+func sortedNames(m map[string]bool) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,149 @@
+package downstream
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"sender/authclient"
+)
+
+// AudienceForURL derives the ID token audience for a service from its URL:
+// the scheme and host, lower-cased and without the default port, path,
+// query or fragment. Cloud Run only accepts tokens for the bare service
+// URL, so a URL such as https://svc-xyz.a.run.app/api/v1 must not be used
+// as the audience verbatim. Services behind a custom domain need an
+// explicit audience instead, since the derived one names the domain.
+//
+// Cloud Functions URLs on cloudfunctions.net are the exception: many
+// functions share a host, and tokens must name the function, so their
+// audience keeps the first path segment, as in
+// https://europe-west1-my-project.cloudfunctions.net/resize. This holds for
+// 1st gen functions and for 2nd gen functions called through that URL;
+// 2nd gen functions called through their run.app URL are Cloud Run services
+// and get the bare URL.
+//
+// The tag URL of a Cloud Run revision, such as
+// https://canary---svc-xyz.a.run.app, gets the audience of the service
+// itself, https://svc-xyz.a.run.app, which Cloud Run accepts on every tag
+// URL.
+func AudienceForURL(rawURL string) (string, error) {
+	u, err := parseServiceURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	host := strings.ToLower(u.Hostname())
+	if _, untagged, ok := strings.Cut(host, authclient.RevisionTagSeparator); ok && strings.HasSuffix(host, ".run.app") {
+		host = untagged
+	}
+	if port := u.Port(); port != "" && !(u.Scheme == "https" && port == "443") && !(u.Scheme == "http" && port == "80") {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	audience := u.Scheme + "://" + host
+	if isFunctionsHost(host) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+		if name == "" {
+			return "", fmt.Errorf("%q names no function", rawURL)
+		}
+		audience += "/" + name
+	}
+	return audience, nil
+}
+
+// FunctionURL returns the cloudfunctions.net URL of the Cloud Function name
+// deployed in region of project, such as
+// https://us-central1-my-project.cloudfunctions.net/resize, which is also
+// the audience of its ID tokens.
+func FunctionURL(region, project, name string) string {
+	return "https://" + region + "-" + project + ".cloudfunctions.net/" + name
+}
+
+// isFunctionsHost reports whether host serves Cloud Functions by path.
+func isFunctionsHost(host string) bool {
+	return strings.HasSuffix(host, ".cloudfunctions.net")
+}
+
+// ValidateAudience checks that an explicitly configured audience is a
+// well-formed absolute http or https URL, or an OAuth client ID such as
+// 123456789-abc.apps.googleusercontent.com, for receivers behind IAP or
+// with validators that expect one. Explicit audiences, such as the run.app
+// URL of a service behind a custom domain or a Cloud Run custom audience,
+// are otherwise used verbatim, whatever URL requests are sent to.
+func ValidateAudience(audience string) error {
+	if strings.HasSuffix(strings.ToLower(audience), oauthClientIDSuffix) {
+		if !IsOAuthClientID(audience) {
+			return fmt.Errorf("%q is not an OAuth client ID of the form 123456789-abc.apps.googleusercontent.com", audience)
+		}
+		return nil
+	}
+	if _, err := parseServiceURL(audience); err != nil {
+		return fmt.Errorf("%w; use the URL or OAuth client ID the receiving service expects", err)
+	}
+	return nil
+}
+
+// oauthClientIDSuffix ends the OAuth client IDs of Google Cloud projects.
+const oauthClientIDSuffix = ".apps.googleusercontent.com"
+
+// IsOAuthClientID reports whether audience is an OAuth client ID, such as
+// the client ID of an IAP-protected backend: a project number, a dash and
+// an identifier, followed by .apps.googleusercontent.com.
+func IsOAuthClientID(audience string) bool {
+	id, ok := strings.CutSuffix(audience, oauthClientIDSuffix)
+	if !ok {
+		return false
+	}
+	number, name, ok := strings.Cut(id, "-")
+	if !ok || number == "" || name == "" {
+		return false
+	}
+	for _, r := range number {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// CustomDomainAudience reports whether svc sends HTTPS requests to a host
+// other than a run.app or cloudfunctions.net URL with tokens for that host. That is right for a
+// custom audience configured on the service, but a service mapped to a
+// custom domain only accepts tokens for its run.app URL, which must then
+// be set as the audience.
+func CustomDomainAudience(svc Service) bool {
+	u, err := parseServiceURL(svc.URL)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	if host := strings.ToLower(u.Hostname()); strings.HasSuffix(host, ".run.app") || isFunctionsHost(host) {
+		return false
+	}
+	derived, err := AudienceForURL(svc.URL)
+	return err == nil && svc.Audience == derived
+}
+
+func parseServiceURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%q must use http or https", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", raw)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("%q must not contain credentials", raw)
+	}
+	return u, nil
+}
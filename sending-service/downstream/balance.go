@@ -0,0 +1,79 @@
+package downstream
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"sender/authclient"
+)
+
+// Endpoint is one deployment of a service whose calls are spread over
+// several, such as one per region.
+type Endpoint struct {
+	// URL is the base URL of the endpoint.
+	URL string `json:"url" yaml:"url"`
+	// Audience is the audience of the ID tokens sent to the endpoint. It
+	// defaults to the scheme and host of URL.
+	Audience string `json:"audience,omitempty" yaml:"audience,omitempty"`
+	// Weight is the endpoint's share of calls relative to the others, 1 by
+	// default.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+// Balancing configures how calls are spread over the Endpoints of a
+// service. See authclient.NewBalancer.
+type Balancing struct {
+	// Strategy is random, the default, or round_robin.
+	Strategy string `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+	// EjectAfter is the number of calls in a row an endpoint must fail to
+	// be ejected, 3 by default.
+	EjectAfter int `json:"eject_after,omitempty" yaml:"eject_after,omitempty"`
+	// EjectFor is how long an ejected endpoint gets no calls, 30 seconds
+	// by default.
+	EjectFor time.Duration `json:"eject_for,omitempty" yaml:"eject_for,omitempty"`
+}
+
+// ValidateEndpoints checks the endpoints and balancing of svc.
+func ValidateEndpoints(svc Service) error {
+	if len(svc.Endpoints) == 0 {
+		if svc.Balancing != (Balancing{}) {
+			return errors.New("balancing is set without endpoints")
+		}
+		return nil
+	}
+	if !svc.Failover.IsZero() {
+		return errors.New("endpoints and failover cannot both be set")
+	}
+	for i, e := range svc.Endpoints {
+		if _, err := parseServiceURL(e.URL); err != nil {
+			return fmt.Errorf("endpoint %d: url: %w", i, err)
+		}
+		if err := ValidateAudience(e.Audience); err != nil {
+			return fmt.Errorf("endpoint %d: audience: %w", i, err)
+		}
+		if e.Weight < 0 {
+			return fmt.Errorf("endpoint %d: weight must not be negative", i)
+		}
+	}
+	switch svc.Balancing.Strategy {
+	case "", authclient.BalanceRandom, authclient.BalanceRoundRobin:
+	default:
+		return fmt.Errorf("balancing strategy %q is not random or round_robin", svc.Balancing.Strategy)
+	}
+	if svc.Balancing.EjectAfter < 0 || svc.Balancing.EjectFor < 0 {
+		return errors.New("balancing eject after and eject for must not be negative")
+	}
+	return nil
+}
+
+// settings returns the balancer settings of b for the named service.
+func (b Balancing) settings(name string) authclient.BalancerSettings {
+	return authclient.BalancerSettings{
+		Strategy:   b.Strategy,
+		EjectAfter: b.EjectAfter,
+		EjectFor:   b.EjectFor,
+		Logger:     slog.Default().With(slog.String("service", name)),
+	}
+}
@@ -0,0 +1,63 @@
+package downstream
+
+import (
+	"fmt"
+	"strings"
+
+	"sender/authclient"
+)
+
+// CloudRunResource returns the resource name of the Cloud Run service svc
+// calls, projects/PROJECT/locations/REGION/services/NAME, as the Cloud Run
+// Admin API takes it. It is CloudRunService if set, or else derived from
+// the run.app URL of the audience or of URL, which only works for the
+// deterministic URLs of the form https://NAME-PROJECT_NUMBER.REGION.run.app;
+// the older hashed URLs under a.run.app don't name the project, and ok is
+// false for them.
+func CloudRunResource(svc Service) (resource string, ok bool) {
+	if svc.CloudRunService != "" {
+		return svc.CloudRunService, true
+	}
+	for _, raw := range []string{svc.Audience, svc.URL} {
+		u, err := parseServiceURL(raw)
+		if err != nil {
+			continue
+		}
+		labels := strings.Split(strings.ToLower(u.Hostname()), ".")
+		if len(labels) != 4 || labels[2] != "run" || labels[3] != "app" || labels[1] == "a" {
+			continue
+		}
+		if _, untagged, ok := strings.Cut(labels[0], authclient.RevisionTagSeparator); ok {
+			labels[0] = untagged
+		}
+		i := strings.LastIndexByte(labels[0], '-')
+		if i <= 0 || !digits(labels[0][i+1:]) {
+			continue
+		}
+		return fmt.Sprintf("projects/%s/locations/%s/services/%s", labels[0][i+1:], labels[1], labels[0][:i]), true
+	}
+	return "", false
+}
+
+// ValidateCloudRunResource checks that resource is a Cloud Run service
+// resource name.
+func ValidateCloudRunResource(resource string) error {
+	parts := strings.Split(resource, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "services" ||
+		parts[1] == "" || parts[3] == "" || parts[5] == "" {
+		return fmt.Errorf("%q is not of the form projects/PROJECT/locations/REGION/services/NAME", resource)
+	}
+	return nil
+}
+
+func digits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
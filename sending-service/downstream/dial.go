@@ -0,0 +1,76 @@
+package downstream
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// DialOverrides returns the addresses to connect to in place of the hosts
+// of the services' URLs, keyed by the host:port of the URL, for services
+// with a DialAddress. Services whose URLs cannot be parsed are skipped;
+// ValidateDialAddresses reports them.
+func DialOverrides(services map[string]Service) map[string]string {
+	overrides := make(map[string]string)
+	for _, svc := range services {
+		if svc.DialAddress == "" {
+			continue
+		}
+		if addr, err := hostPort(svc.URL); err == nil {
+			overrides[addr] = svc.DialAddress
+		}
+	}
+	return overrides
+}
+
+// ValidateDialAddresses checks that every DialAddress is a host:port, and
+// that services with the same URL host do not connect to different
+// addresses, since connections are pooled by host.
+func ValidateDialAddresses(services map[string]Service) []error {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	seen := make(map[string]string)
+	for _, name := range names {
+		svc := services[name]
+		if svc.DialAddress == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(svc.DialAddress); err != nil {
+			errs = append(errs, fmt.Errorf("service %q: dial address %q is not a host:port", name, svc.DialAddress))
+			continue
+		}
+		addr, err := hostPort(svc.URL)
+		if err != nil {
+			continue
+		}
+		if other, ok := seen[addr]; ok && services[other].DialAddress != svc.DialAddress {
+			errs = append(errs, fmt.Errorf("services %q and %q share the host %s but have different dial addresses", other, name, addr))
+			continue
+		}
+		seen[addr] = name
+	}
+	return errs
+}
+
+// hostPort returns the lower-cased host:port a request to rawURL connects
+// to, with the scheme's default port if the URL has none.
+func hostPort(rawURL string) (string, error) {
+	u, err := parseServiceURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port), nil
+}
@@ -0,0 +1,67 @@
+package downstream
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/api/option"
+	run "google.golang.org/api/run/v2"
+)
+
+// Discoverer looks up the URLs of Cloud Run services with the Cloud Run
+// Admin API, for services configured by resource name rather than URL.
+// The caller needs run.services.get on them, which roles/run.viewer
+// grants.
+type Discoverer struct {
+	services *run.ProjectsLocationsServicesService
+}
+
+// NewDiscoverer creates a Discoverer whose Admin API client is created
+// with opts.
+func NewDiscoverer(ctx context.Context, opts ...option.ClientOption) (*Discoverer, error) {
+	client, err := run.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("downstream: creating Cloud Run Admin API client: %w", err)
+	}
+	return &Discoverer{services: client.Projects.Locations.Services}, nil
+}
+
+// URL returns the main URL of the Cloud Run service resource, such as
+// https://receiving-service-123456789.europe-west1.run.app.
+func (d *Discoverer) URL(ctx context.Context, resource string) (string, error) {
+	svc, err := d.services.Get(resource).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("downstream: looking up %s: %w", resource, err)
+	}
+	if svc.Uri == "" {
+		return "", fmt.Errorf("downstream: %s has no URL yet", resource)
+	}
+	return svc.Uri, nil
+}
+
+// Discover sets the URL of svc, discovered for its CloudRunService, and
+// unless audience is false, its audience, derived from the URL.
+func (d *Discoverer) Discover(ctx context.Context, svc Service, audience bool) (Service, error) {
+	u, err := d.URL(ctx, svc.CloudRunService)
+	if err != nil {
+		return svc, err
+	}
+	svc.URL = u
+	if audience {
+		if svc.Audience, err = AudienceForURL(u); err != nil {
+			return svc, fmt.Errorf("downstream: %s: %w", svc.CloudRunService, err)
+		}
+	}
+	return svc, nil
+}
+
+// NeedsDiscovery reports whether any of services is configured by Cloud
+// Run resource name without a URL.
+func NeedsDiscovery(services map[string]Service) bool {
+	for _, svc := range services {
+		if svc.URL == "" && svc.CloudRunService != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,434 @@
+// Package downstream describes the services the sending service calls and
+// hands out authenticated clients for them by name.
+package downstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sender/authclient"
+)
+
+// DefaultName is the name given to the service configured through the
+// RECEIVING_SERVICE_URL environment variable, and the default service of
+// the / handler.
+const DefaultName = "receiving-service"
+
+// Service is a named downstream service.
+type Service struct {
+	// URL is the base URL requests are sent to. If it is empty, it is
+	// discovered from the Cloud Run Admin API for CloudRunService.
+	URL string `json:"url" yaml:"url"`
+	// Audience is the audience of the ID tokens sent to the service. It
+	// defaults to the scheme and host of URL; set it for services behind a
+	// custom domain, to the run.app URL of the service.
+	Audience string `json:"audience,omitempty" yaml:"audience,omitempty"`
+	// Stream relays responses from the service as they arrive, flushing
+	// each chunk to the caller, instead of as a single size-limited body.
+	// Set it for services that send server-sent events or other streamed
+	// responses.
+	Stream bool `json:"stream,omitempty" yaml:"stream,omitempty"`
+	// PassThrough relays responses from the service verbatim, with their
+	// status code, headers and body, instead of after the relay prefix
+	// with only their content type. The response headers rules of the
+	// sending service still apply.
+	PassThrough bool `json:"pass_through,omitempty" yaml:"pass_through,omitempty"`
+	// DialAddress, if set, is the host:port connections to the service are
+	// made to, such as the IP of an internal load balancer for a service
+	// with internal ingress. URL and Audience keep naming the run.app URL,
+	// which the Host header, TLS server name and ID token still carry.
+	DialAddress string `json:"dial_address,omitempty" yaml:"dial_address,omitempty"`
+	// IAPClientID, for a service behind a load balancer with Identity-Aware
+	// Proxy, is the OAuth client ID of its backend service. Requests carry
+	// a second ID token for it in Proxy-Authorization, which IAP checks,
+	// alongside the token for Audience, which Cloud Run checks. If only IAP
+	// checks requests, set Audience to the client ID too, and only a token
+	// for it is sent.
+	IAPClientID string `json:"iap_client_id,omitempty" yaml:"iap_client_id,omitempty"`
+	// CloudRunService is the resource name of the Cloud Run service,
+	// projects/PROJECT/locations/REGION/services/NAME. Without a URL, the
+	// URL is discovered from it; otherwise it is only needed for checking
+	// that the caller may invoke the service when neither URL nor Audience
+	// is a run.app URL that names the project and region.
+	CloudRunService string `json:"cloud_run_service,omitempty" yaml:"cloud_run_service,omitempty"`
+	// LongRunning configures calls to a service whose work takes minutes.
+	LongRunning LongRunning `json:"long_running,omitempty" yaml:"long_running,omitempty"`
+	// Failover names the same service deployed in another region, which
+	// calls go to while this one fails.
+	Failover Failover `json:"failover,omitempty" yaml:"failover,omitempty"`
+	// Endpoints, if set, are deployments of the service that calls are
+	// spread over, as Balancing says. URL defaults to the first one and
+	// Audience to its audience; requests are written against URL.
+	Endpoints []Endpoint `json:"endpoints,omitempty" yaml:"endpoints,omitempty"`
+	// Balancing configures how calls are spread over Endpoints.
+	Balancing Balancing `json:"balancing,omitempty" yaml:"balancing,omitempty"`
+}
+
+// Registry resolves downstream services and their authenticated clients by
+// name.
+type Registry struct {
+	clients authclient.TokenClientFactory
+
+	mu       sync.RWMutex
+	services map[string]Service
+	// composed are the clients of services with a Failover or Endpoints,
+	// kept so that whether a service has failed over, and the health of
+	// its endpoints, outlive a single call.
+	composed map[string]*authclient.Client
+}
+
+// NewRegistry creates a Registry for the given services. Clients are taken
+// from clients, normally an *authclient.Cache so that services sharing an
+// audience share a client.
+func NewRegistry(services map[string]Service, clients authclient.TokenClientFactory) *Registry {
+	r := &Registry{services: make(map[string]Service, len(services)), composed: make(map[string]*authclient.Client), clients: clients}
+	for name, svc := range services {
+		r.services[name] = svc
+	}
+	return r
+}
+
+// Service returns the service registered under name.
+func (r *Registry) Service(name string) (Service, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	svc, ok := r.services[name]
+	return svc, ok
+}
+
+// Update replaces the service registered under name, as when its URL is
+// discovered anew. Requests already sent to the service are not affected.
+func (r *Registry) Update(name string, svc Service) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.services[name] = svc
+	delete(r.composed, name)
+}
+
+// Replace registers services in place of every service registered, with
+// clients taken from clients from then on, as when the configuration is
+// reloaded. Requests already sent are not affected.
+func (r *Registry) Replace(services map[string]Service, clients authclient.TokenClientFactory) {
+	replaced := make(map[string]Service, len(services))
+	for name, svc := range services {
+		replaced[name] = svc
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.services = replaced
+	r.clients = clients
+	r.composed = make(map[string]*authclient.Client)
+}
+
+// factory returns the factory clients are taken from.
+func (r *Registry) factory() authclient.TokenClientFactory {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clients
+}
+
+// State describes the clients the registry's factory holds, or returns
+// nil if the factory cannot describe them.
+func (r *Registry) State() []authclient.ClientState {
+	reporter, ok := r.factory().(authclient.StateReporter)
+	if !ok {
+		return nil
+	}
+	return reporter.State()
+}
+
+// Names returns the names of all registered services in sorted order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.services))
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NameForAudience returns the name of a service whose tokens are minted for
+// audience. If several services share the audience, the first in sorted
+// order is returned.
+func (r *Registry) NameForAudience(audience string) (string, bool) {
+	for _, name := range r.Names() {
+		if svc, _ := r.Service(name); svc.Audience == audience {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Client returns the authenticated client for the named service.
+func (r *Registry) Client(name string) (*authclient.Client, error) {
+	svc, ok := r.Service(name)
+	if !ok {
+		return nil, fmt.Errorf("downstream: unknown service %q", name)
+	}
+	if svc.Failover.IsZero() && len(svc.Endpoints) == 0 {
+		return r.factory().Client(svc.Audience)
+	}
+	return r.composedClient(name, svc)
+}
+
+// AudienceClient returns the client for audience, which need not be the
+// audience of a registered service, from the factory clients of services
+// are taken from, so that it mints ID tokens the same way.
+func (r *Registry) AudienceClient(audience string) (*authclient.Client, error) {
+	return r.factory().Client(audience)
+}
+
+// Doer returns an authclient.Doer that sends each request with the client
+// of its audience: that of the registered service whose URL has the
+// request's host, so that services with an explicit audience, such as
+// those behind a custom domain, are called with it, or else the audience
+// AudienceForURL derives from the request URL. Calls to registered
+// services go through their failover and endpoints, like those made with
+// Client.
+func (r *Registry) Doer() authclient.Doer {
+	return registryRouter{r}
+}
+
+// Transport returns a transport that sends each request like the Doer
+// returned by Doer, for code that takes an http.RoundTripper.
+func (r *Registry) Transport() http.RoundTripper {
+	return registryRouter{r}
+}
+
+type registryRouter struct {
+	r *Registry
+}
+
+func (d registryRouter) Do(req *http.Request) (*http.Response, error) {
+	c, err := d.r.clientForRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (d registryRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, err := d.r.clientForRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.HTTPClient().Transport.RoundTrip(req)
+}
+
+// clientForRequest returns the client req is sent with, closing its body
+// if there is none.
+func (r *Registry) clientForRequest(req *http.Request) (*authclient.Client, error) {
+	var c *authclient.Client
+	var err error
+	if name, ok := r.nameForHost(req.URL.Host); ok {
+		c, err = r.Client(name)
+	} else {
+		var audience string
+		if audience, err = AudienceForURL(req.URL.String()); err == nil {
+			c, err = r.AudienceClient(audience)
+		}
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// nameForHost returns the name of a service whose URL has host. If several
+// do, the first in sorted order is returned.
+func (r *Registry) nameForHost(host string) (string, bool) {
+	for _, name := range r.Names() {
+		svc, _ := r.Service(name)
+		if u, err := url.Parse(svc.URL); err == nil && strings.EqualFold(u.Host, host) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// composedClient returns the client that fails the named service over to
+// its secondary, or spreads its calls over its endpoints, creating it on
+// first use.
+func (r *Registry) composedClient(name string, svc Service) (*authclient.Client, error) {
+	r.mu.RLock()
+	client, ok := r.composed[name]
+	r.mu.RUnlock()
+	if ok {
+		return client, nil
+	}
+	var err error
+	if len(svc.Endpoints) > 0 {
+		client, err = r.balancer(name, svc)
+	} else {
+		client, err = r.failover(name, svc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.composed[name]; ok {
+		return existing, nil
+	}
+	r.composed[name] = client
+	return client, nil
+}
+
+func (r *Registry) failover(name string, svc Service) (*authclient.Client, error) {
+	primary, err := r.factory().Client(svc.Audience)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := r.factory().Client(svc.Failover.Audience)
+	if err != nil {
+		return nil, err
+	}
+	return authclient.NewFailover(primary, secondary, svc.Failover.URL, svc.Failover.settings(name))
+}
+
+func (r *Registry) balancer(name string, svc Service) (*authclient.Client, error) {
+	endpoints := make([]authclient.Endpoint, len(svc.Endpoints))
+	for i, e := range svc.Endpoints {
+		client, err := r.factory().Client(e.Audience)
+		if err != nil {
+			return nil, err
+		}
+		endpoints[i] = authclient.Endpoint{Client: client, URL: e.URL, Weight: e.Weight}
+	}
+	return authclient.NewBalancer(svc.URL, endpoints, svc.Balancing.settings(name))
+}
+
+// Flush discards the cached clients of the named services, or of every
+// service if no names are given, so their next requests use new clients
+// and newly minted ID tokens. It returns the audiences whose clients were
+// discarded. It fails if a name is unknown or the registry's client
+// factory is not an authclient.Flusher.
+func (r *Registry) Flush(names ...string) ([]string, error) {
+	f, ok := r.factory().(authclient.Flusher)
+	if !ok {
+		return nil, errors.New("downstream: clients cannot be flushed")
+	}
+	audiences := make([]string, 0, len(names))
+	for _, name := range names {
+		svc, ok := r.Service(name)
+		if !ok {
+			return nil, fmt.Errorf("downstream: unknown service %q", name)
+		}
+		audiences = append(audiences, svc.Audience)
+		if !svc.Failover.IsZero() {
+			audiences = append(audiences, svc.Failover.Audience)
+		}
+		for _, e := range svc.Endpoints {
+			audiences = append(audiences, e.Audience)
+		}
+	}
+	// Failover and balanced clients hold on to the clients being
+	// discarded, so they are created anew too.
+	r.mu.Lock()
+	if len(names) == 0 {
+		clear(r.composed)
+	}
+	for _, name := range names {
+		delete(r.composed, name)
+	}
+	r.mu.Unlock()
+	return f.Flush(audiences...), nil
+}
+
+// WarmupResult is the outcome of minting the first token for a service, or
+// of pinging it.
+type WarmupResult struct {
+	Service  string
+	Audience string
+	Duration time.Duration
+	Err      error
+}
+
+// Prewarm mints an ID token for every registered service, at most
+// concurrency at a time, so the first request to each service doesn't wait
+// for the metadata server. Services still minting when ctx is done are
+// reported with ctx's error. Results are in the order of Names.
+func (r *Registry) Prewarm(ctx context.Context, concurrency int) []WarmupResult {
+	return r.eachService(ctx, concurrency, r.warm)
+}
+
+// WarmConnections pings every registered service as authclient's Warm
+// does, at most concurrency services at a time, so that each keeps warm
+// connections and a recently used instance. Services still being pinged
+// when ctx is done are reported with ctx's error. Results are in the order
+// of Names.
+func (r *Registry) WarmConnections(ctx context.Context, s authclient.WarmSettings, concurrency int) []WarmupResult {
+	return r.eachService(ctx, concurrency, func(ctx context.Context, name string) error {
+		client, err := r.Client(name)
+		if err != nil {
+			return err
+		}
+		return client.Warm(ctx, s)
+	})
+}
+
+// eachService calls f for every registered service, at most concurrency
+// at a time, and times each call.
+func (r *Registry) eachService(ctx context.Context, concurrency int, f func(ctx context.Context, name string) error) []WarmupResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	names := r.Names()
+	results := make([]WarmupResult, len(names))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		svc, _ := r.Service(name)
+		results[i] = WarmupResult{Service: name, Audience: svc.Audience}
+		wg.Add(1)
+		go func(res *WarmupResult) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				res.Err = ctx.Err()
+				return
+			}
+
+			start := time.Now()
+			res.Err = f(ctx, res.Service)
+			res.Duration = time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// warm mints a token for the named service. Token sources don't take a
+// context, so a mint that outlives ctx carries on in the background and
+// its token is cached when it completes.
+func (r *Registry) warm(ctx context.Context, name string) error {
+	client, err := r.Client(name)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Token()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+package downstream
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"sender/authclient"
+)
+
+// Failover names a second deployment of a service, in another region, that
+// calls fail over to while the service cannot be reached or answers with a
+// 5xx status. See authclient.NewFailover.
+type Failover struct {
+	// URL is the base URL of the secondary deployment.
+	URL string `json:"url" yaml:"url"`
+	// Audience is the audience of the ID tokens sent to the secondary. It
+	// defaults to the scheme and host of URL.
+	Audience string `json:"audience,omitempty" yaml:"audience,omitempty"`
+	// HealthPath is the path of the primary probed while calls go to the
+	// secondary, / by default.
+	HealthPath string `json:"health_path,omitempty" yaml:"health_path,omitempty"`
+	// HealthInterval is how often the primary is probed while calls go to
+	// the secondary, 10 seconds by default.
+	HealthInterval time.Duration `json:"health_interval,omitempty" yaml:"health_interval,omitempty"`
+}
+
+// IsZero reports whether f names no secondary, so calls never fail over.
+func (f Failover) IsZero() bool {
+	return f == Failover{}
+}
+
+// Validate checks that f names a secondary URL with an audience.
+func (f Failover) Validate() error {
+	if f.IsZero() {
+		return nil
+	}
+	if _, err := parseServiceURL(f.URL); err != nil {
+		return fmt.Errorf("failover url: %w", err)
+	}
+	if err := ValidateAudience(f.Audience); err != nil {
+		return fmt.Errorf("failover audience: %w", err)
+	}
+	if f.HealthInterval < 0 {
+		return errors.New("failover health interval must not be negative")
+	}
+	return nil
+}
+
+// settings returns the failover settings of f for the named service.
+func (f Failover) settings(name string) authclient.FailoverSettings {
+	return authclient.FailoverSettings{
+		HealthPath:     f.HealthPath,
+		HealthInterval: f.HealthInterval,
+		Logger:         slog.Default().With(slog.String("service", name)),
+	}
+}
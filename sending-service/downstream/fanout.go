@@ -0,0 +1,133 @@
+package downstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxFanoutResponseSize is the largest response body Fanout reads from a
+// single service.
+const MaxFanoutResponseSize = 10 << 20
+
+// Request is one call made by Fanout.
+type Request struct {
+	// Service is the name of the downstream service to call.
+	Service string
+	// Method defaults to GET.
+	Method string
+	// Path is appended to the service's URL.
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Result is the outcome of one Request made by Fanout. Err is set if the
+// request could not be sent or its response could not be read; a response
+// with an error status is not an error.
+type Result struct {
+	Service    string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Duration   time.Duration
+	Err        error
+}
+
+// Fanout sends the requests to their services in parallel, at most
+// maxConcurrency at a time, and returns their results in the order of
+// requests. Requests still waiting to be sent when ctx is done are
+// reported with ctx's error; those in flight are cancelled.
+func (r *Registry) Fanout(ctx context.Context, requests []Request, maxConcurrency int) []Result {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	results := make([]Result, len(requests))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		results[i].Service = req.Service
+		wg.Add(1)
+		go func(req Request, res *Result) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				res.Err = ctx.Err()
+				return
+			}
+
+			start := time.Now()
+			r.send(ctx, req, res)
+			res.Duration = time.Since(start)
+		}(req, &results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// FanoutErrors returns the errors of the failed results, each annotated
+// with its service, or nil if every request succeeded.
+func FanoutErrors(results []Result) error {
+	var errs []error
+	for _, res := range results {
+		if res.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", res.Service, res.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// send makes a single fan-out request and records its response in res.
+func (r *Registry) send(ctx context.Context, req Request, res *Result) {
+	svc, ok := r.Service(req.Service)
+	if !ok {
+		res.Err = fmt.Errorf("downstream: unknown service %q", req.Service)
+		return
+	}
+	client, err := r.Client(req.Service)
+	if err != nil {
+		res.Err = err
+		return
+	}
+
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if req.Body != nil {
+		body = bytes.NewReader(req.Body)
+	}
+	u := strings.TrimSuffix(svc.URL, "/") + "/" + strings.TrimPrefix(req.Path, "/")
+	httpReq, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	for k, v := range req.Header {
+		httpReq.Header[k] = v
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	res.StatusCode = resp.StatusCode
+	res.Header = resp.Header
+	res.Body, res.Err = io.ReadAll(io.LimitReader(resp.Body, MaxFanoutResponseSize+1))
+	if res.Err == nil && len(res.Body) > MaxFanoutResponseSize {
+		res.Body = nil
+		res.Err = fmt.Errorf("downstream: response from %q exceeds %d bytes", req.Service, MaxFanoutResponseSize)
+	}
+}
@@ -0,0 +1,46 @@
+package downstream
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IAPClientIDs returns the IAP OAuth client ID of each service behind
+// Identity-Aware Proxy, keyed by the service's audience, for
+// authclient.WithIAPClientIDs.
+func IAPClientIDs(services map[string]Service) map[string]string {
+	ids := make(map[string]string)
+	for _, svc := range services {
+		if svc.IAPClientID != "" {
+			ids[svc.Audience] = svc.IAPClientID
+		}
+	}
+	return ids
+}
+
+// ValidateIAP checks that every IAPClientID is an OAuth client ID, and that
+// services sharing an audience, which share a client, agree on it.
+func ValidateIAP(services map[string]Service) []error {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	seen := make(map[string]string)
+	for _, name := range names {
+		svc := services[name]
+		if svc.IAPClientID != "" && !strings.HasSuffix(svc.IAPClientID, ".apps.googleusercontent.com") {
+			errs = append(errs, fmt.Errorf("service %q: IAP client ID %q is not an OAuth client ID ending in .apps.googleusercontent.com", name, svc.IAPClientID))
+			continue
+		}
+		if other, ok := seen[svc.Audience]; ok && services[other].IAPClientID != svc.IAPClientID {
+			errs = append(errs, fmt.Errorf("services %q and %q share the audience %s but have different IAP client IDs", other, name, svc.Audience))
+			continue
+		}
+		seen[svc.Audience] = name
+	}
+	return errs
+}
@@ -0,0 +1,60 @@
+package downstream
+
+import (
+	"errors"
+	"time"
+
+	"sender/authclient"
+)
+
+// LongRunning configures calls to a service whose work takes minutes, so
+// that neither the sending service's own timeouts nor the idle timeouts of
+// proxies and load balancers between the caller and the service cut them
+// off.
+type LongRunning struct {
+	// Timeout bounds calls to the service, including polling, instead of
+	// the request timeout of the sending service. Cloud Run still ends
+	// requests after the request timeout of the sending service's own
+	// revision, at most 60 minutes.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// KeepAlive, if set, answers the caller with 200 OK once the service
+	// has not answered for KeepAlive, and sends it a newline every
+	// KeepAlive until it does, so that the connection never looks idle.
+	// The service's status code is then sent in the X-Downstream-Status
+	// trailer after its body. Only relayed calls send keep-alives; proxied
+	// ones do not.
+	KeepAlive time.Duration `json:"keep_alive,omitempty" yaml:"keep_alive,omitempty"`
+	// PollInterval, if set, treats 202 Accepted answers carrying a
+	// Location as work the service goes on doing, and polls that status
+	// endpoint every PollInterval, or after its Retry-After, until it
+	// answers otherwise. See authclient.PollAccepted.
+	PollInterval time.Duration `json:"poll_interval,omitempty" yaml:"poll_interval,omitempty"`
+}
+
+// IsZero reports whether l leaves calls as they are.
+func (l LongRunning) IsZero() bool {
+	return l == LongRunning{}
+}
+
+// Validate checks that no duration is negative.
+func (l LongRunning) Validate() error {
+	if l.Timeout < 0 || l.KeepAlive < 0 || l.PollInterval < 0 {
+		return errors.New("long running timeout, keep alive and poll interval must not be negative")
+	}
+	if l.KeepAlive > 0 && l.Timeout > 0 && l.KeepAlive >= l.Timeout {
+		return errors.New("long running keep alive must be shorter than the timeout")
+	}
+	return nil
+}
+
+// CallOptions returns the call options that apply l to a call.
+func (l LongRunning) CallOptions() []authclient.CallOption {
+	var opts []authclient.CallOption
+	if l.Timeout > 0 {
+		opts = append(opts, authclient.CallTimeout(l.Timeout))
+	}
+	if l.PollInterval > 0 {
+		opts = append(opts, authclient.PollAccepted(l.PollInterval))
+	}
+	return opts
+}
@@ -0,0 +1,228 @@
+package downstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Route maps inbound request paths to a downstream service.
+type Route struct {
+	// Path is the path the route matches: exactly, or, if it ends in /*,
+	// the path before the wildcard and everything below it, so /orders/*
+	// matches /orders and /orders/123.
+	Path string `json:"path" yaml:"path"`
+	// Service is the name of the service matching requests are sent to.
+	Service string `json:"service" yaml:"service"`
+	// Rewrite, if set, replaces the matched path, or for a wildcard route
+	// the part before the wildcard: with /orders/* and a rewrite of
+	// /api/v1/orders, /orders/123 is sent as /api/v1/orders/123, and with
+	// a rewrite of /, as /123.
+	Rewrite string `json:"rewrite,omitempty" yaml:"rewrite,omitempty"`
+	// Policy restricts the requests the route forwards.
+	Policy RoutePolicy `json:"policy,omitempty" yaml:"policy,omitempty"`
+}
+
+// RoutePolicy restricts the requests a route forwards to what the service
+// behind it is meant to receive, so that the sending service does not relay
+// whatever its callers send. Requests that break it are rejected without
+// being forwarded. The zero RoutePolicy allows every request.
+type RoutePolicy struct {
+	// Methods, if set, are the only methods forwarded.
+	Methods []string `json:"methods,omitempty" yaml:"methods,omitempty"`
+	// PathPrefixes, if set, are the only path prefixes forwarded, matched
+	// against the path of the request before it is rewritten.
+	PathPrefixes []string `json:"path_prefixes,omitempty" yaml:"path_prefixes,omitempty"`
+	// MaxBodySize, if positive, is the largest request body in bytes
+	// forwarded.
+	MaxBodySize int64 `json:"max_body_size,omitempty" yaml:"max_body_size,omitempty"`
+	// RequiredHeaders are headers that requests must carry to be forwarded.
+	RequiredHeaders []string `json:"required_headers,omitempty" yaml:"required_headers,omitempty"`
+}
+
+// IsZero reports whether p allows every request.
+func (p RoutePolicy) IsZero() bool {
+	return len(p.Methods) == 0 && len(p.PathPrefixes) == 0 && p.MaxBodySize <= 0 && len(p.RequiredHeaders) == 0
+}
+
+// AllowsMethod reports whether p forwards requests with method.
+func (p RoutePolicy) AllowsMethod(method string) bool {
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, m := range p.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPath reports whether p forwards requests for path.
+func (p RoutePolicy) AllowsPath(path string) bool {
+	if len(p.PathPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.PathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MissingHeader returns the first of the required headers h lacks, or ""
+// if it has them all.
+func (p RoutePolicy) MissingHeader(h http.Header) string {
+	for _, name := range p.RequiredHeaders {
+		if h.Get(name) == "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// prefix returns the path a route matches, without the wildcard, and
+// whether it matches the paths below it too.
+func (r Route) prefix() (string, bool) {
+	if p, ok := strings.CutSuffix(r.Path, "/*"); ok {
+		return p, true
+	}
+	return r.Path, false
+}
+
+// PathRouter picks the downstream service for a request from its path, so
+// the sending service can act as a small API gateway in front of several
+// services. The most specific route wins: the one with the longest path,
+// and an exact route over a wildcard route with the same path.
+type PathRouter struct {
+	routes []Route
+}
+
+// NewPathRouter creates a PathRouter for routes.
+func NewPathRouter(routes []Route) *PathRouter {
+	sorted := append([]Route(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		pi, wi := sorted[i].prefix()
+		pj, wj := sorted[j].prefix()
+		if len(pi) != len(pj) {
+			return len(pi) > len(pj)
+		}
+		return !wi && wj
+	})
+	return &PathRouter{routes: sorted}
+}
+
+// Match returns the route for u and the URL to send the request to the
+// service with: u with its path rewritten by the route. ok is false if no
+// route matches.
+func (t *PathRouter) Match(u *url.URL) (route Route, rewritten *url.URL, ok bool) {
+	for _, route := range t.routes {
+		prefix, wildcard := route.prefix()
+		var rest string
+		switch {
+		case u.Path == prefix:
+		case wildcard && strings.HasPrefix(u.Path, prefix+"/"):
+			rest = u.Path[len(prefix):]
+		default:
+			continue
+		}
+
+		rewritten := *u
+		if route.Rewrite != "" {
+			rewritten.Path = strings.TrimSuffix(route.Rewrite, "/") + rest
+			if rewritten.Path == "" {
+				rewritten.Path = "/"
+			}
+			// The escaped form of the original path no longer applies.
+			rewritten.RawPath = ""
+		}
+		return route, &rewritten, true
+	}
+	return Route{}, nil, false
+}
+
+// Names returns the names of the services routes lead to, each once, in
+// sorted order.
+func (t *PathRouter) Names() []string {
+	seen := make(map[string]bool, len(t.routes))
+	var names []string
+	for _, route := range t.routes {
+		if !seen[route.Service] {
+			seen[route.Service] = true
+			names = append(names, route.Service)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateRoutes checks that every route has an absolute path, at most one
+// trailing wildcard and a configured service, and that no two routes have
+// the same path.
+func ValidateRoutes(routes []Route, services map[string]Service) []error {
+	var errs []error
+	seen := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		prefix, _ := route.prefix()
+		switch {
+		case !strings.HasPrefix(route.Path, "/"):
+			errs = append(errs, fmt.Errorf("route %q: path must start with /", route.Path))
+		case strings.Contains(prefix, "*"):
+			errs = append(errs, fmt.Errorf("route %q: only a trailing /* wildcard is supported", route.Path))
+		case seen[route.Path]:
+			errs = append(errs, fmt.Errorf("route %q: path is routed more than once", route.Path))
+		}
+		seen[route.Path] = true
+		if _, ok := services[route.Service]; !ok {
+			errs = append(errs, fmt.Errorf("route %q: service %q is not configured", route.Path, route.Service))
+		}
+		if route.Rewrite != "" && !strings.HasPrefix(route.Rewrite, "/") {
+			errs = append(errs, fmt.Errorf("route %q: rewrite must start with /", route.Path))
+		}
+		errs = append(errs, validatePolicy(route.Path, route.Policy)...)
+	}
+	return errs
+}
+
+// validatePolicy checks that the methods and required headers of the policy
+// of the route with path are valid tokens and that its path prefixes are
+// absolute.
+func validatePolicy(path string, p RoutePolicy) []error {
+	var errs []error
+	for _, m := range p.Methods {
+		if !isToken(m) {
+			errs = append(errs, fmt.Errorf("route %q: invalid method %q", path, m))
+		}
+	}
+	for _, prefix := range p.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("route %q: path prefix %q must start with /", path, prefix))
+		}
+	}
+	if p.MaxBodySize < 0 {
+		errs = append(errs, fmt.Errorf("route %q: max body size must not be negative", path))
+	}
+	for _, name := range p.RequiredHeaders {
+		if !isToken(name) {
+			errs = append(errs, fmt.Errorf("route %q: invalid required header %q", path, name))
+		}
+	}
+	return errs
+}
+
+// isToken reports whether s is a non-empty HTTP token, as methods and header
+// names are.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+			return false
+		}
+	}
+	return true
+}
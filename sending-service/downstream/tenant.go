@@ -0,0 +1,67 @@
+package downstream
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// TenantRouter picks the downstream service for a request from the tenant
+// it belongs to, so one sending service can act as a shared gateway for
+// many tenant-specific backends. The tenant is the host name the request
+// was sent to or, if the router has a tenant header, the value of that
+// header.
+type TenantRouter struct {
+	header string
+	routes map[string]string
+}
+
+// NewTenantRouter creates a TenantRouter that sends each tenant in routes
+// to the named service. An empty header identifies tenants by host name,
+// which is compared case-insensitively and without a port.
+func NewTenantRouter(header string, routes map[string]string) *TenantRouter {
+	t := &TenantRouter{header: header, routes: make(map[string]string, len(routes))}
+	for tenant, name := range routes {
+		if header == "" {
+			tenant = strings.ToLower(tenant)
+		}
+		t.routes[tenant] = name
+	}
+	return t
+}
+
+// Tenant returns the tenant of r.
+func (t *TenantRouter) Tenant(r *http.Request) string {
+	if t.header != "" {
+		return r.Header.Get(t.header)
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// Route returns the tenant of r and the name of the service it is routed
+// to. ok is false if the tenant has no route.
+func (t *TenantRouter) Route(r *http.Request) (tenant, name string, ok bool) {
+	tenant = t.Tenant(r)
+	name, ok = t.routes[tenant]
+	return tenant, name, ok
+}
+
+// Names returns the names of the services tenants are routed to, each
+// once, in sorted order.
+func (t *TenantRouter) Names() []string {
+	seen := make(map[string]bool, len(t.routes))
+	var names []string
+	for _, name := range t.routes {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
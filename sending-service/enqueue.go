@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"sender/apierror"
+	"sender/browser"
+	"sender/config"
+	"sender/downstream"
+	"sender/logging"
+	"sender/outbox"
+)
+
+// enqueuedHeaders are the request headers kept with an enqueued message and
+// sent with its deliveries.
+var enqueuedHeaders = []string{"Content-Type", "Content-Encoding"}
+
+// enqueueResult is the body of a response to an accepted request.
+type enqueueResult struct {
+	ID      string `json:"id"`
+	Service string `json:"service"`
+}
+
+// newOutbox returns the outbox described by cfg, with the store it names.
+func newOutbox(ctx context.Context, logger *slog.Logger, cfg *config.Config, registry *downstream.Registry, obs outbox.Observer) (*outbox.Outbox, error) {
+	ob := cfg.Outbox
+	var store outbox.Store
+	switch ob.Store {
+	case config.OutboxStoreFile:
+		s, err := outbox.OpenFileStore(ob.Dir)
+		if err != nil {
+			return nil, err
+		}
+		store = s
+	case config.OutboxStoreFirestore:
+		project := ob.FirestoreProject
+		if project == "" {
+			project = logging.ProjectID()
+		}
+		if project == "" {
+			return nil, errors.New("outbox: no Firestore project; set OUTBOX_FIRESTORE_PROJECT")
+		}
+		s, err := outbox.NewFirestoreStore(ctx, project, ob.FirestoreCollection, cfg.ClientOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		store = s
+	default:
+		logger.Warn("Outbox messages are kept in memory and are lost when the instance stops")
+		store = outbox.NewMemoryStore()
+	}
+	return outbox.New(store, registry,
+		outbox.WithMaxAttempts(ob.MaxAttempts),
+		outbox.WithBackoff(ob.InitialBackoff, ob.MaxBackoff),
+		outbox.WithPollInterval(ob.PollInterval),
+		outbox.WithLease(ob.Lease),
+		outbox.WithBatchSize(ob.BatchSize),
+		outbox.WithLogger(logger),
+		outbox.WithObserver(obs),
+	), nil
+}
+
+// enqueue returns a handler for /enqueue/{service}/{path} that accepts the
+// request into box for delivery to path on the named service, or on
+// defaultService for /enqueue, and answers 202 Accepted with the message ID
+// without waiting for the delivery. Bodies over maxBody bytes are rejected.
+func enqueue(box *outbox.Outbox, registry *downstream.Registry, defaultService string, maxBody int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, path := defaultService, ""
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/enqueue/"); ok {
+			name, path, _ = strings.Cut(rest, "/")
+			if path != "" {
+				path = "/" + path
+			}
+		}
+		if _, ok := registry.Service(name); !ok {
+			apierror.Write(w, r, apierror.New(http.StatusNotFound, apierror.CodeUnknownService, "Unknown downstream service"))
+			return
+		}
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			apierror.Write(w, r, apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Request body is too large to enqueue"))
+			return
+		case err != nil:
+			apierror.Write(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "Failed to read request body"))
+			return
+		}
+
+		header := make(http.Header)
+		for _, name := range enqueuedHeaders {
+			if v := r.Header.Get(name); v != "" {
+				header.Set(name, v)
+			}
+		}
+		if id := logging.RequestID(r.Context()); id != "" {
+			header.Set(logging.RequestIDHeader, id)
+		}
+		if user, ok := browser.UserContext(r.Context()); ok {
+			header.Set(browser.UserContextHeader, user)
+		}
+
+		logger := logging.FromContext(r.Context()).With(slog.String("service", name))
+		id, err := box.Enqueue(r.Context(), &outbox.Message{
+			Service: name,
+			Method:  r.Method,
+			Path:    path,
+			Header:  header,
+			Body:    body,
+		})
+		if err != nil {
+			logger.Error("Failed to enqueue request", slog.Any("error", err))
+			apierror.Write(w, r, apierror.New(http.StatusServiceUnavailable, apierror.CodeOutboxUnavailable, "Failed to store the request for delivery"))
+			return
+		}
+		logger.Info("Enqueued request", slog.String("message_id", id))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(enqueueResult{ID: id, Service: name})
+	}
+}
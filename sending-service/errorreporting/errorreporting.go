@@ -0,0 +1,268 @@
+// Package errorreporting sends the errors behind failed downstream calls
+// to Cloud Error Reporting, so that authentication misconfigurations and
+// downstream outages show up grouped in the console with the service and
+// version that hit them: ID tokens that cannot be minted, calls rejected
+// with 401 or 403, calls answered with 5xx and calls that fail outright.
+package errorreporting
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"google.golang.org/api/clouderrorreporting/v1beta1"
+	"google.golang.org/api/option"
+
+	"sender/authclient"
+)
+
+// queueSize is the number of events waiting to be sent beyond which new
+// ones are dropped, so that an outage producing errors faster than they
+// can be reported doesn't grow memory.
+const queueSize = 100
+
+// sendTimeout bounds the sending of one event.
+const sendTimeout = 10 * time.Second
+
+var _ authclient.TokenObserver = (*Reporter)(nil)
+
+// Reporter sends error events to Error Reporting in the background. It
+// implements authclient.TokenObserver, reporting tokens that cannot be
+// minted, reports failed downstream calls with the transport returned by
+// NewTransport, and failed requests with Middleware.
+//
+// Sending needs roles/errorreporting.writer on the project.
+type Reporter struct {
+	events  *clouderrorreporting.ProjectsEventsService
+	project string
+	service string
+	version string
+	logger  *slog.Logger
+
+	queue chan *clouderrorreporting.ReportedErrorEvent
+	done  chan struct{}
+}
+
+// Option configures a Reporter.
+type Option func(*Reporter)
+
+// WithServiceContext sets the service and version errors are reported
+// for. They default to the K_SERVICE and K_REVISION environment variables.
+func WithServiceContext(service, version string) Option {
+	return func(r *Reporter) {
+		r.service = service
+		r.version = version
+	}
+}
+
+// WithLogger sets the logger failed sends and dropped events are logged
+// to.
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Reporter) {
+		r.logger = logger
+	}
+}
+
+// New creates a Reporter that reports errors to project, with an Error
+// Reporting client created with clientOpts, and starts sending the events
+// it reports. Call Close to send those still queued.
+func New(ctx context.Context, project string, clientOpts []option.ClientOption, opts ...Option) (*Reporter, error) {
+	if project == "" {
+		return nil, errors.New("errorreporting: a project is required")
+	}
+	svc, err := clouderrorreporting.NewService(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("errorreporting: failed to create Error Reporting client: %w", err)
+	}
+	r := &Reporter{
+		events:  svc.Projects.Events,
+		project: project,
+		service: os.Getenv("K_SERVICE"),
+		version: os.Getenv("K_REVISION"),
+		logger:  slog.Default(),
+		queue:   make(chan *clouderrorreporting.ReportedErrorEvent, queueSize),
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.service == "" {
+		r.service = "sending-service"
+	}
+	go r.run()
+	return r, nil
+}
+
+// TokenMinted implements authclient.TokenObserver.
+func (r *Reporter) TokenMinted(audience string, expiry time.Time) {}
+
+// TokenRefreshed implements authclient.TokenObserver.
+func (r *Reporter) TokenRefreshed(audience string) {}
+
+// TokenError implements authclient.TokenObserver, reporting that no ID
+// token could be minted for audience.
+func (r *Reporter) TokenError(audience string, err error) {
+	r.report(fmt.Sprintf("minting an ID token for %s: %v", audience, err), nil)
+}
+
+// NewTransport returns a transport that reports the requests sent with
+// next that fail, or are answered with 401, 403 or 5xx. Use it as client
+// middleware, with authclient.WithMiddleware, so that a call is reported
+// once however many attempts it took.
+func (r *Reporter) NewTransport(next http.RoundTripper) http.RoundTripper {
+	return &reportTransport{next: next, reporter: r}
+}
+
+type reportTransport struct {
+	next     http.RoundTripper
+	reporter *Reporter
+}
+
+func (t *reportTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	target := req.URL.Scheme + "://" + req.URL.Host
+	ctx := &clouderrorreporting.HttpRequestContext{Method: req.Method, Url: requestURL(req), UserAgent: req.UserAgent()}
+	switch {
+	case err != nil:
+		if !errors.Is(err, context.Canceled) {
+			t.reporter.report(fmt.Sprintf("%s %s failed: %v", req.Method, target, err), ctx)
+		}
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden, resp.StatusCode >= http.StatusInternalServerError:
+		ctx.ResponseStatusCode = int64(resp.StatusCode)
+		t.reporter.report(fmt.Sprintf("%s %s answered %s", req.Method, target, resp.Status), ctx)
+	}
+	return resp, err
+}
+
+// Middleware returns middleware that reports the requests next answers
+// with 500 Internal Server Error, the errors of the sending service
+// itself. Other 5xx responses are left out: 502 and 504 follow downstream
+// errors the transport reports, and 503 follows shed load. Panics are not
+// reported either, since Error Reporting already picks up the stack traces
+// of their log entries.
+func (r *Reporter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, req)
+		if sw.status == http.StatusInternalServerError {
+			r.report(fmt.Sprintf("%s %s answered %d %s", req.Method, req.URL.Path, sw.status, http.StatusText(sw.status)),
+				&clouderrorreporting.HttpRequestContext{
+					Method:             req.Method,
+					Url:                requestURL(req),
+					UserAgent:          req.UserAgent(),
+					Referrer:           req.Referer(),
+					RemoteIp:           req.RemoteAddr,
+					ResponseStatusCode: int64(sw.status),
+				})
+		}
+	})
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.status = code
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket connections be proxied through the middleware.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.wrote = true
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// report queues an event with message, dropping it if the queue is full.
+// Events carry no stack trace, so they are located at the caller of
+// report, and grouped by message.
+func (r *Reporter) report(message string, req *clouderrorreporting.HttpRequestContext) {
+	event := &clouderrorreporting.ReportedErrorEvent{
+		EventTime:      time.Now().UTC().Format(time.RFC3339Nano),
+		Message:        message,
+		ServiceContext: &clouderrorreporting.ServiceContext{Service: r.service, Version: r.version},
+		Context:        &clouderrorreporting.ErrorContext{HttpRequest: req, ReportLocation: location()},
+	}
+	select {
+	case r.queue <- event:
+	default:
+		r.logger.Warn("Error Reporting queue full, dropping error event", slog.String("error", message))
+	}
+}
+
+// requestURL returns the URL of req without its query, which may carry
+// credentials or personal data.
+func requestURL(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = ""
+	return u.Redacted()
+}
+
+// location returns the source location of report's caller.
+func location() *clouderrorreporting.SourceLocation {
+	pc, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return &clouderrorreporting.SourceLocation{FunctionName: "unknown"}
+	}
+	loc := &clouderrorreporting.SourceLocation{FilePath: file, LineNumber: int64(line)}
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		loc.FunctionName = fn.Name()
+	}
+	return loc
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	name := "projects/" + r.project
+	for event := range r.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		if _, err := r.events.Report(name, event).Context(ctx).Do(); err != nil {
+			r.logger.Warn("Failed to send error event to Error Reporting", slog.Any("error", err))
+		}
+		cancel()
+	}
+}
+
+// Close stops accepting events and waits until those queued are sent or
+// ctx is done.
+func (r *Reporter) Close(ctx context.Context) error {
+	close(r.queue)
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,181 @@
+// Command middle is the middle hop of a three-service chain: the sending
+// service calls it, and it calls the receiving service in turn. It only
+// accepts calls carrying a valid ID token for EXPECTED_AUDIENCE, then calls
+// DOWNSTREAM_URL with an ID token of its own, forwarding the caller's token
+// in X-Forwarded-Authorization, or the one the caller forwarded itself, so
+// that the receiving service can tell who started the chain. The trace
+// and the deadline of the inbound request are carried on to the
+// downstream call.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"sender/admin"
+	"sender/apierror"
+	"sender/authclient"
+	"sender/deadline"
+	"sender/logging"
+	"sender/tracing"
+)
+
+// deadlineReserve is the time kept back from the inbound deadline to
+// answer the caller once the downstream call has failed or timed out.
+const deadlineReserve = 100 * time.Millisecond
+
+// downstreamTimeout bounds downstream calls whose inbound request carried
+// no deadline.
+const downstreamTimeout = 10 * time.Second
+
+func main() {
+	logger := slog.New(logging.NewHandler(os.Stdout, slog.LevelInfo))
+	slog.SetDefault(logger)
+
+	audience := os.Getenv("EXPECTED_AUDIENCE")
+	if audience == "" {
+		log.Fatal("EXPECTED_AUDIENCE environment variable is not set")
+	}
+	downstreamURL := os.Getenv("DOWNSTREAM_URL")
+	if downstreamURL == "" {
+		log.Fatal("DOWNSTREAM_URL environment variable is not set")
+	}
+	downstreamAudience := os.Getenv("DOWNSTREAM_AUDIENCE")
+	if downstreamAudience == "" {
+		downstreamAudience = downstreamURL
+	}
+	var callers []string
+	if v := os.Getenv("ALLOWED_CALLERS"); v != "" {
+		callers = strings.Split(v, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "middle-service", os.Getenv("TRACE_EXPORTER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// The cache keeps one client, and so one cached ID token, per
+	// audience across requests.
+	clients := authclient.NewCache(ctx,
+		authclient.WithLogger(logger),
+		authclient.WithForwardedAuthorization(),
+		authclient.WithDeadlinePropagation(deadlineReserve),
+		authclient.WithAttemptMiddleware(tracing.NewTransport),
+		authclient.WithMiddleware(func(next http.RoundTripper) http.RoundTripper {
+			return logging.NewRequestIDTransport(next)
+		}),
+	)
+
+	call := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := clients.Client(downstreamAudience)
+		if err != nil {
+			apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Failed to create downstream client"))
+			return
+		}
+		ctx := r.Context()
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, downstreamTimeout)
+			defer cancel()
+		}
+		// Forward the credentials of whoever started the chain: those our
+		// caller forwarded itself, or else the caller's own token.
+		origin := r.Header.Get(authclient.ForwardedAuthorizationHeader)
+		if origin == "" {
+			origin = r.Header.Get("Authorization")
+		}
+		ctx = authclient.ForwardAuthorization(ctx, origin)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, downstreamURL, nil)
+		if err != nil {
+			apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Invalid DOWNSTREAM_URL"))
+			return
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+				err = &authclient.DownstreamStatusError{Code: resp.StatusCode, Status: resp.Status, Header: resp.Header, Body: data}
+			}
+		}
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Downstream call failed",
+				slog.String("url", downstreamURL),
+				slog.Any("error", err),
+			)
+			apierror.Write(w, r, apierror.FromDownstream(err))
+			return
+		}
+		fmt.Fprintf(w, "Middle service called %s: %s\n", downstreamURL, body)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", requireCaller(audience, callers, call))
+	handler := logging.Middleware(logger, logging.ProjectID())(tracing.Middleware(deadline.Middleware(mux)))
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           http.MaxBytesHandler(handler, 1<<20),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("Listening", slog.String("port", port), slog.String("downstream", downstreamURL))
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// requireCaller returns a handler that calls next only for requests
+// carrying a Google-signed ID token for audience with a verified email,
+// one of callers if any are given.
+func requireCaller(audience string, callers []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(callers))
+	for _, c := range callers {
+		allowed[strings.ToLower(strings.TrimSpace(c))] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.FromContext(r.Context())
+		email, ok := admin.Authenticate(w, r, audience)
+		if !ok {
+			return
+		}
+		if len(allowed) > 0 && !allowed[strings.ToLower(email)] {
+			logger.Warn("Rejected request from caller not allowed", slog.String("caller", email))
+			apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodePermissionDenied, "Caller may not call this service"))
+			return
+		}
+		logger.Info("Authenticated call", slog.String("caller", email))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,37 @@
+// Command client calls the gRPC health service of a Cloud Run service with
+// an ID token attached.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"sender/grpcauth"
+)
+
+func main() {
+	target := os.Getenv("GRPC_TARGET")
+	audience := os.Getenv("GRPC_AUDIENCE")
+	if target == "" || audience == "" {
+		log.Fatal("GRPC_TARGET and GRPC_AUDIENCE environment variables must be set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := grpcauth.Dial(ctx, target, audience)
+	if err != nil {
+		log.Fatalf("Failed to dial %s: %v", target, err)
+	}
+	defer conn.Close()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		log.Fatalf("Failed to check health: %v", err)
+	}
+	log.Printf("Health of %s: %s", target, resp.Status)
+}
@@ -0,0 +1,43 @@
+// Command server serves the gRPC health service and only accepts calls
+// that carry a valid ID token for EXPECTED_AUDIENCE.
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"sender/grpcauth"
+)
+
+func main() {
+	audience := os.Getenv("EXPECTED_AUDIENCE")
+	if audience == "" {
+		log.Fatal("EXPECTED_AUDIENCE environment variable is not set")
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcauth.UnaryServerInterceptor(audience)),
+		grpc.StreamInterceptor(grpcauth.StreamServerInterceptor(audience)),
+	)
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+
+	log.Printf("Listening on :%s", port)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+}
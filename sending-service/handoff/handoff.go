@@ -0,0 +1,252 @@
+// Package handoff sends request bodies too large for the receiving service,
+// such as those over the 32 MiB Cloud Run allows over HTTP/1, through Cloud
+// Storage: the body is written to a bucket and the request is sent without
+// it, carrying a short-lived V4 signed URL the receiving service fetches
+// the body from, with its size and SHA-256 digest to check it against.
+package handoff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+
+	"sender/authclient"
+	"sender/logging"
+)
+
+// Headers of a request whose body was handed off. The receiving service
+// fetches the body from URLHeader and restores the content type and
+// encoding the request was sent with.
+const (
+	URLHeader             = "X-Payload-Url"
+	SHA256Header          = "X-Payload-Sha256"
+	SizeHeader            = "X-Payload-Size"
+	ContentTypeHeader     = "X-Payload-Content-Type"
+	ContentEncodingHeader = "X-Payload-Content-Encoding"
+)
+
+// maxURLExpiry is the longest a V4 signed URL may be valid for.
+const maxURLExpiry = 7 * 24 * time.Hour
+
+// ErrHandoff is matched by errors.Is for requests that could not be sent
+// because their body could not be written to Cloud Storage or its URL
+// signed.
+var ErrHandoff = errors.New("handoff: failed to hand off request body")
+
+// Settings configures an Offloader.
+type Settings struct {
+	// Bucket is the Cloud Storage bucket bodies are written to. Give it a
+	// lifecycle rule that deletes objects after a day or so: they are not
+	// deleted once fetched.
+	Bucket string
+	// Prefix is prepended to the names of the objects, such as handoff/.
+	Prefix string
+	// Threshold is the size above which bodies are handed off. Bodies of
+	// unknown length are read up to it to find out. It defaults to 16 MiB.
+	Threshold int64
+	// URLExpiry is how long the signed URLs are valid for, up to 7 days.
+	// It defaults to 15 minutes.
+	URLExpiry time.Duration
+	// ServiceAccount is the email of the service account that signs the
+	// URLs and must be able to read the objects.
+	ServiceAccount string
+}
+
+// bucketName matches the names of Cloud Storage buckets.
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,220}[a-z0-9]$`)
+
+// Validate reports the problems of s.
+func (s Settings) Validate() []error {
+	var errs []error
+	if !bucketName.MatchString(s.Bucket) {
+		errs = append(errs, fmt.Errorf("handoff bucket %q is not a valid bucket name", s.Bucket))
+	}
+	if strings.HasPrefix(s.Prefix, "/") || strings.ContainsAny(s.Prefix, "\r\n") {
+		errs = append(errs, fmt.Errorf("handoff prefix %q must not start with / or contain newlines", s.Prefix))
+	}
+	if s.Threshold < 0 {
+		errs = append(errs, fmt.Errorf("handoff threshold must not be negative, got %d", s.Threshold))
+	}
+	if s.URLExpiry < 0 || s.URLExpiry > maxURLExpiry {
+		errs = append(errs, fmt.Errorf("handoff URL expiry must be between 0 and %s, got %s", maxURLExpiry, s.URLExpiry))
+	}
+	return errs
+}
+
+// Offloader writes large request bodies to Cloud Storage.
+type Offloader struct {
+	settings Settings
+	objects  *storage.ObjectsService
+	signer   authclient.Signer
+	now      func() time.Time
+}
+
+// New creates an Offloader for s, with a Cloud Storage client and an IAM
+// Credentials signer, for s.ServiceAccount, created with clientOpts. The
+// credentials need roles/storage.objectCreator on the bucket, and
+// roles/iam.serviceAccountTokenCreator on s.ServiceAccount, which may be
+// the service's own; s.ServiceAccount needs roles/storage.objectViewer on
+// the bucket for the URLs it signs to work.
+func New(ctx context.Context, s Settings, clientOpts []option.ClientOption) (*Offloader, error) {
+	if errs := s.Validate(); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if s.ServiceAccount == "" {
+		return nil, errors.New("handoff: a service account to sign URLs with is required")
+	}
+	if s.Threshold == 0 {
+		s.Threshold = 16 << 20
+	}
+	if s.URLExpiry == 0 {
+		s.URLExpiry = 15 * time.Minute
+	}
+	svc, err := storage.NewService(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("handoff: failed to create Cloud Storage client: %w", err)
+	}
+	signer, err := authclient.IAMSigner(ctx, s.ServiceAccount, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Offloader{settings: s, objects: svc.Objects, signer: signer, now: time.Now}, nil
+}
+
+// Middleware is an authclient.Middleware that hands off the bodies of
+// requests larger than the threshold, before they are retried, compressed
+// or signed, and passes the others through. Requests handed off are sent
+// with an empty body, their Content-Type and Content-Encoding moved to
+// X-Payload-Content-Type and X-Payload-Content-Encoding, and the URL, size
+// and SHA-256 digest of the body in X-Payload-Url, X-Payload-Size and
+// X-Payload-Sha256.
+func (o *Offloader) Middleware(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Body == nil || req.Body == http.NoBody || req.ContentLength > 0 && req.ContentLength <= o.settings.Threshold {
+			return next.RoundTrip(req)
+		}
+		r := req.Clone(req.Context())
+		if req.ContentLength <= 0 {
+			// Read as much as is sent as it is: a body that fits goes out
+			// like one of known length.
+			head, err := io.ReadAll(io.LimitReader(req.Body, o.settings.Threshold+1))
+			if err != nil {
+				req.Body.Close()
+				return nil, err
+			}
+			if int64(len(head)) <= o.settings.Threshold {
+				req.Body.Close()
+				r.ContentLength = int64(len(head))
+				r.Body = io.NopCloser(bytes.NewReader(head))
+				r.GetBody = func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(head)), nil
+				}
+				return next.RoundTrip(r)
+			}
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+		}
+
+		start := o.now()
+		p, err := o.upload(r.Context(), r.Body, req.Header.Get("Content-Type"))
+		r.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrHandoff, err)
+		}
+		logging.FromContext(req.Context()).Info("Handed off request body",
+			slog.String("bucket", o.settings.Bucket),
+			slog.String("object", p.object),
+			slog.Int64("bytes", p.size),
+			slog.Duration("duration", o.now().Sub(start)))
+
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		r.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		r.Header.Del("Content-Length")
+		r.Header.Del("Content-Type")
+		r.Header.Del("Content-Encoding")
+		r.Header.Set(URLHeader, p.url)
+		r.Header.Set(SHA256Header, p.sha256)
+		r.Header.Set(SizeHeader, strconv.FormatInt(p.size, 10))
+		if ct := req.Header.Get("Content-Type"); ct != "" {
+			r.Header.Set(ContentTypeHeader, ct)
+		}
+		if ce := req.Header.Get("Content-Encoding"); ce != "" {
+			r.Header.Set(ContentEncodingHeader, ce)
+		}
+		return next.RoundTrip(r)
+	})
+}
+
+// payload is a body written to Cloud Storage.
+type payload struct {
+	object string
+	url    string
+	sha256 string
+	size   int64
+}
+
+// upload writes body to a new object and returns it with a signed URL.
+func (o *Offloader) upload(ctx context.Context, body io.Reader, contentType string) (*payload, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	name := o.settings.Prefix + hex.EncodeToString(id)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := &hashingReader{r: bufio.NewReaderSize(body, 256<<10), h: sha256.New()}
+	_, err := o.objects.Insert(o.settings.Bucket, &storage.Object{Name: name, ContentType: contentType}).
+		Media(h, googleapi.ContentType(contentType)).
+		IfGenerationMatch(0).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write gs://%s/%s: %w", o.settings.Bucket, name, err)
+	}
+	url, err := o.signedURL(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &payload{object: name, url: url, sha256: hex.EncodeToString(h.h.Sum(nil)), size: h.n}, nil
+}
+
+// hashingReader hashes and counts the bytes read from r.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
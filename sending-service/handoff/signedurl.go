@@ -0,0 +1,76 @@
+package handoff
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// storageHost serves the signed URLs.
+const storageHost = "storage.googleapis.com"
+
+// signedURL returns a V4 signed URL to GET object, signed with the service
+// account's Google-managed key as described in
+// https://cloud.google.com/storage/docs/access-control/signing-urls-manually.
+func (o *Offloader) signedURL(ctx context.Context, object string) (string, error) {
+	now := o.now().UTC()
+	stamp := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+	path := "/" + o.settings.Bucket + "/" + escape(object, true)
+
+	params := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    o.settings.ServiceAccount + "/" + scope,
+		"X-Goog-Date":          stamp,
+		"X-Goog-Expires":       strconv.Itoa(int(o.settings.URLExpiry.Seconds())),
+		"X-Goog-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = escape(k, false) + "=" + escape(params[k], false)
+	}
+	query := strings.Join(pairs, "&")
+
+	canonical := strings.Join([]string{
+		"GET",
+		path,
+		query,
+		"host:" + storageHost + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	digest := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{"GOOG4-RSA-SHA256", stamp, scope, hex.EncodeToString(digest[:])}, "\n")
+	sig, _, err := o.signer.Sign(ctx, []byte(stringToSign))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL of gs://%s/%s: %w", o.settings.Bucket, object, err)
+	}
+	return "https://" + storageHost + path + "?" + query + "&X-Goog-Signature=" + hex.EncodeToString(sig), nil
+}
+
+// escape percent-encodes every byte of s but the unreserved characters of
+// RFC 3986, and slashes if keepSlash is set, as V4 signing requires.
+func escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"sender/config"
+	"sender/secrets"
+)
+
+// loadSecrets resolves the sm:// references in cfg. If header values come
+// from Secret Manager and a refresh interval is configured, the returned
+// function serves the latest values, re-read in the background until ctx
+// is done; otherwise it serves the values read at startup.
+func loadSecrets(ctx context.Context, logger *slog.Logger, cfg *config.Config) (func() http.Header, error) {
+	raw := cfg.Headers
+	var client *secrets.Client
+	if cfg.HasSecretRefs() {
+		var err error
+		if client, err = secrets.NewClient(ctx, cfg.ClientOptions()...); err != nil {
+			return nil, err
+		}
+		if err := cfg.ResolveSecrets(ctx, client.Resolve); err != nil {
+			return nil, err
+		}
+		logger.Info("Resolved configuration values from Secret Manager")
+	}
+
+	var current atomic.Pointer[http.Header]
+	headers := cfg.HTTPHeaders()
+	current.Store(&headers)
+
+	if client != nil && cfg.SecretsRefreshInterval > 0 {
+		go refreshHeaders(ctx, logger, client, raw, cfg.SecretsRefreshInterval, &current)
+	}
+	return func() http.Header { return *current.Load() }, nil
+}
+
+func refreshHeaders(ctx context.Context, logger *slog.Logger, client *secrets.Client, raw map[string]string, interval time.Duration, current *atomic.Pointer[http.Header]) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		resolved, err := config.ResolveHeaders(ctx, raw, client.Resolve)
+		if err != nil {
+			logger.Warn("Failed to refresh headers from Secret Manager, keeping the previous values", slog.Any("error", err))
+			continue
+		}
+		headers := make(http.Header, len(resolved))
+		for name, v := range resolved {
+			headers.Set(name, v)
+		}
+		current.Store(&headers)
+	}
+}
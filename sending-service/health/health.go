@@ -0,0 +1,231 @@
+// Package health implements liveness and readiness endpoints for the
+// sending service. Readiness confirms that an ID token can be obtained for
+// every downstream service, so a misconfigured audience or missing
+// credentials is caught before traffic is routed to the instance.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+
+	"sender/downstream"
+)
+
+// Checker serves the /healthz and /readyz endpoints.
+type Checker struct {
+	registry *downstream.Registry
+	probe    bool
+	ttl      time.Duration
+	timeout  time.Duration
+
+	invoker     bool
+	invokerOpts []option.ClientOption
+
+	mu      sync.Mutex
+	checked time.Time
+	result  Result
+}
+
+// Option configures a Checker.
+type Option func(*Checker)
+
+// WithDownstreamProbe makes readiness also send an authenticated HEAD
+// request to each downstream service. Responses with status 401, 403 or
+// 5xx fail the check; 403 usually means the caller lacks roles/run.invoker.
+func WithDownstreamProbe(probe bool) Option {
+	return func(c *Checker) {
+		c.probe = probe
+	}
+}
+
+// WithCacheTTL sets how long a readiness result is reused before the
+// checks run again. It defaults to 30 seconds.
+func WithCacheTTL(d time.Duration) Option {
+	return func(c *Checker) {
+		c.ttl = d
+	}
+}
+
+// Result is the outcome of a readiness check.
+type Result struct {
+	Ready    bool                     `json:"ready"`
+	Services map[string]ServiceResult `json:"services"`
+}
+
+// ServiceResult is the readiness of a single downstream service.
+type ServiceResult struct {
+	Ready   bool    `json:"ready"`
+	Failure Failure `json:"failure,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Failure classifies why a downstream service failed a check.
+type Failure string
+
+const (
+	// FailureTokenMint means no ID token could be minted for the service's
+	// audience, usually because the caller's credentials are missing or
+	// may not mint tokens.
+	FailureTokenMint Failure = "token_mint"
+	// FailureUnauthenticated means the service rejected the token with 401,
+	// usually because the audience doesn't match the service.
+	FailureUnauthenticated Failure = "unauthenticated"
+	// FailurePermissionDenied means the service rejected the caller with
+	// 403, usually because it lacks roles/run.invoker on the service.
+	FailurePermissionDenied Failure = "permission_denied"
+	// FailureUnreachable means the probe request could not be sent.
+	FailureUnreachable Failure = "unreachable"
+	// FailureServerError means the service answered the probe with 5xx.
+	FailureServerError Failure = "server_error"
+	// FailureIAMCheck means the Cloud Run Admin API could not say whether
+	// the caller may invoke the service, for example because the API is
+	// not enabled or the service does not exist.
+	FailureIAMCheck Failure = "iam_check"
+)
+
+// CheckError is the error of a failed check of a downstream service.
+type CheckError struct {
+	Failure Failure
+	Err     error
+}
+
+func (e *CheckError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// New creates a Checker for the services in registry.
+func New(registry *downstream.Registry, opts ...Option) *Checker {
+	c := &Checker{
+		registry: registry,
+		ttl:      30 * time.Second,
+		timeout:  5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Healthz reports that the process is alive.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// Readyz reports whether every downstream service is reachable with a
+// valid ID token, responding 503 with the failing services otherwise.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	result := c.Check(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// Check runs the readiness checks, or returns the cached result if it is
+// younger than the cache TTL.
+func (c *Checker) Check(ctx context.Context) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checked.IsZero() && time.Since(c.checked) < c.ttl {
+		return c.result
+	}
+
+	c.result = c.run(ctx, c.probe, false)
+	c.checked = time.Now()
+	return c.result
+}
+
+// Validate mints a token for every downstream service and probes each one
+// with an authenticated HEAD request, whether or not readiness probes
+// downstream services. With WithInvokerCheck, it also asks the Cloud Run
+// Admin API whether the caller may invoke each service. Its result is not
+// cached.
+func (c *Checker) Validate(ctx context.Context) Result {
+	return c.run(ctx, true, c.invoker)
+}
+
+func (c *Checker) run(ctx context.Context, probe, invoker bool) Result {
+	result := Result{Ready: true, Services: make(map[string]ServiceResult)}
+	for _, name := range c.registry.Names() {
+		sr := ServiceResult{Ready: true}
+		if err := c.checkService(ctx, name, probe, invoker); err != nil {
+			sr = ServiceResult{Error: err.Error()}
+			var checkErr *CheckError
+			if errors.As(err, &checkErr) {
+				sr.Failure = checkErr.Failure
+			}
+			result.Ready = false
+		}
+		result.Services[name] = sr
+	}
+	return result
+}
+
+func (c *Checker) checkService(ctx context.Context, name string, probe, invoker bool) error {
+	svc, _ := c.registry.Service(name)
+	client, err := c.registry.Client(name)
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	tok, err := client.Token()
+	if err != nil {
+		return &CheckError{Failure: FailureTokenMint, Err: fmt.Errorf("cannot mint an ID token for audience %s: %w", svc.Audience, err)}
+	}
+	if invoker {
+		if err := c.checkInvoker(ctx, svc, caller(tok.AccessToken)); err != nil {
+			return err
+		}
+	}
+	if !probe {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, svc.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &CheckError{Failure: FailureUnreachable, Err: fmt.Errorf("probing %s: %w", svc.URL, err)}
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return &CheckError{Failure: FailureUnauthenticated, Err: fmt.Errorf("probing %s: %s; the token audience %s is probably not the service's URL or one of its custom audiences", svc.URL, resp.Status, svc.Audience)}
+	case resp.StatusCode == http.StatusForbidden:
+		return &CheckError{Failure: FailurePermissionDenied, Err: fmt.Errorf("probing %s: %s; grant %s roles/run.invoker on the service", svc.URL, resp.Status, caller(tok.AccessToken))}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return &CheckError{Failure: FailureServerError, Err: fmt.Errorf("probing %s: %s", svc.URL, resp.Status)}
+	}
+	return nil
+}
+
+// caller returns the email in an ID token, or a placeholder if it has
+// none.
+func caller(token string) string {
+	if payload, err := idtoken.ParsePayload(token); err == nil {
+		if email, _ := payload.Claims["email"].(string); email != "" {
+			return email
+		}
+	}
+	return "the calling service account"
+}
@@ -0,0 +1,86 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	run "google.golang.org/api/run/v2"
+
+	"sender/downstream"
+)
+
+// invokePermission is the permission roles/run.invoker grants, which Cloud
+// Run checks before a request reaches the service.
+const invokePermission = "run.routes.invoke"
+
+// WithInvokerCheck makes Validate and CheckInvoker ask the Cloud Run Admin
+// API, with a client created with opts, whether the caller holds
+// run.routes.invoke on each service, so that a missing roles/run.invoker
+// binding is reported with the command that grants it rather than as a
+// 403 on the first request. The Admin API checks the identity of the
+// credentials in opts, which must be the one the ID tokens are minted for.
+// Services whose resource name downstream.CloudRunResource cannot tell are
+// not checked.
+func WithInvokerCheck(opts ...option.ClientOption) Option {
+	return func(c *Checker) {
+		c.invoker = true
+		c.invokerOpts = opts
+	}
+}
+
+// CheckInvoker mints a token for every downstream service and, if the
+// checker was created WithInvokerCheck, asks the Cloud Run Admin API
+// whether the caller may invoke it, without sending a request to the
+// service. Its result is not cached.
+func (c *Checker) CheckInvoker(ctx context.Context) Result {
+	return c.run(ctx, false, c.invoker)
+}
+
+// checkInvoker checks that caller, the email of the ID tokens sent to svc,
+// holds run.routes.invoke on the Cloud Run service.
+func (c *Checker) checkInvoker(ctx context.Context, svc downstream.Service, caller string) error {
+	resource, ok := downstream.CloudRunResource(svc)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	client, err := run.NewService(ctx, c.invokerOpts...)
+	if err != nil {
+		return &CheckError{Failure: FailureIAMCheck, Err: fmt.Errorf("creating Cloud Run Admin API client: %w", err)}
+	}
+	resp, err := client.Projects.Locations.Services.TestIamPermissions(resource, &run.GoogleIamV1TestIamPermissionsRequest{
+		Permissions: []string{invokePermission},
+	}).Context(ctx).Do()
+	if err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusNotFound {
+			return &CheckError{Failure: FailureIAMCheck, Err: fmt.Errorf("checking %s on %s: the service does not exist; set its cloud_run_service to the right resource name", invokePermission, resource)}
+		}
+		return &CheckError{Failure: FailureIAMCheck, Err: fmt.Errorf("checking %s on %s: %w", invokePermission, resource, err)}
+	}
+	for _, p := range resp.Permissions {
+		if p == invokePermission {
+			return nil
+		}
+	}
+	return &CheckError{Failure: FailurePermissionDenied, Err: fmt.Errorf("%s lacks %s on %s; grant it with: %s", caller, invokePermission, resource, grantCommand(resource, caller))}
+}
+
+// grantCommand returns the gcloud command granting member roles/run.invoker
+// on the Cloud Run service resource.
+func grantCommand(resource, email string) string {
+	parts := strings.Split(resource, "/")
+	member := "serviceAccount:" + email
+	if !strings.HasSuffix(email, ".gserviceaccount.com") {
+		member = "user:" + email
+	}
+	return fmt.Sprintf("gcloud run services add-iam-policy-binding %s --project=%s --region=%s --member=%s --role=roles/run.invoker",
+		parts[5], parts[1], parts[3], member)
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// newHTTP3Transport creates the transport for TRANSPORT_HTTP3. It is only
+// set in builds with -tags http3, so that the service does not depend on
+// QUIC otherwise.
+var newHTTP3Transport func(*tls.Config) http.RoundTripper
@@ -0,0 +1,36 @@
+// Package http3 provides the HTTP/3 transport for authclient.WithHTTP3,
+// built on github.com/quic-go/quic-go. It is a module of its own so that
+// the sending service and the authclient package do not depend on QUIC
+// unless they are built with it; build the sending service with
+// -tags http3 to include it.
+package http3
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HandshakeTimeout bounds the QUIC handshake, so that a host whose UDP
+// traffic is dropped falls back to HTTP/2 quickly.
+const HandshakeTimeout = 2 * time.Second
+
+// NewTransport returns an HTTP/3 transport verifying receivers with
+// tlsConfig, or with the system roots if it is nil. Close it to release
+// its UDP sockets.
+func NewTransport(tlsConfig *tls.Config) *http3.RoundTripper {
+	var cfg *tls.Config
+	if tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	}
+	return &http3.RoundTripper{
+		TLSClientConfig: cfg,
+		QuicConfig: &quic.Config{
+			HandshakeIdleTimeout: HandshakeTimeout,
+			MaxIdleTimeout:       90 * time.Second,
+			KeepAlivePeriod:      30 * time.Second,
+		},
+	}
+}
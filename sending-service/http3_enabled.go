@@ -0,0 +1,16 @@
+//go:build http3
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"sender/http3"
+)
+
+func init() {
+	newHTTP3Transport = func(cfg *tls.Config) http.RoundTripper {
+		return http3.NewTransport(cfg)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"sender/admin"
+	"sender/apierror"
+	"sender/logging"
+)
+
+// requireCallers returns middleware that only lets requests carrying a
+// Google-signed ID token for audience, normally the URL of the sending
+// service, through to the handlers that call downstream services, so that
+// the service can run with --allow-unauthenticated or behind a load
+// balancer. If callers is not empty, the token's verified email must also
+// be one of them or match one of them as a path.Match pattern, such as
+// *@my-project.iam.gserviceaccount.com.
+func requireCallers(audience string, callers []string) func(http.Handler) http.Handler {
+	patterns := make([]string, len(callers))
+	for i, c := range callers {
+		patterns[i] = strings.ToLower(c)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			email, ok := admin.Authenticate(w, r, audience)
+			if !ok {
+				return
+			}
+			logger := logging.FromContext(r.Context())
+			if len(patterns) > 0 && !callerAllowed(patterns, strings.ToLower(email)) {
+				logger.Warn("Rejected request from caller not allowed", slog.String("caller", email), slog.String("path", r.URL.Path))
+				apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodePermissionDenied, "Caller may not call the sending service"))
+				return
+			}
+			logger.Debug("Authenticated caller", slog.String("caller", email))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// callerAllowed reports whether email is one of patterns or matches one of
+// them.
+func callerAllowed(patterns []string, email string) bool {
+	for _, p := range patterns {
+		if p == email {
+			return true
+		}
+		if ok, _ := path.Match(p, email); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,302 @@
+//go:build integration
+
+// Package integration runs end-to-end authentication checks against the
+// sending and receiving services deployed to Cloud Run, so that
+// regressions in the token flow, such as a token the receiving service
+// no longer accepts or a caller without roles/run.invoker let through,
+// fail CI.
+//
+// Run them against services that are already deployed:
+//
+//	SENDER_URL=https://sending-service-xyz.a.run.app \
+//	RECEIVER_URL=https://receiving-service-xyz.a.run.app \
+//	CALLER_SERVICE_ACCOUNT=it-caller@my-project.iam.gserviceaccount.com \
+//	DENIED_SERVICE_ACCOUNT=it-denied@my-project.iam.gserviceaccount.com \
+//	go test -tags integration -v ./integration
+//
+// Or deploy the fixtures in integration/terraform first, reading the URLs
+// and service accounts from its outputs, and destroy them afterwards:
+//
+//	TF_VAR_project=my-project TF_VAR_ci_member=serviceAccount:ci@my-project.iam.gserviceaccount.com \
+//	TF_VAR_sender_image=gcr.io/my-project/sending-service TF_VAR_receiver_image=gcr.io/my-project/receiving-service \
+//	go test -tags integration -v -timeout 30m ./integration -deploy
+//
+// Tests whose variables are not set are skipped. The credentials they run
+// with must be able to impersonate the caller and denied service
+// accounts, which the fixtures grant to ci_member.
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"sender/authclient"
+)
+
+// greeting is what the receiving service answers on /, and relayPrefix what
+// the sending service puts before it when it relays the answer.
+const (
+	greeting    = "Hello from the receiving service!"
+	relayPrefix = "Response from receiving service: "
+)
+
+var (
+	deploy  = flag.Bool("deploy", false, "apply the Terraform fixtures before the tests and destroy them after")
+	keep    = flag.Bool("keep", false, "with -deploy, keep the fixtures instead of destroying them")
+	tfDir   = flag.String("terraform", "terraform", "directory of the Terraform fixtures")
+	settle  = flag.Duration("settle", 3*time.Minute, "how long to retry failing checks, since new deployments and IAM bindings take a while to apply")
+	timeout = flag.Duration("request-timeout", 30*time.Second, "time limit for each request")
+)
+
+// env holds the deployment under test.
+type env struct {
+	SenderURL     string
+	ReceiverURL   string
+	CallerAccount string
+	DeniedAccount string
+}
+
+var (
+	// ctx is cancelled when the tests are interrupted, so that the
+	// fixtures are still destroyed.
+	ctx        context.Context
+	deployment env
+	client     *http.Client
+	// deadline is when failing checks stop being retried, settle after
+	// the tests started.
+	deadline time.Time
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(run(m))
+}
+
+// run runs the tests and returns the exit code, after destroying the
+// fixtures it deployed.
+func run(m *testing.M) int {
+	var stop context.CancelFunc
+	ctx, stop = signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	deployment = env{
+		SenderURL:     strings.TrimSuffix(os.Getenv("SENDER_URL"), "/"),
+		ReceiverURL:   strings.TrimSuffix(os.Getenv("RECEIVER_URL"), "/"),
+		CallerAccount: os.Getenv("CALLER_SERVICE_ACCOUNT"),
+		DeniedAccount: os.Getenv("DENIED_SERVICE_ACCOUNT"),
+	}
+	if *deploy {
+		if err := terraform(ctx, *tfDir, "init", "-input=false"); err != nil {
+			return errorf("terraform init: %v", err)
+		}
+		if !*keep {
+			// Destroy even after a partial apply, so failed runs don't
+			// leave services behind.
+			defer func() {
+				if err := terraform(context.Background(), *tfDir, "destroy", "-auto-approve", "-input=false"); err != nil {
+					fmt.Fprintf(os.Stderr, "terraform destroy: %v\n", err)
+				}
+			}()
+		}
+		if err := terraform(ctx, *tfDir, "apply", "-auto-approve", "-input=false"); err != nil {
+			return errorf("terraform apply: %v", err)
+		}
+		var err error
+		if deployment, err = terraformOutputs(ctx, *tfDir); err != nil {
+			return errorf("%v", err)
+		}
+	}
+	client = &http.Client{Timeout: *timeout}
+	deadline = time.Now().Add(*settle)
+	return m.Run()
+}
+
+func TestReceiverRejectsMissingToken(t *testing.T) {
+	e := require(t, "RECEIVER_URL")
+	eventually(t, func(ctx context.Context) error {
+		_, err := call(ctx, e.ReceiverURL+"/", "", []int{http.StatusUnauthorized, http.StatusForbidden})
+		return err
+	})
+}
+
+func TestReceiverRejectsOtherAudience(t *testing.T) {
+	e := require(t, "RECEIVER_URL", "CALLER_SERVICE_ACCOUNT")
+	eventually(t, func(ctx context.Context) error {
+		return expectToken(ctx, e.CallerAccount, "https://integration.invalid", e.ReceiverURL+"/", "", http.StatusUnauthorized, http.StatusForbidden)
+	})
+}
+
+func TestReceiverAcceptsInvoker(t *testing.T) {
+	e := require(t, "RECEIVER_URL", "CALLER_SERVICE_ACCOUNT")
+	eventually(t, func(ctx context.Context) error {
+		return expectToken(ctx, e.CallerAccount, e.ReceiverURL, e.ReceiverURL+"/", greeting, http.StatusOK)
+	})
+}
+
+func TestReceiverRefusesNonInvoker(t *testing.T) {
+	e := require(t, "RECEIVER_URL", "DENIED_SERVICE_ACCOUNT")
+	eventually(t, func(ctx context.Context) error {
+		return expectToken(ctx, e.DeniedAccount, e.ReceiverURL, e.ReceiverURL+"/", "", http.StatusForbidden)
+	})
+}
+
+func TestSenderRelaysAsItself(t *testing.T) {
+	e := require(t, "SENDER_URL", "CALLER_SERVICE_ACCOUNT")
+	eventually(t, func(ctx context.Context) error {
+		return expectToken(ctx, e.CallerAccount, e.SenderURL, e.SenderURL+"/", relayPrefix+greeting, http.StatusOK)
+	})
+}
+
+func TestSenderRefusesNonInvoker(t *testing.T) {
+	e := require(t, "SENDER_URL", "DENIED_SERVICE_ACCOUNT")
+	eventually(t, func(ctx context.Context) error {
+		return expectToken(ctx, e.DeniedAccount, e.SenderURL, e.SenderURL+"/", "", http.StatusForbidden)
+	})
+}
+
+// require returns the deployment, skipping the test unless it has the
+// variables named.
+func require(t *testing.T, names ...string) env {
+	t.Helper()
+	e := deployment
+	values := map[string]string{
+		"SENDER_URL":             e.SenderURL,
+		"RECEIVER_URL":           e.ReceiverURL,
+		"CALLER_SERVICE_ACCOUNT": e.CallerAccount,
+		"DENIED_SERVICE_ACCOUNT": e.DeniedAccount,
+	}
+	for _, name := range names {
+		if values[name] == "" {
+			t.Skipf("%s is not set", name)
+		}
+	}
+	return e
+}
+
+// eventually runs check every few seconds until it passes, the deadline
+// has passed or the tests are interrupted, failing the test with its last
+// error.
+func eventually(t *testing.T, check func(ctx context.Context) error) {
+	t.Helper()
+	for attempts := 1; ; attempts++ {
+		err := check(ctx)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			t.Fatalf("after %d attempts: %v", attempts, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// expectToken calls target with an ID token for audience minted as
+// account, and checks that the answer has one of codes and that its body
+// contains want, if set.
+func expectToken(ctx context.Context, account, audience, target, want string, codes ...int) error {
+	ts, err := authclient.ImpersonatedTokenSource(account)(ctx, audience)
+	if err != nil {
+		return fmt.Errorf("failed to create token source for %s: %w", account, err)
+	}
+	tok, err := ts.Token()
+	if err != nil {
+		return fmt.Errorf("failed to mint ID token as %s: %w", account, err)
+	}
+	body, err := call(ctx, target, tok.AccessToken, codes)
+	if err != nil {
+		return err
+	}
+	if want != "" && !strings.Contains(body, want) {
+		return fmt.Errorf("response does not contain %q: %s", want, truncate(body))
+	}
+	return nil
+}
+
+// call gets target, with token as a bearer token if it is set, and returns
+// the body of the answer if it has one of codes.
+func call(ctx context.Context, target, token string, codes []int) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return string(data), nil
+		}
+	}
+	return "", fmt.Errorf("got %s, want %s: %s", resp.Status, statusList(codes), truncate(string(data)))
+}
+
+func statusList(codes []int) string {
+	s := make([]string, len(codes))
+	for i, code := range codes {
+		s[i] = fmt.Sprintf("%d", code)
+	}
+	return strings.Join(s, " or ")
+}
+
+func truncate(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 200 {
+		return s[:200] + "..."
+	}
+	return s
+}
+
+// terraform runs terraform with args in dir, passing its output through.
+func terraform(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "terraform", append([]string{"-chdir=" + dir}, args...)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run()
+}
+
+// terraformOutputs reads the deployment from the outputs of the fixtures.
+func terraformOutputs(ctx context.Context, dir string) (env, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "terraform", "-chdir="+dir, "output", "-json")
+	cmd.Stdout, cmd.Stderr = &stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return env{}, fmt.Errorf("terraform output: %w", err)
+	}
+	var outputs map[string]struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &outputs); err != nil {
+		return env{}, fmt.Errorf("failed to parse terraform outputs: %w", err)
+	}
+	return env{
+		SenderURL:     strings.TrimSuffix(outputs["sender_url"].Value, "/"),
+		ReceiverURL:   strings.TrimSuffix(outputs["receiver_url"].Value, "/"),
+		CallerAccount: outputs["caller_service_account"].Value,
+		DeniedAccount: outputs["denied_service_account"].Value,
+	}, nil
+}
+
+func errorf(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	return 1
+}
@@ -0,0 +1,103 @@
+# Fixtures for the integration checks: a receiving service that only its
+# invokers may call, a sending service calling it, a caller service account
+# allowed to invoke both, and a denied one allowed to invoke neither.
+
+terraform {
+  required_providers {
+    google = {
+      source  = "hashicorp/google"
+      version = ">= 5.7"
+    }
+  }
+}
+
+provider "google" {
+  project = var.project
+  region  = var.region
+}
+
+resource "google_service_account" "sender" {
+  account_id   = "sender-${var.suffix}"
+  display_name = "Integration sending service"
+}
+
+resource "google_service_account" "receiver" {
+  account_id   = "receiver-${var.suffix}"
+  display_name = "Integration receiving service"
+}
+
+resource "google_service_account" "caller" {
+  account_id   = "caller-${var.suffix}"
+  display_name = "Integration caller with roles/run.invoker"
+}
+
+resource "google_service_account" "denied" {
+  account_id   = "denied-${var.suffix}"
+  display_name = "Integration caller without roles/run.invoker"
+}
+
+resource "google_cloud_run_v2_service" "receiver" {
+  name                = "receiving-service-${var.suffix}"
+  location            = var.region
+  deletion_protection = false
+
+  template {
+    service_account = google_service_account.receiver.email
+    containers {
+      image = var.receiver_image
+    }
+  }
+}
+
+resource "google_cloud_run_v2_service" "sender" {
+  name                = "sending-service-${var.suffix}"
+  location            = var.region
+  deletion_protection = false
+
+  template {
+    service_account = google_service_account.sender.email
+    containers {
+      image = var.sender_image
+      env {
+        name  = "RECEIVING_SERVICE_URL"
+        value = google_cloud_run_v2_service.receiver.uri
+      }
+    }
+  }
+}
+
+# The sending service and the caller may invoke the receiving service; the
+# denied account deliberately has no binding.
+resource "google_cloud_run_v2_service_iam_member" "receiver_sender" {
+  name     = google_cloud_run_v2_service.receiver.name
+  location = var.region
+  role     = "roles/run.invoker"
+  member   = "serviceAccount:${google_service_account.sender.email}"
+}
+
+resource "google_cloud_run_v2_service_iam_member" "receiver_caller" {
+  name     = google_cloud_run_v2_service.receiver.name
+  location = var.region
+  role     = "roles/run.invoker"
+  member   = "serviceAccount:${google_service_account.caller.email}"
+}
+
+resource "google_cloud_run_v2_service_iam_member" "sender_caller" {
+  name     = google_cloud_run_v2_service.sender.name
+  location = var.region
+  role     = "roles/run.invoker"
+  member   = "serviceAccount:${google_service_account.caller.email}"
+}
+
+# The checks mint ID tokens as the caller and denied accounts.
+resource "google_service_account_iam_member" "ci_caller" {
+  service_account_id = google_service_account.caller.name
+  role               = "roles/iam.serviceAccountTokenCreator"
+  member             = var.ci_member
+}
+
+resource "google_service_account_iam_member" "ci_denied" {
+  service_account_id = google_service_account.denied.name
+  role               = "roles/iam.serviceAccountTokenCreator"
+  member             = var.ci_member
+}
@@ -0,0 +1,15 @@
+output "sender_url" {
+  value = google_cloud_run_v2_service.sender.uri
+}
+
+output "receiver_url" {
+  value = google_cloud_run_v2_service.receiver.uri
+}
+
+output "caller_service_account" {
+  value = google_service_account.caller.email
+}
+
+output "denied_service_account" {
+  value = google_service_account.denied.email
+}
@@ -0,0 +1,31 @@
+variable "project" {
+  description = "Project to deploy the fixtures to."
+  type        = string
+}
+
+variable "region" {
+  description = "Region of the Cloud Run services."
+  type        = string
+  default     = "us-central1"
+}
+
+variable "sender_image" {
+  description = "Image of the sending service, such as gcr.io/my-project/sending-service."
+  type        = string
+}
+
+variable "receiver_image" {
+  description = "Image of the receiving service."
+  type        = string
+}
+
+variable "ci_member" {
+  description = "IAM member the checks run as, such as serviceAccount:ci@my-project.iam.gserviceaccount.com; it may impersonate the caller and denied service accounts."
+  type        = string
+}
+
+variable "suffix" {
+  description = "Suffix of the names of the fixtures, so that concurrent runs don't collide."
+  type        = string
+  default     = "it"
+}
@@ -0,0 +1,134 @@
+// Package loadshed bounds the number of inbound requests the sending
+// service handles at once, queueing a limited number more and shedding the
+// rest with 503 Service Unavailable, so that a surge cannot exhaust
+// downstream connections or memory.
+package loadshed
+
+import (
+	"net/http"
+	"time"
+
+	"sender/apierror"
+)
+
+// Observer is notified as requests enter and leave the gate, for example
+// to export metrics.
+type Observer interface {
+	// Gate is called with the numbers of requests in flight and queued
+	// whenever either changes.
+	Gate(inFlight, queued int)
+	// Shed is called for each request shed, with the reason: queue_full
+	// or timeout.
+	Shed(reason string)
+}
+
+// Reasons passed to Observer.Shed.
+const (
+	ReasonQueueFull = "queue_full"
+	ReasonTimeout   = "timeout"
+)
+
+// Gate admits at most maxInFlight requests at a time. Up to maxQueue more
+// wait for a slot for at most the wait timeout; requests beyond those, and
+// those that time out waiting, are shed.
+type Gate struct {
+	slots    chan struct{}
+	queue    chan struct{}
+	wait     time.Duration
+	observer Observer
+}
+
+// Option configures a Gate.
+type Option func(*Gate)
+
+// WithObserver notifies obs of the gate's activity.
+func WithObserver(obs Observer) Option {
+	return func(g *Gate) {
+		g.observer = obs
+	}
+}
+
+// New creates a Gate admitting maxInFlight requests at a time and queueing
+// up to maxQueue more for at most wait each.
+func New(maxInFlight, maxQueue int, wait time.Duration, opts ...Option) *Gate {
+	g := &Gate{
+		slots: make(chan struct{}, maxInFlight),
+		queue: make(chan struct{}, maxQueue),
+		wait:  wait,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Middleware passes requests to next as the gate admits them, and answers
+// those it sheds with 503 Service Unavailable and a Retry-After header of
+// the wait timeout, after which queued requests have been either served or
+// shed.
+func (g *Gate) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason, ok := g.acquire(r); !ok {
+			g.shed(w, r, reason)
+			return
+		}
+		defer g.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire takes a slot for r, queueing if none is free, and returns the
+// reason r is shed if it gets none.
+func (g *Gate) acquire(r *http.Request) (reason string, ok bool) {
+	select {
+	case g.slots <- struct{}{}:
+		g.notify()
+		return "", true
+	default:
+	}
+
+	select {
+	case g.queue <- struct{}{}:
+	default:
+		return ReasonQueueFull, false
+	}
+	g.notify()
+	defer func() {
+		<-g.queue
+		g.notify()
+	}()
+
+	timer := time.NewTimer(g.wait)
+	defer timer.Stop()
+	select {
+	case g.slots <- struct{}{}:
+		return "", true
+	case <-timer.C:
+		return ReasonTimeout, false
+	case <-r.Context().Done():
+		return ReasonTimeout, false
+	}
+}
+
+func (g *Gate) release() {
+	<-g.slots
+	g.notify()
+}
+
+func (g *Gate) notify() {
+	if g.observer != nil {
+		g.observer.Gate(len(g.slots), len(g.queue))
+	}
+}
+
+func (g *Gate) shed(w http.ResponseWriter, r *http.Request, reason string) {
+	if g.observer != nil {
+		g.observer.Shed(reason)
+	}
+	e := apierror.New(http.StatusServiceUnavailable, apierror.CodeOverloaded, "Too many requests in progress")
+	e.RetryAfter = g.wait
+	if e.RetryAfter < time.Second {
+		e.RetryAfter = time.Second
+	}
+	apierror.Write(w, r, e)
+}
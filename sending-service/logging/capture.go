@@ -0,0 +1,182 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces the values of redacted headers, query parameters and
+// body fields.
+const redacted = "REDACTED"
+
+// sensitiveHeaders are always redacted by a CaptureTransport. They carry
+// ID tokens, request signatures and session credentials.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"X-Serverless-Authorization",
+	"X-Forwarded-Authorization",
+	"X-Signature",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// Capture configures a CaptureTransport.
+type Capture struct {
+	// MaxBodySize is how many bytes of each request and response body are
+	// logged. Zero logs no bodies.
+	MaxBodySize int
+	// RedactHeaders are headers whose values are masked, in addition to
+	// Authorization and the other headers that always carry credentials.
+	RedactHeaders []string
+	// RedactFields are JSON body fields and query parameters whose values
+	// are masked wherever they appear.
+	RedactFields []string
+}
+
+// CaptureTransport logs the headers and the beginning of the body of every
+// request sent through it and of its response, for diagnosing integration
+// issues with a downstream service. Credentials are never logged: the
+// Authorization header and other sensitive values are masked, along with
+// the headers and fields named in the Capture.
+type CaptureTransport struct {
+	next    http.RoundTripper
+	capture Capture
+	headers map[string]bool
+	fields  *regexp.Regexp
+}
+
+// NewCaptureTransport returns a CaptureTransport that sends requests with
+// next.
+func NewCaptureTransport(next http.RoundTripper, c Capture) *CaptureTransport {
+	t := &CaptureTransport{next: next, capture: c, headers: make(map[string]bool)}
+	for _, name := range append(append([]string(nil), sensitiveHeaders...), c.RedactHeaders...) {
+		t.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	if len(c.RedactFields) > 0 {
+		quoted := make([]string, len(c.RedactFields))
+		for i, f := range c.RedactFields {
+			quoted[i] = regexp.QuoteMeta(f)
+		}
+		// A JSON member whose value is a string, number, boolean or null.
+		t.fields = regexp.MustCompile(`("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^\s,}\]{\[]+)`)
+	}
+	return t
+}
+
+func (t *CaptureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	logger := FromContext(ctx)
+
+	reqBody, err := t.captureRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	logger.InfoContext(ctx, "Downstream request captured",
+		slog.String("method", req.Method),
+		slog.String("downstream_url", t.redactURL(req.URL)),
+		slog.Any("headers", t.redactHeaders(req.Header)),
+		slog.String("body", t.redactBody(req.Header, reqBody)),
+	)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody := t.captureResponseBody(resp)
+	logger.InfoContext(ctx, "Downstream response captured",
+		slog.String("downstream_url", t.redactURL(req.URL)),
+		slog.Int("status", resp.StatusCode),
+		slog.Any("headers", t.redactHeaders(resp.Header)),
+		slog.String("body", t.redactBody(resp.Header, respBody)),
+	)
+	return resp, nil
+}
+
+// captureRequestBody returns the first MaxBodySize bytes of the body of
+// req, leaving the body intact for sending.
+func (t *CaptureTransport) captureRequestBody(req *http.Request) ([]byte, error) {
+	if t.capture.MaxBodySize <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, int64(t.capture.MaxBodySize)))
+	}
+	head, err := io.ReadAll(io.LimitReader(req.Body, int64(t.capture.MaxBodySize)))
+	if err != nil {
+		return nil, err
+	}
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+	return head, nil
+}
+
+// captureResponseBody returns the first MaxBodySize bytes of the body of
+// resp, leaving the body intact for the caller. Streamed responses are
+// not captured, since reading ahead would hold back their first events.
+func (t *CaptureTransport) captureResponseBody(resp *http.Response) []byte {
+	if t.capture.MaxBodySize <= 0 || resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == "text/event-stream" {
+		return nil
+	}
+	head := make([]byte, t.capture.MaxBodySize)
+	n, _ := io.ReadFull(resp.Body, head)
+	head = head[:n]
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	return head
+}
+
+func (t *CaptureTransport) redactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for name, values := range h {
+		if t.headers[http.CanonicalHeaderKey(name)] {
+			out[name] = redacted
+			continue
+		}
+		out[name] = strings.Join(values, ", ")
+	}
+	return out
+}
+
+func (t *CaptureTransport) redactURL(u *url.URL) string {
+	if len(t.capture.RedactFields) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+	q := u.Query()
+	for _, f := range t.capture.RedactFields {
+		if q.Has(f) {
+			q.Set(f, redacted)
+		}
+	}
+	masked := *u
+	masked.RawQuery = q.Encode()
+	return masked.String()
+}
+
+func (t *CaptureTransport) redactBody(h http.Header, body []byte) string {
+	if t.fields == nil || len(body) == 0 {
+		return string(body)
+	}
+	if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt != "application/json" && !strings.HasSuffix(mt, "+json") {
+		return string(body)
+	}
+	return t.fields.ReplaceAllString(string(body), `${1}"`+redacted+`"`)
+}
+
+// readCloser reads from one reader and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
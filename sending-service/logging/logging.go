@@ -0,0 +1,243 @@
+// Package logging provides structured JSON logging in the format understood
+// by Cloud Logging, and HTTP middleware that logs each inbound request with
+// its request ID and trace.
+package logging
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// Cloud Logging special field names, see
+// https://cloud.google.com/logging/docs/structured-logging.
+const (
+	traceKey        = "logging.googleapis.com/trace"
+	spanIDKey       = "logging.googleapis.com/spanId"
+	traceSampledKey = "logging.googleapis.com/trace_sampled"
+)
+
+// NewHandler returns a slog handler that writes JSON records with the
+// severity and message fields Cloud Logging expects. Durations are written
+// as strings such as "1.5s".
+func NewHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: replaceAttr,
+	})
+}
+
+// ProjectID returns the project used to build trace resource names: the
+// GOOGLE_CLOUD_PROJECT environment variable, or the metadata server's
+// project when running on Google Cloud.
+func ProjectID() string {
+	if id := os.Getenv("GOOGLE_CLOUD_PROJECT"); id != "" {
+		return id
+	}
+	if metadata.OnGCE() {
+		if id, err := metadata.ProjectID(); err == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		a.Value = slog.StringValue(a.Value.Duration().String())
+	}
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		a.Key = "severity"
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			a.Value = slog.StringValue(severity(level))
+		}
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+	return a
+}
+
+func severity(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the request-scoped logger stored in ctx by the
+// middleware, or slog.Default() if there is none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Middleware returns HTTP middleware that assigns each request an ID,
+// attaches a logger carrying the request ID and Cloud Trace fields to the
+// request context, and logs the completed request in Cloud Logging's
+// httpRequest format. The ID is taken from the request's X-Request-Id or
+// X-Correlation-Id header if it has a usable one, and is returned in the
+// X-Request-Id header of the response. projectID is used to build trace
+// resource names and may be empty.
+func Middleware(logger *slog.Logger, projectID string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			id := inboundRequestID(r)
+			if id == "" {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+			attrs := []any{slog.String("request_id", id)}
+			attrs = append(attrs, traceAttrs(r, projectID)...)
+			reqLogger := logger.With(attrs...)
+
+			ctx := context.WithValue(NewContext(r.Context(), reqLogger), requestIDKey{}, id)
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			level := slog.LevelInfo
+			if rec.status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			reqLogger.Log(r.Context(), level, "Request completed",
+				slog.Group("httpRequest",
+					slog.String("requestMethod", r.Method),
+					slog.String("requestUrl", r.URL.String()),
+					slog.Int("status", rec.status),
+					slog.Int64("responseSize", rec.size),
+					slog.String("latency", fmt.Sprintf("%.9fs", time.Since(start).Seconds())),
+					slog.String("userAgent", r.UserAgent()),
+					slog.String("remoteIp", r.RemoteAddr),
+				),
+			)
+		})
+	}
+}
+
+// traceAttrs extracts the Cloud Trace fields from an
+// X-Cloud-Trace-Context header of the form TRACE_ID/SPAN_ID;o=OPTIONS.
+func traceAttrs(r *http.Request, projectID string) []any {
+	header := r.Header.Get("X-Cloud-Trace-Context")
+	if header == "" || projectID == "" {
+		return nil
+	}
+	traceID, rest, _ := strings.Cut(header, "/")
+	spanID, options, _ := strings.Cut(rest, ";")
+	if traceID == "" {
+		return nil
+	}
+
+	attrs := []any{slog.String(traceKey, fmt.Sprintf("projects/%s/traces/%s", projectID, traceID))}
+	if spanID != "" {
+		attrs = append(attrs, slog.String(spanIDKey, spanID))
+	}
+	attrs = append(attrs, slog.Bool(traceSampledKey, options == "o=1"))
+	return attrs
+}
+
+// statusRecorder captures the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket connections be proxied through the middleware.
+// The connection is recorded as switching protocols.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && !r.wroteHeader {
+		r.status = http.StatusSwitchingProtocols
+		r.wroteHeader = true
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Transport logs every request sent through it, with its URL, status code
+// and latency, using the logger from the request context.
+type Transport struct {
+	Next http.RoundTripper
+}
+
+// NewTransport returns a Transport that sends requests with next.
+func NewTransport(next http.RoundTripper) *Transport {
+	return &Transport{Next: next}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.Next.RoundTrip(req)
+
+	logger := FromContext(req.Context())
+	latency := fmt.Sprintf("%.9fs", time.Since(start).Seconds())
+	if err != nil {
+		logger.ErrorContext(req.Context(), "Downstream request failed",
+			slog.String("downstream_url", req.URL.String()),
+			slog.String("latency", latency),
+			slog.Any("error", err),
+		)
+		return nil, err
+	}
+	logger.InfoContext(req.Context(), "Downstream request completed",
+		slog.String("downstream_url", req.URL.String()),
+		slog.Int("status", resp.StatusCode),
+		slog.String("latency", latency),
+	)
+	return resp, nil
+}
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Headers that carry the ID a request is logged with, so that one call can
+// be followed through the logs of every service it passes.
+const (
+	RequestIDHeader     = "X-Request-Id"
+	CorrelationIDHeader = "X-Correlation-Id"
+)
+
+// maxRequestIDLength is the longest inbound request ID that is honored.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID returns the ID the middleware assigned to the request whose
+// context is ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDTransport sends the ID of the inbound request, taken from the
+// request context, in the X-Request-Id header of each request that doesn't
+// already have one, so the receiving service can log it too.
+type RequestIDTransport struct {
+	next http.RoundTripper
+}
+
+// NewRequestIDTransport returns a RequestIDTransport that sends requests
+// with next.
+func NewRequestIDTransport(next http.RoundTripper) *RequestIDTransport {
+	return &RequestIDTransport{next: next}
+}
+
+func (t *RequestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := RequestID(req.Context())
+	if id == "" || req.Header.Get(RequestIDHeader) != "" {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(RequestIDHeader, id)
+	return t.next.RoundTrip(r)
+}
+
+// inboundRequestID returns the request ID r was sent with, or "" if it has
+// none or it is too long or contains characters other than printable
+// ASCII, which would let callers forge log lines.
+func inboundRequestID(r *http.Request) string {
+	for _, name := range []string{RequestIDHeader, CorrelationIDHeader} {
+		if id := r.Header.Get(name); validRequestID(id) {
+			return id
+		}
+	}
+	return ""
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
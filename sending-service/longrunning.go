@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/downstream"
+	"sender/proxy"
+)
+
+// downstreamStatusTrailer carries the status code the downstream service
+// answered a long-running call with, once the caller has already been
+// answered with 200 OK to keep its connection alive.
+const downstreamStatusTrailer = "X-Downstream-Status"
+
+// keepAlive sends req with client. If no response arrives within
+// interval, it answers the caller with 200 OK, announcing the
+// X-Downstream-Status trailer, and sends it a newline every interval until
+// one does, so that proxies and load balancers between the caller and the
+// sending service never see the connection idle. Leading whitespace is
+// ignored by JSON parsers, so JSON bodies still parse. It reports whether
+// the caller was answered.
+func keepAlive(w http.ResponseWriter, client *authclient.Client, req *http.Request, interval time.Duration) (*http.Response, bool, error) {
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := client.Do(req)
+		done <- result{resp, err}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	rc := http.NewResponseController(w)
+	answered := false
+	for {
+		select {
+		case res := <-done:
+			return res.resp, answered, res.err
+		case <-ticker.C:
+			if !answered {
+				w.Header().Set("Trailer", downstreamStatusTrailer)
+				w.WriteHeader(http.StatusOK)
+				answered = true
+			}
+			// A caller that has gone away cancels the call, which ends
+			// the wait.
+			if _, err := io.WriteString(w, "\n"); err == nil {
+				rc.Flush()
+			}
+		}
+	}
+}
+
+// finishKeepAlive sends the caller the body of a long-running call's
+// response after the keep-alives, or the error the call failed with, and
+// the status code of either in the X-Downstream-Status trailer. The
+// downstream response headers can no longer be sent.
+func finishKeepAlive(w http.ResponseWriter, r *http.Request, resp *http.Response, err error, prefix string, maxSize int64, logger *slog.Logger) {
+	if err != nil {
+		if errors.Is(err, r.Context().Err()) {
+			return
+		}
+		logger.Error("Long-running call failed after keep-alives", slog.Any("error", err))
+		e := apierror.FromDownstream(err)
+		w.Header().Set(downstreamStatusTrailer, strconv.Itoa(e.Status))
+		apierror.WriteBody(w, r, e)
+		return
+	}
+	defer resp.Body.Close()
+
+	io.WriteString(w, prefix)
+	body := io.Reader(resp.Body)
+	if maxSize > 0 {
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+	n, err := proxy.Copy(w, body)
+	if err != nil {
+		logger.Error("Failed to stream response body", slog.Any("error", err))
+		panic(http.ErrAbortHandler)
+	}
+	if maxSize > 0 && n > maxSize {
+		logger.Error("Response body too large", slog.Int64("max_size", maxSize))
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set(downstreamStatusTrailer, strconv.Itoa(resp.StatusCode))
+}
+
+// longRunning applies the timeout and polling of lr to every request
+// passed to next, as for a reverse proxy to the service.
+func longRunning(lr downstream.LongRunning, next http.Handler) http.Handler {
+	opts := lr.CallOptions()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(authclient.CallContext(r.Context(), opts...)))
+	})
+}
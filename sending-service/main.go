@@ -3,57 +3,741 @@ package main
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
-	"google.golang.org/api/idtoken"
+	"cloud.google.com/go/compute/metadata"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+
+	"sender/authclient"
+	"sender/broker"
+	"sender/browser"
+	"sender/buildinfo"
+	"sender/callback"
+	"sender/chaos"
+	"sender/cloudmonitoring"
+	"sender/config"
+	"sender/deadline"
+	"sender/downstream"
+	"sender/errorreporting"
+	"sender/handoff"
+	"sender/health"
+	"sender/logging"
+	"sender/metrics"
+	"sender/profiler"
+	"sender/proxy"
+	"sender/recovery"
+	"sender/rediscache"
+	"sender/tokenaudit"
+	"sender/tracing"
 )
 
-func httpClientWithIDToken(ctx context.Context, audience string) (*http.Client, error) {
-	client, err := idtoken.NewClient(ctx, audience)
+func main() {
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		return nil, err
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	level, _ := cfg.Level()
+	logger := slog.New(logging.NewHandler(os.Stdout, level))
+	slog.SetDefault(logger)
+	logger.Info("Starting sending service", slog.Any("build", buildinfo.Get()))
+	logger.Info("Effective configuration", slog.Any("config", cfg))
+
+	if err := run(cfg, logger); err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
-	return client, nil
 }
 
-func main() {
-	receivingServiceURL := os.Getenv("RECEIVING_SERVICE_URL")
-	if receivingServiceURL == "" {
-		log.Fatal("RECEIVING_SERVICE_URL environment variable is not set")
+func run(cfg *config.Config, logger *slog.Logger) error {
+	// Reloaded configurations are compared with the one loaded, before
+	// services are discovered and secrets resolved in cfg.
+	args := os.Args[1:]
+	loaded := cfg
+	if cfg.ReloadInterval > 0 {
+		var err error
+		if loaded, err = config.Reload(args, cfg.FileData()); err != nil {
+			return err
+		}
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), serviceName(), cfg.TraceExporter)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	m := metrics.New()
+
+	var discoverer *downstream.Discoverer
+	var discovered map[string]bool
+	if downstream.NeedsDiscovery(cfg.Services) {
+		opts, err := adminAPIOptions(cfg)
+		if err != nil {
+			return err
+		}
+		if discoverer, err = downstream.NewDiscoverer(context.Background(), opts...); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+		discovered, err = discoverServices(ctx, logger, discoverer, cfg.Services)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	transport, err := cfg.TransportSettings()
+	if err != nil {
+		return err
+	}
+	var tokenObserver authclient.TokenObserver = m
+	clientOpts := []authclient.Option{
+		authclient.WithRetry(cfg.Retry.Policy()),
+		authclient.WithTimeoutPolicy(cfg.Timeouts.Policy()),
+		authclient.WithLogger(logger),
+		authclient.WithLimitObserver(m),
+		authclient.WithRetryObserver(m),
+		authclient.WithBackpressureObserver(m),
+		authclient.WithTransportSettings(transport),
+		authclient.WithAttemptMiddleware(
+			tracing.NewTransport,
+			m.NewTransport,
+			func(next http.RoundTripper) http.RoundTripper { return logging.NewTransport(next) },
+		),
+	}
+	clientOpts = append(clientOpts, authclient.WithMiddleware(func(next http.RoundTripper) http.RoundTripper {
+		return logging.NewRequestIDTransport(next)
+	}))
+	if cfg.Capture.Enabled {
+		logger.Warn("Capturing downstream requests and responses; disable once done debugging")
+		capture := cfg.CaptureSettings()
+		clientOpts = append(clientOpts, authclient.WithAttemptMiddleware(func(next http.RoundTripper) http.RoundTripper {
+			return logging.NewCaptureTransport(next, capture)
+		}))
+	}
+	if cfg.Chaos.Enabled {
+		logger.Warn("Injecting faults into downstream calls; disable outside resilience tests", slog.Any("rules", cfg.Chaos.Rules))
+		clientOpts = append(clientOpts, authclient.WithAttemptMiddleware(chaos.New(cfg.Chaos.Rules).NewTransport))
+	}
+	if cm := cfg.CloudMonitoring; cm.Enabled {
+		project := cm.ProjectID
+		if project == "" {
+			project = logging.ProjectID()
+		}
+		exporter, err := cloudmonitoring.New(context.Background(), project, cfg.ClientOptions(),
+			cloudmonitoring.WithPrefix(cm.Prefix),
+			cloudmonitoring.WithCaller(serviceName()),
+			cloudmonitoring.WithLogger(logger),
+		)
+		if err != nil {
+			return err
+		}
+		tokenObserver = authclient.MultiTokenObserver(tokenObserver, exporter)
+		clientOpts = append(clientOpts,
+			authclient.WithRetryObserver(exporter),
+			authclient.WithAttemptMiddleware(exporter.NewTransport),
+		)
+		stop := make(chan struct{})
+		go exporter.Run(cm.Interval, stop)
+		defer func() {
+			close(stop)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := exporter.Export(ctx); err != nil {
+				logger.Warn("Failed to write metrics to Cloud Monitoring", slog.Any("error", err))
+			}
+		}()
+		logger.Info("Writing metrics to Cloud Monitoring", slog.String("project", project), slog.Duration("interval", cm.Interval))
+	}
+	var reporter *errorreporting.Reporter
+	if er := cfg.ErrorReporting; er.Enabled {
+		project := er.ProjectID
+		if project == "" {
+			project = logging.ProjectID()
+		}
+		reporter, err = errorreporting.New(context.Background(), project, cfg.ClientOptions(),
+			errorreporting.WithServiceContext(serviceName(), cfg.Identity.Version),
+			errorreporting.WithLogger(logger),
+		)
+		if err != nil {
+			return err
+		}
+		tokenObserver = authclient.MultiTokenObserver(tokenObserver, reporter)
+		clientOpts = append(clientOpts, authclient.WithMiddleware(reporter.NewTransport))
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := reporter.Close(ctx); err != nil {
+				logger.Warn("Failed to send errors to Error Reporting", slog.Any("error", err))
+			}
+		}()
+		logger.Info("Reporting errors to Error Reporting", slog.String("project", project))
+	}
+	if ta := cfg.TokenAudit; ta.SampleRate > 0 {
+		var opts []tokenaudit.Option
+		if ta.ExpectedEmail != "" {
+			opts = append(opts, tokenaudit.WithExpectedEmail(ta.ExpectedEmail))
+		}
+		tokenObserver = authclient.MultiTokenObserver(tokenObserver, tokenaudit.New(logger, ta.SampleRate, opts...))
+		logger.Info("Sampling minted ID tokens for audit", slog.Float64("sample_rate", ta.SampleRate))
+	}
+	clientOpts = append(clientOpts, authclient.WithTokenObserver(tokenObserver))
+	if tc := cfg.Transport; tc.Diagnostics {
+		diag := authclient.NewConnDiagnostics(logger, tc.ForceHTTP2)
+		clientOpts = append(clientOpts, authclient.WithAttemptMiddleware(diag.Middleware))
+		stop := make(chan struct{})
+		go diag.RunStats(tc.DiagnosticsInterval, stop)
+		defer func() {
+			close(stop)
+			diag.LogStats()
+		}()
+	}
+	if cfg.Transport.HTTP3 {
+		if newHTTP3Transport == nil {
+			logger.Warn("Not attempting HTTP/3: the service was built without it; build with -tags http3")
+		} else {
+			logger.Warn("Attempting HTTP/3 with receivers that advertise it; this is experimental")
+			clientOpts = append(clientOpts, authclient.WithHTTP3(authclient.HTTP3Settings{RoundTripper: newHTTP3Transport(transport.TLS), Observer: m}))
+		}
+	}
+	headers, err := loadSecrets(context.Background(), logger, cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Headers) > 0 {
+		clientOpts = append(clientOpts, authclient.WithHeaderFunc(headers))
+	}
+	var responses authclient.ResponseStore
+	if rc := cfg.ResponseCache; rc.Enabled {
+		responses = authclient.NewMemoryStore(rc.MaxEntries)
+		if rc.RedisAddr != "" {
+			opts, err := rc.RedisAuth.Options(rc.RedisAddr)
+			if err != nil {
+				return err
+			}
+			responses = rediscache.New(redis.NewClient(opts), serviceName()+":")
+		}
+		clientOpts = append(clientOpts, authclient.WithResponseCache(responses, rc.DefaultTTL))
+	}
+	clientOpts = append(clientOpts,
+		authclient.WithUserAgent(userAgent(cfg.Identity)),
+		authclient.WithClientVersion(cfg.Identity.Version),
+		authclient.WithClientLabels(cfg.Identity.Labels),
+		authclient.WithTokenHeader(cfg.IDTokenHeader),
+	)
+	if cfg.Retry.IdempotencyKeys {
+		clientOpts = append(clientOpts, authclient.WithIdempotencyKeys())
+	}
+	if cfg.Retry.BodyBufferLimit > 0 {
+		clientOpts = append(clientOpts, authclient.WithBodyBuffering(cfg.Retry.BodyBufferLimit))
+	}
+	if u := cfg.Uploads; u.Stream {
+		clientOpts = append(clientOpts, authclient.WithStreamingUploads(u.Settings(cfg.Retry.BodyBufferLimit)), authclient.WithUploadObserver(m))
+	}
+	if h := cfg.Handoff; h.Bucket != "" {
+		s := h.Settings()
+		if s.ServiceAccount == "" {
+			email, err := metadata.Email("default")
+			if err != nil {
+				return fmt.Errorf("failed to look up the service account for signing handoff URLs: %w", err)
+			}
+			s.ServiceAccount = email
+		}
+		offloader, err := handoff.New(context.Background(), s, cfg.ClientOptions())
+		if err != nil {
+			return err
+		}
+		clientOpts = append(clientOpts, authclient.WithMiddleware(offloader.Middleware))
+	}
+	if c := cfg.Compression; c.Requests != "" {
+		clientOpts = append(clientOpts, authclient.WithRequestCompression(c.Settings()))
+	}
+	if cfg.Compression.DecompressResponses {
+		clientOpts = append(clientOpts, authclient.WithResponseDecompression())
+	}
+	if cfg.Retry.Budget.Enabled {
+		clientOpts = append(clientOpts, authclient.WithRetryBudget(cfg.Retry.Budget.Budget()))
+	}
+	if cfg.ConcurrencyLimit.MaxInFlight > 0 {
+		clientOpts = append(clientOpts, authclient.WithConcurrencyLimit(cfg.ConcurrencyLimit.Limit()))
+	}
+	if cfg.ForwardUserCredentials {
+		clientOpts = append(clientOpts, authclient.WithForwardedAuthorization())
+	}
+	if ids := downstream.IAPClientIDs(cfg.Services); len(ids) > 0 {
+		clientOpts = append(clientOpts, authclient.WithIAPClientIDs(ids))
+	}
+	if cfg.QuotaProject != "" {
+		clientOpts = append(clientOpts, authclient.WithQuotaProject(cfg.QuotaProject))
+	}
+	if cfg.Deadlines.Propagate {
+		clientOpts = append(clientOpts, authclient.WithDeadlinePropagation(cfg.Deadlines.Reserve))
+	}
+	if rs := cfg.RequestSigning; rs.Enabled {
+		signer, err := requestSigner(rs.ServiceAccount, cfg.ClientOptions())
+		if err != nil {
+			return err
+		}
+		clientOpts = append(clientOpts, authclient.WithRequestSigning(signer))
+	}
+	if e := cfg.Encryption; e.Enabled() {
+		wrapper, err := keyWrapper(e, cfg.ClientOptions())
+		if err != nil {
+			return err
+		}
+		clientOpts = append(clientOpts, authclient.WithEncryption(wrapper))
+	}
+	if cfg.HedgeDelay > 0 {
+		clientOpts = append(clientOpts, authclient.WithHedging(cfg.HedgeDelay))
+	}
+	if cfg.DeduplicateGets {
+		clientOpts = append(clientOpts, authclient.WithDeduplication(authclient.DedupSettings{Observer: m}))
+	}
+	if cfg.TokenRefreshSkew > 0 {
+		clientOpts = append(clientOpts, authclient.WithBackgroundRefresh(cfg.TokenRefreshSkew))
+	}
+	if cfg.TokenStaleGrace > 0 {
+		clientOpts = append(clientOpts, authclient.WithStaleTokenGrace(cfg.TokenStaleGrace))
+	}
+	if ts := cfg.TokenStore; ts.RedisAddr != "" {
+		opts, err := ts.RedisAuth.Options(ts.RedisAddr)
+		if err != nil {
+			return err
+		}
+		clientOpts = append(clientOpts, authclient.WithTokenStore(rediscache.NewTokenStore(redis.NewClient(opts), serviceName()+":")))
+	}
+	if cfg.CircuitBreaker.Enabled {
+		clientOpts = append(clientOpts, authclient.WithCircuitBreaker(cfg.CircuitBreaker.Settings()))
+	}
+
+	if customTokens := cfg.Dev.Enabled || cfg.ImpersonateServiceAccount != "" || cfg.WorkloadIdentity.CredentialsFile != "" || cfg.Vault.Enabled(); !customTokens && authclient.OnGKE() {
+		logger.Info("Running on GKE: minting ID tokens from the GKE metadata server with Workload Identity")
+		clientOpts = append(clientOpts, authclient.WithTokenSourceFunc(authclient.GKETokenSource()))
+	}
+
+	if cfg.Dev.Enabled {
+		logger.Info("Development mode: using local credentials instead of the metadata server")
+		devTokens := authclient.GcloudTokenSource(cfg.Dev.ImpersonateServiceAccount)
+		if cfg.Dev.IdentityToken != "" {
+			devTokens = authclient.StaticTokenSource(cfg.Dev.IdentityToken)
+		}
+		clientOpts = append(clientOpts, authclient.WithTokenSourceFunc(devTokens))
+	}
+
+	if sa := cfg.ImpersonateServiceAccount; sa != "" {
+		logger.Info("Minting ID tokens with an impersonated service account", slog.String("service_account", sa), slog.Any("delegates", cfg.ImpersonationDelegates), slog.Bool("omit_email", cfg.ImpersonationOmitEmail))
+		clientOpts = append(clientOpts, authclient.WithTokenSourceFunc(cfg.Impersonation().TokenSource(cfg.ClientOptions()...)))
+	}
+
+	if wi := cfg.WorkloadIdentity; wi.CredentialsFile != "" {
+		federated, err := authclient.FederatedTokenSource(wi.CredentialsFile, wi.ServiceAccount, cfg.ClientOptions()...)
+		if err != nil {
+			return err
+		}
+		logger.Info("Minting ID tokens with Workload Identity Federation", slog.String("credentials_file", wi.CredentialsFile))
+		clientOpts = append(clientOpts, authclient.WithTokenSourceFunc(federated))
+	}
+
+	if v := cfg.Vault; v.Enabled() {
+		provider, err := authclient.VaultTokenProvider(context.Background(), authclient.VaultConfig{
+			Address:        v.Address,
+			Token:          v.Token,
+			TokenFile:      v.TokenFile,
+			Namespace:      v.Namespace,
+			Mount:          v.Mount,
+			Roleset:        v.Roleset,
+			ServiceAccount: v.ServiceAccount,
+		}, cfg.ClientOptions()...)
+		if err != nil {
+			return err
+		}
+		logger.Info("Minting ID tokens with credentials from Vault", slog.String("address", v.Address), slog.String("roleset", v.Roleset))
+		clientOpts = append(clientOpts, authclient.WithTokenProvider(provider))
+	}
+
+	if at := cfg.AccessToken; at.Enabled {
+		ts, err := accessTokenSource(cfg)
+		if err != nil {
+			return err
+		}
+		logger.Info("Sending access tokens with ID tokens", slog.String("id_token_header", cfg.IDTokenHeader), slog.Any("scopes", at.Scopes))
+		clientOpts = append(clientOpts, authclient.WithAccessToken(ts))
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	clients := authclient.NewCache(context.Background(), clientOpts...)
+	registry := downstream.NewRegistry(cfg.Services, clients)
+	for _, name := range registry.Names() {
+		if svc, _ := registry.Service(name); downstream.CustomDomainAudience(svc) {
+			logger.Warn("Service URL is not a run.app URL; if it is a custom domain, set the audience to the service's run.app URL",
+				slog.String("service", name), slog.String("url", svc.URL), slog.String("audience", svc.Audience))
+		}
+	}
+	if discoverer != nil && cfg.DiscoveryInterval > 0 {
+		go rediscoverLoop(logger, discoverer, registry, discovered, cfg.DiscoveryInterval)
+	}
+	checkerOpts := []health.Option{health.WithDownstreamProbe(cfg.ReadinessProbe)}
+	if cfg.CheckInvoker {
+		opts, err := adminAPIOptions(cfg)
+		if err != nil {
+			return err
+		}
+		checkerOpts = append(checkerOpts, health.WithInvokerCheck(opts...))
+	}
+	checker := health.New(registry, checkerOpts...)
+
+	if cfg.ValidateOnly {
+		ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
 		defer cancel()
+		return validate(ctx, logger, checker, slog.LevelInfo)
+	}
+	if cfg.ValidateInterval > 0 {
+		go validateLoop(logger, checker, cfg.ValidateInterval)
+	}
+	if cfg.CheckInvoker {
+		go checkInvoker(logger, checker)
+	}
 
-		client, err := httpClientWithIDToken(ctx, receivingServiceURL)
+	if cfg.Prewarm.Enabled {
+		prewarm(logger, registry, cfg.Prewarm)
+	}
+	if cfg.WarmConnections.Enabled {
+		go keepWarm(logger, registry, cfg.WarmConnections, m)
+	}
+
+	rl, err := newReloader(logger, args, cfg, loaded, registry, clients, clientOpts, m)
+	if err != nil {
+		return err
+	}
+
+	// endUsers wraps the handlers that call downstream services, to verify
+	// the end users of browser requests in browser mode, or the calling
+	// services with inbound authentication.
+	endUsers := func(h http.Handler) http.Handler { return h }
+	if b := cfg.Browser; b.Enabled() {
+		guard, err := browser.New(browser.Settings{
+			FirebaseProject: b.FirebaseProject,
+			GoogleClientIDs: b.GoogleClientIDs,
+			AllowedOrigins:  b.AllowedOrigins,
+			SessionCookie:   b.SessionCookie,
+		})
 		if err != nil {
-			log.Printf("Failed to create authenticated client: %v", err)
-			http.Error(w, "Failed to create authenticated client", http.StatusInternalServerError)
-			return
+			return err
 		}
+		endUsers = guard.Middleware
+		logger.Info("Accepting end-user ID tokens from browsers", slog.String("firebase_project", b.FirebaseProject), slog.Any("google_client_ids", b.GoogleClientIDs))
+	}
+	if in := cfg.Inbound; in.Audience != "" {
+		endUsers = requireCallers(in.Audience, in.AllowedCallers)
+		logger.Info("Verifying the ID tokens of inbound requests", slog.String("audience", in.Audience), slog.Any("allowed_callers", in.AllowedCallers))
+	}
 
-		resp, err := client.Get(receivingServiceURL)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	mux.HandleFunc("/healthz", checker.Healthz)
+	mux.HandleFunc("/readyz", checker.Readyz)
+	mux.HandleFunc("/version", buildinfo.Handler)
+	if cfg.DebugTokenEndpoint {
+		logger.Warn("Serving /debug/token; restrict who can invoke this service")
+		mux.HandleFunc("/debug/token", debugToken(registry, cfg.DefaultService))
+	}
+	if a := cfg.Admin; len(a.AllowedCallers) > 0 {
+		mux.Handle("/admin/cache/flush", rl.requireAdmin(flushCaches(registry, responses)))
+		mux.Handle("/admin/state", rl.requireAdmin(adminState(registry)))
+		if cfg.Profiling.Pprof {
+			logger.Warn("Serving /debug/pprof/ to the admin allowed callers")
+			mux.Handle("/debug/pprof/", rl.requireAdmin(profiler.Handler()))
+		}
+	}
+	if tb := cfg.TokenBroker; len(tb.Grants) > 0 {
+		logger.Info("Serving /token to the token broker's grantees", slog.Int("grants", len(tb.Grants)))
+		mux.Handle("/token", broker.New(tb.Audience, tb.Grants, func(ctx context.Context, audience string) (*oauth2.Token, error) {
+			client, err := registry.AudienceClient(audience)
+			if err != nil {
+				return nil, err
+			}
+			return client.Token()
+		}))
+	}
+	if p := cfg.Profiling; p.CloudProfiler {
+		project := p.ProjectID
+		if project == "" {
+			project = logging.ProjectID()
+		}
+		agent, err := profiler.New(context.Background(), project, cfg.ClientOptions(),
+			profiler.WithTarget(serviceName(), cfg.Identity.Version),
+			profiler.WithLogger(logger),
+		)
 		if err != nil {
-			log.Printf("Failed to make request: %v", err)
-			http.Error(w, "Failed to make request", http.StatusInternalServerError)
-			return
+			return err
 		}
-		defer resp.Body.Close()
+		stop := make(chan struct{})
+		defer close(stop)
+		go agent.Run(stop)
+		logger.Info("Uploading profiles to Cloud Profiler", slog.String("project", project))
+	}
+	mux.Handle("/", endUsers(rl.root()))
+	mux.Handle("/call/", endUsers(rl.calls()))
+	if cfg.ReloadInterval > 0 {
+		go rl.watch(cfg.ReloadInterval)
+		logger.Info("Reloading the configuration file when it changes", slog.String("file", cfg.File), slog.Duration("interval", cfg.ReloadInterval))
+	}
+	if cfg.Outbox.Enabled {
+		box, err := newOutbox(context.Background(), logger, cfg, registry, m)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			box.Run(ctx)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+
+		enq := endUsers(rl.limited(enqueue(box, registry, cfg.DefaultService, cfg.Outbox.MaxBodySize)))
+		mux.Handle("/enqueue", enq)
+		mux.Handle("/enqueue/", enq)
+		if a := cfg.Admin; len(a.AllowedCallers) > 0 {
+			dead := rl.requireAdmin(deadLetters(box))
+			mux.Handle("/admin/dead-letters", dead)
+			mux.Handle("/admin/dead-letters/", dead)
+		}
+	}
 
-		body, err := ioutil.ReadAll(resp.Body)
+	if cb := cfg.Callbacks; cb.URL != "" {
+		var store authclient.ResponseStore = authclient.NewMemoryStore(callbackEntries)
+		if cb.RedisAddr != "" {
+			opts, err := cb.RedisAuth.Options(cb.RedisAddr)
+			if err != nil {
+				return err
+			}
+			store = rediscache.New(redis.NewClient(opts), serviceName()+":")
+		} else {
+			logger.Warn("Keeping callbacks in memory; set CALLBACK_REDIS_ADDR when running more than one instance")
+		}
+		opts := []callback.Option{
+			callback.WithAllowedCallers(cb.AllowedCallers),
+			callback.WithTTL(cb.TTL),
+			callback.WithMaxBodySize(cb.MaxBodySize),
+		}
+		if cb.Audience != "" {
+			opts = append(opts, callback.WithAudience(cb.Audience))
+		}
+		callbacks, err := callback.NewRegistry(store, cb.URL, opts...)
 		if err != nil {
-			log.Printf("Failed to read response body: %v", err)
-			http.Error(w, "Failed to read response body", http.StatusInternalServerError)
-			return
+			return err
 		}
+		mux.Handle(callbacks.Path(), callbacks.Handler())
 
-		fmt.Fprintf(w, "Response from receiving service: %s", string(body))
-	})
+		mux.Handle("/async/", endUsers(rl.limited(asyncCall(callbacks, registry, cb.MaxBodySize))))
+		logger.Info("Accepting asynchronous calls", slog.String("callback_url", cb.URL))
+	}
 
-	http.ListenAndServe(":8080", nil)
+	var inner http.Handler = mux
+	if cfg.Deadlines.Propagate {
+		inner = deadline.Middleware(mux)
+	}
+	if cfg.RevisionTagHeader != "" {
+		inner = revisionTags(cfg.RevisionTagHeader, inner)
+	}
+	if cfg.ServerTiming {
+		inner = serverTiming(inner)
+	}
+	if sa := cfg.SessionAffinity; sa.Header != "" {
+		inner = sessionAffinity(sa.Header, authclient.NewSessions(sa.IdleTimeout, sa.MaxSessions), inner)
+	}
+	if reporter != nil {
+		inner = reporter.Middleware(inner)
+	}
+	inner = recovery.Middleware(serviceName(), cfg.Identity.Version, m)(inner)
+	if n := cfg.Server.MaxRequestBody; n > 0 {
+		inner = limitBody(inner, n)
+	}
+	handler := logging.Middleware(logger, logging.ProjectID())(tracing.Middleware(m.Middleware(inner)))
+
+	if cfg.ServeH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	srv := newServer(":"+cfg.Port, handler, cfg.Server)
+	return serve(logger, srv, cfg.ShutdownTimeout)
+}
+
+// newProxy returns a reverse proxy forwarding every request to the named
+// downstream service, at its current URL.
+func newProxy(logger *slog.Logger, registry *downstream.Registry, name string, opts ...proxy.Option) (http.Handler, error) {
+	svc, _ := registry.Service(name)
+	h, err := buildProxy(logger, registry, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &serviceProxy{logger: logger, registry: registry, name: name, opts: opts, url: svc.URL, handler: h}, nil
+}
+
+// buildProxy returns a reverse proxy forwarding every request to the URL
+// the named downstream service has now.
+func buildProxy(logger *slog.Logger, registry *downstream.Registry, name string, opts ...proxy.Option) (http.Handler, error) {
+	svc, _ := registry.Service(name)
+	target, err := url.Parse(svc.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL for downstream service %q: %w", name, err)
+	}
+	client, err := registry.Client(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create authenticated client: %w", err)
+	}
+	logger.Info("Proxying requests", slog.String("service", name), slog.String("target", target.String()))
+	rp := proxy.New(target, client, opts...)
+	var h http.Handler = rp
+	if !svc.LongRunning.IsZero() {
+		h = longRunning(svc.LongRunning, h)
+	}
+	if svc.Stream {
+		rp.FlushInterval = -1
+		return streaming(h), nil
+	}
+	return h, nil
+}
+
+// prewarm mints a token for every downstream service before the server
+// starts listening, logging how each one went. Failures are not fatal:
+// the token is minted again on the first request.
+func prewarm(logger *slog.Logger, registry *downstream.Registry, cfg config.Prewarm) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	for _, res := range registry.Prewarm(ctx, cfg.Concurrency) {
+		attrs := []any{
+			slog.String("service", res.Service),
+			slog.String("audience", res.Audience),
+			slog.Duration("duration", res.Duration),
+		}
+		if res.Err != nil {
+			logger.Warn("Failed to prewarm ID token", append(attrs, slog.Any("error", res.Err))...)
+			continue
+		}
+		logger.Info("Prewarmed ID token", attrs...)
+	}
+}
+
+// keepWarm pings every downstream service right away and then at the
+// configured interval, so that connections to them stay open and an
+// instance of each stays warm, logging the services that fail.
+func keepWarm(logger *slog.Logger, registry *downstream.Registry, cfg config.WarmConnections, observer authclient.WarmObserver) {
+	settings := cfg.Settings(observer)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Interval)
+		for _, res := range registry.WarmConnections(ctx, settings, cfg.Concurrency) {
+			attrs := []any{
+				slog.String("service", res.Service),
+				slog.String("audience", res.Audience),
+				slog.Duration("duration", res.Duration),
+			}
+			if res.Err != nil {
+				logger.Warn("Failed to keep connections warm", append(attrs, slog.Any("error", res.Err))...)
+				continue
+			}
+			logger.Debug("Kept connections warm", attrs...)
+		}
+		cancel()
+		<-ticker.C
+	}
+}
+
+// accessTokenSource returns the source of access tokens sent with ID
+// tokens: the impersonated service account's if one is configured, and
+// otherwise the service's own.
+func accessTokenSource(cfg *config.Config) (oauth2.TokenSource, error) {
+	ctx := context.Background()
+	if cfg.ImpersonateServiceAccount != "" {
+		return cfg.Impersonation().AccessTokenSource(ctx, cfg.AccessToken.Scopes, cfg.ClientOptions()...)
+	}
+	return authclient.DefaultAccessTokenSource(ctx, cfg.AccessToken.Scopes...)
+}
+
+// adminAPIOptions returns the client options for Google APIs that must be
+// called as the identity ID tokens are minted for: the impersonated
+// service account if one is configured, otherwise the service's own
+// credentials.
+func adminAPIOptions(cfg *config.Config) ([]option.ClientOption, error) {
+	opts := cfg.ClientOptions()
+	if cfg.ImpersonateServiceAccount != "" {
+		ts, err := cfg.Impersonation().AccessTokenSource(context.Background(), nil, opts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithTokenSource(ts))
+	}
+	return opts, nil
+}
+
+// requestSigner returns a signer for the given service account, or for the
+// service's own service account if it is empty, whose IAM client is
+// created with opts.
+func requestSigner(serviceAccount string, opts []option.ClientOption) (authclient.Signer, error) {
+	if serviceAccount == "" {
+		email, err := metadata.Email("default")
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up the service account for request signing: %w", err)
+		}
+		serviceAccount = email
+	}
+	return authclient.IAMSigner(context.Background(), serviceAccount, opts...)
+}
+
+// keyWrapper returns the key wrapper of the Cloud KMS key or keyset file of
+// cfg, whose KMS client is created with opts.
+func keyWrapper(cfg config.Encryption, opts []option.ClientOption) (authclient.KeyWrapper, error) {
+	if cfg.KeysetFile != "" {
+		return authclient.LoadKeyset(cfg.KeysetFile)
+	}
+	return authclient.KMSKeyWrapper(context.Background(), cfg.KMSKey, opts...)
+}
+
+// userAgent returns the configured User-Agent, or one made of the service
+// name and version, followed by the build version and commit if known.
+func userAgent(id config.Identity) string {
+	if id.UserAgent != "" {
+		return id.UserAgent
+	}
+	ua := serviceName()
+	if id.Version != "" {
+		ua += "/" + id.Version
+	}
+	var build []string
+	b := buildinfo.Get()
+	if b.Version != "" && b.Version != id.Version {
+		build = append(build, b.Version)
+	}
+	if c := b.ShortCommit(); c != "" {
+		build = append(build, c)
+	}
+	if len(build) > 0 {
+		ua += " (build " + strings.Join(build, " ") + ")"
+	}
+	return ua
+}
+
+// serviceName returns the Cloud Run service name, which is used to identify
+// the service in traces.
+func serviceName() string {
+	if name := os.Getenv("K_SERVICE"); name != "" {
+		return name
+	}
+	return "sending-service"
 }
@@ -0,0 +1,460 @@
+// Package metrics exposes Prometheus metrics for inbound requests, the
+// load shedding gate and recovered panics, downstream calls, the protocols
+// they use and those deduplicated, ID token activity, the retry budgets and
+// concurrency limits of downstream clients, streamed uploads and the parts
+// of multipart uploads, and outbox deliveries.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"sender/authclient"
+	"sender/loadshed"
+	"sender/outbox"
+	"sender/proxy"
+	"sender/recovery"
+)
+
+// Metrics holds the collectors of the sending service and the registry they
+// are registered with.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	inboundRequests   *prometheus.CounterVec
+	inboundDuration   *prometheus.HistogramVec
+	inboundInFlight   prometheus.Gauge
+	inboundQueued     prometheus.Gauge
+	inboundShed       *prometheus.CounterVec
+	panics            prometheus.Counter
+	downstreamStatus  *prometheus.CounterVec
+	downstreamLatency *prometheus.HistogramVec
+	downstreamErrors  *prometheus.CounterVec
+	downstreamProto   *prometheus.CounterVec
+	http3Fallbacks    *prometheus.CounterVec
+	deduplicated      *prometheus.CounterVec
+	backpressure      *prometheus.CounterVec
+	warmPings         *prometheus.CounterVec
+	tokensMinted      *prometheus.CounterVec
+	tokensRefreshed   *prometheus.CounterVec
+	tokenErrors       *prometheus.CounterVec
+	tokenMintLatency  *prometheus.HistogramVec
+	tokensStale       *prometheus.GaugeVec
+	tokenExpiry       *expiryCollector
+	retries           *prometheus.CounterVec
+	retryBudget       *prometheus.GaugeVec
+	retriesDenied     *prometheus.CounterVec
+	inFlight          *prometheus.GaugeVec
+	concurrencyLimit  *prometheus.CounterVec
+	uploadsInFlight   *prometheus.GaugeVec
+	uploadBytes       *prometheus.CounterVec
+	uploads           *prometheus.CounterVec
+	multipartParts    *prometheus.HistogramVec
+	outboxMessages    *prometheus.CounterVec
+}
+
+var (
+	_ authclient.TokenObserver        = (*Metrics)(nil)
+	_ authclient.TokenLatencyObserver = (*Metrics)(nil)
+	_ authclient.StaleTokenObserver   = (*Metrics)(nil)
+	_ authclient.LimitObserver        = (*Metrics)(nil)
+	_ authclient.RetryObserver        = (*Metrics)(nil)
+	_ authclient.UploadObserver       = (*Metrics)(nil)
+	_ authclient.HTTP3Observer        = (*Metrics)(nil)
+	_ authclient.DedupObserver        = (*Metrics)(nil)
+	_ authclient.BackpressureObserver = (*Metrics)(nil)
+	_ authclient.WarmObserver         = (*Metrics)(nil)
+	_ proxy.MultipartObserver         = (*Metrics)(nil)
+	_ outbox.Observer                 = (*Metrics)(nil)
+	_ loadshed.Observer               = (*Metrics)(nil)
+	_ recovery.Observer               = (*Metrics)(nil)
+)
+
+// New creates the collectors and registers them, together with the Go
+// runtime and process collectors, on a new registry.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		inboundRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_inbound_requests_total",
+			Help: "Inbound HTTP requests by method and status code.",
+		}, []string{"method", "code"}),
+		inboundDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sender_inbound_request_duration_seconds",
+			Help:    "Latency of inbound HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		inboundInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sender_inbound_in_flight",
+			Help: "Inbound requests admitted by the load shedding gate and in progress.",
+		}),
+		inboundQueued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sender_inbound_queued",
+			Help: "Inbound requests waiting for the load shedding gate.",
+		}),
+		inboundShed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_inbound_shed_total",
+			Help: "Inbound requests shed with 503, by reason: queue_full or timeout.",
+		}, []string{"reason"}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sender_panics_total",
+			Help: "Panics recovered in inbound request handlers.",
+		}),
+		downstreamStatus: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_downstream_requests_total",
+			Help: "Downstream HTTP requests by host and status code.",
+		}, []string{"host", "code"}),
+		downstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sender_downstream_request_duration_seconds",
+			Help:    "Latency of downstream HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"host"}),
+		downstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_downstream_errors_total",
+			Help: "Downstream HTTP requests that failed without a response.",
+		}, []string{"host"}),
+		downstreamProto: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_downstream_responses_by_protocol_total",
+			Help: "Downstream HTTP responses by host and the protocol they were received over, such as HTTP/2.0.",
+		}, []string{"host", "protocol"}),
+		http3Fallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_downstream_http3_fallbacks_total",
+			Help: "Downstream requests sent over HTTP/2 or HTTP/1.1 after an HTTP/3 attempt failed.",
+		}, []string{"host"}),
+		deduplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_downstream_deduplicated_requests_total",
+			Help: "Downstream GET requests answered by an identical call already in flight, by audience.",
+		}, []string{"audience"}),
+		backpressure: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_downstream_backpressure_total",
+			Help: "Downstream 429 and 503 answers, by audience and status code.",
+		}, []string{"audience", "code"}),
+		warmPings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_downstream_warm_pings_total",
+			Help: "Pings keeping downstream connections warm, by audience and result: reused, new or failed.",
+		}, []string{"audience", "result"}),
+		tokensMinted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_id_tokens_minted_total",
+			Help: "ID tokens obtained, by audience.",
+		}, []string{"audience"}),
+		tokensRefreshed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_id_token_refreshes_total",
+			Help: "ID tokens discarded and refreshed after being rejected, by audience.",
+		}, []string{"audience"}),
+		tokenErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_id_token_errors_total",
+			Help: "Failures to obtain or refresh an ID token, by audience.",
+		}, []string{"audience"}),
+		tokenMintLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sender_id_token_mint_duration_seconds",
+			Help:    "Time taken to obtain a new ID token, by audience.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"audience"}),
+		tokensStale: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sender_id_token_stale",
+			Help: "1 while requests are sent with a cached ID token that could not be renewed, by audience.",
+		}, []string{"audience"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_downstream_retries_total",
+			Help: "Downstream requests retried, by audience and the status code of the failed attempt, 0 for network errors.",
+		}, []string{"audience", "code"}),
+		retryBudget: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sender_retry_budget_available",
+			Help: "Retries left in the current retry budget window, by audience.",
+		}, []string{"audience"}),
+		retriesDenied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_retries_denied_total",
+			Help: "Failed downstream requests not retried because the retry budget was spent, by audience.",
+		}, []string{"audience"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sender_downstream_in_flight",
+			Help: "Downstream attempts in flight, by audience.",
+		}, []string{"audience"}),
+		concurrencyLimit: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_concurrency_limited_total",
+			Help: "Downstream attempts rejected by the concurrency limit, by audience.",
+		}, []string{"audience"}),
+		uploadsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sender_uploads_in_flight",
+			Help: "Streamed uploads in progress, by audience.",
+		}, []string{"audience"}),
+		uploadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_upload_bytes_total",
+			Help: "Bytes of streamed uploads sent, by audience.",
+		}, []string{"audience"}),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_uploads_total",
+			Help: "Streamed uploads by audience and result: complete or failed.",
+		}, []string{"audience", "result"}),
+		tokenExpiry: newExpiryCollector(prometheus.NewDesc(
+			"sender_id_token_expiry_seconds",
+			"Seconds until the ID token last minted for an audience expires, negative once it has.",
+			[]string{"audience"}, nil,
+		)),
+		multipartParts: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sender_multipart_part_bytes",
+			Help:    "Sizes of the parts of forwarded multipart/form-data bodies, by host.",
+			Buckets: prometheus.ExponentialBuckets(1024, 8, 8),
+		}, []string{"host"}),
+		outboxMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sender_outbox_messages_total",
+			Help: "Outbox messages by service and outcome: enqueued, delivered, retried, dead_lettered or replayed.",
+		}, []string{"service", "outcome"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.inboundRequests,
+		m.inboundDuration,
+		m.inboundInFlight,
+		m.inboundQueued,
+		m.inboundShed,
+		m.panics,
+		m.downstreamStatus,
+		m.downstreamLatency,
+		m.downstreamErrors,
+		m.downstreamProto,
+		m.http3Fallbacks,
+		m.deduplicated,
+		m.backpressure,
+		m.warmPings,
+		m.tokensMinted,
+		m.tokensRefreshed,
+		m.tokenErrors,
+		m.tokenMintLatency,
+		m.tokensStale,
+		m.tokenExpiry,
+		m.retries,
+		m.retryBudget,
+		m.retriesDenied,
+		m.inFlight,
+		m.concurrencyLimit,
+		m.uploadsInFlight,
+		m.uploadBytes,
+		m.uploads,
+		m.multipartParts,
+		m.outboxMessages,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records the count and latency of inbound requests.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(m.inboundDuration,
+		promhttp.InstrumentHandlerCounter(m.inboundRequests, next))
+}
+
+// NewTransport returns a transport that records the status code, protocol
+// and latency of each request sent with next.
+func (m *Metrics) NewTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		m.downstreamLatency.WithLabelValues(req.URL.Host).Observe(time.Since(start).Seconds())
+		if err != nil {
+			m.downstreamErrors.WithLabelValues(req.URL.Host).Inc()
+			return nil, err
+		}
+		m.downstreamStatus.WithLabelValues(req.URL.Host, strconv.Itoa(resp.StatusCode)).Inc()
+		m.downstreamProto.WithLabelValues(req.URL.Host, resp.Proto).Inc()
+		return resp, nil
+	})
+}
+
+// TokenMinted implements authclient.TokenObserver.
+func (m *Metrics) TokenMinted(audience string, expiry time.Time) {
+	m.tokensMinted.WithLabelValues(audience).Inc()
+	m.tokenExpiry.set(audience, expiry)
+}
+
+// TokenRefreshed implements authclient.TokenObserver.
+func (m *Metrics) TokenRefreshed(audience string) {
+	m.tokensRefreshed.WithLabelValues(audience).Inc()
+}
+
+// TokenError implements authclient.TokenObserver.
+func (m *Metrics) TokenError(audience string, err error) {
+	m.tokenErrors.WithLabelValues(audience).Inc()
+}
+
+// TokenMintLatency implements authclient.TokenLatencyObserver.
+func (m *Metrics) TokenMintLatency(audience string, d time.Duration) {
+	m.tokenMintLatency.WithLabelValues(audience).Observe(d.Seconds())
+}
+
+// TokenStale implements authclient.StaleTokenObserver.
+func (m *Metrics) TokenStale(audience string, stale bool) {
+	v := 0.0
+	if stale {
+		v = 1
+	}
+	m.tokensStale.WithLabelValues(audience).Set(v)
+}
+
+// HTTP3Fallback implements authclient.HTTP3Observer.
+func (m *Metrics) HTTP3Fallback(host string, err error) {
+	m.http3Fallbacks.WithLabelValues(host).Inc()
+}
+
+// RequestDeduplicated implements authclient.DedupObserver.
+func (m *Metrics) RequestDeduplicated(audience string) {
+	m.deduplicated.WithLabelValues(audience).Inc()
+}
+
+// Backpressure implements authclient.BackpressureObserver.
+func (m *Metrics) Backpressure(audience string, status int, retryAfter time.Duration) {
+	m.backpressure.WithLabelValues(audience, strconv.Itoa(status)).Inc()
+}
+
+// WarmPing implements authclient.WarmObserver.
+func (m *Metrics) WarmPing(audience, result string) {
+	m.warmPings.WithLabelValues(audience, result).Inc()
+}
+
+// Retrying implements authclient.RetryObserver.
+func (m *Metrics) Retrying(audience string, attempt, status int) {
+	m.retries.WithLabelValues(audience, strconv.Itoa(status)).Inc()
+}
+
+// RetryBudget implements authclient.LimitObserver.
+func (m *Metrics) RetryBudget(audience string, available float64) {
+	m.retryBudget.WithLabelValues(audience).Set(available)
+}
+
+// RetryDenied implements authclient.LimitObserver.
+func (m *Metrics) RetryDenied(audience string) {
+	m.retriesDenied.WithLabelValues(audience).Inc()
+}
+
+// InFlight implements authclient.LimitObserver.
+func (m *Metrics) InFlight(audience string, n int) {
+	m.inFlight.WithLabelValues(audience).Set(float64(n))
+}
+
+// ConcurrencyLimited implements authclient.LimitObserver.
+func (m *Metrics) ConcurrencyLimited(audience string) {
+	m.concurrencyLimit.WithLabelValues(audience).Inc()
+}
+
+// UploadStarted implements authclient.UploadObserver.
+func (m *Metrics) UploadStarted(audience string, contentLength int64) {
+	m.uploadsInFlight.WithLabelValues(audience).Inc()
+}
+
+// UploadProgress implements authclient.UploadObserver.
+func (m *Metrics) UploadProgress(audience string, n int64) {
+	m.uploadBytes.WithLabelValues(audience).Add(float64(n))
+}
+
+// UploadFinished implements authclient.UploadObserver.
+func (m *Metrics) UploadFinished(audience string, sent int64, err error) {
+	m.uploadsInFlight.WithLabelValues(audience).Dec()
+	result := "complete"
+	if err != nil {
+		result = "failed"
+	}
+	m.uploads.WithLabelValues(audience, result).Inc()
+}
+
+// MultipartPart implements proxy.MultipartObserver.
+func (m *Metrics) MultipartPart(host string, size int64) {
+	m.multipartParts.WithLabelValues(host).Observe(float64(size))
+}
+
+// Gate implements loadshed.Observer.
+func (m *Metrics) Gate(inFlight, queued int) {
+	m.inboundInFlight.Set(float64(inFlight))
+	m.inboundQueued.Set(float64(queued))
+}
+
+// Shed implements loadshed.Observer.
+func (m *Metrics) Shed(reason string) {
+	m.inboundShed.WithLabelValues(reason).Inc()
+}
+
+// Panicked implements recovery.Observer.
+func (m *Metrics) Panicked() {
+	m.panics.Inc()
+}
+
+// Enqueued implements outbox.Observer.
+func (m *Metrics) Enqueued(service string) {
+	m.outboxMessages.WithLabelValues(service, "enqueued").Inc()
+}
+
+// Delivered implements outbox.Observer.
+func (m *Metrics) Delivered(service string) {
+	m.outboxMessages.WithLabelValues(service, "delivered").Inc()
+}
+
+// Retried implements outbox.Observer.
+func (m *Metrics) Retried(service string) {
+	m.outboxMessages.WithLabelValues(service, "retried").Inc()
+}
+
+// DeadLettered implements outbox.Observer.
+func (m *Metrics) DeadLettered(service string) {
+	m.outboxMessages.WithLabelValues(service, "dead_lettered").Inc()
+}
+
+// Replayed implements outbox.Observer.
+func (m *Metrics) Replayed(service string) {
+	m.outboxMessages.WithLabelValues(service, "replayed").Inc()
+}
+
+// expiryCollector reports the time left until each audience's token
+// expires, computed when the metrics are scraped.
+type expiryCollector struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	expiry map[string]time.Time
+}
+
+func newExpiryCollector(desc *prometheus.Desc) *expiryCollector {
+	return &expiryCollector{desc: desc, expiry: make(map[string]time.Time)}
+}
+
+// set records when the token of audience expires. Tokens without an
+// expiry are not reported.
+func (c *expiryCollector) set(audience string, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if expiry.IsZero() {
+		delete(c.expiry, audience)
+		return
+	}
+	c.expiry[audience] = expiry
+}
+
+// Describe implements prometheus.Collector.
+func (c *expiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *expiryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for audience, expiry := range c.expiry {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Until(expiry).Seconds(), audience)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,215 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore is a Store that writes each message to a JSON file in a
+// directory, so that messages survive a restart of the process, and moves
+// dead letters to its dead subdirectory. Claims are only kept in memory:
+// messages whose delivery was interrupted by a crash are delivered again
+// when the store is reopened. A directory must only be used by one process
+// at a time; on Cloud Run, where the file system is in memory, mount a
+// volume such as a Cloud Storage or NFS volume that outlives instances, or
+// use a FirestoreStore.
+type FileStore struct {
+	dir string
+
+	// mu serializes writes so that the files and the index agree.
+	mu    sync.Mutex
+	index *MemoryStore
+}
+
+// OpenFileStore opens the store in dir, creating the directory if needed,
+// and loads the messages it holds.
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "dead"), 0o700); err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	s := &FileStore{dir: dir, index: NewMemoryStore()}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	for _, path := range paths {
+		m, err := read(path)
+		if err != nil {
+			return nil, err
+		}
+		s.index.Put(context.Background(), m)
+	}
+	return s, nil
+}
+
+// Put implements Store.
+func (s *FileStore) Put(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(s.path(m.ID), m); err != nil {
+		return err
+	}
+	return s.index.Put(ctx, m)
+}
+
+// Claim implements Store.
+func (s *FileStore) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Message, error) {
+	return s.index.Claim(ctx, now, lease, limit)
+}
+
+// Retry implements Store.
+func (s *FileStore) Retry(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.path(m.ID)); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err := s.write(s.path(m.ID), m); err != nil {
+		return err
+	}
+	return s.index.Retry(ctx, m)
+}
+
+// Ack implements Store.
+func (s *FileStore) Ack(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return s.index.Ack(ctx, id)
+}
+
+// DeadLetter implements Store.
+func (s *FileStore) DeadLetter(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(s.deadPath(m.ID), m); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(m.ID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return s.index.Ack(ctx, m.ID)
+}
+
+// ListDeadLetters implements DeadLetterStore.
+func (s *FileStore) ListDeadLetters(ctx context.Context, limit int) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(s.dir, "dead", "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	dead := make([]*Message, 0, len(paths))
+	for _, path := range paths {
+		m, err := read(path)
+		if err != nil {
+			return nil, err
+		}
+		dead = append(dead, m)
+	}
+	return newestDeadFirst(dead, limit), nil
+}
+
+// GetDeadLetter implements DeadLetterStore.
+func (s *FileStore) GetDeadLetter(ctx context.Context, id string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return read(s.deadPath(id))
+}
+
+// Requeue implements DeadLetterStore.
+func (s *FileStore) Requeue(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.deadPath(m.ID)); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err := s.write(s.path(m.ID), m); err != nil {
+		return err
+	}
+	if err := os.Remove(s.deadPath(m.ID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return s.index.Put(ctx, m)
+}
+
+// DeleteDeadLetter implements DeadLetterStore.
+func (s *FileStore) DeleteDeadLetter(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.deadPath(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, fileName(id))
+}
+
+func (s *FileStore) deadPath(id string) string {
+	return filepath.Join(s.dir, "dead", fileName(id))
+}
+
+// read returns the message in the file at path, or ErrNotFound.
+func read(path string) (*Message, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("outbox: parsing %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// write replaces the file at path with m, through a temporary file so that
+// a crash never leaves a partial message behind.
+func (s *FileStore) write(path string, m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return nil
+}
+
+// fileName returns the file a message is kept in. IDs are generated by
+// Enqueue, but ones set by callers must not escape the directory.
+func fileName(id string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(id) + ".json"
+}
@@ -0,0 +1,258 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	firestore "google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Fields of a message document. The message itself is stored as JSON, and
+// its due time separately so that due messages can be listed in order.
+const (
+	messageField        = "message"
+	nextAttemptField    = "next_attempt"
+	deadLetteredAtField = "dead_lettered_at"
+)
+
+// FirestoreStore is a Store that keeps messages as documents of a Firestore
+// collection, and dead letters in a second collection named after it with
+// a "-dead-letters" suffix. Several instances can share a collection:
+// claims are made with preconditions on the document update time, so each
+// message is claimed by one instance at a time.
+type FirestoreStore struct {
+	docs       *firestore.ProjectsDatabasesDocumentsService
+	database   string
+	collection string
+}
+
+// NewFirestoreStore returns a FirestoreStore for collection in the default
+// database of project. The caller needs roles/datastore.user.
+func NewFirestoreStore(ctx context.Context, project, collection string, opts ...option.ClientOption) (*FirestoreStore, error) {
+	svc, err := firestore.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("outbox: creating Firestore client: %w", err)
+	}
+	return &FirestoreStore{
+		docs:       svc.Projects.Databases.Documents,
+		database:   "projects/" + project + "/databases/(default)",
+		collection: collection,
+	}, nil
+}
+
+// Put implements Store.
+func (s *FirestoreStore) Put(ctx context.Context, m *Message) error {
+	doc, err := document(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.docs.CreateDocument(s.parent(), s.collection, doc).DocumentId(m.ID).Context(ctx).Do()
+	return wrap(err)
+}
+
+// Claim implements Store. Messages already claimed elsewhere are skipped.
+func (s *FirestoreStore) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Message, error) {
+	list, err := s.docs.List(s.parent(), s.collection).
+		OrderBy(nextAttemptField).
+		PageSize(int64(limit)).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, wrap(err)
+	}
+
+	var claimed []*Message
+	for _, doc := range list.Documents {
+		m, err := message(doc)
+		if err != nil {
+			return claimed, err
+		}
+		if m.NextAttempt.After(now) {
+			break
+		}
+		m.NextAttempt = now.Add(lease)
+		update, err := document(m)
+		if err != nil {
+			return claimed, err
+		}
+		_, err = s.docs.Patch(doc.Name, update).
+			CurrentDocumentUpdateTime(doc.UpdateTime).
+			UpdateMaskFieldPaths(messageField, nextAttemptField).
+			Context(ctx).
+			Do()
+		if isConflict(err) {
+			continue
+		}
+		if err != nil {
+			return claimed, wrap(err)
+		}
+		claimed = append(claimed, m)
+	}
+	return claimed, nil
+}
+
+// Retry implements Store.
+func (s *FirestoreStore) Retry(ctx context.Context, m *Message) error {
+	doc, err := document(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.docs.Patch(s.name(s.collection, m.ID), doc).
+		CurrentDocumentExists(true).
+		UpdateMaskFieldPaths(messageField, nextAttemptField).
+		Context(ctx).
+		Do()
+	if isNotFound(err) {
+		return ErrNotFound
+	}
+	return wrap(err)
+}
+
+// Ack implements Store.
+func (s *FirestoreStore) Ack(ctx context.Context, id string) error {
+	_, err := s.docs.Delete(s.name(s.collection, id)).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil
+	}
+	return wrap(err)
+}
+
+// DeadLetter implements Store. The message is moved in one commit, so it
+// is never in both collections or in neither.
+func (s *FirestoreStore) DeadLetter(ctx context.Context, m *Message) error {
+	doc, err := document(m)
+	if err != nil {
+		return err
+	}
+	doc.Name = s.name(s.deadCollection(), m.ID)
+	_, err = s.docs.Commit(s.database, &firestore.CommitRequest{
+		Writes: []*firestore.Write{
+			{Update: doc},
+			{Delete: s.name(s.collection, m.ID)},
+		},
+	}).Context(ctx).Do()
+	return wrap(err)
+}
+
+// ListDeadLetters implements DeadLetterStore.
+func (s *FirestoreStore) ListDeadLetters(ctx context.Context, limit int) ([]*Message, error) {
+	call := s.docs.List(s.parent(), s.deadCollection()).OrderBy(deadLetteredAtField + " desc")
+	if limit > 0 {
+		call = call.PageSize(int64(limit))
+	}
+	list, err := call.Context(ctx).Do()
+	if err != nil {
+		return nil, wrap(err)
+	}
+	dead := make([]*Message, 0, len(list.Documents))
+	for _, doc := range list.Documents {
+		m, err := message(doc)
+		if err != nil {
+			return nil, err
+		}
+		dead = append(dead, m)
+	}
+	return dead, nil
+}
+
+// GetDeadLetter implements DeadLetterStore.
+func (s *FirestoreStore) GetDeadLetter(ctx context.Context, id string) (*Message, error) {
+	doc, err := s.docs.Get(s.name(s.deadCollection(), id)).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	return message(doc)
+}
+
+// Requeue implements DeadLetterStore. Like DeadLetter, the message is
+// moved in one commit.
+func (s *FirestoreStore) Requeue(ctx context.Context, m *Message) error {
+	doc, err := document(m)
+	if err != nil {
+		return err
+	}
+	doc.Name = s.name(s.collection, m.ID)
+	_, err = s.docs.Commit(s.database, &firestore.CommitRequest{
+		Writes: []*firestore.Write{
+			{Update: doc},
+			{Delete: s.name(s.deadCollection(), m.ID), CurrentDocument: &firestore.Precondition{Exists: true}},
+		},
+	}).Context(ctx).Do()
+	if isNotFound(err) {
+		return ErrNotFound
+	}
+	return wrap(err)
+}
+
+// DeleteDeadLetter implements DeadLetterStore.
+func (s *FirestoreStore) DeleteDeadLetter(ctx context.Context, id string) error {
+	_, err := s.docs.Delete(s.name(s.deadCollection(), id)).CurrentDocumentExists(true).Context(ctx).Do()
+	if isNotFound(err) {
+		return ErrNotFound
+	}
+	return wrap(err)
+}
+
+func (s *FirestoreStore) deadCollection() string {
+	return s.collection + "-dead-letters"
+}
+
+func (s *FirestoreStore) parent() string {
+	return s.database + "/documents"
+}
+
+func (s *FirestoreStore) name(collection, id string) string {
+	return s.parent() + "/" + collection + "/" + id
+}
+
+func document(m *Message) (*firestore.Document, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	fields := map[string]firestore.Value{
+		messageField:     {StringValue: string(data)},
+		nextAttemptField: {TimestampValue: m.NextAttempt.UTC().Format(time.RFC3339Nano)},
+	}
+	if !m.DeadLetteredAt.IsZero() {
+		fields[deadLetteredAtField] = firestore.Value{TimestampValue: m.DeadLetteredAt.UTC().Format(time.RFC3339Nano)}
+	}
+	return &firestore.Document{Fields: fields}, nil
+}
+
+func message(doc *firestore.Document) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal([]byte(doc.Fields[messageField].StringValue), &m); err != nil {
+		return nil, fmt.Errorf("outbox: parsing %s: %w", doc.Name, err)
+	}
+	return &m, nil
+}
+
+// isConflict reports whether err is a failed precondition, meaning that
+// the document changed since it was read.
+func isConflict(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusConflict ||
+		apiErr.Code == http.StatusPreconditionFailed || apiErr.Code == http.StatusBadRequest)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("outbox: %w", err)
+}
@@ -0,0 +1,150 @@
+package outbox
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps messages in memory. Messages are lost
+// when the process exits, so it only suits work that may be dropped on a
+// restart; use a FileStore or FirestoreStore otherwise.
+type MemoryStore struct {
+	mu       sync.Mutex
+	messages map[string]*Message
+	dead     map[string]*Message
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{messages: make(map[string]*Message), dead: make(map[string]*Message)}
+}
+
+// Put implements Store.
+func (s *MemoryStore) Put(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[m.ID] = clone(m)
+	return nil
+}
+
+// Claim implements Store.
+func (s *MemoryStore) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*Message
+	for _, m := range s.messages {
+		if !m.NextAttempt.After(now) {
+			due = append(due, m)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(due[j].NextAttempt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	claimed := make([]*Message, len(due))
+	for i, m := range due {
+		m.NextAttempt = now.Add(lease)
+		claimed[i] = clone(m)
+	}
+	return claimed, nil
+}
+
+// Retry implements Store.
+func (s *MemoryStore) Retry(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.messages[m.ID]; !ok {
+		return ErrNotFound
+	}
+	s.messages[m.ID] = clone(m)
+	return nil
+}
+
+// Ack implements Store.
+func (s *MemoryStore) Ack(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, id)
+	return nil
+}
+
+// DeadLetter implements Store.
+func (s *MemoryStore) DeadLetter(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, m.ID)
+	s.dead[m.ID] = clone(m)
+	return nil
+}
+
+// ListDeadLetters implements DeadLetterStore.
+func (s *MemoryStore) ListDeadLetters(ctx context.Context, limit int) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dead := make([]*Message, 0, len(s.dead))
+	for _, m := range s.dead {
+		dead = append(dead, clone(m))
+	}
+	return newestDeadFirst(dead, limit), nil
+}
+
+// GetDeadLetter implements DeadLetterStore.
+func (s *MemoryStore) GetDeadLetter(ctx context.Context, id string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.dead[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return clone(m), nil
+}
+
+// Requeue implements DeadLetterStore.
+func (s *MemoryStore) Requeue(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dead[m.ID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.dead, m.ID)
+	s.messages[m.ID] = clone(m)
+	return nil
+}
+
+// DeleteDeadLetter implements DeadLetterStore.
+func (s *MemoryStore) DeleteDeadLetter(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dead[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.dead, id)
+	return nil
+}
+
+// Len returns the number of messages waiting to be delivered.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+// newestDeadFirst sorts dead letters by when they were dead-lettered,
+// newest first, and returns at most limit of them.
+func newestDeadFirst(dead []*Message, limit int) []*Message {
+	sort.Slice(dead, func(i, j int) bool { return dead[i].DeadLetteredAt.After(dead[j].DeadLetteredAt) })
+	if limit > 0 && len(dead) > limit {
+		dead = dead[:limit]
+	}
+	return dead
+}
+
+// clone returns a copy of m that can be changed without affecting m. The
+// header and body are shared, since they are never modified.
+func clone(m *Message) *Message {
+	c := *m
+	return &c
+}
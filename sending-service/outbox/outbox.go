@@ -0,0 +1,467 @@
+// Package outbox accepts requests for downstream services, persists them
+// and delivers them asynchronously, retrying failed deliveries with backoff
+// and moving the ones that cannot be delivered to dead letters. Delivery is
+// at least once: a message whose delivery was interrupted, for example by
+// the instance shutting down, is delivered again once its claim expires,
+// so receivers should deduplicate on the Idempotency-Key header.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sender/authclient"
+	"sender/downstream"
+)
+
+// IdempotencyKeyHeader carries the ID of a message on each delivery, which
+// is the same for every attempt.
+const IdempotencyKeyHeader = authclient.IdempotencyKeyHeader
+
+// ErrNotFound is returned by a Store for a message it does not hold.
+var ErrNotFound = errors.New("outbox: message not found")
+
+// Message is a request waiting to be delivered.
+type Message struct {
+	ID string `json:"id"`
+	// Service is the name of the downstream service the request is for.
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	// Path, with its query, is appended to the service URL.
+	Path   string      `json:"path,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	// Attempts counts the deliveries tried so far.
+	Attempts int `json:"attempts"`
+	// NextAttempt is when the message is next due for delivery.
+	NextAttempt time.Time `json:"next_attempt"`
+	// LastError describes why the last delivery failed.
+	LastError string `json:"last_error,omitempty"`
+	// DeadLetteredAt is when the message was given up on, for dead
+	// letters.
+	DeadLetteredAt time.Time `json:"dead_lettered_at,omitempty"`
+}
+
+// Store persists messages until they are delivered. Implementations must be
+// safe for concurrent use.
+type Store interface {
+	// Put saves a new message.
+	Put(ctx context.Context, m *Message) error
+	// Claim returns up to limit messages due at now and makes them due
+	// again only at now+lease, so that no one else delivers them meanwhile
+	// and they are delivered again if their delivery is interrupted.
+	Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Message, error)
+	// Retry saves m after a failed delivery, to be claimed again at
+	// m.NextAttempt.
+	Retry(ctx context.Context, m *Message) error
+	// Ack removes a delivered message.
+	Ack(ctx context.Context, id string) error
+	// DeadLetter moves m, which will not be delivered, out of the queue
+	// into the store's dead letters.
+	DeadLetter(ctx context.Context, m *Message) error
+}
+
+// DeadLetterStore is implemented by stores whose dead letters can be
+// inspected and replayed, as all the stores of this package can.
+type DeadLetterStore interface {
+	// ListDeadLetters returns up to limit dead letters, the most recently
+	// dead-lettered first.
+	ListDeadLetters(ctx context.Context, limit int) ([]*Message, error)
+	// GetDeadLetter returns the dead letter with the given ID, or
+	// ErrNotFound.
+	GetDeadLetter(ctx context.Context, id string) (*Message, error)
+	// Requeue moves m from the dead letters back to the queue, to be
+	// claimed at m.NextAttempt. It returns ErrNotFound if m is not a dead
+	// letter.
+	Requeue(ctx context.Context, m *Message) error
+	// DeleteDeadLetter discards the dead letter with the given ID, or
+	// returns ErrNotFound.
+	DeleteDeadLetter(ctx context.Context, id string) error
+}
+
+// ErrNoDeadLetters is returned for dead letter operations when the store
+// does not implement DeadLetterStore.
+var ErrNoDeadLetters = errors.New("outbox: the store does not keep dead letters")
+
+// Observer is notified of the outcome of each delivery, for example to
+// export metrics.
+type Observer interface {
+	// Enqueued is called when a message for service is accepted.
+	Enqueued(service string)
+	// Delivered is called when a message for service is delivered.
+	Delivered(service string)
+	// Retried is called when a delivery to service failed and will be
+	// tried again.
+	Retried(service string)
+	// DeadLettered is called when a message for service is given up on.
+	DeadLettered(service string)
+	// Replayed is called when a dead letter for service is queued again.
+	Replayed(service string)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) Enqueued(string)     {}
+func (nopObserver) Delivered(string)    {}
+func (nopObserver) Retried(string)      {}
+func (nopObserver) DeadLettered(string) {}
+func (nopObserver) Replayed(string)     {}
+
+// Outbox accepts messages and delivers them to downstream services.
+type Outbox struct {
+	store    Store
+	registry *downstream.Registry
+
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	pollInterval   time.Duration
+	lease          time.Duration
+	batchSize      int
+	logger         *slog.Logger
+	observer       Observer
+
+	// wake starts a poll without waiting for the poll interval.
+	wake chan struct{}
+}
+
+// Option configures an Outbox.
+type Option func(*Outbox)
+
+// WithMaxAttempts sets how many deliveries of a message are tried before it
+// is dead-lettered. It defaults to 10.
+func WithMaxAttempts(n int) Option {
+	return func(o *Outbox) {
+		o.maxAttempts = n
+	}
+}
+
+// WithBackoff sets the delay before the second delivery of a message,
+// which doubles after each further failure up to max. It defaults to 1
+// second, growing to 5 minutes.
+func WithBackoff(initial, max time.Duration) Option {
+	return func(o *Outbox) {
+		o.initialBackoff = initial
+		o.maxBackoff = max
+	}
+}
+
+// WithPollInterval sets how often the store is checked for due messages.
+// It defaults to 1 second.
+func WithPollInterval(d time.Duration) Option {
+	return func(o *Outbox) {
+		o.pollInterval = d
+	}
+}
+
+// WithLease sets how long a claimed message is hidden from other claims.
+// It must exceed the time a delivery can take, or slow deliveries are
+// duplicated. It defaults to 1 minute.
+func WithLease(d time.Duration) Option {
+	return func(o *Outbox) {
+		o.lease = d
+	}
+}
+
+// WithBatchSize sets how many messages are claimed, and delivered
+// concurrently, per poll. It defaults to 10.
+func WithBatchSize(n int) Option {
+	return func(o *Outbox) {
+		o.batchSize = n
+	}
+}
+
+// WithLogger sets the logger deliveries are logged with. It defaults to
+// slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *Outbox) {
+		o.logger = logger
+	}
+}
+
+// WithObserver sets the observer notified of deliveries.
+func WithObserver(obs Observer) Option {
+	return func(o *Outbox) {
+		o.observer = obs
+	}
+}
+
+// New returns an Outbox that keeps messages in store and delivers them
+// with the clients of registry. Call Run to start delivering.
+func New(store Store, registry *downstream.Registry, opts ...Option) *Outbox {
+	o := &Outbox{
+		store:          store,
+		registry:       registry,
+		maxAttempts:    10,
+		initialBackoff: time.Second,
+		maxBackoff:     5 * time.Minute,
+		pollInterval:   time.Second,
+		lease:          time.Minute,
+		batchSize:      10,
+		logger:         slog.Default(),
+		observer:       nopObserver{},
+		wake:           make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Enqueue persists m for delivery, assigning its ID, and returns once it is
+// stored. m.Service must name a registered service.
+func (o *Outbox) Enqueue(ctx context.Context, m *Message) (string, error) {
+	if _, ok := o.registry.Service(m.Service); !ok {
+		return "", errors.New("outbox: unknown service " + strconv.Quote(m.Service))
+	}
+	if m.ID == "" {
+		m.ID = newID()
+	}
+	if m.Method == "" {
+		m.Method = http.MethodPost
+	}
+	now := time.Now()
+	m.CreatedAt = now
+	m.NextAttempt = now
+	if err := o.store.Put(ctx, m); err != nil {
+		return "", err
+	}
+	o.observer.Enqueued(m.Service)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return m.ID, nil
+}
+
+// Run delivers due messages until ctx is done. A batch of deliveries in
+// progress is finished first: deliveries use their own context, so that
+// shutting down does not fail them.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.pollInterval)
+	defer ticker.Stop()
+	for {
+		msgs, err := o.store.Claim(ctx, time.Now(), o.lease, o.batchSize)
+		if err != nil && ctx.Err() == nil {
+			o.logger.Error("Failed to claim outbox messages", slog.Any("error", err))
+		}
+		var wg sync.WaitGroup
+		for _, m := range msgs {
+			wg.Add(1)
+			go func(m *Message) {
+				defer wg.Done()
+				o.deliver(context.WithoutCancel(ctx), m)
+			}(m)
+		}
+		wg.Wait()
+		if len(msgs) == o.batchSize && ctx.Err() == nil {
+			// There may be more due; claim them without waiting.
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// DeadLetters returns up to limit dead letters, the most recently
+// dead-lettered first.
+func (o *Outbox) DeadLetters(ctx context.Context, limit int) ([]*Message, error) {
+	store, ok := o.store.(DeadLetterStore)
+	if !ok {
+		return nil, ErrNoDeadLetters
+	}
+	return store.ListDeadLetters(ctx, limit)
+}
+
+// DeadLetter returns the dead letter with the given ID.
+func (o *Outbox) DeadLetter(ctx context.Context, id string) (*Message, error) {
+	store, ok := o.store.(DeadLetterStore)
+	if !ok {
+		return nil, ErrNoDeadLetters
+	}
+	return store.GetDeadLetter(ctx, id)
+}
+
+// Replay queues the dead letter with the given ID for delivery again, with
+// a fresh allowance of attempts. Its ID is kept, so a receiver that
+// processed an earlier delivery can tell it is a duplicate.
+func (o *Outbox) Replay(ctx context.Context, id string) (*Message, error) {
+	store, ok := o.store.(DeadLetterStore)
+	if !ok {
+		return nil, ErrNoDeadLetters
+	}
+	m, err := store.GetDeadLetter(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	m.Attempts = 0
+	m.NextAttempt = time.Now()
+	m.DeadLetteredAt = time.Time{}
+	if err := store.Requeue(ctx, m); err != nil {
+		return nil, err
+	}
+	o.observer.Replayed(m.Service)
+	o.logger.Info("Replaying dead-lettered outbox message", slog.String("message_id", m.ID), slog.String("service", m.Service))
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return m, nil
+}
+
+// Discard deletes the dead letter with the given ID.
+func (o *Outbox) Discard(ctx context.Context, id string) error {
+	store, ok := o.store.(DeadLetterStore)
+	if !ok {
+		return ErrNoDeadLetters
+	}
+	return store.DeleteDeadLetter(ctx, id)
+}
+
+// deliver sends m, then acknowledges, retries or dead-letters it.
+func (o *Outbox) deliver(ctx context.Context, m *Message) {
+	ctx, cancel := context.WithTimeout(ctx, o.lease)
+	defer cancel()
+
+	m.Attempts++
+	logger := o.logger.With(
+		slog.String("message_id", m.ID),
+		slog.String("service", m.Service),
+		slog.Int("attempt", m.Attempts),
+	)
+
+	resp, err := o.send(ctx, m)
+	if err == nil {
+		if err := o.store.Ack(ctx, m.ID); err != nil {
+			logger.Error("Failed to acknowledge delivered outbox message", slog.Any("error", err))
+		}
+		o.observer.Delivered(m.Service)
+		logger.Info("Delivered outbox message", slog.Duration("age", time.Since(m.CreatedAt)))
+		return
+	}
+
+	m.LastError = err.Error()
+	if !retryable(err) || m.Attempts >= o.maxAttempts {
+		m.DeadLetteredAt = time.Now()
+		if err := o.store.DeadLetter(ctx, m); err != nil {
+			logger.Error("Failed to dead-letter outbox message", slog.Any("error", err))
+			return
+		}
+		o.observer.DeadLettered(m.Service)
+		logger.Error("Dead-lettered outbox message", slog.Any("error", err))
+		return
+	}
+
+	wait := o.backoff(m.Attempts, resp)
+	m.NextAttempt = time.Now().Add(wait)
+	if err := o.store.Retry(ctx, m); err != nil {
+		logger.Error("Failed to reschedule outbox message", slog.Any("error", err))
+		return
+	}
+	o.observer.Retried(m.Service)
+	logger.Warn("Outbox delivery failed, retrying", slog.Any("error", err), slog.Duration("wait", wait))
+}
+
+// send delivers m once. It returns the response for failed deliveries that
+// got one, for its Retry-After header.
+func (o *Outbox) send(ctx context.Context, m *Message) (*http.Response, error) {
+	svc, ok := o.registry.Service(m.Service)
+	if !ok {
+		return nil, errors.New("outbox: unknown service " + strconv.Quote(m.Service))
+	}
+	client, err := o.registry.Client(m.Service)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, m.Method, strings.TrimSuffix(svc.URL, "/")+m.Path, bytes.NewReader(m.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range m.Header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	req.Header.Set(IdempotencyKeyHeader, m.ID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, &authclient.DownstreamStatusError{
+			Code:   resp.StatusCode,
+			Status: resp.Status,
+			Header: resp.Header,
+			Body:   data,
+		}
+	}
+	return nil, nil
+}
+
+// retryable reports whether a delivery that failed with err may succeed
+// later. Client errors other than 401, 403, 408, 409, 425 and 429 are
+// permanent, as is 501; rejections of the token are retried because IAM
+// bindings take minutes to apply.
+func retryable(err error) bool {
+	var statusErr *authclient.DownstreamStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	switch code := statusErr.Code; {
+	case code == http.StatusNotImplemented:
+		return false
+	case code >= 500:
+		return true
+	case code == http.StatusUnauthorized, code == http.StatusForbidden,
+		code == http.StatusRequestTimeout, code == http.StatusConflict,
+		code == http.StatusTooEarly, code == http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before the delivery after attempt, with up to
+// 20% jitter, or longer if the response asked for it with Retry-After.
+func (o *Outbox) backoff(attempt int, resp *http.Response) time.Duration {
+	d := float64(o.initialBackoff)
+	for i := 1; i < attempt && time.Duration(d) < o.maxBackoff; i++ {
+		d *= 2
+	}
+	d += d * 0.2 * (2*mathrand.Float64() - 1)
+	wait := time.Duration(d)
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(secs)*time.Second > wait {
+			wait = time.Duration(secs) * time.Second
+		}
+	}
+	if o.maxBackoff > 0 && wait > o.maxBackoff {
+		wait = o.maxBackoff
+	}
+	return wait
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,247 @@
+// Package profiler profiles the sending service in production: it serves
+// the net/http/pprof endpoints, and runs a Cloud Profiler agent that
+// collects CPU, heap and goroutine profiles when Cloud Profiler asks for
+// them, so that the overhead of minting tokens and proxying can be seen
+// across instances over time.
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"regexp"
+	rpprof "runtime/pprof"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"google.golang.org/api/cloudprofiler/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Profile types the agent collects.
+const (
+	typeCPU     = "CPU"
+	typeHeap    = "HEAP"
+	typeThreads = "THREADS"
+)
+
+// Backoff of failed requests to Cloud Profiler, when it does not say how
+// long to wait itself.
+const (
+	minBackoff = time.Minute
+	maxBackoff = time.Hour
+)
+
+// uploadTimeout bounds the upload of one profile.
+const uploadTimeout = time.Minute
+
+// targetPattern is what Cloud Profiler accepts as a target.
+var targetPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9_.]{0,253}[a-z0-9])?$`)
+
+// Handler serves the net/http/pprof endpoints under /debug/pprof/. They
+// reveal the service's internals and a CPU profile slows it down while it
+// runs, so only serve them to operators.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Agent uploads profiles to Cloud Profiler. Cloud Profiler picks which
+// instance collects which kind of profile, about one a minute across the
+// deployment, so the overhead on each instance stays small.
+//
+// Uploading needs roles/cloudprofiler.agent on the project.
+type Agent struct {
+	profiles   *cloudprofiler.ProjectsProfilesService
+	project    string
+	deployment *cloudprofiler.Deployment
+	logger     *slog.Logger
+}
+
+// Option configures an Agent.
+type Option func(*Agent)
+
+// WithTarget sets the name profiles are grouped by in Cloud Profiler, and
+// their version. They default to the K_SERVICE and K_REVISION environment
+// variables.
+func WithTarget(service, version string) Option {
+	return func(a *Agent) {
+		a.deployment.Target = service
+		if version != "" {
+			a.deployment.Labels["version"] = version
+		}
+	}
+}
+
+// WithLogger sets the logger failed collections and uploads are logged
+// to.
+func WithLogger(logger *slog.Logger) Option {
+	return func(a *Agent) {
+		a.logger = logger
+	}
+}
+
+// New creates an Agent that uploads profiles to project, with a Cloud
+// Profiler client created with clientOpts.
+func New(ctx context.Context, project string, clientOpts []option.ClientOption, opts ...Option) (*Agent, error) {
+	if project == "" {
+		return nil, errors.New("profiler: a project is required")
+	}
+	svc, err := cloudprofiler.NewService(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("profiler: failed to create Cloud Profiler client: %w", err)
+	}
+	a := &Agent{
+		profiles: svc.Projects.Profiles,
+		project:  project,
+		deployment: &cloudprofiler.Deployment{
+			ProjectId: project,
+			Target:    os.Getenv("K_SERVICE"),
+			Labels:    map[string]string{"language": "go"},
+		},
+		logger: slog.Default(),
+	}
+	if v := os.Getenv("K_REVISION"); v != "" {
+		a.deployment.Labels["version"] = v
+	}
+	if metadata.OnGCE() {
+		if zone, err := metadata.Zone(); err == nil {
+			a.deployment.Labels["zone"] = zone
+		}
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.deployment.Target == "" {
+		a.deployment.Target = "sending-service"
+	}
+	if !targetPattern.MatchString(a.deployment.Target) {
+		return nil, fmt.Errorf("profiler: %q is not a Cloud Profiler target", a.deployment.Target)
+	}
+	return a, nil
+}
+
+// Run collects and uploads the profiles Cloud Profiler asks for until stop
+// is closed. Failed requests are retried with backoff, and logged.
+func (a *Agent) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	backoff := minBackoff
+	for ctx.Err() == nil {
+		wait, err := a.profileOnce(ctx)
+		if err == nil {
+			backoff = minBackoff
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff = min(backoff*2, maxBackoff)
+			a.logger.Warn("Cloud Profiler request failed", slog.Any("error", err), slog.Duration("retry_in", wait))
+		} else {
+			a.logger.Debug("Cloud Profiler wants no profile for now", slog.Duration("retry_in", wait))
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// profileOnce waits until Cloud Profiler asks for a profile, then collects
+// and uploads it. On failure it returns how long Cloud Profiler asked to
+// wait before trying again, if it did.
+func (a *Agent) profileOnce(ctx context.Context) (time.Duration, error) {
+	// Cloud Profiler holds the request open until a profile is wanted.
+	profile, err := a.profiles.Create("projects/"+a.project, &cloudprofiler.CreateProfileRequest{
+		Deployment:  a.deployment,
+		ProfileType: []string{typeCPU, typeHeap, typeThreads},
+	}).Context(ctx).Do()
+	if err != nil {
+		return retryDelay(err), err
+	}
+	data, err := collect(ctx, profile)
+	if err != nil {
+		return 0, fmt.Errorf("profiler: failed to collect %s profile: %w", profile.ProfileType, err)
+	}
+	profile.ProfileBytes = base64.StdEncoding.EncodeToString(data)
+	uploadCtx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	if _, err := a.profiles.Patch(profile.Name, profile).Context(uploadCtx).Do(); err != nil {
+		return 0, fmt.Errorf("profiler: failed to upload %s profile: %w", profile.ProfileType, err)
+	}
+	a.logger.Debug("Uploaded profile", slog.String("type", profile.ProfileType))
+	return 0, nil
+}
+
+// collect returns the gzipped pprof profile Cloud Profiler asked for.
+func collect(ctx context.Context, profile *cloudprofiler.Profile) ([]byte, error) {
+	var buf bytes.Buffer
+	switch profile.ProfileType {
+	case typeCPU:
+		d, err := time.ParseDuration(profile.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q", profile.Duration)
+		}
+		// This fails while a CPU profile is served on /debug/pprof/profile.
+		if err := rpprof.StartCPUProfile(&buf); err != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+		}
+		rpprof.StopCPUProfile()
+	case typeHeap:
+		if err := rpprof.Lookup("heap").WriteTo(&buf, 0); err != nil {
+			return nil, err
+		}
+	case typeThreads:
+		if err := rpprof.Lookup("goroutine").WriteTo(&buf, 0); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported profile type")
+	}
+	return buf.Bytes(), nil
+}
+
+// retryDelay returns the delay Cloud Profiler asks for in the RetryInfo
+// of err, or 0. It answers 409 Conflict with one when no profile is
+// wanted from this instance for a while.
+func retryDelay(err error) time.Duration {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return 0
+	}
+	for _, detail := range gerr.Details {
+		m, ok := detail.(map[string]any)
+		if !ok || m["@type"] != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+		if s, ok := m["retryDelay"].(string); ok {
+			if d, err := time.ParseDuration(s); err == nil {
+				return d
+			}
+		}
+	}
+	return 0
+}
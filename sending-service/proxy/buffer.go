@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+// bufferSize is the size of the buffers response bodies are copied with,
+// the same as io.Copy uses.
+const bufferSize = 32 << 10
+
+// Buffers is a pool of the buffers response bodies are copied through. It
+// implements httputil.BufferPool. Sharing them saves allocating a buffer
+// per response, since the writers handlers get are wrapped by middleware
+// and so do not offer the server's own pooled io.ReaderFrom.
+var Buffers bufferPool
+
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// Get returns a buffer of bufferSize bytes.
+func (p *bufferPool) Get() []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, bufferSize)
+}
+
+// Put returns b to the pool. Buffers of another size are dropped.
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) != bufferSize {
+		return
+	}
+	b = b[:bufferSize]
+	p.pool.Put(&b)
+}
+
+// Copy is io.Copy with a buffer from Buffers.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := Buffers.Get()
+	defer Buffers.Put(buf)
+	return io.CopyBuffer(dst, src, buf)
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"sender/authclient"
+)
+
+// bodySize is the size of the response bodies copied and forwarded.
+const bodySize = 1 << 20
+
+// writerOnly hides the io.ReaderFrom of the writer it wraps, as the
+// middleware wrapping handlers' writers does.
+type writerOnly struct {
+	io.Writer
+}
+
+// BenchmarkCopy compares copying a body through a pooled buffer with
+// io.Copy, which allocates one per call when neither side helps.
+func BenchmarkCopy(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), bodySize)
+	for _, bm := range []struct {
+		name string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		{"Pooled", Copy},
+		{"Unpooled", io.Copy},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(bodySize)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := bm.copy(writerOnly{io.Discard}, struct{ io.Reader }{bytes.NewReader(body)}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkProxy measures forwarding a request and its response through
+// the reverse proxy.
+func BenchmarkProxy(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), bodySize)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	tokens := func(context.Context, string) (oauth2.TokenSource, error) {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}), nil
+	}
+	client, err := authclient.New(context.Background(), backend.URL,
+		authclient.WithTokenSourceFunc(tokens),
+		authclient.WithTransport(backend.Client().Transport))
+	if err != nil {
+		b.Fatal(err)
+	}
+	rp := New(target, client)
+	b.ReportAllocs()
+	b.SetBytes(bodySize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() != bodySize {
+			b.Fatalf("got %d with %d bytes", rec.Code, rec.Body.Len())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"sender/logging"
+)
+
+// hopByHopHeaders apply to a single connection and are never returned to
+// the caller, along with the headers named in Connection.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HeaderRules select the headers of downstream responses that are returned
+// to the caller. Names are matched case-insensitively, and a name ending in
+// * matches every header starting with the rest, such as X-Goog-*.
+// Hop-by-hop headers and X-Request-Id, which the sending service sets
+// itself, are never returned.
+type HeaderRules struct {
+	// Allow lists the headers returned. If empty, every header not in Deny
+	// is returned.
+	Allow []string
+	// Deny lists headers that are not returned even if allowed, such as
+	// Server or Set-Cookie.
+	Deny []string
+}
+
+// IsZero reports whether r has no rules, in which case each handler keeps
+// its own default.
+func (r HeaderRules) IsZero() bool {
+	return len(r.Allow) == 0 && len(r.Deny) == 0
+}
+
+// Validate checks that every rule is a header name, optionally ending in *.
+func (r HeaderRules) Validate() error {
+	for _, list := range [][]string{r.Allow, r.Deny} {
+		for _, p := range list {
+			if !validHeaderName(strings.TrimSuffix(p, "*")) {
+				return fmt.Errorf("proxy: %q is not a header name", p)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether the header name may be returned to the caller.
+func (r HeaderRules) Allowed(name string) bool {
+	if len(r.Allow) > 0 && !matchAny(r.Allow, name) {
+		return false
+	}
+	return !matchAny(r.Deny, name)
+}
+
+// Filter removes from h the hop-by-hop headers and those r does not allow.
+func (r HeaderRules) Filter(h http.Header) {
+	removeHopByHop(h)
+	h.Del(logging.RequestIDHeader)
+	for name := range h {
+		if !r.Allowed(name) {
+			delete(h, name)
+		}
+	}
+}
+
+// Copy adds the headers of src that Filter would keep to dst.
+func (r HeaderRules) Copy(dst, src http.Header) {
+	h := src.Clone()
+	r.Filter(h)
+	for name, values := range h {
+		dst[name] = append(dst[name], values...)
+	}
+}
+
+// WithResponseHeaders returns to the caller only the response headers
+// rules allow. By default every header other than the hop-by-hop ones is
+// returned.
+func WithResponseHeaders(rules HeaderRules) Option {
+	return func(o *options) {
+		o.headers = rules
+	}
+}
+
+func removeHopByHop(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// validHeaderName reports whether name is an HTTP token, as header names
+// must be.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"sender/apierror"
+)
+
+// MultipartObserver is told about each part of the multipart/form-data
+// requests forwarded to host, for example to export metrics.
+type MultipartObserver interface {
+	MultipartPart(host string, size int64)
+}
+
+// MultipartSettings configures the inspection of forwarded
+// multipart/form-data bodies.
+type MultipartSettings struct {
+	// MaxPartSize is the largest part, in bytes, such as an uploaded
+	// file. Zero means no limit beyond that of the whole body.
+	MaxPartSize int64
+	// MaxParts is the largest number of parts. Zero means no limit.
+	MaxParts int
+	// Observer, if set, is told about each part.
+	Observer MultipartObserver
+}
+
+// MultipartError is returned by reads of a multipart/form-data body that
+// breaks the limits of its MultipartSettings or is malformed. The request
+// it belongs to is answered with the error's APIError.
+type MultipartError struct {
+	// Reason says what is wrong with the body.
+	Reason string
+	// TooLarge is set when the body broke a limit, rather than being
+	// malformed.
+	TooLarge bool
+}
+
+func (e *MultipartError) Error() string {
+	return "proxy: multipart body " + e.Reason
+}
+
+// APIError returns the error response for the request: 413 for a body
+// over a limit, and 400 for a malformed one.
+func (e *MultipartError) APIError() *apierror.Error {
+	if e.TooLarge {
+		return apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Multipart request "+e.Reason)
+	}
+	return apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "Multipart request "+e.Reason)
+}
+
+// WithMultipart inspects the bodies of multipart/form-data requests as
+// they are forwarded, as InspectMultipart describes.
+func WithMultipart(s MultipartSettings) Option {
+	return func(o *options) {
+		o.multipart = &s
+	}
+}
+
+// InspectMultipart lets the body of r, if it is multipart/form-data, be
+// streamed to host unchanged, boundary and Content-Type included, while
+// the parts are counted and measured as they pass. Reading a part larger
+// than s.MaxPartSize, more than s.MaxParts parts, or a body that is not
+// valid multipart fails the read with a *MultipartError, which aborts the
+// downstream request. Other bodies are left alone.
+func InspectMultipart(r *http.Request, host string, s MultipartSettings) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return
+	}
+	if params["boundary"] == "" {
+		r.Body = &multipartBody{src: r.Body, err: &MultipartError{Reason: "has no boundary"}}
+		return
+	}
+	pr, pw := io.Pipe()
+	b := &multipartBody{src: r.Body, pw: pw, done: make(chan struct{})}
+	go b.inspect(multipart.NewReader(pr, params["boundary"]), pr, host, s)
+	r.Body = b
+}
+
+// multipartBody passes the bytes read from src on to a multipart parser
+// through pw, and fails once the parser has.
+type multipartBody struct {
+	src  io.ReadCloser
+	pw   *io.PipeWriter
+	done chan struct{}
+	// err is the parser's error, set before done is closed.
+	err error
+}
+
+func (b *multipartBody) Read(p []byte) (int, error) {
+	if b.pw == nil {
+		return 0, b.err
+	}
+	n, err := b.src.Read(p)
+	if n > 0 {
+		if _, werr := b.pw.Write(p[:n]); werr != nil {
+			<-b.done
+			return 0, b.err
+		}
+	}
+	if err == io.EOF {
+		// Wait for the parser to see the end, so that a body cut short
+		// is not taken for a complete one.
+		b.pw.Close()
+		<-b.done
+		if b.err != nil {
+			return n, b.err
+		}
+	} else if err != nil {
+		b.pw.CloseWithError(err)
+	}
+	return n, err
+}
+
+func (b *multipartBody) Close() error {
+	if b.pw != nil {
+		b.pw.CloseWithError(io.ErrClosedPipe)
+	}
+	return b.src.Close()
+}
+
+func (b *multipartBody) inspect(mr *multipart.Reader, pr *io.PipeReader, host string, s MultipartSettings) {
+	err := inspectParts(mr, host, s)
+	if err == nil {
+		// Drain the epilogue after the closing boundary.
+		_, err = io.Copy(io.Discard, pr)
+	}
+	var mpErr *MultipartError
+	if err != nil && !errors.As(err, &mpErr) && !errors.Is(err, io.ErrClosedPipe) {
+		mpErr = &MultipartError{Reason: "is malformed"}
+	}
+	if mpErr != nil {
+		b.err = mpErr
+	} else if err != nil {
+		b.err = err
+	}
+	pr.CloseWithError(b.err)
+	close(b.done)
+}
+
+func inspectParts(mr *multipart.Reader, host string, s MultipartSettings) error {
+	for parts := 1; ; parts++ {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if s.MaxParts > 0 && parts > s.MaxParts {
+			return &MultipartError{Reason: fmt.Sprintf("has more than %d parts", s.MaxParts), TooLarge: true}
+		}
+		limit := s.MaxPartSize
+		var size int64
+		if limit > 0 {
+			size, err = io.Copy(io.Discard, io.LimitReader(part, limit+1))
+		} else {
+			size, err = io.Copy(io.Discard, part)
+		}
+		if err != nil {
+			return err
+		}
+		if limit > 0 && size > limit {
+			return &MultipartError{Reason: fmt.Sprintf("has a part over %d bytes", limit), TooLarge: true}
+		}
+		if s.Observer != nil {
+			s.Observer.MultipartPart(host, size)
+		}
+	}
+}
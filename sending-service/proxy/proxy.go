@@ -0,0 +1,124 @@
+// Package proxy forwards inbound requests to a downstream service with an
+// ID token attached, turning the sending service into an authenticated
+// gateway.
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/logging"
+)
+
+// Option configures a proxy.
+type Option func(*options)
+
+type options struct {
+	before     []authclient.RequestHook
+	after      []authclient.ResponseHook
+	decompress bool
+	headers    HeaderRules
+	multipart  *MultipartSettings
+}
+
+// WithDecompression decodes gzip and deflate responses before they are
+// returned to the caller, and before response hooks see them. By default
+// responses are passed through as the receiving service encoded them for
+// the Accept-Encoding the caller sent, even if the client was created
+// with authclient.WithResponseDecompression.
+func WithDecompression() Option {
+	return func(o *options) {
+		o.decompress = true
+	}
+}
+
+// WithRequestHooks calls hooks, in order, with each request after it has
+// been prepared for target, with hop-by-hop headers removed and the path
+// and Host header rewritten, and before it is sent with the client. A hook
+// that fails rejects the request with the status of its
+// *authclient.HookError, or 502 Bad Gateway.
+func WithRequestHooks(hooks ...authclient.RequestHook) Option {
+	return func(o *options) {
+		o.before = append(o.before, hooks...)
+	}
+}
+
+// WithResponseHooks calls hooks, in order, with each response from target
+// before it is returned to the caller. A hook that fails answers the
+// request as for WithRequestHooks instead.
+func WithResponseHooks(hooks ...authclient.ResponseHook) Option {
+	return func(o *options) {
+		o.after = append(o.after, hooks...)
+	}
+}
+
+// New returns a reverse proxy that forwards the method, path, query string,
+// headers and body of each inbound request to target using client. Paths
+// are appended to the path of target, and the Host header is rewritten to
+// target's host as Cloud Run requires.
+func New(target *url.URL, client *authclient.Client, opts ...Option) *httputil.ReverseProxy {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.BufferPool = &Buffers
+
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		r.Host = target.Host
+		if o.multipart != nil {
+			InspectMultipart(r, target.Host, *o.multipart)
+		}
+	}
+	transport := client.HTTPClient().Transport
+	if o.decompress {
+		transport = authclient.DecompressMiddleware()(transport)
+	} else {
+		transport = passThroughTransport{next: transport}
+	}
+	rp.Transport = authclient.HookMiddleware(o.before, o.after)(transport)
+	rp.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// The upgrade needs its hop-by-hop headers. The sending
+			// service returns the request ID itself.
+			resp.Header.Del(logging.RequestIDHeader)
+			return nil
+		}
+		o.headers.Filter(resp.Header)
+		return nil
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logger := logging.FromContext(r.Context())
+		switch {
+		case errors.Is(err, authclient.ErrCircuitOpen):
+			logger.Warn("Circuit breaker open, failing fast", slog.Any("error", err))
+		case errors.Is(err, authclient.ErrConcurrencyLimit):
+			logger.Warn("Concurrency limit reached, failing fast", slog.Any("error", err))
+		case errors.As(err, new(*authclient.HookError)):
+			logger.Warn("Hook rejected proxied request", slog.Any("error", err))
+		case errors.As(err, new(*MultipartError)):
+			logger.Warn("Rejected multipart request body", slog.Any("error", err))
+		default:
+			logger.Error("Failed to proxy request", slog.Any("error", err))
+		}
+		apierror.Write(w, r, apierror.FromDownstream(err))
+	}
+	return rp
+}
+
+// passThroughTransport keeps responses encoded as the receiving service
+// sent them.
+type passThroughTransport struct {
+	next http.RoundTripper
+}
+
+func (t passThroughTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(authclient.PassThroughEncoding(req.Context())))
+}
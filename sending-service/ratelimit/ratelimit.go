@@ -0,0 +1,126 @@
+// Package ratelimit provides token-bucket rate limiting middleware for the
+// sending service, protecting downstream services from bursts of inbound
+// traffic.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"sender/apierror"
+)
+
+// idleTimeout is how long a per-client bucket is kept after its last use.
+const idleTimeout = 3 * time.Minute
+
+// Limiter limits the rate of inbound requests, either globally or per
+// client IP address.
+type Limiter struct {
+	limit     rate.Limit
+	burst     int
+	perClient bool
+
+	global *rate.Limiter
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// New creates a Limiter that allows rps requests per second with bursts of
+// up to burst requests. With perClient set, each client IP address gets its
+// own bucket; otherwise all requests share one.
+func New(rps float64, burst int, perClient bool) *Limiter {
+	l := &Limiter{
+		limit:     rate.Limit(rps),
+		burst:     burst,
+		perClient: perClient,
+		clients:   make(map[string]*client),
+		lastSweep: time.Now(),
+	}
+	if !perClient {
+		l.global = rate.NewLimiter(l.limit, burst)
+	}
+	return l
+}
+
+// Middleware rejects requests over the limit with 429 Too Many Requests.
+// Every response carries RateLimit-Limit and RateLimit-Remaining headers,
+// and rejected ones a Retry-After header.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lim := l.limiterFor(r)
+		now := time.Now()
+
+		res := lim.ReserveN(now, 1)
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(l.burst))
+
+		if delay := res.DelayFrom(now); !res.OK() || delay > 0 {
+			res.CancelAt(now)
+			h.Set("RateLimit-Remaining", "0")
+			e := apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many requests")
+			e.RetryAfter = delay
+			apierror.Write(w, r, e)
+			return
+		}
+
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, lim.TokensAt(now)))))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *Limiter) limiterFor(r *http.Request) *rate.Limiter {
+	if !l.perClient {
+		return l.global
+	}
+
+	ip := clientIP(r)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > idleTimeout {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) > idleTimeout {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &client{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
+
+// clientIP returns the address of the original client. Cloud Run's front
+// end puts it first in X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		first, _, _ := strings.Cut(xff, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,17 @@
+// Package receiverclient is a typed client for the receiving service,
+// generated from its OpenAPI spec, receiving-service/openapi.yaml. Its
+// methods send calls with an authclient.Client, so they carry ID tokens
+// and follow the client's retries, timeouts and circuit breaker, and
+// return the decoded responses, or a *authclient.DownstreamStatusError
+// for statuses other than 2xx.
+//
+//	client, err := authclient.New(ctx, receivingServiceURL)
+//	if err != nil {
+//		return err
+//	}
+//	job, err := receiverclient.New(client).StartJob(ctx, "", "")
+//
+// Run go generate after changing the spec.
+package receiverclient
+
+//go:generate go run ../cmd/openapigen -spec ../../receiving-service/openapi.yaml -package receiverclient -out client.go
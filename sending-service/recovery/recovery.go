@@ -0,0 +1,108 @@
+// Package recovery recovers panics in the sending service's handlers,
+// reporting them to Error Reporting through the request's log and
+// answering 500 in place of the connection the handler would have dropped.
+package recovery
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"sender/apierror"
+	"sender/logging"
+)
+
+// reportedErrorEvent is the type that makes Error Reporting pick up a log
+// entry whose message is a stack trace, whatever its severity.
+const reportedErrorEvent = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+
+// Observer is notified of recovered panics, for example to export
+// metrics.
+type Observer interface {
+	Panicked()
+}
+
+// Middleware returns HTTP middleware that recovers panics in next. Each
+// panic is logged at error level with the request logger, as an Error
+// Reporting event carrying the stack trace, the request and service and
+// version as its service context, obs is notified if it isn't nil, and
+// the caller gets 500 with the code internal unless the response was
+// already started. Panics with http.ErrAbortHandler, which abort a
+// response on purpose, are passed on.
+func Middleware(service, version string, obs Observer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &responseRecorder{ResponseWriter: w}
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+					panic(v)
+				}
+				logging.FromContext(r.Context()).Error(fmt.Sprintf("panic: %v\n\n%s", v, debug.Stack()),
+					slog.String("@type", reportedErrorEvent),
+					slog.Group("serviceContext",
+						slog.String("service", service),
+						slog.String("version", version),
+					),
+					slog.Group("context",
+						slog.Group("httpRequest",
+							slog.String("method", r.Method),
+							slog.String("url", r.URL.String()),
+							slog.String("userAgent", r.UserAgent()),
+							slog.String("remoteIp", r.RemoteAddr),
+						),
+					),
+				)
+				if obs != nil {
+					obs.Panicked()
+				}
+				if !rec.started {
+					apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Internal server error"))
+				}
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// responseRecorder records whether a response was started, after which
+// no error response can be sent.
+type responseRecorder struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.started = true
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.started = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Flush() {
+	r.started = true
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket connections be proxied through the middleware.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.started = true
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
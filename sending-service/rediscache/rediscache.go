@@ -0,0 +1,66 @@
+// Package rediscache stores cached downstream responses and ID tokens in
+// Redis, for example Memorystore, so that every instance of the sending
+// service shares one cache.
+package rediscache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store is an authclient.ResponseStore backed by Redis.
+type Store struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// New creates a Store that keeps its entries in client under keys starting
+// with prefix.
+func New(client redis.UniversalClient, prefix string) *Store {
+	return &Store{client: client, prefix: prefix}
+}
+
+// Get implements authclient.ResponseStore.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	data, err := s.client.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// Set implements authclient.ResponseStore.
+func (s *Store) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+// Purge implements authclient.ResponsePurger, deleting every cached
+// response under the Store's prefix. The keys of authclient responses
+// start with "authclient:", so tokens kept under the same prefix by a
+// TokenStore are not deleted.
+func (s *Store) Purge(ctx context.Context) error {
+	iter := s.client.Scan(ctx, 0, s.prefix+"authclient:*", 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 100 {
+			if err := s.client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return s.client.Del(ctx, keys...).Err()
+	}
+	return nil
+}
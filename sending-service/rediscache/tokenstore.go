@@ -0,0 +1,68 @@
+package rediscache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// TokenStore is an authclient.TokenStore backed by Redis, so that every
+// instance of the sending service uses the same ID token for an audience.
+type TokenStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewTokenStore creates a TokenStore that keeps tokens in client under keys
+// starting with prefix followed by "token:" and the audience.
+func NewTokenStore(client redis.UniversalClient, prefix string) *TokenStore {
+	return &TokenStore{client: client, prefix: prefix}
+}
+
+type storedToken struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+func (s *TokenStore) key(audience string) string {
+	return s.prefix + "token:" + audience
+}
+
+// GetToken implements authclient.TokenStore.
+func (s *TokenStore) GetToken(ctx context.Context, audience string) (*oauth2.Token, bool, error) {
+	data, err := s.client.Get(ctx, s.key(audience)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var st storedToken
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, false, err
+	}
+	return &oauth2.Token{AccessToken: st.Token, Expiry: st.Expiry}, true, nil
+}
+
+// SetToken implements authclient.TokenStore. The token is kept until it
+// expires; tokens without an expiry are not stored.
+func (s *TokenStore) SetToken(ctx context.Context, audience string, tok *oauth2.Token) error {
+	ttl := time.Until(tok.Expiry)
+	if tok.Expiry.IsZero() || ttl <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(storedToken{Token: tok.AccessToken, Expiry: tok.Expiry})
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.key(audience), data, ttl).Err()
+}
+
+// DeleteToken implements authclient.TokenStore.
+func (s *TokenStore) DeleteToken(ctx context.Context, audience string) error {
+	return s.client.Del(ctx, s.key(audience)).Err()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/downstream"
+	"sender/logging"
+	"sender/proxy"
+)
+
+const relayPrefix = "Response from receiving service: "
+
+// targetAudienceHeader lets a caller pick the downstream service by the
+// audience of its ID tokens.
+const targetAudienceHeader = "X-Target-Audience"
+
+// relay returns a handler that relays to the named downstream service, or
+// to the configured service whose audience is given in the
+// X-Target-Audience header. Unknown audiences are rejected.
+func relay(registry *downstream.Registry, name string, maxSize int64, headers proxy.HeaderRules, multipart proxy.MultipartSettings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := name
+		if audience := r.Header.Get(targetAudienceHeader); audience != "" {
+			var ok bool
+			if target, ok = registry.NameForAudience(audience); !ok {
+				logging.FromContext(r.Context()).Warn("Rejected unknown target audience", slog.String("audience", audience))
+				apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodeAudienceNotAllowed, "Target audience is not a configured downstream service"))
+				return
+			}
+		}
+		relayTo(w, r, registry, target, maxSize, headers, multipart)
+	}
+}
+
+// call returns a handler for /call/{service} that relays to the named
+// downstream service.
+func call(registry *downstream.Registry, maxSize int64, headers proxy.HeaderRules, multipart proxy.MultipartSettings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/call/")
+		if _, ok := registry.Service(name); !ok {
+			apierror.Write(w, r, apierror.New(http.StatusNotFound, apierror.CodeUnknownService, "Unknown downstream service"))
+			return
+		}
+		relayTo(w, r, registry, name, maxSize, headers, multipart)
+	}
+}
+
+// relayTo calls the root of the named downstream service, with the method,
+// body and Content-Type of a request that has a body other than a GET or
+// HEAD, such as a multipart/form-data upload inspected as multipart
+// describes, and with GET otherwise. It streams the response
+// body back after a short prefix, with the downstream status code
+// and content type, or the response headers headers allow if it has rules.
+// Services configured for pass-through get no prefix and keep every header
+// headers allow, so the caller sees the response as the service sent it.
+// Responses larger than maxSize bytes are rejected; a maxSize of 0 disables
+// the limit. Responses from services configured to
+// stream are passed through as they arrive instead, and WebSocket
+// handshakes are proxied. Services configured with a keep-alive may be
+// answered with 200 OK before they respond, as keepAlive describes.
+func relayTo(w http.ResponseWriter, r *http.Request, registry *downstream.Registry, name string, maxSize int64, headers proxy.HeaderRules, multipart proxy.MultipartSettings) {
+	ctx := authclient.ForwardAuthorization(r.Context(), r.Header.Get("Authorization"))
+	logger := logging.FromContext(ctx).With(slog.String("service", name))
+
+	svc, _ := registry.Service(name)
+	if svc.Stream {
+		ctx = authclient.Streaming(ctx)
+	}
+	if !svc.LongRunning.IsZero() {
+		ctx = authclient.CallContext(ctx, svc.LongRunning.CallOptions()...)
+	}
+	client, err := registry.Client(name)
+	if err != nil {
+		logger.Error("Failed to create authenticated client", slog.Any("error", err))
+		apierror.Write(w, r, apierror.FromDownstream(err))
+		return
+	}
+	if isWebSocket(r) {
+		relayWebSocket(w, r, svc, client, logger)
+		return
+	}
+
+	method, upload := http.MethodGet, io.Reader(nil)
+	if r.Body != nil && r.Body != http.NoBody && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		method, upload = r.Method, r.Body
+	}
+	req, err := http.NewRequestWithContext(ctx, method, svc.URL, upload)
+	if err != nil {
+		logger.Error("Failed to create request", slog.Any("error", err))
+		apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Failed to create request"))
+		return
+	}
+	if upload != nil {
+		req.ContentLength = r.ContentLength
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			req.Header.Set("Content-Type", ct)
+		}
+		proxy.InspectMultipart(req, req.URL.Host, multipart)
+	}
+
+	prefix := relayPrefix
+	if svc.PassThrough {
+		prefix = ""
+	}
+	var resp *http.Response
+	if lr := svc.LongRunning; lr.KeepAlive > 0 && !svc.Stream {
+		var answered bool
+		resp, answered, err = keepAlive(w, client, req, lr.KeepAlive)
+		if answered {
+			finishKeepAlive(w, r, resp, err, prefix, maxSize, logger)
+			return
+		}
+	} else {
+		resp, err = client.Do(req)
+	}
+	switch {
+	case errors.Is(err, authclient.ErrCircuitOpen):
+		logger.Warn("Circuit breaker open, failing fast", slog.Any("error", err))
+		apierror.Write(w, r, apierror.FromDownstream(err))
+		return
+	case errors.Is(err, authclient.ErrConcurrencyLimit):
+		logger.Warn("Concurrency limit reached, failing fast", slog.Any("error", err))
+		apierror.Write(w, r, apierror.FromDownstream(err))
+		return
+	case errors.As(err, new(*proxy.MultipartError)):
+		logger.Warn("Rejected multipart request body", slog.Any("error", err))
+		apierror.Write(w, r, apierror.FromDownstream(err))
+		return
+	case err != nil:
+		logger.Error("Failed to make request", slog.Any("error", err))
+		apierror.Write(w, r, apierror.FromDownstream(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if svc.Stream {
+		streamResponse(w, resp, headers, svc.PassThrough, logger)
+		return
+	}
+
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		logger.Error("Response body too large",
+			slog.Int64("content_length", resp.ContentLength),
+			slog.Int64("max_size", maxSize),
+		)
+		e := apierror.New(http.StatusBadGateway, apierror.CodeResponseTooLarge, "Response from receiving service is too large")
+		e.DownstreamStatus = resp.StatusCode
+		apierror.Write(w, r, e)
+		return
+	}
+
+	if headers.IsZero() && !svc.PassThrough {
+		if ct := resp.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+	} else {
+		headers.Copy(w.Header(), resp.Header)
+		w.Header().Del("Content-Length")
+	}
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(prefix))+resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.WriteString(w, prefix)
+
+	body := io.Reader(resp.Body)
+	if maxSize > 0 {
+		body = io.LimitReader(resp.Body, maxSize+1)
+	}
+	n, err := proxy.Copy(w, body)
+	if err != nil {
+		logger.Error("Failed to stream response body", slog.Any("error", err))
+		panic(http.ErrAbortHandler)
+	}
+	if maxSize > 0 && n > maxSize {
+		// The status line has already been sent, so abort the
+		// connection rather than return a truncated body as complete.
+		logger.Error("Response body too large", slog.Int64("max_size", maxSize))
+		panic(http.ErrAbortHandler)
+	}
+}
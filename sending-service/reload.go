@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sender/admin"
+	"sender/authclient"
+	"sender/config"
+	"sender/downstream"
+	"sender/loadshed"
+	"sender/metrics"
+	"sender/proxy"
+	"sender/ratelimit"
+)
+
+// reloadableSections are the sections of the configuration that a reload
+// applies as a whole, and reloadableSettings the single settings of other
+// sections it applies. Changing any other setting needs a restart.
+var (
+	reloadableSections = map[string]bool{
+		"services":          true,
+		"tenants":           true,
+		"path_routes":       true,
+		"max_response_size": true,
+		"response_headers":  true,
+		"rate_limit":        true,
+		"load_shedding":     true,
+	}
+	reloadableSettings = map[string]bool{
+		"admin.allowed_callers": true,
+		"admin.audience":        true,
+		"timeouts.attempt":      true,
+		"timeouts.request":      true,
+		"retry.max_attempts":    true,
+		"retry.initial_backoff": true,
+		"retry.max_backoff":     true,
+		"retry.retry_on":        true,
+	}
+)
+
+// routing is the part of the request path built from settings a reload
+// applies: the handlers of / and /call/, the rate limiter and gate in front
+// of them and of the other downstream calls, and who may call the admin
+// endpoints. A reload builds a new routing and swaps it in at once, so a
+// request sees either the old settings or the new ones.
+type routing struct {
+	root, calls http.Handler
+	gate        *loadshed.Gate
+	limiter     *ratelimit.Limiter
+	admin       config.Admin
+}
+
+// newRouting builds the routing described by cfg, for the services of
+// registry.
+func newRouting(logger *slog.Logger, cfg *config.Config, registry *downstream.Registry, m *metrics.Metrics) (*routing, error) {
+	var proxyOpts []proxy.Option
+	if cfg.Compression.ProxyDecompress {
+		proxyOpts = append(proxyOpts, proxy.WithDecompression())
+	}
+	responseHeaders := cfg.ResponseHeaders.Rules()
+	if !responseHeaders.IsZero() {
+		proxyOpts = append(proxyOpts, proxy.WithResponseHeaders(responseHeaders))
+	}
+	multipart := cfg.Uploads.MultipartSettings(m)
+	proxyOpts = append(proxyOpts, proxy.WithMultipart(multipart))
+	rt := &routing{admin: cfg.Admin}
+	var err error
+	var tenants *downstream.TenantRouter
+	if len(cfg.Tenants.Routes) > 0 {
+		tenants = downstream.NewTenantRouter(cfg.Tenants.Header, cfg.Tenants.Routes)
+	}
+	switch {
+	case cfg.ProxyMode && tenants != nil:
+		proxies := make(map[string]http.Handler)
+		for _, name := range tenants.Names() {
+			if proxies[name], err = newProxy(logger, registry, name, proxyOpts...); err != nil {
+				return nil, err
+			}
+		}
+		rt.root = tenantProxy(tenants, proxies)
+	case cfg.ProxyMode:
+		if rt.root, err = newProxy(logger, registry, cfg.DefaultService, proxyOpts...); err != nil {
+			return nil, err
+		}
+	case tenants != nil:
+		rt.root = tenantRelay(tenants, registry, cfg.MaxResponseSize, responseHeaders, multipart)
+	default:
+		rt.root = relay(registry, cfg.DefaultService, cfg.MaxResponseSize, responseHeaders, multipart)
+		rt.calls = call(registry, cfg.MaxResponseSize, responseHeaders, multipart)
+	}
+	if len(cfg.PathRoutes) > 0 {
+		router := downstream.NewPathRouter(cfg.PathRoutes)
+		proxies := make(map[string]http.Handler)
+		for _, name := range router.Names() {
+			if proxies[name], err = newProxy(logger, registry, name, proxyOpts...); err != nil {
+				return nil, err
+			}
+		}
+		for _, route := range cfg.PathRoutes {
+			logger.Info("Routing requests by path", slog.String("path", route.Path), slog.String("service", route.Service), slog.String("rewrite", route.Rewrite), slog.Any("policy", route.Policy))
+		}
+		rt.root = pathRoutes(router, proxies, rt.root)
+	}
+	// The gate is shared by the relay, call and enqueue handlers,
+	// and sits inside the rate limiter, so that requests over the rate are
+	// turned away before they take a slot.
+	if ls := cfg.LoadShedding; ls.MaxInFlight > 0 {
+		rt.gate = loadshed.New(ls.MaxInFlight, ls.MaxQueue, ls.MaxWait, loadshed.WithObserver(m))
+	}
+	if rl := cfg.RateLimit; rl.Enabled {
+		rt.limiter = ratelimit.New(rl.RequestsPerSecond, rl.Burst, rl.PerClient)
+	}
+	rt.root = rt.limit(rt.root)
+	if rt.calls != nil {
+		rt.calls = rt.limit(rt.calls)
+	}
+	return rt, nil
+}
+
+// limit wraps h in the routing's gate and rate limiter, if it has them.
+func (rt *routing) limit(h http.Handler) http.Handler {
+	if rt.gate != nil {
+		h = rt.gate.Middleware(h)
+	}
+	if rt.limiter != nil {
+		h = rt.limiter.Middleware(h)
+	}
+	return h
+}
+
+// reloader holds the current routing and, when the configuration file is
+// watched, applies its changes to the running server.
+type reloader struct {
+	logger     *slog.Logger
+	args       []string
+	registry   *downstream.Registry
+	clientOpts []authclient.Option
+	metrics    *metrics.Metrics
+
+	// mu serializes reloads.
+	mu      sync.Mutex
+	cfg     *config.Config
+	data    []byte
+	clients *authclient.Cache
+	routing atomic.Pointer[routing]
+}
+
+// newReloader returns a reloader serving the routing of cfg, the running
+// configuration. loaded is the same configuration as it was loaded, before
+// secrets were resolved and services discovered, which reloaded
+// configurations are compared with. clients is the cache registry's clients
+// come from, created with clientOpts.
+func newReloader(logger *slog.Logger, args []string, cfg, loaded *config.Config, registry *downstream.Registry, clients *authclient.Cache, clientOpts []authclient.Option, m *metrics.Metrics) (*reloader, error) {
+	rt, err := newRouting(logger, cfg, registry, m)
+	if err != nil {
+		return nil, err
+	}
+	rl := &reloader{
+		logger:     logger,
+		args:       args,
+		registry:   registry,
+		clientOpts: clientOpts,
+		metrics:    m,
+		cfg:        loaded,
+		data:       loaded.FileData(),
+		clients:    clients,
+	}
+	rl.routing.Store(rt)
+	return rl, nil
+}
+
+// root handles / with the current routing.
+func (rl *reloader) root() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.routing.Load().root.ServeHTTP(w, r)
+	})
+}
+
+// calls handles /call/ with the current routing, or with its / handler if
+// it has no /call/ handler, as when routing by tenant.
+func (rl *reloader) calls() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := rl.routing.Load()
+		if rt.calls == nil {
+			rt.root.ServeHTTP(w, r)
+			return
+		}
+		rt.calls.ServeHTTP(w, r)
+	})
+}
+
+// limited wraps h in the gate and rate limiter of the current routing.
+func (rl *reloader) limited(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.routing.Load().limit(h).ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin only lets the admin allowed callers of the current routing
+// call h.
+func (rl *reloader) requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := rl.routing.Load().admin
+		admin.Require(a.Audience, a.AllowedCallers, h).ServeHTTP(w, r)
+	})
+}
+
+// watch reads the configuration file every interval for the life of the
+// process and reloads it when its content changes. Failed reads are logged
+// and retried at the next interval.
+func (rl *reloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		data, err := config.ReadFile(rl.cfg.File)
+		if err != nil {
+			rl.logger.Warn("Failed to read the configuration file", slog.String("file", rl.cfg.File), slog.Any("error", err))
+			continue
+		}
+		rl.reload(data)
+	}
+}
+
+// reload applies the configuration file content data if it differs from the
+// content last seen. Every attempt is logged as "Configuration reload",
+// with its result, the changed settings and the checksums of the old and
+// new content, as the audit trail of configuration changes. A reload that
+// changes settings needing a restart, or that fails, is rejected as a
+// whole and the running configuration is kept.
+func (rl *reloader) reload(data []byte) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if bytes.Equal(data, rl.data) {
+		return
+	}
+	logger := rl.logger.With(
+		slog.String("file", rl.cfg.File),
+		slog.String("previous_sha256", checksum(rl.data)),
+		slog.String("sha256", checksum(data)),
+	)
+	rl.data = data
+
+	next, err := config.Reload(rl.args, data)
+	if err != nil {
+		logger.Error("Configuration reload", slog.String("result", "rejected"), slog.Any("error", err))
+		return
+	}
+	changes := config.Changes(rl.cfg, next)
+	if len(changes) == 0 {
+		logger.Info("Configuration reload", slog.String("result", "unchanged"))
+		return
+	}
+	if restart := rl.restartRequired(next, changes); len(restart) > 0 {
+		logger.Warn("Configuration reload",
+			slog.String("result", "rejected"),
+			slog.Any("changes", changes),
+			slog.Any("restart_required", restart),
+		)
+		return
+	}
+	if err := rl.apply(next, changes); err != nil {
+		logger.Error("Configuration reload", slog.String("result", "rejected"), slog.Any("changes", changes), slog.Any("error", err))
+		return
+	}
+	rl.cfg = next
+	logger.Info("Configuration reload", slog.String("result", "applied"), slog.Any("changes", changes))
+}
+
+// restartRequired returns the changed settings a reload cannot apply.
+func (rl *reloader) restartRequired(next *config.Config, changes []string) []string {
+	var restart []string
+	for _, c := range changes {
+		section, _, _ := strings.Cut(c, ".")
+		if !reloadableSections[section] && !reloadableSettings[c] {
+			restart = append(restart, c)
+		}
+	}
+	cur := rl.cfg
+	if slices.Contains(changes, "services") {
+		// Discovered URLs, dial addresses and IAP client IDs are set up
+		// once, when the server starts.
+		if downstream.NeedsDiscovery(cur.Services) || downstream.NeedsDiscovery(next.Services) {
+			restart = append(restart, "services.cloud_run_service")
+		}
+		if !maps.Equal(downstream.DialOverrides(cur.Services), downstream.DialOverrides(next.Services)) {
+			restart = append(restart, "services.dial_address")
+		}
+		if !maps.Equal(downstream.IAPClientIDs(cur.Services), downstream.IAPClientIDs(next.Services)) {
+			restart = append(restart, "services.iap_client_id")
+		}
+	}
+	// The admin endpoints are only served if they were enabled at startup.
+	if (len(cur.Admin.AllowedCallers) > 0) != (len(next.Admin.AllowedCallers) > 0) && !slices.Contains(restart, "admin.allowed_callers") {
+		restart = append(restart, "admin.allowed_callers")
+	}
+	return restart
+}
+
+// apply swaps in the services and routing of next, with new clients if
+// their timeouts or retries changed.
+func (rl *reloader) apply(next *config.Config, changes []string) error {
+	clients := rl.clients
+	if slices.ContainsFunc(changes, func(c string) bool {
+		return strings.HasPrefix(c, "timeouts.") || strings.HasPrefix(c, "retry.")
+	}) {
+		opts := append(slices.Clip(rl.clientOpts),
+			authclient.WithRetry(next.Retry.Policy()),
+			authclient.WithTimeoutPolicy(next.Timeouts.Policy()),
+		)
+		clients = authclient.NewCache(context.Background(), opts...)
+	}
+	services := next.Services
+	if !slices.Contains(changes, "services") {
+		// Keep the services as they are running, which may have been
+		// discovered.
+		services = rl.services()
+	}
+	previous := rl.services()
+	rl.registry.Replace(services, clients)
+	rt, err := newRouting(rl.logger, next, rl.registry, rl.metrics)
+	if err != nil {
+		rl.registry.Replace(previous, rl.clients)
+		return err
+	}
+	rl.routing.Store(rt)
+	if clients != rl.clients {
+		// Stop the background token refreshes of the clients no longer
+		// used.
+		rl.clients.Flush()
+		rl.clients = clients
+	}
+	return nil
+}
+
+// services returns the services registered now.
+func (rl *reloader) services() map[string]downstream.Service {
+	services := make(map[string]downstream.Service)
+	for _, name := range rl.registry.Names() {
+		services[name], _ = rl.registry.Service(name)
+	}
+	return services
+}
+
+// checksum returns the start of the SHA-256 of data, which identifies a
+// version of the configuration file in the logs.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
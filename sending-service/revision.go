@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"sender/apierror"
+	"sender/authclient"
+)
+
+// revisionTags sends the downstream calls of requests carrying header to
+// the Cloud Run revision tagged with its value, so that a caller can test
+// a revision that receives no traffic yet through the sending service. The
+// header is removed, so that proxy mode does not forward it.
+func revisionTags(header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tag := r.Header.Get(header)
+		if tag == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := authclient.ValidateRevisionTag(tag); err != nil {
+			apierror.Write(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "Invalid revision tag in "+header))
+			return
+		}
+		r = r.Clone(authclient.CallContext(r.Context(), authclient.RevisionTag(tag)))
+		r.Header.Del(header)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"sender/apierror"
+	"sender/downstream"
+	"sender/logging"
+)
+
+// pathRoutes returns a handler that forwards each request whose path is
+// routed to a downstream service with that service's proxy, from proxies,
+// after checking it against the route's policy and rewriting its path.
+// Requests no route matches are passed to fallback.
+func pathRoutes(router *downstream.PathRouter, proxies map[string]http.Handler, fallback http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, u, ok := router.Match(r.URL)
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		if !allowedByPolicy(w, r, route) {
+			return
+		}
+		routed := r.Clone(r.Context())
+		routed.URL = u
+		next := proxies[route.Service]
+		if n := route.Policy.MaxBodySize; n > 0 {
+			next = limitBody(next, n)
+		}
+		next.ServeHTTP(w, routed)
+	}
+}
+
+// allowedByPolicy reports whether the policy of route lets r through,
+// writing the error response if it does not.
+func allowedByPolicy(w http.ResponseWriter, r *http.Request, route downstream.Route) bool {
+	p := route.Policy
+	var apiErr *apierror.Error
+	switch {
+	case !p.AllowsMethod(r.Method):
+		w.Header().Set("Allow", strings.ToUpper(strings.Join(p.Methods, ", ")))
+		apiErr = apierror.New(http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method is not allowed on this route")
+	case !p.AllowsPath(r.URL.Path):
+		apiErr = apierror.New(http.StatusForbidden, apierror.CodePermissionDenied, "Path is not allowed on this route")
+	default:
+		if name := p.MissingHeader(r.Header); name != "" {
+			apiErr = apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "Missing required header "+http.CanonicalHeaderKey(name))
+		}
+	}
+	if apiErr == nil {
+		return true
+	}
+	logging.FromContext(r.Context()).Warn("Rejected request by route policy",
+		slog.String("route", route.Path),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("reason", apiErr.Message),
+	)
+	apierror.Write(w, r, apiErr)
+	return false
+}
@@ -0,0 +1,64 @@
+// Package secrets resolves configuration values stored in Secret Manager.
+// A value of the form sm://projects/{project}/secrets/{secret}/versions/{version}
+// is replaced by the payload of that secret version; other values are used
+// as they are.
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// Scheme prefixes references to Secret Manager secret versions.
+const Scheme = "sm://"
+
+// IsRef reports whether v refers to a Secret Manager secret version.
+func IsRef(v string) bool {
+	return strings.HasPrefix(v, Scheme)
+}
+
+// Client reads secret versions from Secret Manager. The caller needs
+// roles/secretmanager.secretAccessor on each secret.
+type Client struct {
+	versions *secretmanager.ProjectsSecretsVersionsService
+}
+
+// NewClient creates a Client using Application Default Credentials, or the
+// credentials given in opts.
+func NewClient(ctx context.Context, opts ...option.ClientOption) (*Client, error) {
+	svc, err := secretmanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: failed to create Secret Manager client: %w", err)
+	}
+	return &Client{versions: svc.Projects.Secrets.Versions}, nil
+}
+
+// Resolve returns the payload of the secret version v refers to, or v itself
+// if it is not a reference.
+func (c *Client) Resolve(ctx context.Context, v string) (string, error) {
+	if !IsRef(v) {
+		return v, nil
+	}
+	name := strings.TrimPrefix(v, Scheme)
+	if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/secrets/") {
+		return "", fmt.Errorf("secrets: %q is not of the form %sprojects/{project}/secrets/{secret}/versions/{version}", v, Scheme)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	resp, err := c.versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("secrets: failed to access %s: %w", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("secrets: failed to decode %s: %w", name, err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"sender/apierror"
+	"sender/config"
+)
+
+// newServer returns a server for handler on addr with the timeouts and
+// header limit of s.
+func newServer(addr string, handler http.Handler, s config.Server) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+		MaxHeaderBytes:    s.MaxHeaderBytes,
+	}
+}
+
+// limitBody rejects requests declaring a body larger than n bytes with 413
+// Request Entity Too Large, and fails reads past n bytes of bodies of
+// unknown length with an *http.MaxBytesError, which handlers relaying the
+// body answer with 413 too.
+func limitBody(next http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			apierror.Write(w, r, apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Request body is too large"))
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs srv until it fails or the process receives SIGTERM or SIGINT.
+// On a signal it stops accepting connections and waits up to drainTimeout
+// for in-flight requests; requests still running after that have their
+// contexts cancelled, which aborts their downstream calls.
+func serve(logger *slog.Logger, srv *http.Server, drainTimeout time.Duration) error {
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		logger.Info("Listening", slog.String("addr", srv.Addr))
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-sigCtx.Done():
+	}
+
+	logger.Info("Shutting down", slog.Duration("drain_timeout", drainTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("Drain timeout exceeded, cancelling in-flight requests", slog.Any("error", err))
+		cancelRequests()
+		srv.Close()
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	logger.Info("Shutdown complete")
+	return nil
+}
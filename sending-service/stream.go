@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"sender/authclient"
+	"sender/proxy"
+)
+
+// streamResponse copies resp to w as it arrives, flushing after every
+// chunk so server-sent events reach the caller as soon as they are sent.
+// Unlike relayed responses, the body is passed through unchanged and
+// without a size limit. Only Content-Type and Cache-Control are returned,
+// unless headers has rules or passThrough is set.
+func streamResponse(w http.ResponseWriter, resp *http.Response, headers proxy.HeaderRules, passThrough bool, logger *slog.Logger) {
+	if headers.IsZero() && !passThrough {
+		for _, name := range []string{"Content-Type", "Cache-Control"} {
+			if v := resp.Header.Get(name); v != "" {
+				w.Header().Set(name, v)
+			}
+		}
+	} else {
+		headers.Copy(w.Header(), resp.Header)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	rc := http.NewResponseController(w)
+	flush := func() bool {
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logger.Error("Failed to flush streamed response", slog.Any("error", err))
+			return false
+		}
+		return true
+	}
+	if !flush() {
+		return
+	}
+
+	buf := proxy.Buffers.Get()
+	defer proxy.Buffers.Put(buf)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil || !flush() {
+				// The caller has gone away.
+				return
+			}
+		}
+		if err == io.EOF || errors.Is(err, context.Canceled) {
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to stream response body", slog.Any("error", err))
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// streaming marks every request passed to next as streaming, so the
+// authenticated client doesn't cut off long-lived responses.
+func streaming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(authclient.Streaming(r.Context())))
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"sender/apierror"
+	"sender/downstream"
+	"sender/logging"
+	"sender/proxy"
+)
+
+// tenantRelay returns a handler that relays each request to the downstream
+// service its tenant is routed to. Requests from unknown tenants are
+// rejected, and the service cannot be chosen by the caller with
+// X-Target-Audience, so one tenant cannot reach another's backend.
+func tenantRelay(tenants *downstream.TenantRouter, registry *downstream.Registry, maxSize int64, headers proxy.HeaderRules, multipart proxy.MultipartSettings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := routeTenant(w, r, tenants)
+		if !ok {
+			return
+		}
+		relayTo(w, r, registry, name, maxSize, headers, multipart)
+	}
+}
+
+// tenantProxy returns a handler that forwards each request with the
+// proxy, from proxies, of the downstream service its tenant is routed to.
+func tenantProxy(tenants *downstream.TenantRouter, proxies map[string]http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := routeTenant(w, r, tenants)
+		if !ok {
+			return
+		}
+		proxies[name].ServeHTTP(w, r)
+	}
+}
+
+// routeTenant returns the name of the service r's tenant is routed to. If
+// the tenant is unknown, it answers with 404 Not Found and reports false.
+func routeTenant(w http.ResponseWriter, r *http.Request, tenants *downstream.TenantRouter) (string, bool) {
+	tenant, name, ok := tenants.Route(r)
+	if !ok {
+		logging.FromContext(r.Context()).Warn("Rejected request for unknown tenant", slog.String("tenant", tenant))
+		apierror.Write(w, r, apierror.New(http.StatusNotFound, apierror.CodeUnknownTenant, "Unknown tenant"))
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"sender/authclient"
+	"sender/logging"
+)
+
+// serverTiming times the downstream calls of each request, reports the
+// phases in a Server-Timing response header, followed by the Server-Timing
+// values of the downstream responses, and logs them with the request.
+func serverTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, timing := authclient.TimingContext(r.Context())
+		tw := &timingWriter{ResponseWriter: w, timing: timing}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+
+		if p := timing.Phases(); p.Calls > 0 {
+			logging.FromContext(ctx).InfoContext(ctx, "Downstream timing", slog.Any("timing", p))
+		}
+	})
+}
+
+// timingWriter sets the Server-Timing header of a response when its
+// headers are written, by which time the downstream response it relays has
+// arrived.
+type timingWriter struct {
+	http.ResponseWriter
+	timing      *authclient.Timing
+	wroteHeader bool
+}
+
+func (w *timingWriter) setHeader() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.ResponseWriter.Header()
+	// Downstream values copied by the handler are passed on below.
+	h.Del(authclient.ServerTimingHeader)
+	if v := w.timing.Phases().Header(); v != "" {
+		h.Set(authclient.ServerTimingHeader, v)
+	}
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	w.setHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingWriter) Flush() {
+	w.setHeader()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket connections be proxied through the middleware.
+func (w *timingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.wroteHeader = true
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *timingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
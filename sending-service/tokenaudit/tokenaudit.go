@@ -0,0 +1,111 @@
+// Package tokenaudit samples the ID tokens the sending service mints and
+// logs their claims for security review: the issuer, the audience, how
+// long the token lives and the service account it identifies, so that
+// configuration drift, such as tokens minted for the wrong audience or by
+// an unexpected identity, shows up in the logs. The tokens themselves are
+// never logged.
+package tokenaudit
+
+import (
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+
+	"sender/authclient"
+)
+
+var (
+	_ authclient.TokenObserver       = (*Sampler)(nil)
+	_ authclient.TokenClaimsObserver = (*Sampler)(nil)
+)
+
+// googleIssuer is the issuer of ID tokens minted by Google.
+const googleIssuer = "https://accounts.google.com"
+
+// maxLifetime is the lifetime of Google-signed ID tokens.
+const maxLifetime = time.Hour
+
+// Sampler logs the claims of a fraction of the tokens it is told about. It
+// implements authclient.TokenObserver and authclient.TokenClaimsObserver.
+type Sampler struct {
+	logger *slog.Logger
+	rate   float64
+	email  string
+	now    func() time.Time
+	sample func() float64
+}
+
+// Option configures a Sampler.
+type Option func(*Sampler)
+
+// WithExpectedEmail also flags tokens that do not identify the service
+// account email.
+func WithExpectedEmail(email string) Option {
+	return func(s *Sampler) {
+		s.email = email
+	}
+}
+
+// New creates a Sampler that logs the claims of rate, between 0 and 1, of
+// the tokens minted, with logger.
+func New(logger *slog.Logger, rate float64, opts ...Option) *Sampler {
+	s := &Sampler{logger: logger, rate: rate, now: time.Now, sample: rand.Float64}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// TokenMinted implements authclient.TokenObserver.
+func (s *Sampler) TokenMinted(audience string, expiry time.Time) {}
+
+// TokenRefreshed implements authclient.TokenObserver.
+func (s *Sampler) TokenRefreshed(audience string) {}
+
+// TokenError implements authclient.TokenObserver.
+func (s *Sampler) TokenError(audience string, err error) {}
+
+// TokenClaims implements authclient.TokenClaimsObserver, logging the
+// claims of a sampled token with a warning if they do not match how the
+// token was requested.
+func (s *Sampler) TokenClaims(audience string, claims authclient.TokenClaims) {
+	if s.rate <= 0 || s.sample() >= s.rate {
+		return
+	}
+	attrs := []any{
+		slog.String("audience", audience),
+		slog.String("issuer", claims.Issuer),
+		slog.String("token_audience", claims.Audience),
+		slog.String("email", claims.Email),
+		slog.Duration("lifetime", claims.Expiry.Sub(claims.IssuedAt)),
+		slog.Duration("expires_in", claims.Expiry.Sub(s.now()).Round(time.Second)),
+	}
+	if problems := s.check(audience, claims); len(problems) > 0 {
+		s.logger.Warn("Sampled ID token does not match its configuration", append(attrs, slog.String("problems", strings.Join(problems, "; ")))...)
+		return
+	}
+	s.logger.Info("Sampled ID token", attrs...)
+}
+
+// check returns the ways claims differ from those of a token minted by
+// Google for audience.
+func (s *Sampler) check(audience string, claims authclient.TokenClaims) []string {
+	var problems []string
+	if claims.Audience != audience {
+		problems = append(problems, "audience is not the requested audience")
+	}
+	if claims.Issuer != googleIssuer {
+		problems = append(problems, "issuer is not "+googleIssuer)
+	}
+	if s.email != "" && !strings.EqualFold(claims.Email, s.email) {
+		problems = append(problems, "email is not "+s.email)
+	}
+	if lifetime := claims.Expiry.Sub(claims.IssuedAt); lifetime <= 0 || lifetime > maxLifetime {
+		problems = append(problems, "lifetime is not between 0 and 1h")
+	}
+	if !claims.Expiry.After(s.now()) {
+		problems = append(problems, "token has already expired")
+	}
+	return problems
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const cloudTraceHeader = "X-Cloud-Trace-Context"
+
+// CloudTraceContext propagates trace context in the
+// X-Cloud-Trace-Context header used by Google Cloud load balancers and
+// Cloud Run: TRACE_ID/SPAN_ID;o=OPTIONS, with a hexadecimal trace ID and a
+// decimal span ID.
+type CloudTraceContext struct{}
+
+var _ propagation.TextMapPropagator = CloudTraceContext{}
+
+// Inject writes the span context in ctx to carrier.
+func (CloudTraceContext) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	spanID := sc.SpanID()
+	sampled := 0
+	if sc.IsSampled() {
+		sampled = 1
+	}
+	carrier.Set(cloudTraceHeader, fmt.Sprintf("%s/%d;o=%d",
+		sc.TraceID().String(), binary.BigEndian.Uint64(spanID[:]), sampled))
+}
+
+// Extract returns a copy of ctx carrying the remote span context found in
+// carrier, if any.
+func (CloudTraceContext) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	sc, ok := parseCloudTrace(carrier.Get(cloudTraceHeader))
+	if !ok {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Fields returns the header names the propagator uses.
+func (CloudTraceContext) Fields() []string {
+	return []string{cloudTraceHeader}
+}
+
+func parseCloudTrace(header string) (trace.SpanContext, bool) {
+	traceHex, rest, ok := strings.Cut(header, "/")
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+	spanDec, options, _ := strings.Cut(rest, ";")
+
+	rawTrace, err := hex.DecodeString(traceHex)
+	if err != nil || len(rawTrace) != 16 {
+		return trace.SpanContext{}, false
+	}
+	spanNum, err := strconv.ParseUint(spanDec, 10, 64)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	copy(traceID[:], rawTrace)
+	binary.BigEndian.PutUint64(spanID[:], spanNum)
+
+	var flags trace.TraceFlags
+	if options == "o=1" {
+		flags = trace.FlagsSampled
+	}
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: flags,
+		Remote:     true,
+	})
+	return sc, sc.IsValid()
+}
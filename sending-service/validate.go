@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"sender/health"
+)
+
+// validateTimeout bounds a validation run.
+const validateTimeout = 30 * time.Second
+
+// validate checks that a token can be minted for every downstream service
+// and that the service accepts it, logging failures as errors and
+// successes at level. It returns an error naming the services that failed.
+func validate(ctx context.Context, logger *slog.Logger, checker *health.Checker, level slog.Level) error {
+	return report(ctx, logger, checker.Validate(ctx), level)
+}
+
+// report logs the result of a validation, failures as errors and
+// successes at level, and returns an error naming the services that
+// failed.
+func report(ctx context.Context, logger *slog.Logger, result health.Result, level slog.Level) error {
+	names := make([]string, 0, len(result.Services))
+	for name := range result.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failed []string
+	for _, name := range names {
+		sr := result.Services[name]
+		if sr.Ready {
+			logger.Log(ctx, level, "Downstream service validated", slog.String("service", name))
+			continue
+		}
+		failed = append(failed, name)
+		logger.Error("Downstream service failed validation",
+			slog.String("service", name),
+			slog.String("failure", string(sr.Failure)),
+			slog.String("error", sr.Error),
+		)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("validation failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// validateLoop runs validate every interval for the life of the process,
+// so that a revoked roles/run.invoker binding or broken credentials show
+// up in the logs before the next request fails.
+func validateLoop(logger *slog.Logger, checker *health.Checker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+		if err := validate(ctx, logger, checker, slog.LevelDebug); err != nil {
+			logger.Warn(err.Error())
+		}
+		cancel()
+	}
+}
+
+// checkInvoker asks the Cloud Run Admin API once, at startup, whether the
+// calling identity may invoke every downstream service, logging those it
+// may not with the command that grants roles/run.invoker.
+func checkInvoker(logger *slog.Logger, checker *health.Checker) {
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+	if err := report(ctx, logger, checker.CheckInvoker(ctx), slog.LevelDebug); err != nil {
+		logger.Warn(err.Error())
+	}
+}
@@ -0,0 +1,377 @@
+// Package vcr records downstream calls to fixture files and replays them,
+// so that code calling receiving services can be tested without them: run
+// the tests once against live services to record their answers, and from
+// then on the recorded responses are served in their place. Credentials
+// are scrubbed before anything is written, so fixtures can be committed.
+package vcr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Mode says whether a Recorder records or replays.
+type Mode int
+
+const (
+	// ModeAuto replays the fixture if it exists and records it otherwise.
+	ModeAuto Mode = iota
+	// ModeRecord sends every call and records it, replacing the fixture.
+	ModeRecord
+	// ModeReplay answers every call from the fixture, and fails those it
+	// has no recording for, without sending anything.
+	ModeReplay
+)
+
+// ParseMode parses auto, record or replay, such as the value of a VCR_MODE
+// environment variable. An empty string is ModeAuto.
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return ModeAuto, nil
+	case "record":
+		return ModeRecord, nil
+	case "replay":
+		return ModeReplay, nil
+	}
+	return 0, fmt.Errorf("vcr: unknown mode %q, want auto, record or replay", s)
+}
+
+// Redacted replaces the values of scrubbed headers and query parameters.
+const Redacted = "REDACTED"
+
+// sensitiveHeaders are always scrubbed. They carry ID tokens, request
+// signatures and session credentials.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"X-Serverless-Authorization",
+	"X-Forwarded-Authorization",
+	"X-Signature",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// ErrNoInteraction is matched by errors.Is for calls replayed without a
+// recorded interaction left that matches them.
+var ErrNoInteraction = errors.New("vcr: no recorded interaction matches the request")
+
+// Cassette is the content of a fixture file.
+type Cassette struct {
+	Interactions []*Interaction `yaml:"interactions"`
+}
+
+// Interaction is a recorded call.
+type Interaction struct {
+	Request  Request  `yaml:"request"`
+	Response Response `yaml:"response"`
+}
+
+// Request is a recorded request.
+type Request struct {
+	Method string      `yaml:"method"`
+	URL    string      `yaml:"url"`
+	Header http.Header `yaml:"header,omitempty"`
+	Body   Body        `yaml:"body,omitempty"`
+}
+
+// Response is a recorded response.
+type Response struct {
+	Status int         `yaml:"status"`
+	Header http.Header `yaml:"header,omitempty"`
+	Body   Body        `yaml:"body,omitempty"`
+}
+
+// Body is a recorded body. It is written to fixtures as text if it is
+// valid UTF-8, and base64-encoded otherwise.
+type Body []byte
+
+// MarshalYAML implements yaml.Marshaler.
+func (b Body) MarshalYAML() (interface{}, error) {
+	if utf8.Valid(b) {
+		return string(b), nil
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!binary", Value: base64.StdEncoding.EncodeToString(b)}, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *Body) UnmarshalYAML(n *yaml.Node) error {
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	*b = Body(s)
+	return nil
+}
+
+// Matcher reports whether a recorded request answers req, whose body is
+// given separately.
+type Matcher func(req *http.Request, body []byte, recorded Request) bool
+
+// DefaultMatcher matches requests by method, URL and body.
+func DefaultMatcher(req *http.Request, body []byte, recorded Request) bool {
+	return req.Method == recorded.Method && req.URL.String() == recorded.URL && bytes.Equal(body, recorded.Body)
+}
+
+// Option configures a Recorder.
+type Option func(*Recorder)
+
+// WithRedactHeaders scrubs these headers, in addition to Authorization and
+// the other headers that always carry credentials, such as API keys sent
+// with extra headers.
+func WithRedactHeaders(names ...string) Option {
+	return func(r *Recorder) {
+		for _, name := range names {
+			r.headers[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
+
+// WithRedactQuery scrubs these query parameters from recorded URLs. The
+// requests replayed are matched with the same parameters scrubbed.
+func WithRedactQuery(names ...string) Option {
+	return func(r *Recorder) {
+		r.query = append(r.query, names...)
+	}
+}
+
+// WithScrubber calls f with each interaction before it is written, to
+// remove other secrets or values that change from run to run, such as
+// timestamps in bodies.
+func WithScrubber(f func(*Interaction)) Option {
+	return func(r *Recorder) {
+		r.scrubbers = append(r.scrubbers, f)
+	}
+}
+
+// WithMatcher sets how replayed requests are matched to recorded ones. It
+// defaults to DefaultMatcher.
+func WithMatcher(m Matcher) Option {
+	return func(r *Recorder) {
+		r.matcher = m
+	}
+}
+
+// Recorder records calls to a fixture file or replays them from it.
+type Recorder struct {
+	path      string
+	mode      Mode
+	headers   map[string]bool
+	query     []string
+	scrubbers []func(*Interaction)
+	matcher   Matcher
+
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+}
+
+// New returns a Recorder for the fixture at path, such as
+// testdata/orders.yaml. In ModeReplay, and in ModeAuto if the file
+// exists, the fixture is loaded; otherwise it is written, with the new
+// interaction, after each call.
+func New(path string, mode Mode, opts ...Option) (*Recorder, error) {
+	r := &Recorder{path: path, mode: mode, headers: make(map[string]bool), matcher: DefaultMatcher}
+	for _, name := range sensitiveHeaders {
+		r.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.mode == ModeAuto {
+		r.mode = ModeRecord
+		if _, err := os.Stat(path); err == nil {
+			r.mode = ModeReplay
+		}
+	}
+	if r.mode == ModeReplay {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("vcr: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &r.cassette); err != nil {
+			return nil, fmt.Errorf("vcr: invalid fixture %s: %w", path, err)
+		}
+		r.used = make([]bool, len(r.cassette.Interactions))
+	}
+	return r, nil
+}
+
+// Mode returns whether r records or replays.
+func (r *Recorder) Mode() Mode {
+	return r.mode
+}
+
+// Middleware returns a transport that records the calls sent with next, or
+// answers them from the fixture without calling next. Use it with
+// authclient.WithAttemptMiddleware so that what is recorded is what was
+// sent, with the ID token scrubbed, or as the Transport of an
+// http.Client.
+func (r *Recorder) Middleware(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next, recorder: r}
+}
+
+// Unused returns the recorded interactions that have not been replayed,
+// which a test may want to fail on.
+func (r *Recorder) Unused() []*Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []*Interaction
+	for i, in := range r.cassette.Interactions {
+		if r.mode == ModeReplay && !r.used[i] {
+			unused = append(unused, in)
+		}
+	}
+	return unused
+}
+
+type transport struct {
+	next     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.recorder.mode == ModeReplay {
+		return t.recorder.replay(req, body)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	if err := t.recorder.record(req, body, resp, respBody); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readBody reads the body of req and replaces it with a copy.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// record adds the call to the cassette and writes it.
+func (r *Recorder) record(req *http.Request, body []byte, resp *http.Response, respBody []byte) error {
+	in := &Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    r.scrubURL(req.URL),
+			Header: r.scrubHeader(req.Header),
+			Body:   body,
+		},
+		Response: Response{
+			Status: resp.StatusCode,
+			Header: r.scrubHeader(resp.Header),
+			Body:   respBody,
+		},
+	}
+	for _, f := range r.scrubbers {
+		f(in)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, in)
+	data, err := yaml.Marshal(&r.cassette)
+	if err != nil {
+		return fmt.Errorf("vcr: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("vcr: %w", err)
+	}
+	if err := os.WriteFile(r.path, data, 0o644); err != nil {
+		return fmt.Errorf("vcr: %w", err)
+	}
+	return nil
+}
+
+// replay answers req with the first unused interaction that matches it.
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	scrubbed := req.Clone(req.Context())
+	if u, err := url.Parse(r.scrubURL(req.URL)); err == nil {
+		scrubbed.URL = u
+	}
+	r.mu.Lock()
+	var match *Interaction
+	for i, in := range r.cassette.Interactions {
+		if !r.used[i] && r.matcher(scrubbed, body, in.Request) {
+			r.used[i] = true
+			match = in
+			break
+		}
+	}
+	r.mu.Unlock()
+	if match == nil {
+		return nil, fmt.Errorf("%w: %s %s in %s", ErrNoInteraction, req.Method, scrubbed.URL, r.path)
+	}
+	header := match.Response.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(match.Response.Status) + " " + http.StatusText(match.Response.Status),
+		StatusCode:    match.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(match.Response.Body)),
+		ContentLength: int64(len(match.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+func (r *Recorder) scrubHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for name := range out {
+		if r.headers[http.CanonicalHeaderKey(name)] {
+			out[name] = []string{Redacted}
+		}
+	}
+	return out
+}
+
+func (r *Recorder) scrubURL(u *url.URL) string {
+	if len(r.query) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+	q := u.Query()
+	for _, name := range r.query {
+		if q.Has(name) {
+			q.Set(name, Redacted)
+		}
+	}
+	scrubbed := *u
+	scrubbed.RawQuery = q.Encode()
+	return scrubbed.String()
+}
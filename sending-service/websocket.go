@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"sender/apierror"
+	"sender/authclient"
+	"sender/downstream"
+	"sender/proxy"
+)
+
+// isWebSocket reports whether r is a WebSocket handshake.
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// relayWebSocket proxies a WebSocket handshake to the root of svc with an
+// ID token attached and, once the receiving service accepts it, relays
+// frames in both directions until either side closes the connection.
+func relayWebSocket(w http.ResponseWriter, r *http.Request, svc downstream.Service, client *authclient.Client, logger *slog.Logger) {
+	target, err := url.Parse(svc.URL)
+	if err != nil {
+		logger.Error("Invalid downstream service URL", slog.Any("error", err))
+		apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Failed to create request"))
+		return
+	}
+	logger.Info("Relaying WebSocket connection")
+
+	out := r.Clone(r.Context())
+	out.URL.Path, out.URL.RawPath = "", ""
+	proxy.New(target, client).ServeHTTP(w, out)
+}